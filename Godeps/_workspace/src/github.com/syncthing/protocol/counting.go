@@ -15,8 +15,9 @@ type countingReader struct {
 }
 
 var (
-	totalIncoming int64
-	totalOutgoing int64
+	totalIncoming       int64
+	totalOutgoing       int64
+	totalChecksumErrors int64
 )
 
 func (c *countingReader) Read(bs []byte) (int, error) {
@@ -60,3 +61,9 @@ func (c *countingWriter) Last() time.Time {
 func TotalInOut() (int64, int64) {
 	return atomic.LoadInt64(&totalIncoming), atomic.LoadInt64(&totalOutgoing)
 }
+
+// TotalChecksumErrors returns the number of received messages that didn't
+// match their checksum, over all connections.
+func TotalChecksumErrors() int64 {
+	return atomic.LoadInt64(&totalChecksumErrors)
+}
@@ -5,11 +5,44 @@ package protocol
 import (
 	"os"
 	"strings"
+	"sync/atomic"
 
 	"github.com/calmh/logger"
 )
 
 var (
-	debug = strings.Contains(os.Getenv("STTRACE"), "protocol") || os.Getenv("STTRACE") == "all"
+	debug = newDebugFlag(strings.Contains(os.Getenv("STTRACE"), "protocol") || os.Getenv("STTRACE") == "all")
 	l     = logger.DefaultLogger
 )
+
+// A DebugFlag tells whether the debug output of the package is enabled. It
+// may be toggled while connections are in use.
+type DebugFlag struct {
+	enabled int32 // accessed atomically
+}
+
+func newDebugFlag(enabled bool) *DebugFlag {
+	f := &DebugFlag{}
+	f.Set(enabled)
+	return f
+}
+
+// Debug returns the debug flag of the package, initially set from the
+// STTRACE environment variable.
+func Debug() *DebugFlag {
+	return debug
+}
+
+// On returns true if debug output is enabled.
+func (f *DebugFlag) On() bool {
+	return atomic.LoadInt32(&f.enabled) != 0
+}
+
+// Set enables or disables debug output.
+func (f *DebugFlag) Set(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&f.enabled, v)
+}
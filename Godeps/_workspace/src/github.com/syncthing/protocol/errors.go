@@ -20,6 +20,10 @@ var (
 	ErrInvalid          = errors.New("file is invalid")
 )
 
+// ErrChecksum is the error a connection is closed with when a received
+// message doesn't match its checksum.
+var ErrChecksum = errors.New("message checksum mismatch")
+
 var lookupError = map[int32]error{
 	ecNoError:    ErrNoError,
 	ecGeneric:    ErrGeneric,
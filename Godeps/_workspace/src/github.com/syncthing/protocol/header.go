@@ -9,6 +9,7 @@ type header struct {
 	msgID       int
 	msgType     int
 	compression bool
+	checksum    bool // the message is followed by a CRC-32C of its uncompressed contents
 }
 
 func (h header) encodeXDR(xw *xdr.Writer) (int, error) {
@@ -23,13 +24,17 @@ func (h *header) decodeXDR(xr *xdr.Reader) error {
 }
 
 func encodeHeader(h header) uint32 {
-	var isComp uint32
+	var isComp, isSum uint32
 	if h.compression {
 		isComp = 1 << 0 // the zeroth bit is the compression bit
 	}
+	if h.checksum {
+		isSum = 1 << 1 // the first bit is the checksum bit
+	}
 	return uint32(h.version&0xf)<<28 +
 		uint32(h.msgID&0xfff)<<16 +
 		uint32(h.msgType&0xff)<<8 +
+		isSum +
 		isComp
 }
 
@@ -39,5 +44,6 @@ func decodeHeader(u uint32) header {
 		msgID:       int(u>>16) & 0xfff,
 		msgType:     int(u>>8) & 0xff,
 		compression: u&1 == 1,
+		checksum:    u&2 == 2,
 	}
 }
@@ -7,8 +7,10 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	lz4 "github.com/bkaradzic/go-lz4"
@@ -97,6 +99,11 @@ type Connection interface {
 	Request(folder string, name string, offset int64, size int, hash []byte, flags uint32, options []Option) ([]byte, error)
 	ClusterConfig(config ClusterConfigMessage)
 	Statistics() Statistics
+
+	// EnableChecksums makes outgoing messages carry a checksum of their
+	// contents. Received checksums are always verified, so this should only
+	// be called once the peer has announced that it understands them.
+	EnableChecksums()
 }
 
 type rawConnection struct {
@@ -120,8 +127,14 @@ type rawConnection struct {
 
 	compression Compression
 
+	pingIdleTime time.Duration
+	pingTimeout  time.Duration
+
 	rdbuf0 []byte // used & reused by readMessage
 	rdbuf1 []byte // used & reused by readMessage
+
+	checksums      int32 // 1 when sending checksums; accessed atomically
+	checksumErrors int64 // accessed atomically
 }
 
 type asyncResult struct {
@@ -130,8 +143,9 @@ type asyncResult struct {
 }
 
 type hdrMsg struct {
-	hdr header
-	msg encodable
+	hdr  header
+	msg  encodable
+	done chan struct{} // closed once written, if not nil
 }
 
 type encodable interface {
@@ -142,12 +156,21 @@ type isEofer interface {
 	IsEOF() bool
 }
 
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
 const (
-	pingTimeout  = 30 * time.Second
-	pingIdleTime = 60 * time.Second
+	DefaultPingTimeout  = 30 * time.Second
+	DefaultPingIdleTime = 60 * time.Second
 )
 
 func NewConnection(deviceID DeviceID, reader io.Reader, writer io.Writer, receiver Model, name string, compress Compression) Connection {
+	return NewConnectionWithPing(deviceID, reader, writer, receiver, name, compress, DefaultPingIdleTime, DefaultPingTimeout)
+}
+
+// NewConnectionWithPing is like NewConnection, but pings the peer when the
+// connection has been idle for pingIdleTime, and closes the connection if no
+// response arrives within pingTimeout.
+func NewConnectionWithPing(deviceID DeviceID, reader io.Reader, writer io.Writer, receiver Model, name string, compress Compression, pingIdleTime, pingTimeout time.Duration) Connection {
 	cr := &countingReader{Reader: reader}
 	cw := &countingWriter{Writer: writer}
 
@@ -162,6 +185,9 @@ func NewConnection(deviceID DeviceID, reader io.Reader, writer io.Writer, receiv
 		nextID:      make(chan int),
 		closed:      make(chan struct{}),
 		compression: compress,
+
+		pingIdleTime: pingIdleTime,
+		pingTimeout:  pingTimeout,
 	}
 
 	go c.readerLoop()
@@ -180,40 +206,50 @@ func (c *rawConnection) Name() string {
 	return c.name
 }
 
-// Index writes the list of file information to the connected peer device
+// Index writes the list of file information to the connected peer device.
+// It returns once the message has been written, so the caller may reuse the
+// list, and a caller sending batch after batch holds no more than one in
+// memory.
 func (c *rawConnection) Index(folder string, idx []FileInfo, flags uint32, options []Option) error {
-	select {
-	case <-c.closed:
-		return ErrClosed
-	default:
-	}
-	c.idxMut.Lock()
-	c.send(-1, messageTypeIndex, IndexMessage{
+	return c.sendIndex(messageTypeIndex, IndexMessage{
 		Folder:  folder,
 		Files:   idx,
 		Flags:   flags,
 		Options: options,
 	})
-	c.idxMut.Unlock()
-	return nil
 }
 
-// IndexUpdate writes the list of file information to the connected peer device as an update
+// IndexUpdate writes the list of file information to the connected peer
+// device as an update. It returns once the message has been written, like
+// Index.
 func (c *rawConnection) IndexUpdate(folder string, idx []FileInfo, flags uint32, options []Option) error {
+	return c.sendIndex(messageTypeIndexUpdate, IndexMessage{
+		Folder:  folder,
+		Files:   idx,
+		Flags:   flags,
+		Options: options,
+	})
+}
+
+func (c *rawConnection) sendIndex(msgType int, msg IndexMessage) error {
 	select {
 	case <-c.closed:
 		return ErrClosed
 	default:
 	}
+	done := make(chan struct{})
 	c.idxMut.Lock()
-	c.send(-1, messageTypeIndexUpdate, IndexMessage{
-		Folder:  folder,
-		Files:   idx,
-		Flags:   flags,
-		Options: options,
-	})
+	ok := c.sendDone(-1, msgType, msg, done)
 	c.idxMut.Unlock()
-	return nil
+	if !ok {
+		return ErrClosed
+	}
+	select {
+	case <-done:
+		return nil
+	case <-c.closed:
+		return ErrClosed
+	}
 }
 
 // Request returns the bytes for the specified block after fetching them from the connected peer.
@@ -253,6 +289,11 @@ func (c *rawConnection) Request(folder string, name string, offset int64, size i
 	return res.val, res.err
 }
 
+// EnableChecksums makes outgoing messages carry a checksum of their contents
+func (c *rawConnection) EnableChecksums() {
+	atomic.StoreInt32(&c.checksums, 1)
+}
+
 // ClusterConfig send the cluster configuration message to the peer and returns any error
 func (c *rawConnection) ClusterConfig(config ClusterConfigMessage) {
 	c.send(-1, messageTypeClusterConfig, config)
@@ -363,7 +404,7 @@ func (c *rawConnection) readMessage() (hdr header, msg encodable, err error) {
 	hdr = decodeHeader(binary.BigEndian.Uint32(c.rdbuf0[0:4]))
 	msglen := int(binary.BigEndian.Uint32(c.rdbuf0[4:8]))
 
-	if debug {
+	if debug.On() {
 		l.Debugf("read header %v (msglen=%d)", hdr, msglen)
 	}
 
@@ -382,7 +423,17 @@ func (c *rawConnection) readMessage() (hdr header, msg encodable, err error) {
 		return
 	}
 
-	if debug {
+	var sum uint32
+	if hdr.checksum {
+		if msglen < 4 {
+			err = fmt.Errorf("protocol error: %s: message too short for checksum", c.id)
+			return
+		}
+		sum = binary.BigEndian.Uint32(c.rdbuf0[msglen-4:])
+		c.rdbuf0 = c.rdbuf0[:msglen-4]
+	}
+
+	if debug.On() {
 		l.Debugf("read %d bytes", len(c.rdbuf0))
 	}
 
@@ -394,12 +445,19 @@ func (c *rawConnection) readMessage() (hdr header, msg encodable, err error) {
 			return
 		}
 		msgBuf = c.rdbuf1
-		if debug {
+		if debug.On() {
 			l.Debugf("decompressed to %d bytes", len(msgBuf))
 		}
 	}
 
-	if debug {
+	if hdr.checksum && crc32.Checksum(msgBuf, crc32c) != sum {
+		atomic.AddInt64(&c.checksumErrors, 1)
+		atomic.AddInt64(&totalChecksumErrors, 1)
+		err = ErrChecksum
+		return
+	}
+
+	if debug.On() {
 		if len(msgBuf) > 1024 {
 			l.Debugf("message data:\n%s", hex.Dump(msgBuf[:1024]))
 		} else {
@@ -469,14 +527,14 @@ func (c *rawConnection) readMessage() (hdr header, msg encodable, err error) {
 }
 
 func (c *rawConnection) handleIndex(im IndexMessage) {
-	if debug {
+	if debug.On() {
 		l.Debugf("Index(%v, %v, %d file, flags %x, opts: %s)", c.id, im.Folder, len(im.Files), im.Flags, im.Options)
 	}
 	c.receiver.Index(c.id, im.Folder, filterIndexMessageFiles(im.Files), im.Flags, im.Options)
 }
 
 func (c *rawConnection) handleIndexUpdate(im IndexMessage) {
-	if debug {
+	if debug.On() {
 		l.Debugf("queueing IndexUpdate(%v, %v, %d files, flags %x, opts: %s)", c.id, im.Folder, len(im.Files), im.Flags, im.Options)
 	}
 	c.receiver.IndexUpdate(c.id, im.Folder, filterIndexMessageFiles(im.Files), im.Flags, im.Options)
@@ -538,6 +596,12 @@ func (c *rawConnection) handlePong(msgID int) {
 }
 
 func (c *rawConnection) send(msgID int, msgType int, msg encodable) bool {
+	return c.sendDone(msgID, msgType, msg, nil)
+}
+
+// sendDone queues the message for writing, like send, and closes done once it
+// has been written.
+func (c *rawConnection) sendDone(msgID int, msgType int, msg encodable, done chan struct{}) bool {
 	if msgID < 0 {
 		select {
 		case id := <-c.nextID:
@@ -554,7 +618,7 @@ func (c *rawConnection) send(msgID int, msgType int, msg encodable) bool {
 	}
 
 	select {
-	case c.outbox <- hdrMsg{hdr, msg}:
+	case c.outbox <- hdrMsg{hdr, msg, done}:
 		return true
 	case <-c.closed:
 		return false
@@ -601,7 +665,7 @@ func (c *rawConnection) writerLoop() {
 					binary.BigEndian.PutUint32(msgBuf[4:8], uint32(len(tempBuf)))
 					msgBuf = msgBuf[0 : len(tempBuf)+8]
 
-					if debug {
+					if debug.On() {
 						l.Debugf("write compressed message; %v (len=%d)", hm.hdr, len(tempBuf))
 					}
 				} else {
@@ -617,12 +681,19 @@ func (c *rawConnection) writerLoop() {
 					msgBuf = msgBuf[0 : len(uncBuf)+8]
 					copy(msgBuf[8:], uncBuf)
 
-					if debug {
+					if debug.On() {
 						l.Debugf("write uncompressed message; %v (len=%d)", hm.hdr, len(uncBuf))
 					}
 				}
+
+				if atomic.LoadInt32(&c.checksums) == 1 {
+					hm.hdr.checksum = true
+					msgBuf = append(msgBuf, 0, 0, 0, 0)
+					binary.BigEndian.PutUint32(msgBuf[len(msgBuf)-4:], crc32.Checksum(uncBuf, crc32c))
+					binary.BigEndian.PutUint32(msgBuf[4:8], uint32(len(msgBuf)-8))
+				}
 			} else {
-				if debug {
+				if debug.On() {
 					l.Debugf("write empty message; %v", hm.hdr)
 				}
 				binary.BigEndian.PutUint32(msgBuf[4:8], 0)
@@ -634,7 +705,7 @@ func (c *rawConnection) writerLoop() {
 			if err == nil {
 				var n int
 				n, err = c.cw.Write(msgBuf)
-				if debug {
+				if debug.On() {
 					l.Debugf("wrote %d bytes on the wire", n)
 				}
 			}
@@ -642,6 +713,9 @@ func (c *rawConnection) writerLoop() {
 				c.close(err)
 				return
 			}
+			if hm.done != nil {
+				close(hm.done)
+			}
 		case <-c.closed:
 			return
 		}
@@ -679,37 +753,37 @@ func (c *rawConnection) idGenerator() {
 
 func (c *rawConnection) pingerLoop() {
 	var rc = make(chan bool, 1)
-	ticker := time.Tick(pingIdleTime / 2)
+	ticker := time.Tick(c.pingIdleTime / 2)
 	for {
 		select {
 		case <-ticker:
-			if d := time.Since(c.cr.Last()); d < pingIdleTime {
-				if debug {
+			if d := time.Since(c.cr.Last()); d < c.pingIdleTime {
+				if debug.On() {
 					l.Debugln(c.id, "ping skipped after rd", d)
 				}
 				continue
 			}
-			if d := time.Since(c.cw.Last()); d < pingIdleTime {
-				if debug {
+			if d := time.Since(c.cw.Last()); d < c.pingIdleTime {
+				if debug.On() {
 					l.Debugln(c.id, "ping skipped after wr", d)
 				}
 				continue
 			}
 			go func() {
-				if debug {
+				if debug.On() {
 					l.Debugln(c.id, "ping ->")
 				}
 				rc <- c.ping()
 			}()
 			select {
 			case ok := <-rc:
-				if debug {
+				if debug.On() {
 					l.Debugln(c.id, "<- pong")
 				}
 				if !ok {
 					c.close(fmt.Errorf("ping failure"))
 				}
-			case <-time.After(pingTimeout):
+			case <-time.After(c.pingTimeout):
 				c.close(fmt.Errorf("ping timeout"))
 			case <-c.closed:
 				return
@@ -722,15 +796,17 @@ func (c *rawConnection) pingerLoop() {
 }
 
 type Statistics struct {
-	At            time.Time
-	InBytesTotal  int64
-	OutBytesTotal int64
+	At             time.Time
+	InBytesTotal   int64
+	OutBytesTotal  int64
+	ChecksumErrors int64 // Received messages that didn't match their checksum
 }
 
 func (c *rawConnection) Statistics() Statistics {
 	return Statistics{
-		At:            time.Now(),
-		InBytesTotal:  c.cr.Tot(),
-		OutBytesTotal: c.cw.Tot(),
+		At:             time.Now(),
+		InBytesTotal:   c.cr.Tot(),
+		OutBytesTotal:  c.cw.Tot(),
+		ChecksumErrors: atomic.LoadInt64(&c.checksumErrors),
 	}
 }
@@ -4,10 +4,12 @@ package protocol
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"os"
@@ -15,6 +17,7 @@ import (
 	"strings"
 	"testing"
 	"testing/quick"
+	"time"
 
 	"github.com/calmh/xdr"
 )
@@ -61,6 +64,16 @@ func TestHeaderLayout(t *testing.T) {
 	if a != e {
 		t.Errorf("Header layout incorrect; %08x != %08x", a, e)
 	}
+
+	// Checksum is the second to last bit
+	e = 0x00000002
+	a = encodeHeader(header{checksum: true})
+	if a != e {
+		t.Errorf("Header layout incorrect; %08x != %08x", a, e)
+	}
+	if h := decodeHeader(e); !h.checksum || h.compression {
+		t.Errorf("Checksum bit decoded incorrectly; %+v", h)
+	}
 }
 
 func TestPing(t *testing.T) {
@@ -206,6 +219,45 @@ func TestTypeErr(t *testing.T) {
 	}
 }
 
+func TestChecksum(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection(c0ID, ar, bw, m0, "name", CompressAlways).(wireFormatConnection).next.(*rawConnection)
+	c1 := NewConnection(c1ID, br, aw, m1, "name", CompressAlways).(wireFormatConnection).next.(*rawConnection)
+
+	// A message with a matching checksum is accepted; the ping is answered
+	// after it has been read.
+	c0.EnableChecksums()
+	c0.ClusterConfig(ClusterConfigMessage{ClientName: "test"})
+	if !c1.ping() {
+		t.Fatal("c1 ping failed")
+	}
+	if n := c1.Statistics().ChecksumErrors; n != 0 {
+		t.Errorf("Unexpected %d checksum errors", n)
+	}
+
+	// A corrupted message closes the connection.
+	bs, _ := ClusterConfigMessage{ClientName: "test"}.AppendXDR(nil)
+	frame := make([]byte, 8, 8+len(bs)+4)
+	binary.BigEndian.PutUint32(frame[0:], encodeHeader(header{msgType: messageTypeClusterConfig, checksum: true}))
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(bs)+4))
+	frame = append(frame, bs...)
+	frame = append(frame, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(frame[len(frame)-4:], crc32.Checksum(bs, crc32c)^1)
+	c0.cw.Write(frame)
+
+	if !m1.isClosed() {
+		t.Fatal("Connection should close due to checksum mismatch")
+	}
+	if n := c1.Statistics().ChecksumErrors; n != 1 {
+		t.Errorf("Unexpected %d checksum errors, expected 1", n)
+	}
+}
+
 func TestClose(t *testing.T) {
 	m0 := newTestModel()
 	m1 := newTestModel()
@@ -237,6 +289,52 @@ func TestClose(t *testing.T) {
 	}
 }
 
+func TestIndexWritten(t *testing.T) {
+	m0 := newTestModel()
+
+	ar, _ := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection(c0ID, ar, bw, m0, "name", CompressAlways)
+
+	// Nothing reads the other end yet, so the index can't be written.
+	done := make(chan error)
+	go func() {
+		done <- c0.Index("default", []FileInfo{{Name: "foo"}}, 0, nil)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Index returned before the message was written")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	go io.Copy(ioutil.Discard, br)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error("Unexpected error:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Index didn't return after the message was written")
+	}
+}
+
+func TestWireNames(t *testing.T) {
+	fs := []FileInfo{{Name: "a"}, {Name: "b"}}
+	if wfs := wireNames(fs); &wfs[0] != &fs[0] {
+		t.Error("Files copied without a name to change")
+	}
+
+	fs = []FileInfo{{Name: "a"}, {Name: "e\u0301"}}
+	wfs := wireNames(fs)
+	if &wfs[0] == &fs[0] {
+		t.Fatal("Files not copied to change a name")
+	}
+	if wfs[1].Name != "\u00e9" || fs[1].Name != "e\u0301" {
+		t.Errorf("Unexpected names %q, originally %q", wfs[1].Name, fs[1].Name)
+	}
+}
+
 func TestElementSizeExceededNested(t *testing.T) {
 	m := ClusterConfigMessage{
 		Folders: []Folder{
@@ -21,25 +21,30 @@ func (c wireFormatConnection) Name() string {
 }
 
 func (c wireFormatConnection) Index(folder string, fs []FileInfo, flags uint32, options []Option) error {
-	var myFs = make([]FileInfo, len(fs))
-	copy(myFs, fs)
-
-	for i := range fs {
-		myFs[i].Name = norm.NFC.String(filepath.ToSlash(myFs[i].Name))
-	}
-
-	return c.next.Index(folder, myFs, flags, options)
+	return c.next.Index(folder, wireNames(fs), flags, options)
 }
 
 func (c wireFormatConnection) IndexUpdate(folder string, fs []FileInfo, flags uint32, options []Option) error {
-	var myFs = make([]FileInfo, len(fs))
-	copy(myFs, fs)
+	return c.next.IndexUpdate(folder, wireNames(fs), flags, options)
+}
 
+// wireNames returns the files with their names in wire format. The list is
+// only copied if a name needs changing, which is rarely, so that index
+// batches aren't duplicated on their way out.
+func wireNames(fs []FileInfo) []FileInfo {
+	myFs := fs
 	for i := range fs {
-		myFs[i].Name = norm.NFC.String(filepath.ToSlash(myFs[i].Name))
+		name := norm.NFC.String(filepath.ToSlash(fs[i].Name))
+		if name == fs[i].Name {
+			continue
+		}
+		if &myFs[0] == &fs[0] {
+			myFs = make([]FileInfo, len(fs))
+			copy(myFs, fs)
+		}
+		myFs[i].Name = name
 	}
-
-	return c.next.IndexUpdate(folder, myFs, flags, options)
+	return myFs
 }
 
 func (c wireFormatConnection) Request(folder, name string, offset int64, size int, hash []byte, flags uint32, options []Option) ([]byte, error) {
@@ -47,6 +52,10 @@ func (c wireFormatConnection) Request(folder, name string, offset int64, size in
 	return c.next.Request(folder, name, offset, size, hash, flags, options)
 }
 
+func (c wireFormatConnection) EnableChecksums() {
+	c.next.EnableChecksums()
+}
+
 func (c wireFormatConnection) ClusterConfig(config ClusterConfigMessage) {
 	c.next.ClusterConfig(config)
 }
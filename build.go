@@ -14,6 +14,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"crypto/md5"
+	"crypto/sha256"
 	"flag"
 	"fmt"
 	"io"
@@ -31,16 +32,58 @@ import (
 )
 
 var (
-	versionRe = regexp.MustCompile(`-[0-9]{1,3}-g[0-9a-f]{5,10}`)
-	goarch    string
-	goos      string
-	noupgrade bool
-	version   string
-	race      bool
+	versionRe    = regexp.MustCompile(`-[0-9]{1,3}-g[0-9a-f]{5,10}`)
+	goarch       string
+	goos         string
+	noupgrade    bool
+	version      string
+	race         bool
+	reproducible bool
 )
 
 const minGoVersion = 1.3
 
+// In reproducible builds, the build user and host are replaced by these.
+const (
+	reproducibleUser = "reproducible"
+	reproducibleHost = "reproducible"
+)
+
+// distDir is where the "all" command puts the release artifacts.
+const distDir = "dist"
+
+type target struct {
+	goos, goarch string
+	packages     []string // "tar", "zip" and/or "deb"
+}
+
+// releaseTargets lists the platforms built by the "all" command.
+var releaseTargets = []target{
+	{"darwin", "amd64", []string{"tar"}},
+	{"darwin", "386", []string{"tar"}},
+
+	{"dragonfly", "386", []string{"tar"}},
+	{"dragonfly", "amd64", []string{"tar"}},
+
+	{"freebsd", "386", []string{"tar"}},
+	{"freebsd", "amd64", []string{"tar"}},
+
+	{"linux", "386", []string{"tar", "deb"}},
+	{"linux", "amd64", []string{"tar", "deb"}},
+	{"linux", "arm", []string{"tar", "deb"}},
+
+	{"netbsd", "386", []string{"tar"}},
+	{"netbsd", "amd64", []string{"tar"}},
+
+	{"openbsd", "386", []string{"tar"}},
+	{"openbsd", "amd64", []string{"tar"}},
+
+	{"solaris", "amd64", []string{"tar"}},
+
+	{"windows", "386", []string{"zip"}},
+	{"windows", "amd64", []string{"zip"}},
+}
+
 func main() {
 	log.SetOutput(os.Stdout)
 	log.SetFlags(0)
@@ -61,6 +104,7 @@ func main() {
 	flag.BoolVar(&noupgrade, "no-upgrade", noupgrade, "Disable upgrade functionality")
 	flag.StringVar(&version, "version", getVersion(), "Set compiled in version string")
 	flag.BoolVar(&race, "race", race, "Use race detector")
+	flag.BoolVar(&reproducible, "reproducible", reproducible, "Make a reproducible build and write a manifest of the artifacts")
 	flag.Parse()
 
 	switch goarch {
@@ -86,6 +130,9 @@ func main() {
 		return
 	}
 
+	// Artifacts built by the tar, zip and build commands, for the manifest
+	var artifacts []string
+
 	for _, cmd := range flag.Args() {
 		switch cmd {
 		case "setup":
@@ -105,7 +152,7 @@ func main() {
 			if noupgrade {
 				tags = []string{"noupgrade"}
 			}
-			build(pkg, tags)
+			artifacts = append(artifacts, build(pkg, tags))
 
 		case "test":
 			test("./...")
@@ -119,6 +166,9 @@ func main() {
 		case "translate":
 			translate()
 
+		case "completion":
+			completion()
+
 		case "transifex":
 			transifex()
 
@@ -126,14 +176,17 @@ func main() {
 			deps()
 
 		case "tar":
-			buildTar()
+			artifacts = append(artifacts, buildTar())
 
 		case "zip":
-			buildZip()
+			artifacts = append(artifacts, buildZip())
 
 		case "deb":
 			buildDeb()
 
+		case "all":
+			buildAll()
+
 		case "clean":
 			clean()
 
@@ -149,6 +202,12 @@ func main() {
 			log.Fatalf("Unknown command %q", cmd)
 		}
 	}
+
+	if reproducible && len(artifacts) > 0 {
+		if err := writeManifest("manifest.txt", artifacts); err != nil {
+			log.Fatal(err)
+		}
+	}
 }
 
 func checkRequiredGoVersion() {
@@ -196,7 +255,7 @@ func install(pkg string, tags []string) {
 	runPrint("go", args...)
 }
 
-func build(pkg string, tags []string) {
+func build(pkg string, tags []string) string {
 	binary := "syncthing"
 	if goos == "windows" {
 		binary += ".exe"
@@ -210,8 +269,13 @@ func build(pkg string, tags []string) {
 	if race {
 		args = append(args, "-race")
 	}
-	args = append(args, pkg)
 	setBuildEnv()
+	if reproducible {
+		// Remove the local source paths from the binary.
+		trim := "-trimpath " + strings.Join(filepath.SplitList(os.Getenv("GOPATH")), ";")
+		args = append(args, "-gcflags", trim, "-asmflags", trim)
+	}
+	args = append(args, pkg)
 	runPrint("go", args...)
 
 	// Create an md5 checksum of the binary, to be included in the archive for
@@ -220,9 +284,10 @@ func build(pkg string, tags []string) {
 	if err != nil {
 		log.Fatal(err)
 	}
+	return binary
 }
 
-func buildTar() {
+func buildTar() string {
 	name := archiveName()
 	var tags []string
 	if noupgrade {
@@ -248,9 +313,10 @@ func buildTar() {
 
 	tarGz(filename, files)
 	log.Println(filename)
+	return filename
 }
 
-func buildZip() {
+func buildZip() string {
 	name := archiveName()
 	var tags []string
 	if noupgrade {
@@ -271,8 +337,13 @@ func buildZip() {
 		files = append(files, archiveFile{src: file, dst: name + "/" + filepath.Base(file)})
 	}
 
+	for _, file := range listFiles("etc/completion") {
+		files = append(files, archiveFile{src: file, dst: name + "/" + file})
+	}
+
 	zipFile(filename, files)
 	log.Println(filename)
+	return filename
 }
 
 func buildDeb() {
@@ -291,16 +362,18 @@ func buildDeb() {
 		files = append(files, archiveFile{src: file, dst: "deb/usr/share/doc/syncthing/" + filepath.Base(file), perm: 0644})
 	}
 
+	files = append(files,
+		archiveFile{src: "etc/completion/syncthing.bash", dst: "deb/usr/share/bash-completion/completions/syncthing", perm: 0644},
+		archiveFile{src: "etc/completion/_syncthing", dst: "deb/usr/share/zsh/vendor-completions/_syncthing", perm: 0644},
+	)
+
 	for _, af := range files {
 		if err := copyFile(af.src, af.dst, af.perm); err != nil {
 			log.Fatal(err)
 		}
 	}
 
-	debarch := goarch
-	if debarch == "386" {
-		debarch = "i386"
-	}
+	debarch := debArch()
 
 	control := `Package: syncthing
 Architecture: {{arch}}
@@ -322,7 +395,7 @@ Description: Open Source Continuous File Synchronization
 	control = strings.Replace(control, "{{version}}", version[1:], -1)
 	changelog = strings.Replace(changelog, "{{arch}}", debarch, -1)
 	changelog = strings.Replace(changelog, "{{version}}", version[1:], -1)
-	changelog = strings.Replace(changelog, "{{date}}", time.Now().Format(time.RFC1123), -1)
+	changelog = strings.Replace(changelog, "{{date}}", buildTime().Format(time.RFC1123), -1)
 
 	os.MkdirAll("deb/DEBIAN", 0755)
 	ioutil.WriteFile("deb/DEBIAN/control", []byte(control), 0644)
@@ -331,6 +404,100 @@ Description: Open Source Continuous File Synchronization
 
 }
 
+func debArch() string {
+	if goarch == "386" {
+		return "i386"
+	}
+	return goarch
+}
+
+// buildAll builds the release packages for every target in releaseTargets
+// into distDir, together with a manifest of their SHA-256 checksums in the
+// format used by sha256sum.
+func buildAll() {
+	rmr(distDir)
+	if err := os.MkdirAll(distDir, 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	var artifacts []string
+	for _, t := range releaseTargets {
+		goos, goarch = t.goos, t.goarch
+		for _, pkg := range t.packages {
+			var file string
+			switch pkg {
+			case "tar":
+				file = buildTar()
+			case "zip":
+				file = buildZip()
+			case "deb":
+				file = packageDeb()
+				if file == "" {
+					continue
+				}
+			default:
+				log.Fatalf("Unknown package type %q", pkg)
+			}
+
+			dst := filepath.Join(distDir, filepath.Base(file))
+			if err := os.Rename(file, dst); err != nil {
+				log.Fatal(err)
+			}
+			artifacts = append(artifacts, dst)
+		}
+	}
+
+	if err := writeManifest(filepath.Join(distDir, "manifest.txt"), artifacts); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// packageDeb prepares the deb directory and builds a package from it with
+// dpkg-deb. It returns the name of the package, or an empty string if
+// dpkg-deb is not available.
+func packageDeb() string {
+	buildDeb()
+
+	if _, err := exec.LookPath("dpkg-deb"); err != nil {
+		log.Printf("Skipping deb for %s: %v", buildArch(), err)
+		return ""
+	}
+
+	filename := fmt.Sprintf("syncthing_%s_%s.deb", version[1:], debArch())
+	runPrint("dpkg-deb", "-b", "deb", filename)
+	rmr("deb")
+	log.Println(filename)
+	return filename
+}
+
+func writeManifest(out string, files []string) error {
+	fd, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		sf, err := os.Open(file)
+		if err != nil {
+			fd.Close()
+			return err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, sf)
+		sf.Close()
+		if err != nil {
+			fd.Close()
+			return err
+		}
+		if _, err := fmt.Fprintf(fd, "%x  %s\n", h.Sum(nil), filepath.Base(file)); err != nil {
+			fd.Close()
+			return err
+		}
+	}
+
+	return fd.Close()
+}
+
 func copyFile(src, dst string, perm os.FileMode) error {
 	dstDir := filepath.Dir(dst)
 	os.MkdirAll(dstDir, 0755) // ignore error
@@ -379,6 +546,12 @@ func assets() {
 	runPipe("internal/auto/gui.files.go", "go", "run", "cmd/genassets/main.go", "gui")
 }
 
+func completion() {
+	setBuildEnv()
+	runPipe("etc/completion/syncthing.bash", "go", "run", "./cmd/syncthing", "-generate-completion", "bash")
+	runPipe("etc/completion/_syncthing", "go", "run", "./cmd/syncthing", "-generate-completion", "zsh")
+}
+
 func xdr() {
 	runPrint("go", "generate", "./internal/discover", "./internal/db")
 }
@@ -471,13 +644,28 @@ func getVersion() string {
 func buildStamp() int64 {
 	bs, err := runError("git", "show", "-s", "--format=%ct")
 	if err != nil {
+		if reproducible {
+			log.Fatal("Reproducible build requires the commit time:", err)
+		}
 		return time.Now().Unix()
 	}
-	s, _ := strconv.ParseInt(string(bs), 10, 64)
+	s, _ := strconv.ParseInt(string(bytes.TrimSpace(bs)), 10, 64)
 	return s
 }
 
+// buildTime returns the time to use for timestamps in packages; the commit
+// time in reproducible builds, otherwise the current time.
+func buildTime() time.Time {
+	if reproducible {
+		return time.Unix(buildStamp(), 0).UTC()
+	}
+	return time.Now()
+}
+
 func buildUser() string {
+	if reproducible {
+		return reproducibleUser
+	}
 	u, err := user.Current()
 	if err != nil {
 		return "unknown-user"
@@ -486,6 +674,9 @@ func buildUser() string {
 }
 
 func buildHost() string {
+	if reproducible {
+		return reproducibleHost
+	}
 	h, err := os.Hostname()
 	if err != nil {
 		return "unknown-host"
@@ -586,6 +777,9 @@ func tarGz(out string, files []archiveFile) {
 			Mode:    int64(info.Mode()),
 			ModTime: info.ModTime(),
 		}
+		if reproducible {
+			h.ModTime = buildTime()
+		}
 
 		err = tw.WriteHeader(h)
 		if err != nil {
@@ -637,6 +831,9 @@ func zipFile(out string, files []archiveFile) {
 		}
 		fh.Name = f.dst
 		fh.Method = zip.Deflate
+		if reproducible {
+			fh.SetModTime(buildTime())
+		}
 
 		if strings.HasSuffix(f.dst, ".txt") {
 			// Text file. Read it and convert line endings.
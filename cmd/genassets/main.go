@@ -11,8 +11,10 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
 	"encoding/base64"
 	"flag"
+	"fmt"
 	"go/format"
 	"io"
 	"net/http"
@@ -41,11 +43,20 @@ func Assets() map[string][]byte {
 	return assets
 }
 
+// AssetHashes returns the hex encoded SHA-256 hash of the uncompressed
+// contents of each asset.
+func AssetHashes() map[string]string {
+	return map[string]string{
+{{range $asset := .Assets}}		"{{$asset.Name}}": "{{$asset.Hash}}",
+{{end}}	}
+}
+
 `))
 
 type asset struct {
 	Name string
 	Data string
+	Hash string
 }
 
 var assets []asset
@@ -56,8 +67,13 @@ func walkerFor(basePath string) filepath.WalkFunc {
 			return err
 		}
 
-		if strings.HasPrefix(filepath.Base(name), ".") {
-			// Skip dotfiles
+		if strings.HasPrefix(filepath.Base(name), ".") && name != basePath {
+			// Skip dotfiles and directories. The GUI server skips them too
+			// when serving assets from disk (STGUIASSETS), so that both
+			// serve the same set of files.
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 
@@ -69,7 +85,8 @@ func walkerFor(basePath string) filepath.WalkFunc {
 
 			var buf bytes.Buffer
 			gw := gzip.NewWriter(&buf)
-			io.Copy(gw, fd)
+			h := sha256.New()
+			io.Copy(io.MultiWriter(gw, h), fd)
 			fd.Close()
 			gw.Flush()
 			gw.Close()
@@ -78,6 +95,7 @@ func walkerFor(basePath string) filepath.WalkFunc {
 			assets = append(assets, asset{
 				Name: filepath.ToSlash(name),
 				Data: base64.StdEncoding.EncodeToString(buf.Bytes()),
+				Hash: fmt.Sprintf("%x", h.Sum(nil)),
 			})
 		}
 
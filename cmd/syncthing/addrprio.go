@@ -0,0 +1,119 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"time"
+
+	"github.com/syncthing/protocol"
+)
+
+// The longest a failed address class is skipped.
+const maxClassBackoff = time.Hour
+
+// An addrClass is one entry of the address list of a device, in priority
+// order: either a static address, or "dynamic" for the addresses found by
+// discovery.
+type addrClass struct {
+	entry string
+	addrs []string
+}
+
+// addressClasses expands the address list of a device to the classes to
+// dial, in the configured order. An address is only dialed as part of the
+// first class it appears in, and classes without addresses are left out.
+func addressClasses(entries []string, lookup func() []string) []addrClass {
+	seen := make(map[string]bool)
+	var classes []addrClass
+	for _, entry := range entries {
+		addrs := []string{entry}
+		if entry == "dynamic" {
+			if lookup == nil {
+				continue
+			}
+			addrs = lookup()
+		}
+
+		class := addrClass{entry: entry}
+		for _, addr := range addrs {
+			if !seen[addr] {
+				seen[addr] = true
+				class.addrs = append(class.addrs, addr)
+			}
+		}
+		if len(class.addrs) > 0 {
+			classes = append(classes, class)
+		}
+	}
+	return classes
+}
+
+type classFailure struct {
+	failures int
+	until    time.Time
+}
+
+// The dialPriority remembers for each device which address class connected
+// last and which ones failed, so that the dialer sticks with the best
+// working class: a class that failed is skipped for a backoff period, as
+// long as a class after it is known to work. It is only used by the dialer
+// routine and is not safe for concurrent use.
+type dialPriority struct {
+	working  map[protocol.DeviceID]string
+	failures map[protocol.DeviceID]map[string]classFailure
+}
+
+func newDialPriority() *dialPriority {
+	return &dialPriority{
+		working:  make(map[protocol.DeviceID]string),
+		failures: make(map[protocol.DeviceID]map[string]classFailure),
+	}
+}
+
+// skip returns true if the class at index i of classes should not be dialed
+// now.
+func (p *dialPriority) skip(device protocol.DeviceID, classes []addrClass, i int, now time.Time) bool {
+	f, ok := p.failures[device][classes[i].entry]
+	if !ok || !now.Before(f.until) {
+		return false
+	}
+	working, ok := p.working[device]
+	if !ok {
+		return false
+	}
+	for _, class := range classes[i+1:] {
+		if class.entry == working {
+			return true
+		}
+	}
+	return false
+}
+
+// failed records that no address of the class could be dialed. The class
+// is skipped for the base interval, doubling with each further failure.
+func (p *dialPriority) failed(device protocol.DeviceID, entry string, base time.Duration, now time.Time) {
+	if p.failures[device] == nil {
+		p.failures[device] = make(map[string]classFailure)
+	}
+	f := p.failures[device][entry]
+	f.failures++
+	d := base
+	for i := 1; i < f.failures && d < maxClassBackoff; i++ {
+		d *= 2
+	}
+	if d > maxClassBackoff {
+		d = maxClassBackoff
+	}
+	f.until = now.Add(d)
+	p.failures[device][entry] = f
+}
+
+// connected records that the class was used to connect to the device.
+func (p *dialPriority) connected(device protocol.DeviceID, entry string) {
+	p.working[device] = entry
+	delete(p.failures[device], entry)
+}
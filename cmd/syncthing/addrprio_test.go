@@ -0,0 +1,80 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/syncthing/protocol"
+)
+
+func TestAddressClasses(t *testing.T) {
+	lookup := func() []string {
+		return []string{"10.0.0.1:22000", "192.0.2.1:22000", "192.0.2.2:22000"}
+	}
+
+	classes := addressClasses([]string{"10.0.0.1:22000", "dynamic", "example.com"}, lookup)
+	expected := []addrClass{
+		{"10.0.0.1:22000", []string{"10.0.0.1:22000"}},
+		{"dynamic", []string{"192.0.2.1:22000", "192.0.2.2:22000"}},
+		{"example.com", []string{"example.com"}},
+	}
+	if !reflect.DeepEqual(classes, expected) {
+		t.Errorf("Incorrect classes\n%v\n!=\n%v", classes, expected)
+	}
+
+	// Without discovery, dynamic entries are left out.
+	classes = addressClasses([]string{"dynamic", "example.com"}, nil)
+	expected = []addrClass{{"example.com", []string{"example.com"}}}
+	if !reflect.DeepEqual(classes, expected) {
+		t.Errorf("Incorrect classes\n%v\n!=\n%v", classes, expected)
+	}
+}
+
+func TestDialPriority(t *testing.T) {
+	dev := protocol.LocalDeviceID
+	classes := addressClasses([]string{"a", "b", "c"}, nil)
+	p := newDialPriority()
+	now := time.Now()
+
+	// Nothing has worked yet, so everything is dialed.
+	p.failed(dev, "a", time.Minute, now)
+	if p.skip(dev, classes, 0, now) {
+		t.Error("Failed class skipped although no other class is known to work")
+	}
+
+	// Once a worse class works, the failed better one is skipped until its
+	// backoff expires.
+	p.failed(dev, "b", time.Minute, now)
+	p.connected(dev, "c")
+	if !p.skip(dev, classes, 0, now) || !p.skip(dev, classes, 1, now) {
+		t.Error("Failed classes not skipped")
+	}
+	if p.skip(dev, classes, 2, now) {
+		t.Error("Working class skipped")
+	}
+	if p.skip(dev, classes, 0, now.Add(time.Minute)) {
+		t.Error("Class skipped after its backoff expired")
+	}
+
+	// The backoff doubles with each failure.
+	p.failed(dev, "a", time.Minute, now)
+	if !p.skip(dev, classes, 0, now.Add(time.Minute)) || p.skip(dev, classes, 0, now.Add(2*time.Minute)) {
+		t.Error("Backoff not doubled")
+	}
+
+	// When the better class works again, it is preferred.
+	p.connected(dev, "a")
+	if p.skip(dev, classes, 0, now) {
+		t.Error("Working class skipped")
+	}
+	if p.skip(dev, classes, 1, now) {
+		t.Error("Class skipped although no class after it is known to work")
+	}
+}
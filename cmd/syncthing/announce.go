@@ -0,0 +1,228 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/sync"
+	"github.com/thejerf/suture"
+)
+
+// How often the public IP is looked up, when announcing the external
+// address with the IP from the ExternalIPURL.
+const externalIPInterval = time.Hour
+
+// The announcer starts discovery and the UPnP port mapping for the announced
+// listener, and keeps them up to date as the listeners are changed.
+type announcer struct {
+	mainSvc     *suture.Supervisor
+	cfg         *config.Wrapper
+	announced   config.ListenerConfiguration
+	upnpToken   suture.ServiceToken
+	upnpRunning bool
+	extAddress  string // the configured external address and IP URL
+	extIPURL    string
+	extAnnounce string // the external address last announced
+	mut         sync.Mutex
+}
+
+func newAnnouncer(mainSvc *suture.Supervisor, cfg *config.Wrapper) *announcer {
+	a := &announcer{
+		mainSvc: mainSvc,
+		cfg:     cfg,
+		mut:     sync.NewMutex(),
+	}
+
+	// The default port we announce, possibly modified by UPnP. That's the
+	// port of the first listener with NAT traversal, or of the first
+	// listener if there is none.
+
+	opts := cfg.Options()
+	var localPort int
+	announced, ok := announcedListener(opts.Listeners)
+	if ok {
+		var err error
+		localPort, err = listenerPort(announced)
+		if err != nil {
+			l.Fatalln("Bad listen address:", err)
+		}
+	} else {
+		l.Warnln("No listen addresses enabled; other devices will not be able to connect to us")
+	}
+	a.announced = announced
+	a.extAddress, a.extIPURL = opts.ExternalAddress, opts.ExternalIPURL
+
+	// Start discovery
+
+	discoverer = discovery()
+	a.startGlobal(opts, localPort)
+
+	// Start UPnP, unless the external address is known. The UPnP service
+	// will restart global discovery if the external port changes.
+
+	if opts.UPnPEnabled && announced.NATTraversal && opts.ExternalAddress == "" {
+		a.startUPnP(localPort)
+	}
+
+	cfg.Subscribe(a)
+	go a.refreshExternalIP()
+
+	return a
+}
+
+func (a *announcer) Changed(cfg config.Configuration) error {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+
+	opts := cfg.Options
+	discoverer.SetListenAddresses(opts.ListenAddresses())
+
+	announced, _ := announcedListener(opts.Listeners)
+	if announced == a.announced && opts.ExternalAddress == a.extAddress && opts.ExternalIPURL == a.extIPURL {
+		return nil
+	}
+	a.announced = announced
+	a.extAddress, a.extIPURL = opts.ExternalAddress, opts.ExternalIPURL
+
+	localPort, err := listenerPort(announced)
+	if err != nil {
+		l.Warnln("Bad listen address:", err)
+		localPort = 0
+	}
+
+	if a.upnpRunning {
+		a.mainSvc.Remove(a.upnpToken)
+		a.upnpRunning = false
+	}
+
+	a.startGlobal(opts, localPort)
+
+	if opts.UPnPEnabled && announced.NATTraversal && localPort != 0 && opts.ExternalAddress == "" {
+		// Global discovery is restarted again with the external port, once
+		// a mapping has been set up.
+		a.startUPnP(localPort)
+	}
+
+	return nil
+}
+
+// startGlobal (re)starts global discovery, announcing the external address
+// if one is configured, and the local port otherwise.
+func (a *announcer) startGlobal(opts config.OptionsConfiguration, localPort int) {
+	if !opts.GlobalAnnEnabled {
+		return
+	}
+	l.Infoln("Starting global discovery announcements")
+
+	a.extAnnounce = ""
+	if opts.ExternalAddress != "" {
+		addr, err := externalAddress(opts)
+		if err == nil {
+			l.Infoln("Announcing external address", addr)
+			discoverer.StartGlobalExternal(opts.GlobalAnnServers, addr)
+			a.extAnnounce = addr.String()
+			return
+		}
+		l.Warnln("External address:", err)
+	}
+
+	discoverer.StartGlobal(opts.GlobalAnnServers, uint16(localPort))
+}
+
+// refreshExternalIP regularly looks up our public IP, when announcing an
+// external address with the IP given by ExternalIPURL, and restarts global
+// discovery when it has changed.
+func (a *announcer) refreshExternalIP() {
+	for _ = range time.NewTicker(externalIPInterval).C {
+		opts := a.cfg.Options()
+		if opts.ExternalIPURL == "" || !opts.GlobalAnnEnabled {
+			continue
+		}
+		if host, _, err := net.SplitHostPort(opts.ExternalAddress); err != nil || host != "" {
+			continue
+		}
+
+		addr, err := externalAddress(opts)
+		if err != nil {
+			l.Infoln("External address:", err)
+			continue
+		}
+
+		a.mut.Lock()
+		if addr.String() != a.extAnnounce {
+			localPort, _ := listenerPort(a.announced)
+			a.startGlobal(opts, localPort)
+		}
+		a.mut.Unlock()
+	}
+}
+
+// externalAddress returns the configured external address, with the IP
+// looked up at the ExternalIPURL if the address has no host.
+func externalAddress(opts config.OptionsConfiguration) (*net.TCPAddr, error) {
+	host, port, err := net.SplitHostPort(opts.ExternalAddress)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" && opts.ExternalIPURL != "" {
+		host, err = lookupExternalIP(opts.ExternalIPURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return net.ResolveTCPAddr("tcp", net.JoinHostPort(host, port))
+}
+
+// lookupExternalIP returns our public IP, as returned in plain text by the
+// service at the URL.
+func lookupExternalIP(url string) (string, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", url, resp.Status)
+	}
+
+	bs, err := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return "", err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(bs)))
+	if ip == nil {
+		return "", fmt.Errorf("%s: no IP address in the response", url)
+	}
+	return ip.String(), nil
+}
+
+func (a *announcer) startUPnP(localPort int) {
+	a.upnpToken = a.mainSvc.Add(newUPnPSvc(a.cfg, localPort))
+	a.upnpRunning = true
+}
+
+// listenerPort returns the port of the given listener, or zero if it has no
+// address.
+func listenerPort(lc config.ListenerConfiguration) (int, error) {
+	if lc.Address == "" {
+		return 0, nil
+	}
+	addr, err := net.ResolveTCPAddr("tcp", lc.Address)
+	if err != nil {
+		return 0, err
+	}
+	return addr.Port, nil
+}
@@ -0,0 +1,49 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/syncthing/syncthing/internal/config"
+)
+
+func TestExternalAddress(t *testing.T) {
+	response := "192.0.2.42\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, response)
+	}))
+	defer srv.Close()
+
+	cases := []struct {
+		addr, url string
+		expected  string
+	}{
+		{"192.0.2.1:22001", "", "192.0.2.1:22001"},
+		{"192.0.2.1:22001", srv.URL, "192.0.2.1:22001"},
+		{":22002", "", ":22002"},
+		{":22002", srv.URL, "192.0.2.42:22002"},
+	}
+	for _, tc := range cases {
+		addr, err := externalAddress(config.OptionsConfiguration{ExternalAddress: tc.addr, ExternalIPURL: tc.url})
+		if err != nil {
+			t.Errorf("%s, %s: %v", tc.addr, tc.url, err)
+			continue
+		}
+		if addr.String() != tc.expected {
+			t.Errorf("%s, %s: %s != expected %s", tc.addr, tc.url, addr, tc.expected)
+		}
+	}
+
+	response = "<html>not an IP</html>"
+	if _, err := externalAddress(config.OptionsConfiguration{ExternalAddress: ":22002", ExternalIPURL: srv.URL}); err == nil {
+		t.Error("no error for a response without an IP")
+	}
+}
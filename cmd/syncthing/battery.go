@@ -0,0 +1,95 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/model"
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+const batteryCheckInterval = time.Minute
+
+var (
+	runningOnBattery bool
+	batteryMut       = sync.NewMutex()
+)
+
+// The batteryMonitor keeps track of whether we are running on battery power,
+// and suspends scanning and transfers meanwhile if so configured.
+type batteryMonitor struct {
+	cfg     *config.Wrapper
+	model   *model.Model
+	recheck chan struct{}
+	stop    chan struct{}
+}
+
+func newBatteryMonitor(cfg *config.Wrapper, m *model.Model) *batteryMonitor {
+	b := &batteryMonitor{
+		cfg:     cfg,
+		model:   m,
+		recheck: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+	cfg.Subscribe(b)
+	return b
+}
+
+func (b *batteryMonitor) Serve() {
+	t := time.NewTicker(batteryCheckInterval)
+	defer t.Stop()
+
+	warned := false
+	for {
+		battery, err := onBattery()
+		if err != nil && !warned {
+			l.Infoln("Detecting battery power:", err)
+			warned = true
+		}
+
+		batteryMut.Lock()
+		runningOnBattery = battery
+		batteryMut.Unlock()
+
+		pause := battery && b.cfg.Options().PauseOnBattery
+		if pause && !b.model.Suspended() {
+			l.Infoln("Running on battery power; pausing scanning and transfers")
+		} else if !pause && b.model.Suspended() {
+			l.Infoln("Resuming scanning and transfers")
+		}
+		b.model.SetSuspended(pause)
+
+		select {
+		case <-t.C:
+		case <-b.recheck:
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+func (b *batteryMonitor) Stop() {
+	close(b.stop)
+}
+
+func (b *batteryMonitor) Changed(cfg config.Configuration) error {
+	select {
+	case b.recheck <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// onBatteryPower returns true if we were running on battery power at the
+// last check.
+func onBatteryPower() bool {
+	batteryMut.Lock()
+	defer batteryMut.Unlock()
+	return runningOnBattery
+}
@@ -0,0 +1,21 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"os/exec"
+	"strings"
+)
+
+func onBattery() (bool, error) {
+	cmd := exec.Command("pmset", "-g", "batt")
+	out, err := cmd.Output()
+	if err != nil {
+		return false, err
+	}
+	return strings.Contains(string(out), "'Battery Power'"), nil
+}
@@ -0,0 +1,40 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+var powerSupplyDir = "/sys/class/power_supply"
+
+// onBattery returns true if there is an AC adapter and it's offline. Without
+// an AC adapter we're on a desktop or server, which is assumed to be on mains
+// power.
+func onBattery() (bool, error) {
+	supplies, err := ioutil.ReadDir(powerSupplyDir)
+	if err != nil {
+		return false, err
+	}
+
+	haveMains := false
+	for _, supply := range supplies {
+		dir := filepath.Join(powerSupplyDir, supply.Name())
+		bs, err := ioutil.ReadFile(filepath.Join(dir, "type"))
+		if err != nil || strings.TrimSpace(string(bs)) != "Mains" {
+			continue
+		}
+		haveMains = true
+		bs, err = ioutil.ReadFile(filepath.Join(dir, "online"))
+		if err == nil && strings.TrimSpace(string(bs)) == "1" {
+			return false, nil
+		}
+	}
+	return haveMains, nil
+}
@@ -0,0 +1,49 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOnBattery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "power")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldDir := powerSupplyDir
+	powerSupplyDir = dir
+	defer func() {
+		powerSupplyDir = oldDir
+	}()
+
+	supply := func(name, typ, online string) {
+		os.Mkdir(filepath.Join(dir, name), 0755)
+		ioutil.WriteFile(filepath.Join(dir, name, "type"), []byte(typ+"\n"), 0644)
+		ioutil.WriteFile(filepath.Join(dir, name, "online"), []byte(online+"\n"), 0644)
+	}
+
+	supply("BAT0", "Battery", "1")
+	if battery, err := onBattery(); err != nil || battery {
+		t.Errorf("Without AC adapter: %v, %v; expected mains power", battery, err)
+	}
+
+	supply("AC", "Mains", "0")
+	if battery, err := onBattery(); err != nil || !battery {
+		t.Errorf("With AC adapter offline: %v, %v; expected battery power", battery, err)
+	}
+
+	supply("AC", "Mains", "1")
+	if battery, err := onBattery(); err != nil || battery {
+		t.Errorf("With AC adapter online: %v, %v; expected mains power", battery, err)
+	}
+}
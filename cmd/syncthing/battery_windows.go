@@ -0,0 +1,28 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var getSystemPowerStatus, _ = syscall.GetProcAddress(kernel32, "GetSystemPowerStatus")
+
+func onBattery() (bool, error) {
+	// SYSTEM_POWER_STATUS; the first byte is the AC line status, which is
+	// zero when offline.
+	var powerStatus [12]byte
+	p := uintptr(unsafe.Pointer(&powerStatus[0]))
+
+	ret, _, callErr := syscall.Syscall(uintptr(getSystemPowerStatus), 1, p, 0, 0)
+	if ret == 0 {
+		return false, callErr
+	}
+
+	return powerStatus[0] == 0, nil
+}
@@ -0,0 +1,102 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
+)
+
+// A bootstrap file describes a new device, to set it up without the GUI: it
+// is the configuration in the JSON format of the REST API, with anything
+// left out keeping its default. Folders and devices are added to the
+// default ones, or replace those of the same ID; new folders default to
+// being rescanned every minute.
+//
+//	{
+//		"gui": {"address": "0.0.0.0:8384", "apiKey": "..."},
+//		"folders": [{"id": "photos", "path": "/data/photos", "devices": [{"deviceID": "..."}]}],
+//		"devices": [{"deviceID": "...", "name": "nas", "addresses": ["nas.example.com"]}]
+//	}
+type bootstrap struct {
+	Folders []json.RawMessage `json:"folders"`
+	Devices []json.RawMessage `json:"devices"`
+	GUI     json.RawMessage   `json:"gui"`
+	Options json.RawMessage   `json:"options"`
+}
+
+// applyBootstrap applies the bootstrap file at path to the new
+// configuration of the device myID, and validates the result.
+func applyBootstrap(cfg *config.Configuration, myID protocol.DeviceID, path string) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	var bs bootstrap
+	if err := json.NewDecoder(fd).Decode(&bs); err != nil {
+		return err
+	}
+
+	for _, raw := range bs.Folders {
+		folder := config.FolderConfiguration{RescanIntervalS: 60}
+		if err := json.Unmarshal(raw, &folder); err != nil {
+			return err
+		}
+		cfg.SetFolder(folder)
+	}
+	for _, raw := range bs.Devices {
+		device := config.DeviceConfiguration{Addresses: []string{"dynamic"}}
+		if err := json.Unmarshal(raw, &device); err != nil {
+			return err
+		}
+		if device.DeviceID == (protocol.DeviceID{}) {
+			return errors.New("device without a device ID")
+		}
+		cfg.SetDevice(device)
+	}
+	// The folders are shared with us, and with configured devices only
+	devices := make(map[protocol.DeviceID]bool)
+	for _, device := range cfg.Devices {
+		devices[device.DeviceID] = true
+	}
+	for i, folder := range cfg.Folders {
+		shared := false
+		for _, fd := range folder.Devices {
+			if fd.DeviceID == myID {
+				shared = true
+			} else if !devices[fd.DeviceID] {
+				return fmt.Errorf("folder %q is shared with device %v, which is not configured", folder.ID, fd.DeviceID)
+			}
+		}
+		if !shared {
+			cfg.Folders[i].Devices = append(folder.Devices, config.FolderDeviceConfiguration{DeviceID: myID})
+		}
+	}
+
+	if bs.GUI != nil {
+		if err := json.Unmarshal(bs.GUI, &cfg.GUI); err != nil {
+			return err
+		}
+		if err := cfg.GUI.HashPasswords(); err != nil {
+			return err
+		}
+	}
+	if bs.Options != nil {
+		if err := json.Unmarshal(bs.Options, &cfg.Options); err != nil {
+			return err
+		}
+	}
+
+	return cfg.Validate()
+}
@@ -0,0 +1,77 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
+)
+
+func TestApplyBootstrap(t *testing.T) {
+	me, _ := protocol.DeviceIDFromString("AIR6LPZ-7K4PTTV-UXQSMUU-CPQ5YWH-OEDFIIQ-JUG777G-2YQXXR5-YD6AWQR")
+	other, _ := protocol.DeviceIDFromString("I6KAH76-66SLLLB-5PFXSOA-UFJCDZC-YAOMLEK-CP2GB32-BV5RQST-3PSROAU")
+
+	apply := func(bs string) (config.Configuration, error) {
+		fd, err := ioutil.TempFile("", "bootstrap")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(fd.Name())
+		fd.WriteString(bs)
+		fd.Close()
+
+		cfg := config.New(me)
+		cfg.Devices = []config.DeviceConfiguration{{DeviceID: me, Addresses: []string{"dynamic"}}}
+		cfg.Folders = []config.FolderConfiguration{{ID: "default", RawPath: "testdata/default", Devices: []config.FolderDeviceConfiguration{{DeviceID: me}}}}
+		return cfg, applyBootstrap(&cfg, me, fd.Name())
+	}
+
+	cfg, err := apply(`{
+		"gui": {"address": "0.0.0.0:8385", "apiKey": "abc123", "users": [{"name": "admin", "password": "secret", "role": "admin"}]},
+		"options": {"maxRecvKbps": 100},
+		"devices": [{"deviceID": "` + other.String() + `", "name": "nas"}],
+		"folders": [{"id": "photos", "path": "testdata/photos", "devices": [{"deviceID": "` + other.String() + `"}]}]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.GUI.Address != "0.0.0.0:8385" || cfg.GUI.APIKey != "abc123" || !cfg.GUI.Enabled {
+		t.Errorf("unexpected GUI config %+v", cfg.GUI)
+	}
+	if u, ok := cfg.GUI.UserByName("admin"); !ok || u.Password == "secret" {
+		t.Errorf("user not added with a hashed password: %+v", u)
+	}
+	if cfg.Options.MaxRecvKbps != 100 || !cfg.Options.GlobalAnnEnabled {
+		t.Errorf("unexpected options %+v", cfg.Options)
+	}
+	if len(cfg.Devices) != 2 || cfg.Devices[1].Name != "nas" || cfg.Devices[1].Addresses[0] != "dynamic" {
+		t.Errorf("unexpected devices %+v", cfg.Devices)
+	}
+	if len(cfg.Folders) != 2 {
+		t.Fatalf("unexpected folders %+v", cfg.Folders)
+	}
+	if f := cfg.Folders[1]; f.ID != "photos" || f.RescanIntervalS != 60 || len(f.Devices) != 2 || f.Devices[1].DeviceID != me {
+		t.Errorf("unexpected folder %+v", f)
+	}
+
+	for _, bs := range []string{
+		`{"folders": [{"id": "photos", "path": "testdata/photos", "devices": [{"deviceID": "` + other.String() + `"}]}]}`,
+		`{"folders": [{"id": "photos"}]}`,
+		`{"devices": [{"name": "nas"}]}`,
+		`{"gui": {"address": "localhost"}}`,
+		`{"gui": `,
+	} {
+		if _, err := apply(bs); err == nil {
+			t.Errorf("%s: no error", bs)
+		}
+	}
+}
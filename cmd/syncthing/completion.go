@@ -0,0 +1,106 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// completionPaths are the flags taking a path, and whether it is a
+// directory ("dir") or a file ("file"). The values of the other flags are
+// not completed.
+var completionPaths = map[string]string{
+	"bootstrap": "file",
+	"generate":  "dir",
+	"home":      "dir",
+	"logfile":   "file",
+}
+
+// completionScript returns a script for the given shell ("bash" or "zsh")
+// completing the flags in the flag set.
+func completionScript(fs *flag.FlagSet, shell string) (string, error) {
+	switch shell {
+	case "bash":
+		return bashCompletion(fs), nil
+	case "zsh":
+		return zshCompletion(fs), nil
+	default:
+		return "", fmt.Errorf("unsupported shell %q; use bash or zsh", shell)
+	}
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	bf, ok := f.Value.(interface {
+		IsBoolFlag() bool
+	})
+	return ok && bf.IsBoolFlag()
+}
+
+func bashCompletion(fs *flag.FlagSet) string {
+	var names, dirs, files, values []string
+	fs.VisitAll(func(f *flag.Flag) {
+		names = append(names, "-"+f.Name)
+		switch {
+		case completionPaths[f.Name] == "dir":
+			dirs = append(dirs, "-"+f.Name)
+		case completionPaths[f.Name] == "file":
+			files = append(files, "-"+f.Name)
+		case !isBoolFlag(f):
+			values = append(values, "-"+f.Name)
+		}
+	})
+
+	var buf bytes.Buffer
+	buf.WriteString("# bash completion for syncthing\n")
+	buf.WriteString("# Generated by syncthing -generate-completion bash\n\n")
+	buf.WriteString("_syncthing()\n{\n")
+	buf.WriteString("\tlocal cur prev\n")
+	buf.WriteString("\tcur=\"${COMP_WORDS[COMP_CWORD]}\"\n")
+	buf.WriteString("\tprev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n\n")
+	buf.WriteString("\tcase \"$prev\" in\n")
+	if len(dirs) > 0 {
+		fmt.Fprintf(&buf, "\t%s)\n\t\tCOMPREPLY=( $(compgen -d -- \"$cur\") )\n\t\treturn 0\n\t\t;;\n", strings.Join(dirs, "|"))
+	}
+	if len(files) > 0 {
+		fmt.Fprintf(&buf, "\t%s)\n\t\tCOMPREPLY=( $(compgen -f -- \"$cur\") )\n\t\treturn 0\n\t\t;;\n", strings.Join(files, "|"))
+	}
+	if len(values) > 0 {
+		fmt.Fprintf(&buf, "\t%s)\n\t\treturn 0\n\t\t;;\n", strings.Join(values, "|"))
+	}
+	buf.WriteString("\tesac\n\n")
+	fmt.Fprintf(&buf, "\tCOMPREPLY=( $(compgen -W \"%s\" -- \"$cur\") )\n", strings.Join(names, " "))
+	buf.WriteString("}\n\n")
+	buf.WriteString("complete -F _syncthing syncthing\n")
+	return buf.String()
+}
+
+func zshCompletion(fs *flag.FlagSet) string {
+	var buf bytes.Buffer
+	buf.WriteString("#compdef syncthing\n")
+	buf.WriteString("# zsh completion for syncthing\n")
+	buf.WriteString("# Generated by syncthing -generate-completion zsh\n\n")
+	buf.WriteString("_arguments")
+
+	escaper := strings.NewReplacer("'", `'\''`, "[", `\[`, "]", `\]`)
+	fs.VisitAll(func(f *flag.Flag) {
+		spec := fmt.Sprintf("-%s[%s]", f.Name, escaper.Replace(f.Usage))
+		switch {
+		case completionPaths[f.Name] == "dir":
+			spec += ":directory:_files -/"
+		case completionPaths[f.Name] == "file":
+			spec += ":file:_files"
+		case !isBoolFlag(f):
+			spec += ":value: "
+		}
+		fmt.Fprintf(&buf, " \\\n\t'%s'", spec)
+	})
+	buf.WriteString("\n")
+	return buf.String()
+}
@@ -0,0 +1,57 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestCompletionScript(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Bool("verbose", false, "Print verbose log output")
+	fs.String("home", "", "Set configuration directory")
+	fs.String("logfile", "", "Log file name")
+	fs.String("gui-address", "", "Override GUI address [host:port]")
+
+	bash, err := completionScript(fs, "bash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		`compgen -W "-gui-address -home -logfile -verbose"`,
+		"\t-home)\n\t\tCOMPREPLY=( $(compgen -d",
+		"\t-logfile)\n\t\tCOMPREPLY=( $(compgen -f",
+		"\t-gui-address)\n\t\treturn 0",
+		"complete -F _syncthing syncthing",
+	} {
+		if !strings.Contains(bash, s) {
+			t.Errorf("bash completion lacks %q:\n%s", s, bash)
+		}
+	}
+
+	zsh, err := completionScript(fs, "zsh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"#compdef syncthing",
+		`'-verbose[Print verbose log output]'`,
+		`'-home[Set configuration directory]:directory:_files -/'`,
+		`'-logfile[Log file name]:file:_files'`,
+		`'-gui-address[Override GUI address \[host:port\]]:value: '`,
+	} {
+		if !strings.Contains(zsh, s) {
+			t.Errorf("zsh completion lacks %q:\n%s", s, zsh)
+		}
+	}
+
+	if _, err := completionScript(fs, "fish"); err == nil {
+		t.Error("unexpected nil error for unsupported shell")
+	}
+}
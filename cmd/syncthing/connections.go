@@ -17,10 +17,33 @@ import (
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/events"
+	"github.com/syncthing/syncthing/internal/faults"
 	"github.com/syncthing/syncthing/internal/model"
+	"github.com/syncthing/syncthing/internal/sync"
 	"github.com/thejerf/suture"
 )
 
+// A connection is an established TLS connection to a device, along with
+// what we learned about it while setting it up.
+type connection struct {
+	*tls.Conn
+	lan bool
+}
+
+// IsLAN returns true if the connection is to a device on the local network
+// and hence not subject to rate limiting.
+func (c connection) IsLAN() bool {
+	return c.lan
+}
+
+// An intermediateConnection is a TLS connection that has yet to be verified
+// and handed to the model, along with the rate limiting class of the
+// listener that accepted it.
+type intermediateConnection struct {
+	*tls.Conn
+	rateLimit string
+}
+
 // The connection service listens on TLS and dials configured unconnected
 // devices. Successful connections are handed to the model.
 type connectionSvc struct {
@@ -29,7 +52,19 @@ type connectionSvc struct {
 	myID   protocol.DeviceID
 	model  *model.Model
 	tlsCfg *tls.Config
-	conns  chan *tls.Conn
+	conns  chan intermediateConnection
+
+	listeners    map[config.ListenerConfiguration]runningListener
+	listenersMut sync.Mutex
+
+	pauseWAN bool                            // no connections outside the local network
+	wanConns map[protocol.DeviceID]io.Closer // connections outside the local network
+	wanMut   sync.Mutex                      // protects pauseWAN and wanConns
+}
+
+type runningListener struct {
+	svc   *listenerSvc
+	token suture.ServiceToken
 }
 
 func newConnectionSvc(cfg *config.Wrapper, myID protocol.DeviceID, model *model.Model, tlsCfg *tls.Config) *connectionSvc {
@@ -39,7 +74,13 @@ func newConnectionSvc(cfg *config.Wrapper, myID protocol.DeviceID, model *model.
 		myID:       myID,
 		model:      model,
 		tlsCfg:     tlsCfg,
-		conns:      make(chan *tls.Conn),
+		conns:      make(chan intermediateConnection),
+
+		listeners:    make(map[config.ListenerConfiguration]runningListener),
+		listenersMut: sync.NewMutex(),
+
+		wanConns: make(map[protocol.DeviceID]io.Closer),
+		wanMut:   sync.NewMutex(),
 	}
 
 	// There are several moving parts here; one routine per listening address
@@ -53,8 +94,8 @@ func newConnectionSvc(cfg *config.Wrapper, myID protocol.DeviceID, model *model.
 	//    Incoming    | +---------------+-+      +-----------------+
 	//   Connections  | |                 |      |                 |   Outgoing
 	// -------------->| |   svc.listen    |      |                 |  Connections
-	//                | |  (1 per listen  |      |   svc.connect   |-------------->
-	//                | |    address)     |      |                 |
+	//                | |  (1 per enabled |      |   svc.connect   |-------------->
+	//                | |    listener)    |      |                 |
 	//                +-+                 |      |                 |
 	//                  +-----------------+      +-----------------+
 	//                           v                        v
@@ -73,23 +114,59 @@ func newConnectionSvc(cfg *config.Wrapper, myID protocol.DeviceID, model *model.
 	//                               +-----------------+
 	//
 	// TODO: Clean shutdown, and/or handling config changes on the fly. We
-	// partly do this now - new devices and addresses will be picked up, but
-	// not new listen addresses and we don't support disconnecting devices
-	// that are removed and so on...
+	// partly do this now - new devices, addresses and listeners will be
+	// picked up, but we don't support disconnecting devices that are
+	// removed and so on...
 
 	svc.Add(serviceFunc(svc.connect))
-	for _, addr := range svc.cfg.Options().ListenAddress {
-		addr := addr
-		listener := serviceFunc(func() {
-			svc.listen(addr)
-		})
-		svc.Add(listener)
-	}
+	svc.updateListeners(cfg.Options().Listeners)
 	svc.Add(serviceFunc(svc.handle))
 
+	// Listen to future config changes so that we can rebind the listeners.
+	cfg.Subscribe(svc)
+
 	return svc
 }
 
+func (s *connectionSvc) Changed(cfg config.Configuration) error {
+	s.updateListeners(cfg.Options.Listeners)
+	return nil
+}
+
+// updateListeners starts listening for the enabled listeners not already
+// running and stops those that are no longer configured. A listener whose
+// settings have changed is stopped and started anew.
+func (s *connectionSvc) updateListeners(listeners []config.ListenerConfiguration) {
+	s.listenersMut.Lock()
+	defer s.listenersMut.Unlock()
+
+	wanted := make(map[config.ListenerConfiguration]bool)
+	for _, lc := range listeners {
+		if lc.Enabled {
+			wanted[lc] = true
+		}
+	}
+
+	for lc, running := range s.listeners {
+		if wanted[lc] {
+			continue
+		}
+		l.Infoln("Stopped listening on", lc.Address)
+		s.Remove(running.token)
+		// Stop it right away, as a new listener may want the address.
+		running.svc.Stop()
+		delete(s.listeners, lc)
+	}
+
+	for lc := range wanted {
+		if _, ok := s.listeners[lc]; ok {
+			continue
+		}
+		svc := newListenerSvc(s, lc)
+		s.listeners[lc] = runningListener{svc, s.Add(svc)}
+	}
+}
+
 func (s *connectionSvc) handle() {
 next:
 	for conn := range s.conns {
@@ -155,26 +232,45 @@ next:
 					continue next
 				}
 
+				// The device may be restricted to certain networks.
+				if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && !deviceCfg.AllowsIP(tcpAddr.IP) {
+					l.Infof("Connection from %s at %s is not in an allowed network", remoteID, conn.RemoteAddr())
+					conn.Close()
+					continue next
+				}
+
+				// Connections outside the local network are paused while
+				// on a metered network.
+				lan := isLANAddr(conn.RemoteAddr())
+				if !lan && s.wanPaused() {
+					l.Infof("Not connecting to %s at %s while on a metered network", remoteID, conn.RemoteAddr())
+					conn.Close()
+					continue next
+				}
+
 				// If rate limiting is set, and based on the address we should
 				// limit the connection, then we wrap it in a limiter.
 
-				limit := s.shouldLimit(conn.RemoteAddr())
+				limit := s.shouldLimit(conn.RemoteAddr(), conn.rateLimit)
 
 				wr := io.Writer(conn)
 				if limit && writeRateLimit != nil {
 					wr = &limitedWriter{conn, writeRateLimit}
 				}
 
+				wr = faults.Default.Writer(wr, conn)
+
 				rd := io.Reader(conn)
 				if limit && readRateLimit != nil {
 					rd = &limitedReader{conn, readRateLimit}
 				}
 
 				name := fmt.Sprintf("%s-%s", conn.LocalAddr(), conn.RemoteAddr())
-				protoConn := protocol.NewConnection(remoteID, rd, wr, s.model, name, deviceCfg.Compression)
+				pingIdle, pingTimeout := deviceCfg.PingTimes(s.cfg.Options())
+				protoConn := protocol.NewConnectionWithPing(remoteID, rd, wr, s.model, name, deviceCfg.Compression, pingIdle, pingTimeout)
 
 				l.Infof("Established secure connection to %s at %s", remoteID, name)
-				if debugNet {
+				if debugNet.On() {
 					l.Debugf("cipher suite: %04X in lan: %t", conn.ConnectionState().CipherSuite, !limit)
 				}
 				events.Default.Log(events.DeviceConnected, map[string]string{
@@ -182,7 +278,8 @@ next:
 					"addr": conn.RemoteAddr().String(),
 				})
 
-				s.model.AddConnection(conn, protoConn)
+				s.model.AddConnection(connection{conn.Conn, !limit}, protoConn)
+				s.trackWAN(remoteID, conn, lan)
 				continue next
 			}
 		}
@@ -201,35 +298,72 @@ next:
 	}
 }
 
-func (s *connectionSvc) listen(addr string) {
-	if debugNet {
-		l.Debugln("listening on", addr)
+// A listenerSvc accepts incoming connections for one listener, handing
+// them to the connection service, until stopped.
+type listenerSvc struct {
+	svc      *connectionSvc
+	lc       config.ListenerConfiguration
+	listener *net.TCPListener
+	stop     chan struct{}
+	mut      sync.Mutex // protects listener and stop
+}
+
+func newListenerSvc(svc *connectionSvc, lc config.ListenerConfiguration) *listenerSvc {
+	return &listenerSvc{
+		svc:  svc,
+		lc:   lc,
+		stop: make(chan struct{}),
+		mut:  sync.NewMutex(),
 	}
+}
 
-	tcaddr, err := net.ResolveTCPAddr("tcp", addr)
-	if err != nil {
-		l.Fatalln("listen (BEP):", err)
+func (s *listenerSvc) Serve() {
+	if debugNet.On() {
+		l.Debugln("listening on", s.lc.Address)
 	}
-	listener, err := net.ListenTCP("tcp", tcaddr)
+
+	listener, err := s.bind()
 	if err != nil {
-		l.Fatalln("listen (BEP):", err)
+		// There's no point in retrying; the listener is replaced when the
+		// configuration changes.
+		l.Warnln("Listen (BEP):", err)
+		<-s.stop
+		return
 	}
 
+	s.mut.Lock()
+	select {
+	case <-s.stop:
+		s.mut.Unlock()
+		listener.Close()
+		return
+	default:
+	}
+	s.listener = listener
+	s.mut.Unlock()
+
+	l.Infoln("Listening for connections on", s.lc.Address)
+
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			select {
+			case <-s.stop:
+				return
+			default:
+			}
 			l.Warnln("Accepting connection:", err)
 			continue
 		}
 
-		if debugNet {
+		if debugNet.On() {
 			l.Debugln("connect from", conn.RemoteAddr())
 		}
 
 		tcpConn := conn.(*net.TCPConn)
-		s.setTCPOptions(tcpConn)
+		s.svc.setTCPOptions(tcpConn)
 
-		tc := tls.Server(conn, s.tlsCfg)
+		tc := tls.Server(conn, s.svc.tlsCfg)
 		err = tc.Handshake()
 		if err != nil {
 			l.Infoln("TLS handshake:", err)
@@ -237,12 +371,46 @@ func (s *connectionSvc) listen(addr string) {
 			continue
 		}
 
-		s.conns <- tc
+		s.svc.conns <- intermediateConnection{tc, s.lc.RateLimit}
+	}
+}
+
+func (s *listenerSvc) Stop() {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	select {
+	case <-s.stop:
+		// Already stopped
+		return
+	default:
+	}
+	close(s.stop)
+	if s.listener != nil {
+		s.listener.Close()
+	}
+}
+
+// bind returns the socket passed on by the monitor process for the address,
+// if there is one, or a newly opened one.
+func (s *listenerSvc) bind() (*net.TCPListener, error) {
+	if listener, ok := inheritedListener(s.lc.Address); ok {
+		if debugNet.On() {
+			l.Debugln("using inherited listener for", s.lc.Address)
+		}
+		return listener, nil
+	}
+
+	tcaddr, err := net.ResolveTCPAddr("tcp", s.lc.Address)
+	if err != nil {
+		return nil, err
 	}
+	return net.ListenTCP("tcp", tcaddr)
 }
 
 func (s *connectionSvc) connect() {
 	delay := time.Second
+	prio := newDialPriority()
 	for {
 	nextDevice:
 		for deviceID, deviceCfg := range s.cfg.Devices() {
@@ -254,62 +422,32 @@ func (s *connectionSvc) connect() {
 				continue
 			}
 
-			var addrs []string
-			for _, addr := range deviceCfg.Addresses {
-				if addr == "dynamic" {
-					if discoverer != nil {
-						t := discoverer.Lookup(deviceID)
-						if len(t) == 0 {
-							continue
-						}
-						addrs = append(addrs, t...)
-					}
-				} else {
-					addrs = append(addrs, addr)
+			var lookup func() []string
+			if discoverer != nil {
+				lookup = func() []string {
+					return discoverer.Lookup(deviceID)
 				}
 			}
 
-			for _, addr := range addrs {
-				host, port, err := net.SplitHostPort(addr)
-				if err != nil && strings.HasPrefix(err.Error(), "missing port") {
-					// addr is on the form "1.2.3.4"
-					addr = net.JoinHostPort(addr, "22000")
-				} else if err == nil && port == "" {
-					// addr is on the form "1.2.3.4:"
-					addr = net.JoinHostPort(host, "22000")
-				}
-				if debugNet {
-					l.Debugln("dial", deviceCfg.DeviceID, addr)
-				}
-
-				raddr, err := net.ResolveTCPAddr("tcp", addr)
-				if err != nil {
-					if debugNet {
-						l.Debugln(err)
+			// The address classes are tried in the configured order.
+			retry := time.Duration(s.cfg.Options().ReconnectIntervalS) * time.Second
+			classes := addressClasses(deviceCfg.Addresses, lookup)
+			for i, class := range classes {
+				if prio.skip(deviceID, classes, i, time.Now()) {
+					if debugNet.On() {
+						l.Debugln("not dialing", deviceCfg.DeviceID, class.entry, "as it failed recently")
 					}
 					continue
 				}
 
-				conn, err := net.DialTCP("tcp", nil, raddr)
-				if err != nil {
-					if debugNet {
-						l.Debugln(err)
+				for _, addr := range class.addrs {
+					if tc := s.dial(deviceCfg, addr); tc != nil {
+						prio.connected(deviceID, class.entry)
+						s.conns <- intermediateConnection{tc, config.RateLimitAuto}
+						continue nextDevice
 					}
-					continue
-				}
-
-				s.setTCPOptions(conn)
-
-				tc := tls.Client(conn, s.tlsCfg)
-				err = tc.Handshake()
-				if err != nil {
-					l.Infoln("TLS handshake:", err)
-					tc.Close()
-					continue
 				}
-
-				s.conns <- tc
-				continue nextDevice
+				prio.failed(deviceID, class.entry, retry, time.Now())
 			}
 		}
 
@@ -321,6 +459,97 @@ func (s *connectionSvc) connect() {
 	}
 }
 
+// dial returns a TLS connection to the device at the given address, or nil
+// if it could not be established.
+func (s *connectionSvc) dial(deviceCfg config.DeviceConfiguration, addr string) *tls.Conn {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil && strings.HasPrefix(err.Error(), "missing port") {
+		// addr is on the form "1.2.3.4"
+		addr = net.JoinHostPort(addr, "22000")
+	} else if err == nil && port == "" {
+		// addr is on the form "1.2.3.4:"
+		addr = net.JoinHostPort(host, "22000")
+	}
+	if debugNet.On() {
+		l.Debugln("dial", deviceCfg.DeviceID, addr)
+	}
+
+	raddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		if debugNet.On() {
+			l.Debugln(err)
+		}
+		return nil
+	}
+
+	if !deviceCfg.AllowsIP(raddr.IP) {
+		if debugNet.On() {
+			l.Debugln("not dialing", deviceCfg.DeviceID, raddr, "outside allowed networks")
+		}
+		return nil
+	}
+
+	if s.wanPaused() && !isLANAddr(raddr) {
+		if debugNet.On() {
+			l.Debugln("not dialing", deviceCfg.DeviceID, raddr, "on a metered network")
+		}
+		return nil
+	}
+
+	conn, err := net.DialTCP("tcp", nil, raddr)
+	if err != nil {
+		if debugNet.On() {
+			l.Debugln(err)
+		}
+		return nil
+	}
+
+	s.setTCPOptions(conn)
+
+	tc := tls.Client(conn, s.tlsCfg)
+	err = tc.Handshake()
+	if err != nil {
+		l.Infoln("TLS handshake:", err)
+		tc.Close()
+		return nil
+	}
+	return tc
+}
+
+// setWANPaused pauses or resumes connections to devices outside the local
+// network. When pausing, the existing connections are closed.
+func (s *connectionSvc) setWANPaused(paused bool) {
+	s.wanMut.Lock()
+	defer s.wanMut.Unlock()
+
+	s.pauseWAN = paused
+	if paused {
+		for deviceID, conn := range s.wanConns {
+			conn.Close()
+			delete(s.wanConns, deviceID)
+		}
+	}
+}
+
+func (s *connectionSvc) wanPaused() bool {
+	s.wanMut.Lock()
+	defer s.wanMut.Unlock()
+	return s.pauseWAN
+}
+
+// trackWAN remembers the connection to the given device if it's outside the
+// local network, to be closed when pausing.
+func (s *connectionSvc) trackWAN(deviceID protocol.DeviceID, conn io.Closer, lan bool) {
+	s.wanMut.Lock()
+	defer s.wanMut.Unlock()
+
+	if lan {
+		delete(s.wanConns, deviceID)
+	} else {
+		s.wanConns[deviceID] = conn
+	}
+}
+
 func (*connectionSvc) setTCPOptions(conn *net.TCPConn) {
 	var err error
 	if err = conn.SetLinger(0); err != nil {
@@ -337,19 +566,17 @@ func (*connectionSvc) setTCPOptions(conn *net.TCPConn) {
 	}
 }
 
-func (s *connectionSvc) shouldLimit(addr net.Addr) bool {
-	if s.cfg.Options().LimitBandwidthInLan {
+func (s *connectionSvc) shouldLimit(addr net.Addr, rateLimit string) bool {
+	switch rateLimit {
+	case config.RateLimitAlways:
 		return true
+	case config.RateLimitNever:
+		return false
 	}
 
-	tcpaddr, ok := addr.(*net.TCPAddr)
-	if !ok {
+	if s.cfg.Options().LimitBandwidthInLan {
 		return true
 	}
-	for _, lan := range lans {
-		if lan.Contains(tcpaddr.IP) {
-			return false
-		}
-	}
-	return !tcpaddr.IP.IsLoopback()
+
+	return !isLANAddr(addr)
 }
@@ -0,0 +1,145 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/sync"
+	"github.com/thejerf/suture"
+)
+
+func TestUpdateListeners(t *testing.T) {
+	// Find a free port to listen on.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	svc := &connectionSvc{
+		Supervisor:   suture.NewSimple("connectionSvc"),
+		tlsCfg:       &tls.Config{},
+		conns:        make(chan intermediateConnection),
+		listeners:    make(map[config.ListenerConfiguration]runningListener),
+		listenersMut: sync.NewMutex(),
+	}
+	svc.ServeBackground()
+	defer svc.Stop()
+
+	listening := func() bool {
+		for i := 0; i < 50; i++ {
+			conn, err := net.Dial("tcp", addr)
+			if err == nil {
+				conn.Close()
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+
+	lc := config.ListenerConfiguration{Address: addr, Enabled: true}
+	svc.updateListeners([]config.ListenerConfiguration{lc})
+	if !listening() {
+		t.Fatal("not listening")
+	}
+
+	// Changing the listener settings rebinds the same address.
+	lc.RateLimit = config.RateLimitAlways
+	svc.updateListeners([]config.ListenerConfiguration{lc})
+	if !listening() {
+		t.Fatal("not listening after change")
+	}
+	if len(svc.listeners) != 1 {
+		t.Errorf("unexpected number of listeners %d", len(svc.listeners))
+	}
+
+	svc.updateListeners(nil)
+	if len(svc.listeners) != 0 {
+		t.Errorf("unexpected number of listeners %d", len(svc.listeners))
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Error("still listening after removal")
+	}
+}
+
+type closeCounter int
+
+func (c *closeCounter) Close() error {
+	*c++
+	return nil
+}
+
+func TestWANPaused(t *testing.T) {
+	svc := &connectionSvc{
+		wanConns: make(map[protocol.DeviceID]io.Closer),
+		wanMut:   sync.NewMutex(),
+	}
+
+	device1 := protocol.DeviceID{1}
+	device2 := protocol.DeviceID{2}
+
+	var wan, lan closeCounter
+	svc.trackWAN(device1, &wan, false)
+	svc.trackWAN(device2, &lan, true)
+
+	svc.setWANPaused(true)
+	if !svc.wanPaused() {
+		t.Error("Not paused")
+	}
+	if wan != 1 || lan != 0 {
+		t.Errorf("Closed %d WAN and %d LAN connections, expected 1 and 0", wan, lan)
+	}
+
+	svc.setWANPaused(false)
+	if svc.wanPaused() {
+		t.Error("Still paused")
+	}
+	if wan != 1 {
+		t.Errorf("WAN connection closed %d times, expected once", wan)
+	}
+
+	if !isLANAddr(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 22000}) {
+		t.Error("Loopback address is not on the LAN")
+	}
+}
+
+func TestIsLANIP(t *testing.T) {
+	alwaysLocal := []string{"100.64.0.0/10", "invalid"}
+	cases := []struct {
+		ip  string
+		lan bool
+	}{
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"172.32.0.1", false},
+		{"192.168.1.1", true},
+		{"169.254.1.1", true},
+		{"fd12:3456::1", true},
+		{"fe80::1", true},
+		{"100.64.1.1", true},
+		{"100.128.1.1", false},
+		{"8.8.8.8", false},
+		{"2001:4860:4860::8888", false},
+	}
+	for _, tc := range cases {
+		if lan := isLANIP(net.ParseIP(tc.ip), alwaysLocal); lan != tc.lan {
+			t.Errorf("%s: LAN %v, expected %v", tc.ip, lan, tc.lan)
+		}
+	}
+}
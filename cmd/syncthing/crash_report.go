@@ -0,0 +1,90 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
+)
+
+const (
+	maxCrashReportSize = 1 << 20 // larger panic logs are truncated
+	crashReportTimeout = 30 * time.Second
+)
+
+// A crashReport is what gets sent to the crash reporting server. It contains
+// the panic log and enough information to know what it applies to, but
+// nothing identifying the user or device.
+type crashReport struct {
+	Version     string `json:"version"`
+	LongVersion string `json:"longVersion"`
+	Platform    string `json:"platform"`
+	Log         string `json:"log"`
+}
+
+// maybeReportCrash uploads the given panic log, if the user has enabled
+// crash reporting. The configuration is read anew from disk, as the monitor
+// process does not otherwise load it.
+func maybeReportCrash(panicLog string) {
+	cfg, err := config.Load(locations[locConfigFile], protocol.LocalDeviceID)
+	if err != nil {
+		l.Infoln("Crash report: loading config:", err)
+		return
+	}
+	opts := cfg.Options()
+	if !opts.CREnabled || opts.CRURL == "" {
+		return
+	}
+
+	if err := sendCrashReport(opts.CRURL, panicLog); err != nil {
+		l.Infoln("Crash report:", err)
+		return
+	}
+	l.Infof("Crash report for %q sent", panicLog)
+}
+
+func sendCrashReport(url, panicLog string) error {
+	fd, err := os.Open(panicLog)
+	if err != nil {
+		return err
+	}
+	var log bytes.Buffer
+	_, err = io.Copy(&log, io.LimitReader(fd, maxCrashReportSize))
+	fd.Close()
+	if err != nil {
+		return err
+	}
+
+	report := crashReport{
+		Version:     Version,
+		LongVersion: LongVersion,
+		Platform:    runtime.GOOS + "-" + runtime.GOARCH,
+		Log:         log.String(),
+	}
+	var b bytes.Buffer
+	json.NewEncoder(&b).Encode(report)
+
+	client := &http.Client{Timeout: crashReportTimeout}
+	resp, err := client.Post(url, "application/json", &b)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestSendCrashReport(t *testing.T) {
+	var received crashReport
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			http.Error(w, err.Error(), 400)
+		}
+	}))
+	defer srv.Close()
+
+	fd, err := ioutil.TempFile("", "panic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	fd.WriteString("panic: test\n")
+	fd.Close()
+
+	if err := sendCrashReport(srv.URL, fd.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if received.Log != "panic: test\n" {
+		t.Errorf("unexpected log %q", received.Log)
+	}
+	if received.Version != Version {
+		t.Errorf("unexpected version %q", received.Version)
+	}
+}
@@ -9,9 +9,18 @@ package main
 import (
 	"os"
 	"strings"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/trace"
 )
 
 var (
-	debugNet  = strings.Contains(os.Getenv("STTRACE"), "net") || os.Getenv("STTRACE") == "all"
-	debugHTTP = strings.Contains(os.Getenv("STTRACE"), "http") || os.Getenv("STTRACE") == "all"
+	debugNet  = trace.NewFlag(strings.Contains(os.Getenv("STTRACE"), "net") || os.Getenv("STTRACE") == "all")
+	debugHTTP = trace.NewFlag(strings.Contains(os.Getenv("STTRACE"), "http") || os.Getenv("STTRACE") == "all")
 )
+
+func init() {
+	trace.Register("net", "The main package; connections and network messages", debugNet)
+	trace.Register("http", "The main package; HTTP requests", debugHTTP)
+	trace.Register("protocol", "The protocol package; messages to and from devices", protocol.Debug())
+}
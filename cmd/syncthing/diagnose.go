@@ -0,0 +1,201 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/discover"
+)
+
+const diagnoseDialTimeout = 10 * time.Second
+
+// A diagnosisStep is the outcome of one step in connecting to a device.
+type diagnosisStep struct {
+	Step   string `json:"step"`
+	OK     bool   `json:"ok"`
+	Result string `json:"result"`
+}
+
+// diagnoseConnection goes through the same steps as the connection service
+// when connecting to the given device and reports the outcome of each. The
+// connection, if one is established, is closed again without being handed to
+// the model. Both disc and connected may be nil.
+func diagnoseConnection(cfg *config.Wrapper, tlsCfg *tls.Config, disc *discover.Discoverer, connected func(protocol.DeviceID) bool, deviceID protocol.DeviceID) []diagnosisStep {
+	var steps []diagnosisStep
+	step := func(name string, ok bool, format string, args ...interface{}) {
+		steps = append(steps, diagnosisStep{name, ok, fmt.Sprintf(format, args...)})
+	}
+
+	deviceCfg, ok := cfg.Devices()[deviceID]
+	if !ok {
+		step("configuration", false, "device %s is not configured", deviceID)
+		return steps
+	}
+	step("configuration", true, "device %s is configured with addresses %s", deviceID, strings.Join(deviceCfg.Addresses, ", "))
+
+	if connected != nil && connected(deviceID) {
+		step("connection", true, "already connected")
+	}
+
+	var addrs []string
+	for _, addr := range deviceCfg.Addresses {
+		if addr != "dynamic" {
+			addrs = append(addrs, addr)
+			continue
+		}
+
+		if disc == nil {
+			step("discovery", false, "discovery is not running")
+			continue
+		}
+
+		if cached := disc.All()[deviceID]; len(cached) > 0 {
+			var cachedAddrs []string
+			for _, entry := range cached {
+				cachedAddrs = append(cachedAddrs, fmt.Sprintf("%s (seen %s)", entry.Address, entry.Seen.Format(time.RFC3339)))
+			}
+			step("discovery cache", true, "%s", strings.Join(cachedAddrs, ", "))
+			for _, entry := range cached {
+				addrs = append(addrs, entry.Address)
+			}
+		}
+
+		servers := disc.LookupEach(deviceID)
+		if len(servers) == 0 {
+			step("global discovery", false, "no global discovery servers")
+		}
+		for server, found := range servers {
+			if len(found) == 0 {
+				step("global discovery "+server, false, "device not known")
+				continue
+			}
+			step("global discovery "+server, true, "%s", strings.Join(found, ", "))
+			addrs = append(addrs, found...)
+		}
+	}
+
+	if len(addrs) == 0 {
+		step("addresses", false, "no addresses to try")
+		return steps
+	}
+
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil && strings.HasPrefix(err.Error(), "missing port") {
+			addr = net.JoinHostPort(addr, "22000")
+		} else if err == nil && port == "" {
+			addr = net.JoinHostPort(host, "22000")
+		}
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+
+		raddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			step("resolve "+addr, false, "%v", err)
+			continue
+		}
+		step("resolve "+addr, true, "%s", raddr)
+
+		if !deviceCfg.AllowsIP(raddr.IP) {
+			step("allowed networks "+addr, false, "%s is outside the allowed networks", raddr.IP)
+			continue
+		}
+		if pausedOnMetered() && !isLANAddr(raddr) {
+			step("metered network "+addr, false, "not connecting outside the LAN on a metered network")
+			continue
+		}
+
+		conn, err := net.DialTimeout("tcp", raddr.String(), diagnoseDialTimeout)
+		if err != nil {
+			step("dial "+addr, false, "%v", err)
+			continue
+		}
+		step("dial "+addr, true, "connected from %s", conn.LocalAddr())
+
+		tc := tls.Client(conn, tlsCfg)
+		tc.SetDeadline(time.Now().Add(diagnoseDialTimeout))
+		err = tc.Handshake()
+		if err != nil {
+			step("TLS handshake "+addr, false, "%v", err)
+			tc.Close()
+			continue
+		}
+		cs := tc.ConnectionState()
+		tc.Close()
+		step("TLS handshake "+addr, true, "negotiated protocol %q", cs.NegotiatedProtocol)
+
+		if cl := len(cs.PeerCertificates); cl != 1 {
+			step("certificate "+addr, false, "got %d peer certificates, expected exactly one", cl)
+			continue
+		}
+		remoteCert := cs.PeerCertificates[0]
+		remoteID := protocol.NewDeviceID(remoteCert.Raw)
+		if remoteID != deviceID {
+			step("device ID "+addr, false, "remote device ID is %s, expected %s", remoteID, deviceID)
+			continue
+		}
+		step("device ID "+addr, true, "%s", remoteID)
+
+		certName := deviceCfg.CertName
+		if certName == "" {
+			certName = tlsDefaultCommonName
+		}
+		if err := remoteCert.VerifyHostname(certName); err != nil {
+			step("certificate name "+addr, false, "certificate with common name %q is not valid for %q: %v", remoteCert.Subject.CommonName, certName, err)
+			continue
+		}
+		step("certificate name "+addr, true, "%q", certName)
+	}
+
+	return steps
+}
+
+// diagnoseMain runs the connection diagnosis on the command line, using the
+// configuration and certificate from the configuration directory, and prints
+// the result.
+func diagnoseMain(device string) {
+	deviceID, err := protocol.DeviceIDFromString(device)
+	if err != nil {
+		l.Fatalln("Device ID:", err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(locations[locCertFile], locations[locKeyFile])
+	if err != nil {
+		l.Fatalln("Load cert:", err)
+	}
+	myID = protocol.NewDeviceID(cert.Certificate[0])
+
+	cfg, err := config.Load(locations[locConfigFile], myID)
+	if err != nil {
+		l.Fatalln("Configuration:", err)
+	}
+
+	var disc *discover.Discoverer
+	if opts := cfg.Options(); opts.GlobalAnnEnabled {
+		disc = discover.NewDiscoverer(myID, nil)
+		disc.StartLookups(opts.GlobalAnnServers)
+		defer disc.StopGlobal()
+	}
+
+	for _, s := range diagnoseConnection(cfg, newTLSConfig(cert, cfg.Options()), disc, nil, deviceID) {
+		status := "OK"
+		if !s.OK {
+			status = "FAIL"
+		}
+		fmt.Printf("%-4s %s: %s\n", status, s.Step, s.Result)
+	}
+}
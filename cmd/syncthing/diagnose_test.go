@@ -0,0 +1,75 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
+)
+
+func TestDiagnoseConnection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diagnose")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert, err := newCertificate(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), tlsDefaultCommonName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsCfg := newTLSConfig(cert, config.New(protocol.DeviceID{}).Options)
+	remoteID := protocol.NewDeviceID(cert.Certificate[0])
+
+	lst, err := tls.Listen("tcp", "127.0.0.1:0", tlsCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lst.Close()
+	go func() {
+		for {
+			conn, err := lst.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	addr := lst.Addr().String()
+
+	last := func(deviceCfg config.DeviceConfiguration) diagnosisStep {
+		cfg := config.Wrap("/tmp/test", config.Configuration{
+			Devices: []config.DeviceConfiguration{deviceCfg},
+		})
+		steps := diagnoseConnection(cfg, tlsCfg, nil, nil, deviceCfg.DeviceID)
+		return steps[len(steps)-1]
+	}
+
+	cfg := config.Wrap("/tmp/test", config.Configuration{})
+	if steps := diagnoseConnection(cfg, tlsCfg, nil, nil, remoteID); len(steps) != 1 || steps[0].OK {
+		t.Error("Unconfigured device should fail at once:", steps)
+	}
+
+	if s := last(config.DeviceConfiguration{DeviceID: remoteID, Addresses: []string{"dynamic"}}); s.Step != "addresses" || s.OK {
+		t.Error("Expected no addresses without discovery, got", s)
+	}
+
+	if s := last(config.DeviceConfiguration{DeviceID: protocol.DeviceID{1}, Addresses: []string{addr}}); s.Step != "device ID "+addr || s.OK {
+		t.Error("Expected device ID mismatch, got", s)
+	}
+
+	if s := last(config.DeviceConfiguration{DeviceID: remoteID, Addresses: []string{addr}, CertName: "other"}); s.Step != "certificate name "+addr || s.OK {
+		t.Error("Expected certificate name mismatch, got", s)
+	}
+}
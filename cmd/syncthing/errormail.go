@@ -0,0 +1,233 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/model"
+)
+
+const (
+	errorMailCheckInterval = time.Minute
+	errorMailMaxItems      = 20 // failing items listed per folder
+)
+
+// The folderErrorSource is the part of the model the errorMailer looks at.
+type folderErrorSource interface {
+	State(folder string) (string, time.Time, error)
+	FolderErrors(folder string) ([]model.FileError, error)
+}
+
+// A folderProblem tracks since when a folder has been stopped by an error,
+// and since when items in it have been failing to sync, and whether this has
+// been mailed about yet.
+type folderProblem struct {
+	err         string
+	errSince    time.Time
+	errMailed   bool
+	items       []model.FileError
+	itemsSince  time.Time
+	itemsMailed bool
+}
+
+// The errorMailer sends a mail to the configured recipients when a folder
+// remains in an error state, or items keep failing to sync, for longer than
+// the configured delay. Problems are mailed about once, in a digest of those
+// that became due at the same check; a problem that clears and comes back is
+// mailed about again.
+type errorMailer struct {
+	cfg      *config.Wrapper
+	source   folderErrorSource
+	send     func(opts config.OptionsConfiguration, subject, body string) error
+	stop     chan struct{}
+	problems map[string]*folderProblem
+}
+
+func newErrorMailer(cfg *config.Wrapper, source folderErrorSource) *errorMailer {
+	return &errorMailer{
+		cfg:      cfg,
+		source:   source,
+		send:     sendMail,
+		stop:     make(chan struct{}),
+		problems: make(map[string]*folderProblem),
+	}
+}
+
+func (e *errorMailer) Serve() {
+	t := time.NewTicker(errorMailCheckInterval)
+	defer t.Stop()
+
+	warned := false
+	for {
+		select {
+		case <-t.C:
+		case <-e.stop:
+			return
+		}
+
+		opts := e.cfg.Options()
+		if opts.SMTPServer == "" || len(opts.SMTPRecipients) == 0 {
+			// Start over if mailing is enabled again later, rather than
+			// mailing about whatever happened meanwhile all at once.
+			e.problems = make(map[string]*folderProblem)
+			continue
+		}
+
+		e.update(time.Now(), opts.SMTPSeverity)
+		subject, body, mailed := e.digest(time.Now(), opts)
+		if body == "" {
+			continue
+		}
+		if err := e.send(opts, subject, body); err != nil {
+			// Try again at the next check, but only say so once.
+			if !warned {
+				l.Warnln("Sending error mail:", err)
+				warned = true
+			}
+			continue
+		}
+		warned = false
+		for _, flag := range mailed {
+			*flag = true
+		}
+	}
+}
+
+func (e *errorMailer) Stop() {
+	close(e.stop)
+}
+
+// update records the current problems of the configured folders.
+func (e *errorMailer) update(now time.Time, severity string) {
+	folders := e.cfg.Folders()
+	for id := range e.problems {
+		if _, ok := folders[id]; !ok {
+			delete(e.problems, id)
+		}
+	}
+
+	for id := range folders {
+		p, ok := e.problems[id]
+		if !ok {
+			p = &folderProblem{}
+			e.problems[id] = p
+		}
+
+		if _, _, err := e.source.State(id); err != nil {
+			if p.errSince.IsZero() {
+				p.errSince = now
+			}
+			p.err = err.Error()
+		} else {
+			p.err = ""
+			p.errSince = time.Time{}
+			p.errMailed = false
+		}
+
+		var items []model.FileError
+		if severity == "warning" {
+			items, _ = e.source.FolderErrors(id)
+		}
+		if len(items) > 0 {
+			if p.itemsSince.IsZero() {
+				p.itemsSince = now
+			}
+			p.items = items
+		} else {
+			p.items = nil
+			p.itemsSince = time.Time{}
+			p.itemsMailed = false
+		}
+	}
+}
+
+// digest returns the mail about the problems that have persisted past the
+// delay and not been mailed about yet, and the flags to set once it has been
+// sent. The body is empty if there is nothing to mail about.
+func (e *errorMailer) digest(now time.Time, opts config.OptionsConfiguration) (string, string, []*bool) {
+	delay := time.Duration(opts.SMTPErrorDelayM) * time.Minute
+	folders := e.cfg.Folders()
+
+	var ids []string
+	for id := range e.problems {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var buf bytes.Buffer
+	var mailed []*bool
+	for _, id := range ids {
+		p := e.problems[id]
+		path := folders[id].RawPath
+
+		if !p.errSince.IsZero() && !p.errMailed && now.Sub(p.errSince) >= delay {
+			fmt.Fprintf(&buf, "Folder %q (%s) has been stopped since %s:\n    %s\n\n", id, path, p.errSince.Format(time.RFC1123), p.err)
+			mailed = append(mailed, &p.errMailed)
+		}
+
+		if !p.itemsSince.IsZero() && !p.itemsMailed && now.Sub(p.itemsSince) >= delay {
+			fmt.Fprintf(&buf, "Folder %q (%s) has had %d items failing to sync since %s:\n", id, path, len(p.items), p.itemsSince.Format(time.RFC1123))
+			for i, item := range p.items {
+				if i == errorMailMaxItems {
+					fmt.Fprintf(&buf, "    ... and %d more\n", len(p.items)-i)
+					break
+				}
+				fmt.Fprintf(&buf, "    %s: %s\n", item.Path, item.Err)
+			}
+			buf.WriteString("\n")
+			mailed = append(mailed, &p.itemsMailed)
+		}
+	}
+
+	if buf.Len() == 0 {
+		return "", "", nil
+	}
+
+	name := e.cfg.Devices()[myID].Name
+	if name == "" {
+		name = myID.String()
+	}
+	subject := fmt.Sprintf("Syncthing on %s: sync problems", name)
+	body := fmt.Sprintf("The following problems have persisted for more than %d minutes.\n\n", opts.SMTPErrorDelayM) + buf.String()
+	return subject, body, mailed
+}
+
+// sendMail sends a plain text mail using the SMTP settings in the options.
+// The first recipient is used as the sender if none is set.
+func sendMail(opts config.OptionsConfiguration, subject, body string) error {
+	host, _, err := net.SplitHostPort(opts.SMTPServer)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if opts.SMTPUser != "" {
+		auth = smtp.PlainAuth("", opts.SMTPUser, opts.SMTPPassword, host)
+	}
+	from := opts.SMTPFrom
+	if from == "" {
+		from = opts.SMTPRecipients[0]
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(opts.SMTPRecipients, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+
+	return smtp.SendMail(opts.SMTPServer, auth, from, opts.SMTPRecipients, msg.Bytes())
+}
@@ -0,0 +1,92 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/model"
+)
+
+type fakeErrorSource struct {
+	errs  map[string]error
+	items map[string][]model.FileError
+}
+
+func (s *fakeErrorSource) State(folder string) (string, time.Time, error) {
+	if err := s.errs[folder]; err != nil {
+		return "error", time.Time{}, err
+	}
+	return "idle", time.Time{}, nil
+}
+
+func (s *fakeErrorSource) FolderErrors(folder string) ([]model.FileError, error) {
+	return s.items[folder], nil
+}
+
+func TestErrorMailDigest(t *testing.T) {
+	cfg := config.Wrap("/tmp/test", config.Configuration{
+		Folders: []config.FolderConfiguration{{ID: "a", RawPath: "/a"}, {ID: "b", RawPath: "/b"}},
+	})
+	opts := config.OptionsConfiguration{SMTPSeverity: "error", SMTPErrorDelayM: 60}
+	src := &fakeErrorSource{
+		errs:  map[string]error{"a": errors.New("folder path missing")},
+		items: map[string][]model.FileError{"b": {{Path: "file", Err: "permission denied"}}},
+	}
+	e := newErrorMailer(cfg, src)
+
+	check := func(now time.Time) string {
+		e.update(now, opts.SMTPSeverity)
+		_, body, mailed := e.digest(now, opts)
+		for _, flag := range mailed {
+			*flag = true
+		}
+		return body
+	}
+
+	t0 := time.Now()
+	if body := check(t0); body != "" {
+		t.Error("Unexpected mail before the delay:", body)
+	}
+
+	body := check(t0.Add(time.Hour))
+	if !strings.Contains(body, "folder path missing") {
+		t.Error("Expected folder error in mail:", body)
+	}
+	if strings.Contains(body, "permission denied") {
+		t.Error("Unexpected failing item at error severity:", body)
+	}
+
+	if body := check(t0.Add(2 * time.Hour)); body != "" {
+		t.Error("Unexpected second mail about the same problem:", body)
+	}
+
+	// Failing items are included at warning severity, once they have
+	// persisted long enough by themselves.
+	opts.SMTPSeverity = "warning"
+	if body := check(t0.Add(2 * time.Hour)); body != "" {
+		t.Error("Unexpected mail before the delay:", body)
+	}
+	body = check(t0.Add(3 * time.Hour))
+	if !strings.Contains(body, "file: permission denied") || strings.Contains(body, "folder path missing") {
+		t.Error("Expected only the failing item in mail:", body)
+	}
+
+	// A problem that clears and comes back is mailed about again.
+	delete(src.errs, "a")
+	check(t0.Add(4 * time.Hour))
+	src.errs["a"] = errors.New("folder marker missing")
+	check(t0.Add(5 * time.Hour))
+	body = check(t0.Add(6 * time.Hour))
+	if !strings.Contains(body, "folder marker missing") {
+		t.Error("Expected recurring folder error in mail:", body)
+	}
+}
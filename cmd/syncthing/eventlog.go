@@ -0,0 +1,163 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/events"
+	"github.com/syncthing/syncthing/internal/sync"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var eventLog *eventLogSvc
+
+// The eventLogSvc keeps the events of the types selected in the options in
+// the database, as a ring of the configured size. The event IDs continue
+// from those kept, so that a consumer can ask for the events since a given
+// ID across restarts.
+type eventLogSvc struct {
+	cfg     *config.Wrapper
+	ldb     *leveldb.DB
+	stop    chan struct{}
+	mut     sync.Mutex
+	last    int           // ID of the newest event kept, -1 if none
+	count   int           // number of events kept
+	changed chan struct{} // closed when an event is added
+}
+
+func newEventLogSvc(cfg *config.Wrapper, ldb *leveldb.DB) *eventLogSvc {
+	s := &eventLogSvc{
+		cfg:     cfg,
+		ldb:     ldb,
+		stop:    make(chan struct{}),
+		mut:     sync.NewMutex(),
+		last:    -1,
+		changed: make(chan struct{}),
+	}
+
+	it := ldb.NewIterator(util.BytesPrefix([]byte{db.KeyTypeEvent}), nil)
+	for it.Next() {
+		s.last = eventLogID(it.Key())
+		s.count++
+	}
+	it.Release()
+
+	events.Default.SetNextID(s.last + 1)
+	return s
+}
+
+func (s *eventLogSvc) Serve() {
+	sub := events.Default.Subscribe(events.AllEvents)
+	defer events.Default.Unsubscribe(sub)
+
+	for {
+		select {
+		case ev := <-sub.C():
+			opts := s.cfg.Options()
+			if opts.EventLogSize > 0 && eventLogSelected(ev.Type, opts.EventLogTypes) {
+				s.add(ev, opts.EventLogSize)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *eventLogSvc) Stop() {
+	close(s.stop)
+}
+
+func (s *eventLogSvc) add(ev events.Event, size int) {
+	bs, err := json.Marshal(ev)
+	if err != nil {
+		l.Infoln("Event log:", err)
+		return
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	batch := new(leveldb.Batch)
+	batch.Put(eventLogKey(ev.ID), bs)
+	s.last = ev.ID
+	s.count++
+
+	// Drop the oldest events beyond the size, which may have been lowered
+	// since the last time.
+	if s.count > size {
+		it := s.ldb.NewIterator(util.BytesPrefix([]byte{db.KeyTypeEvent}), nil)
+		for s.count > size && it.Next() {
+			batch.Delete(append([]byte(nil), it.Key()...))
+			s.count--
+		}
+		it.Release()
+	}
+
+	if err := s.ldb.Write(batch, nil); err != nil {
+		l.Infoln("Event log:", err)
+	}
+
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// since returns up to limit of the oldest events kept with an ID higher than
+// the given one, waiting up to the given timeout for one if there are none.
+// A limit of zero means no limit.
+func (s *eventLogSvc) since(id, limit int, timeout time.Duration) []json.RawMessage {
+	deadline := time.After(timeout)
+	for {
+		s.mut.Lock()
+		last, changed := s.last, s.changed
+		s.mut.Unlock()
+		if last > id {
+			break
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return nil
+		}
+	}
+
+	var evs []json.RawMessage
+	it := s.ldb.NewIterator(&util.Range{Start: eventLogKey(id + 1), Limit: []byte{db.KeyTypeEvent + 1}}, nil)
+	defer it.Release()
+	for it.Next() {
+		evs = append(evs, json.RawMessage(append([]byte(nil), it.Value()...)))
+		if len(evs) == limit {
+			break
+		}
+	}
+	return evs
+}
+
+func eventLogSelected(t events.EventType, types []string) bool {
+	for _, name := range types {
+		if name == t.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func eventLogKey(id int) []byte {
+	k := make([]byte, 9)
+	k[0] = db.KeyTypeEvent
+	binary.BigEndian.PutUint64(k[1:], uint64(id))
+	return k
+}
+
+func eventLogID(key []byte) int {
+	return int(binary.BigEndian.Uint64(key[1:]))
+}
@@ -0,0 +1,71 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/events"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestEventLog(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Wrap("/tmp/test", config.Configuration{})
+
+	ids := func(evs []json.RawMessage) []int {
+		var res []int
+		for _, bs := range evs {
+			var ev struct{ ID int }
+			json.Unmarshal(bs, &ev)
+			res = append(res, ev.ID)
+		}
+		return res
+	}
+
+	s := newEventLogSvc(cfg, ldb)
+	if evs := s.since(0, 0, time.Millisecond); evs != nil {
+		t.Error("Unexpected events in empty log:", ids(evs))
+	}
+	for id := 1; id <= 5; id++ {
+		s.add(events.Event{ID: id, Type: events.DeviceConnected}, 3)
+	}
+
+	if got := ids(s.since(0, 0, time.Second)); len(got) != 3 || got[0] != 3 || got[2] != 5 {
+		t.Error("Expected the last three events, got", got)
+	}
+	if got := ids(s.since(3, 1, time.Second)); len(got) != 1 || got[0] != 4 {
+		t.Error("Expected event 4, got", got)
+	}
+
+	// Waiting for an event.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.add(events.Event{ID: 6, Type: events.DeviceConnected}, 3)
+	}()
+	if got := ids(s.since(5, 0, time.Second)); len(got) != 1 || got[0] != 6 {
+		t.Error("Expected event 6, got", got)
+	}
+
+	// The events are kept across restarts, and lowering the size drops the
+	// oldest.
+	s = newEventLogSvc(cfg, ldb)
+	if s.last != 6 || s.count != 3 {
+		t.Errorf("Expected three events up to 6, got %d up to %d", s.count, s.last)
+	}
+	s.add(events.Event{ID: 7, Type: events.DeviceConnected}, 2)
+	if got := ids(s.since(0, 0, time.Second)); len(got) != 2 || got[0] != 6 {
+		t.Error("Expected events 6 and 7, got", got)
+	}
+}
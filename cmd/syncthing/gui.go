@@ -12,6 +12,7 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"mime"
 	"net"
@@ -20,6 +21,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"runtime/pprof"
 	"strconv"
 	"strings"
 	"time"
@@ -34,11 +36,15 @@ import (
 	"github.com/syncthing/syncthing/internal/model"
 	"github.com/syncthing/syncthing/internal/osutil"
 	"github.com/syncthing/syncthing/internal/sync"
+	"github.com/syncthing/syncthing/internal/trace"
 	"github.com/syncthing/syncthing/internal/upgrade"
 	"github.com/vitrun/qart/qr"
-	"golang.org/x/crypto/bcrypt"
 )
 
+// maxCPUProfileDuration is the longest CPU profile that can be requested over
+// the REST interface.
+const maxCPUProfileDuration = 5 * time.Minute
+
 type guiError struct {
 	Time  time.Time `json:"time"`
 	Error string    `json:"error"`
@@ -52,12 +58,22 @@ var (
 	eventSub     *events.BufferedSubscription
 )
 
+func init() {
+	// Registered once rather than by each API service, as the service is
+	// replaced when the GUI settings change.
+	l.AddHandler(logger.LevelWarn, showGuiError)
+}
+
 type apiSvc struct {
 	cfg      config.GUIConfiguration
 	assetDir string
 	model    *model.Model
 	fss      *folderSummarySvc
 	listener net.Listener
+
+	stop  chan struct{}
+	conns map[net.Conn]http.ConnState // open HTTP connections
+	mut   sync.Mutex                  // protects stop and conns
 }
 
 func newAPISvc(cfg config.GUIConfiguration, assetDir string, m *model.Model) (*apiSvc, error) {
@@ -66,6 +82,9 @@ func newAPISvc(cfg config.GUIConfiguration, assetDir string, m *model.Model) (*a
 		assetDir: assetDir,
 		model:    m,
 		fss:      newFolderSummarySvc(m),
+		stop:     make(chan struct{}),
+		conns:    make(map[net.Conn]http.ConnState),
+		mut:      sync.NewMutex(),
 	}
 
 	var err error
@@ -74,6 +93,10 @@ func newAPISvc(cfg config.GUIConfiguration, assetDir string, m *model.Model) (*a
 }
 
 func (s *apiSvc) getListener() (net.Listener, error) {
+	if path, ok := s.cfg.UnixSocket(); ok {
+		return listenUnix(path, s.cfg.UnixSocketMode())
+	}
+
 	cert, err := tls.LoadX509KeyPair(locations[locHTTPSCertFile], locations[locHTTPSKeyFile])
 	if err != nil {
 		l.Infoln("Loading HTTPS certificate:", err)
@@ -109,6 +132,11 @@ func (s *apiSvc) getListener() (net.Listener, error) {
 			tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
 		},
 	}
+	if len(s.cfg.ClientCertificates) > 0 {
+		// Client certificates are checked against the configured
+		// fingerprints by the auth middleware, not verified against any CA.
+		tlsCfg.ClientAuth = tls.RequestClientCert
+	}
 
 	rawListener, err := net.Listen("tcp", s.cfg.Address)
 	if err != nil {
@@ -119,108 +147,233 @@ func (s *apiSvc) getListener() (net.Listener, error) {
 	return listener, nil
 }
 
+// listenUnix listens on a unix socket at the given path, with the given
+// permissions. A socket left behind by a previous run is removed.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
 func (s *apiSvc) Serve() {
-	l.AddHandler(logger.LevelWarn, s.showGuiError)
 	sub := events.Default.Subscribe(events.AllEvents)
 	eventSub = events.NewBufferedSubscription(sub, 1000)
 	defer events.Default.Unsubscribe(sub)
 
 	// The GET handlers
 	getRestMux := http.NewServeMux()
-	getRestMux.HandleFunc("/rest/db/completion", s.getDBCompletion)              // device folder
-	getRestMux.HandleFunc("/rest/db/file", s.getDBFile)                          // folder file
-	getRestMux.HandleFunc("/rest/db/ignores", s.getDBIgnores)                    // folder
-	getRestMux.HandleFunc("/rest/db/need", s.getDBNeed)                          // folder [perpage] [page]
-	getRestMux.HandleFunc("/rest/db/status", s.getDBStatus)                      // folder
-	getRestMux.HandleFunc("/rest/db/browse", s.getDBBrowse)                      // folder [prefix] [dirsonly] [levels]
-	getRestMux.HandleFunc("/rest/events", s.getEvents)                           // since [limit]
-	getRestMux.HandleFunc("/rest/stats/device", s.getDeviceStats)                // -
-	getRestMux.HandleFunc("/rest/stats/folder", s.getFolderStats)                // -
-	getRestMux.HandleFunc("/rest/svc/deviceid", s.getDeviceID)                   // id
-	getRestMux.HandleFunc("/rest/svc/lang", s.getLang)                           // -
-	getRestMux.HandleFunc("/rest/svc/report", s.getReport)                       // -
-	getRestMux.HandleFunc("/rest/system/browse", s.getSystemBrowse)              // current
-	getRestMux.HandleFunc("/rest/system/config", s.getSystemConfig)              // -
-	getRestMux.HandleFunc("/rest/system/config/insync", s.getSystemConfigInsync) // -
-	getRestMux.HandleFunc("/rest/system/connections", s.getSystemConnections)    // -
-	getRestMux.HandleFunc("/rest/system/discovery", s.getSystemDiscovery)        // -
-	getRestMux.HandleFunc("/rest/system/error", s.getSystemError)                // -
-	getRestMux.HandleFunc("/rest/system/ping", s.restPing)                       // -
-	getRestMux.HandleFunc("/rest/system/status", s.getSystemStatus)              // -
-	getRestMux.HandleFunc("/rest/system/upgrade", s.getSystemUpgrade)            // -
-	getRestMux.HandleFunc("/rest/system/version", s.getSystemVersion)            // -
+	getRestMux.HandleFunc("/rest/db/completion", s.getDBCompletion)                // [device] [folder]
+	getRestMux.HandleFunc("/rest/db/deletes", s.getDBDeletes)                      // folder
+	getRestMux.HandleFunc("/rest/db/file", s.getDBFile)                            // folder file
+	getRestMux.HandleFunc("/rest/db/ignores", s.getDBIgnores)                      // folder
+	getRestMux.HandleFunc("/rest/db/ignored", s.getDBIgnored)                      // folder
+	getRestMux.HandleFunc("/rest/db/masschanges", s.getDBMassChanges)              // -
+	getRestMux.HandleFunc("/rest/db/need", s.getDBNeed)                            // folder [perpage] [page]
+	getRestMux.HandleFunc("/rest/db/plan", s.getDBPlan)                            // folder
+	getRestMux.HandleFunc("/rest/db/quarantine", s.getDBQuarantine)                // [folder]
+	getRestMux.HandleFunc("/rest/db/retained", s.getDBRetained)                    // folder
+	getRestMux.HandleFunc("/rest/db/override", s.getDBOverride)                    // folder
+	getRestMux.HandleFunc("/rest/db/status", s.getDBStatus)                        // folder
+	getRestMux.HandleFunc("/rest/db/browse", s.getDBBrowse)                        // folder [prefix] [dirsonly] [levels] [list [sort] [order] [page] [perpage]]
+	getRestMux.HandleFunc("/rest/db/remote-browse", s.getDBRemoteBrowse)           // device folder [prefix] [dirsonly] [levels]
+	getRestMux.HandleFunc("/rest/events", s.getEvents)                             // since [limit]
+	getRestMux.HandleFunc("/rest/events/persisted", s.getEventsPersisted)          // since [limit]
+	getRestMux.HandleFunc("/rest/folder/conflicts", s.getFolderConflicts)          // folder
+	getRestMux.HandleFunc("/rest/folder/errors", s.getFolderErrors)                // folder [perpage] [page]
+	getRestMux.HandleFunc("/rest/folder/tuning", s.getFolderTuning)                // folder
+	getRestMux.HandleFunc("/rest/stats/device", s.getDeviceStats)                  // -
+	getRestMux.HandleFunc("/rest/stats/folder", s.getFolderStats)                  // -
+	getRestMux.HandleFunc("/rest/stats/history", s.getHistoryStats)                // -
+	getRestMux.HandleFunc("/rest/svc/deviceid", s.getDeviceID)                     // id
+	getRestMux.HandleFunc("/rest/svc/lang", s.getLang)                             // -
+	getRestMux.HandleFunc("/rest/svc/report", s.getReport)                         // -
+	getRestMux.HandleFunc("/rest/system/browse", s.getSystemBrowse)                // current
+	getRestMux.HandleFunc("/rest/system/config", s.getSystemConfig)                // -
+	getRestMux.HandleFunc("/rest/system/config/insync", s.getSystemConfigInsync)   // -
+	getRestMux.HandleFunc("/rest/system/config/folder", s.getSystemConfigFolder)   // folder
+	getRestMux.HandleFunc("/rest/system/config/device", s.getSystemConfigDevice)   // device
+	getRestMux.HandleFunc("/rest/system/config/options", s.getSystemConfigOptions) // -
+	getRestMux.HandleFunc("/rest/system/connections", s.getSystemConnections)      // -
+	getRestMux.HandleFunc("/rest/system/debug", s.getSystemDebug)                  // -
+	getRestMux.HandleFunc("/rest/system/discovery", s.getSystemDiscovery)          // -
+	getRestMux.HandleFunc("/rest/system/error", s.getSystemError)                  // -
+	getRestMux.HandleFunc("/rest/system/log", s.getSystemLog)                      // [since]
+	getRestMux.HandleFunc("/rest/system/log.txt", s.getSystemLogTxt)               // [since]
+	getRestMux.HandleFunc("/rest/system/ping", s.restPing)                         // -
+	getRestMux.HandleFunc("/rest/system/sessions", s.getSystemSessions)            // -
+	getRestMux.HandleFunc("/rest/system/status", s.getSystemStatus)                // -
+	getRestMux.HandleFunc("/rest/system/upgrade", s.getSystemUpgrade)              // -
+	getRestMux.HandleFunc("/rest/system/version", s.getSystemVersion)              // -
 
 	// The POST handlers
 	postRestMux := http.NewServeMux()
-	postRestMux.HandleFunc("/rest/db/prio", s.postDBPrio)                      // folder file [perpage] [page]
-	postRestMux.HandleFunc("/rest/db/ignores", s.postDBIgnores)                // folder
-	postRestMux.HandleFunc("/rest/db/override", s.postDBOverride)              // folder
-	postRestMux.HandleFunc("/rest/db/scan", s.postDBScan)                      // folder [sub...] [delay]
-	postRestMux.HandleFunc("/rest/system/config", s.postSystemConfig)          // <body>
-	postRestMux.HandleFunc("/rest/system/discovery", s.postSystemDiscovery)    // device addr
-	postRestMux.HandleFunc("/rest/system/error", s.postSystemError)            // <body>
-	postRestMux.HandleFunc("/rest/system/error/clear", s.postSystemErrorClear) // -
-	postRestMux.HandleFunc("/rest/system/ping", s.restPing)                    // -
-	postRestMux.HandleFunc("/rest/system/reset", s.postSystemReset)            // [folder]
-	postRestMux.HandleFunc("/rest/system/restart", s.postSystemRestart)        // -
-	postRestMux.HandleFunc("/rest/system/shutdown", s.postSystemShutdown)      // -
-	postRestMux.HandleFunc("/rest/system/upgrade", s.postSystemUpgrade)        // -
+	postRestMux.HandleFunc("/rest/db/deletes/cancel", s.postDBDeletesCancel)           // folder file
+	postRestMux.HandleFunc("/rest/db/fetch", s.postDBFetch)                            // device folder file path
+	postRestMux.HandleFunc("/rest/db/masschanges/resume", s.postDBMassChangesResume)   // folder
+	postRestMux.HandleFunc("/rest/db/prio", s.postDBPrio)                              // folder file [perpage] [page]
+	postRestMux.HandleFunc("/rest/db/quarantine/clear", s.postDBQuarantineClear)       // [folder]
+	postRestMux.HandleFunc("/rest/db/ignores", s.postDBIgnores)                        // folder
+	postRestMux.HandleFunc("/rest/db/ignores/gitignore", s.postDBIgnoresGitignore)     // folder
+	postRestMux.HandleFunc("/rest/db/ignores/test", s.postDBIgnoresTest)               // folder <body>
+	postRestMux.HandleFunc("/rest/db/override", s.postDBOverride)                      // folder
+	postRestMux.HandleFunc("/rest/db/scan", s.postDBScan)                              // folder [sub...] [delay]
+	postRestMux.HandleFunc("/rest/db/scrub", s.postDBScrub)                            // folder [device...] [sub]
+	postRestMux.HandleFunc("/rest/db/tombstones/expire", s.postDBTombstonesExpire)     // folder [maxage]
+	postRestMux.HandleFunc("/rest/db/verify", s.postDBVerify)                          // folder [sub]
+	postRestMux.HandleFunc("/rest/folder/conflicts", s.postFolderConflicts)            // folder file...
+	postRestMux.HandleFunc("/rest/folder/retry", s.postFolderRetry)                    // folder [item...]
+	postRestMux.HandleFunc("/rest/folder/fetch", s.postFolderFetch)                    // folder item...
+	postRestMux.HandleFunc("/rest/system/config", s.postSystemConfig)                  // <body>
+	postRestMux.HandleFunc("/rest/system/config/folder", s.postSystemConfigFolder)     // folder <body>
+	postRestMux.HandleFunc("/rest/system/config/device", s.postSystemConfigDevice)     // device <body>
+	postRestMux.HandleFunc("/rest/system/config/options", s.postSystemConfigOptions)   // <body>
+	postRestMux.HandleFunc("/rest/system/db/compact", s.postSystemDBCompact)           // -
+	postRestMux.HandleFunc("/rest/system/debug", s.postSystemDebug)                    // [enable] [disable]
+	postRestMux.HandleFunc("/rest/system/diagnose", s.postSystemDiagnose)              // device
+	postRestMux.HandleFunc("/rest/system/discovery", s.postSystemDiscovery)            // device addr
+	postRestMux.HandleFunc("/rest/system/error", s.postSystemError)                    // <body>
+	postRestMux.HandleFunc("/rest/system/error/clear", s.postSystemErrorClear)         // -
+	postRestMux.HandleFunc("/rest/system/logout", s.postSystemLogout)                  // -
+	postRestMux.HandleFunc("/rest/system/ping", s.restPing)                            // -
+	postRestMux.HandleFunc("/rest/system/reload", s.postSystemReload)                  // -
+	postRestMux.HandleFunc("/rest/system/reset", s.postSystemReset)                    // [folder]
+	postRestMux.HandleFunc("/rest/system/restart", s.postSystemRestart)                // -
+	postRestMux.HandleFunc("/rest/system/selftest", s.postSystemSelfTest)              // [device]
+	postRestMux.HandleFunc("/rest/system/sessions/revoke", s.postSystemSessionsRevoke) // id
+	postRestMux.HandleFunc("/rest/system/shutdown", s.postSystemShutdown)              // -
+	postRestMux.HandleFunc("/rest/system/totp/enroll", s.postSystemTOTPEnroll)         // user
+	postRestMux.HandleFunc("/rest/system/totp/confirm", s.postSystemTOTPConfirm)       // user code
+	postRestMux.HandleFunc("/rest/system/totp/disable", s.postSystemTOTPDisable)       // user
+	postRestMux.HandleFunc("/rest/system/upgrade", s.postSystemUpgrade)                // -
 
 	// Debug endpoints, not for general use
 	getRestMux.HandleFunc("/rest/debug/peerCompletion", s.getPeerCompletion)
 
+	// Profiling endpoints. These require the API key, as profiles reveal a
+	// lot about the internals of the running process.
+	getRestMux.Handle("/rest/debug/pprof/cpu", apiKeyMiddleware(s.cfg, http.HandlerFunc(s.getDebugPprofCPU)))             // [duration]
+	getRestMux.Handle("/rest/debug/pprof/goroutine", apiKeyMiddleware(s.cfg, http.HandlerFunc(s.getDebugPprofGoroutine))) // -
+	getRestMux.Handle("/rest/debug/pprof/heap", apiKeyMiddleware(s.cfg, http.HandlerFunc(s.getDebugPprofHeap)))           // -
+
 	// A handler that splits requests between the two above and disables
 	// caching
-	restMux := noCacheMiddleware(getPostHandler(getRestMux, postRestMux))
+	restMux := noCacheMiddleware(gzipMiddleware(getPostHandler(getRestMux, postRestMux)))
 
 	// The main routing handler
 	mux := http.NewServeMux()
 	mux.Handle("/rest/", restMux)
 	mux.HandleFunc("/qr/", s.getQR)
 
-	// Serve compiled in assets unless an asset directory was set (for development)
+	// Serve compiled in assets, or files from the asset directory if one was
+	// set (for development)
 	mux.Handle("/", embeddedStatic{
 		assetDir: s.assetDir,
 		assets:   auto.Assets(),
+		hashes:   auto.AssetHashes(),
 	})
 
 	// Wrap everything in CSRF protection. The /rest prefix should be
 	// protected, other requests will grant cookies.
-	handler := csrfMiddleware("/rest", s.cfg.APIKey, mux)
+	handler := csrfMiddleware("/rest", s.cfg, mux)
 
 	// Add our version as a header to responses
 	handler = withVersionMiddleware(handler)
 
-	// Wrap everything in basic auth, if user/password is set.
-	if len(s.cfg.User) > 0 && len(s.cfg.Password) > 0 {
+	// Require a login, if users are configured. The login form is served
+	// at /rest/system/login. On a unix socket, the socket permissions are
+	// the access control.
+	_, unixSocket := s.cfg.UnixSocket()
+	if s.cfg.AuthRequired() && !unixSocket {
 		handler = basicAuthAndSessionMiddleware(s.cfg, handler)
 	}
 
+	// Let the allowed origins use the REST API from other web pages. This
+	// comes before authentication, as preflight requests carry none.
+	handler = corsMiddleware("/rest", s.cfg, handler)
+
+	// Serve everything under the path prefix, if one is set.
+	if urlPath := s.cfg.URLPath(); urlPath != "/" {
+		handler = pathPrefixMiddleware(urlPath, handler)
+	}
+
 	// Redirect to HTTPS if we are supposed to
-	if s.cfg.UseTLS {
+	if s.cfg.UseTLS && !unixSocket {
 		handler = redirectToHTTPSMiddleware(handler)
 	}
 
-	if debugHTTP {
-		handler = debugMiddleware(handler)
-	}
+	handler = debugMiddleware(handler)
 
 	srv := http.Server{
 		Handler:     handler,
 		ReadTimeout: 10 * time.Second,
+		ConnState:   s.connState,
 	}
 
 	s.fss.ServeBackground()
 
 	err := srv.Serve(s.listener)
-	l.Warnln("API:", err)
+	select {
+	case <-s.stop:
+		// The listener was closed by Stop.
+	default:
+		l.Warnln("API:", err)
+	}
 }
 
+// Stop closes the listener, and the open connections as soon as they are
+// idle, so that no requests are served with the old settings once the GUI
+// has been replaced.
 func (s *apiSvc) Stop() {
+	s.mut.Lock()
+	select {
+	case <-s.stop:
+		// Already stopped
+		s.mut.Unlock()
+		return
+	default:
+	}
+	close(s.stop)
 	s.listener.Close()
+	for conn, state := range s.conns {
+		if state == http.StateNew || state == http.StateIdle {
+			conn.Close()
+		}
+	}
+	s.mut.Unlock()
+
 	s.fss.Stop()
 }
 
+func (s *apiSvc) connState(conn net.Conn, state http.ConnState) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	switch state {
+	case http.StateClosed, http.StateHijacked:
+		delete(s.conns, conn)
+		return
+	case http.StateIdle:
+		select {
+		case <-s.stop:
+			conn.Close()
+			delete(s.conns, conn)
+			return
+		default:
+		}
+	}
+	s.conns[conn] = state
+}
+
 func getPostHandler(get, post http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
@@ -236,6 +389,12 @@ func getPostHandler(get, post http.Handler) http.Handler {
 
 func debugMiddleware(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !debugHTTP.On() {
+			// Checked per request, as debugging can be enabled at runtime.
+			h.ServeHTTP(w, r)
+			return
+		}
+
 		t0 := time.Now()
 		h.ServeHTTP(w, r)
 		ms := 1000 * time.Since(t0).Seconds()
@@ -275,6 +434,24 @@ func redirectToHTTPSMiddleware(h http.Handler) http.Handler {
 	})
 }
 
+// pathPrefixMiddleware serves h under the given prefix, which must have
+// leading and trailing slashes. The prefix is removed from the request path
+// before passing the request on to h. Requests for the prefix without the
+// trailing slash are redirected, requests outside of it are not found.
+func pathPrefixMiddleware(prefix string, h http.Handler) http.Handler {
+	strip := http.StripPrefix(strings.TrimSuffix(prefix, "/"), h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path+"/" == prefix:
+			http.Redirect(w, r, prefix, http.StatusFound)
+		case strings.HasPrefix(r.URL.Path, prefix):
+			strip.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
 func noCacheMiddleware(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Cache-Control", "max-age=0, no-cache, no-store")
@@ -291,6 +468,78 @@ func withVersionMiddleware(h http.Handler) http.Handler {
 	})
 }
 
+// gzipMiddleware compresses the responses of h when the client accepts the
+// gzip content encoding.
+func gzipMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.close()
+		h.ServeHTTP(gw, r)
+	})
+}
+
+// A gzipResponseWriter compresses what is written to it, unless the
+// response has no body or is already encoded. It supports flushing, so that
+// the long polling handlers can send their headers early.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	hdr := w.Header()
+	if code != http.StatusNoContent && code != http.StatusNotModified && hdr.Get("Content-Encoding") == "" {
+		hdr.Del("Content-Length")
+		hdr.Set("Content-Encoding", "gzip")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipResponseWriter) Write(bs []byte) (int, error) {
+	if !w.wroteHeader {
+		// The content type must be sniffed from the uncompressed data, as
+		// the server would otherwise see only gzip.
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(bs))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz == nil {
+		return w.ResponseWriter.Write(bs)
+	}
+	return w.gz.Write(bs)
+}
+
+func (w *gzipResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *gzipResponseWriter) close() {
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
+
 func (s *apiSvc) restPing(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(map[string]string{
@@ -314,6 +563,11 @@ func (s *apiSvc) getDBBrowse(w http.ResponseWriter, r *http.Request) {
 	prefix := qs.Get("prefix")
 	dirsonly := qs.Get("dirsonly") != ""
 
+	if qs.Get("list") != "" {
+		s.getDBBrowseList(w, r)
+		return
+	}
+
 	levels, err := strconv.Atoi(qs.Get("levels"))
 	if err != nil {
 		levels = -1
@@ -326,23 +580,89 @@ func (s *apiSvc) getDBBrowse(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(tree)
 }
 
-func (s *apiSvc) getDBCompletion(w http.ResponseWriter, r *http.Request) {
-	var qs = r.URL.Query()
-	var folder = qs.Get("folder")
-	var deviceStr = qs.Get("device")
+// getDBBrowseList returns a page of the entries directly in the prefix
+// directory, rather than the tree below it.
+func (s *apiSvc) getDBBrowseList(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	folder := qs.Get("folder")
+	prefix := qs.Get("prefix")
+	sortBy := qs.Get("sort")
+	desc := qs.Get("order") == "desc"
+
+	page, err := strconv.Atoi(qs.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	perpage, err := strconv.Atoi(qs.Get("perpage"))
+	if err != nil || perpage < 1 {
+		perpage = 1 << 16
+	}
+
+	entries, total, ok := s.model.GlobalDirectoryListing(folder, prefix, sortBy, desc, page, perpage)
+	if !ok {
+		http.Error(w, "No such folder", 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"entries": entries,
+		"total":   total,
+		"page":    page,
+		"perpage": perpage,
+	})
+}
 
-	device, err := protocol.DeviceIDFromString(deviceStr)
+func (s *apiSvc) getDBRemoteBrowse(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	folder := qs.Get("folder")
+	prefix := qs.Get("prefix")
+	dirsonly := qs.Get("dirsonly") != ""
+
+	device, err := protocol.DeviceIDFromString(qs.Get("device"))
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 
-	res := map[string]float64{
-		"completion": s.model.Completion(device, folder),
+	levels, err := strconv.Atoi(qs.Get("levels"))
+	if err != nil {
+		levels = -1
+	}
+
+	tree, ok := s.model.RemoteDirectoryTree(device, folder, prefix, levels, dirsonly)
+	if !ok {
+		http.Error(w, "No index for folder from device", 404)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	json.NewEncoder(w).Encode(res)
+	json.NewEncoder(w).Encode(tree)
+}
+
+func (s *apiSvc) getDBCompletion(w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var folder = qs.Get("folder")
+	var deviceStr = qs.Get("device")
+
+	var device protocol.DeviceID
+	if deviceStr != "" {
+		var err error
+		device, err = protocol.DeviceIDFromString(deviceStr)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if deviceStr != "" && folder != "" {
+		json.NewEncoder(w).Encode(s.model.DeviceCompletion(device, folder))
+		return
+	}
+	// Every folder shared with the device, or every device sharing the
+	// folder, or everything.
+	json.NewEncoder(w).Encode(s.model.DeviceCompletions(device, folder))
 }
 
 func (s *apiSvc) getDBStatus(w http.ResponseWriter, r *http.Request) {
@@ -369,6 +689,9 @@ func folderSummary(m *model.Model, folder string) map[string]interface{} {
 
 	res["inSyncFiles"], res["inSyncBytes"] = globalFiles-needFiles, globalBytes-needBytes
 
+	// The time remaining is -1 until the puller has made some progress.
+	res["pullRate"], res["etaS"] = m.PullRate(folder, needBytes)
+
 	var err error
 	res["state"], res["stateChanged"], err = m.State(folder)
 	if err != nil {
@@ -389,10 +712,57 @@ func folderSummary(m *model.Model, folder string) map[string]interface{} {
 	return res
 }
 
+func (s *apiSvc) getDBOverride(w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var folder = qs.Get("folder")
+
+	files, bytes, err := s.model.OverrideSize(folder)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"outOfSyncFiles": files,
+		"outOfSyncBytes": bytes,
+	})
+}
+
 func (s *apiSvc) postDBOverride(w http.ResponseWriter, r *http.Request) {
 	var qs = r.URL.Query()
 	var folder = qs.Get("folder")
-	go s.model.Override(folder)
+	if err := s.model.Override(folder); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
+
+func (s *apiSvc) postDBFetch(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	folder := qs.Get("folder")
+	file := qs.Get("file")
+
+	device, err := protocol.DeviceIDFromString(qs.Get("device"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	path, err := osutil.ExpandTilde(qs.Get("path"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if !filepath.IsAbs(path) {
+		http.Error(w, "Destination path must be absolute", 500)
+		return
+	}
+
+	if err := s.model.FetchFile(device, folder, file, path); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
 }
 
 func (s *apiSvc) getDBNeed(w http.ResponseWriter, r *http.Request) {
@@ -425,6 +795,111 @@ func (s *apiSvc) getDBNeed(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(output)
 }
 
+func (s *apiSvc) getFolderConflicts(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	folder := qs.Get("folder")
+
+	conflicts, err := s.model.Conflicts(folder)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if conflicts == nil {
+		conflicts = []model.Conflict{}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(conflicts)
+}
+
+// postFolderConflicts deletes the given conflict copies.
+func (s *apiSvc) postFolderConflicts(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	folder := qs.Get("folder")
+	files := qs["file"]
+
+	if err := s.model.DeleteConflicts(folder, files); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
+
+func (s *apiSvc) getFolderErrors(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	folder := qs.Get("folder")
+
+	page, err := strconv.Atoi(qs.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	perpage, err := strconv.Atoi(qs.Get("perpage"))
+	if err != nil || perpage < 1 {
+		perpage = 1 << 16
+	}
+
+	errors, err := s.model.FolderErrors(folder)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	total := len(errors)
+	start := (page - 1) * perpage
+	if start > total {
+		start = total
+	}
+	end := start + perpage
+	if end > total {
+		end = total
+	}
+
+	output := map[string]interface{}{
+		"folder":  folder,
+		"errors":  errors[start:end],
+		"total":   total,
+		"page":    page,
+		"perpage": perpage,
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(output)
+}
+
+func (s *apiSvc) getFolderTuning(w http.ResponseWriter, r *http.Request) {
+	tuning, err := s.model.FolderTuning(r.URL.Query().Get("folder"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(tuning)
+}
+
+func (s *apiSvc) postFolderRetry(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	folder := qs.Get("folder")
+	items := qs["item"]
+	if err := s.model.RetryFolderItems(folder, items); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
+
+func (s *apiSvc) postFolderFetch(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	folder := qs.Get("folder")
+	items := qs["item"]
+	if len(items) == 0 {
+		http.Error(w, "no items given", 400)
+		return
+	}
+	if err := s.model.FetchFolderItems(folder, items); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
+
 func (s *apiSvc) getSystemConnections(w http.ResponseWriter, r *http.Request) {
 	var res = s.model.ConnectionStats()
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -443,6 +918,15 @@ func (s *apiSvc) getFolderStats(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(res)
 }
 
+func (s *apiSvc) getHistoryStats(w http.ResponseWriter, r *http.Request) {
+	devices, folders := s.model.TransferHistory()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"devices": devices,
+		"folders": folders,
+	})
+}
+
 func (s *apiSvc) getDBFile(w http.ResponseWriter, r *http.Request) {
 	qs := r.URL.Query()
 	folder := qs.Get("folder")
@@ -460,7 +944,41 @@ func (s *apiSvc) getDBFile(w http.ResponseWriter, r *http.Request) {
 
 func (s *apiSvc) getSystemConfig(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	json.NewEncoder(w).Encode(cfg.Raw())
+	c := cfg.Raw()
+	if redactSecrets(r) {
+		c = redactedConfig(c)
+	}
+	// The overridden options are reported, as they are not saved
+	json.NewEncoder(w).Encode(struct {
+		config.Configuration
+		Overrides config.Overrides `json:"overrides"`
+	}{c, cfg.Overrides()})
+}
+
+// redactSecrets returns true if the request is authorized with a scope
+// that may see the configuration but not its secrets.
+func redactSecrets(r *http.Request) bool {
+	scope := r.Header.Get(apiScopeHeader)
+	return scope == config.APIScopeReadOnly || scope == config.APIScopeStatus
+}
+
+// redactedConfig returns a copy of the configuration without the password
+// hashes, API keys and folder secrets, for those who may see but not change
+// the configuration.
+func redactedConfig(c config.Configuration) config.Configuration {
+	c = c.Copy()
+	for i := range c.GUI.Users {
+		c.GUI.Users[i].Password = ""
+		c.GUI.Users[i].TOTPSecret = ""
+		c.GUI.Users[i].RecoveryCodes = nil
+	}
+	c.GUI.APIKey = ""
+	c.GUI.ScopedAPIKeys = nil
+	c.Options.SMTPPassword = ""
+	for i := range c.Folders {
+		c.Folders[i].Secret = ""
+	}
+	return c
 }
 
 func (s *apiSvc) postSystemConfig(w http.ResponseWriter, r *http.Request) {
@@ -472,43 +990,183 @@ func (s *apiSvc) postSystemConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if newCfg.GUI.Password != cfg.GUI().Password {
-		if newCfg.GUI.Password != "" {
-			hash, err := bcrypt.GenerateFromPassword([]byte(newCfg.GUI.Password), 0)
-			if err != nil {
-				l.Warnln("bcrypting password:", err)
-				http.Error(w, err.Error(), 500)
-				return
-			}
-
-			newCfg.GUI.Password = string(hash)
-		}
+	if err := newCfg.GUI.HashPasswords(); err != nil {
+		l.Warnln("bcrypting password:", err)
+		http.Error(w, err.Error(), 500)
+		return
 	}
 
-	// Fixup usage reporting settings
+	fixupURSettings(&newCfg.Options)
 
-	if curAcc := cfg.Options().URAccepted; newCfg.Options.URAccepted > curAcc {
+	s.commitConfigChange(w, func(c *config.Configuration) { *c = newCfg })
+}
+
+// fixupURSettings sets the usage reporting version and unique ID according
+// to whether usage reporting is being enabled or disabled.
+func fixupURSettings(opts *config.OptionsConfiguration) {
+	if curAcc := cfg.Options().URAccepted; opts.URAccepted > curAcc {
 		// UR was enabled
-		newCfg.Options.URAccepted = usageReportVersion
-		newCfg.Options.URUniqueID = randomString(8)
-	} else if newCfg.Options.URAccepted < curAcc {
+		opts.URAccepted = usageReportVersion
+		opts.URUniqueID = randomString(8)
+	} else if opts.URAccepted < curAcc {
 		// UR was disabled
-		newCfg.Options.URAccepted = -1
-		newCfg.Options.URUniqueID = ""
+		opts.URAccepted = -1
+		opts.URUniqueID = ""
 	}
+}
 
-	// Activate and save
+// The config folder, device and options handlers operate on a part of the
+// configuration at a time. The POST handlers accept a partial object;
+// attributes not present in the posted JSON are left unchanged. Adding and
+// removing folders and devices is done by posting the full configuration.
 
-	configInSync = !config.ChangeRequiresRestart(cfg.Raw(), newCfg)
-	cfg.Replace(newCfg)
+func (s *apiSvc) getSystemConfigFolder(w http.ResponseWriter, r *http.Request) {
+	folder, ok := cfg.Folders()[r.URL.Query().Get("folder")]
+	if !ok {
+		http.Error(w, "No such folder", 404)
+		return
+	}
+
+	if redactSecrets(r) {
+		folder.Secret = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(folder)
+}
+
+func (s *apiSvc) postSystemConfigFolder(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("folder")
+	folder, ok := cfg.Folders()[id]
+	if !ok {
+		http.Error(w, "No such folder", 404)
+		return
+	}
+
+	folder = folder.Copy()
+	if err := json.NewDecoder(r.Body).Decode(&folder); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	folder.ID = id
+
+	s.commitConfigChange(w, func(c *config.Configuration) { c.SetFolder(folder) })
+}
+
+func (s *apiSvc) getSystemConfigDevice(w http.ResponseWriter, r *http.Request) {
+	id, err := protocol.DeviceIDFromString(r.URL.Query().Get("device"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	device, ok := cfg.Devices()[id]
+	if !ok {
+		http.Error(w, "No such device", 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(device)
+}
+
+func (s *apiSvc) postSystemConfigDevice(w http.ResponseWriter, r *http.Request) {
+	id, err := protocol.DeviceIDFromString(r.URL.Query().Get("device"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	device, ok := cfg.Devices()[id]
+	if !ok {
+		http.Error(w, "No such device", 404)
+		return
+	}
+
+	device = device.Copy()
+	if err := json.NewDecoder(r.Body).Decode(&device); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	device.DeviceID = id
+
+	s.commitConfigChange(w, func(c *config.Configuration) { c.SetDevice(device) })
+}
+
+func (s *apiSvc) getSystemConfigOptions(w http.ResponseWriter, r *http.Request) {
+	opts := cfg.Options()
+	if redactSecrets(r) {
+		opts.SMTPPassword = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(opts)
+}
+
+func (s *apiSvc) postSystemConfigOptions(w http.ResponseWriter, r *http.Request) {
+	opts := cfg.Options().Copy()
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	fixupURSettings(&opts)
+
+	s.commitConfigChange(w, func(c *config.Configuration) { c.Options = opts })
+}
+
+// commitConfigChange applies a change to a copy of the configuration, and
+// puts the result in place and saves it if it is valid. Otherwise nothing is
+// changed, and the problems are returned as a list of field errors with a
+// 400 status.
+func (s *apiSvc) commitConfigChange(w http.ResponseWriter, change func(*config.Configuration)) {
+	newCfg := cfg.Raw().Copy()
+	change(&newCfg)
+
+	if err := applyConfig(newCfg); err != nil {
+		configErrorResponse(w, err)
+		return
+	}
 	cfg.Save()
 }
 
+// applyConfig validates the new configuration and, if it is valid, puts it
+// in place, noting if a restart is required to activate it.
+func applyConfig(newCfg config.Configuration) error {
+	if err := newCfg.Validate(); err != nil {
+		return err
+	}
+
+	if config.ChangeRequiresRestart(cfg.Raw(), newCfg) {
+		configInSync = false
+	}
+	cfg.Replace(newCfg)
+	return nil
+}
+
+// configErrorResponse returns the field errors of an invalid configuration
+// with a 400 status, and other errors with a 500 status.
+func configErrorResponse(w http.ResponseWriter, err error) {
+	if _, ok := err.(config.ValidationErrors); !ok {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(400)
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": err})
+}
+
 func (s *apiSvc) getSystemConfigInsync(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(map[string]bool{"configInSync": configInSync})
 }
 
+func (s *apiSvc) postSystemReload(w http.ResponseWriter, r *http.Request) {
+	if err := reloadConfig(); err != nil {
+		configErrorResponse(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]bool{"configInSync": configInSync})
+}
+
 func (s *apiSvc) postSystemRestart(w http.ResponseWriter, r *http.Request) {
 	s.flushResponse(`{"ok": "restarting"}`, w)
 	go restart()
@@ -572,11 +1230,51 @@ func (s *apiSvc) getSystemStatus(w http.ResponseWriter, r *http.Request) {
 	res["cpuPercent"] = cpusum / float64(len(cpuUsagePercent)) / float64(runtime.NumCPU())
 	res["pathSeparator"] = string(filepath.Separator)
 	res["uptime"] = int(time.Since(startTime).Seconds())
+	res["onBattery"] = onBatteryPower()
+	res["suspended"] = s.model.Suspended()
+	res["meteredPaused"] = pausedOnMetered()
+	if mappings := currentUPnPMappings(); mappings != nil {
+		res["upnp"] = mappings
+	}
+	res["dbSize"] = databaseDiskSize()
+	res["dbFolderSizes"] = s.model.DatabaseSizes()
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(res)
 }
 
+func (s *apiSvc) postSystemDBCompact(w http.ResponseWriter, r *http.Request) {
+	before := databaseDiskSize()
+	if err := s.model.CompactDatabase(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	after := databaseDiskSize()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]int64{
+		"sizeBefore": before,
+		"sizeAfter":  after,
+		"reclaimed":  before - after,
+	})
+}
+
+// databaseDiskSize returns the total size of the files in the database
+// directory.
+func databaseDiskSize() int64 {
+	infos, err := ioutil.ReadDir(locations[locDatabase])
+	if err != nil {
+		return 0
+	}
+	var size int64
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
 func (s *apiSvc) getSystemError(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	guiErrorsMut.Lock()
@@ -587,7 +1285,7 @@ func (s *apiSvc) getSystemError(w http.ResponseWriter, r *http.Request) {
 func (s *apiSvc) postSystemError(w http.ResponseWriter, r *http.Request) {
 	bs, _ := ioutil.ReadAll(r.Body)
 	r.Body.Close()
-	s.showGuiError(0, string(bs))
+	showGuiError(0, string(bs))
 }
 
 func (s *apiSvc) postSystemErrorClear(w http.ResponseWriter, r *http.Request) {
@@ -596,7 +1294,37 @@ func (s *apiSvc) postSystemErrorClear(w http.ResponseWriter, r *http.Request) {
 	guiErrorsMut.Unlock()
 }
 
-func (s *apiSvc) showGuiError(l logger.LogLevel, err string) {
+func (s *apiSvc) getSystemLog(w http.ResponseWriter, r *http.Request) {
+	since, err := logSince(r)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string][]logLine{"messages": recentLog.since(since)})
+}
+
+func (s *apiSvc) getSystemLogTxt(w http.ResponseWriter, r *http.Request) {
+	since, err := logSince(r)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writeLogText(w, recentLog.since(since))
+}
+
+// logSince returns the time given by the since parameter, or the zero time
+// if there is none.
+func logSince(r *http.Request) (time.Time, error) {
+	since := r.URL.Query().Get("since")
+	if since == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, since)
+}
+
+func showGuiError(l logger.LogLevel, err string) {
 	guiErrorsMut.Lock()
 	guiErrors = append(guiErrors, guiError{time.Now(), err})
 	if len(guiErrors) > 5 {
@@ -605,6 +1333,33 @@ func (s *apiSvc) showGuiError(l logger.LogLevel, err string) {
 	guiErrorsMut.Unlock()
 }
 
+func (s *apiSvc) getSystemDebug(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"facilities": trace.Facilities(),
+		"enabled":    trace.Enabled(),
+	})
+}
+
+func (s *apiSvc) postSystemDebug(w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	for _, set := range []struct {
+		param   string
+		enabled bool
+	}{{"enable", true}, {"disable", false}} {
+		for _, name := range strings.Split(qs.Get(set.param), ",") {
+			if name == "" {
+				continue
+			}
+			if err := trace.Set(name, set.enabled); err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			l.Infof("Debug facility %q enabled: %v", name, set.enabled)
+		}
+	}
+}
+
 func (s *apiSvc) postSystemDiscovery(w http.ResponseWriter, r *http.Request) {
 	var qs = r.URL.Query()
 	var device = qs.Get("device")
@@ -630,9 +1385,40 @@ func (s *apiSvc) getSystemDiscovery(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(devices)
 }
 
+func (s *apiSvc) postSystemDiagnose(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	deviceID, err := protocol.DeviceIDFromString(qs.Get("device"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	steps := diagnoseConnection(cfg, newTLSConfig(cert, cfg.Options()), discoverer, s.model.ConnectedTo, deviceID)
+	json.NewEncoder(w).Encode(steps)
+}
+
+func (s *apiSvc) postSystemSelfTest(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	res := localSelfTest(newTLSConfig(cert, cfg.Options()))
+	if device := qs.Get("device"); device != "" {
+		deviceID, err := protocol.DeviceIDFromString(device)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		res.Transfer = transferTest(s.model, deviceID, transferTestDuration)
+	}
+
+	json.NewEncoder(w).Encode(res)
+}
+
 func (s *apiSvc) getReport(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	json.NewEncoder(w).Encode(reportData(s.model))
+	json.NewEncoder(w).Encode(reportData(s.model, currentReportFormat()))
 }
 
 func (s *apiSvc) getDBIgnores(w http.ResponseWriter, r *http.Request) {
@@ -672,6 +1458,126 @@ func (s *apiSvc) postDBIgnores(w http.ResponseWriter, r *http.Request) {
 	s.getDBIgnores(w, r)
 }
 
+func (s *apiSvc) postDBIgnoresGitignore(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	err := s.model.ImportGitignore(qs.Get("folder"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	s.getDBIgnores(w, r)
+}
+
+func (s *apiSvc) postDBIgnoresTest(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	var data struct {
+		Ignore []string `json:"ignore"` // optional; the current patterns are used if missing
+		Paths  []string `json:"paths"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	res, err := s.model.MatchIgnores(qs.Get("folder"), data.Ignore, data.Paths)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
+
+func (s *apiSvc) getDBIgnored(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	files, err := s.model.IgnoredFiles(qs.Get("folder"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(s.toNeedSlice(files))
+}
+
+func (s *apiSvc) getDBRetained(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	files, err := s.model.RetainedFiles(qs.Get("folder"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(s.toNeedSlice(files))
+}
+
+func (s *apiSvc) getDBDeletes(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	deletes, err := s.model.PendingDeletes(qs.Get("folder"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(deletes)
+}
+
+func (s *apiSvc) postDBDeletesCancel(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	if err := s.model.CancelDelete(qs.Get("folder"), qs.Get("file")); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func (s *apiSvc) getDBPlan(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	plan, err := s.model.PullPlan(qs.Get("folder"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"create":  s.toNeedSlice(plan.Create),
+		"replace": s.toNeedSlice(plan.Replace),
+		"delete":  s.toNeedSlice(plan.Delete),
+	})
+}
+
+func (s *apiSvc) getDBQuarantine(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(s.model.Quarantined(r.URL.Query().Get("folder")))
+}
+
+func (s *apiSvc) postDBQuarantineClear(w http.ResponseWriter, r *http.Request) {
+	s.model.ClearQuarantine(r.URL.Query().Get("folder"))
+}
+
+func (s *apiSvc) getDBMassChanges(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(s.model.MassChanges())
+}
+
+func (s *apiSvc) postDBMassChangesResume(w http.ResponseWriter, r *http.Request) {
+	if err := s.model.ResumeMassChange(r.URL.Query().Get("folder")); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
 func (s *apiSvc) getEvents(w http.ResponseWriter, r *http.Request) {
 	qs := r.URL.Query()
 	sinceStr := qs.Get("since")
@@ -696,6 +1602,25 @@ func (s *apiSvc) getEvents(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(evs)
 }
 
+// getEventsPersisted returns the oldest events kept in the database after the
+// given ID, which unlike the events in memory survive a restart.
+func (s *apiSvc) getEventsPersisted(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	since, _ := strconv.Atoi(qs.Get("since"))
+	limit, _ := strconv.Atoi(qs.Get("limit"))
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	// Flush before blocking, to indicate that we've received the request.
+	w.(http.Flusher).Flush()
+
+	evs := eventLog.since(since, limit, time.Minute)
+	if evs == nil {
+		evs = []json.RawMessage{}
+	}
+	json.NewEncoder(w).Encode(evs)
+}
+
 func (s *apiSvc) getSystemUpgrade(w http.ResponseWriter, r *http.Request) {
 	if noUpgrade {
 		http.Error(w, upgrade.ErrUpgradeUnsupported.Error(), 500)
@@ -791,6 +1716,61 @@ func (s *apiSvc) postDBScan(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *apiSvc) postDBScrub(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	var devices []protocol.DeviceID
+	for _, str := range qs["device"] {
+		device, err := protocol.DeviceIDFromString(str)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		devices = append(devices, device)
+	}
+
+	mismatches, err := s.model.Scrub(qs.Get("folder"), qs.Get("sub"), devices)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(mismatches)
+}
+
+func (s *apiSvc) postDBTombstonesExpire(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	var maxAge time.Duration
+	if str := qs.Get("maxage"); str != "" {
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		maxAge = d
+	}
+
+	expired, err := s.model.ExpireTombstones(qs.Get("folder"), maxAge)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]int{
+		"expired": expired,
+	})
+}
+
+func (s *apiSvc) postDBVerify(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	mismatches, err := s.model.VerifyFolder(qs.Get("folder"), qs.Get("sub"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(mismatches)
+}
+
 func (s *apiSvc) postDBPrio(w http.ResponseWriter, r *http.Request) {
 	qs := r.URL.Query()
 	folder := qs.Get("folder")
@@ -812,6 +1792,46 @@ func (s *apiSvc) getQR(w http.ResponseWriter, r *http.Request) {
 	w.Write(code.PNG())
 }
 
+func (s *apiSvc) getDebugPprofCPU(w http.ResponseWriter, r *http.Request) {
+	duration := 30 * time.Second
+	if d := r.URL.Query().Get("duration"); d != "" {
+		var err error
+		duration, err = time.ParseDuration(d)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+	if duration <= 0 || duration > maxCPUProfileDuration {
+		http.Error(w, fmt.Sprintf("duration must be positive and at most %v", maxCPUProfileDuration), 500)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := pprof.StartCPUProfile(&buf); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	time.Sleep(duration)
+	pprof.StopCPUProfile()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="cpu.pprof"`)
+	w.Write(buf.Bytes())
+}
+
+func (s *apiSvc) getDebugPprofGoroutine(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	pprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+func (s *apiSvc) getDebugPprofHeap(w http.ResponseWriter, r *http.Request) {
+	runtime.GC()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="heap.pprof"`)
+	pprof.WriteHeapProfile(w)
+}
+
 func (s *apiSvc) getPeerCompletion(w http.ResponseWriter, r *http.Request) {
 	tot := map[string]float64{}
 	count := map[string]float64{}
@@ -862,7 +1882,8 @@ func (s *apiSvc) getSystemBrowse(w http.ResponseWriter, r *http.Request) {
 
 type embeddedStatic struct {
 	assetDir string
-	assets   map[string][]byte
+	assets   map[string][]byte // gzipped
+	hashes   map[string]string // of the uncompressed assets
 }
 
 func (s embeddedStatic) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -876,13 +1897,8 @@ func (s embeddedStatic) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		file = "index.html"
 	}
 
-	if s.assetDir != "" {
-		p := filepath.Join(s.assetDir, filepath.FromSlash(file))
-		_, err := os.Stat(p)
-		if err == nil {
-			http.ServeFile(w, r, p)
-			return
-		}
+	if s.assetDir != "" && s.serveAssetFile(w, file) {
+		return
 	}
 
 	bs, ok := s.assets[file]
@@ -891,11 +1907,32 @@ func (s embeddedStatic) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	gzipped := acceptsGzip(r)
+
+	// The gzipped and plain versions are different representations and
+	// need different strong ETags.
+	var etag string
+	if hash, ok := s.hashes[file]; ok {
+		if gzipped {
+			etag = `"` + hash + `-gzip"`
+		} else {
+			etag = `"` + hash + `"`
+		}
+		w.Header().Set("ETag", etag)
+	}
+	w.Header().Set("Last-Modified", auto.AssetsBuildDate)
+	w.Header().Set("Vary", "Accept-Encoding")
+
+	if notModified(r, etag, auto.AssetsBuildDate) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	mtype := s.mimeTypeForFile(file)
 	if len(mtype) != 0 {
 		w.Header().Set("Content-Type", mtype)
 	}
-	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+	if gzipped {
 		w.Header().Set("Content-Encoding", "gzip")
 	} else {
 		// ungzip if browser not send gzip accepted header
@@ -905,11 +1942,99 @@ func (s embeddedStatic) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		gr.Close()
 	}
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(bs)))
-	w.Header().Set("Last-Modified", auto.AssetsBuildDate)
 
 	w.Write(bs)
 }
 
+// acceptsGzip returns true if the request accepts the gzip content encoding,
+// as given by the Accept-Encoding header.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(enc, ";")
+		if name := strings.TrimSpace(fields[0]); name != "gzip" && name != "*" {
+			continue
+		}
+		for _, param := range fields[1:] {
+			param = strings.Replace(param, " ", "", -1)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					// Explicitly not acceptable
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// notModified returns true if the conditional headers of the request show
+// that the client already has the representation with the given ETag and
+// modification time. If-None-Match takes precedence over If-Modified-Since.
+func notModified(r *http.Request, etag, lastModified string) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			if tag = strings.TrimSpace(tag); tag == etag || tag == "*" {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		modified, err := http.ParseTime(lastModified)
+		if err != nil {
+			return false
+		}
+		return !modified.After(since)
+	}
+
+	return false
+}
+
+// serveAssetFile serves the given file from the asset directory, for GUI
+// development. The file is read anew on each request and the browser is told
+// not to cache it, so that changes take effect on reload. Returns false if
+// there is no such file, in which case the compiled in asset should be used.
+func (s embeddedStatic) serveAssetFile(w http.ResponseWriter, file string) bool {
+	for _, part := range strings.Split(file, "/") {
+		if strings.HasPrefix(part, ".") {
+			// Dotfiles aren't compiled in by genassets either.
+			return false
+		}
+	}
+
+	fd, err := os.Open(filepath.Join(s.assetDir, filepath.FromSlash(file)))
+	if err != nil {
+		return false
+	}
+	defer fd.Close()
+
+	info, err := fd.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+
+	mtype := s.mimeTypeForFile(file)
+	if len(mtype) != 0 {
+		w.Header().Set("Content-Type", mtype)
+	}
+	w.Header().Set("Cache-Control", "max-age=0, no-cache, no-store")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", info.Size()))
+
+	if _, err := io.Copy(w, fd); err != nil && debugHTTP.On() {
+		l.Debugf("serving asset %s: %v", file, err)
+	}
+	return true
+}
+
 func (s embeddedStatic) mimeTypeForFile(file string) string {
 	// We use a built in table of the common types since the system
 	// TypeByExtension might be unreliable. But if we don't know, we delegate
@@ -8,89 +8,335 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
 	"math/rand"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/events"
 	"github.com/syncthing/syncthing/internal/sync"
 	"golang.org/x/crypto/bcrypt"
 )
 
+const (
+	authFreeAttempts = 3 // failures allowed before backing off
+	authBaseDelay    = time.Second
+	authMaxDelay     = 10 * time.Minute
+	authForgetAfter  = time.Hour // failures older than this are forgotten
+)
+
 var (
-	sessions    = make(map[string]bool)
-	sessionsMut = sync.NewMutex()
+	authFailures    = make(map[string]authFailure) // remote address -> failures
+	authFailuresMut = sync.NewMutex()
 )
 
+type authFailure struct {
+	count int
+	last  time.Time
+}
+
+// The header telling the handlers the API scope of the request, when it is
+// authenticated by an API key or user with a limited role. It can only
+// narrow down what is returned, so it need not be protected from clients.
+const apiScopeHeader = "X-Syncthing-Scope"
+
+// serveScoped passes the request on to next if the scope grants access to
+// it, and refuses it otherwise.
+func serveScoped(scope string, next http.Handler, w http.ResponseWriter, r *http.Request) {
+	if !apiScopeAllows(scope, r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	r.Header.Set(apiScopeHeader, scope)
+	next.ServeHTTP(w, r)
+}
+
+// basicAuthAndSessionMiddleware lets requests through if they belong to a
+// session, or carry an API key, trusted client certificate or user name and
+// password. Others are shown the login form, which starts a session.
 func basicAuthAndSessionMiddleware(cfg config.GUIConfiguration, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if cfg.APIKey != "" && r.Header.Get("X-API-Key") == cfg.APIKey {
+		if scope, ok := cfg.APIKeyScope(r.Header.Get("X-API-Key")); ok {
+			serveScoped(scope, next, w, r)
+			return
+		}
+		if trustedClientCert(r, cfg.ClientCertificates) {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		cookie, err := r.Cookie("sessionid")
-		if err == nil && cookie != nil {
-			sessionsMut.Lock()
-			_, ok := sessions[cookie.Value]
-			sessionsMut.Unlock()
-			if ok {
-				next.ServeHTTP(w, r)
+		if r.URL.Path == loginPath {
+			serveLogin(cfg, w, r)
+			return
+		}
+
+		if name, ok := sessionUser(r, time.Now()); ok {
+			// The user is looked up anew, so that removed users are logged
+			// out and role changes apply immediately.
+			if role, found := cfg.UserRole(name); found {
+				serveScoped(role, next, w, r)
 				return
 			}
 		}
 
-		if debugHTTP {
-			l.Debugln("Sessionless HTTP request with authentication; this is expensive.")
+		addr := remoteHost(r.RemoteAddr)
+		if !authBackoffAllows(addr, w) {
+			return
 		}
 
-		error := func() {
-			time.Sleep(time.Duration(rand.Intn(100)+100) * time.Millisecond)
-			w.Header().Set("WWW-Authenticate", "Basic realm=\"Authorization Required\"")
-			http.Error(w, "Not Authorized", http.StatusUnauthorized)
+		notAuthorized := func() {
+			authFailureDelay()
+			if strings.HasPrefix(r.URL.Path, "/rest/") || strings.HasPrefix(r.URL.Path, "/qr/") {
+				http.Error(w, "Not Authorized", http.StatusUnauthorized)
+				return
+			}
+			serveLoginPage(cfg, w, http.StatusUnauthorized, "")
+		}
+		failure := func(username string) {
+			recordAuthFailure(addr, username, time.Now())
+			notAuthorized()
 		}
 
+		// User name and password in the Authorization header are still
+		// accepted, for API clients.
 		hdr := r.Header.Get("Authorization")
 		if !strings.HasPrefix(hdr, "Basic ") {
-			error()
+			if r.Header.Get("X-API-Key") != "" {
+				// An incorrect API key
+				failure("")
+				return
+			}
+			notAuthorized()
 			return
 		}
 
+		if debugHTTP.On() {
+			l.Debugln("Sessionless HTTP request with authentication; this is expensive.")
+		}
+
 		hdr = hdr[6:]
 		bs, err := base64.StdEncoding.DecodeString(hdr)
 		if err != nil {
-			error()
+			failure("")
 			return
 		}
 
 		fields := bytes.SplitN(bs, []byte(":"), 2)
 		if len(fields) != 2 {
-			error()
+			failure("")
 			return
 		}
 
-		if string(fields[0]) != cfg.User {
-			error()
+		name := string(fields[0])
+		role, ok := cfg.UserRole(name)
+		if !ok || !authenticate(cfg, name, string(fields[1])) {
+			failure(name)
 			return
 		}
 
-		if err := bcrypt.CompareHashAndPassword([]byte(cfg.Password), fields[1]); err != nil {
-			error()
+		clearAuthFailures(addr)
+		newSession(cfg, name, w, r)
+		serveScoped(role, next, w, r)
+	})
+}
+
+// authenticate verifies the login of the GUI user, including the second
+// factor if the user has one.
+func authenticate(cfg config.GUIConfiguration, name, password string) bool {
+	if user, ok := cfg.UserByName(name); ok && user.TOTPSecret != "" {
+		return authenticateTOTP(cfg, user, password)
+	}
+	return verifyPassword(cfg, name, password)
+}
+
+// verifyPassword verifies the password of the GUI user, according to the
+// authentication mode.
+func verifyPassword(cfg config.GUIConfiguration, name, password string) bool {
+	switch cfg.AuthMode {
+	case "", config.AuthModeStatic:
+		user, ok := cfg.UserByName(name)
+		if !ok || user.Password == "" {
+			return false
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+			return false
+		}
+		if cfg.PasswordNeedsRehash(user.Password) {
+			rehashGUIPassword(user.Name, user.Password, password)
+		}
+		return true
+
+	case config.AuthModeLDAP:
+		if err := ldapAuthenticate(cfg.LDAP, name, password); err != nil {
+			l.Infof("LDAP authentication of GUI user %q: %v", name, err)
+			return false
+		}
+		return true
+
+	default:
+		return false
+	}
+}
+
+// apiKeyMiddleware lets requests through only if they carry the full access
+// API key.
+func apiKeyMiddleware(cfg config.GUIConfiguration, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if scope, ok := cfg.APIKeyScope(r.Header.Get("X-API-Key")); !ok || scope != config.APIScopeAdmin {
+			http.Error(w, "Forbidden", http.StatusForbidden)
 			return
 		}
+		h.ServeHTTP(w, r)
+	})
+}
 
-		sessionid := randomString(32)
-		sessionsMut.Lock()
-		sessions[sessionid] = true
-		sessionsMut.Unlock()
-		http.SetCookie(w, &http.Cookie{
-			Name:   "sessionid",
-			Value:  sessionid,
-			MaxAge: 0,
-		})
+// rehashGUIPassword replaces the stored password hash of the GUI user with
+// one using the currently configured cost, unless the hash has been changed
+// since.
+func rehashGUIPassword(name, oldHash, password string) {
+	guiCfg := cfg.GUI().Copy()
+	user, ok := guiCfg.UserByName(name)
+	if !ok || user.Password != oldHash {
+		return
+	}
+	hash, err := guiCfg.HashPassword(password)
+	if err != nil {
+		l.Warnln("bcrypting password:", err)
+		return
+	}
+	user.Password = hash
+	guiCfg.SetUser(user)
+	cfg.SetGUI(guiCfg)
+	cfg.Save()
+}
+
+// authBackoff returns the time a client must wait before making another
+// authentication attempt, after the given number of consecutive failures.
+func authBackoff(failures int) time.Duration {
+	if failures <= authFreeAttempts {
+		return 0
+	}
+	delay := authBaseDelay
+	for i := authFreeAttempts + 1; i < failures && delay < authMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > authMaxDelay {
+		delay = authMaxDelay
+	}
+	return delay
+}
+
+// authBackoffAllows returns true if the address may make an authentication
+// attempt, and responds with the time to wait otherwise.
+func authBackoffAllows(addr string, w http.ResponseWriter) bool {
+	wait := authBackoffRemaining(addr, time.Now())
+	if wait <= 0 {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+	http.Error(w, "Too Many Failed Authentication Attempts", 429)
+	return false
+}
+
+// authFailureDelay sleeps for a short random time before a failed
+// authentication attempt is answered.
+func authFailureDelay() {
+	time.Sleep(time.Duration(rand.Intn(100)+100) * time.Millisecond)
+}
 
-		next.ServeHTTP(w, r)
+// authBackoffRemaining returns the time left until the given address may
+// make another authentication attempt.
+func authBackoffRemaining(addr string, now time.Time) time.Duration {
+	authFailuresMut.Lock()
+	f, ok := authFailures[addr]
+	authFailuresMut.Unlock()
+	if !ok {
+		return 0
+	}
+	return f.last.Add(authBackoff(f.count)).Sub(now)
+}
+
+// recordAuthFailure counts a failed authentication attempt from the given
+// address and emits an AuthFailure event.
+func recordAuthFailure(addr, username string, now time.Time) {
+	authFailuresMut.Lock()
+	// Forget about addresses that have behaved for a while, so that the map
+	// doesn't grow without bounds.
+	for a, f := range authFailures {
+		if now.Sub(f.last) > authForgetAfter {
+			delete(authFailures, a)
+		}
+	}
+	f := authFailures[addr]
+	f.count++
+	f.last = now
+	authFailures[addr] = f
+	authFailuresMut.Unlock()
+
+	l.Infof("Failed GUI authentication from %s (%d failures)", addr, f.count)
+	events.Default.Log(events.AuthFailure, map[string]interface{}{
+		"address":  addr,
+		"username": username,
+		"failures": f.count,
 	})
 }
+
+func clearAuthFailures(addr string) {
+	authFailuresMut.Lock()
+	delete(authFailures, addr)
+	authFailuresMut.Unlock()
+}
+
+// remoteHost returns the host part of the given address, or the address
+// itself if it has no port.
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// apiScopeAllows returns true if an API key with the given scope grants
+// access to the request.
+func apiScopeAllows(scope string, r *http.Request) bool {
+	switch scope {
+	case config.APIScopeAdmin:
+		return true
+	case config.APIScopeReadOnly:
+		return r.Method == "GET"
+	case config.APIScopeStatus:
+		// The configuration contains the password hash and API keys, and
+		// the options the mail server password.
+		return r.Method == "GET" && r.URL.Path != "/rest/system/config" && r.URL.Path != "/rest/system/config/options"
+	case config.APIScopeEvents:
+		return r.Method == "GET" && (r.URL.Path == "/rest/events" || r.URL.Path == "/rest/events/persisted")
+	default:
+		return false
+	}
+}
+
+// trustedClientCert returns true if the request was made over TLS using a
+// client certificate matching one of the given SHA-256 fingerprints. The
+// fingerprints are hex strings, optionally with colons between the bytes.
+func trustedClientCert(r *http.Request, fingerprints []string) bool {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 || len(fingerprints) == 0 {
+		return false
+	}
+
+	sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+	have := hex.EncodeToString(sum[:])
+	for _, fp := range fingerprints {
+		fp = strings.ToLower(strings.Replace(fp, ":", "", -1))
+		if subtle.ConstantTimeCompare([]byte(fp), []byte(have)) == 1 {
+			return true
+		}
+	}
+	return false
+}
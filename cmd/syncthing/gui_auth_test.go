@@ -0,0 +1,241 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuthBackoff(t *testing.T) {
+	cases := []struct {
+		failures int
+		delay    time.Duration
+	}{
+		{0, 0},
+		{authFreeAttempts, 0},
+		{authFreeAttempts + 1, authBaseDelay},
+		{authFreeAttempts + 2, 2 * authBaseDelay},
+		{authFreeAttempts + 3, 4 * authBaseDelay},
+		{authFreeAttempts + 100, authMaxDelay},
+	}
+
+	for _, tc := range cases {
+		if d := authBackoff(tc.failures); d != tc.delay {
+			t.Errorf("%d failures: incorrect delay %v != %v", tc.failures, d, tc.delay)
+		}
+	}
+}
+
+func TestAuthFailureLockout(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	guiCfg := config.GUIConfiguration{
+		Users:        []config.GUIUser{{Name: "user", Password: string(hash), Role: config.GUIRoleAdmin}},
+		PasswordCost: bcrypt.MinCost,
+	}
+	handler := basicAuthAndSessionMiddleware(guiCfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	const addr = "192.0.2.42"
+	defer clearAuthFailures(addr)
+
+	request := func(password string) int {
+		req, _ := http.NewRequest("GET", "/rest/system/status", nil)
+		req.RemoteAddr = addr + ":12345"
+		req.SetBasicAuth("user", password)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for i := 0; i < authFreeAttempts+1; i++ {
+		if code := request("wrong"); code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: unexpected status %d", i, code)
+		}
+	}
+
+	// Even the correct password is refused while backing off.
+	if code := request("pass"); code != 429 {
+		t.Fatalf("unexpected status %d during backoff", code)
+	}
+
+	// Pretend the backoff time has passed.
+	authFailuresMut.Lock()
+	f := authFailures[addr]
+	f.last = f.last.Add(-authBaseDelay)
+	authFailures[addr] = f
+	authFailuresMut.Unlock()
+
+	if code := request("pass"); code != http.StatusOK {
+		t.Fatalf("unexpected status %d after backoff", code)
+	}
+	if d := authBackoffRemaining(addr, time.Now()); d != 0 {
+		t.Errorf("failures not cleared after success; %v remaining", d)
+	}
+}
+
+func TestGUIUserRoles(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	guiCfg := config.GUIConfiguration{
+		Users: []config.GUIUser{
+			{Name: "admin", Password: string(hash), Role: config.GUIRoleAdmin},
+			{Name: "viewer", Password: string(hash), Role: config.GUIRoleReadOnly},
+		},
+		PasswordCost: bcrypt.MinCost,
+	}
+	var scope string
+	handler := basicAuthAndSessionMiddleware(guiCfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scope = r.Header.Get(apiScopeHeader)
+	}))
+
+	cases := []struct {
+		user   string
+		method string
+		code   int
+		scope  string
+	}{
+		{"admin", "GET", http.StatusOK, config.APIScopeAdmin},
+		{"admin", "POST", http.StatusOK, config.APIScopeAdmin},
+		{"viewer", "GET", http.StatusOK, config.APIScopeReadOnly},
+		{"viewer", "POST", http.StatusForbidden, ""},
+	}
+
+	for _, tc := range cases {
+		scope = ""
+		req, _ := http.NewRequest(tc.method, "/rest/system/config", nil)
+		req.RemoteAddr = "192.0.2.43:12345"
+		req.SetBasicAuth(tc.user, "pass")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.code || scope != tc.scope {
+			t.Errorf("%s %s: unexpected status %d, scope %q", tc.user, tc.method, rec.Code, scope)
+		}
+
+		// The session gets the same role
+		cookies := rec.HeaderMap["Set-Cookie"]
+		if len(cookies) == 0 {
+			t.Fatalf("%s: no session cookie", tc.user)
+		}
+		req, _ = http.NewRequest(tc.method, "/rest/system/config", nil)
+		req.Header.Set("Cookie", cookies[0])
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.code {
+			t.Errorf("%s %s with session: unexpected status %d", tc.user, tc.method, rec.Code)
+		}
+	}
+}
+
+func TestTrustedClientCert(t *testing.T) {
+	cert := &x509.Certificate{Raw: []byte("not really a certificate")}
+	sum := sha256.Sum256(cert.Raw)
+	fp := hex.EncodeToString(sum[:])
+
+	var colons []string
+	for i := 0; i < len(fp); i += 2 {
+		colons = append(colons, strings.ToUpper(fp[i:i+2]))
+	}
+
+	req, _ := http.NewRequest("GET", "/rest/system/status", nil)
+	if trustedClientCert(req, []string{fp}) {
+		t.Error("trusted request without TLS")
+	}
+
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	cases := []struct {
+		fingerprints []string
+		trusted      bool
+	}{
+		{nil, false},
+		{[]string{"0123"}, false},
+		{[]string{fp}, true},
+		{[]string{"0123", strings.Join(colons, ":")}, true},
+	}
+	for _, tc := range cases {
+		if res := trustedClientCert(req, tc.fingerprints); res != tc.trusted {
+			t.Errorf("%v: unexpected result %v", tc.fingerprints, res)
+		}
+	}
+}
+
+func TestAPIScopeAllows(t *testing.T) {
+	cases := []struct {
+		scope   string
+		method  string
+		path    string
+		allowed bool
+	}{
+		{config.APIScopeAdmin, "POST", "/rest/system/shutdown", true},
+		{config.APIScopeAdmin, "GET", "/rest/system/config", true},
+		{config.APIScopeReadOnly, "GET", "/rest/system/config", true},
+		{config.APIScopeReadOnly, "POST", "/rest/system/config", false},
+		{config.APIScopeStatus, "GET", "/rest/system/status", true},
+		{config.APIScopeStatus, "GET", "/rest/system/config", false},
+		{config.APIScopeStatus, "GET", "/rest/system/config/options", false},
+		{config.APIScopeStatus, "POST", "/rest/system/shutdown", false},
+		{config.APIScopeReadOnly, "POST", "/rest/system/diagnose", false},
+		{config.APIScopeStatus, "POST", "/rest/system/diagnose", false},
+		{config.APIScopeReadOnly, "POST", "/rest/system/selftest", false},
+		{config.APIScopeStatus, "POST", "/rest/system/selftest", false},
+		{config.APIScopeEvents, "GET", "/rest/events", true},
+		{config.APIScopeEvents, "GET", "/rest/events/persisted", true},
+		{config.APIScopeEvents, "GET", "/rest/system/status", false},
+		{"unknown", "GET", "/rest/events", false},
+	}
+
+	for _, tc := range cases {
+		req, _ := http.NewRequest(tc.method, tc.path, nil)
+		if res := apiScopeAllows(tc.scope, req); res != tc.allowed {
+			t.Errorf("%s %s %s: unexpected result %v", tc.scope, tc.method, tc.path, res)
+		}
+	}
+}
+
+func TestAPIKeyMiddleware(t *testing.T) {
+	guiCfg := config.GUIConfiguration{
+		APIKey:        "admin",
+		ScopedAPIKeys: []config.ScopedAPIKey{{Key: "status", Scope: config.APIScopeStatus}},
+	}
+	handler := apiKeyMiddleware(guiCfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	cases := []struct {
+		key  string
+		code int
+	}{
+		{"", http.StatusForbidden},
+		{"wrong", http.StatusForbidden},
+		{"status", http.StatusForbidden},
+		{"admin", http.StatusOK},
+	}
+
+	for _, tc := range cases {
+		req, _ := http.NewRequest("GET", "/rest/debug/pprof/heap", nil)
+		if tc.key != "" {
+			req.Header.Set("X-API-Key", tc.key)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.code {
+			t.Errorf("key %q: unexpected status %d != %d", tc.key, rec.Code, tc.code)
+		}
+	}
+}
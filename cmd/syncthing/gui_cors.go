@@ -0,0 +1,57 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/syncthing/syncthing/internal/config"
+)
+
+// corsMiddleware lets web pages on the configured allowed origins use the
+// REST API. Preflight requests from those origins are answered directly, as
+// they carry no credentials. Other requests get the CORS headers only when
+// they carry a valid API key, so that the page can't read responses
+// authorized by the cookies of the user's own GUI session.
+func corsMiddleware(prefix string, guiCfg config.GUIConfiguration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !strings.HasPrefix(r.URL.Path, prefix) || !corsAllowed(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.Header().Add("Vary", "Origin")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		if _, ok := guiCfg.APIKeyScope(r.Header.Get("X-API-Key")); ok {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", "X-Syncthing-Version")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// corsAllowed returns true if the origin is one of the allowed origins in
+// the current options.
+func corsAllowed(origin string) bool {
+	for _, allowed := range cfg.Options().CORSAllowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	return false
+}
@@ -14,6 +14,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/osutil"
 	"github.com/syncthing/syncthing/internal/sync"
 )
@@ -24,11 +25,15 @@ var csrfMut = sync.NewMutex()
 // Check for CSRF token on /rest/ URLs. If a correct one is not given, reject
 // the request with 403. For / and /index.html, set a new CSRF cookie if none
 // is currently set.
-func csrfMiddleware(prefix, apiKey string, next http.Handler) http.Handler {
+func csrfMiddleware(prefix string, cfg config.GUIConfiguration, next http.Handler) http.Handler {
 	loadCsrfTokens()
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Allow requests carrying a valid API key
-		if apiKey != "" && r.Header.Get("X-API-Key") == apiKey {
+		// Allow requests carrying a valid API key or client certificate
+		if scope, ok := cfg.APIKeyScope(r.Header.Get("X-API-Key")); ok {
+			serveScoped(scope, next, w, r)
+			return
+		}
+		if trustedClientCert(r, cfg.ClientCertificates) {
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -40,6 +45,7 @@ func csrfMiddleware(prefix, apiKey string, next http.Handler) http.Handler {
 				cookie = &http.Cookie{
 					Name:  "CSRF-Token",
 					Value: newCsrfToken(),
+					Path:  cfg.URLPath(),
 				}
 				http.SetCookie(w, cookie)
 			}
@@ -0,0 +1,79 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/ldap"
+)
+
+var errNotGroupMember = errors.New("not a member of the required group")
+
+// ldapAuthenticate verifies the password of the user by binding to the LDAP
+// server as the user, and checks the group membership if one is required.
+func ldapAuthenticate(cfg config.LDAPConfiguration, name, password string) error {
+	if cfg.Address == "" || !strings.Contains(cfg.BindDN, "%s") {
+		return errors.New("LDAP address or bind DN not configured")
+	}
+
+	host, _, err := net.SplitHostPort(cfg.Address)
+	if err != nil {
+		return err
+	}
+	tlsCfg := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	var conn *ldap.Conn
+	switch cfg.Transport {
+	case "", config.LDAPTransportTLS:
+		conn, err = ldap.Dial(cfg.Address, tlsCfg)
+	case config.LDAPTransportStartTLS:
+		conn, err = ldap.Dial(cfg.Address, nil)
+		if err == nil {
+			if err = conn.StartTLS(tlsCfg); err != nil {
+				conn.Close()
+			}
+		}
+	case config.LDAPTransportPlain:
+		conn, err = ldap.Dial(cfg.Address, nil)
+	default:
+		err = fmt.Errorf("unknown LDAP transport %q", cfg.Transport)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	dn := strings.Replace(cfg.BindDN, "%s", ldap.EscapeDN(name), -1)
+	if err := conn.Bind(dn, password); err != nil {
+		return err
+	}
+
+	if cfg.GroupDN == "" {
+		return nil
+	}
+	attr := cfg.GroupAttribute
+	if attr == "" {
+		attr = "member"
+	}
+	member, err := conn.Compare(cfg.GroupDN, attr, dn)
+	if err != nil {
+		return err
+	}
+	if !member {
+		return errNotGroupMember
+	}
+	return nil
+}
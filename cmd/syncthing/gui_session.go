@@ -0,0 +1,283 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+const (
+	sessionCookie      = "sessionid"
+	sessionIdleTimeout = 24 * time.Hour     // sessions unused for this long are logged out
+	sessionMaxLifetime = 7 * 24 * time.Hour // and all sessions after this long
+)
+
+// The path of the login form and endpoint, relative to the GUI URL path.
+const loginPath = "/rest/system/login"
+
+type session struct {
+	user     string
+	address  string
+	created  time.Time
+	lastUsed time.Time
+}
+
+func (s *session) expired(now time.Time) bool {
+	return now.Sub(s.lastUsed) > sessionIdleTimeout || now.Sub(s.created) > sessionMaxLifetime
+}
+
+var (
+	sessions    = make(map[string]*session) // session ID -> session
+	sessionsMut = sync.NewMutex()
+)
+
+// newSession starts a session for the user and sets the session cookie on
+// the response.
+func newSession(cfg config.GUIConfiguration, name string, w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	id := randomString(32)
+
+	sessionsMut.Lock()
+	// Forget expired sessions, so that the map doesn't grow without bounds.
+	for sid, s := range sessions {
+		if s.expired(now) {
+			delete(sessions, sid)
+		}
+	}
+	sessions[id] = &session{
+		user:     name,
+		address:  remoteHost(r.RemoteAddr),
+		created:  now,
+		lastUsed: now,
+	}
+	sessionsMut.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     cfg.URLPath(),
+		Expires:  now.Add(sessionMaxLifetime),
+		MaxAge:   int(sessionMaxLifetime / time.Second),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+	})
+}
+
+// sessionUser returns the user of the session the request belongs to, if
+// it has one that has not expired.
+func sessionUser(r *http.Request, now time.Time) (string, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", false
+	}
+
+	sessionsMut.Lock()
+	defer sessionsMut.Unlock()
+	s, ok := sessions[cookie.Value]
+	if !ok {
+		return "", false
+	}
+	if s.expired(now) {
+		delete(sessions, cookie.Value)
+		return "", false
+	}
+	s.lastUsed = now
+	return s.user, true
+}
+
+// endSession ends the session the request belongs to, if any, and clears
+// the session cookie.
+func endSession(cfg config.GUIConfiguration, w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		sessionsMut.Lock()
+		delete(sessions, cookie.Value)
+		sessionsMut.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   sessionCookie,
+		Path:   cfg.URLPath(),
+		MaxAge: -1,
+	})
+}
+
+// sessionKey returns the identifier of the session shown in the REST API.
+// The session ID itself is never shown, as knowing it is enough to use the
+// session.
+func sessionKey(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+var loginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Syncthing</title>
+<style>
+body { font-family: "Helvetica Neue", Helvetica, Arial, sans-serif; background: #f5f5f5; }
+form { max-width: 320px; margin: 10% auto; padding: 20px; background: #fff; border: 1px solid #ddd; border-radius: 4px; }
+label, input { display: block; width: 100%; box-sizing: border-box; }
+input { margin: 4px 0 12px; padding: 6px; }
+.error { color: #a94442; }
+</style>
+</head>
+<body>
+<form method="post" action="{{.Action}}">
+<h3>Syncthing</h3>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<label for="user">User</label>
+<input id="user" name="user" type="text" autofocus autocomplete="username">
+<label for="password">Password</label>
+<input id="password" name="password" type="password" autocomplete="current-password">
+<label for="code">Two-Factor Code (if enabled)</label>
+<input id="code" name="code" type="text" autocomplete="one-time-code">
+<input type="submit" value="Log In">
+</form>
+</body>
+</html>
+`))
+
+// serveLoginPage shows the login form, with the given status code and
+// error message.
+func serveLoginPage(cfg config.GUIConfiguration, w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	loginTemplate.Execute(w, map[string]string{
+		"Action": cfg.URLPath() + loginPath[1:],
+		"Error":  msg,
+	})
+}
+
+// sameOriginRequest returns true unless the request carries an Origin
+// header for another host, which would make it a cross site form post.
+func sameOriginRequest(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// serveLogin handles the login endpoint. A GET shows the login form, a
+// POST of the user, password and optional two-factor code starts a session
+// and redirects to the GUI.
+func serveLogin(cfg config.GUIConfiguration, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		serveLoginPage(cfg, w, http.StatusOK, "")
+		return
+	case "POST":
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !sameOriginRequest(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	addr := remoteHost(r.RemoteAddr)
+	if !authBackoffAllows(addr, w) {
+		return
+	}
+
+	name := r.PostFormValue("user")
+	password := r.PostFormValue("password") + r.PostFormValue("code")
+	if _, ok := cfg.UserRole(name); !ok || !authenticate(cfg, name, password) {
+		recordAuthFailure(addr, name, time.Now())
+		authFailureDelay()
+		serveLoginPage(cfg, w, http.StatusUnauthorized, "Incorrect user name, password or code.")
+		return
+	}
+
+	clearAuthFailures(addr)
+	newSession(cfg, name, w, r)
+	l.Infof("GUI user %q logged in from %s", name, addr)
+	http.Redirect(w, r, cfg.URLPath(), http.StatusSeeOther)
+}
+
+// sessionInfo is a session as shown in the REST API.
+type sessionInfo struct {
+	ID       string    `json:"id"`
+	User     string    `json:"user"`
+	Address  string    `json:"address"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"lastUsed"`
+	Expires  time.Time `json:"expires"`
+	Current  bool      `json:"current"`
+}
+
+type sessionsByCreated []sessionInfo
+
+func (l sessionsByCreated) Len() int           { return len(l) }
+func (l sessionsByCreated) Less(a, b int) bool { return l[a].Created.Before(l[b].Created) }
+func (l sessionsByCreated) Swap(a, b int)      { l[a], l[b] = l[b], l[a] }
+
+func (s *apiSvc) postSystemLogout(w http.ResponseWriter, r *http.Request) {
+	endSession(s.cfg, w, r)
+}
+
+func (s *apiSvc) getSystemSessions(w http.ResponseWriter, r *http.Request) {
+	var current string
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		current = cookie.Value
+	}
+
+	now := time.Now()
+	res := []sessionInfo{}
+	sessionsMut.Lock()
+	for id, s := range sessions {
+		if s.expired(now) {
+			continue
+		}
+		expires := s.lastUsed.Add(sessionIdleTimeout)
+		if max := s.created.Add(sessionMaxLifetime); max.Before(expires) {
+			expires = max
+		}
+		res = append(res, sessionInfo{
+			ID:       sessionKey(id),
+			User:     s.user,
+			Address:  s.address,
+			Created:  s.created,
+			LastUsed: s.lastUsed,
+			Expires:  expires,
+			Current:  id == current,
+		})
+	}
+	sessionsMut.Unlock()
+	sort.Sort(sessionsByCreated(res))
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
+
+func (s *apiSvc) postSystemSessionsRevoke(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("id")
+
+	sessionsMut.Lock()
+	defer sessionsMut.Unlock()
+	for id := range sessions {
+		if sessionKey(id) == key {
+			delete(sessions, id)
+			return
+		}
+	}
+	http.Error(w, "No such session", 404)
+}
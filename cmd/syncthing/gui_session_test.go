@@ -0,0 +1,191 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func sessionTestConfig(t *testing.T) config.GUIConfiguration {
+	hash, err := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config.GUIConfiguration{
+		Users:        []config.GUIUser{{Name: "user", Password: string(hash), Role: config.GUIRoleAdmin}},
+		PasswordCost: bcrypt.MinCost,
+	}
+}
+
+func login(handler http.Handler, password string) *httptest.ResponseRecorder {
+	form := url.Values{"user": {"user"}, "password": {password}}
+	req, _ := http.NewRequest("POST", loginPath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = "192.0.2.44:12345"
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestLoginAndLogout(t *testing.T) {
+	guiCfg := sessionTestConfig(t)
+	svc := &apiSvc{cfg: guiCfg}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rest/system/logout", svc.postSystemLogout)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	handler := basicAuthAndSessionMiddleware(guiCfg, mux)
+	defer clearAuthFailures("192.0.2.44")
+
+	get := func(path, cookie string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Without a session the GUI shows the login form, and the REST API
+	// refuses requests.
+	rec := get("/", "")
+	if rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Body.String(), "<form") {
+		t.Errorf("unexpected status %d or no login form", rec.Code)
+	}
+	if rec.HeaderMap.Get("WWW-Authenticate") != "" {
+		t.Error("unexpected basic auth challenge")
+	}
+	if rec := get("/rest/system/status", ""); rec.Code != http.StatusUnauthorized || strings.Contains(rec.Body.String(), "<form") {
+		t.Errorf("unexpected REST response %d", rec.Code)
+	}
+
+	if rec := login(handler, "wrong"); rec.Code != http.StatusUnauthorized || len(rec.HeaderMap["Set-Cookie"]) != 0 {
+		t.Errorf("login with the wrong password: unexpected status %d", rec.Code)
+	}
+
+	rec = login(handler, "pass")
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("unexpected login status %d", rec.Code)
+	}
+	cookies := rec.HeaderMap["Set-Cookie"]
+	if len(cookies) == 0 || !strings.Contains(cookies[0], "HttpOnly") || !strings.Contains(cookies[0], "Max-Age=") {
+		t.Fatalf("unexpected session cookie %v", cookies)
+	}
+	cookie := strings.SplitN(cookies[0], ";", 2)[0]
+
+	if rec := get("/rest/system/status", cookie); rec.Code != http.StatusOK {
+		t.Errorf("unexpected status %d with session", rec.Code)
+	}
+
+	req, _ := http.NewRequest("POST", "/rest/system/logout", nil)
+	req.Header.Set("Cookie", cookie)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if rec := get("/rest/system/status", cookie); rec.Code != http.StatusUnauthorized {
+		t.Errorf("unexpected status %d after logout", rec.Code)
+	}
+}
+
+func TestLoginCrossOrigin(t *testing.T) {
+	guiCfg := sessionTestConfig(t)
+	handler := basicAuthAndSessionMiddleware(guiCfg, http.NotFoundHandler())
+
+	form := url.Values{"user": {"user"}, "password": {"pass"}}
+	req, _ := http.NewRequest("POST", loginPath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", "http://evil.example.com")
+	req.Host = "localhost:8384"
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("cross origin login: unexpected status %d", rec.Code)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		created, lastUsed time.Duration // before now
+		expired           bool
+	}{
+		{0, 0, false},
+		{time.Hour, time.Minute, false},
+		{2 * sessionIdleTimeout, sessionIdleTimeout - time.Minute, false},
+		{2 * sessionIdleTimeout, sessionIdleTimeout + time.Minute, true},
+		{sessionMaxLifetime + time.Minute, time.Minute, true},
+	}
+	for i, tc := range cases {
+		s := &session{created: now.Add(-tc.created), lastUsed: now.Add(-tc.lastUsed)}
+		if s.expired(now) != tc.expired {
+			t.Errorf("%d: expired %v != expected %v", i, s.expired(now), tc.expired)
+		}
+	}
+}
+
+func TestSessionsListAndRevoke(t *testing.T) {
+	guiCfg := sessionTestConfig(t)
+	svc := &apiSvc{cfg: guiCfg}
+	handler := basicAuthAndSessionMiddleware(guiCfg, http.NotFoundHandler())
+	defer clearAuthFailures("192.0.2.44")
+
+	rec := login(handler, "pass")
+	cookie := strings.SplitN(rec.HeaderMap["Set-Cookie"][0], ";", 2)[0]
+	id := strings.TrimPrefix(cookie, sessionCookie+"=")
+	defer func() {
+		sessionsMut.Lock()
+		delete(sessions, id)
+		sessionsMut.Unlock()
+	}()
+
+	req, _ := http.NewRequest("GET", "/rest/system/sessions", nil)
+	req.Header.Set("Cookie", cookie)
+	rec = httptest.NewRecorder()
+	svc.getSystemSessions(rec, req)
+
+	var list []sessionInfo
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	var found *sessionInfo
+	for i := range list {
+		if list[i].Current {
+			found = &list[i]
+		}
+		if strings.Contains(list[i].ID, id) {
+			t.Fatal("session ID exposed")
+		}
+	}
+	if found == nil || found.User != "user" || found.Address != "192.0.2.44" {
+		t.Fatalf("current session not listed correctly: %+v", list)
+	}
+
+	req, _ = http.NewRequest("POST", "/rest/system/sessions/revoke?id="+found.ID, nil)
+	req.Header.Set("Cookie", cookie)
+	rec = httptest.NewRecorder()
+	svc.postSystemSessionsRevoke(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("unexpected revoke status %d", rec.Code)
+	}
+	if _, ok := sessionUser(req, time.Now()); ok {
+		t.Error("revoked session still valid")
+	}
+
+	rec = httptest.NewRecorder()
+	svc.postSystemSessionsRevoke(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unexpected status %d revoking an unknown session", rec.Code)
+	}
+}
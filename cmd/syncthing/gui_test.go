@@ -0,0 +1,447 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/syncthing/syncthing/internal/auto"
+	"github.com/syncthing/syncthing/internal/config"
+)
+
+func TestPathPrefixMiddleware(t *testing.T) {
+	var seen string
+	handler := pathPrefixMiddleware("/syncthing/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.URL.Path
+	}))
+
+	cases := []struct {
+		path string
+		code int
+		seen string
+	}{
+		{"/syncthing/", http.StatusOK, "/"},
+		{"/syncthing/rest/system/status", http.StatusOK, "/rest/system/status"},
+		{"/syncthing", http.StatusFound, ""},
+		{"/rest/system/status", http.StatusNotFound, ""},
+		{"/syncthingfoo/", http.StatusNotFound, ""},
+	}
+
+	for _, tc := range cases {
+		seen = ""
+		req, _ := http.NewRequest("GET", tc.path, nil)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.code {
+			t.Errorf("%s: unexpected status %d != %d", tc.path, rec.Code, tc.code)
+		}
+		if seen != tc.seen {
+			t.Errorf("%s: handler saw path %q, expected %q", tc.path, seen, tc.seen)
+		}
+	}
+}
+
+func TestPostSystemConfigFolder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldCfg := cfg
+	defer func() { cfg, configInSync = oldCfg, true }()
+	cfg = config.Wrap(filepath.Join(dir, "config.xml"), config.Configuration{
+		Folders: []config.FolderConfiguration{
+			{ID: "default", RawPath: "/a", RescanIntervalS: 60, Pullers: 16},
+			{ID: "other", RawPath: "/b", RescanIntervalS: 60},
+		},
+	})
+
+	s := &apiSvc{}
+	post := func(query, body string) int {
+		req, _ := http.NewRequest("POST", "/rest/system/config/folder?"+query, strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		s.postSystemConfigFolder(rec, req)
+		return rec.Code
+	}
+
+	if code := post("folder=default", `{"id": "renamed", "rescanIntervalS": 3600}`); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	folders := cfg.Folders()
+	if f := folders["default"]; f.RescanIntervalS != 3600 || f.Pullers != 16 || f.RawPath != "/a" {
+		t.Errorf("folder not updated as expected: %+v", f)
+	}
+	if _, ok := folders["renamed"]; ok {
+		t.Error("folder was renamed")
+	}
+	if f := folders["other"]; f.RescanIntervalS != 60 {
+		t.Errorf("other folder changed: %+v", f)
+	}
+	if configInSync {
+		t.Error("folder change should require restart")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "config.xml")); err != nil {
+		t.Error("config not saved:", err)
+	}
+
+	if code := post("folder=missing", `{}`); code != http.StatusNotFound {
+		t.Errorf("unexpected status %d for missing folder", code)
+	}
+
+	// An invalid change is rejected as a whole, with the offending fields.
+	req, _ := http.NewRequest("POST", "/rest/system/config/folder?folder=other", strings.NewReader(`{"path": "/a", "copiers": 1000, "rescanIntervalS": 10}`))
+	rec := httptest.NewRecorder()
+	s.postSystemConfigFolder(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status %d for invalid folder", rec.Code)
+	}
+	var res struct {
+		Errors []config.FieldError `json:"errors"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	var fields []string
+	for _, fe := range res.Errors {
+		fields = append(fields, fe.Field)
+	}
+	if strings.Join(fields, " ") != "folders[other].path folders[other].copiers" {
+		t.Errorf("unexpected errors %+v", res.Errors)
+	}
+	if f := cfg.Folders()["other"]; f.RawPath != "/b" || f.RescanIntervalS != 60 {
+		t.Errorf("invalid change applied: %+v", f)
+	}
+}
+
+func TestEmbeddedStaticAssetDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("from disk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ".hidden.js"), []byte("hidden"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := embeddedStatic{
+		assetDir: dir,
+		assets:   map[string][]byte{},
+	}
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "from disk" {
+		t.Fatalf("unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+	if ct := rec.HeaderMap.Get("Content-Type"); ct != "text/html" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	if cc := rec.HeaderMap.Get("Cache-Control"); !strings.Contains(cc, "no-cache") {
+		t.Errorf("caching not disabled: %q", cc)
+	}
+
+	// Changes on disk are served directly.
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Body.String() != "changed" {
+		t.Errorf("unexpected response %q after change", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/.hidden.js", nil)
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("dotfile served with status %d", rec.Code)
+	}
+}
+
+func TestEmbeddedStaticConditional(t *testing.T) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write([]byte("<html></html>"))
+	gw.Close()
+
+	handler := embeddedStatic{
+		assets: map[string][]byte{"index.html": buf.Bytes()},
+		hashes: map[string]string{"index.html": "abc123"},
+	}
+
+	get := func(hdr map[string]string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/index.html", nil)
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get(nil)
+	if rec.Code != http.StatusOK || rec.Body.String() != "<html></html>" {
+		t.Fatalf("unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+	if etag := rec.HeaderMap.Get("ETag"); etag != `"abc123"` {
+		t.Errorf("unexpected ETag %s", etag)
+	}
+
+	rec = get(map[string]string{"Accept-Encoding": "deflate, gzip"})
+	if rec.HeaderMap.Get("Content-Encoding") != "gzip" || !bytes.Equal(rec.Body.Bytes(), buf.Bytes()) {
+		t.Error("gzip encoding not used when accepted")
+	}
+	if etag := rec.HeaderMap.Get("ETag"); etag != `"abc123-gzip"` {
+		t.Errorf("unexpected ETag %s for gzipped response", etag)
+	}
+
+	cases := []struct {
+		hdr  map[string]string
+		code int
+	}{
+		{map[string]string{"If-None-Match": `"abc123"`}, http.StatusNotModified},
+		{map[string]string{"If-None-Match": `"other", "abc123"`}, http.StatusNotModified},
+		{map[string]string{"If-None-Match": `"abc123"`, "Accept-Encoding": "gzip"}, http.StatusOK},
+		{map[string]string{"If-None-Match": `"abc123-gzip"`, "Accept-Encoding": "gzip"}, http.StatusNotModified},
+		{map[string]string{"If-None-Match": `"other"`}, http.StatusOK},
+		{map[string]string{"If-Modified-Since": auto.AssetsBuildDate}, http.StatusNotModified},
+		{map[string]string{"If-Modified-Since": "Mon, 02 Jan 2006 15:04:05 GMT"}, http.StatusOK},
+		{map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": auto.AssetsBuildDate}, http.StatusOK},
+	}
+	for _, tc := range cases {
+		if rec := get(tc.hdr); rec.Code != tc.code {
+			t.Errorf("%v: unexpected status %d != %d", tc.hdr, rec.Code, tc.code)
+		}
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	cases := []struct {
+		hdr  string
+		gzip bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.0, deflate", false},
+		{"*", true},
+		{"deflate", false},
+	}
+	for _, tc := range cases {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", tc.hdr)
+		if res := acceptsGzip(req); res != tc.gzip {
+			t.Errorf("%q: unexpected result %v", tc.hdr, res)
+		}
+	}
+}
+
+func TestGzipMiddleware(t *testing.T) {
+	body := strings.Repeat(`{"name": "file"}`, 100)
+	handler := gzipMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/notmodified" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.(http.Flusher).Flush()
+		w.Write([]byte(body))
+	}))
+
+	get := func(path, encoding string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/", "")
+	if rec.HeaderMap.Get("Content-Encoding") != "" || rec.Body.String() != body {
+		t.Errorf("unexpected plain response %q", rec.Body.String())
+	}
+
+	rec = get("/", "gzip")
+	if rec.HeaderMap.Get("Content-Encoding") != "gzip" {
+		t.Fatal("gzip encoding not used when accepted")
+	}
+	if rec.Body.Len() >= len(body) {
+		t.Errorf("response of %d bytes not compressed", rec.Body.Len())
+	}
+	gr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bs, err := ioutil.ReadAll(gr); err != nil || string(bs) != body {
+		t.Errorf("unexpected decompressed response %q, %v", bs, err)
+	}
+
+	rec = get("/notmodified", "gzip")
+	if rec.Code != http.StatusNotModified || rec.HeaderMap.Get("Content-Encoding") != "" || rec.Body.Len() != 0 {
+		t.Errorf("unexpected response %d %q to empty body", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	oldCfg := cfg
+	defer func() { cfg = oldCfg }()
+	cfg = config.Wrap("/tmp/test", config.Configuration{
+		Options: config.OptionsConfiguration{
+			CORSAllowedOrigins: []string{"https://dashboard.example.com"},
+		},
+	})
+
+	guiCfg := config.GUIConfiguration{APIKey: "admin"}
+	handler := corsMiddleware("/rest", guiCfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	cases := []struct {
+		method, path, origin, key string
+		code                      int
+		allowOrigin               string
+	}{
+		// Preflight requests from allowed origins are answered directly
+		{"OPTIONS", "/rest/system/status", "https://dashboard.example.com", "", http.StatusNoContent, "https://dashboard.example.com"},
+		{"OPTIONS", "/rest/system/status", "https://evil.example.com", "", http.StatusTeapot, ""},
+		// Requests get the headers only with an API key
+		{"GET", "/rest/system/status", "https://dashboard.example.com", "admin", http.StatusTeapot, "https://dashboard.example.com"},
+		{"GET", "/rest/system/status", "https://dashboard.example.com", "", http.StatusTeapot, ""},
+		{"GET", "/rest/system/status", "https://dashboard.example.com", "wrong", http.StatusTeapot, ""},
+		{"GET", "/rest/system/status", "https://evil.example.com", "admin", http.StatusTeapot, ""},
+		// Only the REST API is shared
+		{"GET", "/index.html", "https://dashboard.example.com", "admin", http.StatusTeapot, ""},
+	}
+
+	for _, tc := range cases {
+		req, _ := http.NewRequest(tc.method, tc.path, nil)
+		req.Header.Set("Origin", tc.origin)
+		if tc.method == "OPTIONS" {
+			req.Header.Set("Access-Control-Request-Method", "POST")
+		}
+		if tc.key != "" {
+			req.Header.Set("X-API-Key", tc.key)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.code {
+			t.Errorf("%s %s from %s: unexpected status %d != %d", tc.method, tc.path, tc.origin, rec.Code, tc.code)
+		}
+		if origin := rec.HeaderMap.Get("Access-Control-Allow-Origin"); origin != tc.allowOrigin {
+			t.Errorf("%s %s from %s: unexpected allowed origin %q != %q", tc.method, tc.path, tc.origin, origin, tc.allowOrigin)
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix sockets on Windows")
+	}
+
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gui.sock")
+
+	// Leave a socket file behind, as if we had crashed. Closing a datagram
+	// socket doesn't remove the file.
+	stale, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.Close()
+
+	listener, err := listenUnix(path, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0640 {
+		t.Errorf("unexpected mode %v", fi.Mode())
+	}
+	listener.Close()
+
+	// Other files are left alone.
+	ioutil.WriteFile(path, []byte("data"), 0644)
+	if _, err := listenUnix(path, 0600); err == nil {
+		t.Error("unexpected nil error listening on top of a regular file")
+	}
+}
+
+func TestPostSystemReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldCfg, oldPath := cfg, locations[locConfigFile]
+	defer func() { cfg, locations[locConfigFile], configInSync = oldCfg, oldPath, true }()
+	path := filepath.Join(dir, "config.xml")
+	locations[locConfigFile] = path
+
+	cfg = config.Wrap(path, config.New(myID))
+	onDisk := config.Wrap(path, config.New(myID))
+	s := &apiSvc{}
+	reload := func() int {
+		req, _ := http.NewRequest("POST", "/rest/system/reload", nil)
+		rec := httptest.NewRecorder()
+		s.postSystemReload(rec, req)
+		return rec.Code
+	}
+
+	// Changes made to the file are applied
+	opts := onDisk.Options()
+	opts.MaxRecvKbps = 100
+	onDisk.SetOptions(opts)
+	if err := onDisk.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if code := reload(); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if cfg.Options().MaxRecvKbps != 100 {
+		t.Error("change not applied")
+	}
+
+	// An invalid file changes nothing
+	opts.MaxRecvKbps = 200
+	opts.AlwaysLocalNets = []string{"10.0.0.1"}
+	onDisk.SetOptions(opts)
+	if err := onDisk.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if code := reload(); code != http.StatusBadRequest {
+		t.Fatalf("unexpected status %d for invalid config", code)
+	}
+	if cfg.Options().MaxRecvKbps != 100 {
+		t.Error("invalid config applied")
+	}
+}
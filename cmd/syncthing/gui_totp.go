@@ -0,0 +1,239 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/sync"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Users with two-factor authentication enabled append the current TOTP
+// code (RFC 6238), or one of their recovery codes, to their password when
+// logging in.
+const (
+	totpDigits        = 6
+	totpStep          = 30 // seconds
+	totpSkew          = 1  // steps of clock difference accepted either way
+	recoveryCodes     = 8
+	recoveryCodeChars = 10 // written as two groups of five, "abcde-fghij"
+)
+
+var (
+	// Secrets being enrolled, not yet confirmed with a code.
+	totpPending = make(map[string]string) // user name -> secret
+	// The last code counter used by each user, so that a code can't be
+	// replayed.
+	totpLastCounter = make(map[string]uint64)
+	totpMut         = sync.NewMutex()
+)
+
+// newTOTPSecret returns a random secret in base32, as used by
+// authenticator apps.
+func newTOTPSecret() string {
+	bs := make([]byte, 20)
+	rand.Reader.Read(bs)
+	return base32.StdEncoding.EncodeToString(bs)
+}
+
+// totpURI returns the provisioning URI of the secret, to be shown as a QR
+// code.
+func totpURI(name, secret string) string {
+	label := url.QueryEscape("Syncthing:" + name)
+	return fmt.Sprintf("otpauth://totp/%s?secret=%s&issuer=Syncthing&digits=%d&period=%d", label, secret, totpDigits, totpStep)
+}
+
+// totpCode returns the code of the secret for the counter.
+func totpCode(secret string, counter uint64) (string, error) {
+	key, err := base32.StdEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000), nil
+}
+
+// validTOTP returns true if the code is valid for the secret at the given
+// time and has not been used by the user before.
+func validTOTP(name, secret, code string, now time.Time) bool {
+	current := uint64(now.Unix() / totpStep)
+	for c := current - totpSkew; c <= current+totpSkew; c++ {
+		expected, err := totpCode(secret, c)
+		if err != nil {
+			return false
+		}
+		if subtle.ConstantTimeCompare([]byte(code), []byte(expected)) != 1 {
+			continue
+		}
+
+		totpMut.Lock()
+		defer totpMut.Unlock()
+		if last, ok := totpLastCounter[name]; ok && c <= last {
+			return false
+		}
+		totpLastCounter[name] = c
+		return true
+	}
+	return false
+}
+
+// newRecoveryCodes returns new recovery codes and their hashes.
+func newRecoveryCodes(guiCfg config.GUIConfiguration) ([]string, []string, error) {
+	const chars = "abcdefghijkmnpqrstuvwxyz23456789"
+	var codes, hashes []string
+	for i := 0; i < recoveryCodes; i++ {
+		bs := make([]byte, recoveryCodeChars)
+		rand.Reader.Read(bs)
+		for j := range bs {
+			bs[j] = chars[int(bs[j])%len(chars)]
+		}
+		code := string(bs[:recoveryCodeChars/2]) + "-" + string(bs[recoveryCodeChars/2:])
+		hash, err := guiCfg.HashPassword(code)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, code)
+		hashes = append(hashes, hash)
+	}
+	return codes, hashes, nil
+}
+
+// useRecoveryCode returns true if the code is one of the unused recovery
+// codes of the user, and removes it from the configuration.
+func useRecoveryCode(name, code string) bool {
+	guiCfg := cfg.GUI().Copy()
+	user, ok := guiCfg.UserByName(name)
+	if !ok {
+		return false
+	}
+	for i, hash := range user.RecoveryCodes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) == nil {
+			user.RecoveryCodes = append(user.RecoveryCodes[:i], user.RecoveryCodes[i+1:]...)
+			guiCfg.SetUser(user)
+			cfg.SetGUI(guiCfg)
+			cfg.Save()
+			l.Infof("GUI user %q logged in with a recovery code; %d remain", name, len(user.RecoveryCodes))
+			return true
+		}
+	}
+	return false
+}
+
+// authenticateTOTP verifies the password of a user with two-factor
+// authentication enabled, followed by either the current code or a
+// recovery code.
+func authenticateTOTP(guiCfg config.GUIConfiguration, user config.GUIUser, password string) bool {
+	if n := len(password) - totpDigits; n > 0 {
+		if verifyPassword(guiCfg, user.Name, password[:n]) && validTOTP(user.Name, user.TOTPSecret, password[n:], time.Now()) {
+			return true
+		}
+	}
+	if n := len(password) - recoveryCodeChars - 1; n > 0 {
+		if verifyPassword(guiCfg, user.Name, password[:n]) && useRecoveryCode(user.Name, password[n:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *apiSvc) postSystemTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("user")
+	if _, ok := cfg.GUI().UserByName(name); !ok {
+		http.Error(w, "No such user", 404)
+		return
+	}
+
+	secret := newTOTPSecret()
+	totpMut.Lock()
+	totpPending[name] = secret
+	totpMut.Unlock()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret": secret,
+		"uri":    totpURI(name, secret),
+	})
+}
+
+func (s *apiSvc) postSystemTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	name := qs.Get("user")
+
+	totpMut.Lock()
+	secret, ok := totpPending[name]
+	totpMut.Unlock()
+	if !ok {
+		http.Error(w, "No enrollment in progress", 400)
+		return
+	}
+	if !validTOTP(name, secret, qs.Get("code"), time.Now()) {
+		http.Error(w, "Incorrect code", 400)
+		return
+	}
+
+	guiCfg := cfg.GUI().Copy()
+	user, ok := guiCfg.UserByName(name)
+	if !ok {
+		http.Error(w, "No such user", 404)
+		return
+	}
+	codes, hashes, err := newRecoveryCodes(guiCfg)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	user.TOTPSecret = secret
+	user.RecoveryCodes = hashes
+	guiCfg.SetUser(user)
+
+	totpMut.Lock()
+	delete(totpPending, name)
+	totpMut.Unlock()
+
+	cfg.SetGUI(guiCfg)
+	cfg.Save()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string][]string{
+		"recoveryCodes": codes,
+	})
+}
+
+func (s *apiSvc) postSystemTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("user")
+	guiCfg := cfg.GUI().Copy()
+	user, ok := guiCfg.UserByName(name)
+	if !ok {
+		http.Error(w, "No such user", 404)
+		return
+	}
+	user.TOTPSecret = ""
+	user.RecoveryCodes = nil
+	guiCfg.SetUser(user)
+	cfg.SetGUI(guiCfg)
+	cfg.Save()
+}
@@ -0,0 +1,120 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The SHA-1 test secret of RFC 6238, "12345678901234567890", in base32.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// The RFC test vectors, truncated to six digits.
+	cases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tc := range cases {
+		code, err := totpCode(rfcSecret, uint64(tc.unix/totpStep))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tc.code {
+			t.Errorf("%d: code %s != expected %s", tc.unix, code, tc.code)
+		}
+	}
+}
+
+func TestValidTOTP(t *testing.T) {
+	defer func() {
+		totpMut.Lock()
+		delete(totpLastCounter, "totp-user")
+		totpMut.Unlock()
+	}()
+
+	now := time.Unix(1111111109, 0)
+	if validTOTP("totp-user", rfcSecret, "000000", now) {
+		t.Error("incorrect code accepted")
+	}
+	// The previous step is accepted for clock skew
+	if !validTOTP("totp-user", rfcSecret, "081804", now.Add(totpStep*time.Second)) {
+		t.Error("code of the previous step refused")
+	}
+	// But not twice
+	if validTOTP("totp-user", rfcSecret, "081804", now.Add(totpStep*time.Second)) {
+		t.Error("code replayed")
+	}
+	if validTOTP("totp-user", rfcSecret, "081804", now.Add(3*totpStep*time.Second)) {
+		t.Error("code too old accepted")
+	}
+}
+
+func TestAuthenticateTOTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	guiCfg := config.GUIConfiguration{PasswordCost: bcrypt.MinCost}
+	hash, _ := guiCfg.HashPassword("pass")
+	codes, hashes, err := newRecoveryCodes(guiCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := newTOTPSecret()
+	guiCfg.SetUser(config.GUIUser{
+		Name:          "totp-user",
+		Password:      hash,
+		Role:          config.GUIRoleAdmin,
+		TOTPSecret:    secret,
+		RecoveryCodes: hashes,
+	})
+
+	oldCfg := cfg
+	defer func() {
+		cfg = oldCfg
+		totpMut.Lock()
+		delete(totpLastCounter, "totp-user")
+		totpMut.Unlock()
+	}()
+	cfg = config.Wrap(filepath.Join(dir, "config.xml"), config.Configuration{GUI: guiCfg})
+
+	code, _ := totpCode(secret, uint64(time.Now().Unix()/totpStep))
+	if authenticate(guiCfg, "totp-user", "pass") {
+		t.Error("login without a code accepted")
+	}
+	if authenticate(guiCfg, "totp-user", "wrong"+code) {
+		t.Error("login with the wrong password accepted")
+	}
+	if !authenticate(guiCfg, "totp-user", "pass"+code) {
+		t.Error("login with the code refused")
+	}
+
+	if !authenticate(guiCfg, "totp-user", "pass"+codes[3]) {
+		t.Error("login with a recovery code refused")
+	}
+	if user, _ := cfg.GUI().UserByName("totp-user"); len(user.RecoveryCodes) != recoveryCodes-1 {
+		t.Errorf("recovery code not removed; %d remain", len(user.RecoveryCodes))
+	}
+	if authenticate(cfg.GUI(), "totp-user", "pass"+codes[3]) {
+		t.Error("recovery code used twice")
+	}
+}
@@ -16,6 +16,8 @@ import (
 	"time"
 )
 
+const heapDumpInterval = 10 * time.Second
+
 func init() {
 	if innerProcess && os.Getenv("STHEAPPROFILE") != "" {
 		rate := 1
@@ -27,6 +29,45 @@ func init() {
 	}
 }
 
+// dumpHeapAbove writes a heap profile to the config directory when the
+// memory obtained from the operating system grows past the threshold, so that
+// the cause of excessive memory usage can be found. Another profile is
+// written if the usage falls back below the threshold and then exceeds it
+// again.
+func dumpHeapAbove(threshold uint64) {
+	var memstats runtime.MemStats
+	dumped := false
+	for _ = range time.NewTicker(heapDumpInterval).C {
+		runtime.ReadMemStats(&memstats)
+
+		switch {
+		case memstats.Sys > threshold && !dumped:
+			name := timestampedLoc(locHeapDump)
+			if err := writeHeapProfile(name); err != nil {
+				l.Warnln("Writing heap profile:", err)
+			} else {
+				l.Warnf("Memory usage of %d MiB exceeds %d MiB; heap profile written to %q", memstats.Sys>>20, threshold>>20, name)
+			}
+			dumped = true
+
+		case memstats.Sys < threshold:
+			dumped = false
+		}
+	}
+}
+
+func writeHeapProfile(name string) error {
+	fd, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := pprof.WriteHeapProfile(fd); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
 func saveHeapProfiles(rate int) {
 	runtime.MemProfileRate = rate
 	var memstats, prevMemstats runtime.MemStats
@@ -0,0 +1,67 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"net"
+
+	"github.com/syncthing/syncthing/internal/osutil"
+)
+
+// The private address ranges of RFC 1918 and the unique local IPv6
+// addresses of RFC 4193, which are always on the LAN.
+var privateNets = parseNets([]string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"})
+
+// parseNets returns the networks in the given CIDR notation, skipping
+// invalid ones.
+func parseNets(cidrs []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		if _, ipnet, err := net.ParseCIDR(cidr); err == nil {
+			nets = append(nets, ipnet)
+		}
+	}
+	return nets
+}
+
+// isLANAddr returns true if the given address is on the local network: a
+// loopback, link local or private address, or one on one of the networks
+// our interfaces are on or the configured always local networks.
+func isLANAddr(addr net.Addr) bool {
+	tcpaddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	var alwaysLocal []string
+	if cfg != nil {
+		alwaysLocal = cfg.Options().AlwaysLocalNets
+	}
+	return isLANIP(tcpaddr.IP, alwaysLocal)
+}
+
+func isLANIP(ip net.IP, alwaysLocal []string) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return true
+	}
+	for _, lan := range privateNets {
+		if lan.Contains(ip) {
+			return true
+		}
+	}
+	for _, lan := range parseNets(alwaysLocal) {
+		if lan.Contains(ip) {
+			return true
+		}
+	}
+	nets, _ := osutil.GetLans()
+	for _, lan := range nets {
+		if lan.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
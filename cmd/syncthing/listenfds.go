@@ -0,0 +1,154 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+// The listening sockets are opened by the monitor process and handed to
+// syncthing, so that they stay open when syncthing restarts. Incoming
+// connections are then queued by the operating system for the new process
+// to accept, instead of being refused. The sockets are passed as extra files,
+// listed in the environment as space separated address=fd pairs.
+const listenFDsEnv = "STLISTENFDS"
+
+// heldListeners are the listening sockets kept by the monitor process.
+type heldListeners struct {
+	files map[string]*os.File // address -> socket
+}
+
+func newHeldListeners() *heldListeners {
+	return &heldListeners{
+		files: make(map[string]*os.File),
+	}
+}
+
+// update opens the sockets for the configured listeners not already held,
+// and closes those that are no longer configured. The configuration is read
+// anew from disk each time, as it may have changed since the last start.
+func (h *heldListeners) update() {
+	if runtime.GOOS == "windows" {
+		// Extra files can't be passed to a child process on Windows.
+		return
+	}
+
+	cfg, err := config.Load(locations[locConfigFile], protocol.LocalDeviceID)
+	if err != nil {
+		// Most likely there is no config yet; syncthing will create one and
+		// listen by itself.
+		return
+	}
+
+	wanted := make(map[string]bool)
+	for _, addr := range cfg.Options().ListenAddresses() {
+		wanted[addr] = true
+	}
+
+	for addr, fd := range h.files {
+		if !wanted[addr] {
+			fd.Close()
+			delete(h.files, addr)
+		}
+	}
+
+	for addr := range wanted {
+		if _, ok := h.files[addr]; ok {
+			continue
+		}
+		fd, err := listenFile(addr)
+		if err != nil {
+			// Syncthing will try again, and complain properly if it fails.
+			l.Infof("Listening on %s: %v", addr, err)
+			continue
+		}
+		h.files[addr] = fd
+	}
+}
+
+// pass makes the held sockets available to the given command, which must
+// not yet have been started.
+func (h *heldListeners) pass(cmd *exec.Cmd) {
+	var fds []string
+	for addr, fd := range h.files {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, fd)
+		// The extra files follow stdin, stdout and stderr.
+		fds = append(fds, fmt.Sprintf("%s=%d", addr, 2+len(cmd.ExtraFiles)))
+	}
+	os.Setenv(listenFDsEnv, strings.Join(fds, " "))
+}
+
+func listenFile(addr string) (*os.File, error) {
+	tcaddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.ListenTCP("tcp", tcaddr)
+	if err != nil {
+		return nil, err
+	}
+	// The file is a duplicate of the socket, which stays open when the
+	// listener is closed.
+	fd, err := listener.File()
+	listener.Close()
+	return fd, err
+}
+
+var (
+	inheritedFiles    map[string]*os.File // address -> socket
+	inheritedFilesMut = sync.NewMutex()
+)
+
+// inheritedListener returns the listening socket for the given address as
+// passed on by the monitor process, if there is one. The same socket may be
+// returned again after the previous listener for it has been closed.
+//
+// A socket held by the monitor stays open until the next restart, even when
+// the listener for it is removed from the configuration.
+func inheritedListener(addr string) (*net.TCPListener, bool) {
+	inheritedFilesMut.Lock()
+	defer inheritedFilesMut.Unlock()
+
+	if inheritedFiles == nil {
+		// The files are kept for the lifetime of the process, so that the
+		// descriptors aren't closed by the finalizer.
+		inheritedFiles = make(map[string]*os.File)
+		for _, pair := range strings.Fields(os.Getenv(listenFDsEnv)) {
+			idx := strings.LastIndex(pair, "=")
+			if idx < 0 {
+				continue
+			}
+			fd, err := strconv.Atoi(pair[idx+1:])
+			if err != nil {
+				continue
+			}
+			inheritedFiles[pair[:idx]] = os.NewFile(uintptr(fd), pair[:idx])
+		}
+	}
+
+	fd, ok := inheritedFiles[addr]
+	if !ok {
+		return nil, false
+	}
+	listener, err := net.FileListener(fd)
+	if err != nil {
+		l.Infof("Inherited listener for %s: %v", addr, err)
+		return nil, false
+	}
+	tcpListener, ok := listener.(*net.TCPListener)
+	return tcpListener, ok
+}
@@ -0,0 +1,54 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestInheritedListener(t *testing.T) {
+	const addr = "127.0.0.1:0"
+
+	fd, err := listenFile(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+
+	os.Setenv(listenFDsEnv, fmt.Sprintf("[::]:22000=1234 %s=%d", addr, fd.Fd()))
+	defer os.Setenv(listenFDsEnv, "")
+
+	// Make sure the environment is parsed anew.
+	inheritedFilesMut.Lock()
+	inheritedFiles = nil
+	inheritedFilesMut.Unlock()
+
+	if _, ok := inheritedListener("0.0.0.0:22000"); ok {
+		t.Error("got listener for an address that wasn't passed")
+	}
+
+	listener, ok := inheritedListener(addr)
+	if !ok {
+		t.Fatal("no inherited listener")
+	}
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if conn, err := listener.Accept(); err != nil {
+		t.Error(err)
+	} else {
+		conn.Close()
+	}
+}
@@ -31,6 +31,7 @@ const (
 	locCsrfTokens                 = "csrfTokens"
 	locPanicLog                   = "panicLog"
 	locAuditLog                   = "auditLog"
+	locHeapDump                   = "heapDump"
 	locDefFolder                  = "defFolder"
 )
 
@@ -52,6 +53,7 @@ var locations = map[locationEnum]string{
 	locCsrfTokens:    "${config}/csrftokens.txt",
 	locPanicLog:      "${config}/panic-${timestamp}.log",
 	locAuditLog:      "${config}/audit-${timestamp}.log",
+	locHeapDump:      "${config}/heap-${timestamp}.pprof",
 	locDefFolder:     "${home}/Sync",
 }
 
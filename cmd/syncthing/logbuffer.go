@@ -0,0 +1,93 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/calmh/logger"
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+// The number of log lines kept in memory for the REST interface.
+const logBufferLines = 1000
+
+var logLevelNames = [logger.NumLevels]string{
+	logger.LevelDebug:   "DEBUG",
+	logger.LevelVerbose: "VERBOSE",
+	logger.LevelInfo:    "INFO",
+	logger.LevelOK:      "OK",
+	logger.LevelWarn:    "WARNING",
+	logger.LevelFatal:   "FATAL",
+}
+
+type logLine struct {
+	When    time.Time `json:"when"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+}
+
+// A logBuffer keeps the most recent log lines, oldest first.
+type logBuffer struct {
+	lines []logLine
+	max   int
+	mut   sync.Mutex
+}
+
+var recentLog = newLogBuffer(logBufferLines)
+
+func init() {
+	for level := logger.LevelDebug; level < logger.NumLevels; level++ {
+		l.AddHandler(level, recentLog.add)
+	}
+}
+
+func newLogBuffer(max int) *logBuffer {
+	return &logBuffer{
+		max: max,
+		mut: sync.NewMutex(),
+	}
+}
+
+// add is a logger.MessageHandler. It is called with the logger lock held and
+// must not log.
+func (b *logBuffer) add(level logger.LogLevel, msg string) {
+	b.mut.Lock()
+	b.lines = append(b.lines, logLine{time.Now(), logLevelNames[level], msg})
+	if len(b.lines) >= 2*b.max {
+		// Trim now and then rather than on every line; the surplus is
+		// skipped when reading.
+		b.lines = append([]logLine(nil), b.lines[len(b.lines)-b.max:]...)
+	}
+	b.mut.Unlock()
+}
+
+// since returns the lines logged after the given time.
+func (b *logBuffer) since(t time.Time) []logLine {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	lines := b.lines
+	if len(lines) > b.max {
+		lines = lines[len(lines)-b.max:]
+	}
+	for i, line := range lines {
+		if line.When.After(t) {
+			return append([]logLine(nil), lines[i:]...)
+		}
+	}
+	return nil
+}
+
+// writeLogText writes the lines in a format similar to the console log.
+func writeLogText(w io.Writer, lines []logLine) {
+	for _, line := range lines {
+		fmt.Fprintf(w, "%s %s: %s\n", line.When.Format("2006-01-02 15:04:05"), line.Level, line.Message)
+	}
+}
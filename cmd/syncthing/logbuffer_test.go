@@ -0,0 +1,48 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/calmh/logger"
+)
+
+func TestLogBuffer(t *testing.T) {
+	b := newLogBuffer(10)
+	for i := 0; i < 25; i++ {
+		b.add(logger.LevelInfo, fmt.Sprint("line ", i))
+	}
+
+	lines := b.since(time.Time{})
+	if len(lines) != 10 {
+		t.Fatalf("got %d lines, expected 10", len(lines))
+	}
+	if lines[0].Message != "line 15" || lines[9].Message != "line 24" {
+		t.Errorf("unexpected lines %q ... %q", lines[0].Message, lines[9].Message)
+	}
+	if lines[0].Level != "INFO" {
+		t.Errorf("unexpected level %q", lines[0].Level)
+	}
+
+	if lines := b.since(lines[7].When); len(lines) > 2 {
+		t.Errorf("got %d lines after the eighth, expected at most 2", len(lines))
+	}
+	if lines := b.since(time.Now().Add(time.Second)); len(lines) != 0 {
+		t.Errorf("got %d lines from the future", len(lines))
+	}
+
+	var buf bytes.Buffer
+	writeLogText(&buf, lines[:2])
+	if !strings.HasSuffix(buf.String(), " INFO: line 15\n"+lines[1].When.Format("2006-01-02 15:04:05")+" INFO: line 16\n") {
+		t.Errorf("unexpected text %q", buf.String())
+	}
+}
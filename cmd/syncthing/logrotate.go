@@ -0,0 +1,164 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/osutil"
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+// A rotatedFile is a log file that is rotated when it grows too large or too
+// old. Rotated files are named as the log file plus ".1", ".2" and so on,
+// with ".1" being the most recent, optionally compressed with a ".gz" suffix.
+type rotatedFile struct {
+	name     string
+	maxSize  int64         // rotate when the file would grow larger than this; 0 for no limit
+	maxAge   time.Duration // rotate when the file is older than this; 0 for no limit
+	keep     int           // number of rotated files to keep
+	compress bool          // compress the rotated files
+
+	fd      *os.File
+	size    int64
+	created time.Time
+	mut     sync.Mutex
+}
+
+// newRotatedFile opens the named log file. The log of a previous run, if
+// any, is rotated away first.
+func newRotatedFile(name string, maxSize int64, maxAge time.Duration, keep int, compress bool) (*rotatedFile, error) {
+	f := &rotatedFile{
+		name:     name,
+		maxSize:  maxSize,
+		maxAge:   maxAge,
+		keep:     keep,
+		compress: compress,
+		mut:      sync.NewMutex(),
+	}
+
+	if fi, err := os.Stat(name); err == nil && fi.Size() > 0 {
+		if err := f.shift(); err != nil {
+			return nil, err
+		}
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatedFile) Write(bs []byte) (int, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	if f.size > 0 && (f.maxSize > 0 && f.size+int64(len(bs)) > f.maxSize || f.maxAge > 0 && time.Since(f.created) > f.maxAge) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.fd.Write(bs)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatedFile) Close() error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return f.fd.Close()
+}
+
+func (f *rotatedFile) open() error {
+	fd, err := os.Create(f.name)
+	if err != nil {
+		return err
+	}
+	f.fd = fd
+	f.size = 0
+	f.created = time.Now()
+	return nil
+}
+
+func (f *rotatedFile) rotate() error {
+	f.fd.Close()
+	if err := f.shift(); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+// shift renames the log file and the rotated files one step down the line,
+// removing the oldest one.
+func (f *rotatedFile) shift() error {
+	ext := ""
+	if f.compress {
+		ext = ".gz"
+	}
+
+	if f.keep < 1 {
+		return os.Remove(f.name)
+	}
+
+	os.Remove(f.rotatedName(f.keep) + ext)
+	for i := f.keep - 1; i >= 1; i-- {
+		os.Rename(f.rotatedName(i)+ext, f.rotatedName(i+1)+ext)
+	}
+
+	first := f.rotatedName(1)
+	if err := osutil.Rename(f.name, first); err != nil {
+		return err
+	}
+	if f.compress {
+		if err := gzipFile(first); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *rotatedFile) rotatedName(i int) string {
+	return fmt.Sprintf("%s.%d", f.name, i)
+}
+
+// gzipFile compresses the named file into one with a ".gz" suffix, and
+// removes the original.
+func gzipFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(name + ".gz")
+	if err != nil {
+		return err
+	}
+
+	gw := gzip.NewWriter(dst)
+	if _, err := io.Copy(gw, src); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(dst.Name())
+		return err
+	}
+
+	src.Close()
+	return os.Remove(name)
+}
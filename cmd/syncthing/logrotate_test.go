@@ -0,0 +1,96 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotatedFileSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "syncthing.log")
+
+	// The log of a previous run is rotated away on start.
+	ioutil.WriteFile(name, []byte("previous\n"), 0644)
+
+	f, err := newRotatedFile(name, 10, 0, 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	expected := map[string]string{
+		name:        "third\n",
+		name + ".1": "second\n",
+		name + ".2": "first\n",
+	}
+	for file, data := range expected {
+		bs, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Error(err)
+		} else if string(bs) != data {
+			t.Errorf("%s contains %q, not %q", file, bs, data)
+		}
+	}
+	if _, err := os.Stat(name + ".3"); !os.IsNotExist(err) {
+		t.Error("too many rotated files kept")
+	}
+}
+
+func TestRotatedFileAgeCompressed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "syncthing.log")
+
+	f, err := newRotatedFile(name, 0, time.Hour, 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("old\n"))
+	f.created = f.created.Add(-2 * time.Hour)
+	f.Write([]byte("new\n"))
+	f.Close()
+
+	bs, err := ioutil.ReadFile(name)
+	if err != nil || string(bs) != "new\n" {
+		t.Errorf("unexpected log file contents %q, %v", bs, err)
+	}
+
+	fd, err := os.Open(name + ".1.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	gr, err := gzip.NewReader(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err = ioutil.ReadAll(gr)
+	if err != nil || string(bs) != "old\n" {
+		t.Errorf("unexpected rotated file contents %q, %v", bs, err)
+	}
+	if _, err := os.Stat(name + ".1"); !os.IsNotExist(err) {
+		t.Error("uncompressed rotated file remains")
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"io/ioutil"
+	"strconv"
+	"syscall"
+)
+
+const (
+	ioprioClassShift = 13
+	ioprioClassBE    = 2
+	ioprioWhoProcess = 1
+)
+
+// setLowPriority lowers the CPU and I/O priority of the process. On Linux
+// both are properties of the individual thread, so each existing thread is
+// changed; threads created later inherit the priorities from the thread
+// creating them.
+func setLowPriority() error {
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, lowPriorityNice); err != nil {
+			return err
+		}
+		// Lowest priority within the "best effort" class, which is the
+		// default one.
+		prio := ioprioClassBE<<ioprioClassShift | 7
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(prio)); errno != 0 {
+			return errno
+		}
+	}
+
+	return nil
+}
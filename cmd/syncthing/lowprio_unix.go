@@ -0,0 +1,18 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build !windows,!linux,!solaris
+
+package main
+
+import "syscall"
+
+// setLowPriority lowers the CPU priority of the process. There is no
+// portable way to lower the I/O priority, but it usually follows the CPU
+// priority on these platforms.
+func setLowPriority() error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, 0, lowPriorityNice)
+}
@@ -0,0 +1,36 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build windows
+
+package main
+
+import "syscall"
+
+const (
+	belowNormalPriorityClass   = 0x00004000
+	processModeBackgroundBegin = 0x00100000
+)
+
+var setPriorityClass = syscall.NewLazyDLL("kernel32.dll").NewProc("SetPriorityClass")
+
+// setLowPriority lowers the CPU priority of the process and puts it in
+// background processing mode, which also lowers its I/O and memory priority.
+func setLowPriority() error {
+	handle, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return err
+	}
+
+	if r, _, err := setPriorityClass.Call(uintptr(handle), belowNormalPriorityClass); r == 0 {
+		return err
+	}
+	if r, _, err := setPriorityClass.Call(uintptr(handle), processModeBackgroundBegin); r == 0 {
+		return err
+	}
+
+	return nil
+}
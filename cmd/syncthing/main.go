@@ -17,12 +17,15 @@ import (
 	_ "net/http/pprof"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"runtime"
 	"runtime/pprof"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/calmh/logger"
@@ -35,12 +38,12 @@ import (
 	"github.com/syncthing/syncthing/internal/model"
 	"github.com/syncthing/syncthing/internal/osutil"
 	"github.com/syncthing/syncthing/internal/symlinks"
+	"github.com/syncthing/syncthing/internal/sync"
 	"github.com/syncthing/syncthing/internal/upgrade"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/errors"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/thejerf/suture"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var (
@@ -66,6 +69,8 @@ const (
 const (
 	bepProtocolName   = "bep/1.0"
 	pingEventInterval = time.Minute
+	lowPriorityNice   = 10               // used when running at background priority, where applicable
+	folderStopTimeout = 10 * time.Second // time given to in-flight transfers on shutdown and restart
 )
 
 var l = logger.DefaultLogger
@@ -110,7 +115,6 @@ var (
 	stop           = make(chan int)
 	discoverer     *discover.Discoverer
 	cert           tls.Certificate
-	lans           []*net.IPNet
 )
 
 const (
@@ -134,13 +138,57 @@ above). The value 0 is used to disable all of the above. The default is to
 show time only (2).
 
 
+Option Overrides
+----------------
+
+Any option in the options and GUI sections of the configuration can be
+overridden, without saving the new value, by -option name=value or an
+environment variable STOPTION_NAME=value. The name is that of the option in
+the REST API, such as maxRecvKbps, prefixed by gui for the GUI section, such
+as guiAddress, and is not case sensitive. Lists are given comma separated;
+listeners as their addresses. Changes made to overridden options in the GUI
+have no effect.
+
+  syncthing -option maxRecvKbps=1000 -option listeners=0.0.0.0:22001
+  STOPTION_GLOBALANNOUNCEENABLED=false STOPTION_GUIADDRESS=0.0.0.0:8384 syncthing
+
+
+Unattended Setup
+----------------
+
+A new config, as created on the first start or by -generate, can be set up
+from a JSON file given by -bootstrap or the STBOOTSTRAP environment
+variable. It has the format of /rest/system/config, with anything left out
+keeping its default. The folders and devices are added to the defaults. With
+-generate, the -gui-address, -gui-authentication and -gui-apikey settings are
+also saved.
+
+  {
+    "gui": {"address": "0.0.0.0:8384", "apiKey": "abc123"},
+    "devices": [{"deviceID": "AIR6LPZ-...", "name": "nas"}],
+    "folders": [{"id": "photos", "path": "/data/photos",
+                 "devices": [{"deviceID": "AIR6LPZ-..."}]}]
+  }
+
+
+Reloading the Config
+--------------------
+
+The config file is read again on SIGHUP, or a POST to /rest/system/reload,
+and the changes made to it are applied as if made in the GUI. A config that
+isn't valid is not applied, and the errors are logged.
+
+
 Development Settings
 --------------------
 
 The following environment variables modify syncthing's behavior in ways that
 are mostly useful for developers. Use with care.
 
- STGUIASSETS     Directory to load GUI assets from. Overrides compiled in assets.
+ STGUIASSETS     Directory to load GUI assets from, such as "gui". Files there
+                 override the compiled in assets and are read from disk on each
+                 request, with caching disabled, so that changes to the GUI
+                 don't require regenerating the compiled in assets.
 
  STTRACE         A comma separated string of facilities to trace. The valid
                  facility strings are:
@@ -153,12 +201,16 @@ are mostly useful for developers. Use with care.
                  - "locks"    (the sync package; trace long held locks)
                  - "net"      (the main package; connections & network messages)
                  - "model"    (the model package)
+                 - "protocol" (the protocol package)
                  - "scanner"  (the scanner package)
                  - "stats"    (the stats package)
                  - "upnp"     (the upnp package)
                  - "xdr"      (the xdr package)
                  - "all"      (all of the above)
 
+                 Facilities can also be enabled and disabled at runtime,
+                 using the /rest/system/debug endpoint.
+
  STPROFILER      Set to a listen address such as "127.0.0.1:9090" to start the
                  profiler with HTTP access.
 
@@ -175,6 +227,11 @@ are mostly useful for developers. Use with care.
 
  STNOUPGRADE     Disable automatic upgrades.
 
+ STFAULTS        Inject faults, for testing error handling. A comma separated
+                 list of "drop", "truncate" and "diskfull" probabilities per
+                 write, and a maximum "delay" before each network write, such
+                 as "drop=0.01,delay=500ms,diskfull=0.05".
+
  GOMAXPROCS      Set the maximum number of CPU cores to use. Defaults to all
                  available CPU cores.
 
@@ -186,6 +243,8 @@ are mostly useful for developers. Use with care.
 // Command line and environment options
 var (
 	reset             bool
+	repairDB          bool
+	verifyFiles       bool
 	showVersion       bool
 	doUpgrade         bool
 	doUpgradeCheck    bool
@@ -193,7 +252,15 @@ var (
 	noBrowser         bool
 	noConsole         bool
 	generateDir       string
+	diagnoseDevice    string
+	selfTest          bool
+	selfTestDevice    string
+	genCompletion     string
 	logFile           string
+	logMaxSizeMiB     int
+	logMaxAgeH        int
+	logMaxOldFiles    int
+	logCompress       bool
 	auditEnabled      bool
 	verbose           bool
 	noRestart         = os.Getenv("STNORESTART") != ""
@@ -203,9 +270,13 @@ var (
 	guiAPIKey         = os.Getenv("STGUIAPIKEY")  // legacy
 	profiler          = os.Getenv("STPROFILER")
 	guiAssets         = os.Getenv("STGUIASSETS")
+	bootstrapFile     = os.Getenv("STBOOTSTRAP")
 	cpuProfile        = os.Getenv("STCPUPROFILE") != ""
 	stRestarting      = os.Getenv("STRESTART") != ""
+	rolledBackFrom    = os.Getenv("STROLLEDBACK")    // set by the monitor after rolling back a failed upgrade
+	failedUpgrade     = os.Getenv("STUPGRADEFAILED") // version not to upgrade to again
 	innerProcess      = os.Getenv("STNORESTART") != "" || os.Getenv("STMONITORED") != ""
+	optionOverrides   = make(config.Overrides)
 )
 
 func main() {
@@ -217,10 +288,21 @@ func main() {
 
 		// We also add an option to hide the console window
 		flag.BoolVar(&noConsole, "no-console", false, "Hide console window")
+	} else {
+		flag.StringVar(&logFile, "logfile", "", "Log file name, in addition to stdout")
 	}
+	flag.IntVar(&logMaxSizeMiB, "log-max-size", 10, "Rotate the log file when larger than this many MiB; 0 for no limit")
+	flag.IntVar(&logMaxAgeH, "log-max-age", 0, "Rotate the log file when older than this many hours; 0 for no limit")
+	flag.IntVar(&logMaxOldFiles, "log-max-old-files", 3, "Number of rotated log files to keep")
+	flag.BoolVar(&logCompress, "log-compress", false, "Compress rotated log files")
 
 	flag.StringVar(&generateDir, "generate", "", "Generate key and config in specified dir, then exit")
-	flag.StringVar(&guiAddress, "gui-address", guiAddress, "Override GUI address")
+	flag.StringVar(&bootstrapFile, "bootstrap", bootstrapFile, "Set up a new config, on the first start or with -generate, from this JSON file")
+	flag.StringVar(&genCompletion, "generate-completion", "", "Print a completion script for the given shell (bash or zsh), then exit")
+	flag.StringVar(&diagnoseDevice, "diagnose-connection", "", "Try to connect to the given device ID, report each step, then exit")
+	flag.BoolVar(&selfTest, "self-test", false, "Measure hashing and encryption speed, then exit")
+	flag.StringVar(&selfTestDevice, "self-test-device", "", "With -self-test, also measure transfer speed from the given connected device ID")
+	flag.StringVar(&guiAddress, "gui-address", guiAddress, "Override GUI address; \"unix:///path/to/socket\" for a unix socket")
 	flag.StringVar(&guiAuthentication, "gui-authentication", guiAuthentication, "Override GUI authentication; username:password")
 	flag.StringVar(&guiAPIKey, "gui-apikey", guiAPIKey, "Override GUI API key")
 	flag.StringVar(&confDir, "home", "", "Set configuration directory")
@@ -228,16 +310,32 @@ func main() {
 	flag.BoolVar(&noBrowser, "no-browser", false, "Do not start browser")
 	flag.BoolVar(&noRestart, "no-restart", noRestart, "Do not restart; just exit")
 	flag.BoolVar(&reset, "reset", false, "Reset the database")
+	flag.BoolVar(&repairDB, "repair-database", false, "Repair the database and rebuild the local index from disk before starting")
+	flag.BoolVar(&verifyFiles, "verify", false, "Verify the local files against the index before starting and report corrupted files")
 	flag.BoolVar(&doUpgrade, "upgrade", false, "Perform upgrade")
 	flag.BoolVar(&doUpgradeCheck, "upgrade-check", false, "Check for available upgrade")
 	flag.BoolVar(&showVersion, "version", false, "Show version")
 	flag.StringVar(&upgradeTo, "upgrade-to", upgradeTo, "Force upgrade directly from specified URL")
 	flag.BoolVar(&auditEnabled, "audit", false, "Write events to audit file")
 	flag.BoolVar(&verbose, "verbose", false, "Print verbose log output")
+	flag.Var(optionOverrides, "option", "Override a configuration option without saving it, as name=value; may be repeated")
+
+	if err := optionOverrides.SetEnv(os.Environ()); err != nil {
+		l.Fatalln("Overriding options:", err)
+	}
 
 	flag.Usage = usageFor(flag.CommandLine, usage, fmt.Sprintf(extraUsage, baseDirs["config"]))
 	flag.Parse()
 
+	if genCompletion != "" {
+		script, err := completionScript(flag.CommandLine, genCompletion)
+		if err != nil {
+			l.Fatalln(err)
+		}
+		fmt.Print(script)
+		return
+	}
+
 	if noConsole {
 		osutil.HideConsole()
 	}
@@ -292,14 +390,12 @@ func main() {
 			l.Infoln("Device ID:", protocol.NewDeviceID(cert.Certificate[0]))
 		} else {
 			cert, err = newCertificate(certFile, keyFile, tlsDefaultCommonName)
-			myID = protocol.NewDeviceID(cert.Certificate[0])
 			if err != nil {
 				l.Fatalln("load cert:", err)
 			}
-			if err == nil {
-				l.Infoln("Device ID:", protocol.NewDeviceID(cert.Certificate[0]))
-			}
+			l.Infoln("Device ID:", protocol.NewDeviceID(cert.Certificate[0]))
 		}
+		myID = protocol.NewDeviceID(cert.Certificate[0])
 
 		cfgFile := filepath.Join(dir, "config.xml")
 		if _, err := os.Stat(cfgFile); err == nil {
@@ -307,7 +403,10 @@ func main() {
 			return
 		}
 		var myName, _ = os.Hostname()
-		var newCfg = defaultConfig(myName)
+		var newCfg = newConfig(myName)
+		// Settings given on the command line are kept, as there is no
+		// later start for them to apply to
+		newCfg.GUI = overrideGUIConfig(newCfg.GUI, guiAddress, guiAuthentication, guiAPIKey)
 		var cfg = config.Wrap(cfgFile, newCfg)
 		err = cfg.Save()
 		if err != nil {
@@ -374,6 +473,16 @@ func main() {
 		return
 	}
 
+	if diagnoseDevice != "" {
+		diagnoseMain(diagnoseDevice)
+		return
+	}
+
+	if selfTest {
+		selfTestMain(selfTestDevice)
+		return
+	}
+
 	if noRestart {
 		syncthingMain()
 	} else {
@@ -382,26 +491,10 @@ func main() {
 }
 
 func upgradeViaRest() error {
-	cfg, err := config.Load(locations[locConfigFile], protocol.LocalDeviceID)
+	client, r, err := newRestRequest("POST", "rest/system/upgrade")
 	if err != nil {
 		return err
 	}
-	target := cfg.GUI().Address
-	if cfg.GUI().UseTLS {
-		target = "https://" + target
-	} else {
-		target = "http://" + target
-	}
-	r, _ := http.NewRequest("POST", target+"/rest/system/upgrade", nil)
-	r.Header.Set("X-API-Key", cfg.GUI().APIKey)
-
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	client := &http.Client{
-		Transport: tr,
-		Timeout:   60 * time.Second,
-	}
 	resp, err := client.Do(r)
 	if err != nil {
 		return err
@@ -418,6 +511,40 @@ func upgradeViaRest() error {
 	return err
 }
 
+// newRestRequest returns a client and request for the given path of the REST
+// interface of the Syncthing running with the same configuration.
+func newRestRequest(method, urlPath string) (*http.Client, *http.Request, error) {
+	cfg, err := config.Load(locations[locConfigFile], protocol.LocalDeviceID)
+	if err != nil {
+		return nil, nil, err
+	}
+	target := cfg.GUI().Address
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	if path, ok := cfg.GUI().UnixSocket(); ok {
+		target = "http://localhost"
+		tr.Dial = func(string, string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		}
+	} else if cfg.GUI().UseTLS {
+		target = "https://" + target
+	} else {
+		target = "http://" + target
+	}
+	r, err := http.NewRequest(method, target+cfg.GUI().URLPath()+urlPath, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	r.Header.Set("X-API-Key", cfg.GUI().APIKey)
+
+	client := &http.Client{
+		Transport: tr,
+		Timeout:   60 * time.Second,
+	}
+	return client, r, nil
+}
+
 func syncthingMain() {
 	// Create a main service manager. We'll add things to this as we go along.
 	// We want any logging it does to go through our log system, with INFO
@@ -448,7 +575,8 @@ func syncthingMain() {
 	events.Default.Log(events.Starting, map[string]string{"home": baseDirs["config"]})
 
 	// Ensure that that we have a certificate and key.
-	cert, err := tls.LoadX509KeyPair(locations[locCertFile], locations[locKeyFile])
+	var err error
+	cert, err = tls.LoadX509KeyPair(locations[locCertFile], locations[locKeyFile])
 	if err != nil {
 		cert, err = newCertificate(locations[locCertFile], locations[locKeyFile], tlsDefaultCommonName)
 		if err != nil {
@@ -493,18 +621,26 @@ func syncthingMain() {
 	} else {
 		l.Infoln("No config file; starting with empty defaults")
 		myName, _ = os.Hostname()
-		newCfg := defaultConfig(myName)
+		newCfg := newConfig(myName)
 		cfg = config.Wrap(cfgFile, newCfg)
 		cfg.Save()
 		l.Infof("Edit %s to taste or use the GUI\n", cfgFile)
 	}
 
 	if cfg.Raw().OriginalVersion != config.CurrentVersion {
-		l.Infoln("Archiving a copy of old config file format")
-		// Archive a copy
-		osutil.Rename(cfgFile, cfgFile+fmt.Sprintf(".v%d", cfg.Raw().OriginalVersion))
-		// Save the new version
-		cfg.Save()
+		// Archive a copy and save the new version, unless archiving fails in
+		// which case we keep the old file as is.
+		if archive, err := config.Archive(cfgFile, cfg.Raw().OriginalVersion); err != nil {
+			l.Warnln("Archiving old config file format:", err)
+		} else {
+			l.Infoln("Archived a copy of old config file format as", archive)
+			cfg.Save()
+		}
+	}
+
+	if len(optionOverrides) > 0 {
+		cfg.SetOverrides(optionOverrides)
+		l.Infoln("Overriding options, without saving them:", optionOverrides)
 	}
 
 	if err := checkShortIDs(cfg); err != nil {
@@ -525,28 +661,21 @@ func syncthingMain() {
 	// The TLS configuration is used for both the listening socket and outgoing
 	// connections.
 
-	tlsCfg := &tls.Config{
-		Certificates:           []tls.Certificate{cert},
-		NextProtos:             []string{bepProtocolName},
-		ClientAuth:             tls.RequestClientCert,
-		SessionTicketsDisabled: true,
-		InsecureSkipVerify:     true,
-		MinVersion:             tls.VersionTLS12,
-		CipherSuites: []uint16{
-			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
-			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
-		},
-	}
+	tlsCfg := newTLSConfig(cert, cfg.Options())
 
 	// If the read or write rate should be limited, set up a rate limiter for it.
 	// This will be used on connections created in the connect and listen routines.
 
 	opts := cfg.Options()
 
+	if opts.BackgroundPriority {
+		if err := setLowPriority(); err != nil {
+			l.Warnln("Failed to lower process priority:", err)
+		} else {
+			l.Infoln("Running at background priority")
+		}
+	}
+
 	if !opts.SymlinksEnabled {
 		symlinks.Supported = false
 	}
@@ -559,7 +688,9 @@ func syncthingMain() {
 	}
 
 	if (opts.MaxRecvKbps > 0 || opts.MaxSendKbps > 0) && !opts.LimitBandwidthInLan {
-		lans, _ = osutil.GetLans()
+		lans, _ := osutil.GetLans()
+		lans = append(lans, privateNets...)
+		lans = append(lans, parseNets(opts.AlwaysLocalNets)...)
 		networks := make([]string, 0, len(lans))
 		for _, lan := range lans {
 			networks = append(networks, lan.String())
@@ -576,6 +707,11 @@ func syncthingMain() {
 		l.Fatalln("Cannot open database:", err, "- Is another copy of Syncthing already running?")
 	}
 
+	// Continue the event IDs from the events kept in the database as early
+	// as possible.
+	eventLog = newEventLogSvc(cfg, ldb)
+	mainSvc.Add(eventLog)
+
 	// Remove database entries for folders that no longer exist in the config
 	folders := cfg.Folders()
 	for _, folder := range db.ListFolders(ldb) {
@@ -596,6 +732,19 @@ func syncthingMain() {
 		m.StartDeadlockDetector(20 * 60 * time.Second)
 	}
 
+	if opts.MaxCPUPercent > 0 {
+		go reportCPUUsage(m)
+	}
+
+	if opts.HeapDumpThresholdMiB > 0 {
+		go dumpHeapAbove(uint64(opts.HeapDumpThresholdMiB) << 20)
+	}
+
+	go storeHistory(m)
+	go cleanTempFiles(m)
+	go expireTombstones(m)
+	go reloadOnSignal()
+
 	// GUI
 
 	setupGUI(mainSvc, cfg, m)
@@ -613,28 +762,24 @@ func syncthingMain() {
 		}
 	}
 
-	// The default port we announce, possibly modified by setupUPnP next.
-
-	addr, err := net.ResolveTCPAddr("tcp", opts.ListenAddress[0])
-	if err != nil {
-		l.Fatalln("Bad listen address:", err)
+	if repairDB && !stRestarting {
+		repairDatabase(ldb, m)
 	}
 
-	// Start discovery
+	if verifyFiles && !stRestarting {
+		verifyFolders(m)
+	}
 
-	localPort := addr.Port
-	discoverer = discovery(localPort)
+	// Start discovery and UPnP. These follow any changes to the listeners,
+	// so the announcer needs not be kept around.
 
-	// Start UPnP. The UPnP service will restart global discovery if the
-	// external port changes.
-
-	if opts.UPnPEnabled {
-		upnpSvc := newUPnPSvc(cfg, localPort)
-		mainSvc.Add(upnpSvc)
-	}
+	newAnnouncer(mainSvc, cfg)
 
 	connectionSvc := newConnectionSvc(cfg, myID, m, tlsCfg)
 	mainSvc.Add(connectionSvc)
+	mainSvc.Add(newMeteredMonitor(cfg, connectionSvc))
+	mainSvc.Add(newNotificationSvc(cfg))
+	mainSvc.Add(newErrorMailer(cfg, m))
 
 	for _, folder := range cfg.Folders() {
 		// Routine to pull blocks from other devices to synchronize the local
@@ -684,6 +829,8 @@ func syncthingMain() {
 	// Hence we don't keep the returned pointer.
 	newUsageReportingManager(m, cfg)
 
+	mainSvc.Add(newBatteryMonitor(cfg, m))
+
 	if opts.RestartOnWakeup {
 		go standbyMonitor()
 	}
@@ -698,6 +845,14 @@ func syncthingMain() {
 		}
 	}
 
+	if rolledBackFrom != "" {
+		l.Warnf("The upgrade to %s crashed repeatedly and was rolled back.", rolledBackFrom)
+		events.Default.Log(events.UpgradeRolledBack, map[string]string{
+			"failedVersion": rolledBackFrom,
+			"version":       Version,
+		})
+	}
+
 	events.Default.Log(events.StartupComplete, nil)
 	go generatePingEvents()
 
@@ -705,6 +860,12 @@ func syncthingMain() {
 
 	code := <-stop
 
+	// Let the folders finish or checkpoint what they're pulling while the
+	// connections are still up.
+	if !m.StopFolders(folderStopTimeout) {
+		l.Infoln("Folders did not stop in time; exiting anyway")
+	}
+
 	mainSvc.Stop()
 
 	l.Okln("Exiting")
@@ -716,7 +877,7 @@ func dbOpts() *opt.Options {
 
 	// Default is 8 MiB. In reality, the database will use twice the amount we
 	// calculate here, as it also has two write buffers each sized at half the
-	// block cache.
+	// block cache, unless configured otherwise.
 	blockCacheCapacity := 8 << 20
 	// Increase block cache up to this maximum:
 	const maxCapacity = 64 << 20
@@ -740,10 +901,15 @@ func dbOpts() *opt.Options {
 		l.Infoln("Database block cache capacity", blockCacheCapacity/1024, "KiB")
 	}
 
+	writeBuffer := blockCacheCapacity / 2
+	if v := cfg.Options().DatabaseWriteBufferMiB; v != 0 {
+		writeBuffer = v << 20
+	}
+
 	return &opt.Options{
 		OpenFilesCacheCapacity: 100,
 		BlockCacheCapacity:     blockCacheCapacity,
-		WriteBuffer:            blockCacheCapacity / 2,
+		WriteBuffer:            writeBuffer,
 	}
 }
 
@@ -767,8 +933,19 @@ func startAuditing(mainSvc *suture.Supervisor) {
 func setupGUI(mainSvc *suture.Supervisor, cfg *config.Wrapper, m *model.Model) {
 	opts := cfg.Options()
 	guiCfg := overrideGUIConfig(cfg.GUI(), guiAddress, guiAuthentication, guiAPIKey)
+	gui := &guiManager{
+		mainSvc: mainSvc,
+		model:   m,
+		guiCfg:  guiCfg,
+		mut:     sync.NewMutex(),
+	}
 
-	if guiCfg.Enabled && guiCfg.Address != "" {
+	if path, ok := guiCfg.UnixSocket(); ok && guiCfg.Enabled {
+		l.Infoln("Starting web GUI on unix socket", path)
+		if err := gui.start(guiCfg); err != nil {
+			l.Fatalln("Cannot start GUI:", err)
+		}
+	} else if guiCfg.Enabled && guiCfg.Address != "" {
 		addr, err := net.ResolveTCPAddr("tcp", guiCfg.Address)
 		if err != nil {
 			l.Fatalf("Cannot start GUI on %q: %v", guiCfg.Address, err)
@@ -791,22 +968,85 @@ func setupGUI(mainSvc *suture.Supervisor, cfg *config.Wrapper, m *model.Model) {
 				proto = "https"
 			}
 
-			urlShow := fmt.Sprintf("%s://%s/", proto, net.JoinHostPort(hostShow, strconv.Itoa(addr.Port)))
+			urlShow := fmt.Sprintf("%s://%s%s", proto, net.JoinHostPort(hostShow, strconv.Itoa(addr.Port)), guiCfg.URLPath())
 			l.Infoln("Starting web GUI on", urlShow)
-			api, err := newAPISvc(guiCfg, guiAssets, m)
-			if err != nil {
+			if err := gui.start(guiCfg); err != nil {
 				l.Fatalln("Cannot start GUI:", err)
 			}
-			mainSvc.Add(api)
 
 			if opts.StartBrowser && !noBrowser && !stRestarting {
-				urlOpen := fmt.Sprintf("%s://%s/", proto, net.JoinHostPort(hostOpen, strconv.Itoa(addr.Port)))
+				urlOpen := fmt.Sprintf("%s://%s%s", proto, net.JoinHostPort(hostOpen, strconv.Itoa(addr.Port)), guiCfg.URLPath())
 				// Can potentially block if the utility we are invoking doesn't
 				// fork, and just execs, hence keep it in it's own routine.
 				go openURL(urlOpen)
 			}
 		}
 	}
+
+	// Listen to future config changes so that we can restart the GUI with
+	// the new settings.
+	cfg.Subscribe(gui)
+}
+
+// The guiManager runs the API service, replacing it with a new one when the
+// GUI settings change.
+type guiManager struct {
+	mainSvc *suture.Supervisor
+	model   *model.Model
+	guiCfg  config.GUIConfiguration // the settings currently in use
+	api     *apiSvc
+	token   suture.ServiceToken
+	mut     sync.Mutex
+}
+
+func (g *guiManager) Changed(cfg config.Configuration) error {
+	guiCfg := overrideGUIConfig(cfg.GUI, guiAddress, guiAuthentication, guiAPIKey)
+
+	g.mut.Lock()
+	defer g.mut.Unlock()
+
+	if reflect.DeepEqual(guiCfg, g.guiCfg) {
+		return nil
+	}
+
+	l.Infoln("GUI settings changed; restarting web GUI")
+	g.stop()
+	if err := g.start(guiCfg); err != nil {
+		l.Warnln("Cannot start GUI with the new settings:", err)
+		if err := g.start(g.guiCfg); err != nil {
+			l.Warnln("Cannot restart GUI:", err)
+		}
+		return nil
+	}
+	g.guiCfg = guiCfg
+	return nil
+}
+
+func (g *guiManager) start(guiCfg config.GUIConfiguration) error {
+	if !guiCfg.Enabled {
+		return nil
+	}
+	if _, ok := guiCfg.UnixSocket(); !ok && guiCfg.Address == "" {
+		return nil
+	}
+
+	api, err := newAPISvc(guiCfg, guiAssets, g.model)
+	if err != nil {
+		return err
+	}
+	g.api = api
+	g.token = g.mainSvc.Add(api)
+	return nil
+}
+
+func (g *guiManager) stop() {
+	if g.api == nil {
+		return
+	}
+	g.mainSvc.Remove(g.token)
+	// Stop it right away, as the new service may want the same address.
+	g.api.Stop()
+	g.api = nil
 }
 
 func defaultConfig(myName string) config.Configuration {
@@ -837,10 +1077,48 @@ func defaultConfig(myName string) config.Configuration {
 	if err != nil {
 		l.Fatalln("get free port (BEP):", err)
 	}
-	newCfg.Options.ListenAddress = []string{fmt.Sprintf("0.0.0.0:%d", port)}
+	newCfg.Options.Listeners = []config.ListenerConfiguration{
+		{
+			Address:      fmt.Sprintf("0.0.0.0:%d", port),
+			Enabled:      true,
+			NATTraversal: true,
+		},
+	}
 	return newCfg
 }
 
+// newConfig returns the configuration of a new device: the defaults, with
+// the bootstrap file applied if one is given.
+func newConfig(myName string) config.Configuration {
+	newCfg := defaultConfig(myName)
+	if bootstrapFile != "" {
+		if err := applyBootstrap(&newCfg, myID, bootstrapFile); err != nil {
+			l.Fatalln("Bootstrap:", err)
+		}
+		l.Infoln("Applied bootstrap file", bootstrapFile)
+	}
+	return newCfg
+}
+
+// announcedListener returns the listener whose port we announce to global
+// discovery, and false if there are no enabled listeners.
+func announcedListener(listeners []config.ListenerConfiguration) (config.ListenerConfiguration, bool) {
+	var first config.ListenerConfiguration
+	var found bool
+	for _, lc := range listeners {
+		if !lc.Enabled {
+			continue
+		}
+		if lc.NATTraversal {
+			return lc, true
+		}
+		if !found {
+			first, found = lc, true
+		}
+	}
+	return first, found
+}
+
 func generatePingEvents() {
 	for {
 		time.Sleep(pingEventInterval)
@@ -848,10 +1126,131 @@ func generatePingEvents() {
 	}
 }
 
+// reportCPUUsage passes the CPU usage measured by trackCPUUsage on to the
+// model, for throttling hashers and pullers.
+func reportCPUUsage(m *model.Model) {
+	for _ = range time.NewTicker(time.Second).C {
+		cpuUsageLock.RLock()
+		usage := cpuUsagePercent[0]
+		cpuUsageLock.RUnlock()
+		m.ReportCPUUsage(usage / float64(runtime.NumCPU()))
+	}
+}
+
+// storeHistory regularly writes the transfers to the transfer history, so
+// that they are attributed to about the right hour.
+func storeHistory(m *model.Model) {
+	for _ = range time.NewTicker(time.Minute).C {
+		m.StoreHistory()
+	}
+}
+
+// cleanTempFiles regularly removes the temporary files of abandoned
+// transfers, which are otherwise only removed by a full scan.
+func cleanTempFiles(m *model.Model) {
+	for _ = range time.NewTicker(time.Hour).C {
+		for id := range cfg.Folders() {
+			if _, err := m.CleanTempFiles(id); err != nil {
+				l.Infof("Cleaning temporary files in folder %q: %v", id, err)
+			}
+		}
+	}
+}
+
+// expireTombstones regularly removes the files deleted for longer than the
+// configured retention from the index.
+func expireTombstones(m *model.Model) {
+	for _ = range time.NewTicker(time.Hour).C {
+		retention := cfg.Options().TombstoneRetentionH
+		if retention <= 0 {
+			continue
+		}
+		for id := range cfg.Folders() {
+			if _, err := m.ExpireTombstones(id, time.Duration(retention)*time.Hour); err != nil {
+				l.Infof("Expiring deleted files in folder %q: %v", id, err)
+			}
+		}
+	}
+}
+
+// repairDatabase removes corrupt and orphaned database entries and rebuilds
+// the local index of each folder from a full scan, preserving file versions
+// where the contents are unchanged.
+func repairDatabase(ldb *leveldb.DB, m *model.Model) {
+	for _, folder := range cfg.Folders() {
+		if folder.Invalid != "" {
+			continue
+		}
+
+		stats, err := db.Repair(ldb, folder.ID)
+		if err != nil {
+			l.Warnf("Repairing database for folder %q: %v", folder.ID, err)
+			continue
+		}
+		l.Infof("Repaired database for folder %q: %v", folder.ID, stats)
+
+		if err := m.RebuildIndex(folder.ID); err != nil {
+			l.Warnf("Rebuilding index for folder %q: %v", folder.ID, err)
+		}
+	}
+}
+
+// verifyFolders rehashes the local files and compares them with the index,
+// before the folders are started so that nothing corrupted is scanned and
+// announced to other devices first.
+func verifyFolders(m *model.Model) {
+	for _, folder := range cfg.Folders() {
+		if folder.Invalid != "" {
+			continue
+		}
+
+		l.Infof("Verifying folder %q", folder.ID)
+		mismatches, err := m.VerifyFolder(folder.ID, "")
+		if err != nil {
+			l.Warnf("Verifying folder %q: %v", folder.ID, err)
+			continue
+		}
+		l.Infof("Verified folder %q: %d corrupted files", folder.ID, len(mismatches))
+	}
+}
+
 func resetDB() error {
 	return os.RemoveAll(locations[locDatabase])
 }
 
+// reloadConfig reads the configuration file and applies the changes made to
+// it, as if they were made in the GUI, for when the file is managed by
+// other means.
+func reloadConfig() error {
+	fd, err := os.Open(locations[locConfigFile])
+	if err != nil {
+		return err
+	}
+	newCfg, err := config.ReadXML(fd, myID)
+	fd.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := applyConfig(newCfg); err != nil {
+		return err
+	}
+	l.Infoln("Reloaded configuration from", locations[locConfigFile])
+	events.Default.Log(events.ConfigSaved, cfg.Raw())
+	return nil
+}
+
+// reloadOnSignal reloads the configuration on SIGHUP.
+func reloadOnSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for _ = range hup {
+		if err := reloadConfig(); err != nil {
+			l.Warnln("Reloading configuration:", err)
+		}
+	}
+}
+
 func restart() {
 	l.Infoln("Restarting")
 	stop <- exitRestarting
@@ -862,18 +1261,15 @@ func shutdown() {
 	stop <- exitSuccess
 }
 
-func discovery(extPort int) *discover.Discoverer {
+// discovery returns a discoverer with local discovery started; global
+// discovery is started by the announcer.
+func discovery() *discover.Discoverer {
 	opts := cfg.Options()
-	disc := discover.NewDiscoverer(myID, opts.ListenAddress)
+	disc := discover.NewDiscoverer(myID, opts.ListenAddresses())
 
 	if opts.LocalAnnEnabled {
 		l.Infoln("Starting local discovery announcements")
-		disc.StartLocal(opts.LocalAnnPort, opts.LocalAnnMCAddr)
-	}
-
-	if opts.GlobalAnnEnabled {
-		l.Infoln("Starting global discovery announcements")
-		disc.StartGlobal(opts.GlobalAnnServers, uint16(extPort))
+		disc.StartLocal(opts.LocalAnnPort, opts.LocalAnnMCAddr, opts.LocalAnnMCHops)
 	}
 
 	return disc
@@ -923,6 +1319,8 @@ func overrideGUIConfig(cfg config.GUIConfiguration, address, authentication, api
 		if !strings.Contains(address, "//") {
 			// Assume just an IP was given. Don't touch he TLS setting.
 			cfg.Address = address
+		} else if strings.HasPrefix(address, "unix://") {
+			cfg.Address = address
 		} else {
 			parsed, err := url.Parse(address)
 			if err != nil {
@@ -943,13 +1341,17 @@ func overrideGUIConfig(cfg config.GUIConfiguration, address, authentication, api
 	if authentication != "" {
 		authenticationParts := strings.SplitN(authentication, ":", 2)
 
-		hash, err := bcrypt.GenerateFromPassword([]byte(authenticationParts[1]), 0)
+		hash, err := cfg.HashPassword(authenticationParts[1])
 		if err != nil {
 			l.Fatalln("Invalid GUI password:", err)
 		}
 
-		cfg.User = authenticationParts[0]
-		cfg.Password = string(hash)
+		cfg = cfg.Copy()
+		cfg.SetUser(config.GUIUser{
+			Name:     authenticationParts[0],
+			Password: hash,
+			Role:     config.GUIRoleAdmin,
+		})
 	}
 
 	if apikey != "" {
@@ -1011,6 +1413,12 @@ func autoUpgrade() {
 			continue
 		}
 
+		if rel.Tag == failedUpgrade {
+			// Skip the version that was rolled back after crashing
+			timer.Reset(time.Duration(cfg.Options().AutoUpgradeIntervalH) * time.Hour)
+			continue
+		}
+
 		l.Infof("Automatic upgrade (current %q < latest %q)", Version, rel.Tag)
 		err = upgrade.To(rel)
 		if err != nil {
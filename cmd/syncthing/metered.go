@@ -0,0 +1,101 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/events"
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+const meteredCheckInterval = time.Minute
+
+var (
+	meteredPaused    bool
+	meteredPausedMut = sync.NewMutex()
+)
+
+// The meteredMonitor keeps track of whether we are on a metered network, and
+// if so configured, pauses the connections to devices outside of the local
+// network meanwhile.
+type meteredMonitor struct {
+	cfg     *config.Wrapper
+	conns   *connectionSvc
+	recheck chan struct{}
+	stop    chan struct{}
+}
+
+func newMeteredMonitor(cfg *config.Wrapper, conns *connectionSvc) *meteredMonitor {
+	m := &meteredMonitor{
+		cfg:     cfg,
+		conns:   conns,
+		recheck: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+	cfg.Subscribe(m)
+	return m
+}
+
+func (m *meteredMonitor) Serve() {
+	t := time.NewTicker(meteredCheckInterval)
+	defer t.Stop()
+
+	warned := false
+	for {
+		metered, err := meteredNetwork()
+		if err != nil && !warned {
+			l.Infoln("Detecting metered network:", err)
+			warned = true
+		}
+
+		pause := metered && m.cfg.Options().PauseOnMetered
+		if pause != m.conns.wanPaused() {
+			if pause {
+				l.Infoln("On a metered network; pausing connections outside the local network")
+			} else {
+				l.Infoln("Resuming connections outside the local network")
+			}
+			m.conns.setWANPaused(pause)
+			meteredPausedMut.Lock()
+			meteredPaused = pause
+			meteredPausedMut.Unlock()
+			events.Default.Log(events.MeteredNetwork, map[string]interface{}{
+				"metered": metered,
+				"paused":  pause,
+			})
+		}
+
+		select {
+		case <-t.C:
+		case <-m.recheck:
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+func (m *meteredMonitor) Stop() {
+	close(m.stop)
+}
+
+func (m *meteredMonitor) Changed(cfg config.Configuration) error {
+	select {
+	case m.recheck <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// pausedOnMetered returns true if the connections outside the local network
+// are currently paused due to a metered network.
+func pausedOnMetered() bool {
+	meteredPausedMut.Lock()
+	defer meteredPausedMut.Unlock()
+	return meteredPaused
+}
@@ -0,0 +1,35 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// meteredNetwork asks NetworkManager whether the primary connection is
+// metered. The reply ends with the NMMetered value: 1 for yes, 3 for guessed
+// yes.
+func meteredNetwork() (bool, error) {
+	cmd := exec.Command("dbus-send", "--system", "--print-reply",
+		"--dest=org.freedesktop.NetworkManager", "/org/freedesktop/NetworkManager",
+		"org.freedesktop.DBus.Properties.Get",
+		"string:org.freedesktop.NetworkManager", "string:Metered")
+	out, err := cmd.Output()
+	if err != nil {
+		return false, err
+	}
+	fs := strings.Fields(string(out))
+	if len(fs) == 0 {
+		return false, nil
+	}
+	switch fs[len(fs)-1] {
+	case "1", "3":
+		return true, nil
+	}
+	return false, nil
+}
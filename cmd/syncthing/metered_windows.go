@@ -0,0 +1,31 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// The connection cost is only available through the Windows Runtime API,
+// which we reach by way of PowerShell.
+const connectionCostScript = `[void][Windows.Networking.Connectivity.NetworkInformation,Windows,ContentType=WindowsRuntime]; ` +
+	`$p = [Windows.Networking.Connectivity.NetworkInformation]::GetInternetConnectionProfile(); ` +
+	`if ($p) { $p.GetConnectionCost().NetworkCostType }`
+
+func meteredNetwork() (bool, error) {
+	cmd := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", connectionCostScript)
+	out, err := cmd.Output()
+	if err != nil {
+		return false, err
+	}
+	switch strings.TrimSpace(string(out)) {
+	case "Fixed", "Variable":
+		return true, nil
+	}
+	return false, nil
+}
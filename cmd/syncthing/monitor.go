@@ -13,12 +13,14 @@ import (
 	"os/exec"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/syncthing/syncthing/internal/osutil"
 	"github.com/syncthing/syncthing/internal/sync"
+	"github.com/syncthing/syncthing/internal/upgrade"
 )
 
 var (
@@ -30,6 +32,11 @@ var (
 const (
 	countRestarts = 4
 	loopThreshold = 60 * time.Second
+
+	// A freshly upgraded binary that crashes this many times within the
+	// grace period is replaced by the previous one.
+	rollbackCrashes    = 3
+	upgradeGracePeriod = 10 * time.Minute
 )
 
 func monitorMain() {
@@ -43,7 +50,7 @@ func monitorMain() {
 	if logFile != "" {
 		var fileDst io.Writer
 
-		fileDst, err = os.Create(logFile)
+		fileDst, err = newRotatedFile(logFile, int64(logMaxSizeMiB)<<20, time.Duration(logMaxAgeH)*time.Hour, logMaxOldFiles, logCompress)
 		if err != nil {
 			l.Fatalln("log file:", err)
 		}
@@ -65,11 +72,18 @@ func monitorMain() {
 
 	args := os.Args
 	var restarts [countRestarts]time.Time
+	upgradedAt := upgradeTime()
+	crashes := 0
+	listeners := newHeldListeners()
 
 	sign := make(chan os.Signal, 1)
 	sigTerm := syscall.Signal(0xf)
 	signal.Notify(sign, os.Interrupt, sigTerm, os.Kill)
 
+	// A configuration reload is requested of syncthing
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
 	for {
 		if t := time.Since(restarts[0]); t < loopThreshold {
 			l.Warnf("%d restarts in %v; not retrying further", countRestarts, t)
@@ -81,6 +95,9 @@ func monitorMain() {
 
 		cmd := exec.Command(args[0], args[1:]...)
 
+		listeners.update()
+		listeners.pass(cmd)
+
 		stderr, err := cmd.StderrPipe()
 		if err != nil {
 			l.Fatalln("stderr:", err)
@@ -98,8 +115,9 @@ func monitorMain() {
 		}
 
 		// Let the next child process know that this is not the first time
-		// it's starting up.
+		// it's starting up, and only tell the first about a rollback.
 		os.Setenv("STRESTART", "yes")
+		os.Setenv("STROLLEDBACK", "")
 
 		stdoutMut.Lock()
 		stdoutFirstLines = make([]string, 0, 10)
@@ -108,9 +126,10 @@ func monitorMain() {
 
 		wg := sync.NewWaitGroup()
 
+		var panicLog string
 		wg.Add(1)
 		go func() {
-			copyStderr(stderr, dst)
+			panicLog = copyStderr(stderr, dst)
 			wg.Done()
 		}()
 
@@ -127,48 +146,114 @@ func monitorMain() {
 			exit <- cmd.Wait()
 		}()
 
-		select {
-		case s := <-sign:
-			l.Infof("Signal %d received; exiting", s)
-			cmd.Process.Kill()
-			<-exit
-			return
+	wait:
+		for {
+			select {
+			case <-hup:
+				cmd.Process.Signal(syscall.SIGHUP)
 
-		case err = <-exit:
-			if err == nil {
-				// Successful exit indicates an intentional shutdown
+			case s := <-sign:
+				l.Infof("Signal %d received; exiting", s)
+				cmd.Process.Kill()
+				<-exit
 				return
-			} else if exiterr, ok := err.(*exec.ExitError); ok {
-				if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-					switch status.ExitStatus() {
-					case exitUpgrading:
-						// Restart the monitor process to release the .old
-						// binary as part of the upgrade process.
-						l.Infoln("Restarting monitor...")
-						os.Setenv("STNORESTART", "")
-						err := exec.Command(args[0], args[1:]...).Start()
-						if err != nil {
-							l.Warnln("restart:", err)
+
+			case err = <-exit:
+				if err == nil {
+					// Successful exit indicates an intentional shutdown
+					return
+				} else if exiterr, ok := err.(*exec.ExitError); ok {
+					if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
+						switch status.ExitStatus() {
+						case exitUpgrading:
+							// Restart the monitor process to release the .old
+							// binary as part of the upgrade process.
+							l.Infoln("Restarting monitor...")
+							os.Setenv("STNORESTART", "")
+							os.Setenv("STUPGRADEDAT", strconv.FormatInt(time.Now().Unix(), 10))
+							err := exec.Command(args[0], args[1:]...).Start()
+							if err != nil {
+								l.Warnln("restart:", err)
+							}
+							return
 						}
-						return
 					}
 				}
+				break wait
 			}
 		}
 
 		l.Infoln("Syncthing exited:", err)
+		if panicLog != "" {
+			go maybeReportCrash(panicLog)
+		}
+
+		if !upgradedAt.IsZero() && time.Since(upgradedAt) < upgradeGracePeriod && !isRestartExit(err) {
+			crashes++
+			if crashes >= rollbackCrashes {
+				rollbackUpgrade(args)
+				return
+			}
+		}
 		time.Sleep(1 * time.Second)
 	}
 }
 
-func copyStderr(stderr io.Reader, dst io.Writer) {
+// upgradeTime returns when the binary was automatically upgraded, as told by
+// the monitor process that started this one; zero if it wasn't.
+func upgradeTime() time.Time {
+	secs, err := strconv.ParseInt(os.Getenv("STUPGRADEDAT"), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(secs, 0)
+}
+
+// isRestartExit returns true if the child exited to be restarted, rather
+// than crashing.
+func isRestartExit(err error) bool {
+	if exiterr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus() == exitRestarting
+		}
+	}
+	return false
+}
+
+// rollbackUpgrade restores the binary from before the upgrade and starts a
+// new monitor process running it. The version rolled back from is passed
+// on, to be reported and not upgraded to again.
+func rollbackUpgrade(args []string) {
+	l.Warnf("Syncthing %s crashed %d times since the upgrade; rolling back to the previous version", Version, rollbackCrashes)
+	if err := upgrade.Rollback(); err != nil {
+		l.Warnln("Rolling back the upgrade:", err)
+		os.Exit(exitError)
+	}
+
+	os.Setenv("STNORESTART", "")
+	os.Setenv("STUPGRADEDAT", "")
+	os.Setenv("STROLLEDBACK", Version)
+	os.Setenv("STUPGRADEFAILED", Version)
+	if err := exec.Command(args[0], args[1:]...).Start(); err != nil {
+		l.Warnln("restart:", err)
+	}
+}
+
+// copyStderr copies the child's stderr to dst, capturing any panic into a
+// panic log. The name of the panic log is returned, or the empty string if
+// there was no panic.
+func copyStderr(stderr io.Reader, dst io.Writer) string {
 	br := bufio.NewReader(stderr)
 
 	var panicFd *os.File
 	for {
 		line, err := br.ReadString('\n')
 		if err != nil {
-			return
+			if panicFd != nil {
+				panicFd.Close()
+				return panicFd.Name()
+			}
+			return ""
 		}
 
 		if panicFd == nil {
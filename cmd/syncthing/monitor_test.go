@@ -0,0 +1,46 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestUpgradeTime(t *testing.T) {
+	defer os.Setenv("STUPGRADEDAT", os.Getenv("STUPGRADEDAT"))
+
+	os.Setenv("STUPGRADEDAT", "")
+	if !upgradeTime().IsZero() {
+		t.Error("Upgrade time set without an upgrade")
+	}
+
+	os.Setenv("STUPGRADEDAT", "1440000000")
+	if ut := upgradeTime(); !ut.Equal(time.Unix(1440000000, 0)) {
+		t.Errorf("Incorrect upgrade time %v", ut)
+	}
+}
+
+func TestIsRestartExit(t *testing.T) {
+	if isRestartExit(nil) || isRestartExit(errors.New("crashed")) {
+		t.Error("Not an exit status")
+	}
+
+	err := exec.Command("sh", "-c", "exit 3").Run()
+	if _, ok := err.(*exec.ExitError); !ok {
+		t.Skip("No shell to test exit statuses:", err)
+	}
+	if !isRestartExit(err) {
+		t.Error("Exit status 3 is a restart")
+	}
+	if isRestartExit(exec.Command("sh", "-c", "exit 2").Run()) {
+		t.Error("Exit status 2 is not a restart")
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/events"
+)
+
+const notificationEvents = events.DeviceRejected | events.FolderRejected | events.ItemFinished
+
+// The notification service shows desktop notifications for the event types
+// selected in the options.
+type notificationSvc struct {
+	cfg    *config.Wrapper
+	show   func(title, body string) error
+	stop   chan struct{}
+	failed bool // a notification failed to show; only reported once
+}
+
+func newNotificationSvc(cfg *config.Wrapper) *notificationSvc {
+	return &notificationSvc{
+		cfg:  cfg,
+		show: showNotification,
+		stop: make(chan struct{}),
+	}
+}
+
+func (s *notificationSvc) Serve() {
+	sub := events.Default.Subscribe(notificationEvents)
+	defer events.Default.Unsubscribe(sub)
+
+	for {
+		select {
+		case ev := <-sub.C():
+			title, body := s.format(ev, s.cfg.Options())
+			if title == "" {
+				continue
+			}
+			if err := s.show(title, body); err != nil && !s.failed {
+				l.Infoln("Showing desktop notification:", err)
+				s.failed = true
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *notificationSvc) Stop() {
+	close(s.stop)
+}
+
+// format returns the title and body of the notification for the event, or
+// empty strings if it should not be shown.
+func (s *notificationSvc) format(ev events.Event, opts config.OptionsConfiguration) (string, string) {
+	enabled := false
+	for _, t := range opts.NotifyEvents {
+		if t == ev.Type.String() {
+			enabled = true
+			break
+		}
+	}
+	if !enabled {
+		return "", ""
+	}
+
+	switch ev.Type {
+	case events.DeviceRejected:
+		data := ev.Data.(map[string]string)
+		return "Unknown device", fmt.Sprintf("Device %v at %v wants to connect. Add it in the GUI to accept.", data["device"], data["address"])
+
+	case events.FolderRejected:
+		data := ev.Data.(map[string]string)
+		return "Unshared folder", fmt.Sprintf("Device %v wants to share folder %q. Add it in the GUI to accept.", data["device"], data["folder"])
+
+	case events.ItemFinished:
+		data := ev.Data.(map[string]interface{})
+		size, ok := data["size"].(int64)
+		if !ok || size < int64(opts.NotifyMinTransferMiB)<<20 || data["error"] != nil {
+			return "", ""
+		}
+		return "Download finished", fmt.Sprintf("%s (%d MiB) in folder %q", data["item"], size>>20, data["folder"])
+	}
+
+	return "", ""
+}
@@ -0,0 +1,23 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import "os/exec"
+
+// The title and body are passed as arguments rather than in the script, so
+// they need no quoting.
+var notificationScript = []string{
+	"-e", "on run argv",
+	"-e", "display notification (item 2 of argv) with title (item 1 of argv)",
+	"-e", "end run",
+}
+
+// showNotification posts to the Notification Center by way of AppleScript.
+func showNotification(title, body string) error {
+	args := append(notificationScript, title, body)
+	return exec.Command("osascript", args...).Run()
+}
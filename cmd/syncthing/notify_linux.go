@@ -0,0 +1,15 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import "os/exec"
+
+// showNotification uses notify-send from libnotify, which talks to the
+// notification daemon of the desktop over DBus.
+func showNotification(title, body string) error {
+	return exec.Command("notify-send", "--app-name=Syncthing", title, body).Run()
+}
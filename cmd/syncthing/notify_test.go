@@ -0,0 +1,52 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/events"
+)
+
+func TestNotificationFormat(t *testing.T) {
+	s := &notificationSvc{}
+	opts := config.OptionsConfiguration{
+		NotifyEvents:         []string{"FolderRejected", "ItemFinished"},
+		NotifyMinTransferMiB: 10,
+	}
+
+	finished := func(size int64, err error) events.Event {
+		return events.Event{Type: events.ItemFinished, Data: map[string]interface{}{
+			"folder": "default",
+			"item":   "file",
+			"error":  err,
+			"type":   "file",
+			"action": "update",
+			"size":   size,
+		}}
+	}
+
+	cases := []struct {
+		ev    events.Event
+		shown bool
+	}{
+		{events.Event{Type: events.DeviceRejected, Data: map[string]string{"device": "x", "address": "y"}}, false},
+		{events.Event{Type: events.FolderRejected, Data: map[string]string{"device": "x", "folder": "y"}}, true},
+		{finished(20<<20, nil), true},
+		{finished(5<<20, nil), false},
+		{finished(20<<20, errors.New("failed")), false},
+	}
+
+	for i, tc := range cases {
+		title, body := s.format(tc.ev, opts)
+		if shown := title != "" && body != ""; shown != tc.shown {
+			t.Errorf("%d: shown %v, expected %v (%q, %q)", i, shown, tc.shown, title, body)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Toasts are only available through the Windows Runtime API, which we reach
+// by way of PowerShell. The title and body are passed in the environment so
+// they need no quoting.
+const toastScript = `[void][Windows.UI.Notifications.ToastNotificationManager,Windows.UI.Notifications,ContentType=WindowsRuntime]; ` +
+	`$t = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02); ` +
+	`$x = $t.GetElementsByTagName('text'); ` +
+	`[void]$x.Item(0).AppendChild($t.CreateTextNode($env:STNOTIFYTITLE)); ` +
+	`[void]$x.Item(1).AppendChild($t.CreateTextNode($env:STNOTIFYBODY)); ` +
+	`[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('Syncthing').Show((New-Object Windows.UI.Notifications.ToastNotification $t))`
+
+func showNotification(title, body string) error {
+	cmd := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", toastScript)
+	cmd.Env = append(os.Environ(), "STNOTIFYTITLE="+title, "STNOTIFYBODY="+body)
+	return cmd.Run()
+}
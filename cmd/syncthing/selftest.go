@@ -0,0 +1,172 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/model"
+)
+
+const (
+	cryptoBenchDuration  = 500 * time.Millisecond
+	transferTestDuration = 10 * time.Second
+)
+
+// The selfTestResult tells apart hashing (CPU), encryption (CPU) and
+// transfer (network and remote disk) performance.
+type selfTestResult struct {
+	HashMiBps   float64         `json:"hashMiBps"`
+	CryptoMiBps float64         `json:"cryptoMiBps"`
+	CryptoError string          `json:"cryptoError,omitempty"`
+	Transfer    *transferResult `json:"transfer,omitempty"`
+}
+
+type transferResult struct {
+	Device    string  `json:"device"`
+	Bytes     int64   `json:"bytes"`
+	DurationS float64 `json:"durationS"`
+	MiBps     float64 `json:"MiBps"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// localSelfTest runs the benchmarks that don't involve another device.
+func localSelfTest(tlsCfg *tls.Config) selfTestResult {
+	res := selfTestResult{
+		HashMiBps: sha256Perf(),
+	}
+	perf, err := cryptoBench(tlsCfg)
+	if err != nil {
+		res.CryptoError = err.Error()
+	}
+	res.CryptoMiBps = perf
+	return res
+}
+
+// cryptoBench returns the rate in MiB/s at which data can be sent over a TLS
+// connection to ourselves in memory, i.e. excluding disk and network.
+func cryptoBench(tlsCfg *tls.Config) (float64, error) {
+	// The client never reads, so a session ticket sent by the server would
+	// block on the unbuffered pipe.
+	tlsCfg = tlsCfg.Clone()
+	tlsCfg.SessionTicketsDisabled = true
+
+	c1, c2 := net.Pipe()
+	server := tls.Server(c1, tlsCfg)
+	client := tls.Client(c2, tlsCfg)
+	defer server.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(ioutil.Discard, server)
+		errc <- err
+	}()
+
+	if err := client.Handshake(); err != nil {
+		client.Close()
+		return 0, err
+	}
+
+	bs := make([]byte, 128<<10)
+	rand.Reader.Read(bs)
+
+	t0 := time.Now()
+	var b int64
+	for time.Since(t0) < cryptoBenchDuration {
+		if _, err := client.Write(bs); err != nil {
+			client.Close()
+			return 0, err
+		}
+		b += int64(len(bs))
+	}
+	d := time.Since(t0)
+
+	client.Close()
+	if err := <-errc; err != nil {
+		return 0, err
+	}
+	return mibPerSecond(b, d), nil
+}
+
+// transferTest measures the rate at which data is received from the given
+// device.
+func transferTest(m *model.Model, deviceID protocol.DeviceID, duration time.Duration) *transferResult {
+	n, d, err := m.TransferTest(deviceID, duration)
+	res := &transferResult{
+		Device:    deviceID.String(),
+		Bytes:     n,
+		DurationS: d.Seconds(),
+	}
+	if err != nil {
+		res.Error = err.Error()
+	} else if d > 0 {
+		res.MiBps = mibPerSecond(n, d)
+	}
+	return res
+}
+
+func mibPerSecond(b int64, d time.Duration) float64 {
+	return float64(int(float64(b)/d.Seconds()/(1<<20)*100)) / 100
+}
+
+// selfTestMain runs the local benchmarks on the command line and prints the
+// result. A transfer test needs the connections of the running Syncthing, so
+// if a device is given that test is run by asking it over the REST interface.
+func selfTestMain(device string) {
+	cert, err := tls.LoadX509KeyPair(locations[locCertFile], locations[locKeyFile])
+	if err != nil {
+		l.Fatalln("Load cert:", err)
+	}
+
+	res := localSelfTest(newTLSConfig(cert, config.New(myID).Options))
+	fmt.Printf("Hashing (SHA-256):   %8.2f MiB/s\n", res.HashMiBps)
+	if res.CryptoError != "" {
+		fmt.Printf("Encryption (TLS):    %s\n", res.CryptoError)
+	} else {
+		fmt.Printf("Encryption (TLS):    %8.2f MiB/s\n", res.CryptoMiBps)
+	}
+
+	if device == "" {
+		return
+	}
+
+	client, r, err := newRestRequest("POST", "rest/system/selftest?device="+url.QueryEscape(device))
+	if err != nil {
+		l.Fatalln("Transfer test:", err)
+	}
+	resp, err := client.Do(r)
+	if err != nil {
+		l.Fatalln("Transfer test:", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		bs, _ := ioutil.ReadAll(resp.Body)
+		l.Fatalln("Transfer test:", string(bs))
+	}
+
+	var remote selfTestResult
+	if err := json.NewDecoder(resp.Body).Decode(&remote); err != nil {
+		l.Fatalln("Transfer test:", err)
+	}
+	if t := remote.Transfer; t == nil {
+		l.Fatalln("Transfer test: no result")
+	} else if t.Error != "" {
+		fmt.Printf("Transfer from %s: %s\n", t.Device, t.Error)
+	} else {
+		fmt.Printf("Transfer from %s: %8.2f MiB/s (%d bytes in %.1f s)\n", t.Device, t.MiBps, t.Bytes, t.DurationS)
+	}
+}
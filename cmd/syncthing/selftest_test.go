@@ -0,0 +1,38 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
+)
+
+func TestCryptoBench(t *testing.T) {
+	dir, err := ioutil.TempDir("", "selftest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert, err := newCertificate(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), tlsDefaultCommonName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	perf, err := cryptoBench(newTLSConfig(cert, config.New(protocol.DeviceID{}).Options))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perf <= 0 {
+		t.Errorf("unexpected performance %v MiB/s", perf)
+	}
+}
@@ -180,11 +180,14 @@ func (c *folderSummarySvc) sendSummary(folder string) {
 
 		// Get completion percentage of this folder for the
 		// remote device.
-		comp := c.model.Completion(devCfg.DeviceID, folder)
+		comp := c.model.DeviceCompletion(devCfg.DeviceID, folder)
 		events.Default.Log(events.FolderCompletion, map[string]interface{}{
 			"folder":     folder,
 			"device":     devCfg.DeviceID.String(),
-			"completion": comp,
+			"completion": comp.Completion,
+			"needBytes":  comp.NeedBytes,
+			"needItems":  comp.NeedItems,
+			"etaS":       comp.ETAS,
 		})
 	}
 }
@@ -20,6 +20,8 @@ import (
 	"net"
 	"os"
 	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
 )
 
 const (
@@ -27,6 +29,27 @@ const (
 	tlsDefaultCommonName = "syncthing"
 )
 
+// newTLSConfig returns the TLS configuration used for both the listening
+// socket and outgoing connections, with the version, cipher suites and
+// session resumption set by the options. Resumed sessions keep the
+// certificate of the original handshake, so the device ID is still known.
+func newTLSConfig(cert tls.Certificate, opts config.OptionsConfiguration) *tls.Config {
+	tlsCfg := &tls.Config{
+		Certificates:           []tls.Certificate{cert},
+		NextProtos:             []string{bepProtocolName},
+		ClientAuth:             tls.RequestClientCert,
+		SessionTicketsDisabled: !opts.TLSSessionResumption,
+		InsecureSkipVerify:     true,
+		MinVersion:             opts.TLSVersion(),
+		CipherSuites:           opts.TLSCipherSuiteIDs(),
+	}
+	if opts.TLSSessionResumption {
+		// Sessions are cached by the address dialed, as there is no server name
+		tlsCfg.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	return tlsCfg
+}
+
 func newCertificate(certFile, keyFile, name string) (tls.Certificate, error) {
 	l.Infof("Generating RSA key and certificate for %s...", name)
 
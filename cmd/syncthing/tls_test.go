@@ -0,0 +1,87 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
+)
+
+func TestTLSSessionResumption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	serverCert, err := newCertificate(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"), tlsDefaultCommonName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := newCertificate(filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem"), tlsDefaultCommonName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverID := protocol.NewDeviceID(serverCert.Certificate[0])
+	clientID := protocol.NewDeviceID(clientCert.Certificate[0])
+
+	for _, resume := range []bool{true, false} {
+		opts := config.New(protocol.DeviceID{}).Options
+		opts.TLSSessionResumption = resume
+		serverCfg := newTLSConfig(serverCert, opts)
+		clientCfg := newTLSConfig(clientCert, opts)
+
+		ln, err := tls.Listen("tcp", "127.0.0.1:0", serverCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peers := make(chan protocol.DeviceID)
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				tc := conn.(*tls.Conn)
+				if err := tc.Handshake(); err != nil {
+					conn.Close()
+					continue
+				}
+				// Writing lets the client receive a TLS 1.3 session ticket
+				tc.Write([]byte{0})
+				peers <- protocol.NewDeviceID(tc.ConnectionState().PeerCertificates[0].Raw)
+				conn.Close()
+			}
+		}()
+
+		for i := 0; i < 2; i++ {
+			conn, err := tls.Dial("tcp", ln.Addr().String(), clientCfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Read(make([]byte, 1))
+			cs := conn.ConnectionState()
+			if id := protocol.NewDeviceID(cs.PeerCertificates[0].Raw); id != serverID {
+				t.Errorf("resume %v, connection %d: server ID %v, expected %v", resume, i, id, serverID)
+			}
+			if id := <-peers; id != clientID {
+				t.Errorf("resume %v, connection %d: client ID %v, expected %v", resume, i, id, clientID)
+			}
+			if expected := resume && i > 0; cs.DidResume != expected {
+				t.Errorf("resume %v, connection %d: resumed %v, expected %v", resume, i, cs.DidResume, expected)
+			}
+			conn.Close()
+		}
+		ln.Close()
+	}
+}
@@ -11,14 +11,47 @@ import (
 	"time"
 
 	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/sync"
 	"github.com/syncthing/syncthing/internal/upnp"
 )
 
+// A upnpMapping is the state of the port mapping on one IGD, as shown in
+// the system status.
+type upnpMapping struct {
+	Gateway      string    `json:"gateway"`
+	ExternalIP   string    `json:"externalIP,omitempty"`
+	ExternalPort int       `json:"externalPort,omitempty"`
+	Expires      time.Time `json:"expires"` // zero if the lease doesn't expire
+	Error        string    `json:"error,omitempty"`
+}
+
+var (
+	upnpMappings    []upnpMapping
+	upnpMappingsMut = sync.NewMutex()
+)
+
+// currentUPnPMappings returns the port mappings on the IGDs found in the
+// last round of discovery.
+func currentUPnPMappings() []upnpMapping {
+	upnpMappingsMut.Lock()
+	defer upnpMappingsMut.Unlock()
+	return upnpMappings
+}
+
+func setUPnPMappings(mappings []upnpMapping) {
+	upnpMappingsMut.Lock()
+	upnpMappings = mappings
+	upnpMappingsMut.Unlock()
+}
+
 // The UPnP service runs a loop for discovery of IGDs (Internet Gateway
-// Devices) and setup/renewal of a port mapping.
+// Devices) and setup/renewal of a port mapping on each of them, so that
+// setups with several gateways, such as a router behind another, work.
 type upnpSvc struct {
 	cfg       *config.Wrapper
 	localPort int
+	extPort   int            // the external port announced
+	ports     map[string]int // IGD UUID -> external port mapped
 	stop      chan struct{}
 }
 
@@ -26,30 +59,39 @@ func newUPnPSvc(cfg *config.Wrapper, localPort int) *upnpSvc {
 	return &upnpSvc{
 		cfg:       cfg,
 		localPort: localPort,
+		ports:     make(map[string]int),
 	}
 }
 
 func (s *upnpSvc) Serve() {
-	extPort := 0
 	foundIGD := true
+	failures := 0
 	s.stop = make(chan struct{})
+	defer setUPnPMappings(nil)
 
 	for {
+		ok := true
 		igds := upnp.Discover(time.Duration(s.cfg.Options().UPnPTimeoutS) * time.Second)
 		if len(igds) > 0 {
 			foundIGD = true
-			extPort = s.tryIGDs(igds, extPort)
-		} else if foundIGD {
-			// Only print a notice if we've previously found an IGD or this is
-			// the first time around.
-			foundIGD = false
-			l.Infof("No UPnP device detected")
+			ok = s.tryIGDs(igds)
+		} else {
+			setUPnPMappings(nil)
+			if foundIGD {
+				// Only print a notice if we've previously found an IGD or
+				// this is the first time around.
+				foundIGD = false
+				l.Infof("No UPnP device detected")
+			}
 		}
 
-		d := time.Duration(s.cfg.Options().UPnPRenewalM) * time.Minute
-		if d == 0 {
-			// We always want to do renewal so lets just pick a nice sane number.
-			d = 30 * time.Minute
+		d := upnpRenewal(s.cfg.Options())
+		if ok {
+			failures = 0
+		} else {
+			// Retry the failed mappings sooner, before the others expire.
+			failures++
+			d = upnpBackoff(failures, d)
 		}
 
 		select {
@@ -64,33 +106,63 @@ func (s *upnpSvc) Stop() {
 	close(s.stop)
 }
 
-func (s *upnpSvc) tryIGDs(igds []upnp.IGD, prevExtPort int) int {
-	// Lets try all the IGDs we found and use the first one that works.
-	// TODO: Use all of them, and sort out the resulting mess to the
-	// discovery announcement code...
+// tryIGDs sets up or renews the port mapping on each of the IGDs, returning
+// false if that failed on any of them. The same external port is tried on
+// all of them, and the first one mapped is announced.
+func (s *upnpSvc) tryIGDs(igds []upnp.IGD) bool {
+	lease := time.Duration(s.cfg.Options().UPnPLeaseM) * time.Minute
+	now := time.Now()
+
+	allOK := true
+	extPort := 0
+	mappings := make([]upnpMapping, 0, len(igds))
 	for _, igd := range igds {
-		extPort, err := s.tryIGD(igd, prevExtPort)
+		mapping := upnpMapping{Gateway: igd.FriendlyIdentifier()}
+
+		suggested := s.ports[igd.UUID()]
+		if suggested == 0 {
+			suggested = s.extPort
+		}
+		port, err := s.tryIGD(igd, suggested)
 		if err != nil {
-			l.Warnf("Failed to set UPnP port mapping: external port %d on device %s.", extPort, igd.FriendlyIdentifier())
+			l.Warnf("Failed to set UPnP port mapping: external port %d on device %s.", suggested, igd.FriendlyIdentifier())
+			mapping.Error = err.Error()
+			allOK = false
+			mappings = append(mappings, mapping)
 			continue
 		}
 
-		if extPort != prevExtPort {
-			// External port changed; refresh the discovery announcement.
-			// TODO: Don't reach out to some magic global here?
-			l.Infof("New UPnP port mapping: external port %d to local port %d.", extPort, s.localPort)
-			if s.cfg.Options().GlobalAnnEnabled {
-				discoverer.StopGlobal()
-				discoverer.StartGlobal(s.cfg.Options().GlobalAnnServers, uint16(extPort))
-			}
+		if debugNet.On() {
+			l.Debugf("Created/updated UPnP port mapping for external port %d on device %s.", port, igd.FriendlyIdentifier())
+		}
+		s.ports[igd.UUID()] = port
+		mapping.ExternalPort = port
+		if lease > 0 {
+			mapping.Expires = now.Add(lease)
 		}
-		if debugNet {
-			l.Debugf("Created/updated UPnP port mapping for external port %d on device %s.", extPort, igd.FriendlyIdentifier())
+		if ip, err := igd.GetExternalIPAddress(); err == nil {
+			mapping.ExternalIP = ip.String()
+		}
+		mappings = append(mappings, mapping)
+
+		if extPort == 0 {
+			extPort = port
 		}
-		return extPort
+	}
+	setUPnPMappings(mappings)
+
+	if extPort != 0 && extPort != s.extPort {
+		// External port changed; refresh the discovery announcement.
+		// TODO: Don't reach out to some magic global here?
+		l.Infof("New UPnP port mapping: external port %d to local port %d.", extPort, s.localPort)
+		if s.cfg.Options().GlobalAnnEnabled {
+			discoverer.StopGlobal()
+			discoverer.StartGlobal(s.cfg.Options().GlobalAnnServers, uint16(extPort))
+		}
+		s.extPort = extPort
 	}
 
-	return 0
+	return allOK
 }
 
 func (s *upnpSvc) tryIGD(igd upnp.IGD, suggestedPort int) (int, error) {
@@ -118,3 +190,32 @@ func (s *upnpSvc) tryIGD(igd upnp.IGD, suggestedPort int) (int, error) {
 
 	return 0, err
 }
+
+// upnpRenewal returns the interval at which the mappings are renewed: the
+// configured one, but at most half the lease time so that the mappings are
+// renewed before they expire.
+func upnpRenewal(opts config.OptionsConfiguration) time.Duration {
+	d := time.Duration(opts.UPnPRenewalM) * time.Minute
+	if d == 0 {
+		// We always want to do renewal so lets just pick a nice sane number.
+		d = 30 * time.Minute
+	}
+	if lease := time.Duration(opts.UPnPLeaseM) * time.Minute; lease > 0 && d > lease/2 {
+		d = lease / 2
+	}
+	return d
+}
+
+// upnpBackoff returns the delay before retrying after the given number of
+// consecutive failures: a minute, doubling with each further failure, but
+// at most max.
+func upnpBackoff(failures int, max time.Duration) time.Duration {
+	d := time.Minute
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
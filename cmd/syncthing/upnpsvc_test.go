@@ -0,0 +1,42 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+)
+
+func TestUPnPRenewal(t *testing.T) {
+	cases := []struct {
+		leaseM, renewalM int
+		renewal          time.Duration
+	}{
+		{60, 30, 30 * time.Minute},
+		{60, 0, 30 * time.Minute},
+		{30, 30, 15 * time.Minute},
+		{0, 45, 45 * time.Minute},
+	}
+	for _, tc := range cases {
+		opts := config.OptionsConfiguration{UPnPLeaseM: tc.leaseM, UPnPRenewalM: tc.renewalM}
+		if d := upnpRenewal(opts); d != tc.renewal {
+			t.Errorf("Lease %d, renewal %d: %v != expected %v", tc.leaseM, tc.renewalM, d, tc.renewal)
+		}
+	}
+}
+
+func TestUPnPBackoff(t *testing.T) {
+	max := 30 * time.Minute
+	expected := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 16 * time.Minute, max, max}
+	for i, e := range expected {
+		if d := upnpBackoff(i+1, max); d != e {
+			t.Errorf("After %d failures: %v != expected %v", i+1, d, e)
+		}
+	}
+}
@@ -11,13 +11,17 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/json"
+	"fmt"
 	"net"
 	"net/http"
+	"os/exec"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/model"
+	"github.com/syncthing/syncthing/internal/sync"
 	"github.com/thejerf/suture"
 )
 
@@ -26,6 +30,37 @@ import (
 // are prompted for acceptance of the new report.
 const usageReportVersion = 1
 
+const usageReportURL = "https://data.syncthing.net/newdata"
+
+// The formats of the usage report, as understood by the server. Format 1 is
+// the original, unversioned one; format 2 adds the "urVersion" field and the
+// extended metrics, when those are enabled. The extended metrics are opted
+// into separately, so adding to them does not change usageReportVersion.
+const (
+	minReportFormat = 1
+	maxReportFormat = 2
+)
+
+// The format of the usage report is negotiated with the server: we send the
+// newest format, and fall back to the previous one for as long as the
+// server rejects it. The result is remembered until restart.
+var (
+	reportFormat    = maxReportFormat
+	reportFormatMut = sync.NewMutex()
+)
+
+func currentReportFormat() int {
+	reportFormatMut.Lock()
+	defer reportFormatMut.Unlock()
+	return reportFormat
+}
+
+func setReportFormat(format int) {
+	reportFormatMut.Lock()
+	reportFormat = format
+	reportFormatMut.Unlock()
+}
+
 type usageReportingManager struct {
 	model *model.Model
 	sup   *suture.Supervisor
@@ -63,10 +98,14 @@ func (m *usageReportingManager) Changed(cfg config.Configuration) error {
 	return nil
 }
 
-// reportData returns the data to be sent in a usage report. It's used in
-// various places, so not part of the usageReportingSvc object.
-func reportData(m *model.Model) map[string]interface{} {
+// reportData returns the data to be sent in a usage report of the given
+// format. It's used in various places, so not part of the usageReportingSvc
+// object.
+func reportData(m *model.Model, format int) map[string]interface{} {
 	res := make(map[string]interface{})
+	if format >= 2 {
+		res["urVersion"] = format
+	}
 	res["uniqueID"] = cfg.Options().URUniqueID
 	res["version"] = Version
 	res["longVersion"] = LongVersion
@@ -76,8 +115,10 @@ func reportData(m *model.Model) map[string]interface{} {
 
 	var totFiles, maxFiles int
 	var totBytes, maxBytes int64
+	var folderSizes []int64
 	for folderID := range cfg.Folders() {
 		files, _, bytes := m.GlobalSize(folderID)
+		folderSizes = append(folderSizes, bytes)
 		totFiles += files
 		totBytes += bytes
 		if files > maxFiles {
@@ -97,33 +138,77 @@ func reportData(m *model.Model) map[string]interface{} {
 	runtime.ReadMemStats(&mem)
 	res["memoryUsageMiB"] = (mem.Sys - mem.HeapReleased) / 1024 / 1024
 
-	var perf float64
-	for i := 0; i < 5; i++ {
-		p := cpuBench()
-		if p > perf {
-			perf = p
-		}
-	}
-	res["sha256Perf"] = perf
+	res["sha256Perf"] = sha256Perf()
 
 	bytes, err := memorySize()
 	if err == nil {
 		res["memorySize"] = bytes / 1024 / 1024
 	}
 
+	if format >= 2 && cfg.Options().URExtended {
+		res["folderSizeBuckets"] = folderSizeBuckets(folderSizes)
+		res["osVersion"] = osVersion()
+	}
+
 	return res
 }
 
+// The upper bounds of the folder size buckets in the extended metrics; the
+// last bucket holds the folders larger than all of them.
+var folderSizeBounds = []struct {
+	name  string
+	bytes int64
+}{
+	{"<100MiB", 100 << 20},
+	{"<1GiB", 1 << 30},
+	{"<10GiB", 10 << 30},
+	{"<100GiB", 100 << 30},
+	{"<1TiB", 1 << 40},
+}
+
+// folderSizeBuckets returns the number of folders in each size bucket.
+func folderSizeBuckets(sizes []int64) map[string]int {
+	buckets := make(map[string]int, len(folderSizeBounds)+1)
+	for _, b := range folderSizeBounds {
+		buckets[b.name] = 0
+	}
+	buckets[">=1TiB"] = 0
+
+next:
+	for _, size := range sizes {
+		for _, b := range folderSizeBounds {
+			if size < b.bytes {
+				buckets[b.name]++
+				continue next
+			}
+		}
+		buckets[">=1TiB"]++
+	}
+	return buckets
+}
+
+// osVersion returns the name and version of the operating system, or an
+// empty string if it can't be determined.
+func osVersion() string {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/c", "ver")
+	} else {
+		cmd = exec.Command("uname", "-sr")
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
 type usageReportingService struct {
 	model *model.Model
 	stop  chan struct{}
 }
 
 func (s *usageReportingService) sendUsageReport() error {
-	d := reportData(s.model)
-	var b bytes.Buffer
-	json.NewEncoder(&b).Encode(d)
-
 	var client = http.DefaultClient
 	if BuildEnv == "android" {
 		// This works around the lack of DNS resolution on Android... :(
@@ -134,8 +219,34 @@ func (s *usageReportingService) sendUsageReport() error {
 		}
 		client = &http.Client{Transport: tr}
 	}
-	_, err := client.Post("https://data.syncthing.net/newdata", "application/json", &b)
-	return err
+	return postUsageReport(client, usageReportURL, s.model)
+}
+
+// postUsageReport sends the usage report to the server at url, in the newest
+// format it accepts. A format the server responds to with a client error is
+// taken as not understood, and the previous format is tried instead.
+func postUsageReport(client *http.Client, url string, m *model.Model) error {
+	for {
+		format := currentReportFormat()
+		var b bytes.Buffer
+		json.NewEncoder(&b).Encode(reportData(m, format))
+
+		resp, err := client.Post(url, "application/json", &b)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			return nil
+		case resp.StatusCode >= 400 && resp.StatusCode < 500 && format > minReportFormat:
+			l.Infof("Usage report format %d not accepted by the server (%s); falling back", format, resp.Status)
+			setReportFormat(format - 1)
+		default:
+			return fmt.Errorf("server responded %s", resp.Status)
+		}
+	}
 }
 
 func (s *usageReportingService) Serve() {
@@ -163,6 +274,18 @@ func (s *usageReportingService) Stop() {
 	close(s.stop)
 }
 
+// sha256Perf returns the best of five runs of cpuBench.
+func sha256Perf() float64 {
+	var perf float64
+	for i := 0; i < 5; i++ {
+		p := cpuBench()
+		if p > perf {
+			perf = p
+		}
+	}
+	return perf
+}
+
 // cpuBench returns CPU performance as a measure of single threaded SHA-256 MiB/s
 func cpuBench() float64 {
 	chunkSize := 100 * 1 << 10
@@ -177,6 +300,5 @@ func cpuBench() float64 {
 		b += chunkSize
 	}
 	h.Sum(nil)
-	d := time.Since(t0)
-	return float64(int(float64(b)/d.Seconds()/(1<<20)*100)) / 100
+	return mibPerSecond(int64(b), time.Since(t0))
 }
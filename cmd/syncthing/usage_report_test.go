@@ -0,0 +1,91 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/model"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestFolderSizeBuckets(t *testing.T) {
+	sizes := []int64{0, 100<<20 - 1, 100 << 20, 5 << 30, 1 << 40, 3 << 40}
+	expected := map[string]int{
+		"<100MiB": 2,
+		"<1GiB":   1,
+		"<10GiB":  1,
+		"<100GiB": 0,
+		"<1TiB":   0,
+		">=1TiB":  2,
+	}
+	if buckets := folderSizeBuckets(sizes); !reflect.DeepEqual(buckets, expected) {
+		t.Errorf("Incorrect buckets %v != expected %v", buckets, expected)
+	}
+}
+
+func TestUsageReportFormat(t *testing.T) {
+	oldCfg := cfg
+	defer func() {
+		cfg = oldCfg
+		setReportFormat(maxReportFormat)
+	}()
+
+	cfg = config.Wrap("/tmp/test", config.Configuration{})
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := model.NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+
+	// The extended metrics are only included when opted into.
+
+	if _, ok := reportData(m, maxReportFormat)["osVersion"]; ok {
+		t.Error("Unexpected extended metrics")
+	}
+
+	opts := cfg.Options()
+	opts.URExtended = true
+	cfg.SetOptions(opts)
+
+	if _, ok := reportData(m, maxReportFormat)["osVersion"]; !ok {
+		t.Error("Missing extended metrics")
+	}
+	if _, ok := reportData(m, minReportFormat)["osVersion"]; ok {
+		t.Error("Unexpected extended metrics in the original format")
+	}
+
+	// A server not understanding the newer format gets the original one.
+
+	var formats []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&report)
+		if _, ok := report["urVersion"]; ok {
+			formats = append(formats, int(report["urVersion"].(float64)))
+			http.Error(w, "unknown field", 400)
+			return
+		}
+		formats = append(formats, 1)
+	}))
+	defer srv.Close()
+
+	if err := postUsageReport(http.DefaultClient, srv.URL, m); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(formats, []int{2, 1}) {
+		t.Errorf("Incorrect formats sent %v", formats)
+	}
+	if f := currentReportFormat(); f != 1 {
+		t.Errorf("Negotiated format %d != expected 1", f)
+	}
+}
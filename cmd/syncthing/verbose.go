@@ -97,6 +97,14 @@ func (s *verboseSvc) formatEvent(ev events.Event) string {
 		data := ev.Data.(map[string]string)
 		return fmt.Sprintf("Rejected unshared folder %q from device %v", data["folder"], data["device"])
 
+	case events.UpgradeRolledBack:
+		data := ev.Data.(map[string]string)
+		return fmt.Sprintf("Upgrade to %s rolled back after repeated crashes", data["failedVersion"])
+
+	case events.FolderSecretMismatch:
+		data := ev.Data.(map[string]string)
+		return fmt.Sprintf("Rejected folder %q for device %v, which did not prove knowing its secret", data["folder"], data["device"])
+
 	case events.ItemStarted:
 		data := ev.Data.(map[string]interface{})
 		return fmt.Sprintf("Started syncing %q / %q (%v %v)", data["folder"], data["item"], data["action"], data["type"])
@@ -110,6 +118,45 @@ func (s *verboseSvc) formatEvent(ev events.Event) string {
 	case events.ConfigSaved:
 		return "Configuration was saved"
 
+	case events.AuthFailure:
+		data := ev.Data.(map[string]interface{})
+		return fmt.Sprintf("Failed authentication from %v as %q (%v failures)", data["address"], data["username"], data["failures"])
+
+	case events.FolderChurning:
+		data := ev.Data.(map[string]interface{})
+		return fmt.Sprintf("Ignoring changes to rapidly changing files in folder %q: %v", data["folder"], data["paths"])
+
+	case events.ClockSkew:
+		data := ev.Data.(map[string]interface{})
+		return fmt.Sprintf("Clock of device %v differs from ours by %vs", data["device"], data["skewS"])
+
+	case events.MeteredNetwork:
+		data := ev.Data.(map[string]interface{})
+		return fmt.Sprintf("Metered network: %v, connections outside the local network paused: %v", data["metered"], data["paused"])
+
+	case events.IndexQuarantined:
+		data := ev.Data.(map[string]interface{})
+		return fmt.Sprintf("Quarantined %v impossible items from device %v in folder %q: %v", data["items"], data["device"], data["folder"], data["names"])
+
+	case events.FilenameRejected:
+		data := ev.Data.(map[string]interface{})
+		return fmt.Sprintf("Rejected %v items with unusable names from device %v in folder %q: %v", data["items"], data["device"], data["folder"], data["names"])
+
+	case events.FolderMassChange:
+		data := ev.Data.(map[string]interface{})
+		return fmt.Sprintf("Paused announcing folder %q after %v of %v files changed suspiciously: %v", data["folder"], data["changes"], data["files"], data["names"])
+
+	case events.FolderSnapshot:
+		data := ev.Data.(map[string]interface{})
+		if err, ok := data["error"]; ok {
+			return fmt.Sprintf("Snapshot of folder %q before changing %v items failed: %v", data["folder"], data["items"], err)
+		}
+		return fmt.Sprintf("Took snapshot %q of folder %q before changing %v items", data["snapshot"], data["folder"], data["items"])
+
+	case events.LocalCorruption:
+		data := ev.Data.(map[string]interface{})
+		return fmt.Sprintf("Corrupted file %q in folder %q, blocks %v", data["item"], data["folder"], data["blocks"])
+
 	case events.FolderCompletion:
 		data := ev.Data.(map[string]interface{})
 		return fmt.Sprintf("Completion for folder %q on device %v is %v%%", data["folder"], data["device"], data["completion"])
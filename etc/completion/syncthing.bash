@@ -0,0 +1,27 @@
+# bash completion for syncthing
+# Generated by syncthing -generate-completion bash
+
+_syncthing()
+{
+	local cur prev
+	cur="${COMP_WORDS[COMP_CWORD]}"
+	prev="${COMP_WORDS[COMP_CWORD-1]}"
+
+	case "$prev" in
+	-generate|-home)
+		COMPREPLY=( $(compgen -d -- "$cur") )
+		return 0
+		;;
+	-logfile)
+		COMPREPLY=( $(compgen -f -- "$cur") )
+		return 0
+		;;
+	-diagnose-connection|-generate-completion|-gui-address|-gui-apikey|-gui-authentication|-log-max-age|-log-max-old-files|-log-max-size|-logflags|-self-test-device|-upgrade-to)
+		return 0
+		;;
+	esac
+
+	COMPREPLY=( $(compgen -W "-audit -diagnose-connection -generate -generate-completion -gui-address -gui-apikey -gui-authentication -home -log-compress -log-max-age -log-max-old-files -log-max-size -logfile -logflags -no-browser -no-restart -repair-database -reset -self-test -self-test-device -upgrade -upgrade-check -upgrade-to -verbose -verify -version" -- "$cur") )
+}
+
+complete -F _syncthing syncthing
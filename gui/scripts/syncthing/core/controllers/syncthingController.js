@@ -30,6 +30,9 @@ angular.module('syncthing.core')
         $scope.devices = [];
         $scope.deviceRejections = {};
         $scope.folderRejections = {};
+        $scope.clockSkews = {};
+        $scope.quarantines = {};
+        $scope.massChanges = {};
         $scope.protocolChanged = false;
         $scope.reportData = {};
         $scope.reportPreview = false;
@@ -154,6 +157,7 @@ angular.module('syncthing.core')
 
         $scope.$on('DeviceDisconnected', function (event, arg) {
             delete $scope.connections[arg.data.id];
+            delete $scope.clockSkews[arg.data.id];
             refreshDeviceStats();
         });
 
@@ -200,6 +204,22 @@ angular.module('syncthing.core')
             $scope.folderRejections[arg.data.folder + "-" + arg.data.device] = arg;
         });
 
+        $scope.$on('ClockSkew', function (event, arg) {
+            $scope.clockSkews[arg.data.device] = arg;
+        });
+
+        $scope.$on('IndexQuarantined', function (event, arg) {
+            $scope.quarantines[arg.data.folder + "-" + arg.data.device] = arg;
+        });
+
+        $scope.$on('FolderMassChange', function (event, arg) {
+            $scope.massChanges[arg.data.folder] = arg;
+        });
+
+        $scope.$on('MeteredNetwork', function (event, arg) {
+            refreshSystem();
+        });
+
         $scope.$on('ConfigSaved', function (event, arg) {
             updateLocalConfig(arg.data);
 
@@ -300,7 +320,9 @@ angular.module('syncthing.core')
             var hasConfig = !isEmptyObject($scope.config);
 
             $scope.config = config;
-            $scope.config.options.listenAddressStr = $scope.config.options.listenAddress.join(', ');
+            $scope.config.options.listenersStr = $scope.config.options.listeners.map(function (x) {
+                return x.address;
+            }).join(', ');
             $scope.config.options.globalAnnounceServersStr = $scope.config.options.globalAnnounceServers.join(', ');
 
             $scope.devices = $scope.config.devices;
@@ -669,6 +691,10 @@ angular.module('syncthing.core')
             $scope.tmpOptions.urEnabled = ($scope.tmpOptions.urAccepted > 0);
             $scope.tmpOptions.deviceName = $scope.thisDevice().name;
             $scope.tmpOptions.autoUpgradeEnabled = ($scope.tmpOptions.autoUpgradeIntervalH > 0);
+            $scope.tmpOptions.notify = {};
+            ($scope.tmpOptions.notifyEvents || []).forEach(function (type) {
+                $scope.tmpOptions.notify[type] = true;
+            });
             $scope.tmpGUI = angular.copy($scope.config.gui);
             $('#settings').modal();
         };
@@ -684,7 +710,24 @@ angular.module('syncthing.core')
                 $http.get(urlbase + '/system/config/insync').success(function (data) {
                     $scope.configInSync = data.configInSync;
                 });
-            }).error($scope.emitHTTPError);
+            }).error(function (data, status, headers, config) {
+                if (status !== 400 || !data || !data.errors) {
+                    $scope.emitHTTPError(data, status, headers, config);
+                    return;
+                }
+                // Nothing was saved; show why and go back to the
+                // configuration in effect.
+                $scope.configErrors = data.errors;
+                refreshConfig();
+                $('#configErrors').modal();
+            });
+        };
+
+        $scope.overriddenOptions = function () {
+            if (!$scope.config || !$scope.config.overrides) {
+                return '';
+            }
+            return Object.keys($scope.config.overrides).sort().join(', ');
         };
 
         $scope.saveSettings = function () {
@@ -705,22 +748,58 @@ angular.module('syncthing.core')
                     $scope.tmpOptions.autoUpgradeIntervalH = 0;
                 }
 
+                // Collect the event types to show notifications for
+                $scope.tmpOptions.notifyEvents = Object.keys($scope.tmpOptions.notify).filter(function (type) {
+                    return $scope.tmpOptions.notify[type];
+                });
+
                 // Check if protocol will need to be changed on restart
                 if ($scope.config.gui.useTLS !== $scope.tmpGUI.useTLS) {
                     $scope.protocolChanged = true;
                 }
 
+                // Users without a name are left out
+                if ($scope.tmpGUI.users) {
+                    $scope.tmpGUI.users = $scope.tmpGUI.users.filter(function (user) {
+                        return user.name;
+                    });
+                }
+
                 // Apply new settings locally
                 $scope.thisDevice().name = $scope.tmpOptions.deviceName;
                 $scope.config.options = angular.copy($scope.tmpOptions);
                 $scope.config.gui = angular.copy($scope.tmpGUI);
 
-                ['listenAddress', 'globalAnnounceServers'].forEach(function (key) {
-                    $scope.config.options[key] = $scope.config.options[key + "Str"].split(/[ ,]+/).map(function (x) {
-                        return x.trim();
-                    });
+                $scope.config.options.globalAnnounceServers = $scope.config.options.globalAnnounceServersStr.split(/[ ,]+/).map(function (x) {
+                    return x.trim();
                 });
 
+                // Listeners keep their options as long as the address is
+                // unchanged. If no listener does NAT traversal any more, the
+                // first one takes it over.
+                var listeners = $scope.config.options.listeners;
+                $scope.config.options.listeners = $scope.config.options.listenersStr.split(/[ ,]+/).filter(function (x) {
+                    return x !== '';
+                }).map(function (addr) {
+                    for (var i = 0; i < listeners.length; i++) {
+                        if (listeners[i].address === addr) {
+                            return listeners[i];
+                        }
+                    }
+                    return {
+                        address: addr,
+                        enabled: true,
+                        natTraversal: false,
+                        rateLimit: ''
+                    };
+                });
+                var natTraversal = $scope.config.options.listeners.some(function (x) {
+                    return x.enabled && x.natTraversal;
+                });
+                if (!natTraversal && $scope.config.options.listeners.length > 0) {
+                    $scope.config.options.listeners[0].natTraversal = true;
+                }
+
                 $scope.saveConfig();
             }
 
@@ -773,11 +852,23 @@ angular.module('syncthing.core')
             $scope.configInSync = true;
         };
 
+        $scope.loginRequired = function () {
+            var gui = $scope.config && $scope.config.gui;
+            return gui && ((gui.users && gui.users.length > 0) || (gui.authMode && gui.authMode !== 'static'));
+        };
+
+        $scope.logout = function () {
+            $http.post(urlbase + '/system/logout').finally(function () {
+                location.reload();
+            });
+        };
+
         $scope.editDevice = function (deviceCfg) {
             $scope.currentDevice = $.extend({}, deviceCfg);
             $scope.editingExisting = true;
             $scope.editingSelf = (deviceCfg.deviceID == $scope.myID);
             $scope.currentDevice.addressesStr = deviceCfg.addresses.join(', ');
+            $scope.currentDevice.allowedNetworksStr = (deviceCfg.allowedNetworks || []).join(', ');
             if (!$scope.editingSelf) {
                 $scope.currentDevice.selectedFolders = {};
                 $scope.deviceFolders($scope.currentDevice).forEach(function (folder) {
@@ -800,6 +891,7 @@ angular.module('syncthing.core')
                 .then(function () {
                     $scope.currentDevice = {
                         addressesStr: 'dynamic',
+                        allowedNetworksStr: '',
                         compression: 'metadata',
                         introducer: false,
                         selectedFolders: {}
@@ -845,6 +937,7 @@ angular.module('syncthing.core')
             var deviceCfg = {
                 deviceID: device,
                 addressesStr: 'dynamic',
+                allowedNetworksStr: '',
                 compression: 'metadata',
                 introducer: false,
                 selectedFolders: {}
@@ -858,6 +951,11 @@ angular.module('syncthing.core')
             deviceCfg.addresses = deviceCfg.addressesStr.split(',').map(function (x) {
                 return x.trim();
             });
+            deviceCfg.allowedNetworks = deviceCfg.allowedNetworksStr.split(',').map(function (x) {
+                return x.trim();
+            }).filter(function (x) {
+                return x !== '';
+            });
 
             done = false;
             for (i = 0; i < $scope.devices.length; i++) {
@@ -911,6 +1009,20 @@ angular.module('syncthing.core')
             delete $scope.deviceRejections[device];
         };
 
+        $scope.dismissClockSkew = function (device) {
+            delete $scope.clockSkews[device];
+        };
+
+        $scope.dismissQuarantine = function (key) {
+            delete $scope.quarantines[key];
+        };
+
+        $scope.resumeMassChange = function (folder) {
+            $http.post(urlbase + '/db/masschanges/resume?folder=' + encodeURIComponent(folder)).success(function () {
+                delete $scope.massChanges[folder];
+            }).error($scope.emitHTTPError);
+        };
+
         $scope.ignoreRejectedDevice = function (device) {
             $scope.config.ignoredDevices.push(device);
             $scope.saveConfig();
@@ -1036,10 +1148,11 @@ angular.module('syncthing.core')
             $('#editFolder').modal();
         };
 
-        $scope.addFolderAndShare = function (folder, device) {
+        $scope.addFolderAndShare = function (folder, device, defaultPath) {
             $scope.dismissFolderRejection(folder, device);
             $scope.currentFolder = {
                 id: folder,
+                path: defaultPath || "",
                 selectedDevices: {}
             };
             $scope.currentFolder.selectedDevices[device] = true;
@@ -1071,12 +1184,17 @@ angular.module('syncthing.core')
 
             $('#editFolder').modal('hide');
             folderCfg = $scope.currentFolder;
+            var readOnly = {};
+            (folderCfg.devices || []).forEach(function (device) {
+                readOnly[device.deviceID] = device.readOnly;
+            });
             folderCfg.devices = [];
             folderCfg.selectedDevices[$scope.myID] = true;
             for (var deviceID in folderCfg.selectedDevices) {
                 if (folderCfg.selectedDevices[deviceID] === true) {
                     folderCfg.devices.push({
-                        deviceID: deviceID
+                        deviceID: deviceID,
+                        readOnly: readOnly[deviceID] === true
                     });
                 }
             }
@@ -1205,6 +1323,65 @@ angular.module('syncthing.core')
             });
         };
 
+        $scope.addGUIUser = function () {
+            $scope.tmpGUI.users = $scope.tmpGUI.users || [];
+            $scope.tmpGUI.users.push({name: '', password: '', role: 'admin'});
+        };
+
+        $scope.removeGUIUser = function (index) {
+            $scope.tmpGUI.users.splice(index, 1);
+        };
+
+        $scope.savedGUIUser = function (name) {
+            return ($scope.config.gui.users || []).some(function (user) {
+                return user.name === name;
+            });
+        };
+
+        // The second factor is enrolled and disabled directly in the saved
+        // configuration; the settings being edited are updated to match.
+        $scope.updateTOTPUser = function (name) {
+            $http.get(urlbase + '/system/config').success(function (config) {
+                $scope.config.gui.users = config.gui.users;
+                (config.gui.users || []).forEach(function (saved) {
+                    ($scope.tmpGUI.users || []).forEach(function (user) {
+                        if (user.name === name && saved.name === name) {
+                            user.totpSecret = saved.totpSecret;
+                            user.recoveryCodes = saved.recoveryCodes;
+                        }
+                    });
+                });
+            }).error($scope.emitHTTPError);
+        };
+
+        $scope.enrollTOTP = function (user) {
+            $http.post(urlbase + '/system/totp/enroll?user=' + encodeURIComponent(user.name)).success(function (data) {
+                $scope.totp = {
+                    user: user.name,
+                    secret: data.secret,
+                    qr: 'qr/?text=' + encodeURIComponent(data.uri)
+                };
+                $('#settings').modal('hide');
+                $('#totp').modal().one('hidden.bs.modal', function () {
+                    $('#settings').modal();
+                });
+            }).error($scope.emitHTTPError);
+        };
+
+        $scope.confirmTOTP = function () {
+            var url = urlbase + '/system/totp/confirm?user=' + encodeURIComponent($scope.totp.user) + '&code=' + encodeURIComponent($scope.totp.code);
+            $http.post(url).success(function (data) {
+                $scope.totp.recoveryCodes = data.recoveryCodes;
+                $scope.updateTOTPUser($scope.totp.user);
+            }).error($scope.emitHTTPError);
+        };
+
+        $scope.disableTOTP = function (user) {
+            $http.post(urlbase + '/system/totp/disable?user=' + encodeURIComponent(user.name)).success(function () {
+                $scope.updateTOTPUser(user.name);
+            }).error($scope.emitHTTPError);
+        };
+
         $scope.setAPIKey = function (cfg) {
             cfg.apiKey = randomString(32);
         };
@@ -1240,13 +1417,29 @@ angular.module('syncthing.core')
         };
 
         $scope.override = function (folder) {
-            $http.post(urlbase + "/db/override?folder=" + encodeURIComponent(folder));
+            $http.get(urlbase + "/db/override?folder=" + encodeURIComponent(folder)).success(function (data) {
+                $scope.overrideFolder = folder;
+                $scope.overrideInfo = data;
+                $('#override').modal();
+            });
+        };
+
+        $scope.confirmOverride = function () {
+            $('#override').modal('hide');
+            $http.post(urlbase + "/db/override?folder=" + encodeURIComponent($scope.overrideFolder));
         };
 
         $scope.about = function () {
             $('#about').modal('show');
         };
 
+        $scope.showLog = function () {
+            $http.get(urlbase + '/system/log').success(function (data) {
+                $scope.logMessages = data.messages;
+                $('#log').modal('show');
+            }).error($scope.emitHTTPError);
+        };
+
         $scope.showReportPreview = function () {
             $scope.reportPreview = true;
         };
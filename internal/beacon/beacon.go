@@ -26,7 +26,7 @@ func genericReader(conn *net.UDPConn, outbox chan<- recv) {
 			l.Warnln("multicast read:", err)
 			return
 		}
-		if debug {
+		if debug.On() {
 			l.Debugf("recv %d bytes from %s", n, addr)
 		}
 
@@ -35,7 +35,7 @@ func genericReader(conn *net.UDPConn, outbox chan<- recv) {
 		select {
 		case outbox <- recv{c, addr}:
 		default:
-			if debug {
+			if debug.On() {
 				l.Debugln("dropping message")
 			}
 		}
@@ -64,7 +64,7 @@ func (b *Broadcast) writer() {
 			dsts = append(dsts, net.IP{0xff, 0xff, 0xff, 0xff})
 		}
 
-		if debug {
+		if debug.On() {
 			l.Debugln("addresses:", dsts)
 		}
 
@@ -73,10 +73,10 @@ func (b *Broadcast) writer() {
 
 			_, err := b.conn.WriteTo(bs, dst)
 			if err != nil {
-				if debug {
+				if debug.On() {
 					l.Debugln(err)
 				}
-			} else if debug {
+			} else if debug.On() {
 				l.Debugf("sent %d bytes to %s", len(bs), dst)
 			}
 		}
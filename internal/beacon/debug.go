@@ -11,9 +11,14 @@ import (
 	"strings"
 
 	"github.com/calmh/logger"
+	"github.com/syncthing/syncthing/internal/trace"
 )
 
 var (
-	debug = strings.Contains(os.Getenv("STTRACE"), "beacon") || os.Getenv("STTRACE") == "all"
+	debug = trace.NewFlag(strings.Contains(os.Getenv("STTRACE"), "beacon") || os.Getenv("STTRACE") == "all")
 	l     = logger.DefaultLogger
 )
+
+func init() {
+	trace.Register("beacon", "The beacon package", debug)
+}
@@ -0,0 +1,33 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build !windows
+
+package beacon
+
+import (
+	"net"
+	"syscall"
+)
+
+// setMulticastHops sets the hop limit of the multicast packets sent on conn.
+// There is no way to do so in the net package, and golang.org/x/net/ipv6 is
+// not vendored, so it is set on a duplicate of the socket. Getting the
+// duplicate puts the socket in blocking mode, which would tie up a thread in
+// each read and keep Close from interrupting them; non-blocking mode, which
+// is shared by the duplicates, is restored.
+func setMulticastHops(conn *net.UDPConn, hops int) error {
+	fd, err := conn.File()
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	sock := int(fd.Fd())
+	if err := syscall.SetsockoptInt(sock, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, hops); err != nil {
+		return err
+	}
+	return syscall.SetNonblock(sock, true)
+}
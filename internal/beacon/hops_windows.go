@@ -0,0 +1,21 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package beacon
+
+import (
+	"net"
+	"syscall"
+)
+
+func setMulticastHops(conn *net.UDPConn, hops int) error {
+	fd, err := conn.File()
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return syscall.SetsockoptInt(syscall.Handle(fd.Fd()), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, hops)
+}
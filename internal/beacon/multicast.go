@@ -16,7 +16,11 @@ type Multicast struct {
 	outbox chan recv
 }
 
-func NewMulticast(addr, ifname string) (*Multicast, error) {
+// NewMulticast returns a beacon sending to and receiving from the given IPv6
+// multicast group on the named interface. The multicast packets cross at
+// most hops routers; zero means the system default, usually the local
+// network only.
+func NewMulticast(addr, ifname string, hops int) (*Multicast, error) {
 	gaddr, err := net.ResolveUDPAddr("udp6", addr)
 	if err != nil {
 		return nil, err
@@ -29,6 +33,12 @@ func NewMulticast(addr, ifname string) (*Multicast, error) {
 	if err != nil {
 		return nil, err
 	}
+	if hops > 0 {
+		if err := setMulticastHops(conn, hops); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
 	b := &Multicast{
 		conn:   conn,
 		addr:   gaddr,
@@ -57,9 +67,9 @@ func (b *Multicast) writer() {
 	addr.Zone = b.intf.Name
 	for bs := range b.inbox {
 		_, err := b.conn.WriteTo(bs, &addr)
-		if err != nil && debug {
+		if err != nil && debug.On() {
 			l.Debugln(err, "on write to", addr)
-		} else if debug {
+		} else if debug.On() {
 			l.Debugf("sent %d bytes to %s", len(bs), addr.String())
 		}
 	}
@@ -8,10 +8,15 @@
 package config
 
 import (
+	"crypto/tls"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -19,6 +24,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/calmh/logger"
 	"github.com/syncthing/protocol"
@@ -30,9 +36,14 @@ var l = logger.DefaultLogger
 
 const (
 	OldestHandledVersion = 5
-	CurrentVersion       = 10
+	CurrentVersion       = 12
 )
 
+// DefaultMarkerName is the folder marker used unless another is configured.
+const DefaultMarkerName = ".stfolder"
+
+var errMarkerContent = errors.New("folder marker exists with different content")
+
 type Configuration struct {
 	Version        int                   `xml:"version,attr" json:"version"`
 	Folders        []FolderConfiguration `xml:"folder" json:"folders"`
@@ -61,6 +72,7 @@ func (cfg Configuration) Copy() Configuration {
 	}
 
 	newCfg.Options = cfg.Options.Copy()
+	newCfg.GUI = cfg.GUI.Copy()
 
 	// DeviceIDs are values
 	newCfg.IgnoredDevices = make([]protocol.DeviceID, len(cfg.IgnoredDevices))
@@ -69,6 +81,30 @@ func (cfg Configuration) Copy() Configuration {
 	return newCfg
 }
 
+// SetFolder adds a new folder to the configuration, or overwrites an
+// existing folder with the same ID.
+func (cfg *Configuration) SetFolder(fld FolderConfiguration) {
+	for i := range cfg.Folders {
+		if cfg.Folders[i].ID == fld.ID {
+			cfg.Folders[i] = fld
+			return
+		}
+	}
+	cfg.Folders = append(cfg.Folders, fld)
+}
+
+// SetDevice adds a new device to the configuration, or overwrites an
+// existing device with the same ID.
+func (cfg *Configuration) SetDevice(dev DeviceConfiguration) {
+	for i := range cfg.Devices {
+		if cfg.Devices[i].DeviceID == dev.DeviceID {
+			cfg.Devices[i] = dev
+			return
+		}
+	}
+	cfg.Devices = append(cfg.Devices, dev)
+}
+
 type FolderConfiguration struct {
 	ID              string                      `xml:"id,attr" json:"id"`
 	RawPath         string                      `xml:"path,attr" json:"path"`
@@ -78,10 +114,26 @@ type FolderConfiguration struct {
 	IgnorePerms     bool                        `xml:"ignorePerms,attr" json:"ignorePerms"`
 	AutoNormalize   bool                        `xml:"autoNormalize,attr" json:"autoNormalize"`
 	Versioning      VersioningConfiguration     `xml:"versioning" json:"versioning"`
-	Copiers         int                         `xml:"copiers" json:"copiers"` // This defines how many files are handled concurrently.
-	Pullers         int                         `xml:"pullers" json:"pullers"` // Defines how many blocks are fetched at the same time, possibly between separate copier routines.
-	Hashers         int                         `xml:"hashers" json:"hashers"` // Less than one sets the value to the number of cores. These are CPU bound due to hashing.
+	Copiers         int                         `xml:"copiers" json:"copiers"` // This defines how many files are handled concurrently; 0 for automatic.
+	Pullers         int                         `xml:"pullers" json:"pullers"` // Defines how many blocks are fetched at the same time, possibly between separate copier routines; 0 for automatic.
+	Hashers         int                         `xml:"hashers" json:"hashers"` // 0 for automatic, based on the number of cores. These are CPU bound due to hashing.
 	Order           PullOrder                   `xml:"order" json:"order"`
+	MaxConflicts    int                         `xml:"maxConflicts" json:"maxConflicts"`             // Conflict copies to keep per file; 0 for unlimited
+	ConflictMaxAgeH int                         `xml:"conflictMaxAgeH" json:"conflictMaxAgeH"`       // Remove conflict copies older than this; 0 for never
+	Placeholders    bool                        `xml:"placeholders" json:"placeholders"`             // Create empty placeholders instead of pulling content, unless fetched on request
+	ModTimeWindowS  int                         `xml:"modTimeWindowS" json:"modTimeWindowS"`         // Modification times this many seconds apart are equal; 2 for FAT
+	MarkerName      string                      `xml:"markerName,omitempty" json:"markerName"`       // Relative to the folder; .stfolder if empty. A custom marker is synced like any other file.
+	MarkerContent   string                      `xml:"markerContent,omitempty" json:"markerContent"` // Required marker file content; any if empty
+	ImportGitignore bool                        `xml:"importGitignore" json:"importGitignore"`       // Also ignore what the .gitignore files in the folder ignore
+	Archive         bool                        `xml:"archive" json:"archive"`                       // Remote deletions are not applied; the files are kept locally
+	MaxFileSizeMiB  int                         `xml:"maxFileSizeMiB" json:"maxFileSizeMiB"`         // Files larger than this are neither announced nor pulled; 0 for no limit
+	Secret          string                      `xml:"secret,omitempty" json:"secret"`               // Shared with the other devices, which must prove knowing it to get the folder; empty for none
+	DryRun          bool                        `xml:"dryRun" json:"dryRun"`                         // Nothing is pulled; see /rest/db/plan for what would be
+	DeleteDelayH    int                         `xml:"deleteDelayH" json:"deleteDelayH"`             // Remote deletions are applied this long after being seen and can be cancelled meanwhile; 0 for immediately
+	MassChangePct   int                         `xml:"massChangePct" json:"massChangePct"`           // Changes are no longer announced when more than this percentage of files gets random looking content or a new extension within ten minutes; 0 to never pause
+	SnapshotCommand string                      `xml:"snapshotCommand" json:"snapshotCommand"`       // Run with the folder path and item count before pulls deleting or replacing more than SnapshotItems items, printing the snapshot ID; empty for none
+	SnapshotItems   int                         `xml:"snapshotItems" json:"snapshotItems"`           // See SnapshotCommand; 0 to take a snapshot before any deletion or replacement
+	Priority        int                         `xml:"priority" json:"priority"`                     // Blocks of higher priority folders are requested first when several folders pull from the same device
 
 	Invalid string `xml:"-" json:"invalid"` // Set at runtime when there is an error, not saved
 
@@ -95,6 +147,46 @@ func (f FolderConfiguration) Copy() FolderConfiguration {
 	return c
 }
 
+// The highest numbers of copier, puller and hasher routines accepted per
+// folder.
+const (
+	MaxCopiers = 64
+	MaxPullers = 1024
+	MaxHashers = 64
+)
+
+// CheckTuning returns an error if the numbers of copier, puller or hasher
+// routines are out of range. Zero means tuned automatically.
+func (f FolderConfiguration) CheckTuning() error {
+	switch {
+	case f.Copiers < 0 || f.Copiers > MaxCopiers:
+		return fmt.Errorf("copiers must be between 0 (automatic) and %d", MaxCopiers)
+	case f.Pullers < 0 || f.Pullers > MaxPullers:
+		return fmt.Errorf("pullers must be between 0 (automatic) and %d", MaxPullers)
+	case f.Hashers < 0 || f.Hashers > MaxHashers:
+		return fmt.Errorf("hashers must be between 0 (automatic) and %d", MaxHashers)
+	}
+	return nil
+}
+
+// MaxFileSize returns the maximum file size in bytes, or zero if there is
+// no limit.
+func (f FolderConfiguration) MaxFileSize() int64 {
+	if f.MaxFileSizeMiB <= 0 {
+		return 0
+	}
+	return int64(f.MaxFileSizeMiB) << 20
+}
+
+// DeleteDelay returns how long remote deletions are held back, or zero if
+// they are applied immediately.
+func (f FolderConfiguration) DeleteDelay() time.Duration {
+	if f.DeleteDelayH <= 0 {
+		return 0
+	}
+	return time.Duration(f.DeleteDelayH) * time.Hour
+}
+
 func (f FolderConfiguration) Path() string {
 	// This is intentionally not a pointer method, because things like
 	// cfg.Folders["default"].Path() should be valid.
@@ -123,26 +215,62 @@ func (f FolderConfiguration) Path() string {
 	return f.RawPath
 }
 
+// MarkerPath returns the path of the folder marker, the file or directory
+// whose presence shows that the folder is available (i.e. mounted).
+func (f FolderConfiguration) MarkerPath() string {
+	name := f.MarkerName
+	if name == "" {
+		name = DefaultMarkerName
+	}
+	return filepath.Join(f.Path(), osutil.NativeFilename(name))
+}
+
+// CreateMarker creates the folder marker as a file with the configured
+// content, unless there already is one. A marker with the wrong content is an
+// error, and is not overwritten.
 func (f *FolderConfiguration) CreateMarker() error {
-	if !f.HasMarker() {
-		marker := filepath.Join(f.Path(), ".stfolder")
-		fd, err := os.Create(marker)
-		if err != nil {
+	if f.HasMarker() {
+		return nil
+	}
+
+	marker := f.MarkerPath()
+	if _, err := os.Lstat(marker); err == nil {
+		return errMarkerContent
+	}
+
+	fd, err := os.Create(marker)
+	if err != nil {
+		return err
+	}
+	if f.MarkerContent != "" {
+		if _, err := fd.WriteString(f.MarkerContent + "\n"); err != nil {
+			fd.Close()
 			return err
 		}
-		fd.Close()
+	}
+	if err := fd.Close(); err != nil {
+		return err
+	}
+	if f.MarkerName == "" {
 		osutil.HideFile(marker)
 	}
 
 	return nil
 }
 
+// HasMarker returns true if the folder marker exists and, if a marker
+// content is configured, has that content.
 func (f *FolderConfiguration) HasMarker() bool {
-	_, err := os.Stat(filepath.Join(f.Path(), ".stfolder"))
+	if f.MarkerContent == "" {
+		_, err := os.Stat(f.MarkerPath())
+		return err == nil
+	}
+
+	bs, err := ioutil.ReadFile(f.MarkerPath())
 	if err != nil {
 		return false
 	}
-	return true
+	return strings.TrimSpace(string(bs)) == strings.TrimSpace(f.MarkerContent)
 }
 
 func (f *FolderConfiguration) DeviceIDs() []protocol.DeviceID {
@@ -202,50 +330,270 @@ type DeviceConfiguration struct {
 	Compression protocol.Compression `xml:"compression,attr" json:"compression"`
 	CertName    string               `xml:"certName,attr,omitempty" json:"certName"`
 	Introducer  bool                 `xml:"introducer,attr" json:"introducer"`
+	// Connections to and from the device are only allowed with addresses
+	// in these networks, in CIDR notation. An empty list allows any address.
+	AllowedNetworks []string `xml:"allowedNetwork,omitempty" json:"allowedNetworks"`
+	// Overrides of the ping options for this device; 0 to use the global
+	// setting.
+	PingIdleTimeS int `xml:"pingIdleTimeS,attr,omitempty" json:"pingIdleTimeS"`
+	PingTimeoutS  int `xml:"pingTimeoutS,attr,omitempty" json:"pingTimeoutS"`
+	// Block requests outstanding on a connection to the device at once; 0
+	// to adapt to the measured round trip time and throughput. Takes effect
+	// on the next connection.
+	MaxRequests int `xml:"maxRequests,attr,omitempty" json:"maxRequests"`
 }
 
+// The highest number of block requests outstanding on a connection.
+const MaxRequests = 1024
+
 func (orig DeviceConfiguration) Copy() DeviceConfiguration {
 	c := orig
 	c.Addresses = make([]string, len(orig.Addresses))
 	copy(c.Addresses, orig.Addresses)
+	if orig.AllowedNetworks != nil {
+		c.AllowedNetworks = make([]string, len(orig.AllowedNetworks))
+		copy(c.AllowedNetworks, orig.AllowedNetworks)
+	}
 	return c
 }
 
+// PingTimes returns how long the connection to the device may be idle before
+// the device is pinged, and how long to wait for the response before the
+// connection is considered dead. Unset values fall back to the global
+// options, and to the protocol defaults.
+func (cfg DeviceConfiguration) PingTimes(opts OptionsConfiguration) (idle, timeout time.Duration) {
+	idle, timeout = protocol.DefaultPingIdleTime, protocol.DefaultPingTimeout
+	if opts.PingIdleTimeS > 0 {
+		idle = time.Duration(opts.PingIdleTimeS) * time.Second
+	}
+	if opts.PingTimeoutS > 0 {
+		timeout = time.Duration(opts.PingTimeoutS) * time.Second
+	}
+	if cfg.PingIdleTimeS > 0 {
+		idle = time.Duration(cfg.PingIdleTimeS) * time.Second
+	}
+	if cfg.PingTimeoutS > 0 {
+		timeout = time.Duration(cfg.PingTimeoutS) * time.Second
+	}
+	return idle, timeout
+}
+
+// AllowsIP returns true if connections to and from the device are allowed
+// with the given address.
+func (cfg DeviceConfiguration) AllowsIP(ip net.IP) bool {
+	if len(cfg.AllowedNetworks) == 0 {
+		return true
+	}
+	for _, network := range cfg.AllowedNetworks {
+		if _, ipnet, err := net.ParseCIDR(network); err == nil && ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 type FolderDeviceConfiguration struct {
 	DeviceID protocol.DeviceID `xml:"id,attr" json:"deviceID"`
+	ReadOnly bool              `xml:"readOnly,attr,omitempty" json:"readOnly"` // The device receives the folder, but its changes are not accepted
+}
+
+// Rate limiting classes for listeners.
+const (
+	RateLimitAuto   = ""       // limited unless on the LAN, as per LimitBandwidthInLan
+	RateLimitAlways = "always" // always limited
+	RateLimitNever  = "never"  // never limited
+)
+
+// A ListenerConfiguration is an address to accept sync protocol connections
+// on.
+type ListenerConfiguration struct {
+	Address string `xml:"address,attr" json:"address"`
+	Enabled bool   `xml:"enabled,attr" json:"enabled"`
+	// Set up a UPnP port mapping for the listener, if UPnP is enabled. Only
+	// the first such listener is announced to global discovery.
+	NATTraversal bool   `xml:"natTraversal,attr" json:"natTraversal"`
+	RateLimit    string `xml:"rateLimit,attr,omitempty" json:"rateLimit"`
+}
+
+var defaultListener = ListenerConfiguration{
+	Address:      "0.0.0.0:22000",
+	Enabled:      true,
+	NATTraversal: true,
 }
 
 type OptionsConfiguration struct {
-	ListenAddress           []string `xml:"listenAddress" json:"listenAddress" default:"0.0.0.0:22000"`
-	GlobalAnnServers        []string `xml:"globalAnnounceServer" json:"globalAnnounceServers" json:"globalAnnounceServer" default:"udp4://announce.syncthing.net:22026, udp6://announce-v6.syncthing.net:22026"`
-	GlobalAnnEnabled        bool     `xml:"globalAnnounceEnabled" json:"globalAnnounceEnabled" default:"true"`
-	LocalAnnEnabled         bool     `xml:"localAnnounceEnabled" json:"localAnnounceEnabled" default:"true"`
-	LocalAnnPort            int      `xml:"localAnnouncePort" json:"localAnnouncePort" default:"21025"`
-	LocalAnnMCAddr          string   `xml:"localAnnounceMCAddr" json:"localAnnounceMCAddr" default:"[ff32::5222]:21026"`
-	MaxSendKbps             int      `xml:"maxSendKbps" json:"maxSendKbps"`
-	MaxRecvKbps             int      `xml:"maxRecvKbps" json:"maxRecvKbps"`
-	ReconnectIntervalS      int      `xml:"reconnectionIntervalS" json:"reconnectionIntervalS" default:"60"`
-	StartBrowser            bool     `xml:"startBrowser" json:"startBrowser" default:"true"`
-	UPnPEnabled             bool     `xml:"upnpEnabled" json:"upnpEnabled" default:"true"`
-	UPnPLeaseM              int      `xml:"upnpLeaseMinutes" json:"upnpLeaseMinutes" default:"60"`
-	UPnPRenewalM            int      `xml:"upnpRenewalMinutes" json:"upnpRenewalMinutes" default:"30"`
-	UPnPTimeoutS            int      `xml:"upnpTimeoutSeconds" json:"upnpTimeoutSeconds" default:"10"`
-	URAccepted              int      `xml:"urAccepted" json:"urAccepted"` // Accepted usage reporting version; 0 for off (undecided), -1 for off (permanently)
-	URUniqueID              string   `xml:"urUniqueID" json:"urUniqueId"` // Unique ID for reporting purposes, regenerated when UR is turned on.
-	RestartOnWakeup         bool     `xml:"restartOnWakeup" json:"restartOnWakeup" default:"true"`
-	AutoUpgradeIntervalH    int      `xml:"autoUpgradeIntervalH" json:"autoUpgradeIntervalH" default:"12"` // 0 for off
-	KeepTemporariesH        int      `xml:"keepTemporariesH" json:"keepTemporariesH" default:"24"`         // 0 for off
-	CacheIgnoredFiles       bool     `xml:"cacheIgnoredFiles" json:"cacheIgnoredFiles" default:"true"`
-	ProgressUpdateIntervalS int      `xml:"progressUpdateIntervalS" json:"progressUpdateIntervalS" default:"5"`
-	SymlinksEnabled         bool     `xml:"symlinksEnabled" json:"symlinksEnabled" default:"true"`
-	LimitBandwidthInLan     bool     `xml:"limitBandwidthInLan" json:"limitBandwidthInLan" default:"false"`
-	DatabaseBlockCacheMiB   int      `xml:"databaseBlockCacheMiB" json:"databaseBlockCacheMiB" default:"0"`
+	ListenAddress           []string                `xml:"listenAddress,omitempty" json:"-"` // Replaced by Listeners in version 11
+	Listeners               []ListenerConfiguration `xml:"listener" json:"listeners"`
+	GlobalAnnServers        []string                `xml:"globalAnnounceServer" json:"globalAnnounceServers" json:"globalAnnounceServer" default:"udp4://announce.syncthing.net:22026, udp6://announce-v6.syncthing.net:22026"`
+	GlobalAnnEnabled        bool                    `xml:"globalAnnounceEnabled" json:"globalAnnounceEnabled" default:"true"`
+	LocalAnnEnabled         bool                    `xml:"localAnnounceEnabled" json:"localAnnounceEnabled" default:"true"`
+	LocalAnnPort            int                     `xml:"localAnnouncePort" json:"localAnnouncePort" default:"21025"`
+	LocalAnnMCAddr          string                  `xml:"localAnnounceMCAddr" json:"localAnnounceMCAddr" default:"[ff32::5222]:21026"`
+	LocalAnnMCHops          int                     `xml:"localAnnounceMCHops" json:"localAnnounceMCHops" default:"1"` // Routers the IPv6 announcements may cross; more than one needs multicast routing between the networks
+	MaxSendKbps             int                     `xml:"maxSendKbps" json:"maxSendKbps"`
+	MaxRecvKbps             int                     `xml:"maxRecvKbps" json:"maxRecvKbps"`
+	ReconnectIntervalS      int                     `xml:"reconnectionIntervalS" json:"reconnectionIntervalS" default:"60"`
+	StartBrowser            bool                    `xml:"startBrowser" json:"startBrowser" default:"true"`
+	UPnPEnabled             bool                    `xml:"upnpEnabled" json:"upnpEnabled" default:"true"`
+	UPnPLeaseM              int                     `xml:"upnpLeaseMinutes" json:"upnpLeaseMinutes" default:"60"`
+	UPnPRenewalM            int                     `xml:"upnpRenewalMinutes" json:"upnpRenewalMinutes" default:"30"`
+	UPnPTimeoutS            int                     `xml:"upnpTimeoutSeconds" json:"upnpTimeoutSeconds" default:"10"`
+	URAccepted              int                     `xml:"urAccepted" json:"urAccepted"` // Accepted usage reporting version; 0 for off (undecided), -1 for off (permanently)
+	URUniqueID              string                  `xml:"urUniqueID" json:"urUniqueId"` // Unique ID for reporting purposes, regenerated when UR is turned on.
+	RestartOnWakeup         bool                    `xml:"restartOnWakeup" json:"restartOnWakeup" default:"true"`
+	AutoUpgradeIntervalH    int                     `xml:"autoUpgradeIntervalH" json:"autoUpgradeIntervalH" default:"12"` // 0 for off
+	KeepTemporariesH        int                     `xml:"keepTemporariesH" json:"keepTemporariesH" default:"24"`         // 0 for off
+	CacheIgnoredFiles       bool                    `xml:"cacheIgnoredFiles" json:"cacheIgnoredFiles" default:"true"`
+	ProgressUpdateIntervalS int                     `xml:"progressUpdateIntervalS" json:"progressUpdateIntervalS" default:"5"`
+	SymlinksEnabled         bool                    `xml:"symlinksEnabled" json:"symlinksEnabled" default:"true"`
+	LimitBandwidthInLan     bool                    `xml:"limitBandwidthInLan" json:"limitBandwidthInLan" default:"false"`
+	DatabaseBlockCacheMiB   int                     `xml:"databaseBlockCacheMiB" json:"databaseBlockCacheMiB" default:"0"`
+	MaxScanReadMBps         int                     `xml:"maxScanReadMBps" json:"maxScanReadMBps"`             // Total read rate while hashing, over all folders; 0 for unlimited
+	MaxConcurrentHashers    int                     `xml:"maxConcurrentHashers" json:"maxConcurrentHashers"`   // Total number of files hashed at once, over all folders; 0 for unlimited
+	MaxCPUPercent           int                     `xml:"maxCPUPercent" json:"maxCPUPercent"`                 // Target CPU usage, in percent of all cores, above which hashing and pulling is throttled; 0 for unlimited
+	BackgroundPriority      bool                    `xml:"backgroundPriority" json:"backgroundPriority"`       // Run at lowered CPU and I/O priority
+	HeapDumpThresholdMiB    int                     `xml:"heapDumpThresholdMiB" json:"heapDumpThresholdMiB"`   // Write a heap profile to the config directory when memory usage exceeds this; 0 for off
+	CREnabled               bool                    `xml:"crashReportingEnabled" json:"crashReportingEnabled"` // Upload crash logs; off unless explicitly enabled by the user
+	CRURL                   string                  `xml:"crashReportingURL" json:"crashReportingURL" default:"https://crash.syncthing.net/newcrash"`
+	PauseOnBattery          bool                    `xml:"pauseOnBattery" json:"pauseOnBattery"`                           // Pause scanning and transfers while on battery power
+	PauseOnMetered          bool                    `xml:"pauseOnMeteredNetwork" json:"pauseOnMeteredNetwork"`             // Pause connections outside the local network while on a metered network
+	NotifyEvents            []string                `xml:"notifyEvent" json:"notifyEvents"`                                // Event types shown as desktop notifications: DeviceRejected, FolderRejected, ItemFinished
+	NotifyMinTransferMiB    int                     `xml:"notifyMinTransferMiB" json:"notifyMinTransferMiB" default:"100"` // Smallest finished download that is notified about
+	SMTPServer              string                  `xml:"smtpServer" json:"smtpServer"`                                   // host:port of the mail server for error notifications; empty for off
+	SMTPUser                string                  `xml:"smtpUser" json:"smtpUser"`                                       // Empty for no authentication
+	SMTPPassword            string                  `xml:"smtpPassword" json:"smtpPassword"`
+	SMTPFrom                string                  `xml:"smtpFrom" json:"smtpFrom"`
+	SMTPRecipients          []string                `xml:"smtpRecipient" json:"smtpRecipients"`
+	SMTPSeverity            string                  `xml:"smtpSeverity" json:"smtpSeverity" default:"error"`                // "error" mails about folders stopped by an error, "warning" also about items failing to sync
+	SMTPErrorDelayM         int                     `xml:"smtpErrorDelayM" json:"smtpErrorDelayM" default:"60"`             // How long a problem must persist before it is mailed about
+	EventLogTypes           []string                `xml:"eventLogType" json:"eventLogTypes"`                               // Event types kept in the database across restarts
+	EventLogSize            int                     `xml:"eventLogSize" json:"eventLogSize" default:"10000"`                // Number of events kept in the database; the oldest are dropped
+	PingIdleTimeS           int                     `xml:"pingIdleTimeS" json:"pingIdleTimeS" default:"60"`                 // Idle time after which a connected device is pinged
+	PingTimeoutS            int                     `xml:"pingTimeoutS" json:"pingTimeoutS" default:"30"`                   // Time to wait for the ping response before the connection is considered dead and redialed
+	ExcludeTypes            []string                `xml:"excludeType" json:"excludeTypes"`                                 // Patterns ignored in all folders, regardless of their ignore patterns; "*.iso", "node_modules/"
+	AlwaysLocalNets         []string                `xml:"alwaysLocalNet" json:"alwaysLocalNets"`                           // Networks on the LAN in addition to the private ranges and those of our interfaces; "100.64.0.0/10"
+	URExtended              bool                    `xml:"urExtended" json:"urExtended"`                                    // Include the extended metrics in the usage report; opted into separately from usage reporting itself
+	CORSAllowedOrigins      []string                `xml:"corsAllowedOrigin" json:"corsAllowedOrigins"`                     // Origins of web pages allowed to use the REST API with an API key; "https://dashboard.example.com"
+	DefaultFolderPath       string                  `xml:"defaultFolderPath" json:"defaultFolderPath"`                      // Path suggested for folders shared by other devices; %id%, %label% and %device% are replaced by the folder ID and the name of the sharing device. "~/Sync/%id%"
+	TombstoneRetentionH     int                     `xml:"tombstoneRetentionH" json:"tombstoneRetentionH"`                  // Deleted files known as deleted by all devices are removed from the index after this long; 0 to keep them forever
+	ExternalAddress         string                  `xml:"externalAddress" json:"externalAddress"`                          // Address announced to global discovery instead of that of the listener or UPnP mapping, for manually forwarded ports; "host:port", or ":port" for the IP the announcement comes from or given by ExternalIPURL
+	ExternalIPURL           string                  `xml:"externalIPURL" json:"externalIPURL"`                              // HTTPS service returning our public IP as text, used with an ExternalAddress without host; "https://api.ipify.org"
+	TLSMinVersion           string                  `xml:"tlsMinVersion" json:"tlsMinVersion" default:"1.2"`                // Lowest TLS version accepted for sync connections; "1.2" or "1.3"
+	TLSCipherSuites         []string                `xml:"tlsCipherSuite" json:"tlsCipherSuites"`                           // Cipher suites allowed with TLS 1.2, in order of preference; empty for the defaults. TLS 1.3 suites are not configurable
+	TLSSessionResumption    bool                    `xml:"tlsSessionResumption" json:"tlsSessionResumption" default:"true"` // Resume TLS sessions when reconnecting to a device, skipping the full handshake
+	MessageChecksums        bool                    `xml:"messageChecksums" json:"messageChecksums" default:"true"`         // Checksum protocol messages, with devices supporting it, to detect corruption by faulty memory on either end
+	DatabaseWriteBufferMiB  int                     `xml:"databaseWriteBufferMiB" json:"databaseWriteBufferMiB"`            // Size of each of the two database write buffers; 0 for half the block cache
+	MaxPullQueueItems       int                     `xml:"maxPullQueueItems" json:"maxPullQueueItems"`                      // Needed items of a folder held in memory for pulling at once, the rest waiting in the database for the next round; 0 for unlimited
+	MaxPullBufferMiB        int                     `xml:"maxPullBufferMiB" json:"maxPullBufferMiB"`                        // Block data held in memory while being pulled, over all folders; 0 for unlimited
+}
+
+// ValidOrigin returns true if the string is a web origin, a scheme and host
+// with an optional port, as sent by browsers in the Origin header.
+func ValidOrigin(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && u.Path == "" && u.RawQuery == "" && u.Fragment == "" && u.User == nil
+}
+
+// DefaultFolderPathFor returns the default path of a folder shared with us
+// by the named device, or the empty string if there is no default. The
+// folder ID and device name come from the remote device, so anything in them
+// that would let the path escape the directory of the template is replaced.
+func (cfg OptionsConfiguration) DefaultFolderPathFor(folder, device string) string {
+	if cfg.DefaultFolderPath == "" {
+		return ""
+	}
+	folder = pathElement(folder)
+	return strings.NewReplacer(
+		"%id%", folder,
+		"%label%", folder,
+		"%device%", pathElement(device),
+	).Replace(cfg.DefaultFolderPath)
+}
+
+// pathElement returns the string made safe to use as a single path element.
+func pathElement(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, s)
+	switch s {
+	case "", ".", "..":
+		return "_"
+	}
+	return s
+}
+
+// ListenAddresses returns the addresses of the enabled listeners.
+func (cfg OptionsConfiguration) ListenAddresses() []string {
+	var addrs []string
+	for _, lc := range cfg.Listeners {
+		if lc.Enabled {
+			addrs = append(addrs, lc.Address)
+		}
+	}
+	return addrs
+}
+
+// The TLS versions and cipher suites that can be configured for sync
+// connections, by name.
+var (
+	tlsVersions = map[string]uint16{
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+	tlsCipherSuites = map[string]uint16{
+		"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+		"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	}
+	defaultTLSCipherSuites = []uint16{
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	}
+)
+
+// TLSVersion returns the lowest TLS version accepted for sync connections;
+// TLS 1.2 unless another known version is configured.
+func (cfg OptionsConfiguration) TLSVersion() uint16 {
+	if v, ok := tlsVersions[cfg.TLSMinVersion]; ok {
+		return v
+	}
+	return tls.VersionTLS12
+}
+
+// TLSCipherSuiteIDs returns the cipher suites allowed for sync connections,
+// leaving out unknown names, or the defaults if none are configured.
+func (cfg OptionsConfiguration) TLSCipherSuiteIDs() []uint16 {
+	var ids []uint16
+	for _, name := range cfg.TLSCipherSuites {
+		if id, ok := tlsCipherSuites[name]; ok {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return defaultTLSCipherSuites
+	}
+	return ids
 }
 
 func (orig OptionsConfiguration) Copy() OptionsConfiguration {
 	c := orig
-	c.ListenAddress = make([]string, len(orig.ListenAddress))
-	copy(c.ListenAddress, orig.ListenAddress)
+	c.Listeners = make([]ListenerConfiguration, len(orig.Listeners))
+	copy(c.Listeners, orig.Listeners)
 	c.GlobalAnnServers = make([]string, len(orig.GlobalAnnServers))
 	copy(c.GlobalAnnServers, orig.GlobalAnnServers)
 	return c
@@ -254,10 +602,248 @@ func (orig OptionsConfiguration) Copy() OptionsConfiguration {
 type GUIConfiguration struct {
 	Enabled  bool   `xml:"enabled,attr" json:"enabled" default:"true"`
 	Address  string `xml:"address" json:"address" default:"127.0.0.1:8384"`
-	User     string `xml:"user,omitempty" json:"user"`
-	Password string `xml:"password,omitempty" json:"password"`
+	User     string `xml:"user,omitempty" json:"-"`     // Replaced by Users in version 12
+	Password string `xml:"password,omitempty" json:"-"` // Replaced by Users in version 12
 	UseTLS   bool   `xml:"tls,attr" json:"useTLS"`
 	APIKey   string `xml:"apikey,omitempty" json:"apiKey"`
+	// The bcrypt cost used when hashing the password; 0 for the bcrypt
+	// default. Existing hashes with a lower cost are rehashed on the next
+	// successful login.
+	PasswordCost int `xml:"passwordCost,omitempty" json:"passwordCost"`
+	// SHA-256 fingerprints of client certificates that are allowed to use
+	// the GUI and REST API without further authentication, when using TLS.
+	ClientCertificates []string `xml:"clientCertificate" json:"clientCertificates"`
+	// The GUI and REST API are served under this path, to allow proxying
+	// them from a subdirectory of another web server. Empty for the root.
+	PathPrefix string `xml:"pathPrefix,omitempty" json:"pathPrefix"`
+	// Additional API keys with limited access, in addition to APIKey which
+	// grants full access.
+	ScopedAPIKeys []ScopedAPIKey `xml:"scopedAPIKey" json:"scopedAPIKeys"`
+	// The permissions, in octal, of the unix socket the GUI is served on
+	// when the address is of the form "unix:///path/to/socket". Anyone
+	// allowed to connect to the socket has access without authentication.
+	UnixSocketPermissions string `xml:"unixSocketPermissions,omitempty" json:"unixSocketPermissions"`
+	// The users allowed to log in to the GUI. Authentication is required
+	// when there is at least one.
+	Users []GUIUser `xml:"account" json:"users"`
+	// How GUI logins are verified: AuthModeStatic against the passwords of
+	// the users, or AuthModeLDAP against an LDAP server.
+	AuthMode string            `xml:"authMode,omitempty" json:"authMode"`
+	LDAP     LDAPConfiguration `xml:"ldap" json:"ldap"`
+}
+
+// The GUI authentication modes.
+const (
+	AuthModeStatic = "static" // the default
+	AuthModeLDAP   = "ldap"
+)
+
+// The ways of connecting to the LDAP server.
+const (
+	LDAPTransportTLS      = "tls" // the default
+	LDAPTransportStartTLS = "starttls"
+	LDAPTransportPlain    = "plain"
+)
+
+type LDAPConfiguration struct {
+	Address string `xml:"address,omitempty" json:"address"` // host:port
+	// The DN to bind as, with %s for the user name;
+	// "uid=%s,ou=people,dc=example,dc=com".
+	BindDN             string `xml:"bindDN,omitempty" json:"bindDN"`
+	Transport          string `xml:"transport,omitempty" json:"transport"`
+	InsecureSkipVerify bool   `xml:"insecureSkipVerify,omitempty" json:"insecureSkipVerify"`
+	// If set, only members of the group may log in: the group entry must
+	// have the user's DN as a value of GroupAttribute ("member" if empty).
+	GroupDN        string `xml:"groupDN,omitempty" json:"groupDN"`
+	GroupAttribute string `xml:"groupAttribute,omitempty" json:"groupAttribute"`
+}
+
+// AuthRequired returns true if GUI logins are required: with users or any
+// mode other than static, including unknown ones.
+func (c GUIConfiguration) AuthRequired() bool {
+	return (c.AuthMode != "" && c.AuthMode != AuthModeStatic) || len(c.Users) > 0
+}
+
+// UserRole returns the role of the named user once authenticated. Users
+// authenticated by LDAP get the role of the local user of the same name,
+// if there is one, and are admins otherwise.
+func (c GUIConfiguration) UserRole(name string) (string, bool) {
+	u, ok := c.UserByName(name)
+	if c.AuthMode == AuthModeLDAP {
+		if !ok {
+			return GUIRoleAdmin, true
+		}
+		return u.Role, true
+	}
+	return u.Role, ok
+}
+
+// The API key scopes, in order of increasing access.
+const (
+	APIScopeEvents   = "events"   // the event interface only
+	APIScopeStatus   = "status"   // everything that is read only, except the configuration
+	APIScopeReadOnly = "readonly" // everything that is read only, with the secrets left out of the configuration
+	APIScopeAdmin    = "admin"    // everything
+)
+
+// The roles of GUI users are the API scopes they are granted.
+const (
+	GUIRoleReadOnly = APIScopeReadOnly
+	GUIRoleAdmin    = APIScopeAdmin
+)
+
+type GUIUser struct {
+	Name     string `xml:"name,attr" json:"name"`
+	Password string `xml:"password" json:"password"` // bcrypt hash
+	Role     string `xml:"role,attr" json:"role"`
+	// The base32 TOTP secret, when two-factor authentication is enabled,
+	// and the bcrypt hashes of the unused recovery codes.
+	TOTPSecret    string   `xml:"totpSecret,omitempty" json:"totpSecret"`
+	RecoveryCodes []string `xml:"recoveryCode" json:"recoveryCodes"`
+}
+
+// UserByName returns the user with the given name, or false if there is
+// none.
+func (c GUIConfiguration) UserByName(name string) (GUIUser, bool) {
+	for _, u := range c.Users {
+		if u.Name == name {
+			return u, true
+		}
+	}
+	return GUIUser{}, false
+}
+
+// SetUser adds the user, or replaces the user with the same name.
+func (c *GUIConfiguration) SetUser(user GUIUser) {
+	for i := range c.Users {
+		if c.Users[i].Name == user.Name {
+			c.Users[i] = user
+			return
+		}
+	}
+	c.Users = append(c.Users, user)
+}
+
+// HashPasswords replaces the passwords of the users that are not bcrypt
+// hashes, as set by hand or posted from the GUI, by their hashes.
+func (c *GUIConfiguration) HashPasswords() error {
+	for i, u := range c.Users {
+		if _, err := bcrypt.Cost([]byte(u.Password)); u.Password == "" || err == nil {
+			continue
+		}
+		hash, err := c.HashPassword(u.Password)
+		if err != nil {
+			return err
+		}
+		c.Users[i].Password = hash
+	}
+	return nil
+}
+
+type ScopedAPIKey struct {
+	Key   string `xml:",chardata" json:"key"`
+	Scope string `xml:"scope,attr" json:"scope"`
+}
+
+// APIKeyScope returns the scope of the given API key, or false if it is not
+// a valid key.
+func (c GUIConfiguration) APIKeyScope(key string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+	if key == c.APIKey {
+		return APIScopeAdmin, true
+	}
+	for _, k := range c.ScopedAPIKeys {
+		if key == k.Key {
+			return k.Scope, true
+		}
+	}
+	return "", false
+}
+
+// URLPath returns the path that the GUI is served under, with leading and
+// trailing slashes; "/" when there is no path prefix.
+func (c GUIConfiguration) URLPath() string {
+	prefix := strings.Trim(c.PathPrefix, "/")
+	if prefix == "" {
+		return "/"
+	}
+	return "/" + prefix + "/"
+}
+
+const unixSocketScheme = "unix://"
+
+// UnixSocket returns the path of the unix socket the GUI is served on, and
+// false if it is served on a TCP address.
+func (c GUIConfiguration) UnixSocket() (string, bool) {
+	if !strings.HasPrefix(c.Address, unixSocketScheme) {
+		return "", false
+	}
+	return c.Address[len(unixSocketScheme):], true
+}
+
+// UnixSocketMode returns the file mode of the unix socket the GUI is served
+// on; only accessible by the owner unless otherwise configured.
+func (c GUIConfiguration) UnixSocketMode() os.FileMode {
+	mode, err := strconv.ParseUint(c.UnixSocketPermissions, 8, 32)
+	if err != nil {
+		return 0600
+	}
+	return os.FileMode(mode) & os.ModePerm
+}
+
+func (orig GUIConfiguration) Copy() GUIConfiguration {
+	c := orig
+	if orig.ClientCertificates != nil {
+		c.ClientCertificates = make([]string, len(orig.ClientCertificates))
+		copy(c.ClientCertificates, orig.ClientCertificates)
+	}
+	if orig.ScopedAPIKeys != nil {
+		c.ScopedAPIKeys = make([]ScopedAPIKey, len(orig.ScopedAPIKeys))
+		copy(c.ScopedAPIKeys, orig.ScopedAPIKeys)
+	}
+	if orig.Users != nil {
+		c.Users = make([]GUIUser, len(orig.Users))
+		for i, u := range orig.Users {
+			c.Users[i] = u
+			if u.RecoveryCodes != nil {
+				c.Users[i].RecoveryCodes = make([]string, len(u.RecoveryCodes))
+				copy(c.Users[i].RecoveryCodes, u.RecoveryCodes)
+			}
+		}
+	}
+	return c
+}
+
+// HashPassword returns the bcrypt hash of the given password, using the
+// configured cost.
+func (c GUIConfiguration) HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), c.passwordCost())
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// PasswordNeedsRehash returns true if the stored password hash is not a
+// bcrypt hash, or is hashed with a lower cost than configured.
+func (c GUIConfiguration) PasswordNeedsRehash(hash string) bool {
+	if hash == "" {
+		return false
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost < c.passwordCost()
+}
+
+func (c GUIConfiguration) passwordCost() int {
+	if c.PasswordCost < bcrypt.MinCost {
+		return bcrypt.DefaultCost
+	}
+	if c.PasswordCost > bcrypt.MaxCost {
+		return bcrypt.MaxCost
+	}
+	return c.PasswordCost
 }
 
 func New(myID protocol.DeviceID) Configuration {
@@ -333,6 +919,11 @@ func (cfg *Configuration) prepare(myID protocol.DeviceID) {
 			folder.ID = "default"
 		}
 
+		if name := filepath.Clean(folder.MarkerName); folder.MarkerName != "" && (filepath.IsAbs(name) || name == "." || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator))) {
+			l.Warnf("Folder %q: marker %q is not within the folder; using %s", folder.ID, folder.MarkerName, DefaultMarkerName)
+			folder.MarkerName = ""
+		}
+
 		if seen, ok := seenFolders[folder.ID]; ok {
 			l.Warnf("Multiple folders with ID %q; disabling", folder.ID)
 
@@ -351,32 +942,46 @@ func (cfg *Configuration) prepare(myID protocol.DeviceID) {
 
 	if cfg.Version < OldestHandledVersion {
 		l.Warnf("Configuration version %d is deprecated. Attempting best effort conversion, but please verify manually.", cfg.Version)
+	} else if cfg.Version > CurrentVersion {
+		l.Warnf("Configuration version %d is newer than the supported version %d. Settings this version doesn't know about will be lost; a copy of the original is kept.", cfg.Version, CurrentVersion)
 	}
 
 	// Upgrade configuration versions as appropriate
-	if cfg.Version <= 5 {
-		convertV5V6(cfg)
-	}
-	if cfg.Version == 6 {
-		convertV6V7(cfg)
-	}
-	if cfg.Version == 7 {
-		convertV7V8(cfg)
+	migrations.apply(cfg)
+
+	// Hash cleartext passwords
+	if err := cfg.GUI.HashPasswords(); err != nil {
+		l.Warnln("bcrypting password:", err)
 	}
-	if cfg.Version == 8 {
-		convertV8V9(cfg)
+	for _, u := range cfg.GUI.Users {
+		switch {
+		case u.Role != GUIRoleAdmin && u.Role != GUIRoleReadOnly:
+			l.Warnf("Unknown role %q of GUI user %q; the user has no access", u.Role, u.Name)
+		case u.Password == "" && cfg.GUI.AuthMode != AuthModeLDAP:
+			l.Warnf("GUI user %q has no password and can't log in", u.Name)
+		}
 	}
-	if cfg.Version == 9 {
-		convertV9V10(cfg)
+	switch cfg.GUI.AuthMode {
+	case "", AuthModeStatic:
+	case AuthModeLDAP:
+		if cfg.GUI.LDAP.Address == "" || !strings.Contains(cfg.GUI.LDAP.BindDN, "%s") {
+			l.Warnf("LDAP authentication needs an address and a bind DN containing %q; nobody can log in to the GUI", "%s")
+		}
+		switch cfg.GUI.LDAP.Transport {
+		case "", LDAPTransportTLS, LDAPTransportStartTLS, LDAPTransportPlain:
+		default:
+			l.Warnf("Unknown LDAP transport %q; nobody can log in to the GUI", cfg.GUI.LDAP.Transport)
+		}
+	default:
+		l.Warnf("Unknown GUI authentication mode %q; nobody can log in to the GUI", cfg.GUI.AuthMode)
 	}
 
-	// Hash old cleartext passwords
-	if len(cfg.GUI.Password) > 0 && cfg.GUI.Password[0] != '$' {
-		hash, err := bcrypt.GenerateFromPassword([]byte(cfg.GUI.Password), 0)
-		if err != nil {
-			l.Warnln("bcrypting password:", err)
-		} else {
-			cfg.GUI.Password = string(hash)
+	if _, ok := tlsVersions[cfg.Options.TLSMinVersion]; !ok && cfg.Options.TLSMinVersion != "" {
+		l.Warnf("Unknown TLS version %q; using 1.2", cfg.Options.TLSMinVersion)
+	}
+	for _, name := range cfg.Options.TLSCipherSuites {
+		if _, ok := tlsCipherSuites[name]; !ok {
+			l.Warnf("Unknown TLS cipher suite %q; ignored", name)
 		}
 	}
 
@@ -404,11 +1009,11 @@ func (cfg *Configuration) prepare(myID protocol.DeviceID) {
 		cfg.Folders[i].Devices = ensureDevicePresent(cfg.Folders[i].Devices, myID)
 		cfg.Folders[i].Devices = ensureExistingDevices(cfg.Folders[i].Devices, existingDevices)
 		cfg.Folders[i].Devices = ensureNoDuplicates(cfg.Folders[i].Devices)
-		if cfg.Folders[i].Copiers == 0 {
-			cfg.Folders[i].Copiers = 1
-		}
-		if cfg.Folders[i].Pullers == 0 {
-			cfg.Folders[i].Pullers = 16
+		if err := cfg.Folders[i].CheckTuning(); err != nil {
+			l.Warnf("Folder %q: %v; tuning automatically", cfg.Folders[i].ID, err)
+			cfg.Folders[i].Copiers = 0
+			cfg.Folders[i].Pullers = 0
+			cfg.Folders[i].Hashers = 0
 		}
 		sort.Sort(FolderDeviceConfigurationList(cfg.Folders[i].Devices))
 	}
@@ -421,22 +1026,80 @@ func (cfg *Configuration) prepare(myID protocol.DeviceID) {
 		}
 	}
 
+	// Invalid allowed networks never match, so that a typo doesn't open up
+	// the device to any address. Let the user know about them.
+	for _, n := range cfg.Devices {
+		for _, network := range n.AllowedNetworks {
+			if _, _, err := net.ParseCIDR(network); err != nil {
+				l.Warnf("Invalid allowed network %q for device %v: %v", network, n.DeviceID, err)
+			}
+		}
+	}
+	for _, network := range cfg.Options.AlwaysLocalNets {
+		if _, _, err := net.ParseCIDR(network); err != nil {
+			l.Warnf("Invalid always local network %q: %v", network, err)
+		}
+	}
+	for _, origin := range cfg.Options.CORSAllowedOrigins {
+		if !ValidOrigin(origin) {
+			l.Warnf("Invalid CORS allowed origin %q; should be like https://host:port", origin)
+		}
+	}
+
 	// Very short reconnection intervals are annoying
 	if cfg.Options.ReconnectIntervalS < 5 {
 		cfg.Options.ReconnectIntervalS = 5
 	}
 
-	cfg.Options.ListenAddress = uniqueStrings(cfg.Options.ListenAddress)
+	// Without listeners we'd only ever make outgoing connections, which is
+	// unlikely to be intended.
+	if len(cfg.Options.Listeners) == 0 {
+		cfg.Options.Listeners = []ListenerConfiguration{defaultListener}
+	}
+	for _, lc := range cfg.Options.Listeners {
+		switch lc.RateLimit {
+		case RateLimitAuto, RateLimitAlways, RateLimitNever:
+		default:
+			l.Warnf("Unknown rate limit %q for listener %s; using the default", lc.RateLimit, lc.Address)
+		}
+	}
 	cfg.Options.GlobalAnnServers = uniqueStrings(cfg.Options.GlobalAnnServers)
 
 	if cfg.GUI.APIKey == "" {
 		cfg.GUI.APIKey = randomString(32)
 	}
+
+	// Scoped API keys must be usable and have a known scope
+	var keys []ScopedAPIKey
+	for _, k := range cfg.GUI.ScopedAPIKeys {
+		switch {
+		case k.Key == "" || k.Key == cfg.GUI.APIKey:
+			l.Warnf("Ignoring API key with %q scope; it is empty or the same as the full access key", k.Scope)
+		case k.Scope != APIScopeEvents && k.Scope != APIScopeStatus && k.Scope != APIScopeAdmin:
+			l.Warnf("Ignoring API key with unknown scope %q", k.Scope)
+		default:
+			keys = append(keys, k)
+		}
+	}
+	cfg.GUI.ScopedAPIKeys = keys
 }
 
 // ChangeRequiresRestart returns true if updating the configuration requires a
 // complete restart.
 func ChangeRequiresRestart(from, to Configuration) bool {
+	// The numbers of copiers, pullers and hashers are read at each pull and
+	// scan.
+	to.Folders = append([]FolderConfiguration(nil), to.Folders...)
+	for i := range to.Folders {
+		for _, f := range from.Folders {
+			if f.ID == to.Folders[i].ID {
+				to.Folders[i].Copiers = f.Copiers
+				to.Folders[i].Pullers = f.Pullers
+				to.Folders[i].Hashers = f.Hashers
+			}
+		}
+	}
+
 	// Adding, removing or changing folders requires restart
 	if !reflect.DeepEqual(from.Folders, to.Folders) {
 		return true
@@ -456,59 +1119,64 @@ func ChangeRequiresRestart(from, to Configuration) bool {
 	// Changing usage reporting to on or off does not require a restart.
 	to.Options.URAccepted = from.Options.URAccepted
 	to.Options.URUniqueID = from.Options.URUniqueID
+	to.Options.URExtended = from.Options.URExtended
 
-	// All of the generic options require restart
-	if !reflect.DeepEqual(from.Options, to.Options) || !reflect.DeepEqual(from.GUI, to.GUI) {
-		return true
-	}
+	// The allowed origins are checked for each API request.
+	to.Options.CORSAllowedOrigins = from.Options.CORSAllowedOrigins
 
-	return false
-}
+	// The default folder path is only a suggestion to the user.
+	to.Options.DefaultFolderPath = from.Options.DefaultFolderPath
 
-func convertV9V10(cfg *Configuration) {
-	// Enable auto normalization on existing folders.
-	for i := range cfg.Folders {
-		cfg.Folders[i].AutoNormalize = true
-	}
-	cfg.Version = 10
-}
+	// The retention is read at each expiry pass.
+	to.Options.TombstoneRetentionH = from.Options.TombstoneRetentionH
 
-func convertV8V9(cfg *Configuration) {
-	// Compression is interpreted and serialized differently, but no enforced
-	// changes. Still need a new version number since the compression stuff
-	// isn't understandable by earlier versions.
-	cfg.Version = 9
-}
+	// The announcements are restarted with the new external address.
+	to.Options.ExternalAddress = from.Options.ExternalAddress
+	to.Options.ExternalIPURL = from.Options.ExternalIPURL
 
-func convertV7V8(cfg *Configuration) {
-	// Add IPv6 announce server
-	if len(cfg.Options.GlobalAnnServers) == 1 && cfg.Options.GlobalAnnServers[0] == "udp4://announce.syncthing.net:22026" {
-		cfg.Options.GlobalAnnServers = append(cfg.Options.GlobalAnnServers, "udp6://announce-v6.syncthing.net:22026")
-	}
+	// The checksum feature is announced anew to each connecting device.
+	to.Options.MessageChecksums = from.Options.MessageChecksums
 
-	cfg.Version = 8
-}
+	// The listeners and the GUI are rebound on the fly.
+	to.Options.Listeners = from.Options.Listeners
 
-func convertV6V7(cfg *Configuration) {
-	// Migrate announce server addresses to the new URL based format
-	for i := range cfg.Options.GlobalAnnServers {
-		cfg.Options.GlobalAnnServers[i] = "udp4://" + cfg.Options.GlobalAnnServers[i]
-	}
+	// Pausing on battery or metered networks is checked regularly anyway.
+	to.Options.PauseOnBattery = from.Options.PauseOnBattery
+	to.Options.PauseOnMetered = from.Options.PauseOnMetered
 
-	cfg.Version = 7
-}
+	// Notifications are checked against the current options for each event.
+	to.Options.NotifyEvents = from.Options.NotifyEvents
+	to.Options.NotifyMinTransferMiB = from.Options.NotifyMinTransferMiB
+
+	// The error mail settings are read at each check.
+	to.Options.SMTPServer = from.Options.SMTPServer
+	to.Options.SMTPUser = from.Options.SMTPUser
+	to.Options.SMTPPassword = from.Options.SMTPPassword
+	to.Options.SMTPFrom = from.Options.SMTPFrom
+	to.Options.SMTPRecipients = from.Options.SMTPRecipients
+	to.Options.SMTPSeverity = from.Options.SMTPSeverity
+	to.Options.SMTPErrorDelayM = from.Options.SMTPErrorDelayM
 
-func convertV5V6(cfg *Configuration) {
-	// Added ".stfolder" file at folder roots to identify mount issues
-	// Doesn't affect the config itself, but uses config migrations to identify
-	// the migration point.
-	for _, folder := range Wrap("", *cfg).Folders() {
-		// Best attempt, if it fails, it fails, the user will have to fix
-		// it up manually, as the repo will not get started.
-		folder.CreateMarker()
+	// The event log settings are applied to each new event.
+	to.Options.EventLogTypes = from.Options.EventLogTypes
+	to.Options.EventLogSize = from.Options.EventLogSize
+
+	// The ping settings are used for new connections.
+	to.Options.PingIdleTimeS = from.Options.PingIdleTimeS
+	to.Options.PingTimeoutS = from.Options.PingTimeoutS
+
+	// The excluded types are added to the ignore patterns at each scan.
+	to.Options.ExcludeTypes = from.Options.ExcludeTypes
+
+	// Connections are classified as LAN or WAN when established.
+	to.Options.AlwaysLocalNets = from.Options.AlwaysLocalNets
+
+	// All of the other generic options require restart
+	if !reflect.DeepEqual(from.Options, to.Options) {
+		return true
 	}
 
-	cfg.Version = 6
+	return false
 }
 
 func setDefaults(data interface{}) error {
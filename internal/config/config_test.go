@@ -10,14 +10,18 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"reflect"
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/syncthing/protocol"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var device1, device2, device3, device4 protocol.DeviceID
@@ -31,12 +35,13 @@ func init() {
 
 func TestDefaultValues(t *testing.T) {
 	expected := OptionsConfiguration{
-		ListenAddress:           []string{"0.0.0.0:22000"},
+		Listeners:               []ListenerConfiguration{{Address: "0.0.0.0:22000", Enabled: true, NATTraversal: true}},
 		GlobalAnnServers:        []string{"udp4://announce.syncthing.net:22026", "udp6://announce-v6.syncthing.net:22026"},
 		GlobalAnnEnabled:        true,
 		LocalAnnEnabled:         true,
 		LocalAnnPort:            21025,
 		LocalAnnMCAddr:          "[ff32::5222]:21026",
+		LocalAnnMCHops:          1,
 		MaxSendKbps:             0,
 		MaxRecvKbps:             0,
 		ReconnectIntervalS:      60,
@@ -53,6 +58,16 @@ func TestDefaultValues(t *testing.T) {
 		SymlinksEnabled:         true,
 		LimitBandwidthInLan:     false,
 		DatabaseBlockCacheMiB:   0,
+		CRURL:                   "https://crash.syncthing.net/newcrash",
+		NotifyMinTransferMiB:    100,
+		SMTPSeverity:            "error",
+		SMTPErrorDelayM:         60,
+		EventLogSize:            10000,
+		PingIdleTimeS:           60,
+		PingTimeoutS:            30,
+		TLSMinVersion:           "1.2",
+		TLSSessionResumption:    true,
+		MessageChecksums:        true,
 	}
 
 	cfg := New(device1)
@@ -86,8 +101,8 @@ func TestDeviceConfig(t *testing.T) {
 				Devices:         []FolderDeviceConfiguration{{DeviceID: device1}, {DeviceID: device4}},
 				ReadOnly:        true,
 				RescanIntervalS: 600,
-				Copiers:         1,
-				Pullers:         16,
+				Copiers:         0,
+				Pullers:         0,
 				Hashers:         0,
 				AutoNormalize:   true,
 			},
@@ -129,21 +144,23 @@ func TestNoListenAddress(t *testing.T) {
 		t.Error(err)
 	}
 
-	expected := []string{""}
-	actual := cfg.Options().ListenAddress
+	// An empty listen address is dropped, and the default used instead.
+	expected := []ListenerConfiguration{defaultListener}
+	actual := cfg.Options().Listeners
 	if !reflect.DeepEqual(actual, expected) {
-		t.Errorf("Unexpected ListenAddress %#v", actual)
+		t.Errorf("Unexpected Listeners %#v", actual)
 	}
 }
 
 func TestOverriddenValues(t *testing.T) {
 	expected := OptionsConfiguration{
-		ListenAddress:           []string{":23000"},
+		Listeners:               []ListenerConfiguration{{Address: ":23000", Enabled: true, NATTraversal: true}},
 		GlobalAnnServers:        []string{"udp4://syncthing.nym.se:22026"},
 		GlobalAnnEnabled:        false,
 		LocalAnnEnabled:         false,
 		LocalAnnPort:            42123,
 		LocalAnnMCAddr:          "quux:3232",
+		LocalAnnMCHops:          4,
 		MaxSendKbps:             1234,
 		MaxRecvKbps:             2341,
 		ReconnectIntervalS:      6000,
@@ -160,6 +177,39 @@ func TestOverriddenValues(t *testing.T) {
 		SymlinksEnabled:         false,
 		LimitBandwidthInLan:     true,
 		DatabaseBlockCacheMiB:   42,
+		MaxScanReadMBps:         20,
+		MaxConcurrentHashers:    2,
+		MaxCPUPercent:           50,
+		BackgroundPriority:      true,
+		CREnabled:               true,
+		CRURL:                   "https://crash.example.com/",
+		PauseOnBattery:          true,
+		PauseOnMetered:          true,
+		NotifyEvents:            []string{"DeviceRejected", "ItemFinished"},
+		NotifyMinTransferMiB:    10,
+		SMTPServer:              "smtp.example.com:587",
+		SMTPUser:                "syncthing",
+		SMTPPassword:            "secret",
+		SMTPFrom:                "syncthing@example.com",
+		SMTPRecipients:          []string{"admin@example.com", "backup@example.com"},
+		SMTPSeverity:            "warning",
+		SMTPErrorDelayM:         30,
+		EventLogTypes:           []string{"DeviceConnected", "DeviceDisconnected"},
+		EventLogSize:            500,
+		PingIdleTimeS:           300,
+		PingTimeoutS:            90,
+		ExcludeTypes:            []string{"*.iso", "node_modules/"},
+		AlwaysLocalNets:         []string{"100.64.0.0/10", "2001:db8::/32"},
+		URExtended:              true,
+		CORSAllowedOrigins:      []string{"https://dashboard.example.com", "http://localhost:3000"},
+		DefaultFolderPath:       "~/Sync/%device%/%id%",
+		TombstoneRetentionH:     720,
+		ExternalAddress:         ":22001",
+		ExternalIPURL:           "https://ip.example.com",
+		TLSMinVersion:           "1.3",
+		TLSCipherSuites:         []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384", "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"},
+		TLSSessionResumption:    false,
+		MessageChecksums:        false,
 	}
 
 	cfg, err := Load("testdata/overridenvalues.xml", device1)
@@ -404,13 +454,13 @@ func TestNewSaveLoad(t *testing.T) {
 func TestPrepare(t *testing.T) {
 	var cfg Configuration
 
-	if cfg.Folders != nil || cfg.Devices != nil || cfg.Options.ListenAddress != nil {
+	if cfg.Folders != nil || cfg.Devices != nil || cfg.Options.Listeners != nil {
 		t.Error("Expected nil")
 	}
 
 	cfg.prepare(device1)
 
-	if cfg.Folders == nil || cfg.Devices == nil || cfg.Options.ListenAddress == nil {
+	if cfg.Folders == nil || cfg.Devices == nil || cfg.Options.Listeners == nil {
 		t.Error("Unexpected nil")
 	}
 }
@@ -467,6 +517,20 @@ func TestRequiresRestart(t *testing.T) {
 		t.Error("Changing a folder requires restart")
 	}
 
+	newCfg = cfg
+	newFolders = make([]FolderConfiguration, len(cfg.Folders))
+	copy(newFolders, cfg.Folders)
+	newCfg.Folders = newFolders
+	newCfg.Folders[0].Copiers = 4
+	newCfg.Folders[0].Pullers = 64
+	newCfg.Folders[0].Hashers = 2
+	if ChangeRequiresRestart(cfg, newCfg) {
+		t.Error("Changing the folder tuning does not require restart")
+	}
+	if newCfg.Folders[0].Copiers != 4 {
+		t.Error("Checking for restart changed the new configuration")
+	}
+
 	newCfg = cfg
 	newDevices := make([]DeviceConfiguration, len(cfg.Devices))
 	copy(newDevices, cfg.Devices)
@@ -485,10 +549,113 @@ func TestRequiresRestart(t *testing.T) {
 		t.Error("Changing general options requires restart")
 	}
 
+	newCfg = cfg
+	newCfg.Options.Listeners = []ListenerConfiguration{{Address: ":23000", Enabled: true}}
+	if ChangeRequiresRestart(cfg, newCfg) {
+		t.Error("Changing listeners does not require restart")
+	}
+
 	newCfg = cfg
 	newCfg.GUI.UseTLS = !cfg.GUI.UseTLS
+	newCfg.GUI.Address = "127.0.0.1:9090"
+	if ChangeRequiresRestart(cfg, newCfg) {
+		t.Error("Changing GUI options does not require restart")
+	}
+
+	newCfg = cfg
+	newCfg.Options.PauseOnBattery = !cfg.Options.PauseOnBattery
+	if ChangeRequiresRestart(cfg, newCfg) {
+		t.Error("Changing pause on battery does not require restart")
+	}
+
+	newCfg = cfg
+	newCfg.Options.PauseOnMetered = !cfg.Options.PauseOnMetered
+	if ChangeRequiresRestart(cfg, newCfg) {
+		t.Error("Changing pause on metered network does not require restart")
+	}
+
+	newCfg = cfg
+	newCfg.Options.NotifyEvents = []string{"FolderRejected"}
+	newCfg.Options.NotifyMinTransferMiB = 1
+	if ChangeRequiresRestart(cfg, newCfg) {
+		t.Error("Changing notifications does not require restart")
+	}
+
+	newCfg = cfg
+	newCfg.Options.SMTPServer = "smtp.example.com:25"
+	newCfg.Options.SMTPRecipients = []string{"admin@example.com"}
+	newCfg.Options.SMTPErrorDelayM = 5
+	if ChangeRequiresRestart(cfg, newCfg) {
+		t.Error("Changing error mail settings does not require restart")
+	}
+
+	newCfg = cfg
+	newCfg.Options.EventLogTypes = []string{"ItemFinished"}
+	newCfg.Options.EventLogSize = 100
+	if ChangeRequiresRestart(cfg, newCfg) {
+		t.Error("Changing the event log does not require restart")
+	}
+
+	newCfg = cfg
+	newCfg.Options.PingIdleTimeS = 10
+	newCfg.Options.PingTimeoutS = 5
+	if ChangeRequiresRestart(cfg, newCfg) {
+		t.Error("Changing ping settings does not require restart")
+	}
+
+	newCfg = cfg
+	newCfg.Options.ExcludeTypes = []string{"*.tmp"}
+	if ChangeRequiresRestart(cfg, newCfg) {
+		t.Error("Changing excluded types does not require restart")
+	}
+
+	newCfg = cfg
+	newCfg.Options.AlwaysLocalNets = []string{"100.64.0.0/10"}
+	if ChangeRequiresRestart(cfg, newCfg) {
+		t.Error("Changing always local networks does not require restart")
+	}
+
+	newCfg = cfg
+	newCfg.Options.URExtended = true
+	if ChangeRequiresRestart(cfg, newCfg) {
+		t.Error("Changing extended usage reporting does not require restart")
+	}
+
+	newCfg = cfg
+	newCfg.Options.CORSAllowedOrigins = []string{"https://dashboard.example.com"}
+	if ChangeRequiresRestart(cfg, newCfg) {
+		t.Error("Changing CORS allowed origins does not require restart")
+	}
+
+	newCfg = cfg
+	newCfg.Options.DefaultFolderPath = "~/Sync/%id%"
+	if ChangeRequiresRestart(cfg, newCfg) {
+		t.Error("Changing the default folder path does not require restart")
+	}
+
+	newCfg = cfg
+	newCfg.Options.TombstoneRetentionH = 720
+	if ChangeRequiresRestart(cfg, newCfg) {
+		t.Error("Changing the tombstone retention does not require restart")
+	}
+
+	newCfg = cfg
+	newCfg.Options.ExternalAddress = "192.0.2.1:22000"
+	newCfg.Options.ExternalIPURL = ""
+	if ChangeRequiresRestart(cfg, newCfg) {
+		t.Error("Changing the external address does not require restart")
+	}
+
+	newCfg = cfg
+	newCfg.Options.MessageChecksums = !cfg.Options.MessageChecksums
+	if ChangeRequiresRestart(cfg, newCfg) {
+		t.Error("Changing message checksums does not require restart")
+	}
+
+	newCfg = cfg
+	newCfg.Options.TLSMinVersion = "1.3"
 	if !ChangeRequiresRestart(cfg, newCfg) {
-		t.Error("Changing GUI options requires restart")
+		t.Error("Changing the TLS version requires restart")
 	}
 }
 
@@ -508,8 +675,9 @@ func TestCopy(t *testing.T) {
 
 	cfg.Devices[0].Addresses[0] = "wrong"
 	cfg.Folders[0].Devices[0].DeviceID = protocol.DeviceID{0, 1, 2, 3}
-	cfg.Options.ListenAddress[0] = "wrong"
+	cfg.Options.Listeners[0].Address = "wrong"
 	cfg.GUI.APIKey = "wrong"
+	cfg.GUI.ClientCertificates[0] = "wrong"
 
 	bsChanged, err := json.MarshalIndent(cfg, "", "  ")
 	if err != nil {
@@ -578,3 +746,575 @@ func TestPullOrder(t *testing.T) {
 		}
 	}
 }
+
+func TestGUIPasswordHashing(t *testing.T) {
+	gui := GUIConfiguration{PasswordCost: bcrypt.MinCost}
+
+	hash, err := gui.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte("secret")); err != nil {
+		t.Error("hash does not match password:", err)
+	}
+	if cost, _ := bcrypt.Cost([]byte(hash)); cost != bcrypt.MinCost {
+		t.Errorf("incorrect cost %d != %d", cost, bcrypt.MinCost)
+	}
+
+	if gui.PasswordNeedsRehash(hash) {
+		t.Error("unexpected rehash at configured cost")
+	}
+	gui.PasswordCost = bcrypt.MinCost + 1
+	if !gui.PasswordNeedsRehash(hash) {
+		t.Error("expected rehash after raising cost")
+	}
+	if !gui.PasswordNeedsRehash("cleartext") {
+		t.Error("expected rehash of cleartext password")
+	}
+}
+
+func TestPrepareHashesCleartextPassword(t *testing.T) {
+	cfg := New(device1)
+	cfg.GUI.PasswordCost = bcrypt.MinCost
+	cfg.GUI.SetUser(GUIUser{Name: "user", Password: "$notahash", Role: GUIRoleAdmin})
+	cfg.prepare(device1)
+
+	u, _ := cfg.GUI.UserByName("user")
+	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte("$notahash")); err != nil {
+		t.Error("cleartext password was not hashed:", err)
+	}
+
+	// Hashes are left alone
+	hash := u.Password
+	cfg.prepare(device1)
+	if u, _ := cfg.GUI.UserByName("user"); u.Password != hash {
+		t.Error("hashed password was rehashed")
+	}
+}
+
+func TestGUIUsers(t *testing.T) {
+	var gui GUIConfiguration
+	gui.SetUser(GUIUser{Name: "admin", Password: "a", Role: GUIRoleAdmin})
+	gui.SetUser(GUIUser{Name: "viewer", Password: "v", Role: GUIRoleReadOnly})
+	gui.SetUser(GUIUser{Name: "admin", Password: "b", Role: GUIRoleAdmin})
+
+	if len(gui.Users) != 2 {
+		t.Fatalf("unexpected users %v", gui.Users)
+	}
+	if u, ok := gui.UserByName("admin"); !ok || u.Password != "b" {
+		t.Errorf("user not replaced: %v", u)
+	}
+	if u, ok := gui.UserByName("viewer"); !ok || u.Role != GUIRoleReadOnly {
+		t.Errorf("unexpected user %v", u)
+	}
+	if _, ok := gui.UserByName("other"); ok {
+		t.Error("unexpected user found")
+	}
+}
+
+func TestGUIAuthModes(t *testing.T) {
+	gui := GUIConfiguration{}
+	if gui.AuthRequired() {
+		t.Error("auth required without users")
+	}
+	gui.SetUser(GUIUser{Name: "viewer", Password: "hash", Role: GUIRoleReadOnly})
+	if !gui.AuthRequired() {
+		t.Error("auth not required with users")
+	}
+	if _, ok := gui.UserRole("other"); ok {
+		t.Error("unknown user has a role")
+	}
+
+	gui = GUIConfiguration{AuthMode: "unknown"}
+	if !gui.AuthRequired() {
+		t.Error("auth not required in unknown mode")
+	}
+
+	gui = GUIConfiguration{AuthMode: AuthModeLDAP}
+	gui.SetUser(GUIUser{Name: "viewer", Role: GUIRoleReadOnly})
+	if !gui.AuthRequired() {
+		t.Error("auth not required with LDAP")
+	}
+	if role, ok := gui.UserRole("viewer"); !ok || role != GUIRoleReadOnly {
+		t.Errorf("unexpected role %q for local user", role)
+	}
+	if role, ok := gui.UserRole("other"); !ok || role != GUIRoleAdmin {
+		t.Errorf("unexpected role %q for LDAP user", role)
+	}
+}
+
+func TestGUIURLPath(t *testing.T) {
+	cases := []struct {
+		prefix string
+		path   string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"syncthing", "/syncthing/"},
+		{"/syncthing/", "/syncthing/"},
+		{"/a/b", "/a/b/"},
+	}
+
+	for _, tc := range cases {
+		gui := GUIConfiguration{PathPrefix: tc.prefix}
+		if p := gui.URLPath(); p != tc.path {
+			t.Errorf("%q: incorrect URL path %q != %q", tc.prefix, p, tc.path)
+		}
+	}
+}
+
+func TestScopedAPIKeys(t *testing.T) {
+	cfg := New(device1)
+	cfg.GUI.APIKey = "full"
+	cfg.GUI.ScopedAPIKeys = []ScopedAPIKey{
+		{Key: "ev", Scope: APIScopeEvents},
+		{Key: "st", Scope: APIScopeStatus},
+		{Key: "", Scope: APIScopeStatus},
+		{Key: "full", Scope: APIScopeStatus},
+		{Key: "bad", Scope: "superuser"},
+	}
+	cfg.prepare(device1)
+
+	if len(cfg.GUI.ScopedAPIKeys) != 2 {
+		t.Errorf("invalid keys were not removed: %v", cfg.GUI.ScopedAPIKeys)
+	}
+
+	cases := []struct {
+		key   string
+		scope string
+		ok    bool
+	}{
+		{"full", APIScopeAdmin, true},
+		{"ev", APIScopeEvents, true},
+		{"st", APIScopeStatus, true},
+		{"bad", "", false},
+		{"", "", false},
+	}
+	for _, tc := range cases {
+		scope, ok := cfg.GUI.APIKeyScope(tc.key)
+		if scope != tc.scope || ok != tc.ok {
+			t.Errorf("%q: unexpected scope %q, %v", tc.key, scope, ok)
+		}
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	if err := migrations.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	bad := migrationSet{{6, convertV5V6}, {8, convertV7V8}}
+	if err := bad.validate(); err == nil {
+		t.Error("gap in migrations not detected")
+	}
+
+	cfg := Configuration{Version: 7}
+	cfg.Options.GlobalAnnServers = []string{"udp4://announce.syncthing.net:22026"}
+	migrations.apply(&cfg)
+	if cfg.Version != CurrentVersion {
+		t.Errorf("incorrect version %d after migration", cfg.Version)
+	}
+	if len(cfg.Options.GlobalAnnServers) != 2 {
+		t.Error("v7 to v8 migration not applied")
+	}
+
+	cfg = Configuration{Version: 10}
+	cfg.Options.ListenAddress = []string{":22001", "", "0.0.0.0:22000", ":22001"}
+	migrations.apply(&cfg)
+	expected := []ListenerConfiguration{
+		{Address: "0.0.0.0:22000", Enabled: true, NATTraversal: true},
+		{Address: ":22001", Enabled: true},
+	}
+	if !reflect.DeepEqual(cfg.Options.Listeners, expected) {
+		t.Errorf("v10 to v11 migration resulted in %#v", cfg.Options.Listeners)
+	}
+	if cfg.Options.ListenAddress != nil {
+		t.Error("listen addresses remain after v10 to v11 migration")
+	}
+
+	cfg = Configuration{Version: 11}
+	cfg.GUI.User = "user"
+	cfg.GUI.Password = "hash"
+	migrations.apply(&cfg)
+	if exp := []GUIUser{{Name: "user", Password: "hash", Role: GUIRoleAdmin}}; !reflect.DeepEqual(cfg.GUI.Users, exp) {
+		t.Errorf("v11 to v12 migration resulted in %#v", cfg.GUI.Users)
+	}
+	if cfg.GUI.User != "" || cfg.GUI.Password != "" {
+		t.Error("user remains after v11 to v12 migration")
+	}
+
+	cfg = Configuration{Version: 11}
+	cfg.GUI.User = "user"
+	migrations.apply(&cfg)
+	if len(cfg.GUI.Users) != 0 {
+		t.Error("user without password migrated")
+	}
+
+	// Newer versions are left alone
+	cfg = Configuration{Version: CurrentVersion + 1}
+	migrations.apply(&cfg)
+	if cfg.Version != CurrentVersion+1 {
+		t.Errorf("newer version changed to %d", cfg.Version)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.xml")
+	if err := ioutil.WriteFile(path, []byte("original"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := Archive(path, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if archive != path+".v9" {
+		t.Errorf("unexpected archive path %q", archive)
+	}
+
+	// A later archiving of the same version keeps the first copy.
+	ioutil.WriteFile(path, []byte("changed"), 0600)
+	if _, err := Archive(path, 9); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := ioutil.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "original" {
+		t.Errorf("archived copy changed to %q", bs)
+	}
+}
+
+func TestDeviceAllowsIP(t *testing.T) {
+	cases := []struct {
+		networks []string
+		ip       string
+		allowed  bool
+	}{
+		{nil, "192.0.2.1", true},
+		{[]string{"192.0.2.0/24"}, "192.0.2.1", true},
+		{[]string{"192.0.2.0/24"}, "198.51.100.1", false},
+		{[]string{"10.0.0.0/8", "2001:db8::/32"}, "2001:db8::1", true},
+		{[]string{"10.0.0.0/8", "2001:db8::/32"}, "2001:db9::1", false},
+		// An invalid network matches nothing, rather than everything.
+		{[]string{"192.0.2.0/33"}, "192.0.2.1", false},
+	}
+
+	for _, tc := range cases {
+		dev := DeviceConfiguration{AllowedNetworks: tc.networks}
+		if res := dev.AllowsIP(net.ParseIP(tc.ip)); res != tc.allowed {
+			t.Errorf("%v allows %s: %v != expected %v", tc.networks, tc.ip, res, tc.allowed)
+		}
+	}
+}
+
+func TestGUIUnixSocket(t *testing.T) {
+	cfg := GUIConfiguration{Address: "127.0.0.1:8384"}
+	if _, ok := cfg.UnixSocket(); ok {
+		t.Error("TCP address taken as unix socket")
+	}
+
+	cfg.Address = "unix:///var/run/syncthing.sock"
+	if path, ok := cfg.UnixSocket(); !ok || path != "/var/run/syncthing.sock" {
+		t.Errorf("unexpected unix socket %q, %v", path, ok)
+	}
+
+	cases := []struct {
+		perms string
+		mode  os.FileMode
+	}{
+		{"", 0600},
+		{"0660", 0660},
+		{"755", 0755},
+		{"04777", 0777},
+		{"rw-rw----", 0600},
+	}
+	for _, tc := range cases {
+		cfg.UnixSocketPermissions = tc.perms
+		if mode := cfg.UnixSocketMode(); mode != tc.mode {
+			t.Errorf("%q: mode %v != expected %v", tc.perms, mode, tc.mode)
+		}
+	}
+}
+
+func TestFolderMarker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "marker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := FolderConfiguration{RawPath: dir}
+	if f.MarkerPath() != filepath.Join(dir, DefaultMarkerName) {
+		t.Errorf("unexpected default marker path %q", f.MarkerPath())
+	}
+
+	f.MarkerName = "mounted"
+	f.MarkerContent = "disk one"
+	if f.HasMarker() {
+		t.Fatal("unexpected marker before creation")
+	}
+	if err := f.CreateMarker(); err != nil {
+		t.Fatal(err)
+	}
+	if !f.HasMarker() {
+		t.Fatal("missing marker after creation")
+	}
+
+	f.MarkerContent = "disk two"
+	if f.HasMarker() {
+		t.Error("marker with other content accepted")
+	}
+	if err := f.CreateMarker(); err == nil {
+		t.Error("marker with other content overwritten")
+	}
+
+	f.MarkerContent = ""
+	if !f.HasMarker() {
+		t.Error("marker with any content not accepted")
+	}
+}
+
+func TestFolderMarkerOutsideFolder(t *testing.T) {
+	cfg := New(device1)
+	cfg.Folders = []FolderConfiguration{
+		{ID: "a", RawPath: "testdata", MarkerName: "../marker"},
+		{ID: "b", RawPath: "testdata", MarkerName: "sub/marker"},
+	}
+	cfg.prepare(device1)
+
+	if name := cfg.Folders[0].MarkerName; name != "" {
+		t.Errorf("marker outside folder kept as %q", name)
+	}
+	if name := cfg.Folders[1].MarkerName; name != "sub/marker" {
+		t.Errorf("marker within folder changed to %q", name)
+	}
+}
+
+func TestPingTimes(t *testing.T) {
+	opts := OptionsConfiguration{PingIdleTimeS: 300, PingTimeoutS: 90}
+
+	cases := []struct {
+		dev     DeviceConfiguration
+		opts    OptionsConfiguration
+		idle    time.Duration
+		timeout time.Duration
+	}{
+		{DeviceConfiguration{}, OptionsConfiguration{}, protocol.DefaultPingIdleTime, protocol.DefaultPingTimeout},
+		{DeviceConfiguration{}, opts, 300 * time.Second, 90 * time.Second},
+		{DeviceConfiguration{PingIdleTimeS: 20}, opts, 20 * time.Second, 90 * time.Second},
+		{DeviceConfiguration{PingIdleTimeS: 20, PingTimeoutS: 10}, opts, 20 * time.Second, 10 * time.Second},
+	}
+
+	for _, tc := range cases {
+		idle, timeout := tc.dev.PingTimes(tc.opts)
+		if idle != tc.idle || timeout != tc.timeout {
+			t.Errorf("%+v: got %v, %v, expected %v, %v", tc.dev, idle, timeout, tc.idle, tc.timeout)
+		}
+	}
+}
+
+func TestCheckTuning(t *testing.T) {
+	cases := []struct {
+		copiers, pullers, hashers int
+		ok                        bool
+	}{
+		{0, 0, 0, true},
+		{2, 32, 4, true},
+		{MaxCopiers, MaxPullers, MaxHashers, true},
+		{-1, 0, 0, false},
+		{0, MaxPullers + 1, 0, false},
+		{0, 0, -2, false},
+	}
+	for _, tc := range cases {
+		f := FolderConfiguration{Copiers: tc.copiers, Pullers: tc.pullers, Hashers: tc.hashers}
+		if err := f.CheckTuning(); (err == nil) != tc.ok {
+			t.Errorf("%d/%d/%d: unexpected error %v", tc.copiers, tc.pullers, tc.hashers, err)
+		}
+	}
+}
+
+func TestValidOrigin(t *testing.T) {
+	cases := []struct {
+		origin string
+		ok     bool
+	}{
+		{"https://dashboard.example.com", true},
+		{"http://localhost:3000", true},
+		{"http://[::1]:8080", true},
+		{"dashboard.example.com", false},
+		{"https://dashboard.example.com/", false},
+		{"https://dashboard.example.com/path", false},
+		{"ftp://example.com", false},
+		{"*", false},
+		{"", false},
+	}
+	for _, tc := range cases {
+		if ok := ValidOrigin(tc.origin); ok != tc.ok {
+			t.Errorf("%q: unexpected %v", tc.origin, ok)
+		}
+	}
+}
+
+func TestDefaultFolderPathFor(t *testing.T) {
+	cases := []struct {
+		template, folder, device, path string
+	}{
+		{"", "photos", "laptop", ""},
+		{"~/Sync/%id%", "photos", "laptop", "~/Sync/photos"},
+		{"~/Sync/%device%/%label%", "photos", "laptop", "~/Sync/laptop/photos"},
+		{"/data/%id%-%id%", "a", "b", "/data/a-a"},
+		{"~/Sync/%id%", "../../etc", "laptop", "~/Sync/.._.._etc"},
+		{"~/Sync/%device%/%id%", "..", "a/b", "~/Sync/a_b/_"},
+		{"C:\\Sync\\%id%", `x\y:z`, "laptop", `C:\Sync\x_y_z`},
+	}
+	for _, tc := range cases {
+		opts := OptionsConfiguration{DefaultFolderPath: tc.template}
+		if path := opts.DefaultFolderPathFor(tc.folder, tc.device); path != tc.path {
+			t.Errorf("%q, %q, %q: %q != expected %q", tc.template, tc.folder, tc.device, path, tc.path)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() Configuration {
+		cfg := New(device1)
+		cfg.GUI.Users = []GUIUser{{Name: "alice", Role: GUIRoleAdmin}}
+		cfg.Devices = []DeviceConfiguration{
+			{DeviceID: device1, Addresses: []string{"dynamic"}},
+			{DeviceID: device2, Addresses: []string{"192.0.2.1", "[2001:db8::1]:22000"}, AllowedNetworks: []string{"192.0.2.0/24"}},
+		}
+		cfg.Folders = []FolderConfiguration{
+			{ID: "photos", RawPath: "testdata/photos"},
+			{ID: "music", RawPath: "testdata/music"},
+		}
+		return cfg
+	}
+
+	if err := valid().Validate(); err != nil {
+		t.Fatal("valid configuration:", err)
+	}
+
+	cases := []struct {
+		change func(*Configuration)
+		field  string
+	}{
+		{func(c *Configuration) { c.Folders[1].ID = "photos" }, "folders[photos].id"},
+		{func(c *Configuration) { c.Folders[1].ID = "" }, "folders[1].id"},
+		{func(c *Configuration) { c.Folders[1].RawPath = "" }, "folders[music].path"},
+		{func(c *Configuration) { c.Folders[1].RawPath = "testdata/photos/" }, "folders[music].path"},
+		{func(c *Configuration) { c.Folders[1].RawPath = "testdata/example.xml" }, "folders[music].path"},
+		{func(c *Configuration) { c.Folders[1].MarkerName = "../.stfolder" }, "folders[music].markerName"},
+		{func(c *Configuration) { c.Folders[1].Pullers = MaxPullers + 1 }, "folders[music].pullers"},
+		{func(c *Configuration) { c.Folders[1].RescanIntervalS = -1 }, "folders[music].rescanIntervalS"},
+		{func(c *Configuration) { c.Devices[1].DeviceID = device1 }, "devices[" + device1.String() + "].deviceID"},
+		{func(c *Configuration) { c.Devices[1].Addresses = []string{"[2001:db8::1"} }, "devices[" + device2.String() + "].addresses"},
+		{func(c *Configuration) { c.Devices[1].AllowedNetworks = []string{"192.0.2.1"} }, "devices[" + device2.String() + "].allowedNetworks"},
+		{func(c *Configuration) { c.Options.Listeners[0].Address = "0.0.0.0" }, "options.listeners"},
+		{func(c *Configuration) { c.Options.MaxRecvKbps = -1 }, "options.maxRecvKbps"},
+		{func(c *Configuration) { c.Options.CORSAllowedOrigins = []string{"example.com"} }, "options.corsAllowedOrigins"},
+		{func(c *Configuration) { c.Options.ExternalAddress = "192.0.2.1" }, "options.externalAddress"},
+		{func(c *Configuration) { c.Options.ExternalIPURL = "http://ip.example.com" }, "options.externalIPURL"},
+		{func(c *Configuration) { c.Options.TLSMinVersion = "1.1" }, "options.tlsMinVersion"},
+		{func(c *Configuration) { c.Options.TLSCipherSuites = []string{"TLS_RSA_WITH_RC4_128_SHA"} }, "options.tlsCipherSuites"},
+		{func(c *Configuration) { c.GUI.Address = "localhost" }, "gui.address"},
+		{func(c *Configuration) {
+			c.GUI.Users = append(c.GUI.Users, GUIUser{Name: "alice", Role: GUIRoleReadOnly})
+		}, "gui.users[alice].name"},
+		{func(c *Configuration) { c.GUI.Users[0].Role = "root" }, "gui.users[alice].role"},
+		{func(c *Configuration) { c.GUI.AuthMode = AuthModeLDAP; c.GUI.LDAP.Address = "ldap:636" }, "gui.ldap.bindDN"},
+		{func(c *Configuration) { c.GUI.AuthMode = "kerberos" }, "gui.authMode"},
+	}
+
+	for i, tc := range cases {
+		cfg := valid()
+		tc.change(&cfg)
+		err := cfg.Validate()
+		errs, ok := err.(ValidationErrors)
+		if !ok || len(errs) != 1 || errs[0].Field != tc.field {
+			t.Errorf("%d: unexpected error %v, expected one for %s", i, err, tc.field)
+		}
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	o := make(Overrides)
+	err := o.SetEnv([]string{"HOME=/root", "STOPTION_MAXRECVKBPS=100", "STOPTION_GLOBALANNOUNCEENABLED=false", "STOPTION_GUIADDRESS=0.0.0.0:8385"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"alwaysLocalNets=10.0.0.0/8, 192.168.0.0/16", "listeners=0.0.0.0:22001", "guiUseTLS=true"} {
+		if err := o.Set(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, s := range []string{"maxRecvKbps", "noSuchOption=1", "maxSendKbps=fast", "listenAddress=:22000", "urAccepted=", "address=:8384", "guiUsers=x", "guiUser=x"} {
+		if err := o.Set(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.xml")
+
+	w := Wrap(path, New(device1))
+	w.SetOverrides(o)
+
+	opts := w.Options()
+	if opts.MaxRecvKbps != 100 || opts.GlobalAnnEnabled {
+		t.Errorf("options not overridden: %+v", opts)
+	}
+	if !reflect.DeepEqual(opts.AlwaysLocalNets, []string{"10.0.0.0/8", "192.168.0.0/16"}) {
+		t.Errorf("unexpected list %q", opts.AlwaysLocalNets)
+	}
+	if addrs := opts.ListenAddresses(); !reflect.DeepEqual(addrs, []string{"0.0.0.0:22001"}) {
+		t.Errorf("unexpected listeners %q", addrs)
+	}
+	if gui := w.GUI(); gui.Address != "0.0.0.0:8385" || !gui.UseTLS {
+		t.Errorf("GUI not overridden: %+v", gui)
+	}
+
+	// Changes to overridden options have no effect, while others are
+	// applied and saved; the overridden values are not.
+	opts.MaxRecvKbps = 200
+	opts.MaxSendKbps = 300
+	w.SetOptions(opts)
+	if opts := w.Options(); opts.MaxRecvKbps != 100 || opts.MaxSendKbps != 300 {
+		t.Errorf("unexpected options after change: %+v", opts)
+	}
+	gui := w.GUI()
+	gui.Address = "127.0.0.1:9000"
+	gui.APIKey = "abc123"
+	w.SetGUI(gui)
+	if gui := w.GUI(); gui.Address != "0.0.0.0:8385" || gui.APIKey != "abc123" {
+		t.Errorf("unexpected GUI after change: %+v", gui)
+	}
+	if err := w.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := Load(path, device1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts := saved.Options(); opts.MaxRecvKbps != 0 || !opts.GlobalAnnEnabled || opts.MaxSendKbps != 300 || len(opts.AlwaysLocalNets) != 0 {
+		t.Errorf("unexpected saved options: %+v", opts)
+	}
+	if addrs := saved.Options().ListenAddresses(); !reflect.DeepEqual(addrs, []string{"0.0.0.0:22000"}) {
+		t.Errorf("unexpected saved listeners %q", addrs)
+	}
+	if gui := saved.GUI(); gui.Address != "127.0.0.1:8384" || gui.UseTLS || gui.APIKey != "abc123" {
+		t.Errorf("unexpected saved GUI: %+v", gui)
+	}
+}
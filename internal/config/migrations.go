@@ -0,0 +1,151 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/syncthing/syncthing/internal/osutil"
+)
+
+// A migration converts a configuration from the previous version to
+// targetVersion. The version number itself is updated by apply, after the
+// conversion.
+type migration struct {
+	targetVersion int
+	convert       func(cfg *Configuration)
+}
+
+type migrationSet []migration
+
+// The migrations, in order. When changing the configuration format, bump
+// CurrentVersion, add a conversion function and register it here.
+var migrations = migrationSet{
+	{6, convertV5V6},
+	{7, convertV6V7},
+	{8, convertV7V8},
+	{9, convertV8V9},
+	{10, convertV9V10},
+	{11, convertV10V11},
+	{12, convertV11V12},
+}
+
+func init() {
+	if err := migrations.validate(); err != nil {
+		panic(err)
+	}
+}
+
+// validate checks that the migrations are in order and lead up to the
+// current version.
+func (ms migrationSet) validate() error {
+	for i, m := range ms {
+		if i > 0 && m.targetVersion != ms[i-1].targetVersion+1 {
+			return fmt.Errorf("config migration to version %d follows version %d", m.targetVersion, ms[i-1].targetVersion)
+		}
+	}
+	if last := ms[len(ms)-1].targetVersion; last != CurrentVersion {
+		return fmt.Errorf("config migrations end at version %d, not the current version %d", last, CurrentVersion)
+	}
+	return nil
+}
+
+// apply runs the migrations needed to bring the configuration up to the
+// current version. Configurations of a newer version are left alone.
+func (ms migrationSet) apply(cfg *Configuration) {
+	for _, m := range ms {
+		if cfg.Version < m.targetVersion {
+			m.convert(cfg)
+			cfg.Version = m.targetVersion
+		}
+	}
+}
+
+// Archive keeps a copy of the configuration file as it was before being
+// migrated from the given version, so that it can be restored when
+// downgrading. An existing archived copy for the same version is left as
+// is. The path of the archived copy is returned.
+func Archive(path string, version int) (string, error) {
+	archive := fmt.Sprintf("%s.v%d", path, version)
+	if _, err := os.Stat(archive); err == nil {
+		return archive, nil
+	}
+
+	if err := osutil.Copy(path, archive); err != nil {
+		return "", err
+	}
+	return archive, nil
+}
+
+func convertV11V12(cfg *Configuration) {
+	// The single GUI user is replaced by a list of users with roles. It
+	// was only effective with both a user name and a password.
+	if cfg.GUI.User != "" && cfg.GUI.Password != "" {
+		cfg.GUI.Users = append(cfg.GUI.Users, GUIUser{
+			Name:     cfg.GUI.User,
+			Password: cfg.GUI.Password,
+			Role:     GUIRoleAdmin,
+		})
+	}
+	cfg.GUI.User = ""
+	cfg.GUI.Password = ""
+}
+
+func convertV10V11(cfg *Configuration) {
+	// Listen addresses are replaced by listeners with options of their own.
+	// UPnP used to map the port of the first address only.
+	for _, addr := range uniqueStrings(cfg.Options.ListenAddress) {
+		if addr == "" {
+			continue
+		}
+		cfg.Options.Listeners = append(cfg.Options.Listeners, ListenerConfiguration{
+			Address:      addr,
+			Enabled:      true,
+			NATTraversal: len(cfg.Options.Listeners) == 0,
+		})
+	}
+	cfg.Options.ListenAddress = nil
+}
+
+func convertV9V10(cfg *Configuration) {
+	// Enable auto normalization on existing folders.
+	for i := range cfg.Folders {
+		cfg.Folders[i].AutoNormalize = true
+	}
+}
+
+func convertV8V9(cfg *Configuration) {
+	// Compression is interpreted and serialized differently, but no enforced
+	// changes. Still need a new version number since the compression stuff
+	// isn't understandable by earlier versions.
+}
+
+func convertV7V8(cfg *Configuration) {
+	// Add IPv6 announce server
+	if len(cfg.Options.GlobalAnnServers) == 1 && cfg.Options.GlobalAnnServers[0] == "udp4://announce.syncthing.net:22026" {
+		cfg.Options.GlobalAnnServers = append(cfg.Options.GlobalAnnServers, "udp6://announce-v6.syncthing.net:22026")
+	}
+}
+
+func convertV6V7(cfg *Configuration) {
+	// Migrate announce server addresses to the new URL based format
+	for i := range cfg.Options.GlobalAnnServers {
+		cfg.Options.GlobalAnnServers[i] = "udp4://" + cfg.Options.GlobalAnnServers[i]
+	}
+}
+
+func convertV5V6(cfg *Configuration) {
+	// Added ".stfolder" file at folder roots to identify mount issues
+	// Doesn't affect the config itself, but uses config migrations to identify
+	// the migration point.
+	for _, folder := range Wrap("", *cfg).Folders() {
+		// Best attempt, if it fails, it fails, the user will have to fix
+		// it up manually, as the repo will not get started.
+		folder.CreateMarker()
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OverrideEnvPrefix is the prefix of the environment variables overriding
+// options; STOPTION_MAXRECVKBPS=100 overrides maxRecvKbps.
+const OverrideEnvPrefix = "STOPTION_"
+
+// Overrides are option values given in the environment or on the command
+// line, by the name of the option as in the JSON configuration; options in
+// the GUI section are named with a gui prefix, as in guiAddress. They take
+// precedence over the configured values, but are never saved, so that the
+// configuration file may be read only.
+type Overrides map[string]string
+
+// SetEnv adds the overrides given by the STOPTION_ variables in environ, as
+// returned by os.Environ.
+func (o Overrides) SetEnv(environ []string) error {
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, OverrideEnvPrefix) {
+			continue
+		}
+		if err := o.Set(kv[len(OverrideEnvPrefix):]); err != nil {
+			return fmt.Errorf("%s%v", OverrideEnvPrefix, err)
+		}
+	}
+	return nil
+}
+
+// Set adds an override given as "name=value", the name matched case
+// insensitively. This makes Overrides usable as a flag.Value.
+func (o Overrides) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("%s: not on the form name=value", s)
+	}
+	for _, section := range overridableSections {
+		field, ok := overridableOption(section, parts[0])
+		if !ok {
+			continue
+		}
+		v := reflect.New(section).Elem()
+		if err := setOption(v.FieldByIndex(field.Index), parts[1]); err != nil {
+			return fmt.Errorf("%s: %v", parts[0], err)
+		}
+		o[optionName(section, field)] = parts[1]
+		return nil
+	}
+	return fmt.Errorf("%s: no such option, or it can't be overridden", parts[0])
+}
+
+func (o Overrides) String() string {
+	var kvs []string
+	for name, value := range o {
+		kvs = append(kvs, name+"="+value)
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ", ")
+}
+
+// apply sets the overridden options of section, a *OptionsConfiguration or
+// a *GUIConfiguration.
+func (o Overrides) apply(section interface{}) {
+	v := reflect.ValueOf(section).Elem()
+	for name, value := range o {
+		if field, ok := overridableOption(v.Type(), name); ok {
+			// The value was checked by Set
+			setOption(v.FieldByIndex(field.Index), value)
+		}
+	}
+}
+
+// restore sets the overridden options of section back to their values in
+// from, a section of the same type.
+func (o Overrides) restore(section, from interface{}) {
+	v := reflect.ValueOf(section).Elem()
+	fv := reflect.ValueOf(from)
+	for name := range o {
+		if field, ok := overridableOption(v.Type(), name); ok {
+			v.FieldByIndex(field.Index).Set(fv.FieldByIndex(field.Index))
+		}
+	}
+}
+
+var (
+	optionsType = reflect.TypeOf(OptionsConfiguration{})
+	guiType     = reflect.TypeOf(GUIConfiguration{})
+
+	// The configuration sections that have options that can be overridden.
+	overridableSections = []reflect.Type{optionsType, guiType}
+)
+
+// optionName returns the name of the option of the field in section; its
+// name in the JSON configuration, prefixed by gui in the GUI section.
+func optionName(section reflect.Type, field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if section == guiType && name != "" && name != "-" {
+		name = "gui" + strings.ToUpper(name[:1]) + name[1:]
+	}
+	return name
+}
+
+// overridableOption returns the field of the named option in section, if it
+// is of a type that can be given as a string.
+func overridableOption(section reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < section.NumField(); i++ {
+		field := section.Field(i)
+		if jn := optionName(section, field); jn == "" || jn == "-" || !strings.EqualFold(jn, name) {
+			continue
+		}
+		switch field.Type.Kind() {
+		case reflect.String, reflect.Int, reflect.Bool:
+			return field, true
+		case reflect.Slice:
+			return field, field.Type.Elem().Kind() == reflect.String || field.Type == listenersType
+		}
+		return field, false
+	}
+	return reflect.StructField{}, false
+}
+
+var listenersType = reflect.TypeOf([]ListenerConfiguration{})
+
+// setOption sets an option from its string form; lists are comma separated.
+// Listeners are given as their addresses, and are set up like the default
+// listener.
+func setOption(v reflect.Value, s string) error {
+	if v.Type() == listenersType {
+		lcs := []ListenerConfiguration{}
+		for _, addr := range strings.Split(s, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				lc := defaultListener
+				lc.Address = addr
+				lcs = append(lcs, lc)
+			}
+		}
+		v.Set(reflect.ValueOf(lcs))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int:
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(i))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		ss := []string{}
+		for _, e := range strings.Split(s, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				ss = append(ss, e)
+			}
+		}
+		v.Set(reflect.ValueOf(ss))
+	}
+	return nil
+}
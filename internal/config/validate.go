@@ -0,0 +1,234 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/syncthing/protocol"
+)
+
+// The longest folder ID accepted, in bytes.
+const MaxFolderIDLength = 64
+
+// A FieldError is a problem with a single setting. The field is given like
+// "folders[photos].path", "devices[<device ID>].addresses" or
+// "options.maxRecvKbps".
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"error"`
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationErrors are the problems found in a configuration by Validate.
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e *ValidationErrors) add(field, format string, args ...interface{}) {
+	*e = append(*e, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (e *ValidationErrors) checkRange(field string, value, min, max int) {
+	if value < min || value > max {
+		e.add(field, "must be between %d and %d", min, max)
+	}
+}
+
+func (e *ValidationErrors) checkNotNegative(field string, value int) {
+	if value < 0 {
+		e.add(field, "must not be negative")
+	}
+}
+
+// Validate checks a configuration about to be put to use, and returns
+// ValidationErrors describing the settings that are invalid or conflict
+// with each other, or nil. Loading a configuration from disk instead
+// corrects or warns about such settings in prepare, as there is nobody to
+// return an error to.
+func (cfg Configuration) Validate() error {
+	var errs ValidationErrors
+
+	folderPaths := make(map[string]string)
+	seenFolders := make(map[string]bool)
+	for i, f := range cfg.Folders {
+		prefix := fmt.Sprintf("folders[%s]", f.ID)
+		switch {
+		case f.ID == "":
+			prefix = fmt.Sprintf("folders[%d]", i)
+			errs.add(prefix+".id", "must not be empty")
+		case len(f.ID) > MaxFolderIDLength:
+			errs.add(prefix+".id", "must be at most %d bytes long", MaxFolderIDLength)
+		case seenFolders[f.ID]:
+			errs.add(prefix+".id", "is used by more than one folder")
+		}
+		seenFolders[f.ID] = true
+
+		if f.RawPath == "" {
+			errs.add(prefix+".path", "must not be empty")
+		} else {
+			path := filepath.Clean(f.Path())
+			if fi, err := os.Stat(path); err == nil && !fi.IsDir() {
+				errs.add(prefix+".path", "%s is not a directory", f.RawPath)
+			}
+			if other, ok := folderPaths[path]; ok {
+				errs.add(prefix+".path", "is also the path of folder %q", other)
+			} else {
+				folderPaths[path] = f.ID
+			}
+		}
+
+		if name := filepath.Clean(f.MarkerName); f.MarkerName != "" && (filepath.IsAbs(name) || name == "." || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator))) {
+			errs.add(prefix+".markerName", "must be within the folder")
+		}
+
+		errs.checkRange(prefix+".copiers", f.Copiers, 0, MaxCopiers)
+		errs.checkRange(prefix+".pullers", f.Pullers, 0, MaxPullers)
+		errs.checkRange(prefix+".hashers", f.Hashers, 0, MaxHashers)
+		errs.checkNotNegative(prefix+".rescanIntervalS", f.RescanIntervalS)
+		errs.checkNotNegative(prefix+".maxConflicts", f.MaxConflicts)
+		errs.checkNotNegative(prefix+".conflictMaxAgeH", f.ConflictMaxAgeH)
+		errs.checkNotNegative(prefix+".modTimeWindowS", f.ModTimeWindowS)
+		errs.checkNotNegative(prefix+".maxFileSizeMiB", f.MaxFileSizeMiB)
+		errs.checkNotNegative(prefix+".deleteDelayH", f.DeleteDelayH)
+		errs.checkRange(prefix+".massChangePct", f.MassChangePct, 0, 100)
+		errs.checkNotNegative(prefix+".snapshotItems", f.SnapshotItems)
+	}
+
+	seenDevices := make(map[protocol.DeviceID]bool)
+	for _, d := range cfg.Devices {
+		prefix := fmt.Sprintf("devices[%s]", d.DeviceID)
+		if seenDevices[d.DeviceID] {
+			errs.add(prefix+".deviceID", "is used by more than one device")
+		}
+		seenDevices[d.DeviceID] = true
+
+		for _, addr := range d.Addresses {
+			if addr == "" || addr == "dynamic" {
+				continue
+			}
+			// The port defaults to 22000 when left out
+			if _, _, err := net.SplitHostPort(addr); err != nil && !strings.Contains(err.Error(), "missing port") {
+				errs.add(prefix+".addresses", "%q is not \"dynamic\" or a host[:port] address", addr)
+			}
+		}
+		for _, network := range d.AllowedNetworks {
+			if _, _, err := net.ParseCIDR(network); err != nil {
+				errs.add(prefix+".allowedNetworks", "%q is not a network in CIDR notation", network)
+			}
+		}
+		errs.checkNotNegative(prefix+".pingIdleTimeS", d.PingIdleTimeS)
+		errs.checkNotNegative(prefix+".pingTimeoutS", d.PingTimeoutS)
+		errs.checkRange(prefix+".maxRequests", d.MaxRequests, 0, MaxRequests)
+	}
+
+	opts := cfg.Options
+	for _, lc := range opts.Listeners {
+		if _, _, err := net.SplitHostPort(lc.Address); err != nil {
+			errs.add("options.listeners", "%q is not a host:port address", lc.Address)
+		}
+		switch lc.RateLimit {
+		case RateLimitAuto, RateLimitAlways, RateLimitNever:
+		default:
+			errs.add("options.listeners", "unknown rate limit %q for %s", lc.RateLimit, lc.Address)
+		}
+	}
+	errs.checkNotNegative("options.maxSendKbps", opts.MaxSendKbps)
+	errs.checkNotNegative("options.maxRecvKbps", opts.MaxRecvKbps)
+	errs.checkNotNegative("options.maxScanReadMBps", opts.MaxScanReadMBps)
+	errs.checkRange("options.maxCPUPercent", opts.MaxCPUPercent, 0, 100)
+	errs.checkNotNegative("options.tombstoneRetentionH", opts.TombstoneRetentionH)
+	errs.checkNotNegative("options.databaseWriteBufferMiB", opts.DatabaseWriteBufferMiB)
+	errs.checkNotNegative("options.maxPullQueueItems", opts.MaxPullQueueItems)
+	errs.checkNotNegative("options.maxPullBufferMiB", opts.MaxPullBufferMiB)
+	if opts.ExternalAddress != "" {
+		if _, port, err := net.SplitHostPort(opts.ExternalAddress); err != nil || port == "" {
+			errs.add("options.externalAddress", "%q is not a host:port or :port address", opts.ExternalAddress)
+		}
+	}
+	if opts.ExternalIPURL != "" {
+		if u, err := url.Parse(opts.ExternalIPURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			errs.add("options.externalIPURL", "%q is not an https:// URL", opts.ExternalIPURL)
+		}
+	}
+	if _, ok := tlsVersions[opts.TLSMinVersion]; !ok && opts.TLSMinVersion != "" {
+		errs.add("options.tlsMinVersion", "must be \"1.2\" or \"1.3\"")
+	}
+	for _, name := range opts.TLSCipherSuites {
+		if _, ok := tlsCipherSuites[name]; !ok {
+			errs.add("options.tlsCipherSuites", "unknown cipher suite %q", name)
+		}
+	}
+	for _, network := range opts.AlwaysLocalNets {
+		if _, _, err := net.ParseCIDR(network); err != nil {
+			errs.add("options.alwaysLocalNets", "%q is not a network in CIDR notation", network)
+		}
+	}
+	for _, origin := range opts.CORSAllowedOrigins {
+		if !ValidOrigin(origin) {
+			errs.add("options.corsAllowedOrigins", "%q is not an origin like https://host:port", origin)
+		}
+	}
+
+	gui := cfg.GUI
+	if _, ok := gui.UnixSocket(); gui.Enabled && !ok {
+		if _, _, err := net.SplitHostPort(gui.Address); err != nil {
+			errs.add("gui.address", "%q is not a host:port address or unix socket", gui.Address)
+		}
+	}
+	seenUsers := make(map[string]bool)
+	for i, u := range gui.Users {
+		prefix := fmt.Sprintf("gui.users[%s]", u.Name)
+		switch {
+		case u.Name == "":
+			prefix = fmt.Sprintf("gui.users[%d]", i)
+			errs.add(prefix+".name", "must not be empty")
+		case seenUsers[u.Name]:
+			errs.add(prefix+".name", "is used by more than one user")
+		}
+		seenUsers[u.Name] = true
+		if u.Role != GUIRoleAdmin && u.Role != GUIRoleReadOnly {
+			errs.add(prefix+".role", "must be %q or %q", GUIRoleAdmin, GUIRoleReadOnly)
+		}
+	}
+	switch gui.AuthMode {
+	case "", AuthModeStatic:
+	case AuthModeLDAP:
+		if gui.LDAP.Address == "" {
+			errs.add("gui.ldap.address", "must not be empty with LDAP authentication")
+		}
+		if !strings.Contains(gui.LDAP.BindDN, "%s") {
+			errs.add("gui.ldap.bindDN", "must contain %%s, replaced by the user name")
+		}
+		switch gui.LDAP.Transport {
+		case "", LDAPTransportTLS, LDAPTransportStartTLS, LDAPTransportPlain:
+		default:
+			errs.add("gui.ldap.transport", "unknown transport %q", gui.LDAP.Transport)
+		}
+	default:
+		errs.add("gui.authMode", "unknown authentication mode %q", gui.AuthMode)
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
@@ -42,6 +42,12 @@ type Wrapper struct {
 	replaces  chan Configuration
 	mut       sync.Mutex
 
+	// The options and GUI settings are overridden in cfg, and saved as
+	// configured.
+	overrides     Overrides
+	configured    OptionsConfiguration
+	configuredGUI GUIConfiguration
+
 	subs []Handler
 	sMut sync.Mutex
 }
@@ -116,12 +122,63 @@ func (w *Wrapper) Replace(cfg Configuration) {
 	w.mut.Lock()
 	defer w.mut.Unlock()
 
+	w.setOptions(&cfg.Options)
+	w.setGUI(&cfg.GUI)
 	w.cfg = cfg
 	w.deviceMap = nil
 	w.folderMap = nil
 	w.replaces <- cfg.Copy()
 }
 
+// SetOverrides overrides options and GUI settings with values that are
+// used, but not saved. Changes to overridden options have no effect.
+func (w *Wrapper) SetOverrides(o Overrides) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	w.configured = w.cfg.Options.Copy()
+	w.configuredGUI = w.cfg.GUI
+	w.overrides = o
+	o.apply(&w.cfg.Options)
+	o.apply(&w.cfg.GUI)
+	w.replaces <- w.cfg.Copy()
+}
+
+// Overrides returns the options overridden by SetOverrides.
+func (w *Wrapper) Overrides() Overrides {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	o := make(Overrides, len(w.overrides))
+	for name, value := range w.overrides {
+		o[name] = value
+	}
+	return o
+}
+
+// setOptions notes the options as configured, and overrides them for use.
+// Called with the mutex held.
+func (w *Wrapper) setOptions(opts *OptionsConfiguration) {
+	if len(w.overrides) == 0 {
+		return
+	}
+	configured := opts.Copy()
+	w.overrides.restore(&configured, w.configured)
+	w.configured = configured
+	w.overrides.apply(opts)
+}
+
+// setGUI is setOptions for the GUI settings. Called with the mutex held.
+func (w *Wrapper) setGUI(gui *GUIConfiguration) {
+	if len(w.overrides) == 0 {
+		return
+	}
+	configured := *gui
+	w.overrides.restore(&configured, w.configuredGUI)
+	w.configuredGUI = configured
+	w.overrides.apply(gui)
+}
+
 // Devices returns a map of devices. Device structures should not be changed,
 // other than for the purpose of updating via SetDevice().
 func (w *Wrapper) Devices() map[protocol.DeviceID]DeviceConfiguration {
@@ -143,16 +200,7 @@ func (w *Wrapper) SetDevice(dev DeviceConfiguration) {
 	defer w.mut.Unlock()
 
 	w.deviceMap = nil
-
-	for i := range w.cfg.Devices {
-		if w.cfg.Devices[i].DeviceID == dev.DeviceID {
-			w.cfg.Devices[i] = dev
-			w.replaces <- w.cfg.Copy()
-			return
-		}
-	}
-
-	w.cfg.Devices = append(w.cfg.Devices, dev)
+	w.cfg.SetDevice(dev)
 	w.replaces <- w.cfg.Copy()
 }
 
@@ -177,16 +225,7 @@ func (w *Wrapper) SetFolder(fld FolderConfiguration) {
 	defer w.mut.Unlock()
 
 	w.folderMap = nil
-
-	for i := range w.cfg.Folders {
-		if w.cfg.Folders[i].ID == fld.ID {
-			w.cfg.Folders[i] = fld
-			w.replaces <- w.cfg.Copy()
-			return
-		}
-	}
-
-	w.cfg.Folders = append(w.cfg.Folders, fld)
+	w.cfg.SetFolder(fld)
 	w.replaces <- w.cfg.Copy()
 }
 
@@ -201,6 +240,7 @@ func (w *Wrapper) Options() OptionsConfiguration {
 func (w *Wrapper) SetOptions(opts OptionsConfiguration) {
 	w.mut.Lock()
 	defer w.mut.Unlock()
+	w.setOptions(&opts)
 	w.cfg.Options = opts
 	w.replaces <- w.cfg.Copy()
 }
@@ -216,6 +256,7 @@ func (w *Wrapper) GUI() GUIConfiguration {
 func (w *Wrapper) SetGUI(gui GUIConfiguration) {
 	w.mut.Lock()
 	defer w.mut.Unlock()
+	w.setGUI(&gui)
 	w.cfg.GUI = gui
 	w.replaces <- w.cfg.Copy()
 }
@@ -241,7 +282,15 @@ func (w *Wrapper) Save() error {
 	}
 	defer os.Remove(fd.Name())
 
-	err = w.cfg.WriteXML(fd)
+	w.mut.Lock()
+	cfg := w.cfg
+	if len(w.overrides) > 0 {
+		cfg.Options = w.configured
+		cfg.GUI = w.configuredGUI
+	}
+	w.mut.Unlock()
+
+	err = cfg.WriteXML(fd)
 	if err != nil {
 		fd.Close()
 		return err
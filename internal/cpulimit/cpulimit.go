@@ -0,0 +1,90 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package cpulimit implements throttling of CPU heavy work, such as hashing
+// and pulling, based on the measured CPU usage of the process.
+package cpulimit
+
+import (
+	"time"
+
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+const (
+	// Weight of each new sample in the moving average.
+	alpha = 0.3
+	// Throttling is relaxed once the average falls below this fraction of
+	// the target, to avoid flapping around it.
+	hysteresis = 0.9
+
+	minDelay = time.Millisecond
+	maxDelay = time.Second
+)
+
+// A Limiter keeps a moving average of the CPU usage reported to it. While the
+// average is above the target, callers of Wait are delayed; the delay grows
+// for as long as the average stays above the target and shrinks when it falls
+// below. A nil Limiter never delays.
+type Limiter struct {
+	target float64
+	avg    float64
+	delay  time.Duration
+	mut    sync.Mutex
+}
+
+// New returns a Limiter with the given target, in percent of the total CPU
+// capacity of the machine.
+func New(target float64) *Limiter {
+	return &Limiter{
+		target: target,
+		mut:    sync.NewMutex(),
+	}
+}
+
+// Update records a CPU usage sample, in percent of the total CPU capacity of
+// the machine. It should be called at regular intervals.
+func (lim *Limiter) Update(usage float64) {
+	lim.mut.Lock()
+	defer lim.mut.Unlock()
+
+	lim.avg = alpha*usage + (1-alpha)*lim.avg
+
+	switch {
+	case lim.avg > lim.target:
+		lim.delay *= 2
+		if lim.delay < minDelay {
+			lim.delay = minDelay
+		} else if lim.delay > maxDelay {
+			lim.delay = maxDelay
+		}
+	case lim.avg < lim.target*hysteresis:
+		lim.delay /= 2
+		if lim.delay < minDelay {
+			lim.delay = 0
+		}
+	}
+
+	if debug.On() {
+		l.Debugf("usage %.1f%%, average %.1f%%, target %.1f%%, delay %v", usage, lim.avg, lim.target, lim.delay)
+	}
+}
+
+// Wait blocks for the current throttling delay, if any. It should be called
+// before each unit of CPU heavy work.
+func (lim *Limiter) Wait() {
+	if lim == nil {
+		return
+	}
+
+	lim.mut.Lock()
+	delay := lim.delay
+	lim.mut.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cpulimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiterDelay(t *testing.T) {
+	lim := New(50)
+
+	lim.Update(40)
+	if lim.delay != 0 {
+		t.Fatalf("unexpected delay %v below target", lim.delay)
+	}
+
+	// Usage above the target should soon start, and then increase, the delay.
+	var prev time.Duration
+	for i := 0; i < 5; i++ {
+		lim.Update(100)
+		if lim.delay < prev {
+			t.Fatalf("delay decreased from %v to %v above target", prev, lim.delay)
+		}
+		prev = lim.delay
+	}
+	if prev == 0 {
+		t.Fatal("no delay above target")
+	}
+
+	for i := 0; i < 100; i++ {
+		lim.Update(100)
+	}
+	if lim.delay != maxDelay {
+		t.Errorf("delay %v != max %v", lim.delay, maxDelay)
+	}
+
+	// Once usage drops, the delay should go away entirely.
+	for i := 0; i < 100; i++ {
+		lim.Update(0)
+	}
+	if lim.delay != 0 {
+		t.Errorf("delay %v remains below target", lim.delay)
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var lim *Limiter
+	lim.Wait()
+}
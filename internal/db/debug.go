@@ -11,10 +11,16 @@ import (
 	"strings"
 
 	"github.com/calmh/logger"
+	"github.com/syncthing/syncthing/internal/trace"
 )
 
 var (
-	debug   = strings.Contains(os.Getenv("STTRACE"), "files") || os.Getenv("STTRACE") == "all"
-	debugDB = strings.Contains(os.Getenv("STTRACE"), "db") || os.Getenv("STTRACE") == "all"
+	debug   = trace.NewFlag(strings.Contains(os.Getenv("STTRACE"), "files") || os.Getenv("STTRACE") == "all")
+	debugDB = trace.NewFlag(strings.Contains(os.Getenv("STTRACE"), "db") || os.Getenv("STTRACE") == "all")
 	l       = logger.DefaultLogger
 )
+
+func init() {
+	trace.Register("files", "The db package; file set operations", debug)
+	trace.Register("db", "The db package; database operations", debugDB)
+}
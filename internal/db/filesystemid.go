@@ -0,0 +1,44 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import "github.com/syndtr/goleveldb/leveldb"
+
+// This type keeps track of the filesystem the path of a folder was on when
+// the folder was first pulled, so that a folder path found on another
+// filesystem, such as the empty mount point of a failed mount, is noticed
+// across restarts. The ID is stored by folder path, as a folder whose path
+// is changed may well be meant to be on another filesystem.
+
+type FilesystemIDRepo struct {
+	ns *NamespacedKV
+}
+
+func NewFilesystemIDRepo(ldb *leveldb.DB, folder string) *FilesystemIDRepo {
+	prefix := string([]byte{KeyTypeFilesystemID}) + folder
+
+	return &FilesystemIDRepo{
+		ns: NewNamespacedKV(ldb, prefix),
+	}
+}
+
+// Get returns the filesystem ID recorded for the folder path, if any.
+func (r *FilesystemIDRepo) Get(path string) (uint64, bool) {
+	id, ok := r.ns.Int64(path)
+	return uint64(id), ok
+}
+
+func (r *FilesystemIDRepo) Put(path string, id uint64) {
+	if debug.On() {
+		l.Debugf("filesystem id: storing path:%s id:%x", path, id)
+	}
+	r.ns.PutInt64(path, int64(id))
+}
+
+func (r *FilesystemIDRepo) Drop() {
+	r.ns.Reset()
+}
@@ -0,0 +1,46 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestFilesystemIDRepo(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo1 := NewFilesystemIDRepo(ldb, "folder1")
+	repo2 := NewFilesystemIDRepo(ldb, "folder2")
+
+	if _, ok := repo1.Get("/path"); ok {
+		t.Error("Unknown path has an ID")
+	}
+
+	repo1.Put("/path", 1<<63+42)
+
+	if id, ok := repo1.Get("/path"); !ok || id != 1<<63+42 {
+		t.Errorf("Unexpected ID %x, %v", id, ok)
+	}
+	if _, ok := repo1.Get("/other"); ok {
+		t.Error("Other path has an ID")
+	}
+	if _, ok := repo2.Get("/path"); ok {
+		t.Error("Other folder has an ID")
+	}
+
+	repo1.Drop()
+
+	if _, ok := repo1.Get("/path"); ok {
+		t.Error("Dropped path still has an ID")
+	}
+}
@@ -46,6 +46,12 @@ const (
 	KeyTypeDeviceStatistic
 	KeyTypeFolderStatistic
 	KeyTypeVirtualMtime
+	KeyTypePlaceholder
+	KeyTypeEvent
+	KeyTypeTempBlocks
+	KeyTypeTombstone
+	KeyTypePendingDelete
+	KeyTypeFilesystemID
 )
 
 type fileVersion struct {
@@ -171,18 +177,18 @@ func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.File
 	limit := deviceKey(folder, device, []byte{0xff, 0xff, 0xff, 0xff}) // after all folder/device files
 
 	batch := new(leveldb.Batch)
-	if debugDB {
+	if debugDB.On() {
 		l.Debugf("new batch %p", batch)
 	}
 	snap, err := db.GetSnapshot()
 	if err != nil {
 		panic(err)
 	}
-	if debugDB {
+	if debugDB.On() {
 		l.Debugf("created snapshot %p", snap)
 	}
 	defer func() {
-		if debugDB {
+		if debugDB.On() {
 			l.Debugf("close snapshot %p", snap)
 		}
 		snap.Release()
@@ -213,13 +219,13 @@ func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.File
 
 		cmp := bytes.Compare(newName, oldName)
 
-		if debugDB {
+		if debugDB.On() {
 			l.Debugf("generic replace; folder=%q device=%v moreFs=%v moreDb=%v cmp=%d newName=%q oldName=%q", folder, protocol.DeviceIDFromBytes(device), moreFs, moreDb, cmp, newName, oldName)
 		}
 
 		switch {
 		case moreFs && (!moreDb || cmp == -1):
-			if debugDB {
+			if debugDB.On() {
 				l.Debugln("generic replace; missing - insert")
 			}
 			// Database is missing this file. Insert it.
@@ -237,13 +243,13 @@ func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.File
 			// File exists on both sides - compare versions. We might get an
 			// update with the same version and different flags if a device has
 			// marked a file as invalid, so handle that too.
-			if debugDB {
+			if debugDB.On() {
 				l.Debugln("generic replace; exists - compare")
 			}
 			var ef FileInfoTruncated
 			ef.UnmarshalXDR(dbi.Value())
 			if !fs[fsi].Version.Equal(ef.Version) || fs[fsi].Flags != ef.Flags {
-				if debugDB {
+				if debugDB.On() {
 					l.Debugln("generic replace; differs - insert")
 				}
 				if lv := ldbInsert(batch, folder, device, fs[fsi]); lv > maxLocalVer {
@@ -254,7 +260,7 @@ func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.File
 				} else {
 					ldbUpdateGlobal(snap, batch, folder, device, newName, fs[fsi].Version)
 				}
-			} else if debugDB {
+			} else if debugDB.On() {
 				l.Debugln("generic replace; equal - ignore")
 			}
 
@@ -262,7 +268,7 @@ func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.File
 			moreDb = dbi.Next()
 
 		case moreDb && (!moreFs || cmp == 1):
-			if debugDB {
+			if debugDB.On() {
 				l.Debugln("generic replace; exists - remove")
 			}
 			if lv := deleteFn(snap, batch, folder, device, oldName, dbi); lv > maxLocalVer {
@@ -274,7 +280,7 @@ func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.File
 		// Write out and reuse the batch every few records, to avoid the batch
 		// growing too large and thus allocating unnecessarily much memory.
 		if batch.Len() > batchFlushSize {
-			if debugDB {
+			if debugDB.On() {
 				l.Debugf("db.Write %p", batch)
 			}
 
@@ -287,7 +293,7 @@ func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.File
 		}
 	}
 
-	if debugDB {
+	if debugDB.On() {
 		l.Debugf("db.Write %p", batch)
 	}
 	err = db.Write(batch, nil)
@@ -302,11 +308,11 @@ func ldbReplace(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo) i
 	// TODO: Return the remaining maxLocalVer?
 	return ldbGenericReplace(db, folder, device, fs, func(db dbReader, batch dbWriter, folder, device, name []byte, dbi iterator.Iterator) int64 {
 		// Database has a file that we are missing. Remove it.
-		if debugDB {
+		if debugDB.On() {
 			l.Debugf("delete; folder=%q device=%v name=%q", folder, protocol.DeviceIDFromBytes(device), name)
 		}
 		ldbRemoveFromGlobal(db, batch, folder, device, name)
-		if debugDB {
+		if debugDB.On() {
 			l.Debugf("batch.Delete %p %x", batch, dbi.Key())
 		}
 		batch.Delete(dbi.Key())
@@ -324,7 +330,7 @@ func ldbReplaceWithDelete(db *leveldb.DB, folder, device []byte, fs []protocol.F
 			panic(err)
 		}
 		if !tf.IsDeleted() {
-			if debugDB {
+			if debugDB.On() {
 				l.Debugf("mark deleted; folder=%q device=%v name=%q", folder, protocol.DeviceIDFromBytes(device), name)
 			}
 			ts := clock(tf.LocalVersion)
@@ -336,7 +342,7 @@ func ldbReplaceWithDelete(db *leveldb.DB, folder, device []byte, fs []protocol.F
 				Modified:     tf.Modified,
 			}
 			bs, _ := f.MarshalXDR()
-			if debugDB {
+			if debugDB.On() {
 				l.Debugf("batch.Put %p %x", batch, dbi.Key())
 			}
 			batch.Put(dbi.Key(), bs)
@@ -352,18 +358,18 @@ func ldbUpdate(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo) in
 	runtime.GC()
 
 	batch := new(leveldb.Batch)
-	if debugDB {
+	if debugDB.On() {
 		l.Debugf("new batch %p", batch)
 	}
 	snap, err := db.GetSnapshot()
 	if err != nil {
 		panic(err)
 	}
-	if debugDB {
+	if debugDB.On() {
 		l.Debugf("created snapshot %p", snap)
 	}
 	defer func() {
-		if debugDB {
+		if debugDB.On() {
 			l.Debugf("close snapshot %p", snap)
 		}
 		snap.Release()
@@ -373,7 +379,7 @@ func ldbUpdate(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo) in
 	for _, f := range fs {
 		name := []byte(f.Name)
 		fk := deviceKey(folder, device, name)
-		if debugDB {
+		if debugDB.On() {
 			l.Debugf("snap.Get %p %x", snap, fk)
 		}
 		bs, err := snap.Get(fk, nil)
@@ -410,7 +416,7 @@ func ldbUpdate(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo) in
 		// Write out and reuse the batch every few records, to avoid the batch
 		// growing too large and thus allocating unnecessarily much memory.
 		if batch.Len() > batchFlushSize {
-			if debugDB {
+			if debugDB.On() {
 				l.Debugf("db.Write %p", batch)
 			}
 
@@ -423,7 +429,7 @@ func ldbUpdate(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo) in
 		}
 	}
 
-	if debugDB {
+	if debugDB.On() {
 		l.Debugf("db.Write %p", batch)
 	}
 	err = db.Write(batch, nil)
@@ -435,7 +441,7 @@ func ldbUpdate(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo) in
 }
 
 func ldbInsert(batch dbWriter, folder, device []byte, file protocol.FileInfo) int64 {
-	if debugDB {
+	if debugDB.On() {
 		l.Debugf("insert; folder=%q device=%v %v", folder, protocol.DeviceIDFromBytes(device), file)
 	}
 
@@ -445,7 +451,7 @@ func ldbInsert(batch dbWriter, folder, device []byte, file protocol.FileInfo) in
 
 	name := []byte(file.Name)
 	nk := deviceKey(folder, device, name)
-	if debugDB {
+	if debugDB.On() {
 		l.Debugf("batch.Put %p %x", batch, nk)
 	}
 	batch.Put(nk, file.MustMarshalXDR())
@@ -457,7 +463,7 @@ func ldbInsert(batch dbWriter, folder, device []byte, file protocol.FileInfo) in
 // file. If the device is already present in the list, the version is updated.
 // If the file does not have an entry in the global list, it is created.
 func ldbUpdateGlobal(db dbReader, batch dbWriter, folder, device, file []byte, version protocol.Vector) bool {
-	if debugDB {
+	if debugDB.On() {
 		l.Debugf("update global; folder=%q device=%v file=%q version=%d", folder, protocol.DeviceIDFromBytes(device), file, version)
 	}
 	gk := globalKey(folder, file)
@@ -507,7 +513,7 @@ func ldbUpdateGlobal(db dbReader, batch dbWriter, folder, device, file []byte, v
 	fl.versions = append(fl.versions, nv)
 
 done:
-	if debugDB {
+	if debugDB.On() {
 		l.Debugf("batch.Put %p %x", batch, gk)
 		l.Debugf("new global after update: %v", fl)
 	}
@@ -520,7 +526,7 @@ done:
 // given file. If the version list is empty after this, the file entry is
 // removed entirely.
 func ldbRemoveFromGlobal(db dbReader, batch dbWriter, folder, device, file []byte) {
-	if debugDB {
+	if debugDB.On() {
 		l.Debugf("remove from global; folder=%q device=%v file=%q", folder, protocol.DeviceIDFromBytes(device), file)
 	}
 
@@ -546,12 +552,12 @@ func ldbRemoveFromGlobal(db dbReader, batch dbWriter, folder, device, file []byt
 	}
 
 	if len(fl.versions) == 0 {
-		if debugDB {
+		if debugDB.On() {
 			l.Debugf("batch.Delete %p %x", batch, gk)
 		}
 		batch.Delete(gk)
 	} else {
-		if debugDB {
+		if debugDB.On() {
 			l.Debugf("batch.Put %p %x", batch, gk)
 			l.Debugf("new global after remove: %v", fl)
 		}
@@ -559,24 +565,22 @@ func ldbRemoveFromGlobal(db dbReader, batch dbWriter, folder, device, file []byt
 	}
 }
 
-func ldbWithHave(db *leveldb.DB, folder, device []byte, truncate bool, fn Iterator) {
-	start := deviceKey(folder, device, nil)                            // before all folder/device files
-	limit := deviceKey(folder, device, []byte{0xff, 0xff, 0xff, 0xff}) // after all folder/device files
+func ldbWithHave(db *leveldb.DB, folder, device, prefix []byte, truncate bool, fn Iterator) {
 	snap, err := db.GetSnapshot()
 	if err != nil {
 		panic(err)
 	}
-	if debugDB {
+	if debugDB.On() {
 		l.Debugf("created snapshot %p", snap)
 	}
 	defer func() {
-		if debugDB {
+		if debugDB.On() {
 			l.Debugf("close snapshot %p", snap)
 		}
 		snap.Release()
 	}()
 
-	dbi := snap.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	dbi := snap.NewIterator(util.BytesPrefix(deviceKey(folder, device, prefix)), nil)
 	defer dbi.Release()
 
 	for dbi.Next() {
@@ -599,11 +603,11 @@ func ldbWithAllFolderTruncated(db *leveldb.DB, folder []byte, fn func(device []b
 	if err != nil {
 		panic(err)
 	}
-	if debugDB {
+	if debugDB.On() {
 		l.Debugf("created snapshot %p", snap)
 	}
 	defer func() {
-		if debugDB {
+		if debugDB.On() {
 			l.Debugf("close snapshot %p", snap)
 		}
 		snap.Release()
@@ -660,17 +664,17 @@ func ldbGetGlobal(db *leveldb.DB, folder, file []byte, truncate bool) (FileIntf,
 	if err != nil {
 		panic(err)
 	}
-	if debugDB {
+	if debugDB.On() {
 		l.Debugf("created snapshot %p", snap)
 	}
 	defer func() {
-		if debugDB {
+		if debugDB.On() {
 			l.Debugf("close snapshot %p", snap)
 		}
 		snap.Release()
 	}()
 
-	if debugDB {
+	if debugDB.On() {
 		l.Debugf("snap.Get %p %x", snap, k)
 	}
 	bs, err := snap.Get(k, nil)
@@ -692,7 +696,7 @@ func ldbGetGlobal(db *leveldb.DB, folder, file []byte, truncate bool) (FileIntf,
 	}
 
 	k = deviceKey(folder, vl.versions[0].device, file)
-	if debugDB {
+	if debugDB.On() {
 		l.Debugf("snap.Get %p %x", snap, k)
 	}
 	bs, err = snap.Get(k, nil)
@@ -714,11 +718,11 @@ func ldbWithGlobal(db *leveldb.DB, folder, prefix []byte, truncate bool, fn Iter
 	if err != nil {
 		panic(err)
 	}
-	if debugDB {
+	if debugDB.On() {
 		l.Debugf("created snapshot %p", snap)
 	}
 	defer func() {
-		if debugDB {
+		if debugDB.On() {
 			l.Debugf("close snapshot %p", snap)
 		}
 		snap.Release()
@@ -739,7 +743,7 @@ func ldbWithGlobal(db *leveldb.DB, folder, prefix []byte, truncate bool, fn Iter
 		}
 		name := globalKeyName(dbi.Key())
 		fk := deviceKey(folder, vl.versions[0].device, name)
-		if debugDB {
+		if debugDB.On() {
 			l.Debugf("snap.Get %p %x", snap, fk)
 		}
 		bs, err := snap.Get(fk, nil)
@@ -802,11 +806,11 @@ func ldbWithNeed(db *leveldb.DB, folder, device []byte, truncate bool, fn Iterat
 	if err != nil {
 		panic(err)
 	}
-	if debugDB {
+	if debugDB.On() {
 		l.Debugf("created snapshot %p", snap)
 	}
 	defer func() {
-		if debugDB {
+		if debugDB.On() {
 			l.Debugf("close snapshot %p", snap)
 		}
 		snap.Release()
@@ -853,7 +857,7 @@ nextFile:
 					continue nextFile
 				}
 				fk := deviceKey(folder, vl.versions[i].device, name)
-				if debugDB {
+				if debugDB.On() {
 					l.Debugf("snap.Get %p %x", snap, fk)
 				}
 				bs, err := snap.Get(fk, nil)
@@ -885,7 +889,7 @@ nextFile:
 					continue nextFile
 				}
 
-				if debugDB {
+				if debugDB.On() {
 					l.Debugf("need folder=%q device=%v name=%q need=%v have=%v haveV=%d globalV=%d", folder, protocol.DeviceIDFromBytes(device), name, need, have, haveVersion, vl.versions[0].version)
 				}
 
@@ -907,11 +911,11 @@ func ldbListFolders(db *leveldb.DB) []string {
 	if err != nil {
 		panic(err)
 	}
-	if debugDB {
+	if debugDB.On() {
 		l.Debugf("created snapshot %p", snap)
 	}
 	defer func() {
-		if debugDB {
+		if debugDB.On() {
 			l.Debugf("close snapshot %p", snap)
 		}
 		snap.Release()
@@ -944,11 +948,11 @@ func ldbDropFolder(db *leveldb.DB, folder []byte) {
 	if err != nil {
 		panic(err)
 	}
-	if debugDB {
+	if debugDB.On() {
 		l.Debugf("created snapshot %p", snap)
 	}
 	defer func() {
-		if debugDB {
+		if debugDB.On() {
 			l.Debugf("close snapshot %p", snap)
 		}
 		snap.Release()
@@ -994,11 +998,11 @@ func ldbCheckGlobals(db *leveldb.DB, folder []byte) {
 	if err != nil {
 		panic(err)
 	}
-	if debugDB {
+	if debugDB.On() {
 		l.Debugf("created snapshot %p", snap)
 	}
 	defer func() {
-		if debugDB {
+		if debugDB.On() {
 			l.Debugf("close snapshot %p", snap)
 		}
 		snap.Release()
@@ -1010,7 +1014,7 @@ func ldbCheckGlobals(db *leveldb.DB, folder []byte) {
 	defer dbi.Release()
 
 	batch := new(leveldb.Batch)
-	if debugDB {
+	if debugDB.On() {
 		l.Debugf("new batch %p", batch)
 	}
 	for dbi.Next() {
@@ -1030,7 +1034,7 @@ func ldbCheckGlobals(db *leveldb.DB, folder []byte) {
 		var newVL versionList
 		for _, version := range vl.versions {
 			fk := deviceKey(folder, version.device, name)
-			if debugDB {
+			if debugDB.On() {
 				l.Debugf("snap.Get %p %x", snap, fk)
 			}
 			_, err := snap.Get(fk, nil)
@@ -1048,7 +1052,7 @@ func ldbCheckGlobals(db *leveldb.DB, folder []byte) {
 			batch.Put(dbi.Key(), newVL.MustMarshalXDR())
 		}
 	}
-	if debugDB {
+	if debugDB.On() {
 		l.Infoln("db check completed for %q", folder)
 	}
 	db.Write(batch, nil)
@@ -0,0 +1,73 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// The PendingDeleteRepo records when each remote deletion held back by the
+// delete window of a folder was first seen, and whether it was cancelled.
+// As with the TombstoneRepo the deleted version is recorded with the time,
+// so that a file deleted anew after being recreated gets a new window.
+type PendingDeleteRepo struct {
+	ns *NamespacedKV
+}
+
+func NewPendingDeleteRepo(ldb *leveldb.DB, folder string) *PendingDeleteRepo {
+	prefix := string([]byte{KeyTypePendingDelete}) + folder
+
+	return &PendingDeleteRepo{
+		ns: NewNamespacedKV(ldb, prefix),
+	}
+}
+
+// Since returns the time the deletion of the file with the given version
+// was first seen, recording now if it wasn't seen before, and whether it
+// was cancelled.
+func (r *PendingDeleteRepo) Since(name string, version protocol.Vector, now time.Time) (time.Time, bool) {
+	v := []byte(fmt.Sprint(version))
+	if bs, ok := r.ns.Bytes(name); ok && len(bs) >= 9 && bytes.Equal(bs[9:], v) {
+		return time.Unix(0, int64(binary.BigEndian.Uint64(bs))), bs[8] != 0
+	}
+
+	r.put(name, v, now, false)
+	return now, false
+}
+
+// Cancel keeps the deletion of the file with the given version from being
+// applied. A later deletion of the file is not affected.
+func (r *PendingDeleteRepo) Cancel(name string, version protocol.Vector, now time.Time) {
+	since, _ := r.Since(name, version, now)
+	r.put(name, []byte(fmt.Sprint(version)), since, true)
+}
+
+func (r *PendingDeleteRepo) put(name string, version []byte, since time.Time, cancelled bool) {
+	if debug.On() {
+		l.Debugf("pending delete: storing path:%s since:%v cancelled:%v", name, since, cancelled)
+	}
+	bs := make([]byte, 9, 9+len(version))
+	binary.BigEndian.PutUint64(bs, uint64(since.UnixNano()))
+	if cancelled {
+		bs[8] = 1
+	}
+	r.ns.PutBytes(name, append(bs, version...))
+}
+
+func (r *PendingDeleteRepo) Remove(name string) {
+	r.ns.Delete(name)
+}
+
+func (r *PendingDeleteRepo) Drop() {
+	r.ns.Reset()
+}
@@ -0,0 +1,55 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestPendingDeleteRepo(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo1 := NewPendingDeleteRepo(ldb, "folder1")
+	repo2 := NewPendingDeleteRepo(ldb, "folder2")
+
+	v1 := protocol.Vector{{ID: 1, Value: 1}}
+	v2 := protocol.Vector{{ID: 1, Value: 2}}
+	now := time.Unix(1000, 0)
+
+	if since, cancelled := repo1.Since("file1", v1, now); !since.Equal(now) || cancelled {
+		t.Errorf("first seen at %v (cancelled %v), expected %v", since, cancelled, now)
+	}
+	if since, _ := repo1.Since("file1", v1, now.Add(time.Hour)); !since.Equal(now) {
+		t.Errorf("seen again at %v, expected %v", since, now)
+	}
+	if since, _ := repo2.Since("file1", v1, now.Add(time.Hour)); !since.Equal(now.Add(time.Hour)) {
+		t.Error("pending delete leaked into another folder")
+	}
+
+	repo1.Cancel("file1", v1, now.Add(time.Hour))
+	if since, cancelled := repo1.Since("file1", v1, now.Add(2*time.Hour)); !since.Equal(now) || !cancelled {
+		t.Errorf("cancelled delete seen at %v (cancelled %v)", since, cancelled)
+	}
+
+	// A new deletion gets a new window, and isn't cancelled
+	if since, cancelled := repo1.Since("file1", v2, now.Add(2*time.Hour)); !since.Equal(now.Add(2*time.Hour)) || cancelled {
+		t.Errorf("new deletion seen at %v (cancelled %v)", since, cancelled)
+	}
+
+	repo1.Remove("file1")
+	if since, _ := repo1.Since("file1", v2, now.Add(3*time.Hour)); !since.Equal(now.Add(3 * time.Hour)) {
+		t.Error("removed deletion was remembered")
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import "github.com/syndtr/goleveldb/leveldb"
+
+// This type keeps track of the placeholders in a folder, the empty files
+// standing in for files whose content isn't kept locally. The mtime a
+// placeholder has on disk is stored, so that a placeholder that has been
+// written to since it was created is seen as a real file again.
+
+type PlaceholderRepo struct {
+	ns *NamespacedKV
+}
+
+func NewPlaceholderRepo(ldb *leveldb.DB, folder string) *PlaceholderRepo {
+	prefix := string([]byte{KeyTypePlaceholder}) + folder
+
+	return &PlaceholderRepo{
+		ns: NewNamespacedKV(ldb, prefix),
+	}
+}
+
+func (r *PlaceholderRepo) Add(path string, diskMtime int64) {
+	if debug.On() {
+		l.Debugf("placeholder: storing path:%s disk:%d", path, diskMtime)
+	}
+	r.ns.PutInt64(path, diskMtime)
+}
+
+// IsPlaceholder returns true if the file at path, with the given size and
+// mtime on disk, is an untouched placeholder.
+func (r *PlaceholderRepo) IsPlaceholder(path string, size, diskMtime int64) bool {
+	if size != 0 {
+		return false
+	}
+	mtime, ok := r.ns.Int64(path)
+	return ok && mtime == diskMtime
+}
+
+func (r *PlaceholderRepo) Remove(path string) {
+	r.ns.Delete(path)
+}
+
+func (r *PlaceholderRepo) Drop() {
+	r.ns.Reset()
+}
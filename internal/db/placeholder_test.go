@@ -0,0 +1,49 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestPlaceholderRepo(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo1 := NewPlaceholderRepo(ldb, "folder1")
+	repo2 := NewPlaceholderRepo(ldb, "folder2")
+
+	if repo1.IsPlaceholder("file1", 0, 1000) {
+		t.Error("Unknown file is a placeholder")
+	}
+
+	repo1.Add("file1", 1000)
+
+	if !repo1.IsPlaceholder("file1", 0, 1000) {
+		t.Error("Added file is not a placeholder")
+	}
+	if repo1.IsPlaceholder("file1", 0, 1001) {
+		t.Error("Touched placeholder is still a placeholder")
+	}
+	if repo1.IsPlaceholder("file1", 42, 1000) {
+		t.Error("Written placeholder is still a placeholder")
+	}
+	if repo2.IsPlaceholder("file1", 0, 1000) {
+		t.Error("Placeholder leaked into another folder")
+	}
+
+	repo1.Remove("file1")
+
+	if repo1.IsPlaceholder("file1", 0, 1000) {
+		t.Error("Removed file is still a placeholder")
+	}
+}
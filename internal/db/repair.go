@@ -0,0 +1,153 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"fmt"
+
+	"github.com/syncthing/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// RepairStats lists the number of inconsistencies found, and fixed, by
+// Repair.
+type RepairStats struct {
+	CorruptFiles   int // file entries that could not be decoded; removed
+	CorruptGlobals int // global version lists that could not be decoded; rebuilt
+	StaleGlobals   int // global versions pointing to no file entry; removed
+	MissingGlobals int // file entries not present in the global version list; added
+	OrphanedBlocks int // block map entries for files we don't have; removed
+}
+
+func (s RepairStats) String() string {
+	return fmt.Sprintf("%d corrupt files, %d corrupt globals, %d stale globals, %d missing globals, %d orphaned blocks",
+		s.CorruptFiles, s.CorruptGlobals, s.StaleGlobals, s.MissingGlobals, s.OrphanedBlocks)
+}
+
+// Repair checks the database entries for the given folder for consistency
+// and removes or rebuilds those that are corrupt or orphaned. It should not
+// be called while the folder is being scanned or synced.
+func Repair(db *leveldb.DB, folder string) (RepairStats, error) {
+	var stats RepairStats
+	bFolder := []byte(folder)
+
+	// File entries that cannot be decoded are useless; remove them. Their
+	// global versions are removed as stale below.
+
+	batch := new(leveldb.Batch)
+	dbi := db.NewIterator(util.BytesPrefix(deviceKey(bFolder, nil, nil)[:1+64]), nil)
+	for dbi.Next() {
+		var f protocol.FileInfo
+		if err := f.UnmarshalXDR(dbi.Value()); err != nil {
+			l.Infof("db repair: removing corrupt file entry %x", dbi.Key())
+			batch.Delete(append([]byte(nil), dbi.Key()...))
+			stats.CorruptFiles++
+		}
+	}
+	dbi.Release()
+	if err := db.Write(batch, nil); err != nil {
+		return stats, err
+	}
+
+	// Global version lists that cannot be decoded are removed, to be rebuilt
+	// from the file entries. Versions pointing to no file entry are removed.
+
+	batch = new(leveldb.Batch)
+	dbi = db.NewIterator(util.BytesPrefix(globalKey(bFolder, nil)), nil)
+	for dbi.Next() {
+		gk := append([]byte(nil), dbi.Key()...)
+		var vl versionList
+		if err := vl.UnmarshalXDR(dbi.Value()); err != nil {
+			l.Infof("db repair: removing corrupt global version list %x", gk)
+			batch.Delete(gk)
+			stats.CorruptGlobals++
+			continue
+		}
+
+		name := globalKeyName(gk)
+		var newVL versionList
+		for _, version := range vl.versions {
+			if _, err := db.Get(deviceKey(bFolder, version.device, name), nil); err == leveldb.ErrNotFound {
+				stats.StaleGlobals++
+				continue
+			} else if err != nil {
+				dbi.Release()
+				return stats, err
+			}
+			newVL.versions = append(newVL.versions, version)
+		}
+
+		switch {
+		case len(newVL.versions) == 0:
+			batch.Delete(gk)
+		case len(newVL.versions) != len(vl.versions):
+			batch.Put(gk, newVL.MustMarshalXDR())
+		}
+	}
+	dbi.Release()
+	if err := db.Write(batch, nil); err != nil {
+		return stats, err
+	}
+
+	// Each valid file entry must be present in the global version list.
+
+	batch = new(leveldb.Batch)
+	ldbWithAllFolderTruncated(db, bFolder, func(device []byte, f FileInfoTruncated) bool {
+		if f.IsInvalid() {
+			return true
+		}
+		if ldbInGlobal(db, bFolder, device, []byte(f.Name)) {
+			return true
+		}
+		stats.MissingGlobals++
+		ldbUpdateGlobal(db, batch, bFolder, device, []byte(f.Name), f.Version)
+		// Write each change immediately, as ldbUpdateGlobal reads the
+		// current global version list from the database.
+		db.Write(batch, nil)
+		batch.Reset()
+		return true
+	})
+
+	// Block map entries must refer to a valid local file.
+
+	batch = new(leveldb.Batch)
+	dbi = db.NewIterator(util.BytesPrefix(toBlockKey(nil, folder, "")[:1+64]), nil)
+	for dbi.Next() {
+		_, name := fromBlockKey(dbi.Key())
+		f, ok := ldbGet(db, bFolder, protocol.LocalDeviceID[:], []byte(name))
+		if !ok || f.IsDeleted() || f.IsInvalid() || f.IsDirectory() {
+			batch.Delete(append([]byte(nil), dbi.Key()...))
+			stats.OrphanedBlocks++
+		}
+	}
+	dbi.Release()
+	if err := db.Write(batch, nil); err != nil {
+		return stats, err
+	}
+
+	return stats, nil
+}
+
+// ldbInGlobal returns true if the given device is present in the
+// global version list for the file.
+func ldbInGlobal(db *leveldb.DB, folder, device, file []byte) bool {
+	bs, err := db.Get(globalKey(folder, file), nil)
+	if err != nil {
+		return false
+	}
+	var vl versionList
+	if err := vl.UnmarshalXDR(bs); err != nil {
+		return false
+	}
+	for _, v := range vl.versions {
+		if string(v.device) == string(device) {
+			return true
+		}
+	}
+	return false
+}
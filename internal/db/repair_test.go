@@ -0,0 +1,81 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"testing"
+
+	"github.com/syncthing/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestRepair(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	folder := []byte("test")
+	local := protocol.LocalDeviceID[:]
+
+	s := NewFileSet("test", db)
+	s.Replace(protocol.LocalDeviceID, []protocol.FileInfo{f1, f2, f3})
+	if err := NewBlockMap(db, "test").Add([]protocol.FileInfo{f1, f2, f3}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A truncated file entry
+	if err := db.Put(deviceKey(folder, local, []byte("f1")), []byte{0, 1, 2}, nil); err != nil {
+		t.Fatal(err)
+	}
+	// A file entry missing from the global version list
+	if err := db.Delete(globalKey(folder, []byte("f2")), nil); err != nil {
+		t.Fatal(err)
+	}
+	// A truncated global version list
+	if err := db.Put(globalKey(folder, []byte("f3")), []byte{0, 1, 2}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := Repair(db, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := RepairStats{
+		CorruptFiles:   1,
+		CorruptGlobals: 1,
+		StaleGlobals:   1, // f1's global version
+		MissingGlobals: 2, // f2 and f3
+		OrphanedBlocks: len(f1.Blocks),
+	}
+	if stats != expected {
+		t.Errorf("unexpected stats\n  %v !=\n  %v", stats, expected)
+	}
+
+	if _, ok := s.Get(protocol.LocalDeviceID, "f1"); ok {
+		t.Error("corrupt file f1 still present")
+	}
+	if _, ok := s.GetGlobal("f1"); ok {
+		t.Error("stale global f1 still present")
+	}
+	for _, name := range []string{"f2", "f3"} {
+		if _, ok := s.GetGlobal(name); !ok {
+			t.Errorf("global %s missing after repair", name)
+		}
+	}
+
+	// A second pass should find nothing to do.
+	stats, err = Repair(db, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (RepairStats{}) {
+		t.Errorf("unexpected stats on second pass: %v", stats)
+	}
+}
@@ -861,3 +861,34 @@ func TestLongPath(t *testing.T) {
 			gf[0].Name, local[0].Name)
 	}
 }
+
+func TestPrefixedHave(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := db.NewFileSet("test", ldb)
+
+	local := []protocol.FileInfo{
+		{Name: "a", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+		{Name: "b", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+		{Name: "b/c", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+		{Name: "b/d", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+		{Name: "bc", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+		{Name: "c", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+	}
+
+	s.ReplaceWithDelete(protocol.LocalDeviceID, local, myID)
+
+	var names []string
+	s.WithPrefixedHaveTruncated(protocol.LocalDeviceID, "b", func(fi db.FileIntf) bool {
+		names = append(names, fi.(db.FileInfoTruncated).Name)
+		return true
+	})
+
+	expected := []string{"b", "b/c", "b/d", "bc"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Incorrect prefixed have list;\n E: %v\n A: %v", expected, names)
+	}
+}
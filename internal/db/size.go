@@ -0,0 +1,43 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// FolderSize returns the approximate space used on disk by the entries of
+// the folder. Recently written entries not yet flushed from the journal to
+// the tables are not counted.
+func FolderSize(db *leveldb.DB, folder string) (int64, error) {
+	bFolder := []byte(folder)
+	blockPrefix := make([]byte, 1+64)
+	blockPrefix[0] = KeyTypeBlock
+	copy(blockPrefix[1:], bFolder)
+
+	ranges := []util.Range{
+		*util.BytesPrefix(deviceKey(bFolder, nil, nil)[:1+64]),
+		*util.BytesPrefix(globalKey(bFolder, nil)),
+		*util.BytesPrefix(blockPrefix),
+	}
+	for _, keyType := range []byte{KeyTypeVirtualMtime, KeyTypePlaceholder, KeyTypeTempBlocks, KeyTypeTombstone} {
+		ranges = append(ranges, *util.BytesPrefix(append([]byte{keyType}, bFolder...)))
+	}
+
+	sizes, err := db.SizeOf(ranges)
+	if err != nil {
+		return 0, err
+	}
+	return int64(sizes.Sum()), nil
+}
+
+// Compact compacts the whole database, discarding deleted and overwritten
+// entries.
+func Compact(db *leveldb.DB) error {
+	return db.CompactRange(util.Range{})
+}
@@ -0,0 +1,54 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/syncthing/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestFolderSize(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fs []protocol.FileInfo
+	for i := 0; i < 1000; i++ {
+		fs = append(fs, protocol.FileInfo{
+			Name:    fmt.Sprintf("file%d", i),
+			Version: protocol.Vector{{ID: 1, Value: 1}},
+		})
+	}
+	NewFileSet("big", ldb).Replace(protocol.LocalDeviceID, fs)
+	NewFileSet("small", ldb).Replace(protocol.LocalDeviceID, fs[:10])
+
+	// The entries are counted once they are in the tables.
+	if err := Compact(ldb); err != nil {
+		t.Fatal(err)
+	}
+
+	big, err := FolderSize(ldb, "big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, err := FolderSize(ldb, "small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	none, err := FolderSize(ldb, "none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if big <= small || small <= 0 || none != 0 {
+		t.Errorf("unexpected sizes %d, %d, %d", big, small, none)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"encoding/binary"
+
+	"github.com/syncthing/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// This type keeps track of the blocks written to the temporary file of a file
+// whose transfer was interrupted, so that the transfer can be resumed without
+// hashing the temporary file. The size and mtime the temporary file had on
+// disk are stored with the blocks; if it has changed since, the blocks are
+// not trusted.
+
+type TempBlockRepo struct {
+	ns *NamespacedKV
+}
+
+func NewTempBlockRepo(ldb *leveldb.DB, folder string) *TempBlockRepo {
+	prefix := string([]byte{KeyTypeTempBlocks}) + folder
+
+	return &TempBlockRepo{
+		ns: NewNamespacedKV(ldb, prefix),
+	}
+}
+
+// Put records the blocks of the file at path that are in its temporary file,
+// which has the given size and mtime on disk. The blocks not written have a
+// nil hash.
+func (r *TempBlockRepo) Put(path string, size, diskMtime int64, blocks []protocol.BlockInfo) {
+	if debug.On() {
+		l.Debugf("tempblocks: storing path:%s size:%d disk:%d blocks:%d", path, size, diskMtime, len(blocks))
+	}
+
+	bs := make([]byte, 20, 20+len(blocks)*(13+32))
+	binary.BigEndian.PutUint64(bs[0:], uint64(size))
+	binary.BigEndian.PutUint64(bs[8:], uint64(diskMtime))
+	binary.BigEndian.PutUint32(bs[16:], uint32(len(blocks)))
+	var hdr [13]byte
+	for _, b := range blocks {
+		binary.BigEndian.PutUint64(hdr[0:], uint64(b.Offset))
+		binary.BigEndian.PutUint32(hdr[8:], uint32(b.Size))
+		hdr[12] = byte(len(b.Hash))
+		bs = append(bs, hdr[:]...)
+		bs = append(bs, b.Hash...)
+	}
+	r.ns.PutBytes(path, bs)
+}
+
+// Get returns the blocks recorded for the file at path, if its temporary file
+// still has the given size and mtime on disk.
+func (r *TempBlockRepo) Get(path string, size, diskMtime int64) ([]protocol.BlockInfo, bool) {
+	bs, ok := r.ns.Bytes(path)
+	if !ok || len(bs) < 20 {
+		return nil, false
+	}
+	if int64(binary.BigEndian.Uint64(bs[0:])) != size || int64(binary.BigEndian.Uint64(bs[8:])) != diskMtime {
+		return nil, false
+	}
+
+	blocks := make([]protocol.BlockInfo, binary.BigEndian.Uint32(bs[16:]))
+	bs = bs[20:]
+	for i := range blocks {
+		if len(bs) < 13 || len(bs) < 13+int(bs[12]) {
+			return nil, false
+		}
+		blocks[i].Offset = int64(binary.BigEndian.Uint64(bs[0:]))
+		blocks[i].Size = int32(binary.BigEndian.Uint32(bs[8:]))
+		if n := int(bs[12]); n > 0 {
+			blocks[i].Hash = append([]byte(nil), bs[13:13+n]...)
+		}
+		bs = bs[13+int(bs[12]):]
+	}
+	return blocks, true
+}
+
+func (r *TempBlockRepo) Remove(path string) {
+	r.ns.Delete(path)
+}
+
+func (r *TempBlockRepo) Drop() {
+	r.ns.Reset()
+}
@@ -0,0 +1,55 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/syncthing/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestTempBlockRepo(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo1 := NewTempBlockRepo(ldb, "folder1")
+	repo2 := NewTempBlockRepo(ldb, "folder2")
+
+	if _, ok := repo1.Get("file1", 1000, 1000); ok {
+		t.Error("Unexpected blocks for unknown file")
+	}
+
+	blocks := []protocol.BlockInfo{
+		{Offset: 0, Size: 128 << 10, Hash: []byte{1, 2, 3}},
+		{},
+		{Offset: 256 << 10, Size: 42, Hash: []byte{4, 5, 6}},
+	}
+	repo1.Put("file1", 1000, 2000, blocks)
+
+	if got, ok := repo1.Get("file1", 1000, 2000); !ok || !reflect.DeepEqual(got, blocks) {
+		t.Errorf("Recorded blocks %v not returned, got %v", blocks, got)
+	}
+	if _, ok := repo1.Get("file1", 1000, 2001); ok {
+		t.Error("Blocks returned for changed temp file")
+	}
+	if _, ok := repo1.Get("file1", 1001, 2000); ok {
+		t.Error("Blocks returned for changed temp file")
+	}
+	if _, ok := repo2.Get("file1", 1000, 2000); ok {
+		t.Error("Blocks leaked into another folder")
+	}
+
+	repo1.Remove("file1")
+	if _, ok := repo1.Get("file1", 1000, 2000); ok {
+		t.Error("Blocks not removed")
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// The TombstoneRepo records when the deletion of each file was first seen,
+// as the modification time of a deleted file is that of the file before it
+// was deleted. The deleted version is recorded with the time, so that a file
+// deleted anew after being recreated gets a new time.
+type TombstoneRepo struct {
+	ns *NamespacedKV
+}
+
+func NewTombstoneRepo(ldb *leveldb.DB, folder string) *TombstoneRepo {
+	prefix := string([]byte{KeyTypeTombstone}) + folder
+
+	return &TombstoneRepo{
+		ns: NewNamespacedKV(ldb, prefix),
+	}
+}
+
+// firstSeen returns the time the deletion of the file with the given
+// version was first seen, recording now if it wasn't seen before.
+func (r *TombstoneRepo) firstSeen(name string, version protocol.Vector, now time.Time) time.Time {
+	v := []byte(fmt.Sprint(version))
+	if bs, ok := r.ns.Bytes(name); ok && len(bs) >= 8 && bytes.Equal(bs[8:], v) {
+		return time.Unix(0, int64(binary.BigEndian.Uint64(bs)))
+	}
+
+	bs := make([]byte, 8, 8+len(v))
+	binary.BigEndian.PutUint64(bs, uint64(now.UnixNano()))
+	r.ns.PutBytes(name, append(bs, v...))
+	return now
+}
+
+func (r *TombstoneRepo) Remove(name string) {
+	r.ns.Delete(name)
+}
+
+func (r *TombstoneRepo) Drop() {
+	r.ns.Reset()
+}
+
+// ExpireTombstones removes the deleted entries of files deleted for longer
+// than maxAge from the index; all of those deleted, with a zero maxAge. Only
+// files that all devices know as deleted are expired, and none at all unless
+// we have an index from each of the given devices sharing the folder, as a
+// device we know nothing about may still have the files and would bring
+// them back. Returns the number of files expired.
+func (s *FileSet) ExpireTombstones(devices []protocol.DeviceID, maxAge time.Duration, now time.Time) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, device := range devices {
+		if s.localVersion[device] == 0 {
+			if debug.On() {
+				l.Debugf("%s ExpireTombstones: no index from %v", s.folder, device)
+			}
+			return 0
+		}
+	}
+
+	folder := []byte(s.folder)
+	repo := NewTombstoneRepo(s.db, s.folder)
+	batch := new(leveldb.Batch)
+	expired := 0
+
+	dbi := s.db.NewIterator(util.BytesPrefix(globalKey(folder, nil)), nil)
+	defer dbi.Release()
+
+nextFile:
+	for dbi.Next() {
+		var vl versionList
+		if err := vl.UnmarshalXDR(dbi.Value()); err != nil {
+			panic(err)
+		}
+		if len(vl.versions) == 0 {
+			continue
+		}
+
+		name := globalKeyName(dbi.Key())
+		var keys [][]byte
+		for _, v := range vl.versions {
+			fk := deviceKey(folder, v.device, name)
+			bs, err := s.db.Get(fk, nil)
+			if err != nil {
+				continue nextFile
+			}
+			var f FileInfoTruncated
+			if err := f.UnmarshalXDR(bs); err != nil || !f.IsDeleted() {
+				continue nextFile
+			}
+			keys = append(keys, fk)
+		}
+
+		deleted := repo.firstSeen(string(name), vl.versions[0].version, now)
+		if now.Sub(deleted) < maxAge {
+			continue
+		}
+
+		if debug.On() {
+			l.Debugf("%s ExpireTombstones: expiring %q, deleted since %v", s.folder, name, deleted)
+		}
+		for _, fk := range keys {
+			batch.Delete(fk)
+		}
+		batch.Delete(append([]byte(nil), dbi.Key()...))
+		repo.Remove(string(name))
+		expired++
+
+		if batch.Len() > batchFlushSize {
+			if err := s.db.Write(batch, nil); err != nil {
+				panic(err)
+			}
+			batch.Reset()
+		}
+	}
+
+	if err := s.db.Write(batch, nil); err != nil {
+		panic(err)
+	}
+	return expired
+}
@@ -0,0 +1,94 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestExpireTombstones(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, _ := protocol.DeviceIDFromString("AIR6LPZ-7K4PTTV-UXQSMUU-CPQ5YWH-OEDFIIQ-JUG777G-2YQXXR5-YD6AWQR")
+	other, _ := protocol.DeviceIDFromString("I6KAH76-66SLLLB-5PFXSOA-UFJCDZC-YAOMLEK-CP2GB32-BV5RQST-3PSROAU")
+
+	deleted := protocol.Vector{{ID: 1, Value: 2}}
+	s := NewFileSet("folder", ldb)
+	s.Replace(protocol.LocalDeviceID, []protocol.FileInfo{
+		{Name: "gone", Flags: protocol.FlagDeleted, Version: deleted},
+		{Name: "remote-has", Flags: protocol.FlagDeleted, Version: deleted},
+		{Name: "present", Version: protocol.Vector{{ID: 1, Value: 1}}},
+	})
+	s.Replace(remote, []protocol.FileInfo{
+		{Name: "gone", Flags: protocol.FlagDeleted, Version: deleted},
+		// The remote device hasn't seen the deletion yet
+		{Name: "remote-has", Version: protocol.Vector{{ID: 1, Value: 1}}},
+	})
+
+	now := time.Now()
+
+	// Nothing is expired while we have no index from one of the devices.
+	if n := s.ExpireTombstones([]protocol.DeviceID{remote, other}, 0, now); n != 0 {
+		t.Fatalf("expired %d files without an index from all devices", n)
+	}
+
+	// The deletions are recorded on the first pass and expired once they
+	// are older than the retention.
+	if n := s.ExpireTombstones([]protocol.DeviceID{remote}, time.Hour, now); n != 0 {
+		t.Fatalf("expired %d files too early", n)
+	}
+	if n := s.ExpireTombstones([]protocol.DeviceID{remote}, time.Hour, now.Add(2*time.Hour)); n != 1 {
+		t.Fatalf("expired %d files != 1", n)
+	}
+
+	if _, ok := s.Get(protocol.LocalDeviceID, "gone"); ok {
+		t.Error("local tombstone not expired")
+	}
+	if _, ok := s.Get(remote, "gone"); ok {
+		t.Error("remote tombstone not expired")
+	}
+	if _, ok := s.GetGlobal("gone"); ok {
+		t.Error("global entry not expired")
+	}
+	if _, ok := s.Get(protocol.LocalDeviceID, "remote-has"); !ok {
+		t.Error("tombstone of a file the remote device still has was expired")
+	}
+	if _, ok := s.Get(protocol.LocalDeviceID, "present"); !ok {
+		t.Error("existing file expired")
+	}
+}
+
+func TestTombstoneRepoFirstSeen(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := NewTombstoneRepo(ldb, "folder")
+
+	v1 := protocol.Vector{{ID: 1, Value: 2}}
+	v2 := protocol.Vector{{ID: 1, Value: 4}}
+	t0 := time.Unix(1000, 0)
+	t1 := time.Unix(2000, 0)
+
+	if seen := repo.firstSeen("file", v1, t0); !seen.Equal(t0) {
+		t.Errorf("first seen %v != %v", seen, t0)
+	}
+	if seen := repo.firstSeen("file", v1, t1); !seen.Equal(t0) {
+		t.Errorf("first seen %v != %v for the same deletion", seen, t0)
+	}
+	// Deleted again, after being recreated
+	if seen := repo.firstSeen("file", v2, t1); !seen.Equal(t1) {
+		t.Errorf("first seen %v != %v for a new deletion", seen, t1)
+	}
+}
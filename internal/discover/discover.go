@@ -29,7 +29,7 @@ type Discoverer struct {
 	cacheLifetime   time.Duration
 	negCacheCutoff  time.Duration
 	beacons         []beacon.Interface
-	extPort         uint16
+	extAddr         Address
 	localBcastTick  <-chan time.Time
 	forcedBcastTick chan time.Time
 
@@ -64,13 +64,16 @@ func NewDiscoverer(id protocol.DeviceID, addresses []string) *Discoverer {
 	}
 }
 
-func (d *Discoverer) StartLocal(localPort int, localMCAddr string) {
+// StartLocal starts the local announcements, broadcast over IPv4 to the given
+// port and multicast over IPv6 to the given group, crossing at most mcHops
+// routers (zero for the system default).
+func (d *Discoverer) StartLocal(localPort int, localMCAddr string, mcHops int) {
 	if localPort > 0 {
 		d.startLocalIPv4Broadcasts(localPort)
 	}
 
 	if len(localMCAddr) > 0 {
-		d.startLocalIPv6Multicasts(localMCAddr)
+		d.startLocalIPv6Multicasts(localMCAddr, mcHops)
 	}
 
 	if len(d.beacons) == 0 {
@@ -87,7 +90,7 @@ func (d *Discoverer) StartLocal(localPort int, localMCAddr string) {
 func (d *Discoverer) startLocalIPv4Broadcasts(localPort int) {
 	bb, err := beacon.NewBroadcast(localPort)
 	if err != nil {
-		if debug {
+		if debug.On() {
 			l.Debugln("discover: Start local v4:", err)
 		}
 		l.Infoln("Local discovery over IPv4 unavailable")
@@ -98,10 +101,10 @@ func (d *Discoverer) startLocalIPv4Broadcasts(localPort int) {
 	go d.recvAnnouncements(bb)
 }
 
-func (d *Discoverer) startLocalIPv6Multicasts(localMCAddr string) {
+func (d *Discoverer) startLocalIPv6Multicasts(localMCAddr string, mcHops int) {
 	intfs, err := net.Interfaces()
 	if err != nil {
-		if debug {
+		if debug.On() {
 			l.Debugln("discover: interfaces:", err)
 		}
 		l.Infoln("Local discovery over IPv6 unavailable")
@@ -114,9 +117,9 @@ func (d *Discoverer) startLocalIPv6Multicasts(localMCAddr string) {
 			continue
 		}
 
-		mb, err := beacon.NewMulticast(localMCAddr, intf.Name)
+		mb, err := beacon.NewMulticast(localMCAddr, intf.Name, mcHops)
 		if err != nil {
-			if debug {
+			if debug.On() {
 				l.Debugln("discover: Start local v6:", err)
 			}
 			continue
@@ -140,8 +143,46 @@ func (d *Discoverer) StartGlobal(servers []string, extPort uint16) {
 		d.stopGlobal()
 	}
 
-	d.extPort = extPort
-	pkt := d.announcementPkt()
+	d.extAddr = Address{Port: extPort}
+	d.startClients(servers, d.announcementPkt())
+}
+
+// StartGlobalExternal starts global discovery like StartGlobal, but
+// announcing the given external address. Without an IP, the discovery
+// servers use the one the announcements come from.
+func (d *Discoverer) StartGlobalExternal(servers []string, addr *net.TCPAddr) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	if len(d.clients) > 0 {
+		d.stopGlobal()
+	}
+
+	d.extAddr = Address{Port: uint16(addr.Port)}
+	if len(addr.IP) > 0 && !addr.IP.IsUnspecified() {
+		if bs := addr.IP.To4(); bs != nil {
+			d.extAddr.IP = bs
+		} else {
+			d.extAddr.IP = addr.IP.To16()
+		}
+	}
+	d.startClients(servers, d.announcementPkt())
+}
+
+// StartLookups creates clients for the global discovery servers that perform
+// lookups only, without announcing this device.
+func (d *Discoverer) StartLookups(servers []string) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	if len(d.clients) > 0 {
+		d.stopGlobal()
+	}
+
+	d.startClients(servers, nil)
+}
+
+func (d *Discoverer) startClients(servers []string, pkt *Announce) {
 	wg := sync.NewWaitGroup()
 	clients := make(chan Client, len(servers))
 	for _, address := range servers {
@@ -165,6 +206,14 @@ func (d *Discoverer) StartGlobal(servers []string, extPort uint16) {
 	}
 }
 
+// SetListenAddresses changes the addresses announced by local discovery, and
+// by global discovery the next time it is started without an external port.
+func (d *Discoverer) SetListenAddresses(addrs []string) {
+	d.mut.Lock()
+	d.listenAddrs = addrs
+	d.mut.Unlock()
+}
+
 func (d *Discoverer) StopGlobal() {
 	d.mut.Lock()
 	defer d.mut.Unlock()
@@ -260,6 +309,38 @@ func (d *Discoverer) Lookup(device protocol.DeviceID) []string {
 	return nil
 }
 
+// LookupEach asks every global discovery server about the device, bypassing
+// the cache, and returns the answer of each keyed by server address. The
+// result is not cached.
+func (d *Discoverer) LookupEach(device protocol.DeviceID) map[string][]string {
+	d.mut.RLock()
+	defer d.mut.RUnlock()
+
+	type result struct {
+		server string
+		addrs  []string
+	}
+
+	results := make(chan result, len(d.clients))
+	wg := sync.NewWaitGroup()
+	for _, client := range d.clients {
+		wg.Add(1)
+		go func(c Client) {
+			defer wg.Done()
+			results <- result{c.Address(), c.Lookup(device)}
+		}(client)
+	}
+
+	wg.Wait()
+	close(results)
+
+	res := make(map[string][]string, len(d.clients))
+	for r := range results {
+		res[r.server] = r.addrs
+	}
+	return res
+}
+
 func (d *Discoverer) Hint(device string, addrs []string) {
 	resAddrs := resolveAddrs(addrs)
 	var id protocol.DeviceID
@@ -284,15 +365,15 @@ func (d *Discoverer) All() map[protocol.DeviceID][]CacheEntry {
 
 func (d *Discoverer) announcementPkt() *Announce {
 	var addrs []Address
-	if d.extPort != 0 {
-		addrs = []Address{{Port: d.extPort}}
+	if d.extAddr.Port != 0 {
+		addrs = []Address{d.extAddr}
 	} else {
 		for _, astr := range d.listenAddrs {
 			addr, err := net.ResolveTCPAddr("tcp", astr)
 			if err != nil {
 				l.Warnln("discover: %v: not announcing %s", err, astr)
 				continue
-			} else if debug {
+			} else if debug.On() {
 				l.Debugf("discover: resolved %s as %#v", astr, addr)
 			}
 			if len(addr.IP) == 0 || addr.IP.IsUnspecified() {
@@ -311,15 +392,19 @@ func (d *Discoverer) announcementPkt() *Announce {
 }
 
 func (d *Discoverer) sendLocalAnnouncements() {
-	var addrs = resolveAddrs(d.listenAddrs)
+	for {
+		d.mut.RLock()
+		listenAddrs := d.listenAddrs
+		d.mut.RUnlock()
 
-	var pkt = Announce{
-		Magic: AnnouncementMagic,
-		This:  Device{d.myID[:], addrs},
-	}
-	msg := pkt.MustMarshalXDR()
+		var addrs = resolveAddrs(listenAddrs)
+
+		var pkt = Announce{
+			Magic: AnnouncementMagic,
+			This:  Device{d.myID[:], addrs},
+		}
+		msg := pkt.MustMarshalXDR()
 
-	for {
 		for _, b := range d.beacons {
 			b.Send(msg)
 		}
@@ -338,13 +423,13 @@ func (d *Discoverer) recvAnnouncements(b beacon.Interface) {
 		var pkt Announce
 		err := pkt.UnmarshalXDR(buf)
 		if err != nil && err != io.EOF {
-			if debug {
+			if debug.On() {
 				l.Debugf("discover: Failed to unmarshal local announcement from %s:\n%s", addr, hex.Dump(buf))
 			}
 			continue
 		}
 
-		if debug {
+		if debug.On() {
 			l.Debugf("discover: Received local announcement from %s for %s", addr, protocol.DeviceIDFromBytes(pkt.This.ID))
 		}
 
@@ -394,7 +479,7 @@ func (d *Discoverer) registerDevice(addr net.Addr, device Device) bool {
 	done:
 	}
 
-	if debug {
+	if debug.On() {
 		l.Debugf("discover: Caching %s addresses: %v", id, current)
 	}
 
@@ -417,7 +502,7 @@ func (d *Discoverer) registerDevice(addr net.Addr, device Device) bool {
 func (d *Discoverer) filterCached(c []CacheEntry) []CacheEntry {
 	for i := 0; i < len(c); {
 		if ago := time.Since(c[i].Seen); ago > d.cacheLifetime {
-			if debug {
+			if debug.On() {
 				l.Debugf("discover: Removing cached address %s - seen %v ago", c[i].Address, ago)
 			}
 			c[i] = c[len(c)-1]
@@ -7,6 +7,7 @@
 package discover
 
 import (
+	"net"
 	"net/url"
 	"time"
 
@@ -129,6 +130,20 @@ func TestGlobalDiscovery(t *testing.T) {
 		}
 	}
 
+	// LookupEach bypasses the cache and reports per server
+	each := d.LookupEach(device)
+	if len(each) != 3 {
+		t.Fatal("Wrong number of servers", each)
+	}
+	for _, c := range []*DummyClient{c1, c2, c3} {
+		if len(c.lookups) != 2 {
+			t.Fatal("Wrong lookups")
+		}
+		if len(each[c.url.String()]) != len(c.lookupRet) {
+			t.Fatal("Wrong result for", c.url, each[c.url.String()])
+		}
+	}
+
 	d.StopGlobal()
 
 	for _, c := range []*DummyClient{c1, c2, c3} {
@@ -137,3 +152,34 @@ func TestGlobalDiscovery(t *testing.T) {
 		}
 	}
 }
+
+func TestExternalAddress(t *testing.T) {
+	d := NewDiscoverer(device, []string{"0.0.0.0:22000"})
+
+	cases := []struct {
+		addr string
+		ip   string
+		port uint16
+	}{
+		{"192.0.2.1:22001", "192.0.2.1", 22001},
+		{"[2001:db8::1]:22002", "2001:db8::1", 22002},
+		{":22003", "", 22003},
+		{"0.0.0.0:22004", "", 22004},
+	}
+	for _, tc := range cases {
+		addr, err := net.ResolveTCPAddr("tcp", tc.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.StartGlobalExternal(nil, addr)
+
+		addrs := d.announcementPkt().This.Addresses
+		if len(addrs) != 1 || addrs[0].Port != tc.port {
+			t.Errorf("%s: unexpected addresses %v", tc.addr, addrs)
+			continue
+		}
+		if ip := net.IP(addrs[0].IP); tc.ip == "" && len(ip) != 0 || tc.ip != "" && !ip.Equal(net.ParseIP(tc.ip)) {
+			t.Errorf("%s: announced IP %v != %s", tc.addr, ip, tc.ip)
+		}
+	}
+}
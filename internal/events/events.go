@@ -35,6 +35,17 @@ const (
 	DownloadProgress
 	FolderSummary
 	FolderCompletion
+	AuthFailure
+	FolderChurning
+	ClockSkew
+	MeteredNetwork
+	LocalCorruption
+	FolderSecretMismatch
+	UpgradeRolledBack
+	IndexQuarantined
+	FilenameRejected
+	FolderMassChange
+	FolderSnapshot
 
 	AllEvents = (1 << iota) - 1
 )
@@ -75,6 +86,28 @@ func (t EventType) String() string {
 		return "FolderSummary"
 	case FolderCompletion:
 		return "FolderCompletion"
+	case AuthFailure:
+		return "AuthFailure"
+	case FolderChurning:
+		return "FolderChurning"
+	case ClockSkew:
+		return "ClockSkew"
+	case MeteredNetwork:
+		return "MeteredNetwork"
+	case LocalCorruption:
+		return "LocalCorruption"
+	case FolderSecretMismatch:
+		return "FolderSecretMismatch"
+	case UpgradeRolledBack:
+		return "UpgradeRolledBack"
+	case IndexQuarantined:
+		return "IndexQuarantined"
+	case FilenameRejected:
+		return "FilenameRejected"
+	case FolderMassChange:
+		return "FolderMassChange"
+	case FolderSnapshot:
+		return "FolderSnapshot"
 	default:
 		return "Unknown"
 	}
@@ -121,7 +154,7 @@ func NewLogger() *Logger {
 
 func (l *Logger) Log(t EventType, data interface{}) {
 	l.mutex.Lock()
-	if debug {
+	if debug.On() {
 		dl.Debugln("log", l.nextID, t.String(), data)
 	}
 	e := Event{
@@ -143,9 +176,20 @@ func (l *Logger) Log(t EventType, data interface{}) {
 	l.mutex.Unlock()
 }
 
+// SetNextID makes the IDs of the events logged from now on start at the given
+// ID, unless they are already past it. It is used to continue the IDs of
+// events kept from an earlier run.
+func (l *Logger) SetNextID(id int) {
+	l.mutex.Lock()
+	if id > l.nextID {
+		l.nextID = id
+	}
+	l.mutex.Unlock()
+}
+
 func (l *Logger) Subscribe(mask EventType) *Subscription {
 	l.mutex.Lock()
-	if debug {
+	if debug.On() {
 		dl.Debugln("subscribe", mask)
 	}
 	s := &Subscription{
@@ -161,7 +205,7 @@ func (l *Logger) Subscribe(mask EventType) *Subscription {
 
 func (l *Logger) Unsubscribe(s *Subscription) {
 	l.mutex.Lock()
-	if debug {
+	if debug.On() {
 		dl.Debugln("unsubscribe")
 	}
 	delete(l.subs, s.id)
@@ -170,7 +214,7 @@ func (l *Logger) Unsubscribe(s *Subscription) {
 }
 
 func (s *Subscription) Poll(timeout time.Duration) (Event, error) {
-	if debug {
+	if debug.On() {
 		dl.Debugln("poll", timeout)
 	}
 
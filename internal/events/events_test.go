@@ -150,6 +150,32 @@ func TestIDs(t *testing.T) {
 	}
 }
 
+func TestSetNextID(t *testing.T) {
+	l := events.NewLogger()
+
+	s := l.Subscribe(events.AllEvents)
+	l.SetNextID(1000)
+	l.Log(events.DeviceConnected, "foo")
+	l.SetNextID(10)
+	l.Log(events.DeviceConnected, "bar")
+
+	ev, err := s.Poll(timeout)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if ev.ID != 1000 {
+		t.Fatal("Incorrect ID:", ev.ID)
+	}
+
+	ev, err = s.Poll(timeout)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if ev.ID != 1001 {
+		t.Fatal("ID should not decrease:", ev.ID)
+	}
+}
+
 func TestBufferedSub(t *testing.T) {
 	l := events.NewLogger()
 
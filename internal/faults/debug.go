@@ -0,0 +1,24 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package faults
+
+import (
+	"os"
+	"strings"
+
+	"github.com/calmh/logger"
+	"github.com/syncthing/syncthing/internal/trace"
+)
+
+var (
+	debug = trace.NewFlag(strings.Contains(os.Getenv("STTRACE"), "faults") || os.Getenv("STTRACE") == "all")
+	l     = logger.DefaultLogger
+)
+
+func init() {
+	trace.Register("faults", "The faults package; injected faults", debug)
+}
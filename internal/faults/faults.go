@@ -0,0 +1,170 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package faults implements injection of network and disk faults, to
+// exercise error handling in integration tests. Faults are configured with
+// the STFAULTS environment variable and are never enabled by default.
+package faults
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Default is the fault configuration given by the STFAULTS environment
+// variable.
+var Default Config
+
+func init() {
+	cfg, err := Parse(os.Getenv("STFAULTS"))
+	if err != nil {
+		l.Warnln("STFAULTS:", err)
+		return
+	}
+	if cfg.Enabled() {
+		l.Warnf("Injecting faults: %v", cfg)
+	}
+	Default = cfg
+}
+
+// Config describes which faults to inject. The probabilities are per write
+// and in the range 0 to 1.
+type Config struct {
+	Drop     float64       // close the connection instead of writing
+	Truncate float64       // write part of the data, then close the connection
+	Delay    time.Duration // random delay, up to this long, before each write
+	DiskFull float64       // fail temporary file writes with ENOSPC
+}
+
+// Parse parses a comma separated list of key=value pairs, such as
+// "drop=0.01,truncate=0.01,delay=500ms,diskfull=0.05".
+func Parse(s string) (Config, error) {
+	var cfg Config
+	if s == "" {
+		return cfg, nil
+	}
+
+	for _, field := range strings.Split(s, ",") {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return Config{}, fmt.Errorf("missing value in %q", field)
+		}
+		key, val := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+
+		var err error
+		switch key {
+		case "drop":
+			cfg.Drop, err = parseProbability(val)
+		case "truncate":
+			cfg.Truncate, err = parseProbability(val)
+		case "diskfull":
+			cfg.DiskFull, err = parseProbability(val)
+		case "delay":
+			cfg.Delay, err = time.ParseDuration(val)
+		default:
+			err = errors.New("unknown fault")
+		}
+		if err != nil {
+			return Config{}, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+
+	return cfg, nil
+}
+
+func parseProbability(s string) (float64, error) {
+	p, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if p < 0 || p > 1 {
+		return 0, errors.New("probability out of range")
+	}
+	return p, nil
+}
+
+// Enabled returns true if any fault is configured.
+func (c Config) Enabled() bool {
+	return c != Config{}
+}
+
+func (c Config) String() string {
+	return fmt.Sprintf("drop=%g,truncate=%g,delay=%v,diskfull=%g", c.Drop, c.Truncate, c.Delay, c.DiskFull)
+}
+
+// Writer returns a writer that injects the configured connection faults
+// before passing writes on to w. Dropping or truncating closes c. If no
+// connection faults are configured, w is returned as is.
+func (c Config) Writer(w io.Writer, cl io.Closer) io.Writer {
+	if c.Drop == 0 && c.Truncate == 0 && c.Delay == 0 {
+		return w
+	}
+	return &faultyWriter{c, w, cl}
+}
+
+// WriterAt returns a writer that fails writes with ENOSPC according to the
+// configured probability, and passes them on to w otherwise. If no disk
+// faults are configured, w is returned as is.
+func (c Config) WriterAt(w io.WriterAt) io.WriterAt {
+	if c.DiskFull == 0 {
+		return w
+	}
+	return &faultyWriterAt{c, w}
+}
+
+type faultyWriter struct {
+	cfg Config
+	w   io.Writer
+	cl  io.Closer
+}
+
+func (w *faultyWriter) Write(bs []byte) (int, error) {
+	if w.cfg.Delay > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(w.cfg.Delay))))
+	}
+
+	if rand.Float64() < w.cfg.Drop {
+		if debug.On() {
+			l.Debugln("injected fault: dropping connection")
+		}
+		w.cl.Close()
+		return 0, io.ErrClosedPipe
+	}
+
+	if len(bs) > 1 && rand.Float64() < w.cfg.Truncate {
+		n := 1 + rand.Intn(len(bs)-1)
+		if debug.On() {
+			l.Debugf("injected fault: truncating write of %d bytes to %d", len(bs), n)
+		}
+		n, _ = w.w.Write(bs[:n])
+		w.cl.Close()
+		return n, io.ErrShortWrite
+	}
+
+	return w.w.Write(bs)
+}
+
+type faultyWriterAt struct {
+	cfg Config
+	w   io.WriterAt
+}
+
+func (w *faultyWriterAt) WriteAt(bs []byte, off int64) (int, error) {
+	if rand.Float64() < w.cfg.DiskFull {
+		if debug.On() {
+			l.Debugf("injected fault: disk full writing %d bytes at %d", len(bs), off)
+		}
+		return 0, syscall.ENOSPC
+	}
+	return w.w.WriteAt(bs, off)
+}
@@ -0,0 +1,106 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package faults
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		in  string
+		cfg Config
+		ok  bool
+	}{
+		{"", Config{}, true},
+		{"drop=0.1", Config{Drop: 0.1}, true},
+		{"drop=0.1, truncate=0.2,delay=50ms,diskfull=1", Config{Drop: 0.1, Truncate: 0.2, Delay: 50 * time.Millisecond, DiskFull: 1}, true},
+		{"drop", Config{}, false},
+		{"drop=2", Config{}, false},
+		{"delay=soon", Config{}, false},
+		{"explode=0.5", Config{}, false},
+	}
+
+	for _, tc := range cases {
+		cfg, err := Parse(tc.in)
+		if (err == nil) != tc.ok {
+			t.Errorf("%q: unexpected error %v", tc.in, err)
+		}
+		if cfg != tc.cfg {
+			t.Errorf("%q: %v != %v", tc.in, cfg, tc.cfg)
+		}
+	}
+}
+
+type closeRecorder struct {
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestWriterDrop(t *testing.T) {
+	var buf bytes.Buffer
+	var cl closeRecorder
+	w := Config{Drop: 1}.Writer(&buf, &cl)
+
+	if _, err := w.Write([]byte("hello")); err == nil {
+		t.Error("unexpected nil error")
+	}
+	if !cl.closed {
+		t.Error("connection not closed")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("unexpected write of %d bytes", buf.Len())
+	}
+}
+
+func TestWriterTruncate(t *testing.T) {
+	var buf bytes.Buffer
+	var cl closeRecorder
+	w := Config{Truncate: 1}.Writer(&buf, &cl)
+
+	n, err := w.Write([]byte("hello"))
+	if err != io.ErrShortWrite {
+		t.Errorf("unexpected error %v", err)
+	}
+	if n < 1 || n >= 5 || buf.Len() != n {
+		t.Errorf("unexpected write of %d (%d) bytes", n, buf.Len())
+	}
+	if !cl.closed {
+		t.Error("connection not closed")
+	}
+}
+
+func TestWriterAtDiskFull(t *testing.T) {
+	fd, err := ioutil.TempFile("", "faults")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	defer fd.Close()
+
+	w := Config{DiskFull: 1}.WriterAt(fd)
+	if _, err := w.WriteAt([]byte("hello"), 0); err != syscall.ENOSPC {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestNoFaults(t *testing.T) {
+	var buf bytes.Buffer
+	if w := (Config{}).Writer(&buf, &closeRecorder{}); w != io.Writer(&buf) {
+		t.Error("writer wrapped without faults")
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ignore
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+// ConvertGitignore converts the contents of a .gitignore file to ignore
+// patterns. The dir is the directory of the .gitignore file relative to the
+// folder root, slash separated; empty for the root. In a .gitignore the last
+// matching line wins while we use the first matching pattern, so the
+// patterns are returned in reverse order.
+//
+// Patterns for directories only ("foo/") also match files of the same name,
+// as we can't tell the difference.
+func ConvertGitignore(r io.Reader, dir string) ([]string, error) {
+	var patterns []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		neg := ""
+		if strings.HasPrefix(line, "!") {
+			neg = "!"
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+			line = line[1:]
+		}
+
+		line = strings.TrimSuffix(line, "/")
+		if line == "" {
+			continue
+		}
+
+		// A pattern with a slash is relative to the directory of the
+		// .gitignore, one without (or starting with **/) matches at any
+		// depth below it.
+		anchored := strings.Contains(line, "/")
+		if strings.HasPrefix(line, "**/") {
+			line = line[3:]
+			anchored = false
+		}
+		line = strings.TrimPrefix(line, "/")
+
+		switch {
+		case anchored:
+			patterns = append(patterns, neg+"/"+path.Join(dir, line))
+		case dir == "" && strings.Contains(line, "/"):
+			patterns = append(patterns, neg+"**/"+line)
+		case dir == "":
+			patterns = append(patterns, neg+line)
+		default:
+			patterns = append(patterns, neg+"/"+path.Join(dir, "**", line))
+			patterns = append(patterns, neg+"/"+path.Join(dir, line))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(patterns)-1; i < j; i, j = i+1, j-1 {
+		patterns[i], patterns[j] = patterns[j], patterns[i]
+	}
+	return patterns, nil
+}
+
+// GitignorePatterns returns the patterns converted from all .gitignore files
+// under root. The patterns of deeper .gitignore files come first, as they
+// take precedence.
+func GitignorePatterns(root string) ([]string, error) {
+	return NewGitignoreCache(root).Patterns()
+}
+
+// A GitignoreCache keeps the patterns converted from the .gitignore files
+// under a root, so that the tree is walked for them only once. After that,
+// the .gitignore files known are read again when their modification time or
+// size changed, and new ones are added as the scanner finds them.
+type GitignoreCache struct {
+	root   string
+	walked bool
+	files  map[string]*gitignoreFile // by slash separated directory; empty for the root
+	mut    sync.Mutex
+}
+
+type gitignoreFile struct {
+	modTime  time.Time
+	size     int64
+	patterns []string
+}
+
+func NewGitignoreCache(root string) *GitignoreCache {
+	return &GitignoreCache{
+		root:  root,
+		files: make(map[string]*gitignoreFile),
+		mut:   sync.NewMutex(),
+	}
+}
+
+// Add makes the .gitignore file of the given name, relative to the root, one
+// of those whose patterns are returned.
+func (c *GitignoreCache) Add(name string) {
+	dir := filepath.ToSlash(filepath.Dir(name))
+	if dir == "." {
+		dir = ""
+	}
+	c.mut.Lock()
+	if _, ok := c.files[dir]; !ok {
+		c.files[dir] = &gitignoreFile{}
+	}
+	c.mut.Unlock()
+}
+
+// Patterns returns the patterns converted from the .gitignore files, as
+// GitignorePatterns does.
+func (c *GitignoreCache) Patterns() ([]string, error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if !c.walked {
+		if err := c.walk(); err != nil {
+			return nil, err
+		}
+		c.walked = true
+	}
+
+	dirs := make([]string, 0, len(c.files))
+	for dir, f := range c.files {
+		info, err := os.Stat(filepath.Join(c.root, filepath.FromSlash(dir), ".gitignore"))
+		if os.IsNotExist(err) {
+			delete(c.files, dir)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if !info.ModTime().Equal(f.modTime) || info.Size() != f.size {
+			if f.patterns, err = readGitignore(c.root, dir); err != nil {
+				return nil, err
+			}
+			f.modTime = info.ModTime()
+			f.size = info.Size()
+		}
+		dirs = append(dirs, dir)
+	}
+
+	sort.Sort(byDepth(dirs))
+
+	var patterns []string
+	for _, dir := range dirs {
+		patterns = append(patterns, c.files[dir].patterns...)
+	}
+	return patterns, nil
+}
+
+func (c *GitignoreCache) walk() error {
+	return filepath.Walk(c.root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() && info.Name() == ".gitignore" {
+			rel, err := filepath.Rel(c.root, filepath.Dir(p))
+			if err != nil {
+				return err
+			}
+			if rel = filepath.ToSlash(rel); rel == "." {
+				rel = ""
+			}
+			if _, ok := c.files[rel]; !ok {
+				c.files[rel] = &gitignoreFile{}
+			}
+		}
+		return nil
+	})
+}
+
+func readGitignore(root, dir string) ([]string, error) {
+	fd, err := os.Open(filepath.Join(root, filepath.FromSlash(dir), ".gitignore"))
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return ConvertGitignore(fd, dir)
+}
+
+// byDepth sorts slash separated directories deepest first.
+type byDepth []string
+
+func (l byDepth) Len() int {
+	return len(l)
+}
+
+func (l byDepth) Swap(a, b int) {
+	l[a], l[b] = l[b], l[a]
+}
+
+func (l byDepth) Less(a, b int) bool {
+	da, db := depth(l[a]), depth(l[b])
+	if da != db {
+		return da > db
+	}
+	return l[a] < l[b]
+}
+
+func depth(dir string) int {
+	if dir == "" {
+		return 0
+	}
+	return strings.Count(dir, "/") + 1
+}
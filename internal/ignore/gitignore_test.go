@@ -0,0 +1,150 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ignore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConvertGitignore(t *testing.T) {
+	gitignore := `
+# comment
+*.o
+/build/
+doc/*.html
+!keep.o
+**/tmp
+\#hash
+`
+	cases := []struct {
+		dir      string
+		patterns []string
+	}{
+		{"", []string{"#hash", "tmp", "!keep.o", "/doc/*.html", "/build", "*.o"}},
+		{"sub/dir", []string{
+			"/sub/dir/#hash", "/sub/dir/**/#hash",
+			"/sub/dir/tmp", "/sub/dir/**/tmp",
+			"!/sub/dir/keep.o", "!/sub/dir/**/keep.o",
+			"/sub/dir/doc/*.html",
+			"/sub/dir/build",
+			"/sub/dir/*.o", "/sub/dir/**/*.o",
+		}},
+	}
+	for _, tc := range cases {
+		patterns, err := ConvertGitignore(bytes.NewBufferString(gitignore), tc.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(patterns, tc.patterns) {
+			t.Errorf("%q: patterns %q != expected %q", tc.dir, patterns, tc.patterns)
+		}
+	}
+}
+
+func TestGitignorePatterns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		".stignore":          "!important.log\n",
+		".gitignore":         "*.log\nbin/\n",
+		"src/.gitignore":     "!debug.log\n/gen\n",
+		".git/.gitignore":    "*\n",
+		"src/lib/.gitignore": "*.a\n",
+	}
+	for name, content := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(name), 0755)
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	patterns, err := GitignorePatterns(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pats := New(false)
+	if err := pats.LoadWith(filepath.Join(dir, ".stignore"), nil, patterns); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		f string
+		r bool
+	}{
+		{"a.log", true},
+		{"important.log", false},
+		{filepath.Join("src", "a.log"), true},
+		{filepath.Join("src", "x", "debug.log"), false},
+		{"debug.log", true},
+		{filepath.Join("bin", "app"), true},
+		{filepath.Join("src", "gen", "file.go"), true},
+		{filepath.Join("src", "x", "gen"), false},
+		{"gen", false},
+		{filepath.Join("src", "lib", "x.a"), true},
+		{filepath.Join("src", "x.a"), false},
+		{"main.go", false},
+	}
+	for _, tc := range tests {
+		if r := pats.Match(tc.f); r != tc.r {
+			t.Errorf("Incorrect match for %s; E: %v, A: %v", tc.f, tc.r, r)
+		}
+	}
+}
+
+func TestGitignoreCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string, mtime time.Time) {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(name), 0755)
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(name, mtime, mtime)
+	}
+	check := func(c *GitignoreCache, expected []string) {
+		patterns, err := c.Patterns()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(patterns, expected) {
+			t.Errorf("Patterns %q != expected %q", patterns, expected)
+		}
+	}
+
+	t0 := time.Now().Add(-time.Hour)
+	write(".gitignore", "*.o\n", t0)
+	c := NewGitignoreCache(dir)
+	check(c, []string{"*.o"})
+
+	// A new .gitignore is only looked at once added, as the tree isn't
+	// walked again.
+	write("sub/.gitignore", "*.a\n", t0)
+	check(c, []string{"*.o"})
+	c.Add(filepath.Join("sub", ".gitignore"))
+	check(c, []string{"/sub/*.a", "/sub/**/*.a", "*.o"})
+
+	// A changed one is read again, a removed one forgotten.
+	write(".gitignore", "*.so\n", t0.Add(time.Minute))
+	os.Remove(filepath.Join(dir, "sub", ".gitignore"))
+	check(c, []string{"*.so"})
+}
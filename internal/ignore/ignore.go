@@ -12,6 +12,7 @@ import (
 	"crypto/md5"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -69,6 +70,28 @@ func (m *Matcher) Load(file string) error {
 	return m.Parse(fd, file)
 }
 
+// LoadWith is like Load, but adds the given patterns before and after those
+// in the file. The patterns before take precedence over the file, which takes
+// precedence over the patterns after.
+func (m *Matcher) LoadWith(file string, before, after []string) error {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		m.Parse(&bytes.Buffer{}, file)
+		return err
+	}
+
+	var buf bytes.Buffer
+	for _, line := range before {
+		buf.WriteString(line + "\n")
+	}
+	buf.Write(bs)
+	buf.WriteString("\n")
+	for _, line := range after {
+		buf.WriteString(line + "\n")
+	}
+	return m.Parse(&buf, file)
+}
+
 func (m *Matcher) Parse(r io.Reader, file string) error {
 	m.mut.Lock()
 	defer m.mut.Unlock()
@@ -0,0 +1,290 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package ldap implements the small part of the LDAPv3 protocol (RFC 4511)
+// needed to verify passwords: simple binds, compare operations for group
+// membership checks and StartTLS.
+package ldap
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// The result codes we care about.
+const (
+	resultSuccess      = 0
+	resultCompareFalse = 5
+	resultCompareTrue  = 6
+)
+
+// The BER tags of the protocol operations.
+const (
+	tagBindRequest      = 0x60
+	tagBindResponse     = 0x61
+	tagUnbindRequest    = 0x42
+	tagCompareRequest   = 0x6e
+	tagCompareResponse  = 0x6f
+	tagExtendedRequest  = 0x77
+	tagExtendedResponse = 0x78
+)
+
+const startTLSOID = "1.3.6.1.4.1.1466.20037"
+
+// The longest we wait for the server to respond to an operation.
+const timeout = 10 * time.Second
+
+// A ResultError is an operation refused by the server.
+type ResultError struct {
+	Code    int
+	Message string
+}
+
+func (e ResultError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("ldap: result code %d", e.Code)
+	}
+	return fmt.Sprintf("ldap: result code %d: %s", e.Code, e.Message)
+}
+
+var errMalformed = errors.New("ldap: malformed response")
+
+// A Conn is a connection to an LDAP server. It is not safe for concurrent
+// use.
+type Conn struct {
+	conn  net.Conn
+	msgID int
+}
+
+// Dial connects to the LDAP server at the address. The connection is
+// wrapped in TLS if a TLS configuration is given.
+func Dial(addr string, tlsCfg *tls.Config) (*Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if tlsCfg != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsCfg)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{conn: conn}, nil
+}
+
+// StartTLS upgrades the connection to TLS.
+func (c *Conn) StartTLS(tlsCfg *tls.Config) error {
+	req := berTLV(0x80, []byte(startTLSOID))
+	if _, err := c.do(tagExtendedRequest, req, tagExtendedResponse); err != nil {
+		return err
+	}
+	tc := tls.Client(c.conn, tlsCfg)
+	tc.SetDeadline(time.Now().Add(timeout))
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	c.conn = tc
+	return nil
+}
+
+// Bind authenticates as the given DN with the password. Empty passwords are
+// refused, as the server would take them as an anonymous bind and succeed.
+func (c *Conn) Bind(dn, password string) error {
+	if password == "" {
+		return errors.New("ldap: empty password")
+	}
+	var req bytes.Buffer
+	req.Write(berInt(3))
+	req.Write(berString(dn))
+	req.Write(berTLV(0x80, []byte(password)))
+	_, err := c.do(tagBindRequest, req.Bytes(), tagBindResponse)
+	return err
+}
+
+// Compare returns whether the entry with the given DN has the attribute
+// value.
+func (c *Conn) Compare(dn, attr, value string) (bool, error) {
+	var ava bytes.Buffer
+	ava.Write(berString(attr))
+	ava.Write(berString(value))
+
+	var req bytes.Buffer
+	req.Write(berString(dn))
+	req.Write(berTLV(0x30, ava.Bytes()))
+
+	code, err := c.do(tagCompareRequest, req.Bytes(), tagCompareResponse)
+	switch {
+	case code == resultCompareTrue:
+		return true, nil
+	case code == resultCompareFalse:
+		return false, nil
+	case err != nil:
+		return false, err
+	default:
+		return false, ResultError{Code: code}
+	}
+}
+
+// Close unbinds and closes the connection.
+func (c *Conn) Close() error {
+	c.msgID++
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	c.conn.Write(berMessage(c.msgID, berTLV(tagUnbindRequest, nil)))
+	return c.conn.Close()
+}
+
+// do sends the request and reads the response, returning its result code.
+// An error is returned for any result other than success, compareTrue and
+// compareFalse.
+func (c *Conn) do(reqTag byte, req []byte, respTag byte) (int, error) {
+	c.msgID++
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := c.conn.Write(berMessage(c.msgID, berTLV(reqTag, req))); err != nil {
+		return 0, err
+	}
+
+	tag, msg, err := readTLV(c.conn)
+	if err != nil {
+		return 0, err
+	}
+	if tag != 0x30 {
+		return 0, errMalformed
+	}
+
+	r := bytes.NewReader(msg)
+	tag, id, err := readTLV(r)
+	if err != nil || tag != 0x02 || berParseInt(id) != c.msgID {
+		return 0, errMalformed
+	}
+	tag, op, err := readTLV(r)
+	if err != nil || tag != respTag {
+		return 0, errMalformed
+	}
+
+	// LDAPResult ::= resultCode, matchedDN, diagnosticMessage, ...
+	r = bytes.NewReader(op)
+	tag, codeBs, err := readTLV(r)
+	if err != nil || tag != 0x0a {
+		return 0, errMalformed
+	}
+	code := berParseInt(codeBs)
+	var message []byte
+	if _, _, err := readTLV(r); err == nil {
+		_, message, _ = readTLV(r)
+	}
+
+	switch code {
+	case resultSuccess, resultCompareTrue, resultCompareFalse:
+		return code, nil
+	default:
+		return code, ResultError{Code: code, Message: string(message)}
+	}
+}
+
+// EscapeDN escapes a value to be used as an attribute value in a
+// distinguished name (RFC 4514).
+func EscapeDN(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case strings.IndexByte(`,+"\<>;=`, ch) >= 0,
+			ch == '#' && i == 0,
+			ch == ' ' && (i == 0 || i == len(s)-1):
+			buf.WriteByte('\\')
+			buf.WriteByte(ch)
+		case ch < 0x20 || ch == 0x7f:
+			fmt.Fprintf(&buf, "\\%02x", ch)
+		default:
+			buf.WriteByte(ch)
+		}
+	}
+	return buf.String()
+}
+
+func berMessage(id int, op []byte) []byte {
+	var msg bytes.Buffer
+	msg.Write(berInt(id))
+	msg.Write(op)
+	return berTLV(0x30, msg.Bytes())
+}
+
+func berTLV(tag byte, value []byte) []byte {
+	buf := []byte{tag}
+	switch l := len(value); {
+	case l < 0x80:
+		buf = append(buf, byte(l))
+	case l < 0x100:
+		buf = append(buf, 0x81, byte(l))
+	case l < 0x10000:
+		buf = append(buf, 0x82, byte(l>>8), byte(l))
+	default:
+		buf = append(buf, 0x84, byte(l>>24), byte(l>>16), byte(l>>8), byte(l))
+	}
+	return append(buf, value...)
+}
+
+func berString(s string) []byte {
+	return berTLV(0x04, []byte(s))
+}
+
+func berInt(v int) []byte {
+	// Minimal two's complement encoding; we only send small non-negative
+	// integers.
+	bs := []byte{byte(v)}
+	for v >>= 8; v > 0; v >>= 8 {
+		bs = append([]byte{byte(v)}, bs...)
+	}
+	if bs[0]&0x80 != 0 {
+		bs = append([]byte{0}, bs...)
+	}
+	return berTLV(0x02, bs)
+}
+
+func berParseInt(bs []byte) int {
+	var v int
+	for _, b := range bs {
+		v = v<<8 | int(b)
+	}
+	return v
+}
+
+// The largest message we accept from the server.
+const maxMessageSize = 1 << 20
+
+func readTLV(r io.Reader) (byte, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	l := int(hdr[1])
+	if l&0x80 != 0 {
+		n := l & 0x7f
+		if n == 0 || n > 4 {
+			return 0, nil, errMalformed
+		}
+		lbs := make([]byte, n)
+		if _, err := io.ReadFull(r, lbs); err != nil {
+			return 0, nil, err
+		}
+		l = berParseInt(lbs)
+	}
+	if l > maxMessageSize {
+		return 0, nil, errMalformed
+	}
+	value := make([]byte, l)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], value, nil
+}
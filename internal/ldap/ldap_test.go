@@ -0,0 +1,121 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ldap
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// fakeServer answers binds as uid=user,dc=example with the password "pass"
+// and compares of member=uid=user,dc=example on any entry.
+func fakeServer(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	for {
+		tag, msg, err := readTLV(conn)
+		if err != nil || tag != 0x30 {
+			return
+		}
+		r := bytes.NewReader(msg)
+		_, id, _ := readTLV(r)
+		tag, op, _ := readTLV(r)
+
+		var respTag byte
+		code := resultSuccess
+		switch tag {
+		case tagBindRequest:
+			respTag = tagBindResponse
+			r := bytes.NewReader(op)
+			readTLV(r)
+			_, dn, _ := readTLV(r)
+			_, password, _ := readTLV(r)
+			if string(dn) != "uid=user,dc=example" || string(password) != "pass" {
+				code = 49 // invalidCredentials
+			}
+		case tagCompareRequest:
+			respTag = tagCompareResponse
+			r := bytes.NewReader(op)
+			readTLV(r)
+			_, ava, _ := readTLV(r)
+			r = bytes.NewReader(ava)
+			_, attr, _ := readTLV(r)
+			_, value, _ := readTLV(r)
+			code = resultCompareFalse
+			if string(attr) == "member" && string(value) == "uid=user,dc=example" {
+				code = resultCompareTrue
+			}
+		default:
+			return
+		}
+
+		var result bytes.Buffer
+		result.Write(berTLV(0x0a, []byte{byte(code)}))
+		result.Write(berString(""))
+		result.Write(berString(""))
+		var resp bytes.Buffer
+		resp.Write(berTLV(0x02, id))
+		resp.Write(berTLV(respTag, result.Bytes()))
+		if _, err := conn.Write(berTLV(0x30, resp.Bytes())); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+}
+
+func TestBindAndCompare(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeServer(t, server)
+	c := &Conn{conn: client}
+	defer c.Close()
+
+	if err := c.Bind("uid=user,dc=example", "wrong"); err == nil {
+		t.Error("bind with the wrong password succeeded")
+	} else if rerr, ok := err.(ResultError); !ok || rerr.Code != 49 {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := c.Bind("uid=user,dc=example", ""); err == nil {
+		t.Error("bind with an empty password succeeded")
+	}
+	if err := c.Bind("uid=user,dc=example", "pass"); err != nil {
+		t.Error(err)
+	}
+
+	if ok, err := c.Compare("cn=syncthing,dc=example", "member", "uid=user,dc=example"); err != nil || !ok {
+		t.Errorf("unexpected compare result %v, %v", ok, err)
+	}
+	if ok, err := c.Compare("cn=syncthing,dc=example", "member", "uid=other,dc=example"); err != nil || ok {
+		t.Errorf("unexpected compare result %v, %v", ok, err)
+	}
+}
+
+func TestEscapeDN(t *testing.T) {
+	cases := []struct {
+		in, out string
+	}{
+		{"user", "user"},
+		{"Doe, John", `Doe\, John`},
+		{"a+b=c", `a\+b\=c`},
+		{" #x ", `\ #x\ `},
+		{"#x", `\#x`},
+		{"a\x00b", `a\00b`},
+	}
+	for _, tc := range cases {
+		if out := EscapeDN(tc.in); out != tc.out {
+			t.Errorf("%q: %q != expected %q", tc.in, out, tc.out)
+		}
+	}
+}
+
+func TestBERLength(t *testing.T) {
+	for _, l := range []int{0, 0x7f, 0x80, 0xff, 0x100, 0x10000} {
+		tag, value, err := readTLV(bytes.NewReader(berTLV(0x04, make([]byte, l))))
+		if err != nil || tag != 0x04 || len(value) != l {
+			t.Errorf("%d: unexpected %x, %d, %v", l, tag, len(value), err)
+		}
+	}
+}
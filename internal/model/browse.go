@@ -0,0 +1,240 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/osutil"
+)
+
+// remoteBrowseOption is announced in the cluster config to tell other
+// devices that we keep the index they send for folders we have not (yet)
+// accepted, so that the user can browse it before accepting the folder.
+const remoteBrowseOption = "remoteBrowse"
+
+// maxBrowseFiles limits the number of entries kept for each folder we have
+// not accepted, as these are kept in memory.
+const maxBrowseFiles = 100000
+
+// A browseIndex is the index a device has sent for a folder we have not
+// accepted, reduced to what is needed to show the directory tree.
+type browseIndex map[string]db.FileInfoTruncated // name -> file
+
+// updateBrowseIndex records the index sent by a device for a folder that is
+// not shared with it. A full index replaces the previously recorded one.
+func (m *Model) updateBrowseIndex(deviceID protocol.DeviceID, folder string, fs []protocol.FileInfo, full bool) {
+	m.bmut.Lock()
+	defer m.bmut.Unlock()
+
+	folders, ok := m.browseIndexes[deviceID]
+	if !ok {
+		folders = make(map[string]browseIndex)
+		m.browseIndexes[deviceID] = folders
+	}
+	idx, ok := folders[folder]
+	if !ok || full {
+		idx = make(browseIndex)
+		folders[folder] = idx
+	}
+
+	for _, f := range fs {
+		if f.IsDeleted() || f.IsInvalid() {
+			delete(idx, f.Name)
+			continue
+		}
+		if _, ok := idx[f.Name]; !ok && len(idx) >= maxBrowseFiles {
+			if debug.On() {
+				l.Debugf("browse index for %s %q full; dropping %q", deviceID, folder, f.Name)
+			}
+			continue
+		}
+		idx[f.Name] = db.FileInfoTruncated{
+			FileInfo: protocol.FileInfo{
+				Name:     f.Name,
+				Flags:    f.Flags,
+				Modified: f.Modified,
+			},
+			ActualSize: f.Size(),
+		}
+	}
+}
+
+// RemoteDirectoryTree returns the directory tree of the folder as announced
+// by the given device, in the same format as GlobalDirectoryTree. This works
+// for folders we share with the device as well as for folders the device
+// shares with us that we have not accepted. Returns false if we have no
+// index for the folder from the device.
+func (m *Model) RemoteDirectoryTree(deviceID protocol.DeviceID, folder, prefix string, levels int, dirsonly bool) (map[string]interface{}, bool) {
+	output := make(map[string]interface{})
+	sep := string(filepath.Separator)
+	prefix = osutil.NativeFilename(prefix)
+
+	if prefix != "" && !strings.HasSuffix(prefix, sep) {
+		prefix = prefix + sep
+	}
+
+	if m.folderSharedWith(folder, deviceID) {
+		m.fmut.RLock()
+		files := m.folderFiles[folder]
+		m.fmut.RUnlock()
+
+		files.WithPrefixedHaveTruncated(deviceID, prefix, func(fi db.FileIntf) bool {
+			addToDirectoryTree(output, fi.(db.FileInfoTruncated), prefix, levels, dirsonly)
+			return true
+		})
+		return output, true
+	}
+
+	m.bmut.Lock()
+	defer m.bmut.Unlock()
+
+	idx, ok := m.browseIndexes[deviceID][folder]
+	if !ok {
+		return nil, false
+	}
+	for name, f := range idx {
+		if strings.HasPrefix(name, prefix) {
+			addToDirectoryTree(output, f, prefix, levels, dirsonly)
+		}
+	}
+	return output, true
+}
+
+// A BrowseEntry is a file or directory in a listing of the global view of a
+// folder.
+type BrowseEntry struct {
+	Name     string              `json:"name"`
+	Type     string              `json:"type"` // "file", "directory" or "symlink"
+	Size     int64               `json:"size"`
+	Modified time.Time           `json:"modified"`
+	Devices  []protocol.DeviceID `json:"devices"` // devices holding the global version, including ourselves
+	State    string              `json:"state"`   // "synced", "needed" or "invalid" (ignored or not present locally on purpose)
+}
+
+// GlobalDirectoryListing returns a page of the entries directly in the given
+// directory of the global view of the folder, sorted by "name", "size" or
+// "modified" with directories first, and the total number of entries.
+// Returns false if there is no such folder.
+func (m *Model) GlobalDirectoryListing(folder, prefix, sortBy string, desc bool, page, perpage int) ([]BrowseEntry, int, bool) {
+	m.fmut.RLock()
+	files, ok := m.folderFiles[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return nil, 0, false
+	}
+
+	sep := string(filepath.Separator)
+	prefix = osutil.NativeFilename(prefix)
+	if prefix != "" && !strings.HasSuffix(prefix, sep) {
+		prefix = prefix + sep
+	}
+
+	var entries []BrowseEntry
+	files.WithPrefixedGlobalTruncated(prefix, func(fi db.FileIntf) bool {
+		f := fi.(db.FileInfoTruncated)
+		if f.IsInvalid() || f.IsDeleted() || f.Name == prefix {
+			return true
+		}
+		name := strings.TrimPrefix(f.Name, prefix)
+		if strings.Contains(name, sep) {
+			return true
+		}
+
+		entry := BrowseEntry{
+			Name:     name,
+			Type:     "file",
+			Size:     f.Size(),
+			Modified: time.Unix(f.Modified, 0),
+		}
+		switch {
+		case f.IsSymlink():
+			entry.Type = "symlink"
+		case f.IsDirectory():
+			entry.Type = "directory"
+		}
+		entries = append(entries, entry)
+		return true
+	})
+
+	sort.Sort(browseEntries{entries, sortBy, desc})
+
+	total := len(entries)
+	start := (page - 1) * perpage
+	if start >= total {
+		return []BrowseEntry{}, total, true
+	}
+	end := start + perpage
+	if end > total {
+		end = total
+	}
+	entries = entries[start:end]
+
+	// Looking up availability and local state takes a database lookup per
+	// file, so only do it for the requested page.
+	for i := range entries {
+		name := prefix + entries[i].Name
+		entries[i].State = "needed"
+		local, hasLocal := files.Get(protocol.LocalDeviceID, name)
+		if hasLocal && local.IsInvalid() {
+			entries[i].State = "invalid"
+		}
+		entries[i].Devices = []protocol.DeviceID{}
+		for _, device := range files.Availability(name) {
+			if device == protocol.LocalDeviceID {
+				if !hasLocal || local.IsInvalid() {
+					continue
+				}
+				device = m.id
+				entries[i].State = "synced"
+			}
+			entries[i].Devices = append(entries[i].Devices, device)
+		}
+	}
+
+	return entries, total, true
+}
+
+type browseEntries struct {
+	entries []BrowseEntry
+	sortBy  string
+	desc    bool
+}
+
+func (s browseEntries) Len() int {
+	return len(s.entries)
+}
+
+func (s browseEntries) Swap(i, j int) {
+	s.entries[i], s.entries[j] = s.entries[j], s.entries[i]
+}
+
+func (s browseEntries) Less(i, j int) bool {
+	a, b := s.entries[i], s.entries[j]
+	if aDir, bDir := a.Type == "directory", b.Type == "directory"; aDir != bDir {
+		return aDir
+	}
+	if s.desc {
+		a, b = b, a
+	}
+	switch s.sortBy {
+	case "size":
+		if a.Size != b.Size {
+			return a.Size < b.Size
+		}
+	case "modified":
+		if !a.Modified.Equal(b.Modified) {
+			return a.Modified.Before(b.Modified)
+		}
+	}
+	return a.Name < b.Name
+}
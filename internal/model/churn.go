@@ -0,0 +1,84 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"time"
+
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+const (
+	churnWindow    = time.Minute      // changes are counted over this period
+	churnThreshold = 10               // changes within the window before a file is suppressed
+	churnSuppress  = 10 * time.Minute // how long changes to a churning file are ignored
+)
+
+// A churnDetector keeps track of how often files change, to detect files that
+// are rewritten continuously (lock files and the like). Changes to such files
+// are suppressed for a while, instead of being hashed and announced to other
+// devices over and over again.
+type churnDetector struct {
+	files map[string]churnState // folder + "/" + name -> state
+	mut   sync.Mutex
+}
+
+type churnState struct {
+	changes         int
+	windowStart     time.Time
+	suppressedUntil time.Time
+}
+
+func newChurnDetector() *churnDetector {
+	return &churnDetector{
+		files: make(map[string]churnState),
+		mut:   sync.NewMutex(),
+	}
+}
+
+// changed records a change to the given file and returns whether the change
+// should be suppressed, and whether the suppression started with this change.
+func (c *churnDetector) changed(folder, name string, now time.Time) (suppress, started bool) {
+	key := folder + "/" + name
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	s := c.files[key]
+	if now.Before(s.suppressedUntil) {
+		return true, false
+	}
+	if !s.suppressedUntil.IsZero() {
+		// The suppression has ended; let this change through and start
+		// counting anew.
+		delete(c.files, key)
+		return false, false
+	}
+
+	if now.Sub(s.windowStart) > churnWindow {
+		s = churnState{windowStart: now}
+	}
+	s.changes++
+	if s.changes > churnThreshold {
+		s.suppressedUntil = now.Add(churnSuppress)
+		started = true
+	}
+	c.files[key] = s
+	return started, started
+}
+
+// prune forgets about files that have not changed recently and are no
+// longer suppressed, so that the map doesn't grow without bounds.
+func (c *churnDetector) prune(now time.Time) {
+	c.mut.Lock()
+	for key, s := range c.files {
+		if now.Sub(s.windowStart) > churnWindow && !now.Before(s.suppressedUntil) {
+			delete(c.files, key)
+		}
+	}
+	c.mut.Unlock()
+}
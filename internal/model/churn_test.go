@@ -0,0 +1,67 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChurnDetector(t *testing.T) {
+	c := newChurnDetector()
+	now := time.Now()
+
+	for i := 0; i < churnThreshold; i++ {
+		if suppress, _ := c.changed("default", "lock", now); suppress {
+			t.Fatalf("change %d suppressed below threshold", i)
+		}
+		now = now.Add(time.Second)
+	}
+
+	// Changes to other files or folders are unaffected.
+	if suppress, _ := c.changed("default", "other", now); suppress {
+		t.Error("unrelated file suppressed")
+	}
+	if suppress, _ := c.changed("other", "lock", now); suppress {
+		t.Error("file in unrelated folder suppressed")
+	}
+
+	if suppress, started := c.changed("default", "lock", now); !suppress || !started {
+		t.Fatalf("unexpected suppress %v, started %v above threshold", suppress, started)
+	}
+	now = now.Add(time.Second)
+	if suppress, started := c.changed("default", "lock", now); !suppress || started {
+		t.Fatalf("unexpected suppress %v, started %v while suppressed", suppress, started)
+	}
+
+	// Suppressed files are not pruned, the rest are once the window is over.
+	c.prune(now.Add(churnWindow + time.Second))
+	if _, ok := c.files["default/other"]; ok {
+		t.Error("idle file not pruned")
+	}
+	if _, ok := c.files["default/lock"]; !ok {
+		t.Error("suppressed file pruned")
+	}
+
+	now = now.Add(churnSuppress)
+	if suppress, _ := c.changed("default", "lock", now); suppress {
+		t.Error("change suppressed after suppression ended")
+	}
+}
+
+func TestChurnDetectorWindow(t *testing.T) {
+	c := newChurnDetector()
+	now := time.Now()
+
+	// Changes spread out over longer than the window are never suppressed.
+	for i := 0; i < 3*churnThreshold; i++ {
+		if suppress, _ := c.changed("default", "slow", now); suppress {
+			t.Fatalf("change %d suppressed", i)
+		}
+		now = now.Add(churnWindow / churnThreshold * 2)
+	}
+}
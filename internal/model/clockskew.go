@@ -0,0 +1,59 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/events"
+)
+
+// clockOption is announced in the cluster config and holds our wall clock
+// time, in seconds since the epoch, when the message was created.
+const clockOption = "time"
+
+// maxClockSkew is the largest difference between our clock and that of
+// another device that we accept without warning the user. Larger skews cause
+// confusing modification times and conflict resolution.
+const maxClockSkew = time.Minute
+
+// clockSkew returns how far the clock of the device that sent the cluster
+// config is ahead of ours, and false if the device did not announce its
+// time.
+func clockSkew(cm protocol.ClusterConfigMessage, now time.Time) (time.Duration, bool) {
+	secs, err := strconv.ParseInt(cm.GetOption(clockOption), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return time.Unix(secs, 0).Sub(now), true
+}
+
+// checkClockSkew records the clock skew announced by the device and warns
+// the user if it's excessive.
+func (m *Model) checkClockSkew(deviceID protocol.DeviceID, cm protocol.ClusterConfigMessage) {
+	skew, ok := clockSkew(cm, time.Now())
+	if !ok {
+		return
+	}
+	skew = skew / time.Second * time.Second
+
+	m.pmut.Lock()
+	m.deviceSkew[deviceID] = skew
+	m.pmut.Unlock()
+
+	if skew < maxClockSkew && skew > -maxClockSkew {
+		return
+	}
+
+	l.Warnf("The clock of device %v differs from ours by %v. Make sure the clocks on both devices are correct.", deviceID, skew)
+	events.Default.Log(events.ClockSkew, map[string]interface{}{
+		"device": deviceID.String(),
+		"skewS":  int(skew / time.Second),
+	})
+}
@@ -0,0 +1,198 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+// Rates are averaged over roughly this long; older samples weigh less and
+// less.
+const rateWindow = 5 * time.Minute
+
+// A rateAverage is an exponentially weighted moving average of a rate in
+// bytes per second, where the weight of a sample depends on the period it
+// covers.
+type rateAverage struct {
+	rate float64
+	set  bool
+}
+
+// update adds a sample of the given number of bytes over the given period.
+func (r *rateAverage) update(bytes int64, period time.Duration) {
+	if period <= 0 {
+		return
+	}
+	cur := float64(bytes) / period.Seconds()
+	if !r.set {
+		r.rate, r.set = cur, true
+		return
+	}
+	alpha := 1 - math.Exp(-period.Seconds()/rateWindow.Seconds())
+	r.rate += alpha * (cur - r.rate)
+}
+
+// eta returns how long it takes to transfer the given number of bytes at the
+// average rate, in seconds, or -1 if there is no telling.
+func (r *rateAverage) eta(bytes int64) int64 {
+	switch {
+	case bytes <= 0:
+		return 0
+	case !r.set || r.rate < 1:
+		return -1
+	}
+	return int64(math.Ceil(float64(bytes) / r.rate))
+}
+
+// A DeviceCompletion is how much of a folder a remote device still needs,
+// and when it is estimated to have it all.
+type DeviceCompletion struct {
+	Device     protocol.DeviceID `json:"device"`
+	Folder     string            `json:"folder"`
+	Completion float64           `json:"completion"` // percent of the global bytes
+	NeedBytes  int64             `json:"needBytes"`
+	NeedItems  int               `json:"needItems"` // including deletions
+	Rate       float64           `json:"rate"`      // bytes per second the need went down by recently
+	ETAS       int64             `json:"etaS"`      // -1 if unknown
+}
+
+// completionRates estimates how fast each remote device catches up on each
+// folder, from how its need changes between the times it is computed.
+type completionRates struct {
+	rates map[protocol.DeviceID]map[string]*needRate
+	mut   sync.Mutex
+}
+
+type needRate struct {
+	rateAverage
+	need int64
+	when time.Time
+}
+
+func newCompletionRates() *completionRates {
+	return &completionRates{
+		rates: make(map[protocol.DeviceID]map[string]*needRate),
+		mut:   sync.NewMutex(),
+	}
+}
+
+// sample records the need of the device at the given time and returns the
+// average rate and the ETA.
+func (c *completionRates) sample(device protocol.DeviceID, folder string, need int64, now time.Time) (rate float64, eta int64) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if c.rates[device] == nil {
+		c.rates[device] = make(map[string]*needRate)
+	}
+	r, ok := c.rates[device][folder]
+	if !ok {
+		r = &needRate{}
+		c.rates[device][folder] = r
+	}
+
+	if ok && r.need > 0 && need > 0 && now.After(r.when) {
+		// New data to catch up on doesn't count as negative progress, nor
+		// does time spent in sync.
+		done := r.need - need
+		if done < 0 {
+			done = 0
+		}
+		r.update(done, now.Sub(r.when))
+	}
+	r.need, r.when = need, now
+	return r.rate, r.eta(need)
+}
+
+// Completion returns the percentage of the global data of the folder the
+// device has.
+func (m *Model) Completion(device protocol.DeviceID, folder string) float64 {
+	return m.DeviceCompletion(device, folder).Completion
+}
+
+// DeviceCompletion returns how much of the folder the device still needs,
+// and an estimate of when it will be done based on its recent progress.
+func (m *Model) DeviceCompletion(device protocol.DeviceID, folder string) DeviceCompletion {
+	res := DeviceCompletion{
+		Device: device,
+		Folder: folder,
+		ETAS:   -1,
+	}
+
+	m.fmut.RLock()
+	rf, ok := m.folderFiles[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return res // Folder doesn't exist, so we hardly have any of it
+	}
+
+	var tot int64
+	rf.WithGlobalTruncated(func(f db.FileIntf) bool {
+		if !f.IsDeleted() {
+			tot += f.Size()
+		}
+		return true
+	})
+
+	rf.WithNeedTruncated(device, func(f db.FileIntf) bool {
+		if !f.IsDeleted() {
+			res.NeedBytes += f.Size()
+		}
+		res.NeedItems++
+		return true
+	})
+
+	if tot == 0 {
+		res.Completion = 100 // Folder is empty, so we have all of it
+	} else {
+		res.Completion = 100 * (1 - float64(res.NeedBytes)/float64(tot))
+	}
+	res.Rate, res.ETAS = m.completionRates.sample(device, folder, res.NeedBytes, time.Now())
+
+	if debug.On() {
+		l.Debugf("%v DeviceCompletion(%s, %q): %f (%d / %d), %d items, eta %ds", m, device, folder, res.Completion, res.NeedBytes, tot, res.NeedItems, res.ETAS)
+	}
+
+	return res
+}
+
+// DeviceCompletions returns the completion of the folders shared with the
+// remote devices, ordered by folder. Only the given device and folder are
+// included, unless they are the zero DeviceID and the empty string.
+func (m *Model) DeviceCompletions(device protocol.DeviceID, folder string) []DeviceCompletion {
+	m.fmut.RLock()
+	var folders []string
+	for fld := range m.folderDevices {
+		if folder == "" || fld == folder {
+			folders = append(folders, fld)
+		}
+	}
+	sort.Strings(folders)
+	devices := make(map[string][]protocol.DeviceID, len(folders))
+	for _, fld := range folders {
+		for _, dev := range m.folderDevices[fld] {
+			if dev != m.id && (device == protocol.DeviceID{} || dev == device) {
+				devices[fld] = append(devices[fld], dev)
+			}
+		}
+	}
+	m.fmut.RUnlock()
+
+	res := []DeviceCompletion{}
+	for _, fld := range folders {
+		for _, dev := range devices[fld] {
+			res = append(res, m.DeviceCompletion(dev, fld))
+		}
+	}
+	return res
+}
@@ -0,0 +1,126 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestRateAverage(t *testing.T) {
+	var r rateAverage
+	if eta := r.eta(1000); eta != -1 {
+		t.Errorf("eta %d without samples, expected -1", eta)
+	}
+	if eta := r.eta(0); eta != 0 {
+		t.Errorf("eta %d for nothing, expected 0", eta)
+	}
+
+	r.update(1000, 10*time.Second)
+	if r.rate != 100 {
+		t.Errorf("rate %f after the first sample, expected 100", r.rate)
+	}
+	if eta := r.eta(1000); eta != 10 {
+		t.Errorf("eta %d, expected 10", eta)
+	}
+
+	// A short sample moves the average a little, a long one a lot.
+	r.update(0, time.Second)
+	if r.rate < 99 || r.rate >= 100 {
+		t.Errorf("rate %f after a short idle sample", r.rate)
+	}
+	r.update(0, 10*rateWindow)
+	if r.rate >= 1 {
+		t.Errorf("rate %f after a long idle sample", r.rate)
+	}
+	if eta := r.eta(1000); eta != -1 {
+		t.Errorf("eta %d without progress, expected -1", eta)
+	}
+}
+
+func TestCompletionRates(t *testing.T) {
+	c := newCompletionRates()
+	now := time.Now()
+
+	if _, eta := c.sample(device1, "default", 1000, now); eta != -1 {
+		t.Errorf("eta %d after the first sample, expected -1", eta)
+	}
+	now = now.Add(10 * time.Second)
+	if rate, eta := c.sample(device1, "default", 500, now); rate != 50 || eta != 10 {
+		t.Errorf("rate %f, eta %d; expected 50, 10", rate, eta)
+	}
+	if _, eta := c.sample(device1, "other", 500, now); eta != -1 {
+		t.Errorf("eta %d for another folder, expected -1", eta)
+	}
+
+	// Time in sync doesn't count against the rate.
+	c.sample(device1, "default", 0, now)
+	now = now.Add(time.Hour)
+	c.sample(device1, "default", 500, now)
+	now = now.Add(10 * time.Second)
+	if rate, _ := c.sample(device1, "default", 0, now); rate != 50 {
+		t.Errorf("rate %f after being in sync, expected 50", rate)
+	}
+}
+
+func TestDeviceCompletions(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(defaultFolderConfig)
+	m.StartFolderRO("default")
+	m.ScanFolder("default")
+
+	comps := m.DeviceCompletions(protocol.DeviceID{}, "")
+	if len(comps) != 1 {
+		t.Fatal("Expected one completion, got", comps)
+	}
+	c := comps[0]
+	if c.Device != device1 || c.Folder != "default" || c.Completion != 0 || c.NeedItems == 0 || c.NeedBytes == 0 || c.ETAS != -1 {
+		t.Errorf("Unexpected completion %+v", c)
+	}
+
+	if comps := m.DeviceCompletions(device2, ""); len(comps) != 0 {
+		t.Error("Expected no completions for an unrelated device, got", comps)
+	}
+	if comps := m.DeviceCompletions(protocol.DeviceID{}, "other"); len(comps) != 0 {
+		t.Error("Expected no completions for an unknown folder, got", comps)
+	}
+}
+
+func TestRateMeter(t *testing.T) {
+	r := newRateMeter()
+	now := time.Now()
+
+	// Nothing is counted while stopped.
+	r.add(1000, now)
+	if _, eta := r.rate(1000, now); eta != -1 {
+		t.Errorf("eta %d before starting, expected -1", eta)
+	}
+
+	r.start(now)
+	now = now.Add(rateMeterTick / 2)
+	r.add(500, now)
+	now = now.Add(rateMeterTick / 2)
+	r.add(500, now)
+	if rate, eta := r.rate(5000, now); rate != 1000/rateMeterTick.Seconds() || eta != int64(5*rateMeterTick.Seconds()) {
+		t.Errorf("rate %f, eta %d after a tick", rate, eta)
+	}
+
+	// Time stopped doesn't count against the rate.
+	r.stop(now)
+	now = now.Add(time.Hour)
+	r.start(now)
+	now = now.Add(rateMeterTick)
+	r.add(1000, now)
+	if rate, _ := r.rate(0, now); rate != 1000/rateMeterTick.Seconds() {
+		t.Errorf("rate %f after being stopped", rate)
+	}
+}
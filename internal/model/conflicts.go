@@ -0,0 +1,201 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/osutil"
+)
+
+const conflictTimeFormat = "20060102-150405"
+
+// Matches the marker inserted by moveForConflict, i.e.
+// "foo.sync-conflict-20150102-150405.txt".
+var conflictMarkerExp = regexp.MustCompile(`\.sync-conflict-(\d{8}-\d{6})`)
+
+var errNotConflict = errors.New("not a conflict copy")
+
+// A Conflict is a conflict copy of a file, created when the file was changed
+// concurrently on two or more devices.
+type Conflict struct {
+	Name     string    `json:"name"`
+	Original string    `json:"original"` // The name of the file this is a conflict copy of
+	Created  time.Time `json:"created"`  // As recorded in the file name
+	Size     int64     `json:"size"`
+}
+
+// parseConflictName returns the original file name and the creation time for
+// the given conflict copy name, or false if the name isn't that of a
+// conflict copy.
+func parseConflictName(name string) (string, time.Time, bool) {
+	// Only the last path component can carry the marker; a directory called
+	// "foo.sync-conflict-..." is just a directory.
+	dir, base := filepath.Split(name)
+	loc := conflictMarkerExp.FindStringSubmatchIndex(base)
+	if loc == nil {
+		return "", time.Time{}, false
+	}
+	t, err := time.ParseInLocation(conflictTimeFormat, base[loc[2]:loc[3]], time.Local)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return dir + base[:loc[0]] + base[loc[1]:], t, true
+}
+
+type conflictList []Conflict
+
+// Sorted by original name, newest conflict copy first.
+func (l conflictList) Less(a, b int) bool {
+	if l[a].Original != l[b].Original {
+		return l[a].Original < l[b].Original
+	}
+	return l[a].Created.After(l[b].Created)
+}
+
+func (l conflictList) Swap(a, b int) {
+	l[a], l[b] = l[b], l[a]
+}
+
+func (l conflictList) Len() int {
+	return len(l)
+}
+
+// conflictsToPrune returns the conflict copies that should be removed
+// according to the given limits; those beyond the newest maxConflicts for
+// each original file, and those older than maxAge. Zero limits are ignored.
+// The list must be sorted.
+func conflictsToPrune(conflicts []Conflict, maxConflicts int, maxAge time.Duration, now time.Time) []Conflict {
+	var prune []Conflict
+	seen := 0
+	for i, c := range conflicts {
+		if i == 0 || c.Original != conflicts[i-1].Original {
+			seen = 0
+		}
+		seen++
+		if maxConflicts > 0 && seen > maxConflicts || maxAge > 0 && now.Sub(c.Created) > maxAge {
+			prune = append(prune, c)
+		}
+	}
+	return prune
+}
+
+// Conflicts returns the conflict copies currently present in the given
+// folder, sorted by original name and newest first.
+func (m *Model) Conflicts(folder string) ([]Conflict, error) {
+	m.fmut.RLock()
+	fs, ok := m.folderFiles[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return nil, errors.New("no such folder")
+	}
+
+	var conflicts []Conflict
+	fs.WithHaveTruncated(protocol.LocalDeviceID, func(fi db.FileIntf) bool {
+		f := fi.(db.FileInfoTruncated)
+		if f.IsDeleted() || f.IsDirectory() || f.IsInvalid() {
+			return true
+		}
+		if orig, created, ok := parseConflictName(f.Name); ok {
+			conflicts = append(conflicts, Conflict{
+				Name:     f.Name,
+				Original: orig,
+				Created:  created,
+				Size:     f.Size(),
+			})
+		}
+		return true
+	})
+
+	sort.Sort(conflictList(conflicts))
+	return conflicts, nil
+}
+
+// DeleteConflicts removes the named conflict copies from the given folder
+// and rescans the affected directories. Names that do not refer to conflict
+// copies are refused.
+func (m *Model) DeleteConflicts(folder string, names []string) error {
+	m.fmut.RLock()
+	folderCfg, ok := m.folderCfgs[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return errors.New("no such folder")
+	}
+
+	for _, name := range names {
+		// Only the base name tells a conflict copy, so the name must also
+		// be checked to stay inside the folder.
+		if err := osutil.CheckFilename(osutil.NativeFilename(name)); err != nil {
+			return err
+		}
+		if _, _, ok := parseConflictName(name); !ok {
+			return errNotConflict
+		}
+	}
+
+	var subs []string
+	var firstErr error
+	for _, name := range names {
+		name = osutil.NativeFilename(name)
+		err := osutil.InWritableDir(osutil.Remove, filepath.Join(folderCfg.Path(), name))
+		if err != nil && !os.IsNotExist(err) {
+			l.Infof("Removing conflict copy %q in folder %q: %v", name, folder, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		subs = append(subs, name)
+	}
+
+	if len(subs) > 0 {
+		if err := m.ScanFolderSubs(folder, subs); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// pruneConflicts removes the conflict copies in the given folder that exceed
+// the configured count or age limits.
+func (m *Model) pruneConflicts(folder string) {
+	m.fmut.RLock()
+	folderCfg := m.folderCfgs[folder]
+	m.fmut.RUnlock()
+
+	if folderCfg.MaxConflicts <= 0 && folderCfg.ConflictMaxAgeH <= 0 {
+		return
+	}
+
+	conflicts, err := m.Conflicts(folder)
+	if err != nil {
+		return
+	}
+	maxAge := time.Duration(folderCfg.ConflictMaxAgeH) * time.Hour
+	prune := conflictsToPrune(conflicts, folderCfg.MaxConflicts, maxAge, time.Now())
+	if len(prune) == 0 {
+		return
+	}
+
+	names := make([]string, len(prune))
+	for i, c := range prune {
+		names[i] = c.Name
+	}
+	if debug.On() {
+		l.Debugln("pruning conflicts in", folder, names)
+	}
+	if err := m.DeleteConflicts(folder, names); err != nil {
+		l.Infof("Pruning conflict copies in folder %q: %v", folder, err)
+	}
+}
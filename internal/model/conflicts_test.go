@@ -0,0 +1,131 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/osutil"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestParseConflictName(t *testing.T) {
+	cases := []struct {
+		name     string
+		original string
+		ok       bool
+	}{
+		{"foo.sync-conflict-20150102-150405.txt", "foo.txt", true},
+		{"foo.sync-conflict-20150102-150405", "foo", true},
+		{filepath.Join("dir", "foo.sync-conflict-20150102-150405.txt"), filepath.Join("dir", "foo.txt"), true},
+		{filepath.Join("dir.sync-conflict-20150102-150405", "foo.txt"), "", false},
+		{"foo.sync-conflict-2015.txt", "", false},
+		{"foo.txt", "", false},
+	}
+
+	for _, tc := range cases {
+		orig, created, ok := parseConflictName(tc.name)
+		if ok != tc.ok {
+			t.Errorf("%q: unexpected ok %v", tc.name, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if orig != tc.original {
+			t.Errorf("%q: incorrect original %q != %q", tc.name, orig, tc.original)
+		}
+		if exp := time.Date(2015, 1, 2, 15, 4, 5, 0, time.Local); !created.Equal(exp) {
+			t.Errorf("%q: incorrect time %v != %v", tc.name, created, exp)
+		}
+	}
+}
+
+func TestConflictsToPrune(t *testing.T) {
+	now := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	conflicts := []Conflict{
+		{Name: "a1", Original: "a", Created: now.Add(-1 * day)},
+		{Name: "a3", Original: "a", Created: now.Add(-3 * day)},
+		{Name: "a2", Original: "a", Created: now.Add(-2 * day)},
+		{Name: "b5", Original: "b", Created: now.Add(-5 * day)},
+	}
+	sort.Sort(conflictList(conflicts))
+
+	names := func(cs []Conflict) []string {
+		var res []string
+		for _, c := range cs {
+			res = append(res, c.Name)
+		}
+		return res
+	}
+
+	cases := []struct {
+		max      int
+		maxAge   time.Duration
+		expected []string
+	}{
+		{0, 0, nil},
+		{1, 0, []string{"a2", "a3"}},
+		{2, 0, []string{"a3"}},
+		{0, 4 * day, []string{"b5"}},
+		{2, 4 * day, []string{"a3", "b5"}},
+	}
+
+	for _, tc := range cases {
+		prune := names(conflictsToPrune(conflicts, tc.max, tc.maxAge, now))
+		if len(prune) != len(tc.expected) {
+			t.Errorf("max %d, maxAge %v: incorrect prune list %v != %v", tc.max, tc.maxAge, prune, tc.expected)
+			continue
+		}
+		for i := range prune {
+			if prune[i] != tc.expected[i] {
+				t.Errorf("max %d, maxAge %v: incorrect prune list %v != %v", tc.max, tc.maxAge, prune, tc.expected)
+				break
+			}
+		}
+	}
+}
+
+func TestDeleteConflictsOutsideFolder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conflicts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	folderDir := filepath.Join(dir, "folder")
+	os.Mkdir(folderDir, 0755)
+
+	// A conflict looking file next to the folder, not in it.
+	outside := filepath.Join(dir, "x.sync-conflict-20150101-000000.txt")
+	if err := ioutil.WriteFile(outside, []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := defaultFolderConfig
+	cfg.RawPath = folderDir
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(cfg)
+
+	for _, name := range []string{"../x.sync-conflict-20150101-000000.txt", "sub/../../x.sync-conflict-20150101-000000.txt", outside} {
+		if err := m.DeleteConflicts("default", []string{name}); err != osutil.ErrNameOutside {
+			t.Errorf("%q: expected %v, got %v", name, osutil.ErrNameOutside, err)
+		}
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Error("File outside the folder removed:", err)
+	}
+}
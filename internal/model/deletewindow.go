@@ -0,0 +1,121 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/db"
+)
+
+// A PendingDelete is a remote deletion held back by the delete window of its
+// folder.
+type PendingDelete struct {
+	Name      string    `json:"name"`
+	Since     time.Time `json:"since"`
+	Due       time.Time `json:"due"`
+	Cancelled bool      `json:"cancelled"`
+}
+
+// pendingDelete returns when the deletion of the file with the given version
+// was first seen and whether it was cancelled. If we don't have the file
+// there is nothing to hold back, and pending is false.
+func pendingDelete(files *db.FileSet, repo *db.PendingDeleteRepo, name string, version protocol.Vector, now time.Time) (since time.Time, cancelled, pending bool) {
+	if lf, ok := files.Get(protocol.LocalDeviceID, name); !ok || lf.IsDeleted() {
+		return time.Time{}, false, false
+	}
+	since, cancelled = repo.Since(name, version, now)
+	return since, cancelled, true
+}
+
+// deletionDue returns whether the deletion of the file may be applied. The
+// time of the first deletion due later is kept, so that the puller comes
+// back to it.
+func (p *rwFolder) deletionDue(files *db.FileSet, file protocol.FileInfo) bool {
+	now := time.Now()
+	since, cancelled, pending := pendingDelete(files, p.pendingDeletes, file.Name, file.Version, now)
+	switch {
+	case !pending:
+		return true
+	case cancelled:
+		return false
+	}
+
+	due := since.Add(p.deleteDelay)
+	if now.Before(due) {
+		if p.deletesDue.IsZero() || due.Before(p.deletesDue) {
+			p.deletesDue = due
+		}
+		return false
+	}
+	return true
+}
+
+// PendingDeletes returns the remote deletions held back by the delete window
+// of the folder, including the cancelled ones.
+func (m *Model) PendingDeletes(folder string) ([]PendingDelete, error) {
+	m.fmut.RLock()
+	files, ok := m.folderFiles[folder]
+	cfg := m.folderCfgs[folder]
+	ignores := m.folderIgnores[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Folder %s does not exist", folder)
+	}
+	delay := cfg.DeleteDelay()
+	if delay == 0 || cfg.Archive {
+		return nil, fmt.Errorf("Folder %s has no delete window", folder)
+	}
+
+	repo := db.NewPendingDeleteRepo(m.db, folder)
+	now := time.Now()
+	pending := []PendingDelete{}
+	files.WithNeedTruncated(protocol.LocalDeviceID, func(fi db.FileIntf) bool {
+		f := fi.(db.FileInfoTruncated)
+		if !f.IsDeleted() || ignores.Match(f.Name) {
+			return true
+		}
+		if since, cancelled, ok := pendingDelete(files, repo, f.Name, f.Version, now); ok {
+			pending = append(pending, PendingDelete{
+				Name:      f.Name,
+				Since:     since,
+				Due:       since.Add(delay),
+				Cancelled: cancelled,
+			})
+		}
+		return true
+	})
+	return pending, nil
+}
+
+// CancelDelete keeps the pending deletion of the file from being applied.
+// The file is deleted if it is deleted anew after being changed again.
+func (m *Model) CancelDelete(folder, file string) error {
+	m.fmut.RLock()
+	files, ok := m.folderFiles[folder]
+	cfg := m.folderCfgs[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return fmt.Errorf("Folder %s does not exist", folder)
+	}
+	if cfg.DeleteDelay() == 0 || cfg.Archive {
+		return fmt.Errorf("Folder %s has no delete window", folder)
+	}
+
+	gf, ok := files.GetGlobal(file)
+	if !ok || !gf.IsDeleted() {
+		return fmt.Errorf("No deletion of %s is pending", file)
+	}
+	repo := db.NewPendingDeleteRepo(m.db, folder)
+	if _, _, pending := pendingDelete(files, repo, file, gf.Version, time.Now()); !pending {
+		return fmt.Errorf("No deletion of %s is pending", file)
+	}
+	repo.Cancel(file, gf.Version, time.Now())
+	return nil
+}
@@ -0,0 +1,80 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/syncthing/protocol"
+)
+
+// featuresOption is announced in the cluster config and lists the optional
+// protocol features we support, separated by commas. A feature is only used
+// with a device that announces it as well, so new features can be introduced
+// without bumping the protocol version. Devices that don't announce any get
+// the behaviour of the base protocol.
+const featuresOption = "features"
+
+// The optional protocol features.
+const (
+	featureRemoteBrowse = "remoteBrowse" // see remoteBrowseOption
+	featureHashRequest  = "hashRequest"  // see hashRequestOption
+	featureChecksums    = "checksums"    // see protocol.Connection.EnableChecksums
+)
+
+// localFeatures are the features we support and announce.
+var localFeatures = []string{
+	featureRemoteBrowse,
+	featureHashRequest,
+	featureChecksums,
+}
+
+// localFeatures returns the features we announce, leaving out those turned
+// off in the options.
+func (m *Model) localFeatures() []string {
+	if m.cfg.Options().MessageChecksums {
+		return localFeatures
+	}
+	var features []string
+	for _, f := range localFeatures {
+		if f != featureChecksums {
+			features = append(features, f)
+		}
+	}
+	return features
+}
+
+// commonFeatures returns the sorted features announced in the cluster config
+// that we support as well.
+func commonFeatures(cm protocol.ClusterConfigMessage, supported []string) []string {
+	var common []string
+	for _, f := range strings.Split(cm.GetOption(featuresOption), ",") {
+		f = strings.TrimSpace(f)
+		for _, s := range supported {
+			if f == s {
+				common = append(common, f)
+				break
+			}
+		}
+	}
+	sort.Strings(common)
+	return common
+}
+
+// deviceSupports returns true if both we and the connected device support
+// the given feature.
+func (m *Model) deviceSupports(deviceID protocol.DeviceID, feature string) bool {
+	m.pmut.RLock()
+	defer m.pmut.RUnlock()
+	for _, f := range m.deviceFeatures[deviceID] {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/osutil"
+	"github.com/syncthing/syncthing/internal/scanner"
+)
+
+// FetchFile downloads a single file, as announced by the given connected
+// device, from that device to the given local path. This is independent of
+// syncing the folder; the file may be ignored and the folder paused. The
+// destination must not already exist.
+func (m *Model) FetchFile(deviceID protocol.DeviceID, folder, name, dst string) error {
+	m.fmut.RLock()
+	fs, ok := m.folderFiles[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return errors.New("no such folder")
+	}
+
+	f, ok := fs.Get(deviceID, name)
+	if !ok || f.IsDeleted() || f.IsInvalid() {
+		return errors.New("no such file")
+	}
+	if f.IsDirectory() || f.IsSymlink() {
+		return errors.New("not a regular file")
+	}
+
+	if _, err := osutil.Lstat(dst); err == nil {
+		return errors.New("destination exists")
+	}
+
+	tempName := defTempNamer.TempName(dst)
+	fd, err := os.OpenFile(tempName, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err := m.fetchBlocks(deviceID, folder, f, fd); err != nil {
+		fd.Close()
+		os.Remove(tempName)
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		os.Remove(tempName)
+		return err
+	}
+
+	if f.HasPermissionBits() {
+		os.Chmod(tempName, os.FileMode(f.Flags&0777))
+	}
+	t := time.Unix(f.Modified, 0)
+	os.Chtimes(tempName, t, t)
+
+	if err := osutil.Rename(tempName, dst); err != nil {
+		return err
+	}
+
+	l.Infof("Fetched %q in folder %q from %s to %s", name, folder, deviceID, dst)
+	return nil
+}
+
+// fetchBlocks requests and verifies each block of the file in turn and
+// writes it to fd.
+func (m *Model) fetchBlocks(deviceID protocol.DeviceID, folder string, f protocol.FileInfo, fd *os.File) error {
+	for _, block := range f.Blocks {
+		m.cpuLimiter.Wait()
+
+		buf, err := m.requestGlobal(deviceID, folder, f.Name, block.Offset, int(block.Size), block.Hash, 0, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := scanner.VerifyBuffer(buf, block); err != nil {
+			return err
+		}
+		if _, err := fd.WriteAt(buf, block.Offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
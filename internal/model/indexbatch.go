@@ -0,0 +1,88 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import "github.com/syncthing/protocol"
+
+// An indexBatch collects files streamed from the database into index
+// messages of bounded size. The connection returns once a message has been
+// written, so the batch is reused and no more than one is in memory per
+// folder. The folders of a connection also share a slot, held while a batch
+// is being filled and sent, so that a connection holds one batch at a time
+// however many folders it shares.
+type indexBatch struct {
+	conn    protocol.Connection
+	folder  string
+	initial bool          // the next message is the initial index
+	slot    chan struct{} // shared by the folders of the connection; nil for none
+	held    bool
+	files   []protocol.FileInfo
+	size    int // estimated
+}
+
+func newIndexBatch(conn protocol.Connection, folder string, initial bool, slot chan struct{}) *indexBatch {
+	return &indexBatch{
+		conn:    conn,
+		folder:  folder,
+		initial: initial,
+		slot:    slot,
+		files:   make([]protocol.FileInfo, 0, indexBatchSize),
+	}
+}
+
+// append adds the file to the batch, sending the batch when it's full.
+func (b *indexBatch) append(f protocol.FileInfo) error {
+	b.hold()
+	b.files = append(b.files, f)
+	b.size += indexPerFileSize + len(f.Blocks)*IndexPerBlockSize
+	if len(b.files) == indexBatchSize || b.size > indexTargetSize {
+		return b.flush()
+	}
+	return nil
+}
+
+// flush sends what is in the batch. An initial index is sent even when
+// empty.
+func (b *indexBatch) flush() error {
+	if len(b.files) == 0 && !b.initial {
+		return nil
+	}
+	b.hold()
+	defer b.release()
+
+	var err error
+	if b.initial {
+		err = b.conn.Index(b.folder, b.files, 0, nil)
+		b.initial = false
+	} else {
+		err = b.conn.IndexUpdate(b.folder, b.files, 0, nil)
+	}
+	if debug.On() && err == nil {
+		l.Debugf("sendIndexes for %s-%s/%q: %d files (<%d bytes)", b.conn.ID(), b.conn.Name(), b.folder, len(b.files), b.size)
+	}
+
+	for i := range b.files {
+		b.files[i] = protocol.FileInfo{} // not to keep the blocks around
+	}
+	b.files = b.files[:0]
+	b.size = 0
+	return err
+}
+
+func (b *indexBatch) hold() {
+	if b.slot != nil && !b.held {
+		b.slot <- struct{}{}
+		b.held = true
+	}
+}
+
+func (b *indexBatch) release() {
+	if b.held {
+		<-b.slot
+		b.held = false
+	}
+}
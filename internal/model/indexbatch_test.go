@@ -0,0 +1,99 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/ignore"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// indexRecorder records the sizes of the index messages sent, and whether
+// the slot was held while sending.
+type indexRecorder struct {
+	FakeConnection
+	slot    chan struct{}
+	initial []int
+	updates []int
+	unheld  int
+}
+
+func (r *indexRecorder) Index(folder string, fs []protocol.FileInfo, flags uint32, options []protocol.Option) error {
+	r.initial = append(r.initial, len(fs))
+	if len(r.slot) == 0 {
+		r.unheld++
+	}
+	return nil
+}
+
+func (r *indexRecorder) IndexUpdate(folder string, fs []protocol.FileInfo, flags uint32, options []protocol.Option) error {
+	r.updates = append(r.updates, len(fs))
+	if len(r.slot) == 0 {
+		r.unheld++
+	}
+	return nil
+}
+
+func TestSendIndexTo(t *testing.T) {
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	fs := db.NewFileSet("default", ldb)
+	slot := make(chan struct{}, 1)
+	conn := &indexRecorder{FakeConnection: FakeConnection{id: device1}, slot: slot}
+
+	// An empty folder still gets an initial index.
+	if _, err := sendIndexTo(true, 0, conn, "default", fs, ignore.New(false), slot); err != nil {
+		t.Fatal(err)
+	}
+	if len(conn.initial) != 1 || conn.initial[0] != 0 || len(conn.updates) != 0 {
+		t.Fatalf("Unexpected messages %v, %v for an empty folder", conn.initial, conn.updates)
+	}
+
+	const files = 2*indexBatchSize + 10
+	var local []protocol.FileInfo
+	for i := 0; i < files; i++ {
+		local = append(local, protocol.FileInfo{
+			Name:    fmt.Sprintf("file%d", i),
+			Flags:   0644,
+			Version: protocol.Vector{{ID: 1, Value: 1}},
+		})
+	}
+	fs.Update(protocol.LocalDeviceID, local)
+
+	conn.initial, conn.updates = nil, nil
+	maxVer, err := sendIndexTo(true, 0, conn, "default", fs, ignore.New(false), slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maxVer != fs.LocalVersion(protocol.LocalDeviceID) {
+		t.Errorf("Max local version %d, expected %d", maxVer, fs.LocalVersion(protocol.LocalDeviceID))
+	}
+	exp := []int{indexBatchSize, indexBatchSize, 10}
+	got := append(conn.initial, conn.updates...)
+	if len(conn.initial) != 1 || fmt.Sprint(got) != fmt.Sprint(exp) {
+		t.Errorf("Sent batches %v, %v; expected %v", conn.initial, conn.updates, exp)
+	}
+	if conn.unheld != 0 {
+		t.Errorf("%d batches sent without holding the slot", conn.unheld)
+	}
+	if len(slot) != 0 {
+		t.Error("Slot still held after sending")
+	}
+
+	// Nothing new, nothing sent.
+	conn.initial, conn.updates = nil, nil
+	if _, err := sendIndexTo(false, maxVer, conn, "default", fs, ignore.New(false), slot); err != nil {
+		t.Fatal(err)
+	}
+	if len(conn.initial) != 0 || len(conn.updates) != 0 {
+		t.Errorf("Unexpected messages %v, %v without changes", conn.initial, conn.updates)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/db"
+)
+
+// CleanTempFiles removes the temporary files of abandoned transfers in the
+// folder: those older than the configured lifetime, and those for files no
+// longer in the global index, which can't be resumed. Ignored directories are
+// left alone, as are temporary files written to since the cleaning started,
+// which may be of transfers started since. Returns the number of files
+// removed.
+func (m *Model) CleanTempFiles(folder string) (int, error) {
+	m.fmut.RLock()
+	fs, ok := m.folderFiles[folder]
+	cfg := m.folderCfgs[folder]
+	ignores := m.folderIgnores[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return 0, errors.New("no such folder")
+	}
+
+	// Temporary files modified after this may belong to pulls of files that
+	// weren't in the global index yet.
+	start := time.Now()
+
+	// The temporary names of the files that may be pulled.
+	wanted := make(map[string]bool)
+	fs.WithGlobalTruncated(func(fi db.FileIntf) bool {
+		f := fi.(db.FileInfoTruncated)
+		if !f.IsDeleted() && !f.IsDirectory() {
+			wanted[defTempNamer.TempName(f.Name)] = true
+		}
+		return true
+	})
+
+	lifetime := time.Duration(m.cfg.Options().KeepTemporariesH) * time.Hour
+	tempBlocks := db.NewTempBlockRepo(m.db, folder)
+	removed := 0
+
+	dir := cfg.Path()
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() && rel != "." && (rel == ".stversions" || ignores.Match(rel)) {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() || !defTempNamer.IsTemporary(rel) {
+			return nil
+		}
+		if info.ModTime().After(start) || wanted[rel] && !info.ModTime().Add(lifetime).Before(start) {
+			return nil
+		}
+
+		if debug.On() {
+			l.Debugf("%v removing temporary %q in %q (wanted %v, mtime %v)", m, rel, folder, wanted[rel], info.ModTime())
+		}
+		if err := os.Remove(path); err != nil {
+			l.Infof("Removing temporary file %q in folder %q: %v", rel, folder, err)
+			return nil
+		}
+		removed++
+
+		// Forget the blocks recorded for the temporary file, if the name
+		// of its file can be told.
+		base := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(rel), defTempNamer.prefix), ".tmp")
+		if name := filepath.Join(filepath.Dir(rel), base); defTempNamer.TempName(name) == rel {
+			tempBlocks.Remove(name)
+		}
+		return nil
+	})
+	if removed > 0 {
+		l.Infof("Removed %d abandoned temporary files in folder %q", removed, folder)
+	}
+	return removed, err
+}
+
+// ExpireTombstones removes the deleted files that all devices sharing the
+// folder know as deleted, and have been for longer than maxAge, from the
+// index of the folder. Returns the number of files expired.
+func (m *Model) ExpireTombstones(folder string, maxAge time.Duration) (int, error) {
+	m.fmut.RLock()
+	fs, ok := m.folderFiles[folder]
+	devices := m.folderDevices[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return 0, errors.New("no such folder")
+	}
+
+	var remotes []protocol.DeviceID
+	for _, device := range devices {
+		if device != m.id {
+			remotes = append(remotes, device)
+		}
+	}
+
+	expired := fs.ExpireTombstones(remotes, maxAge, time.Now())
+	if expired > 0 {
+		l.Infof("Expired %d deleted files from the index of folder %q", expired, folder)
+	}
+	return expired, nil
+}
+
+// CompactDatabase compacts the database, reclaiming the space used by
+// removed and overwritten entries.
+func (m *Model) CompactDatabase() error {
+	start := time.Now()
+	if err := db.Compact(m.db); err != nil {
+		return err
+	}
+	l.Infof("Compacted the database in %v", time.Since(start))
+	return nil
+}
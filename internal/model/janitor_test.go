@@ -0,0 +1,87 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestCleanTempFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "janitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fcfg := config.FolderConfiguration{ID: "janitor", RawPath: dir}
+	cfg := config.Wrap("/tmp/test", config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Options: config.OptionsConfiguration{KeepTemporariesH: 24},
+	})
+	if err := ioutil.WriteFile(filepath.Join(dir, ".stignore"), []byte("ignored\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []string{"ignored", ".stversions", ".stversionsX"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(fcfg)
+
+	// A file that is wanted from another device.
+	m.fmut.RLock()
+	m.folderFiles["janitor"].Update(device1, []protocol.FileInfo{{
+		Name:    "wanted",
+		Version: protocol.Vector{{ID: 42, Value: 1}},
+		Blocks:  []protocol.BlockInfo{{Size: 4, Hash: []byte("hash")}},
+	}})
+	m.fmut.RUnlock()
+
+	old := time.Now().Add(-48 * time.Hour)
+	temps := []struct {
+		name    string
+		mtime   time.Time
+		removed bool
+	}{
+		{defTempNamer.TempName("wanted"), time.Now(), false},
+		{defTempNamer.TempName("orphaned"), time.Now(), true},
+		{defTempNamer.TempName("old"), old, true},
+		{defTempNamer.TempName("started"), time.Now().Add(time.Minute), false},
+		{defTempNamer.TempName(filepath.Join("ignored", "orphaned")), old, false},
+		{defTempNamer.TempName(filepath.Join(".stversions", "orphaned")), old, false},
+		{defTempNamer.TempName(filepath.Join(".stversionsX", "orphaned")), old, true},
+		{"file", old, false},
+	}
+	for _, tc := range temps {
+		path := filepath.Join(dir, tc.name)
+		if err := ioutil.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, tc.mtime, tc.mtime)
+	}
+
+	if n, err := m.CleanTempFiles("janitor"); err != nil || n != 3 {
+		t.Errorf("Expected three files removed, got %d (%v)", n, err)
+	}
+	for _, tc := range temps {
+		_, err := os.Stat(filepath.Join(dir, tc.name))
+		if removed := os.IsNotExist(err); removed != tc.removed {
+			t.Errorf("%s: removed %v, expected %v", tc.name, removed, tc.removed)
+		}
+	}
+}
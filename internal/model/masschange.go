@@ -0,0 +1,269 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/events"
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+const (
+	massChangeWindow   = 10 * time.Minute // suspicious changes are counted over this period
+	massChangeMinFiles = 20               // suspicious changes within the window before a folder can be paused
+	massChangeEntropy  = 7.5              // bits per byte above which content looks encrypted
+	massChangeSample   = 4096             // bytes examined at the start of each rewritten file
+	massChangeLogs     = 10               // names listed in the warning and event
+)
+
+// A MassChange is a burst of suspicious changes to a folder, such as caused
+// by ransomware encrypting the files, that paused the announcement of the
+// folder's index to other devices.
+type MassChange struct {
+	Folder  string    `json:"folder"`
+	Changes int       `json:"changes"` // suspicious changes within the window
+	Files   int       `json:"files"`   // files in the folder
+	Names   []string  `json:"names"`   // some of the changed files
+	Time    time.Time `json:"time"`
+}
+
+// A massChangeDetector counts the suspicious changes to each folder: files
+// rewritten with random looking content, and files showing up again with
+// another extension added to the name. Folders where too large a part of the
+// files changed like that within a short time are paused until resumed by
+// the user, so that the changes aren't announced to other devices.
+type massChangeDetector struct {
+	folders map[string]massChangeState
+	paused  map[string]MassChange
+	mut     sync.Mutex
+}
+
+type massChangeState struct {
+	changes     int
+	names       []string
+	windowStart time.Time
+}
+
+func newMassChangeDetector() *massChangeDetector {
+	return &massChangeDetector{
+		folders: make(map[string]massChangeState),
+		paused:  make(map[string]MassChange),
+		mut:     sync.NewMutex(),
+	}
+}
+
+// changed records suspicious changes to the named files of a folder holding
+// the given number of files. If more than pct percent of the files changed
+// within the window the folder is paused, and the resulting MassChange is
+// returned with started set.
+func (d *massChangeDetector) changed(folder string, names []string, files, pct int, now time.Time) (mc MassChange, started bool) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	if _, ok := d.paused[folder]; ok {
+		return MassChange{}, false
+	}
+
+	s := d.folders[folder]
+	if now.Sub(s.windowStart) > massChangeWindow {
+		s = massChangeState{windowStart: now}
+	}
+	s.changes += len(names)
+	for _, name := range names {
+		if len(s.names) == massChangeLogs {
+			break
+		}
+		s.names = append(s.names, name)
+	}
+	d.folders[folder] = s
+
+	if s.changes < massChangeMinFiles || s.changes*100 <= pct*files {
+		return MassChange{}, false
+	}
+
+	mc = MassChange{
+		Folder:  folder,
+		Changes: s.changes,
+		Files:   files,
+		Names:   s.names,
+		Time:    now,
+	}
+	d.paused[folder] = mc
+	delete(d.folders, folder)
+	return mc, true
+}
+
+func (d *massChangeDetector) isPaused(folder string) bool {
+	d.mut.Lock()
+	_, ok := d.paused[folder]
+	d.mut.Unlock()
+	return ok
+}
+
+// resume unpauses the folder and starts counting anew. It returns false if
+// the folder wasn't paused.
+func (d *massChangeDetector) resume(folder string) bool {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	if _, ok := d.paused[folder]; !ok {
+		return false
+	}
+	delete(d.paused, folder)
+	delete(d.folders, folder)
+	return true
+}
+
+// A massChangeScan looks for suspicious changes among the files found by a
+// scan, before they are committed to the index.
+type massChangeScan struct {
+	m     *Model
+	cfg   config.FolderConfiguration
+	fs    *db.FileSet
+	files int // in the folder before the scan; -1 until counted
+	now   time.Time
+}
+
+func (m *Model) newMassChangeScan(cfg config.FolderConfiguration, fs *db.FileSet, now time.Time) *massChangeScan {
+	return &massChangeScan{
+		m:     m,
+		cfg:   cfg,
+		fs:    fs,
+		files: -1,
+		now:   now,
+	}
+}
+
+// check records the suspicious changes in the batch, pausing the folder and
+// alerting the user if there are too many of them.
+func (s *massChangeScan) check(batch []protocol.FileInfo) {
+	if s.cfg.MassChangePct <= 0 {
+		return
+	}
+
+	var names []string
+	for _, f := range batch {
+		if s.suspicious(f) {
+			names = append(names, f.Name)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+
+	if s.files < 0 {
+		s.files = 0
+		s.fs.WithHaveTruncated(protocol.LocalDeviceID, func(fi db.FileIntf) bool {
+			if !fi.IsDeleted() && !fi.IsDirectory() {
+				s.files++
+			}
+			return true
+		})
+	}
+
+	mc, started := s.m.massChanges.changed(s.cfg.ID, names, s.files, s.cfg.MassChangePct, s.now)
+	if !started {
+		return
+	}
+	l.Warnf("Folder %q: %d of %d files were rewritten with random looking content or renamed to a new extension, such as %q. This may be ransomware encrypting the files. Changes to the folder are not announced to other devices until resumed.", mc.Folder, mc.Changes, mc.Files, mc.Names)
+	events.Default.Log(events.FolderMassChange, map[string]interface{}{
+		"folder":  mc.Folder,
+		"changes": mc.Changes,
+		"files":   mc.Files,
+		"names":   mc.Names,
+	})
+}
+
+// suspicious returns whether the scanned file looks like one encrypted by
+// ransomware: an existing file rewritten with content of high entropy, or a
+// new file named as an existing one with an extension added.
+func (s *massChangeScan) suspicious(f protocol.FileInfo) bool {
+	if f.IsDeleted() || f.IsDirectory() || f.IsSymlink() || f.IsInvalid() {
+		return false
+	}
+
+	if cf, ok := s.fs.Get(protocol.LocalDeviceID, f.Name); ok && !cf.IsDeleted() {
+		return highEntropy(filepath.Join(s.cfg.Path(), f.Name))
+	}
+
+	ext := filepath.Ext(f.Name)
+	if ext == "" {
+		return false
+	}
+	of, ok := s.fs.Get(protocol.LocalDeviceID, strings.TrimSuffix(f.Name, ext))
+	return ok && !of.IsDeleted() && !of.IsDirectory()
+}
+
+// highEntropy returns whether the start of the file looks random, as
+// encrypted data does. Files too small to tell are not.
+func highEntropy(path string) bool {
+	fd, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer fd.Close()
+
+	buf := make([]byte, massChangeSample)
+	n, err := io.ReadFull(fd, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return false
+	}
+	if n < massChangeSample/4 {
+		return false
+	}
+	return entropy(buf[:n]) > massChangeEntropy
+}
+
+// entropy returns the Shannon entropy of the data in bits per byte.
+func entropy(data []byte) float64 {
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+
+	var e float64
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / float64(len(data))
+			e -= p * math.Log2(p)
+		}
+	}
+	return e
+}
+
+// MassChanges returns the folders paused after a burst of suspicious
+// changes.
+func (m *Model) MassChanges() []MassChange {
+	m.massChanges.mut.Lock()
+	defer m.massChanges.mut.Unlock()
+
+	res := []MassChange{}
+	for _, mc := range m.massChanges.paused {
+		res = append(res, mc)
+	}
+	return res
+}
+
+// ResumeMassChange announces the changes to a folder paused after a burst
+// of suspicious changes to other devices again, accepting the changes.
+func (m *Model) ResumeMassChange(folder string) error {
+	if !m.massChanges.resume(folder) {
+		return fmt.Errorf("Folder %s is not paused", folder)
+	}
+	l.Infof("Folder %q: resuming announcement of changes", folder)
+	return nil
+}
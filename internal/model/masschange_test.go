@@ -0,0 +1,145 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/events"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestEntropy(t *testing.T) {
+	random := make([]byte, massChangeSample)
+	rand.Read(random)
+	if e := entropy(random); e < massChangeEntropy {
+		t.Errorf("random data has entropy %f", e)
+	}
+
+	text := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog. "), 100)
+	if e := entropy(text); e > massChangeEntropy {
+		t.Errorf("text has entropy %f", e)
+	}
+}
+
+func TestMassChangeDetector(t *testing.T) {
+	d := newMassChangeDetector()
+	now := time.Now()
+	names := make([]string, massChangeMinFiles/2)
+
+	// Half the files changed, but fewer than the minimum.
+	if _, started := d.changed("default", names, massChangeMinFiles, 10, now); started {
+		t.Fatal("paused below the minimum")
+	}
+	// Enough changes, but not a large enough part of the files.
+	if _, started := d.changed("default", names, 10*massChangeMinFiles, 10, now); started {
+		t.Fatal("paused below the percentage")
+	}
+	// The window has passed; counting starts anew.
+	now = now.Add(massChangeWindow + time.Second)
+	if _, started := d.changed("default", names, massChangeMinFiles, 10, now); started {
+		t.Fatal("paused after the window")
+	}
+
+	mc, started := d.changed("default", names, massChangeMinFiles, 10, now)
+	if !started || mc.Changes != massChangeMinFiles || len(mc.Names) != massChangeLogs {
+		t.Fatalf("unexpected mass change %+v, started %v", mc, started)
+	}
+	if !d.isPaused("default") || d.isPaused("other") {
+		t.Error("unexpected paused folders")
+	}
+	if _, started := d.changed("default", names, massChangeMinFiles, 10, now); started {
+		t.Error("paused again while paused")
+	}
+
+	if !d.resume("default") || d.isPaused("default") {
+		t.Error("folder not resumed")
+	}
+	if d.resume("default") {
+		t.Error("resumed a folder not paused")
+	}
+}
+
+func TestMassChangeScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "masschange")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, ".stfolder"), 0755)
+
+	const files = 2 * massChangeMinFiles
+	text := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog. "), 100)
+	for i := 0; i < files; i++ {
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d.txt", i)), text, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fcfg := config.FolderConfiguration{ID: "masschange", RawPath: dir, MassChangePct: 50}
+	cfg := config.Wrap("/tmp/test", config.Configuration{Folders: []config.FolderConfiguration{fcfg}})
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.StartFolderRO("masschange")
+	// Without a rescan interval the runner returns after the initial scan.
+	m.runners.Wait()
+	if mcs := m.MassChanges(); len(mcs) != 0 {
+		t.Fatal("Unexpected mass change after the initial scan:", mcs)
+	}
+
+	sub := events.Default.Subscribe(events.FolderMassChange)
+	defer events.Default.Unsubscribe(sub)
+
+	// Encrypt three quarters of the files, half of them in place and half
+	// of them renamed to a new extension.
+	random := make([]byte, len(text))
+	later := time.Now().Add(time.Minute)
+	for i := 0; i < files*3/4; i++ {
+		rand.Read(random)
+		name := filepath.Join(dir, fmt.Sprintf("file%d.txt", i))
+		if i%2 == 1 {
+			os.Remove(name)
+			name += ".locked"
+		}
+		if err := ioutil.WriteFile(name, random, 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(name, later, later)
+	}
+	if err := m.ScanFolder("masschange"); err != nil {
+		t.Fatal(err)
+	}
+
+	mcs := m.MassChanges()
+	if len(mcs) != 1 || mcs[0].Folder != "masschange" || mcs[0].Changes != files*3/4 || mcs[0].Files != files {
+		t.Fatalf("Unexpected mass changes %+v", mcs)
+	}
+	if _, err := sub.Poll(time.Second); err != nil {
+		t.Error("No mass change event:", err)
+	}
+
+	if err := m.ResumeMassChange("masschange"); err != nil {
+		t.Fatal(err)
+	}
+	if mcs := m.MassChanges(); len(mcs) != 0 {
+		t.Error("Unexpected mass change after resuming:", mcs)
+	}
+	if err := m.ResumeMassChange("masschange"); err == nil {
+		t.Error("Expected an error resuming a folder not paused")
+	}
+}
@@ -8,6 +8,7 @@ package model
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -17,13 +18,15 @@ import (
 	"net"
 	"os"
 	"path/filepath"
-	"runtime"
+	"strconv"
 	"strings"
 	stdsync "sync"
 	"time"
 
+	"github.com/juju/ratelimit"
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/cpulimit"
 	"github.com/syncthing/syncthing/internal/db"
 	"github.com/syncthing/syncthing/internal/events"
 	"github.com/syncthing/syncthing/internal/ignore"
@@ -50,7 +53,10 @@ type service interface {
 	Jobs() ([]string, []string) // In progress, Queued
 	BringToFront(string)
 	DelayScan(d time.Duration)
-	IndexUpdated() // Remote index was updated notification
+	IndexUpdated()        // Remote index was updated notification
+	Errors() []FileError  // Items that failed during the last pull
+	Retry(items []string) // Pull again as soon as possible, starting with the given items
+	Fetch(items []string) // Pull the content of the given placeholders as soon as possible
 
 	setState(state folderState)
 	setError(err error)
@@ -75,14 +81,42 @@ type Model struct {
 	deviceFolders  map[protocol.DeviceID][]string                         // deviceID -> folders
 	deviceStatRefs map[protocol.DeviceID]*stats.DeviceStatisticsReference // deviceID -> statsRef
 	folderIgnores  map[string]*ignore.Matcher                             // folder -> matcher object
+	gitignores     map[string]*ignore.GitignoreCache                      // folder -> .gitignore patterns
 	folderRunners  map[string]service                                     // folder -> puller or scanner
 	folderStatRefs map[string]*stats.FolderStatisticsReference            // folder -> statsRef
 	fmut           sync.RWMutex                                           // protects the above
 
-	protoConn map[protocol.DeviceID]protocol.Connection
-	rawConn   map[protocol.DeviceID]io.Closer
-	deviceVer map[protocol.DeviceID]string
-	pmut      sync.RWMutex // protects protoConn and rawConn
+	protoConn      map[protocol.DeviceID]protocol.Connection
+	rawConn        map[protocol.DeviceID]io.Closer
+	deviceVer      map[protocol.DeviceID]string
+	deviceFeatures map[protocol.DeviceID][]string // features supported by us and the device
+	deviceConnAt   map[protocol.DeviceID]time.Time
+	deviceStored   map[protocol.DeviceID]protocol.Statistics // connection statistics as last added to the device statistics
+	deviceSkew     map[protocol.DeviceID]time.Duration       // how far the device clock is ahead of ours
+	folderAuth     map[protocol.DeviceID]map[string]bool     // folders with a secret the device has proven knowing
+	requestScheds  map[protocol.DeviceID]*requestScheduler   // request slots of the connection, by folder priority
+	indexSlots     map[protocol.DeviceID]chan struct{}       // held while an index batch for the connection is in memory
+	pmut           sync.RWMutex                              // protects protoConn and rawConn
+
+	browseIndexes map[protocol.DeviceID]map[string]browseIndex // deviceID -> folder -> index, for folders not shared with the device
+	bmut          sync.Mutex                                   // protects browseIndexes
+
+	quarantined *quarantine         // index entries announcing impossible data
+	massChanges *massChangeDetector // folders paused after suspicious changes
+
+	completionRates *completionRates      // how fast remote devices catch up
+	pullRates       map[string]*rateMeter // folder -> throughput of the puller
+	pullRatesMut    sync.Mutex            // protects pullRates
+
+	scanReadLimiter *ratelimit.Bucket // shared by all scanners, nil if unlimited
+	hasherSlots     chan struct{}     // shared by all scanners, nil if unlimited
+	pullerSlots     chan struct{}     // shared by all pullers, one per block being pulled, nil if unlimited
+	cpuLimiter      *cpulimit.Limiter // shared by all scanners and pullers, nil if unlimited
+	churn           *churnDetector    // shared by all scanners
+	runners         sync.WaitGroup    // running folder runners
+
+	suspended    bool // scanning, pulling and serving data paused
+	suspendedMut sync.Mutex
 
 	addedFolder bool
 	started     bool
@@ -112,22 +146,67 @@ func NewModel(cfg *config.Wrapper, id protocol.DeviceID, deviceName, clientName,
 		deviceFolders:   make(map[protocol.DeviceID][]string),
 		deviceStatRefs:  make(map[protocol.DeviceID]*stats.DeviceStatisticsReference),
 		folderIgnores:   make(map[string]*ignore.Matcher),
+		gitignores:      make(map[string]*ignore.GitignoreCache),
 		folderRunners:   make(map[string]service),
 		folderStatRefs:  make(map[string]*stats.FolderStatisticsReference),
 		protoConn:       make(map[protocol.DeviceID]protocol.Connection),
 		rawConn:         make(map[protocol.DeviceID]io.Closer),
 		deviceVer:       make(map[protocol.DeviceID]string),
+		deviceFeatures:  make(map[protocol.DeviceID][]string),
+		deviceConnAt:    make(map[protocol.DeviceID]time.Time),
+		deviceStored:    make(map[protocol.DeviceID]protocol.Statistics),
+		deviceSkew:      make(map[protocol.DeviceID]time.Duration),
+		folderAuth:      make(map[protocol.DeviceID]map[string]bool),
+		requestScheds:   make(map[protocol.DeviceID]*requestScheduler),
+		indexSlots:      make(map[protocol.DeviceID]chan struct{}),
+		browseIndexes:   make(map[protocol.DeviceID]map[string]browseIndex),
+		churn:           newChurnDetector(),
+		massChanges:     newMassChangeDetector(),
+		completionRates: newCompletionRates(),
+		pullRates:       make(map[string]*rateMeter),
+		quarantined:     newQuarantine(),
+		runners:         sync.NewWaitGroup(),
 
 		fmut: sync.NewRWMutex(),
 		pmut: sync.NewRWMutex(),
+		bmut: sync.NewMutex(),
+
+		pullRatesMut: sync.NewMutex(),
+		suspendedMut: sync.NewMutex(),
 	}
 	if cfg.Options().ProgressUpdateIntervalS > -1 {
 		go m.progressEmitter.Serve()
 	}
+	if rate := cfg.Options().MaxScanReadMBps; rate > 0 {
+		bps := float64(rate) * 1024 * 1024
+		m.scanReadLimiter = ratelimit.NewBucketWithRate(bps, int64(bps))
+	}
+	if hashers := cfg.Options().MaxConcurrentHashers; hashers > 0 {
+		m.hasherSlots = make(chan struct{}, hashers)
+	}
+	if mib := cfg.Options().MaxPullBufferMiB; mib > 0 {
+		blocks := (mib << 20) / protocol.BlockSize
+		if blocks < 1 {
+			blocks = 1
+		}
+		m.pullerSlots = make(chan struct{}, blocks)
+	}
+	if pct := cfg.Options().MaxCPUPercent; pct > 0 {
+		m.cpuLimiter = cpulimit.New(float64(pct))
+	}
 
 	return m
 }
 
+// ReportCPUUsage feeds a CPU usage sample, in percent of the total CPU
+// capacity of the machine, to the limiter throttling hashers and pullers. It
+// does nothing unless a CPU usage target is configured.
+func (m *Model) ReportCPUUsage(percent float64) {
+	if m.cpuLimiter != nil {
+		m.cpuLimiter.Update(percent)
+	}
+}
+
 // StartDeadlockDetector starts a deadlock detector on the models locks which
 // causes panics in case the locks cannot be acquired in the given timeout
 // period.
@@ -163,7 +242,11 @@ func (m *Model) StartFolderRW(folder string) {
 		p.versioner = factory(folder, cfg.Path(), cfg.Versioning.Params)
 	}
 
-	go p.Serve()
+	m.runners.Add(1)
+	go func() {
+		p.Serve()
+		m.runners.Done()
+	}()
 }
 
 // StartFolderRO starts read only processing on the current model. When in
@@ -184,29 +267,94 @@ func (m *Model) StartFolderRO(folder string) {
 	m.folderRunners[folder] = s
 	m.fmut.Unlock()
 
-	go s.Serve()
+	m.runners.Add(1)
+	go func() {
+		s.Serve()
+		m.runners.Done()
+	}()
+}
+
+// StopFolders stops all folder runners and waits up to the given timeout for
+// them to exit. Files being pulled are finished or checkpointed, rather than
+// being aborted midway. Returns false if the timeout was reached.
+func (m *Model) StopFolders(timeout time.Duration) bool {
+	m.fmut.RLock()
+	for _, runner := range m.folderRunners {
+		runner.Stop()
+	}
+	m.fmut.RUnlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.runners.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// remoteAddrer is implemented by the raw connections, whatever wraps the
+// *tls.Conn.
+type remoteAddrer interface {
+	RemoteAddr() net.Addr
 }
 
 type ConnectionInfo struct {
 	protocol.Statistics
 	Address       string
 	ClientVersion string
+	Type          string // "tcp4" or "tcp6"
+	Cipher        string // Negotiated TLS cipher suite
+	LAN           bool   // Whether the connection is considered local, and thus not rate limited
+	ConnectedAt   time.Time
+	ClockSkew     time.Duration // How far the device clock is ahead of ours
+	Features      []string      // Optional protocol features in use with the device
+	Requests      RequestStats  // Block requests to the device
 }
 
 func (info ConnectionInfo) MarshalJSON() ([]byte, error) {
-	return json.Marshal(map[string]interface{}{
-		"at":            info.At,
-		"inBytesTotal":  info.InBytesTotal,
-		"outBytesTotal": info.OutBytesTotal,
-		"address":       info.Address,
-		"clientVersion": info.ClientVersion,
-	})
+	res := map[string]interface{}{
+		"at":             info.At,
+		"inBytesTotal":   info.InBytesTotal,
+		"outBytesTotal":  info.OutBytesTotal,
+		"checksumErrors": info.ChecksumErrors,
+		"address":        info.Address,
+		"clientVersion":  info.ClientVersion,
+		"type":           info.Type,
+		"cipher":         info.Cipher,
+		"lan":            info.LAN,
+		"clockSkewS":     int(info.ClockSkew / time.Second),
+		"features":       info.Features,
+	}
+	if !info.ConnectedAt.IsZero() {
+		res["connectedAt"] = info.ConnectedAt
+		res["uptimeS"] = int(info.At.Sub(info.ConnectedAt).Seconds())
+	}
+	if info.Requests.Limit > 0 {
+		res["requests"] = map[string]interface{}{
+			"limit":    info.Requests.Limit,
+			"adaptive": info.Requests.Adaptive,
+			"inFlight": info.Requests.InFlight,
+			"waiting":  info.Requests.Waiting,
+			"rttMs":    int(info.Requests.RTT / time.Millisecond),
+			"rate":     info.Requests.Rate,
+		}
+	}
+	return json.Marshal(res)
 }
 
 // ConnectionStats returns a map with connection statistics for each connected device.
 func (m *Model) ConnectionStats() map[string]interface{} {
-	type remoteAddrer interface {
-		RemoteAddr() net.Addr
+	type connectionStater interface {
+		ConnectionState() tls.ConnectionState
+	}
+	type laner interface {
+		IsLAN() bool
 	}
 
 	m.pmut.RLock()
@@ -218,9 +366,29 @@ func (m *Model) ConnectionStats() map[string]interface{} {
 		ci := ConnectionInfo{
 			Statistics:    conn.Statistics(),
 			ClientVersion: m.deviceVer[device],
+			ConnectedAt:   m.deviceConnAt[device],
+			ClockSkew:     m.deviceSkew[device],
+			Features:      m.deviceFeatures[device],
+		}
+		if sched, ok := m.requestScheds[device]; ok {
+			ci.Requests = sched.stats()
 		}
 		if nc, ok := m.rawConn[device].(remoteAddrer); ok {
-			ci.Address = nc.RemoteAddr().String()
+			addr := nc.RemoteAddr()
+			ci.Address = addr.String()
+			if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+				if tcpAddr.IP.To4() != nil {
+					ci.Type = "tcp4"
+				} else {
+					ci.Type = "tcp6"
+				}
+			}
+		}
+		if tc, ok := m.rawConn[device].(connectionStater); ok {
+			ci.Cipher = cipherSuiteName(tc.ConnectionState().CipherSuite)
+		}
+		if lc, ok := m.rawConn[device].(laner); ok {
+			ci.LAN = lc.IsLAN()
 		}
 
 		conns[device.String()] = ci
@@ -234,9 +402,10 @@ func (m *Model) ConnectionStats() map[string]interface{} {
 	in, out := protocol.TotalInOut()
 	res["total"] = ConnectionInfo{
 		Statistics: protocol.Statistics{
-			At:            time.Now(),
-			InBytesTotal:  in,
-			OutBytesTotal: out,
+			At:             time.Now(),
+			InBytesTotal:   in,
+			OutBytesTotal:  out,
+			ChecksumErrors: protocol.TotalChecksumErrors(),
 		},
 	}
 
@@ -245,6 +414,12 @@ func (m *Model) ConnectionStats() map[string]interface{} {
 
 // DeviceStatistics returns statistics about each device
 func (m *Model) DeviceStatistics() map[string]stats.DeviceStatistics {
+	m.pmut.Lock()
+	for id := range m.protoConn {
+		m.storeTransferredLocked(id)
+	}
+	m.pmut.Unlock()
+
 	var res = make(map[string]stats.DeviceStatistics)
 	for id := range m.cfg.Devices() {
 		res[id.String()] = m.deviceStatRef(id).GetStatistics()
@@ -261,43 +436,47 @@ func (m *Model) FolderStatistics() map[string]stats.FolderStatistics {
 	return res
 }
 
-// Completion returns the completion status, in percent, for the given device
-// and folder.
-func (m *Model) Completion(device protocol.DeviceID, folder string) float64 {
-	var tot int64
-
-	m.fmut.RLock()
-	rf, ok := m.folderFiles[folder]
-	m.fmut.RUnlock()
-	if !ok {
-		return 0 // Folder doesn't exist, so we hardly have any of it
+// StoreHistory writes the transfers since the last call to the transfer
+// history of each device and folder, and marks the connected devices as
+// seen. It should be called regularly, as transfers are attributed to the
+// period in which they are stored.
+func (m *Model) StoreHistory() {
+	m.pmut.Lock()
+	connected := make([]protocol.DeviceID, 0, len(m.protoConn))
+	for id := range m.protoConn {
+		m.storeTransferredLocked(id)
+		connected = append(connected, id)
 	}
+	m.pmut.Unlock()
 
-	rf.WithGlobalTruncated(func(f db.FileIntf) bool {
-		if !f.IsDeleted() {
-			tot += f.Size()
-		}
-		return true
-	})
+	for _, id := range connected {
+		m.deviceWasSeen(id)
+	}
 
-	if tot == 0 {
-		return 100 // Folder is empty, so we have all of it
+	for id := range m.cfg.Devices() {
+		m.deviceStatRef(id).StoreHistory()
 	}
+	for id := range m.cfg.Folders() {
+		m.folderStatRef(id).StoreHistory()
+	}
+}
 
-	var need int64
-	rf.WithNeedTruncated(device, func(f db.FileIntf) bool {
-		if !f.IsDeleted() {
-			need += f.Size()
-		}
-		return true
-	})
+// TransferHistory returns the hourly and daily transfer totals of each device
+// and folder. For devices these are the bytes received and sent over the
+// connection, for folders the size of the files synced into the folder and
+// the data sent from it.
+func (m *Model) TransferHistory() (devices map[string]stats.History, folders map[string]stats.History) {
+	m.StoreHistory()
 
-	res := 100 * (1 - float64(need)/float64(tot))
-	if debug {
-		l.Debugf("%v Completion(%s, %q): %f (%d / %d)", m, device, folder, res, need, tot)
+	devices = make(map[string]stats.History)
+	for id := range m.cfg.Devices() {
+		devices[id.String()] = m.deviceStatRef(id).GetHistory()
 	}
-
-	return res
+	folders = make(map[string]stats.History)
+	for id := range m.cfg.Folders() {
+		folders[id] = m.folderStatRef(id).GetHistory()
+	}
+	return devices, folders
 }
 
 func sizeOf(fs []protocol.FileInfo) (files, deleted int, bytes int64) {
@@ -362,7 +541,12 @@ func (m *Model) NeedSize(folder string) (nfiles int, bytes int64) {
 	m.fmut.RLock()
 	defer m.fmut.RUnlock()
 	if rf, ok := m.folderFiles[folder]; ok {
+		archive := m.folderCfgs[folder].Archive
 		rf.WithNeedTruncated(protocol.LocalDeviceID, func(f db.FileIntf) bool {
+			if archive && f.IsDeleted() {
+				// Never applied, so not needed.
+				return true
+			}
 			fs, de, by := sizeOfFile(f)
 			nfiles += fs + de
 			bytes += by
@@ -370,12 +554,34 @@ func (m *Model) NeedSize(folder string) (nfiles int, bytes int64) {
 		})
 	}
 	bytes -= m.progressEmitter.BytesCompleted(folder)
-	if debug {
+	if debug.On() {
 		l.Debugf("%v NeedSize(%q): %d %d", m, folder, nfiles, bytes)
 	}
 	return
 }
 
+// DatabaseSizes returns the approximate space used on disk by the index of
+// each folder.
+func (m *Model) DatabaseSizes() map[string]int64 {
+	m.fmut.RLock()
+	folders := make([]string, 0, len(m.folderFiles))
+	for folder := range m.folderFiles {
+		folders = append(folders, folder)
+	}
+	m.fmut.RUnlock()
+
+	sizes := make(map[string]int64, len(folders))
+	for _, folder := range folders {
+		size, err := db.FolderSize(m.db, folder)
+		if err != nil {
+			l.Infof("Database size of folder %q: %v", folder, err)
+			continue
+		}
+		sizes[folder] = size
+	}
+	return sizes
+}
+
 // NeedFolderFiles returns paginated list of currently needed files in
 // progress, queued, and to be queued on next puller iteration, as well as the
 // total number of files currently needed.
@@ -451,16 +657,32 @@ func (m *Model) Index(deviceID protocol.DeviceID, folder string, fs []protocol.F
 		return
 	}
 
-	if debug {
+	if debug.On() {
 		l.Debugf("IDX(in): %s %q: %d files", deviceID, folder, len(fs))
 	}
 
 	if !m.folderSharedWith(folder, deviceID) {
+		deviceName := deviceID.String()[:7]
+		if dev, ok := m.cfg.Devices()[deviceID]; ok && dev.Name != "" {
+			deviceName = dev.Name
+		}
 		events.Default.Log(events.FolderRejected, map[string]string{
-			"folder": folder,
-			"device": deviceID.String(),
+			"folder":      folder,
+			"device":      deviceID.String(),
+			"defaultPath": m.cfg.Options().DefaultFolderPathFor(folder, deviceName),
 		})
 		l.Infof("Unexpected folder ID %q sent from device %q; ensure that the folder exists and that this device is selected under \"Share With\" in the folder configuration.", folder, deviceID)
+		m.updateBrowseIndex(deviceID, folder, fs, true)
+		return
+	}
+
+	if !m.folderAuthorized(folder, deviceID) {
+		l.Infof("Ignoring index for folder %q from device %v, which has not proven knowing the folder secret", folder, deviceID)
+		return
+	}
+
+	if m.sharedReadOnly(folder, deviceID) {
+		l.Infof("Ignoring index for folder %q from device %v, which the folder is shared with read only", folder, deviceID)
 		return
 	}
 
@@ -479,15 +701,17 @@ func (m *Model) Index(deviceID protocol.DeviceID, folder string, fs []protocol.F
 		l.Fatalf("Index for nonexistant folder %q", folder)
 	}
 
+	fs = m.quarantine(deviceID, folder, fs)
+	m.rejectInvalidNames(deviceID, folder, fs)
 	for i := 0; i < len(fs); {
 		if fs[i].Flags&^protocol.FlagsAll != 0 {
-			if debug {
+			if debug.On() {
 				l.Debugln("dropping update for file with unknown bits set", fs[i])
 			}
 			fs[i] = fs[len(fs)-1]
 			fs = fs[:len(fs)-1]
 		} else if symlinkInvalid(fs[i].IsSymlink()) {
-			if debug {
+			if debug.On() {
 				l.Debugln("dropping update for unsupported symlink", fs[i])
 			}
 			fs[i] = fs[len(fs)-1]
@@ -515,12 +739,27 @@ func (m *Model) IndexUpdate(deviceID protocol.DeviceID, folder string, fs []prot
 		return
 	}
 
-	if debug {
+	if debug.On() {
 		l.Debugf("%v IDXUP(in): %s / %q: %d files", m, deviceID, folder, len(fs))
 	}
 
 	if !m.folderSharedWith(folder, deviceID) {
 		l.Infof("Update for unexpected folder ID %q sent from device %q; ensure that the folder exists and that this device is selected under \"Share With\" in the folder configuration.", folder, deviceID)
+		m.updateBrowseIndex(deviceID, folder, fs, false)
+		return
+	}
+
+	if !m.folderAuthorized(folder, deviceID) {
+		if debug.On() {
+			l.Debugf("%v ignoring index update for %q from unauthorized device %v", m, folder, deviceID)
+		}
+		return
+	}
+
+	if m.sharedReadOnly(folder, deviceID) {
+		if debug.On() {
+			l.Debugf("%v ignoring index update for %q from read only device %v", m, folder, deviceID)
+		}
 		return
 	}
 
@@ -533,15 +772,17 @@ func (m *Model) IndexUpdate(deviceID protocol.DeviceID, folder string, fs []prot
 		l.Fatalf("IndexUpdate for nonexistant folder %q", folder)
 	}
 
+	fs = m.quarantine(deviceID, folder, fs)
+	m.rejectInvalidNames(deviceID, folder, fs)
 	for i := 0; i < len(fs); {
 		if fs[i].Flags&^protocol.FlagsAll != 0 {
-			if debug {
+			if debug.On() {
 				l.Debugln("dropping update for file with unknown bits set", fs[i])
 			}
 			fs[i] = fs[len(fs)-1]
 			fs = fs[:len(fs)-1]
 		} else if symlinkInvalid(fs[i].IsSymlink()) {
-			if debug {
+			if debug.On() {
 				l.Debugln("dropping update for unsupported symlink", fs[i])
 			}
 			fs[i] = fs[len(fs)-1]
@@ -574,6 +815,19 @@ func (m *Model) folderSharedWith(folder string, deviceID protocol.DeviceID) bool
 	return false
 }
 
+// sharedReadOnly returns true if the folder is shared with the device read
+// only, so that changes from the device are not accepted.
+func (m *Model) sharedReadOnly(folder string, deviceID protocol.DeviceID) bool {
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+	for _, device := range m.folderCfgs[folder].Devices {
+		if device.DeviceID == deviceID {
+			return device.ReadOnly
+		}
+	}
+	return false
+}
+
 func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterConfigMessage) {
 	m.pmut.Lock()
 	if cm.ClientName == "syncthing" {
@@ -581,6 +835,14 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 	} else {
 		m.deviceVer[deviceID] = cm.ClientName + " " + cm.ClientVersion
 	}
+	m.deviceFeatures[deviceID] = commonFeatures(cm, m.localFeatures())
+	if conn, ok := m.protoConn[deviceID]; ok {
+		for _, f := range m.deviceFeatures[deviceID] {
+			if f == featureChecksums {
+				conn.EnableChecksums()
+			}
+		}
+	}
 
 	event := map[string]string{
 		"id":            deviceID.String(),
@@ -588,7 +850,7 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 		"clientVersion": cm.ClientVersion,
 	}
 
-	if conn, ok := m.rawConn[deviceID].(*tls.Conn); ok {
+	if conn, ok := m.rawConn[deviceID].(remoteAddrer); ok {
 		event["addr"] = conn.RemoteAddr().String()
 	}
 
@@ -598,6 +860,17 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 
 	l.Infof(`Device %s client is "%s %s"`, deviceID, cm.ClientName, cm.ClientVersion)
 
+	m.checkClockSkew(deviceID, cm)
+	m.checkSecrets(deviceID, cm)
+
+	for _, folder := range cm.Folders {
+		for _, device := range folder.Devices {
+			if bytes.Equal(device.ID, m.id[:]) && device.Flags&protocol.FlagShareReadOnly != 0 {
+				l.Infof("Device %v shares folder %q with us read only; our changes will not be accepted", deviceID, folder.ID)
+			}
+		}
+	}
+
 	var changed bool
 
 	if name := cm.GetOption("name"); name != "" {
@@ -682,7 +955,11 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 // Close removes the peer from the model and closes the underlying connection if possible.
 // Implements the protocol.Model interface.
 func (m *Model) Close(device protocol.DeviceID, err error) {
-	l.Infof("Connection to %s closed: %v", device, err)
+	if err == protocol.ErrChecksum {
+		l.Warnf("Connection to %s closed: %v. The message was corrupted after it was sent or before it was received, most likely by faulty memory on one of the devices.", device, err)
+	} else {
+		l.Infof("Connection to %s closed: %v", device, err)
+	}
 	events.Default.Log(events.DeviceDisconnected, map[string]string{
 		"id":    device.String(),
 		"error": err.Error(),
@@ -697,7 +974,9 @@ func (m *Model) Close(device protocol.DeviceID, err error) {
 
 	conn, ok := m.rawConn[device]
 	if ok {
-		if conn, ok := conn.(*tls.Conn); ok {
+		if conn, ok := conn.(interface {
+			SetWriteDeadline(time.Time) error
+		}); ok {
 			// If the underlying connection is a *tls.Conn, Close() does more
 			// than it says on the tin. Specifically, it sends a TLS alert
 			// message, which might block forever if the connection is dead
@@ -706,10 +985,27 @@ func (m *Model) Close(device protocol.DeviceID, err error) {
 		}
 		conn.Close()
 	}
+	m.storeTransferredLocked(device)
+
+	m.bmut.Lock()
+	delete(m.browseIndexes, device)
+	m.bmut.Unlock()
+
 	delete(m.protoConn, device)
 	delete(m.rawConn, device)
 	delete(m.deviceVer, device)
+	delete(m.deviceFeatures, device)
+	delete(m.deviceConnAt, device)
+	delete(m.requestScheds, device)
+	delete(m.indexSlots, device)
+	delete(m.deviceStored, device)
+	delete(m.deviceSkew, device)
+	delete(m.folderAuth, device)
 	m.pmut.Unlock()
+
+	if ok {
+		m.deviceWasSeen(device)
+	}
 }
 
 // Request returns the specified data segment by reading it from local disk.
@@ -724,6 +1020,15 @@ func (m *Model) Request(deviceID protocol.DeviceID, folder, name string, offset
 		return nil, protocol.ErrNoSuchFile
 	}
 
+	if !m.folderAuthorized(folder, deviceID) {
+		l.Warnf("Request from %s for file %s in folder %q without proving knowing its secret", deviceID, name, folder)
+		return nil, protocol.ErrNoSuchFile
+	}
+
+	if m.Suspended() {
+		return nil, protocol.ErrGeneric
+	}
+
 	if flags != 0 {
 		// We don't currently support or expect any flags.
 		return nil, fmt.Errorf("protocol error: unknown flags 0x%x in Request message", flags)
@@ -745,26 +1050,33 @@ func (m *Model) Request(deviceID protocol.DeviceID, folder, name string, offset
 	}
 
 	if lf.IsInvalid() || lf.IsDeleted() {
-		if debug {
+		if debug.On() {
 			l.Debugf("%v REQ(in): %s: %q / %q o=%d s=%d; invalid: %v", m, deviceID, folder, name, offset, size, lf)
 		}
 		return nil, protocol.ErrInvalid
 	}
 
 	if offset > lf.Size() {
-		if debug {
+		if debug.On() {
 			l.Debugf("%v REQ(in; nonexistent): %s: %q o=%d s=%d", m, deviceID, name, offset, size)
 		}
 		return nil, protocol.ErrNoSuchFile
 	}
 
-	if debug && deviceID != protocol.LocalDeviceID {
+	if debug.On() && deviceID != protocol.LocalDeviceID {
 		l.Debugf("%v REQ(in): %s: %q / %q o=%d s=%d", m, deviceID, folder, name, offset, size)
 	}
 	m.fmut.RLock()
 	fn := filepath.Join(m.folderCfgs[folder].Path(), name)
 	m.fmut.RUnlock()
 
+	if hasOption(options, hashRequestOption) {
+		if lf.IsSymlink() {
+			return nil, protocol.ErrInvalid
+		}
+		return hashRange(fn, offset, size)
+	}
+
 	var reader io.ReaderAt
 	var err error
 	if lf.IsSymlink() {
@@ -790,6 +1102,10 @@ func (m *Model) Request(deviceID protocol.DeviceID, folder, name string, offset
 		return nil, err
 	}
 
+	if deviceID != protocol.LocalDeviceID {
+		m.folderStatRef(folder).AddTransferred(0, int64(size))
+	}
+
 	return buf, nil
 }
 
@@ -837,9 +1153,6 @@ func (m *Model) ConnectedTo(deviceID protocol.DeviceID) bool {
 	m.pmut.RLock()
 	_, ok := m.protoConn[deviceID]
 	m.pmut.RUnlock()
-	if ok {
-		m.deviceWasSeen(deviceID)
-	}
 	return ok
 }
 
@@ -881,6 +1194,10 @@ func (m *Model) SetIgnores(folder string, content []string) error {
 		return fmt.Errorf("Folder %s does not exist", folder)
 	}
 
+	if _, err := parseIgnores(cfg, content); err != nil {
+		return err
+	}
+
 	fd, err := ioutil.TempFile(cfg.Path(), ".syncthing.stignore-"+folder)
 	if err != nil {
 		l.Warnln("Saving .stignore:", err)
@@ -912,6 +1229,233 @@ func (m *Model) SetIgnores(folder string, content []string) error {
 	return m.ScanFolder(folder)
 }
 
+// tooLarge returns true if the file on disk is larger than the maximum file
+// size of the folder.
+func tooLarge(cfg config.FolderConfiguration, f db.FileInfoTruncated) bool {
+	max := cfg.MaxFileSize()
+	if max == 0 || f.IsDirectory() || f.IsSymlink() {
+		return false
+	}
+	info, err := osutil.Lstat(filepath.Join(cfg.Path(), f.Name))
+	return err == nil && info.Mode().IsRegular() && info.Size() > max
+}
+
+// loadIgnores loads the .stignore of the folder into the matcher. The types
+// excluded in the options come first, so that the .stignore can't override
+// them, and the patterns of the .gitignore files in the folder last, if it
+// imports them.
+func (m *Model) loadIgnores(cfg config.FolderConfiguration, ignores *ignore.Matcher, gitignores *ignore.GitignoreCache) error {
+	var before, after []string
+	for _, pat := range m.cfg.Options().ExcludeTypes {
+		// A trailing slash means the directory and its contents, which is
+		// what a pattern without one means to us.
+		if pat = strings.TrimSuffix(strings.TrimSpace(pat), "/"); pat != "" {
+			before = append(before, pat)
+		}
+	}
+
+	var err error
+	if cfg.ImportGitignore {
+		after, err = gitignores.Patterns()
+	}
+
+	if lerr := ignores.LoadWith(filepath.Join(cfg.Path(), ".stignore"), before, after); lerr != nil {
+		return lerr
+	}
+	return err
+}
+
+// Markers around the patterns added to the .stignore by ImportGitignore.
+const (
+	gitignoreImportStart = "// Imported from .gitignore files"
+	gitignoreImportEnd   = "// End of imported .gitignore files"
+)
+
+// ImportGitignore converts the patterns of the .gitignore files in the folder
+// and adds them to the end of its .stignore, replacing those added by a
+// previous import.
+func (m *Model) ImportGitignore(folder string) error {
+	m.fmut.RLock()
+	cfg, ok := m.folderCfgs[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return fmt.Errorf("Folder %s does not exist", folder)
+	}
+
+	lines, _, err := m.GetIgnores(folder)
+	if err != nil {
+		return err
+	}
+	patterns, err := ignore.GitignorePatterns(cfg.Path())
+	if err != nil {
+		return err
+	}
+
+	var content []string
+	imported := false
+	for _, line := range lines {
+		switch {
+		case line == gitignoreImportStart:
+			imported = true
+		case line == gitignoreImportEnd:
+			imported = false
+		case !imported:
+			content = append(content, line)
+		}
+	}
+	if len(patterns) > 0 {
+		content = append(content, gitignoreImportStart)
+		content = append(content, patterns...)
+		content = append(content, gitignoreImportEnd)
+	}
+
+	return m.SetIgnores(folder, content)
+}
+
+// parseIgnores returns a matcher for the given .stignore contents, or an
+// error if they are invalid. Includes are relative to the folder.
+func parseIgnores(cfg config.FolderConfiguration, content []string) (*ignore.Matcher, error) {
+	matcher := ignore.New(false)
+	err := matcher.Parse(strings.NewReader(strings.Join(content, "\n")), filepath.Join(cfg.Path(), ".stignore"))
+	if err != nil {
+		return nil, err
+	}
+	return matcher, nil
+}
+
+// MatchIgnores returns whether each of the given paths would be ignored in
+// the folder. If content is nil the current ignore patterns are used,
+// otherwise the patterns given by content, which is in .stignore format.
+func (m *Model) MatchIgnores(folder string, content []string, paths []string) (map[string]bool, error) {
+	m.fmut.RLock()
+	cfg, ok := m.folderCfgs[folder]
+	matcher := m.folderIgnores[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Folder %s does not exist", folder)
+	}
+
+	if content != nil {
+		var err error
+		matcher, err = parseIgnores(cfg, content)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		res[path] = matcher.Match(osutil.NativeFilename(path))
+	}
+	return res, nil
+}
+
+// IgnoredFiles returns the files and directories that exist in the global
+// index, that is on other devices, but are ignored in the folder.
+func (m *Model) IgnoredFiles(folder string) ([]db.FileInfoTruncated, error) {
+	m.fmut.RLock()
+	files, ok := m.folderFiles[folder]
+	matcher := m.folderIgnores[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Folder %s does not exist", folder)
+	}
+
+	var ignored []db.FileInfoTruncated
+	files.WithGlobalTruncated(func(fi db.FileIntf) bool {
+		f := fi.(db.FileInfoTruncated)
+		if !f.IsDeleted() && matcher.Match(f.Name) {
+			ignored = append(ignored, f)
+		}
+		return true
+	})
+	return ignored, nil
+}
+
+// RetainedFiles returns the files of an archive folder that have been
+// deleted on other devices but are kept locally.
+func (m *Model) RetainedFiles(folder string) ([]db.FileInfoTruncated, error) {
+	m.fmut.RLock()
+	files, ok := m.folderFiles[folder]
+	cfg := m.folderCfgs[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Folder %s does not exist", folder)
+	}
+	if !cfg.Archive {
+		return nil, fmt.Errorf("Folder %s is not an archive folder", folder)
+	}
+
+	var retained []db.FileInfoTruncated
+	files.WithNeedTruncated(protocol.LocalDeviceID, func(fi db.FileIntf) bool {
+		f := fi.(db.FileInfoTruncated)
+		if f.IsDeleted() {
+			if lf, ok := files.Get(protocol.LocalDeviceID, f.Name); ok && !lf.IsDeleted() {
+				retained = append(retained, f)
+			}
+		}
+		return true
+	})
+	return retained, nil
+}
+
+// A PullPlan lists the changes the next pull would make to a folder.
+type PullPlan struct {
+	Create  []db.FileInfoTruncated
+	Replace []db.FileInfoTruncated
+	Delete  []db.FileInfoTruncated
+}
+
+// PullPlan returns which needed files the puller would create, replace or
+// delete, without touching the disk. Files that would not be pulled, for
+// being ignored, unusable or too large, and deletions held back by the
+// delete window are not included.
+func (m *Model) PullPlan(folder string) (PullPlan, error) {
+	m.fmut.RLock()
+	files, ok := m.folderFiles[folder]
+	cfg := m.folderCfgs[folder]
+	ignores := m.folderIgnores[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return PullPlan{}, fmt.Errorf("Folder %s does not exist", folder)
+	}
+	maxFileSize := cfg.MaxFileSize()
+	deleteDelay := cfg.DeleteDelay()
+	pendingDeletes := db.NewPendingDeleteRepo(m.db, folder)
+	now := time.Now()
+
+	var plan PullPlan
+	files.WithNeedTruncated(protocol.LocalDeviceID, func(fi db.FileIntf) bool {
+		f := fi.(db.FileInfoTruncated)
+		if ignores.Match(f.Name) || osutil.CheckFilename(f.Name) != nil {
+			return true
+		}
+
+		lf, ok := files.Get(protocol.LocalDeviceID, f.Name)
+		exists := ok && !lf.IsDeleted()
+		switch {
+		case f.IsDeleted():
+			if !exists || cfg.Archive {
+				break
+			}
+			if deleteDelay > 0 {
+				since, cancelled, _ := pendingDelete(files, pendingDeletes, f.Name, f.Version, now)
+				if cancelled || now.Sub(since) < deleteDelay {
+					break
+				}
+			}
+			plan.Delete = append(plan.Delete, f)
+		case maxFileSize > 0 && !f.IsDirectory() && !f.IsSymlink() && f.Size() > maxFileSize:
+		case exists:
+			plan.Replace = append(plan.Replace, f)
+		default:
+			plan.Create = append(plan.Create, f)
+		}
+		return true
+	})
+	return plan, nil
+}
+
 // AddConnection adds a new peer connection to the model. An initial index will
 // be sent to the connected peer, thereafter index updates whenever the local
 // folder changes.
@@ -927,14 +1471,22 @@ func (m *Model) AddConnection(rawConn io.Closer, protoConn protocol.Connection)
 		panic("add existing device")
 	}
 	m.rawConn[deviceID] = rawConn
+	m.deviceConnAt[deviceID] = time.Now()
+	m.requestScheds[deviceID] = newRequestScheduler(m.cfg.Devices()[deviceID].MaxRequests)
+	m.indexSlots[deviceID] = make(chan struct{}, 1)
 
 	cm := m.clusterConfig(deviceID)
 	protoConn.ClusterConfig(cm)
 
 	m.fmut.RLock()
 	for _, folder := range m.deviceFolders[deviceID] {
+		if m.folderCfgs[folder].Secret != "" && !m.folderAuth[deviceID][folder] {
+			// The index is sent once the device has proven knowing the
+			// secret of the folder, in its cluster config.
+			continue
+		}
 		fs := m.folderFiles[folder]
-		go sendIndexes(protoConn, folder, fs, m.folderIgnores[folder])
+		go m.sendIndexes(protoConn, folder, fs, m.folderIgnores[folder])
 	}
 	m.fmut.RUnlock()
 	m.pmut.Unlock()
@@ -959,6 +1511,20 @@ func (m *Model) deviceWasSeen(deviceID protocol.DeviceID) {
 	m.deviceStatRef(deviceID).WasSeen()
 }
 
+// storeTransferredLocked adds the bytes transferred over the current
+// connection to the device since the last call to the persistent device
+// statistics. Must be called with pmut held.
+func (m *Model) storeTransferredLocked(deviceID protocol.DeviceID) {
+	conn, ok := m.protoConn[deviceID]
+	if !ok {
+		return
+	}
+	cur := conn.Statistics()
+	prev := m.deviceStored[deviceID]
+	m.deviceStored[deviceID] = cur
+	m.deviceStatRef(deviceID).AddTransferred(cur.InBytesTotal-prev.InBytesTotal, cur.OutBytesTotal-prev.OutBytesTotal)
+}
+
 func (m *Model) folderStatRef(folder string) *stats.FolderStatisticsReference {
 	m.fmut.Lock()
 	defer m.fmut.Unlock()
@@ -975,36 +1541,42 @@ func (m *Model) receivedFile(folder, filename string) {
 	m.folderStatRef(folder).ReceivedFile(filename)
 }
 
-func sendIndexes(conn protocol.Connection, folder string, fs *db.FileSet, ignores *ignore.Matcher) {
+func (m *Model) sendIndexes(conn protocol.Connection, folder string, fs *db.FileSet, ignores *ignore.Matcher) {
 	deviceID := conn.ID()
 	name := conn.Name()
 	var err error
 
-	if debug {
+	if debug.On() {
 		l.Debugf("sendIndexes for %s-%s/%q starting", deviceID, name, folder)
 	}
 
-	minLocalVer, err := sendIndexTo(true, 0, conn, folder, fs, ignores)
+	// Nothing is announced while the folder is paused after a mass change.
+	for m.massChanges.isPaused(folder) {
+		time.Sleep(5 * time.Second)
+	}
+
+	m.pmut.RLock()
+	slot := m.indexSlots[deviceID]
+	m.pmut.RUnlock()
+
+	minLocalVer, err := sendIndexTo(true, 0, conn, folder, fs, ignores, slot)
 
 	for err == nil {
 		time.Sleep(5 * time.Second)
-		if fs.LocalVersion(protocol.LocalDeviceID) <= minLocalVer {
+		if fs.LocalVersion(protocol.LocalDeviceID) <= minLocalVer || m.massChanges.isPaused(folder) {
 			continue
 		}
 
-		minLocalVer, err = sendIndexTo(false, minLocalVer, conn, folder, fs, ignores)
+		minLocalVer, err = sendIndexTo(false, minLocalVer, conn, folder, fs, ignores, slot)
 	}
 
-	if debug {
+	if debug.On() {
 		l.Debugf("sendIndexes for %s-%s/%q exiting: %v", deviceID, name, folder, err)
 	}
 }
 
-func sendIndexTo(initial bool, minLocalVer int64, conn protocol.Connection, folder string, fs *db.FileSet, ignores *ignore.Matcher) (int64, error) {
-	deviceID := conn.ID()
-	name := conn.Name()
-	batch := make([]protocol.FileInfo, 0, indexBatchSize)
-	currentBatchSize := 0
+func sendIndexTo(initial bool, minLocalVer int64, conn protocol.Connection, folder string, fs *db.FileSet, ignores *ignore.Matcher, slot chan struct{}) (int64, error) {
+	batch := newIndexBatch(conn, folder, initial, slot)
 	maxLocalVer := int64(0)
 	var err error
 
@@ -1019,49 +1591,18 @@ func sendIndexTo(initial bool, minLocalVer int64, conn protocol.Connection, fold
 		}
 
 		if ignores.Match(f.Name) || symlinkInvalid(f.IsSymlink()) {
-			if debug {
+			if debug.On() {
 				l.Debugln("not sending update for ignored/unsupported symlink", f)
 			}
 			return true
 		}
 
-		if len(batch) == indexBatchSize || currentBatchSize > indexTargetSize {
-			if initial {
-				if err = conn.Index(folder, batch, 0, nil); err != nil {
-					return false
-				}
-				if debug {
-					l.Debugf("sendIndexes for %s-%s/%q: %d files (<%d bytes) (initial index)", deviceID, name, folder, len(batch), currentBatchSize)
-				}
-				initial = false
-			} else {
-				if err = conn.IndexUpdate(folder, batch, 0, nil); err != nil {
-					return false
-				}
-				if debug {
-					l.Debugf("sendIndexes for %s-%s/%q: %d files (<%d bytes) (batched update)", deviceID, name, folder, len(batch), currentBatchSize)
-				}
-			}
-
-			batch = make([]protocol.FileInfo, 0, indexBatchSize)
-			currentBatchSize = 0
-		}
-
-		batch = append(batch, f)
-		currentBatchSize += indexPerFileSize + len(f.Blocks)*IndexPerBlockSize
-		return true
+		err = batch.append(f)
+		return err == nil
 	})
 
-	if initial && err == nil {
-		err = conn.Index(folder, batch, 0, nil)
-		if debug && err == nil {
-			l.Debugf("sendIndexes for %s-%s/%q: %d files (small initial index)", deviceID, name, folder, len(batch))
-		}
-	} else if len(batch) > 0 && err == nil {
-		err = conn.IndexUpdate(folder, batch, 0, nil)
-		if debug && err == nil {
-			l.Debugf("sendIndexes for %s-%s/%q: %d files (last batch)", deviceID, name, folder, len(batch))
-		}
+	if err == nil {
+		err = batch.flush()
 	}
 
 	return maxLocalVer, err
@@ -1081,17 +1622,31 @@ func (m *Model) updateLocals(folder string, fs []protocol.FileInfo) {
 func (m *Model) requestGlobal(deviceID protocol.DeviceID, folder, name string, offset int64, size int, hash []byte, flags uint32, options []protocol.Option) ([]byte, error) {
 	m.pmut.RLock()
 	nc, ok := m.protoConn[deviceID]
+	sched := m.requestScheds[deviceID]
 	m.pmut.RUnlock()
 
 	if !ok {
 		return nil, fmt.Errorf("requestGlobal: no such device: %s", deviceID)
 	}
 
-	if debug {
+	m.fmut.RLock()
+	priority := m.folderCfgs[folder].Priority
+	m.fmut.RUnlock()
+
+	sched.acquire(priority)
+
+	if debug.On() {
 		l.Debugf("%v REQ(out): %s: %q / %q o=%d s=%d h=%x f=%x op=%s", m, deviceID, folder, name, offset, size, hash, flags, options)
 	}
 
-	return nc.Request(folder, name, offset, size, hash, flags, options)
+	t0 := time.Now()
+	buf, err := nc.Request(folder, name, offset, size, hash, flags, options)
+	if err != nil {
+		sched.release(0, 0)
+	} else {
+		sched.release(len(buf), time.Since(t0))
+	}
+	return buf, err
 }
 
 func (m *Model) AddFolder(cfg config.FolderConfiguration) {
@@ -1113,8 +1668,10 @@ func (m *Model) AddFolder(cfg config.FolderConfiguration) {
 	}
 
 	ignores := ignore.New(m.cfg.Options().CacheIgnoredFiles)
-	_ = ignores.Load(filepath.Join(cfg.Path(), ".stignore")) // Ignore error, there might not be an .stignore
+	gitignores := ignore.NewGitignoreCache(cfg.Path())
+	_ = m.loadIgnores(cfg, ignores, gitignores) // Ignore error, there might not be an .stignore
 	m.folderIgnores[cfg.ID] = ignores
+	m.gitignores[cfg.ID] = gitignores
 
 	m.addedFolder = true
 	m.fmut.Unlock()
@@ -1164,10 +1721,13 @@ func (m *Model) ScanFolder(folder string) error {
 
 func (m *Model) ScanFolderSubs(folder string, subs []string) error {
 	for i, sub := range subs {
-		sub = osutil.NativeFilename(sub)
-		if p := filepath.Clean(filepath.Join(folder, sub)); !strings.HasPrefix(p, folder) {
+		sub = filepath.Clean(osutil.NativeFilename(sub))
+		if filepath.IsAbs(sub) || sub == ".." || strings.HasPrefix(sub, ".."+string(filepath.Separator)) {
 			return errors.New("invalid subpath")
 		}
+		if sub == "." {
+			sub = ""
+		}
 		subs[i] = sub
 	}
 
@@ -1175,6 +1735,7 @@ func (m *Model) ScanFolderSubs(folder string, subs []string) error {
 	fs := m.folderFiles[folder]
 	folderCfg := m.folderCfgs[folder]
 	ignores := m.folderIgnores[folder]
+	gitignores := m.gitignores[folder]
 	runner, ok := m.folderRunners[folder]
 	m.fmut.Unlock()
 
@@ -1185,7 +1746,7 @@ func (m *Model) ScanFolderSubs(folder string, subs []string) error {
 		return errors.New("no such folder")
 	}
 
-	_ = ignores.Load(filepath.Join(folderCfg.Path(), ".stignore")) // Ignore error, there might not be an .stignore
+	_ = m.loadIgnores(folderCfg, ignores, gitignores) // Ignore error, there might not be an .stignore
 
 	// Required to make sure that we start indexing at a directory we're already
 	// aware off.
@@ -1201,8 +1762,13 @@ nextSub:
 				sub = ""
 			}
 		}
+		if sub == "" {
+			// We need to scan the whole folder anyway.
+			unifySubs = nil
+			break
+		}
 		for _, us := range unifySubs {
-			if strings.HasPrefix(sub, us) {
+			if isSubpath(sub, us) {
 				continue nextSub
 			}
 		}
@@ -1219,9 +1785,15 @@ nextSub:
 		TempLifetime:  time.Duration(m.cfg.Options().KeepTemporariesH) * time.Hour,
 		CurrentFiler:  cFiler{m, folder},
 		MtimeRepo:     db.NewVirtualMtimeRepo(m.db, folderCfg.ID),
+		Placeholders:  db.NewPlaceholderRepo(m.db, folderCfg.ID),
 		IgnorePerms:   folderCfg.IgnorePerms,
 		AutoNormalize: folderCfg.AutoNormalize,
-		Hashers:       m.numHashers(folder),
+		ModTimeWindow: time.Duration(folderCfg.ModTimeWindowS) * time.Second,
+		Hashers:       m.folderTuning(folder).Hashers,
+		ReadLimiter:   m.scanReadLimiter,
+		HasherSlots:   m.hasherSlots,
+		CPULimiter:    m.cpuLimiter,
+		MaxFileSize:   folderCfg.MaxFileSize(),
 		ShortID:       m.shortID,
 	}
 
@@ -1239,16 +1811,38 @@ nextSub:
 	batch := make([]protocol.FileInfo, 0, batchSizeFiles)
 	blocksHandled := 0
 
+	now := time.Now()
+	m.churn.prune(now)
+	var churning []string
+	massChange := m.newMassChangeScan(folderCfg, fs, now)
+
 	for f := range fchan {
+		if suppress, started := m.churn.changed(folder, f.Name, now); suppress {
+			// The file keeps changing; leave the old version in the index
+			// for now. It'll be picked up by a later scan once the
+			// suppression is over.
+			if started {
+				churning = append(churning, f.Name)
+			}
+			if debug.On() {
+				l.Debugln("suppressing change to churning file", folder, f.Name)
+			}
+			continue
+		}
 		if len(batch) == batchSizeFiles || blocksHandled > batchSizeBlocks {
 			if err := m.CheckFolderHealth(folder); err != nil {
 				l.Infof("Stopping folder %s mid-scan due to folder error: %s", folder, err)
 				return err
 			}
+			massChange.check(batch)
 			m.updateLocals(folder, batch)
 			batch = batch[:0]
 			blocksHandled = 0
 		}
+		if filepath.Base(f.Name) == ".gitignore" && !f.IsDeleted() && !f.IsDirectory() && !f.IsSymlink() {
+			// Its patterns apply from the next scan.
+			gitignores.Add(f.Name)
+		}
 		batch = append(batch, f)
 		blocksHandled += len(f.Blocks)
 	}
@@ -1257,29 +1851,36 @@ nextSub:
 		l.Infof("Stopping folder %s mid-scan due to folder error: %s", folder, err)
 		return err
 	} else if len(batch) > 0 {
+		massChange.check(batch)
 		m.updateLocals(folder, batch)
 	}
 
+	if len(churning) > 0 {
+		l.Warnf("Folder %q: ignoring changes to rapidly changing files for %v: %s", folder, churnSuppress, strings.Join(churning, ", "))
+		events.Default.Log(events.FolderChurning, map[string]interface{}{
+			"folder": folder,
+			"paths":  churning,
+		})
+	}
+
 	batch = batch[:0]
-	// TODO: We should limit the Have scanning to start at sub
-	seenPrefix := false
-	fs.WithHaveTruncated(protocol.LocalDeviceID, func(fi db.FileIntf) bool {
+	checkDeleted := func(fi db.FileIntf) bool {
 		f := fi.(db.FileInfoTruncated)
-		hasPrefix := len(subs) == 0
-		for _, sub := range subs {
-			if strings.HasPrefix(f.Name, sub) {
-				hasPrefix = true
-				break
+		if len(subs) > 0 {
+			// The prefixed iteration may give us siblings sharing the
+			// prefix, i.e. "foobar" when scanning "foo".
+			inSubs := false
+			for _, sub := range subs {
+				if isSubpath(f.Name, sub) {
+					inSubs = true
+					break
+				}
+			}
+			if !inSubs {
+				return true
 			}
-		}
-		// Return true so that we keep iterating, until we get to the part
-		// of the tree we are interested in. Then return false so we stop
-		// iterating when we've passed the end of the subtree.
-		if !hasPrefix {
-			return !seenPrefix
 		}
 
-		seenPrefix = true
 		if !f.IsDeleted() {
 			if f.IsInvalid() {
 				return true
@@ -1290,9 +1891,10 @@ nextSub:
 				batch = batch[:0]
 			}
 
-			if ignores.Match(f.Name) || symlinkInvalid(f.IsSymlink()) {
-				// File has been ignored or an unsupported symlink. Set invalid bit.
-				if debug {
+			if ignores.Match(f.Name) || symlinkInvalid(f.IsSymlink()) || tooLarge(folderCfg, f) {
+				// File has been ignored, is an unsupported symlink or has
+				// grown too large. Set invalid bit.
+				if debug.On() {
 					l.Debugln("setting invalid bit on ignored", f)
 				}
 				nf := protocol.FileInfo{
@@ -1322,7 +1924,14 @@ nextSub:
 			}
 		}
 		return true
-	})
+	}
+	if len(subs) == 0 {
+		fs.WithHaveTruncated(protocol.LocalDeviceID, checkDeleted)
+	} else {
+		for _, sub := range subs {
+			fs.WithPrefixedHaveTruncated(protocol.LocalDeviceID, sub, checkDeleted)
+		}
+	}
 	if len(batch) > 0 {
 		m.updateLocals(folder, batch)
 	}
@@ -1331,35 +1940,86 @@ nextSub:
 	return nil
 }
 
-func (m *Model) DelayScan(folder string, next time.Duration) {
-	m.fmut.Lock()
+// SetSuspended pauses or resumes the scanning and pulling of all folders,
+// and the serving of file data to other devices. A pull in progress stops
+// after the file at hand.
+func (m *Model) SetSuspended(suspended bool) {
+	m.suspendedMut.Lock()
+	changed := suspended != m.suspended
+	m.suspended = suspended
+	m.suspendedMut.Unlock()
+
+	if changed && !suspended {
+		// Catch up on what was missed.
+		m.fmut.RLock()
+		for _, runner := range m.folderRunners {
+			runner.IndexUpdated()
+		}
+		m.fmut.RUnlock()
+	}
+}
+
+// Suspended returns true if the model has been suspended by SetSuspended.
+func (m *Model) Suspended() bool {
+	m.suspendedMut.Lock()
+	defer m.suspendedMut.Unlock()
+	return m.suspended
+}
+
+// FolderErrors returns the items in the given folder that failed to sync
+// during the last pull.
+func (m *Model) FolderErrors(folder string) ([]FileError, error) {
+	m.fmut.RLock()
 	runner, ok := m.folderRunners[folder]
-	m.fmut.Unlock()
+	m.fmut.RUnlock()
 	if !ok {
-		return
+		return nil, errors.New("no such folder")
 	}
-	runner.DelayScan(next)
+	return runner.Errors(), nil
 }
 
-// numHashers returns the number of hasher routines to use for a given folder,
-// taking into account configuration and available CPU cores.
-func (m *Model) numHashers(folder string) int {
-	m.fmut.Lock()
-	folderCfg := m.folderCfgs[folder]
-	numFolders := len(m.folderCfgs)
-	m.fmut.Unlock()
+// RetryFolderItems triggers a pull of the given folder as soon as possible,
+// handling the given items first.
+func (m *Model) RetryFolderItems(folder string, items []string) error {
+	m.fmut.RLock()
+	runner, ok := m.folderRunners[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return errors.New("no such folder")
+	}
+	runner.Retry(items)
+	return nil
+}
 
-	if folderCfg.Hashers > 0 {
-		// Specific value set in the config, use that.
-		return folderCfg.Hashers
+// FetchFolderItems triggers a pull of the content of the given items in a
+// folder with placeholders, replacing the placeholders.
+func (m *Model) FetchFolderItems(folder string, items []string) error {
+	cfg, ok := m.cfg.Folders()[folder]
+	if !ok {
+		return errors.New("no such folder")
+	}
+	if !cfg.Placeholders {
+		return errors.New("folder does not use placeholders")
 	}
 
-	if perFolder := runtime.GOMAXPROCS(-1) / numFolders; perFolder > 0 {
-		// We have CPUs to spare, divide them per folder.
-		return perFolder
+	m.fmut.RLock()
+	runner, ok := m.folderRunners[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return errors.New("no such folder")
 	}
+	runner.Fetch(items)
+	return nil
+}
 
-	return 1
+func (m *Model) DelayScan(folder string, next time.Duration) {
+	m.fmut.Lock()
+	runner, ok := m.folderRunners[folder]
+	m.fmut.Unlock()
+	if !ok {
+		return
+	}
+	runner.DelayScan(next)
 }
 
 // clusterConfig returns a ClusterConfigMessage that is correct for the given peer device
@@ -1372,6 +2032,18 @@ func (m *Model) clusterConfig(device protocol.DeviceID) protocol.ClusterConfigMe
 				Key:   "name",
 				Value: m.deviceName,
 			},
+			{
+				Key:   remoteBrowseOption,
+				Value: "1",
+			},
+			{
+				Key:   clockOption,
+				Value: strconv.FormatInt(time.Now().Unix(), 10),
+			},
+			{
+				Key:   featuresOption,
+				Value: strings.Join(m.localFeatures(), ","),
+			},
 		},
 	}
 
@@ -1380,15 +2052,27 @@ func (m *Model) clusterConfig(device protocol.DeviceID) protocol.ClusterConfigMe
 		cr := protocol.Folder{
 			ID: folder,
 		}
+		if secret := m.folderCfgs[folder].Secret; secret != "" {
+			cr.Options = append(cr.Options, protocol.Option{
+				Key:   secretProofOption,
+				Value: secretProof(secret, folder, m.id, device),
+			})
+		}
+		readOnly := make(map[protocol.DeviceID]bool)
+		for _, device := range m.folderCfgs[folder].Devices {
+			readOnly[device.DeviceID] = device.ReadOnly
+		}
 		for _, device := range m.folderDevices[folder] {
 			// DeviceID is a value type, but with an underlying array. Copy it
 			// so we don't grab aliases to the same array later on in device[:]
 			device := device
-			// TODO: Set read only bit when relevant
 			cn := protocol.Device{
 				ID:    device[:],
 				Flags: protocol.FlagShareTrusted,
 			}
+			if readOnly[device] {
+				cn.Flags = protocol.FlagShareReadOnly
+			}
 			if deviceCfg := m.cfg.Devices()[device]; deviceCfg.Introducer {
 				cn.Flags |= protocol.FlagIntroducer
 			}
@@ -1415,14 +2099,28 @@ func (m *Model) State(folder string) (string, time.Time, error) {
 	return state.String(), changed, err
 }
 
-func (m *Model) Override(folder string) {
+// OverrideSize returns the number of items, and their size, in which the
+// cluster differs from the local state of the master folder. These are the
+// items that an override will change on the other devices.
+func (m *Model) OverrideSize(folder string) (int, int64, error) {
+	if err := m.checkOverride(folder); err != nil {
+		return 0, 0, err
+	}
+	files, bytes := m.NeedSize(folder)
+	return files, bytes, nil
+}
+
+// Override makes the local state of the master folder the global state,
+// overwriting any changes made on other devices.
+func (m *Model) Override(folder string) error {
+	if err := m.checkOverride(folder); err != nil {
+		return err
+	}
+
 	m.fmut.RLock()
-	fs, ok := m.folderFiles[folder]
+	fs := m.folderFiles[folder]
 	runner := m.folderRunners[folder]
 	m.fmut.RUnlock()
-	if !ok {
-		return
-	}
 
 	runner.setState(FolderScanning)
 	batch := make([]protocol.FileInfo, 0, indexBatchSize)
@@ -1452,6 +2150,25 @@ func (m *Model) Override(folder string) {
 		fs.Update(protocol.LocalDeviceID, batch)
 	}
 	runner.setState(FolderIdle)
+	return nil
+}
+
+func (m *Model) checkOverride(folder string) error {
+	m.fmut.RLock()
+	cfg, ok := m.folderCfgs[folder]
+	_, running := m.folderRunners[folder]
+	m.fmut.RUnlock()
+
+	if !ok {
+		return errors.New("no such folder")
+	}
+	if !cfg.ReadOnly {
+		return errors.New("not a master folder")
+	}
+	if !running {
+		return errors.New("folder is not running")
+	}
+	return nil
 }
 
 // CurrentLocalVersion returns the change version for the given folder.
@@ -1509,50 +2226,55 @@ func (m *Model) GlobalDirectoryTree(folder, prefix string, levels int, dirsonly
 	}
 
 	files.WithPrefixedGlobalTruncated(prefix, func(fi db.FileIntf) bool {
-		f := fi.(db.FileInfoTruncated)
+		addToDirectoryTree(output, fi.(db.FileInfoTruncated), prefix, levels, dirsonly)
+		return true
+	})
 
-		if f.IsInvalid() || f.IsDeleted() || f.Name == prefix {
-			return true
-		}
+	return output
+}
 
-		f.Name = strings.Replace(f.Name, prefix, "", 1)
+// addToDirectoryTree adds the file, which must have the given prefix, to the
+// tree as returned by GlobalDirectoryTree.
+func addToDirectoryTree(output map[string]interface{}, f db.FileInfoTruncated, prefix string, levels int, dirsonly bool) {
+	sep := string(filepath.Separator)
 
-		var dir, base string
-		if f.IsDirectory() && !f.IsSymlink() {
-			dir = f.Name
-		} else {
-			dir = filepath.Dir(f.Name)
-			base = filepath.Base(f.Name)
-		}
+	if f.IsInvalid() || f.IsDeleted() || f.Name == prefix {
+		return
+	}
 
-		if levels > -1 && strings.Count(f.Name, sep) > levels {
-			return true
-		}
+	f.Name = strings.Replace(f.Name, prefix, "", 1)
 
-		last := output
-		if dir != "." {
-			for _, path := range strings.Split(dir, sep) {
-				directory, ok := last[path]
-				if !ok {
-					newdir := make(map[string]interface{})
-					last[path] = newdir
-					last = newdir
-				} else {
-					last = directory.(map[string]interface{})
-				}
-			}
-		}
+	var dir, base string
+	if f.IsDirectory() && !f.IsSymlink() {
+		dir = f.Name
+	} else {
+		dir = filepath.Dir(f.Name)
+		base = filepath.Base(f.Name)
+	}
+
+	if levels > -1 && strings.Count(f.Name, sep) > levels {
+		return
+	}
 
-		if !dirsonly && base != "" {
-			last[base] = []interface{}{
-				time.Unix(f.Modified, 0), f.Size(),
+	last := output
+	if dir != "." {
+		for _, path := range strings.Split(dir, sep) {
+			directory, ok := last[path]
+			if !ok {
+				newdir := make(map[string]interface{})
+				last[path] = newdir
+				last = newdir
+			} else {
+				last = directory.(map[string]interface{})
 			}
 		}
+	}
 
-		return true
-	})
-
-	return output
+	if !dirsonly && base != "" {
+		last[base] = []interface{}{
+			time.Unix(f.Modified, 0), f.Size(),
+		}
+	}
 }
 
 func (m *Model) Availability(folder, file string) []protocol.DeviceID {
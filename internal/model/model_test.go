@@ -8,12 +8,16 @@ package model
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"testing"
 	"time"
@@ -21,6 +25,7 @@ import (
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/events"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/storage"
 )
@@ -281,6 +286,8 @@ func (f FakeConnection) Request(folder, name string, offset int64, size int, has
 
 func (FakeConnection) ClusterConfig(protocol.ClusterConfigMessage) {}
 
+func (FakeConnection) EnableChecksums() {}
+
 func (FakeConnection) Ping() bool {
 	return true
 }
@@ -325,6 +332,320 @@ func BenchmarkRequest(b *testing.B) {
 	}
 }
 
+func TestClockSkew(t *testing.T) {
+	now := time.Unix(1400000000, 0)
+
+	var cm protocol.ClusterConfigMessage
+	if _, ok := clockSkew(cm, now); ok {
+		t.Error("unexpected skew without time option")
+	}
+
+	cases := []struct {
+		value string
+		skew  time.Duration
+	}{
+		{"1400000000", 0},
+		{"1400000090", 90 * time.Second},
+		{"1399996400", -time.Hour},
+	}
+	for _, tc := range cases {
+		cm.Options = []protocol.Option{{Key: clockOption, Value: tc.value}}
+		skew, ok := clockSkew(cm, now)
+		if !ok {
+			t.Errorf("%s: no skew", tc.value)
+		} else if skew != tc.skew {
+			t.Errorf("%s: skew %v != expected %v", tc.value, skew, tc.skew)
+		}
+	}
+}
+
+func TestFeatureNegotiation(t *testing.T) {
+	supported := []string{"a", "b", "c"}
+
+	cases := []struct {
+		value  string
+		common []string
+	}{
+		{"", nil},
+		{"x,y", nil},
+		{"c,a", []string{"a", "c"}},
+		{" b , x ", []string{"b"}},
+	}
+	for _, tc := range cases {
+		var cm protocol.ClusterConfigMessage
+		if tc.value != "" {
+			cm.Options = []protocol.Option{{Key: featuresOption, Value: tc.value}}
+		}
+		if common := commonFeatures(cm, supported); !reflect.DeepEqual(common, tc.common) {
+			t.Errorf("%q: common features %v != expected %v", tc.value, common, tc.common)
+		}
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+
+	// A device announcing our own features supports all of them, and one
+	// announcing none falls back to the base protocol.
+	cc := m.clusterConfig(device1)
+	m.ClusterConfig(device1, cc)
+	if !m.deviceSupports(device1, featureRemoteBrowse) {
+		t.Error("device should support remote browsing")
+	}
+	m.ClusterConfig(device1, protocol.ClusterConfigMessage{})
+	if m.deviceSupports(device1, featureRemoteBrowse) {
+		t.Error("device should not support remote browsing")
+	}
+
+	// Message checksums are only announced when turned on.
+	cfg := defaultConfig.Raw()
+	cfg.Options.MessageChecksums = false
+	m = NewModel(config.Wrap("/tmp/test", cfg), protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.ClusterConfig(device1, m.clusterConfig(device1))
+	if m.deviceSupports(device1, featureChecksums) {
+		t.Error("checksums should not be announced when turned off")
+	}
+	cfg.Options.MessageChecksums = true
+	m = NewModel(config.Wrap("/tmp/test", cfg), protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.ClusterConfig(device1, m.clusterConfig(device1))
+	if !m.deviceSupports(device1, featureChecksums) {
+		t.Error("device should support checksums")
+	}
+}
+
+func TestHashRequest(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(defaultFolderConfig)
+	m.StartFolderRO("default")
+	m.ScanFolder("default")
+
+	options := []protocol.Option{{Key: hashRequestOption, Value: "1"}}
+	bs, err := m.Request(device1, "default", "foo", 0, 6, nil, 0, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash := sha256.Sum256([]byte("foobar")); !bytes.Equal(bs, hash[:]) {
+		t.Errorf("Incorrect hashes from request: %x", bs)
+	}
+
+	if _, err := m.Request(device1, "default", "foo", 0, (maxHashRequestBlocks+1)*protocol.BlockSize, nil, 0, options); err != errHashRequestTooLarge {
+		t.Error("Unexpected error for too large hash request:", err)
+	}
+
+	// The scanned files match the index.
+	mms, err := m.Scrub("default", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mms) != 0 {
+		t.Error("Unexpected mismatches:", mms)
+	}
+}
+
+func TestVerifyFolder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, ".stfolder"), 0755)
+	fn := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(fn, []byte("some data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fcfg := config.FolderConfiguration{ID: "verify", RawPath: dir}
+	cfg := config.Wrap("/tmp/test", config.Configuration{Folders: []config.FolderConfiguration{fcfg}})
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.StartFolderRO("verify")
+	if err := m.ScanFolder("verify"); err != nil {
+		t.Fatal(err)
+	}
+
+	if mms, err := m.VerifyFolder("verify", ""); err != nil || len(mms) != 0 {
+		t.Fatal("Unexpected mismatches before corruption:", mms, err)
+	}
+
+	// Corrupt the file without changing its size or modification time.
+	info, _ := os.Stat(fn)
+	if err := ioutil.WriteFile(fn, []byte("SOME DATA"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(fn, info.ModTime(), info.ModTime())
+
+	sub := events.Default.Subscribe(events.LocalCorruption)
+	defer events.Default.Unsubscribe(sub)
+
+	mms, err := m.VerifyFolder("verify", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mms) != 1 || mms[0].File != "file" || !reflect.DeepEqual(mms[0].Blocks, []int{0}) {
+		t.Fatal("Unexpected mismatches after corruption:", mms)
+	}
+	if _, err := sub.Poll(time.Second); err != nil {
+		t.Error("No corruption event:", err)
+	}
+}
+
+func TestExcludeTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exclude")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, ".stignore"), []byte("!a.iso\nb.txt\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fcfg := config.FolderConfiguration{ID: "exclude", RawPath: dir}
+	cfg := config.Wrap("/tmp/test", config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Options: config.OptionsConfiguration{ExcludeTypes: []string{"*.iso", "node_modules/"}},
+	})
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+
+	expected := map[string]bool{
+		"a.iso":                            true,
+		filepath.Join("sub", "c.iso"):      true,
+		filepath.Join("node_modules", "x"): true,
+		"b.txt":                            true,
+		"c.txt":                            false,
+	}
+	var paths []string
+	for path := range expected {
+		paths = append(paths, path)
+	}
+	res, err := m.MatchIgnores("exclude", nil, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("Ignored %v, expected %v", res, expected)
+	}
+}
+
+func TestRetainedFiles(t *testing.T) {
+	fcfg := defaultFolderConfig.Copy()
+	fcfg.Archive = true
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.StartFolderRO("default")
+	m.ScanFolder("default")
+
+	if files, err := m.RetainedFiles("default"); err != nil || len(files) != 0 {
+		t.Fatal("Unexpected retained files before deletion:", files, err)
+	}
+
+	foo, ok := m.CurrentFolderFile("default", "foo")
+	if !ok {
+		t.Fatal("foo not in the index")
+	}
+	m.Index(device1, "default", []protocol.FileInfo{{
+		Name:     "foo",
+		Flags:    protocol.FlagDeleted,
+		Modified: foo.Modified,
+		Version:  foo.Version.Update(42),
+	}}, 0, nil)
+
+	files, err := m.RetainedFiles("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name != "foo" {
+		t.Error("Expected foo to be retained, got", files)
+	}
+	if nfiles, _ := m.NeedSize("default"); nfiles != 0 {
+		t.Error("Retained files should not be needed, got", nfiles)
+	}
+}
+
+func TestPullPlan(t *testing.T) {
+	fcfg := defaultFolderConfig.Copy()
+	fcfg.DryRun = true
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.StartFolderRO("default")
+	m.ScanFolder("default")
+
+	if _, err := m.PullPlan("nonexistent"); err == nil {
+		t.Error("Expected an error for a nonexistent folder")
+	}
+
+	foo, _ := m.CurrentFolderFile("default", "foo")
+	bar, _ := m.CurrentFolderFile("default", "bar")
+	m.Index(device1, "default", []protocol.FileInfo{
+		{Name: "bar", Modified: bar.Modified + 1, Version: bar.Version.Update(42), Blocks: bar.Blocks},
+		{Name: "foo", Flags: protocol.FlagDeleted, Modified: foo.Modified, Version: foo.Version.Update(42)},
+		{Name: "new", Modified: foo.Modified, Version: protocol.Vector{{ID: 42, Value: 1}}},
+	}, 0, nil)
+
+	plan, err := m.PullPlan("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Create) != 1 || plan.Create[0].Name != "new" {
+		t.Error("Expected new to be created, got", plan.Create)
+	}
+	if len(plan.Replace) != 1 || plan.Replace[0].Name != "bar" {
+		t.Error("Expected bar to be replaced, got", plan.Replace)
+	}
+	if len(plan.Delete) != 1 || plan.Delete[0].Name != "foo" {
+		t.Error("Expected foo to be deleted, got", plan.Delete)
+	}
+}
+
+func TestPendingDeletes(t *testing.T) {
+	fcfg := defaultFolderConfig.Copy()
+	fcfg.DeleteDelayH = 24
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.StartFolderRO("default")
+	m.ScanFolder("default")
+
+	foo, _ := m.CurrentFolderFile("default", "foo")
+	m.Index(device1, "default", []protocol.FileInfo{
+		{Name: "foo", Flags: protocol.FlagDeleted, Modified: foo.Modified, Version: foo.Version.Update(42)},
+		{Name: "never-had", Flags: protocol.FlagDeleted, Version: protocol.Vector{{ID: 42, Value: 1}}},
+	}, 0, nil)
+
+	pending, err := m.PendingDeletes("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].Name != "foo" || pending[0].Cancelled {
+		t.Fatal("Expected foo to be pending deletion, got", pending)
+	}
+	if d := pending[0].Due.Sub(pending[0].Since); d != 24*time.Hour {
+		t.Error("Unexpected delete window", d)
+	}
+
+	if plan, err := m.PullPlan("default"); err != nil || len(plan.Delete) != 0 {
+		t.Error("Pending deletions should not be planned, got", plan.Delete, err)
+	}
+
+	if err := m.CancelDelete("default", "bar"); err == nil {
+		t.Error("Expected an error cancelling a deletion that isn't pending")
+	}
+	if err := m.CancelDelete("default", "foo"); err != nil {
+		t.Fatal(err)
+	}
+	pending, _ = m.PendingDeletes("default")
+	if len(pending) != 1 || !pending[0].Cancelled {
+		t.Error("Expected foo to be cancelled, got", pending)
+	}
+}
+
 func TestDeviceRename(t *testing.T) {
 	ccm := protocol.ClusterConfigMessage{
 		ClientName:    "syncthing",
@@ -401,7 +722,7 @@ func TestClusterConfig(t *testing.T) {
 			ID: "folder2",
 			Devices: []config.FolderDeviceConfiguration{
 				{DeviceID: device1},
-				{DeviceID: device2},
+				{DeviceID: device2, ReadOnly: true},
 			},
 		},
 	}
@@ -457,6 +778,114 @@ func TestClusterConfig(t *testing.T) {
 	if r.Devices[1].Flags&protocol.FlagIntroducer != 0 {
 		t.Error("Device2 should not be flagged as Introducer")
 	}
+	if r.Devices[1].Flags&protocol.FlagShareReadOnly == 0 || r.Devices[1].Flags&protocol.FlagShareTrusted != 0 {
+		t.Error("Device2 should be flagged as read only")
+	}
+	if cm.Folders[0].Devices[1].Flags&protocol.FlagShareReadOnly != 0 {
+		t.Error("Device2 should not be flagged as read only in folder1")
+	}
+}
+
+func TestReadOnlyDeviceIndex(t *testing.T) {
+	cfg := config.New(device1)
+	cfg.Devices = []config.DeviceConfiguration{{DeviceID: device1}, {DeviceID: device2}}
+	cfg.Folders = []config.FolderConfiguration{
+		{
+			ID:      "default",
+			RawPath: "testdata",
+			Devices: []config.FolderDeviceConfiguration{
+				{DeviceID: device1},
+				{DeviceID: device2, ReadOnly: true},
+			},
+		},
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", cfg), protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(cfg.Folders[0])
+
+	files := []protocol.FileInfo{{Name: "readonly", Version: protocol.Vector{{ID: 42, Value: 1}}}}
+	m.Index(device1, "default", files, 0, nil)
+	m.Index(device2, "default", files, 0, nil)
+	m.IndexUpdate(device2, "default", []protocol.FileInfo{{Name: "update", Version: protocol.Vector{{ID: 42, Value: 1}}}}, 0, nil)
+
+	if _, ok := m.CurrentGlobalFile("default", "readonly"); !ok {
+		t.Error("Index from a read write device was not accepted")
+	}
+	m.fmut.RLock()
+	fs := m.folderFiles["default"]
+	m.fmut.RUnlock()
+	if _, ok := fs.Get(device2, "readonly"); ok {
+		t.Error("Index from a read only device was accepted")
+	}
+	if _, ok := fs.Get(device2, "update"); ok {
+		t.Error("Index update from a read only device was accepted")
+	}
+}
+
+func TestFolderSecret(t *testing.T) {
+	cfg := config.New(device1)
+	cfg.Devices = []config.DeviceConfiguration{{DeviceID: device1}, {DeviceID: device2}}
+	cfg.Folders = []config.FolderConfiguration{
+		{
+			ID:      "default",
+			RawPath: "testdata",
+			Secret:  "sesame",
+			Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}, {DeviceID: device2}},
+		},
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", cfg), protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(cfg.Folders[0])
+
+	// Our proof is bound to the receiving device.
+	cm := m.clusterConfig(device1)
+	if proof := cm.Folders[0].Options[0]; proof.Key != secretProofOption || proof.Value != secretProof("sesame", "default", protocol.LocalDeviceID, device1) {
+		t.Errorf("Incorrect proof %v", proof)
+	}
+	if secretProof("sesame", "default", protocol.LocalDeviceID, device1) == secretProof("sesame", "default", protocol.LocalDeviceID, device2) {
+		t.Error("Proof not bound to the receiving device")
+	}
+
+	sub := events.Default.Subscribe(events.FolderSecretMismatch)
+	defer events.Default.Unsubscribe(sub)
+
+	clusterConfig := func(device protocol.DeviceID, secret string) protocol.ClusterConfigMessage {
+		return protocol.ClusterConfigMessage{
+			Folders: []protocol.Folder{{
+				ID:      "default",
+				Options: []protocol.Option{{Key: secretProofOption, Value: secretProof(secret, "default", device, protocol.LocalDeviceID)}},
+			}},
+		}
+	}
+	m.ClusterConfig(device1, clusterConfig(device1, "sesame"))
+	m.ClusterConfig(device2, clusterConfig(device2, "guess"))
+
+	ev, err := sub.Poll(time.Second)
+	if err != nil {
+		t.Fatal("No secret mismatch event:", err)
+	}
+	if dev := ev.Data.(map[string]string)["device"]; dev != device2.String() {
+		t.Errorf("Secret mismatch for %s, expected %s", dev, device2)
+	}
+
+	files := []protocol.FileInfo{{Name: "secret", Version: protocol.Vector{{ID: 42, Value: 1}}}}
+	m.Index(device1, "default", files, 0, nil)
+	m.Index(device2, "default", files, 0, nil)
+
+	m.fmut.RLock()
+	fs := m.folderFiles["default"]
+	m.fmut.RUnlock()
+	if _, ok := fs.Get(device1, "secret"); !ok {
+		t.Error("Index from a device knowing the secret was not accepted")
+	}
+	if _, ok := fs.Get(device2, "secret"); ok {
+		t.Error("Index from a device not knowing the secret was accepted")
+	}
+	if _, err := m.Request(device2, "default", "foo", 0, 6, nil, 0, nil); err != protocol.ErrNoSuchFile {
+		t.Error("Request from a device not knowing the secret was served:", err)
+	}
 }
 
 func TestIgnores(t *testing.T) {
@@ -550,6 +979,54 @@ func TestIgnores(t *testing.T) {
 	}
 }
 
+func TestIgnoreSelection(t *testing.T) {
+	ioutil.WriteFile("testdata/.stfolder", nil, 0644)
+	ioutil.WriteFile("testdata/.stignore", []byte(".*\nquux\n"), 0644)
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(defaultFolderConfig)
+	m.StartFolderRO("default")
+
+	if err := m.SetIgnores("default", []string{"[invalid"}); err == nil {
+		t.Error("invalid pattern accepted")
+	}
+	if ignores, _, _ := m.GetIgnores("default"); len(ignores) != 2 {
+		t.Errorf("ignores changed by invalid pattern: %v", ignores)
+	}
+
+	paths := []string{"quux", "dir/quux", "foo"}
+	res, err := m.MatchIgnores("default", nil, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]bool{"quux": true, "dir/quux": true, "foo": false}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("unexpected current match result %v", res)
+	}
+
+	res, err = m.MatchIgnores("default", []string{"/foo"}, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]bool{"quux": false, "dir/quux": false, "foo": true}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("unexpected match result %v for new patterns", res)
+	}
+
+	m.Index(device1, "default", []protocol.FileInfo{
+		{Name: "quux", Version: protocol.Vector{{ID: 42, Value: 1}}},
+		{Name: "remote", Version: protocol.Vector{{ID: 42, Value: 1}}},
+	}, 0, nil)
+	ignored, err := m.IgnoredFiles("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ignored) != 1 || ignored[0].Name != "quux" {
+		t.Errorf("unexpected ignored files %v", ignored)
+	}
+}
+
 func TestRefuseUnknownBits(t *testing.T) {
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
 	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
@@ -1224,3 +1701,354 @@ func BenchmarkTree_00100_10(b *testing.B) {
 		m.GlobalDirectoryTree("default", "", -1, false)
 	}
 }
+
+func TestScanFolderSubs(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(defaultFolderConfig)
+	m.StartFolderRO("default")
+	if err := m.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sub := range []string{"..", "../foo", "/foo", "foo/../../bar"} {
+		if err := m.ScanFolderSubs("default", []string{sub}); err == nil {
+			t.Errorf("Unexpected nil error scanning invalid subpath %q", sub)
+		}
+	}
+
+	for _, sub := range []string{"", ".", "foo", "nonexistent/dir", "foo/../bar"} {
+		if err := m.ScanFolderSubs("default", []string{sub}); err != nil {
+			t.Errorf("Unexpected error scanning subpath %q: %v", sub, err)
+		}
+	}
+
+	if _, ok := m.CurrentFolderFile("default", "foo"); !ok {
+		t.Error("File foo should be present after subpath scans")
+	}
+}
+
+func TestRebuildIndex(t *testing.T) {
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(defaultFolderConfig)
+
+	if err := m.RebuildIndex("default"); err != nil {
+		t.Fatal(err)
+	}
+	foo, ok := m.CurrentFolderFile("default", "foo")
+	if !ok {
+		t.Fatal("foo should be present after rebuild")
+	}
+
+	// A file that doesn't exist on disk
+	m.folderFiles["default"].Update(protocol.LocalDeviceID, []protocol.FileInfo{{
+		Name:    "nonexistent",
+		Version: protocol.Vector{{ID: 42, Value: 1}},
+	}})
+
+	if err := m.RebuildIndex("default"); err != nil {
+		t.Fatal(err)
+	}
+	if f, _ := m.CurrentFolderFile("default", "foo"); !f.Version.Equal(foo.Version) {
+		t.Errorf("unchanged file got a new version %v != %v", f.Version, foo.Version)
+	}
+	if f, ok := m.CurrentFolderFile("default", "nonexistent"); !ok || !f.IsDeleted() {
+		t.Error("nonexistent file should have been marked deleted")
+	}
+
+	if err := m.RebuildIndex("nonexistent"); err == nil {
+		t.Error("unexpected nil error for unknown folder")
+	}
+}
+
+func TestRemoteDirectoryTree(t *testing.T) {
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(defaultFolderConfig)
+
+	if _, ok := m.RemoteDirectoryTree(device2, "unaccepted", "", -1, false); ok {
+		t.Fatal("unexpected tree before any index")
+	}
+
+	// device2 doesn't share "default", and we don't have "unaccepted"
+	files := []protocol.FileInfo{
+		{Name: "dir", Flags: protocol.FlagDirectory},
+		{Name: filepath.Join("dir", "file"), Modified: 10, Blocks: []protocol.BlockInfo{{Size: 42}}},
+		{Name: "top", Modified: 20, Blocks: []protocol.BlockInfo{{Size: 23}}},
+	}
+	m.Index(device2, "unaccepted", files, 0, nil)
+	m.IndexUpdate(device2, "unaccepted", []protocol.FileInfo{{Name: "top", Flags: protocol.FlagDeleted}}, 0, nil)
+
+	tree, ok := m.RemoteDirectoryTree(device2, "unaccepted", "", -1, false)
+	if !ok {
+		t.Fatal("no tree for unaccepted folder")
+	}
+	expected := map[string]interface{}{
+		"dir": map[string]interface{}{
+			"file": []interface{}{time.Unix(10, 0), int64(42)},
+		},
+	}
+	if !reflect.DeepEqual(tree, expected) {
+		t.Errorf("unexpected tree\n  %v !=\n  %v", tree, expected)
+	}
+
+	// Forgotten once the device disconnects
+	m.Close(device2, errors.New("test"))
+	if _, ok := m.RemoteDirectoryTree(device2, "unaccepted", "", -1, false); ok {
+		t.Error("tree remains after disconnect")
+	}
+
+	// A shared folder, from the index in the database
+	m.Index(device1, "default", files, 0, nil)
+	tree, ok = m.RemoteDirectoryTree(device1, "default", "dir", -1, false)
+	if !ok {
+		t.Fatal("no tree for shared folder")
+	}
+	expected = map[string]interface{}{
+		"file": []interface{}{time.Unix(10, 0), int64(42)},
+	}
+	if !reflect.DeepEqual(tree, expected) {
+		t.Errorf("unexpected tree\n  %v !=\n  %v", tree, expected)
+	}
+}
+
+func TestFetchFile(t *testing.T) {
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(defaultFolderConfig)
+
+	data := []byte("the contents of a remote file")
+	hash := sha256.Sum256(data)
+	file := protocol.FileInfo{
+		Name:     "remote",
+		Flags:    0644,
+		Modified: 1234567890,
+		Blocks:   []protocol.BlockInfo{{Size: int32(len(data)), Hash: hash[:]}},
+	}
+
+	fc := FakeConnection{
+		id:          device1,
+		requestData: data,
+	}
+	m.AddConnection(fc, fc)
+	m.Index(device1, "default", []protocol.FileInfo{file}, 0, nil)
+
+	dir, err := ioutil.TempDir("", "fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dst := filepath.Join(dir, "fetched")
+
+	if err := m.FetchFile(device1, "default", "nonexistent", dst); err == nil {
+		t.Error("unexpected nil error for nonexistent file")
+	}
+
+	if err := m.FetchFile(device1, "default", "remote", dst); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs, data) {
+		t.Errorf("unexpected contents %q", bs)
+	}
+	if info, err := os.Stat(dst); err != nil || info.ModTime().Unix() != file.Modified {
+		t.Errorf("modification time not set (%v)", err)
+	}
+
+	if err := m.FetchFile(device1, "default", "remote", dst); err == nil {
+		t.Error("unexpected nil error for existing destination")
+	}
+}
+
+func TestTransferTest(t *testing.T) {
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(defaultFolderConfig)
+
+	if _, _, err := m.TransferTest(device1, time.Millisecond); err == nil {
+		t.Error("unexpected nil error for unconnected device")
+	}
+
+	fc := FakeConnection{
+		id:          device1,
+		requestData: []byte("some data to return"),
+	}
+	m.AddConnection(fc, fc)
+
+	if _, _, err := m.TransferTest(device1, time.Millisecond); err == nil {
+		t.Error("unexpected nil error for device without data")
+	}
+
+	m.Index(device1, "default", []protocol.FileInfo{
+		{Name: "remote", Modified: 1234567890, Blocks: []protocol.BlockInfo{{Size: 19}}},
+		{Name: "deleted", Flags: protocol.FlagDeleted},
+	}, 0, nil)
+
+	n, d, err := m.TransferTest(device1, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 || n%int64(len(fc.requestData)) != 0 {
+		t.Errorf("received %d bytes, expected a nonzero multiple of %d", n, len(fc.requestData))
+	}
+	if d < 50*time.Millisecond {
+		t.Errorf("test took %v, expected at least 50ms", d)
+	}
+}
+
+func TestGlobalDirectoryListing(t *testing.T) {
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, device2, "device", "syncthing", "dev", ldb)
+	m.AddFolder(defaultFolderConfig)
+
+	v := protocol.Vector{{ID: 42, Value: 1}}
+	block := func(size int32) []protocol.BlockInfo {
+		return []protocol.BlockInfo{{Size: size}}
+	}
+	remote := []protocol.FileInfo{
+		{Name: "small", Modified: 3, Version: v, Blocks: block(10)},
+		{Name: "large", Modified: 1, Version: v, Blocks: block(30)},
+		{Name: "medium", Modified: 2, Version: v, Blocks: block(20)},
+		{Name: "dir", Flags: protocol.FlagDirectory, Version: v},
+		{Name: filepath.Join("dir", "sub"), Modified: 1, Version: v, Blocks: block(10)},
+	}
+	m.Index(device1, "default", remote, 0, nil)
+	m.folderFiles["default"].Update(protocol.LocalDeviceID, []protocol.FileInfo{
+		{Name: "small", Modified: 3, Version: v, Blocks: block(10)},
+		{Name: "medium", Flags: protocol.FlagInvalid, Version: v},
+	})
+
+	if _, _, ok := m.GlobalDirectoryListing("nonexistent", "", "", false, 1, 10); ok {
+		t.Error("unexpected listing for nonexistent folder")
+	}
+
+	names := func(entries []BrowseEntry) []string {
+		var res []string
+		for _, e := range entries {
+			res = append(res, e.Name)
+		}
+		return res
+	}
+
+	entries, total, _ := m.GlobalDirectoryListing("default", "", "size", false, 1, 10)
+	if total != 4 {
+		t.Errorf("total %d, expected 4", total)
+	}
+	if n := names(entries); !reflect.DeepEqual(n, []string{"dir", "small", "medium", "large"}) {
+		t.Errorf("unexpected order %v", n)
+	}
+
+	entries, _, _ = m.GlobalDirectoryListing("default", "", "modified", true, 2, 2)
+	if n := names(entries); !reflect.DeepEqual(n, []string{"medium", "large"}) {
+		t.Errorf("unexpected second page %v", n)
+	}
+
+	entries, _, _ = m.GlobalDirectoryListing("default", "", "", false, 1, 10)
+	states := map[string]string{"dir": "needed", "large": "needed", "medium": "invalid", "small": "synced"}
+	for _, e := range entries {
+		if e.State != states[e.Name] {
+			t.Errorf("%s: state %q, expected %q", e.Name, e.State, states[e.Name])
+		}
+		if e.Name == "small" && len(e.Devices) != 2 {
+			t.Errorf("small: devices %v, expected two", e.Devices)
+		}
+		if e.Name == "medium" && !reflect.DeepEqual(e.Devices, []protocol.DeviceID{device1}) {
+			t.Errorf("medium: devices %v, expected only %v", e.Devices, device1)
+		}
+	}
+
+	entries, total, _ = m.GlobalDirectoryListing("default", "dir", "", false, 1, 10)
+	if n := names(entries); total != 1 || !reflect.DeepEqual(n, []string{"sub"}) {
+		t.Errorf("unexpected subdirectory listing %v", n)
+	}
+}
+
+func TestOverride(t *testing.T) {
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	fcfg := defaultFolderConfig
+	fcfg.ReadOnly = true
+	m.AddFolder(fcfg)
+
+	if _, _, err := m.OverrideSize("default"); err == nil {
+		t.Error("unexpected nil error for folder that isn't running")
+	}
+
+	m.StartFolderRO("default")
+	m.ScanFolder("default")
+
+	foo, ok := m.CurrentFolderFile("default", "foo")
+	if !ok {
+		t.Fatal("foo should exist after scan")
+	}
+	changed := foo
+	changed.Version = foo.Version.Update(42)
+	m.Index(device1, "default", []protocol.FileInfo{
+		changed,
+		{Name: "remote", Version: protocol.Vector{{ID: 42, Value: 1}}},
+	}, 0, nil)
+
+	files, _, err := m.OverrideSize("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files != 2 {
+		t.Errorf("%d files out of sync, expected 2", files)
+	}
+
+	if err := m.Override("default"); err != nil {
+		t.Fatal(err)
+	}
+	if files, _, _ := m.OverrideSize("default"); files != 0 {
+		t.Errorf("%d files out of sync after override", files)
+	}
+	if f, _ := m.CurrentGlobalFile("default", "remote"); !f.IsDeleted() {
+		t.Error("remote file should be deleted after override")
+	}
+
+	m.AddFolder(config.FolderConfiguration{ID: "rw", RawPath: "testdata"})
+	if err := m.Override("rw"); err == nil {
+		t.Error("unexpected nil error for non master folder")
+	}
+}
+
+// addrConnection is a raw connection wrapping a TLS connection, as those of
+// the connection service, with a remote address.
+type addrConnection struct {
+	FakeConnection
+}
+
+func (addrConnection) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22000}
+}
+
+func TestDeviceConnectedAddress(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(defaultFolderConfig)
+
+	fc := FakeConnection{id: device1}
+	m.AddConnection(addrConnection{FakeConnection: fc}, fc)
+
+	sub := events.Default.Subscribe(events.DeviceConnected)
+	defer events.Default.Unsubscribe(sub)
+
+	m.ClusterConfig(device1, protocol.ClusterConfigMessage{
+		ClientName:    "syncthing",
+		ClientVersion: "v0.11.0",
+	})
+
+	ev, err := sub.Poll(time.Second)
+	if err != nil {
+		t.Fatal("No DeviceConnected event:", err)
+	}
+	data := ev.Data.(map[string]string)
+	if data["id"] != device1.String() || data["addr"] != "192.0.2.1:22000" {
+		t.Errorf("Unexpected event data %v", data)
+	}
+}
@@ -48,13 +48,13 @@ func (t *ProgressEmitter) Serve() {
 	for {
 		select {
 		case <-t.stop:
-			if debug {
+			if debug.On() {
 				l.Debugln("progress emitter: stopping")
 			}
 			return
 		case <-t.timer.C:
 			t.mut.Lock()
-			if debug {
+			if debug.On() {
 				l.Debugln("progress emitter: timer - looking after", len(t.registry))
 			}
 			output := make(map[string]map[string]*pullerProgress)
@@ -67,10 +67,10 @@ func (t *ProgressEmitter) Serve() {
 			if !reflect.DeepEqual(t.last, output) {
 				events.Default.Log(events.DownloadProgress, output)
 				t.last = output
-				if debug {
+				if debug.On() {
 					l.Debugf("progress emitter: emitting %#v", output)
 				}
-			} else if debug {
+			} else if debug.On() {
 				l.Debugln("progress emitter: nothing new")
 			}
 			if len(t.registry) != 0 {
@@ -88,7 +88,7 @@ func (t *ProgressEmitter) Changed(cfg config.Configuration) error {
 	defer t.mut.Unlock()
 
 	t.interval = time.Duration(cfg.Options.ProgressUpdateIntervalS) * time.Second
-	if debug {
+	if debug.On() {
 		l.Debugln("progress emitter: updated interval", t.interval)
 	}
 	return nil
@@ -104,7 +104,7 @@ func (t *ProgressEmitter) Stop() {
 func (t *ProgressEmitter) Register(s *sharedPullerState) {
 	t.mut.Lock()
 	defer t.mut.Unlock()
-	if debug {
+	if debug.On() {
 		l.Debugln("progress emitter: registering", s.folder, s.file.Name)
 	}
 	if len(t.registry) == 0 {
@@ -117,7 +117,7 @@ func (t *ProgressEmitter) Register(s *sharedPullerState) {
 func (t *ProgressEmitter) Deregister(s *sharedPullerState) {
 	t.mut.Lock()
 	defer t.mut.Unlock()
-	if debug {
+	if debug.On() {
 		l.Debugln("progress emitter: deregistering", s.folder, s.file.Name)
 	}
 	delete(t.registry, filepath.Join(s.folder, s.file.Name))
@@ -133,7 +133,7 @@ func (t *ProgressEmitter) BytesCompleted(folder string) (bytes int64) {
 			bytes += s.Progress().BytesDone
 		}
 	}
-	if debug {
+	if debug.On() {
 		l.Debugf("progress emitter: bytes completed for %s: %d", folder, bytes)
 	}
 	return
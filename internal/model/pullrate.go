@@ -0,0 +1,103 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"time"
+
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+// The bytes counted by a rateMeter are folded into the average at most this
+// often.
+const rateMeterTick = time.Second
+
+// A rateMeter averages the rate of the bytes counted while it is running.
+// The time it is stopped doesn't count, so that the rate of a folder puller
+// is its throughput while pulling, not over the time it was in sync.
+type rateMeter struct {
+	rateAverage
+	running bool
+	bytes   int64     // counted since last
+	last    time.Time // of the last update of the average
+	mut     sync.Mutex
+}
+
+func newRateMeter() *rateMeter {
+	return &rateMeter{
+		mut: sync.NewMutex(),
+	}
+}
+
+func (r *rateMeter) start(now time.Time) {
+	r.mut.Lock()
+	if !r.running {
+		r.running = true
+		r.bytes = 0
+		r.last = now
+	}
+	r.mut.Unlock()
+}
+
+func (r *rateMeter) stop(now time.Time) {
+	r.mut.Lock()
+	if r.running {
+		r.tick(now, 0)
+		r.running = false
+	}
+	r.mut.Unlock()
+}
+
+func (r *rateMeter) add(bytes int64, now time.Time) {
+	r.mut.Lock()
+	if r.running {
+		r.bytes += bytes
+		r.tick(now, rateMeterTick)
+	}
+	r.mut.Unlock()
+}
+
+// rate returns the average rate in bytes per second, and the time it takes
+// to transfer the given number of bytes at that rate in seconds, or -1 if
+// there is no telling.
+func (r *rateMeter) rate(bytes int64, now time.Time) (float64, int64) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if r.running {
+		r.tick(now, rateMeterTick)
+	}
+	return r.rateAverage.rate, r.eta(bytes)
+}
+
+// tick folds the bytes counted into the average, if at least min has passed
+// since the last time.
+func (r *rateMeter) tick(now time.Time, min time.Duration) {
+	if period := now.Sub(r.last); period > 0 && period >= min {
+		r.update(r.bytes, period)
+		r.bytes = 0
+		r.last = now
+	}
+}
+
+// pullRate returns the rate meter of the puller of the folder.
+func (m *Model) pullRate(folder string) *rateMeter {
+	m.pullRatesMut.Lock()
+	defer m.pullRatesMut.Unlock()
+	r, ok := m.pullRates[folder]
+	if !ok {
+		r = newRateMeter()
+		m.pullRates[folder] = r
+	}
+	return r
+}
+
+// PullRate returns the average throughput of the puller of the folder while
+// pulling, in bytes per second, and the estimated time to pull the given
+// number of needed bytes at that rate in seconds, or -1 if unknown.
+func (m *Model) PullRate(folder string, needBytes int64) (rate float64, etaS int64) {
+	return m.pullRate(folder).rate(needBytes, time.Now())
+}
@@ -0,0 +1,195 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/events"
+	"github.com/syncthing/syncthing/internal/osutil"
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+const (
+	maxFileBlocks     = 1 << 24 // 2 TiB in blocks of protocol.BlockSize
+	maxQuarantined    = 1000    // entries kept for inspection; the oldest are dropped
+	maxQuarantineLogs = 10      // names listed in the warning and event
+)
+
+// A QuarantinedFile is an entry of a remote index that announced impossible
+// data, and was kept out of the database.
+type QuarantinedFile struct {
+	Device   protocol.DeviceID `json:"device"`
+	Folder   string            `json:"folder"`
+	Name     string            `json:"name"`
+	Flags    uint32            `json:"flags"`
+	Modified int64             `json:"modified"`
+	Blocks   int               `json:"blocks"`
+	Reason   string            `json:"reason"`
+	Time     time.Time         `json:"time"`
+}
+
+// A quarantine holds the most recently rejected index entries, so that they
+// can be inspected instead of silently disappearing.
+type quarantine struct {
+	files []QuarantinedFile
+	mut   sync.Mutex
+}
+
+func newQuarantine() *quarantine {
+	return &quarantine{
+		mut: sync.NewMutex(),
+	}
+}
+
+// implausible returns why the file can't be a valid index entry, or the empty
+// string if it can. Names reserved on Windows are possible on other systems,
+// and left to rejectInvalidNames.
+func implausible(f protocol.FileInfo) string {
+	if err := osutil.CheckFilename(f.Name); err != nil && err != osutil.ErrNameReserved {
+		return err.Error()
+	}
+	if len(f.Blocks) > maxFileBlocks {
+		return fmt.Sprintf("%d blocks", len(f.Blocks))
+	}
+
+	var offset int64
+	for i, b := range f.Blocks {
+		if b.Size < 0 || b.Size > protocol.BlockSize {
+			return fmt.Sprintf("block %d has size %d", i, b.Size)
+		}
+		if b.Offset != offset {
+			return fmt.Sprintf("block %d is at offset %d, expected %d", i, b.Offset, offset)
+		}
+		offset += int64(b.Size)
+	}
+	return ""
+}
+
+// quarantine removes the implausible files from fs and keeps them in the
+// quarantine, and returns the remaining files. A warning and an
+// IndexQuarantined event are issued if any files were removed.
+func (m *Model) quarantine(deviceID protocol.DeviceID, folder string, fs []protocol.FileInfo) []protocol.FileInfo {
+	var names []string
+	count := 0
+	now := time.Now()
+
+	m.quarantined.mut.Lock()
+	for i := 0; i < len(fs); {
+		reason := implausible(fs[i])
+		if reason == "" {
+			i++
+			continue
+		}
+
+		if debug.On() {
+			l.Debugf("%v quarantining %s from %s in %q: %s", m, fs[i], deviceID, folder, reason)
+		}
+		m.quarantined.files = append(m.quarantined.files, QuarantinedFile{
+			Device:   deviceID,
+			Folder:   folder,
+			Name:     fs[i].Name,
+			Flags:    fs[i].Flags,
+			Modified: fs[i].Modified,
+			Blocks:   len(fs[i].Blocks),
+			Reason:   reason,
+			Time:     now,
+		})
+		count++
+		if len(names) < maxQuarantineLogs {
+			names = append(names, fs[i].Name)
+		}
+
+		fs[i] = fs[len(fs)-1]
+		fs = fs[:len(fs)-1]
+	}
+	if drop := len(m.quarantined.files) - maxQuarantined; drop > 0 {
+		m.quarantined.files = append(m.quarantined.files[:0], m.quarantined.files[drop:]...)
+	}
+	m.quarantined.mut.Unlock()
+
+	if count > 0 {
+		l.Warnf("Device %v announced impossible data for %d items in folder %q, such as %q; not accepted. This is caused by a bug or by corruption on that device.", deviceID, count, folder, names)
+		events.Default.Log(events.IndexQuarantined, map[string]interface{}{
+			"device": deviceID.String(),
+			"folder": folder,
+			"items":  count,
+			"names":  names,
+		})
+	}
+	return fs
+}
+
+// checkRemoteFilename checks the names announced by other devices. The tests
+// replace it to reject names as Windows does, whatever the system.
+var checkRemoteFilename = osutil.CheckFilename
+
+// rejectInvalidNames marks the files with names that can't be used on this
+// system as invalid, so that they are not pulled, and issues a
+// FilenameRejected event naming the device that announced them.
+func (m *Model) rejectInvalidNames(deviceID protocol.DeviceID, folder string, fs []protocol.FileInfo) {
+	var names []string
+	count := 0
+	for i, f := range fs {
+		if f.IsDeleted() || f.IsInvalid() {
+			// Nothing will be created from it
+			continue
+		}
+		if err := checkRemoteFilename(f.Name); err != nil {
+			if debug.On() {
+				l.Debugf("%v rejecting %s from %s in %q: %v", m, f, deviceID, folder, err)
+			}
+			fs[i].Flags |= protocol.FlagInvalid
+			count++
+			if len(names) < maxQuarantineLogs {
+				names = append(names, f.Name)
+			}
+		}
+	}
+
+	if count > 0 {
+		l.Infof("Device %v announced %d items in folder %q with names that can't be used on this system, such as %q; marked as invalid.", deviceID, count, folder, names)
+		events.Default.Log(events.FilenameRejected, map[string]interface{}{
+			"device": deviceID.String(),
+			"folder": folder,
+			"items":  count,
+			"names":  names,
+		})
+	}
+}
+
+// Quarantined returns the quarantined index entries of the folder, or of
+// all folders if folder is empty, oldest first.
+func (m *Model) Quarantined(folder string) []QuarantinedFile {
+	m.quarantined.mut.Lock()
+	defer m.quarantined.mut.Unlock()
+
+	res := []QuarantinedFile{}
+	for _, f := range m.quarantined.files {
+		if folder == "" || f.Folder == folder {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+// ClearQuarantine forgets the quarantined index entries of the folder, or
+// of all folders if folder is empty.
+func (m *Model) ClearQuarantine(folder string) {
+	m.quarantined.mut.Lock()
+	defer m.quarantined.mut.Unlock()
+
+	kept := m.quarantined.files[:0]
+	for _, f := range m.quarantined.files {
+		if folder != "" && f.Folder != folder {
+			kept = append(kept, f)
+		}
+	}
+	m.quarantined.files = kept
+}
@@ -0,0 +1,135 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/events"
+	"github.com/syncthing/syncthing/internal/osutil"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestImplausible(t *testing.T) {
+	block := func(offset int64, size int32) protocol.BlockInfo {
+		return protocol.BlockInfo{Offset: offset, Size: size}
+	}
+
+	cases := []struct {
+		file protocol.FileInfo
+		ok   bool
+	}{
+		{protocol.FileInfo{Name: "foo", Blocks: []protocol.BlockInfo{block(0, 0)}}, true},
+		{protocol.FileInfo{Name: filepath.Join("a", "..", "b"), Blocks: []protocol.BlockInfo{block(0, protocol.BlockSize), block(protocol.BlockSize, 10)}}, true},
+		{protocol.FileInfo{Name: "deleted", Flags: protocol.FlagDeleted}, true},
+		{protocol.FileInfo{Name: ""}, false},
+		{protocol.FileInfo{Name: "."}, false},
+		{protocol.FileInfo{Name: ".."}, false},
+		{protocol.FileInfo{Name: filepath.Join("..", "etc", "passwd")}, false},
+		{protocol.FileInfo{Name: filepath.Join("a", "..", "..", "b")}, false},
+		{protocol.FileInfo{Name: string(filepath.Separator) + "etc"}, false},
+		{protocol.FileInfo{Name: "foo", Blocks: []protocol.BlockInfo{block(0, -1)}}, false},
+		{protocol.FileInfo{Name: "foo", Blocks: []protocol.BlockInfo{block(0, protocol.BlockSize+1)}}, false},
+		{protocol.FileInfo{Name: "foo", Blocks: []protocol.BlockInfo{block(0, 10), block(20, 10)}}, false},
+		{protocol.FileInfo{Name: "foo", Blocks: make([]protocol.BlockInfo, maxFileBlocks+1)}, false},
+	}
+
+	for i, tc := range cases {
+		if reason := implausible(tc.file); (reason == "") != tc.ok {
+			t.Errorf("%d: %q: unexpected reason %q", i, tc.file.Name, reason)
+		}
+	}
+}
+
+func TestQuarantineIndex(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(defaultFolderConfig)
+	m.ScanFolder("default")
+
+	sub := events.Default.Subscribe(events.IndexQuarantined)
+	defer events.Default.Unsubscribe(sub)
+
+	files := genFiles(2)
+	files = append(files, protocol.FileInfo{Name: filepath.Join("..", "escape")})
+	m.Index(device1, "default", files, 0, nil)
+
+	if _, ok := m.CurrentGlobalFile("default", "file0"); !ok {
+		t.Error("plausible file should be in the index")
+	}
+	if _, ok := m.CurrentGlobalFile("default", filepath.Join("..", "escape")); ok {
+		t.Error("escaping file should not be in the index")
+	}
+
+	q := m.Quarantined("default")
+	if len(q) != 1 || q[0].Name != filepath.Join("..", "escape") || q[0].Device != device1 {
+		t.Fatalf("unexpected quarantine %+v", q)
+	}
+	if len(m.Quarantined("other")) != 0 {
+		t.Error("other folders should have nothing quarantined")
+	}
+
+	ev, err := sub.Poll(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := ev.Data.(map[string]interface{}); data["items"] != 1 || data["folder"] != "default" {
+		t.Errorf("unexpected event data %v", data)
+	}
+
+	m.ClearQuarantine("default")
+	if q := m.Quarantined(""); len(q) != 0 {
+		t.Errorf("unexpected quarantine %+v after clearing", q)
+	}
+}
+
+func TestRejectInvalidNames(t *testing.T) {
+	// Reserved names are only invalid on Windows.
+	defer func(check func(string) error) {
+		checkRemoteFilename = check
+	}(checkRemoteFilename)
+	checkRemoteFilename = func(name string) error {
+		if name == "aux.txt" {
+			return osutil.ErrNameReserved
+		}
+		return osutil.CheckFilename(name)
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(defaultFolderConfig)
+	m.ScanFolder("default")
+
+	sub := events.Default.Subscribe(events.FilenameRejected)
+	defer events.Default.Unsubscribe(sub)
+
+	files := genFiles(1)
+	files = append(files, protocol.FileInfo{Name: "aux.txt"})
+	m.Index(device1, "default", files, 0, nil)
+
+	m.fmut.RLock()
+	f, ok := m.folderFiles["default"].Get(device1, "aux.txt")
+	m.fmut.RUnlock()
+	if !ok || !f.IsInvalid() {
+		t.Errorf("reserved name should be in the index as invalid, got %v", f)
+	}
+	if _, ok := m.CurrentGlobalFile("default", "aux.txt"); ok {
+		t.Error("reserved name should not be in the global index")
+	}
+
+	ev, err := sub.Poll(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := ev.Data.(map[string]interface{}); data["items"] != 1 || data["device"] != device1.String() {
+		t.Errorf("unexpected event data %v", data)
+	}
+}
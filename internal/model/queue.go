@@ -83,6 +83,13 @@ func (q *jobQueue) Done(file string) {
 	}
 }
 
+// Clear drops the queued jobs, leaving those in progress.
+func (q *jobQueue) Clear() {
+	q.mut.Lock()
+	q.queued = nil
+	q.mut.Unlock()
+}
+
 func (q *jobQueue) Jobs() ([]string, []string) {
 	q.mut.Lock()
 	defer q.mut.Unlock()
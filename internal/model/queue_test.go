@@ -159,6 +159,19 @@ func TestBringToFront(t *testing.T) {
 	}
 }
 
+func TestClear(t *testing.T) {
+	q := newJobQueue()
+	q.Push("f1", 0, 0)
+	q.Push("f2", 0, 0)
+	q.Pop()
+
+	q.Clear()
+	progress, queued := q.Jobs()
+	if !reflect.DeepEqual(progress, []string{"f1"}) || len(queued) != 0 {
+		t.Errorf("Incorrect jobs after clear: %v, %v", progress, queued)
+	}
+}
+
 func TestShuffle(t *testing.T) {
 	q := newJobQueue()
 	q.Push("f1", 0, 0)
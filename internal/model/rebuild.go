@@ -0,0 +1,92 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"errors"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/scanner"
+)
+
+// RebuildIndex replaces the local index for the folder with the result of a
+// full scan, where every file is hashed regardless of whether it seems
+// changed or not. Files whose contents match the previous index entry keep
+// their version, so that they don't appear changed to other devices. The
+// folder must not have been started.
+func (m *Model) RebuildIndex(folder string) error {
+	m.fmut.RLock()
+	fs, ok := m.folderFiles[folder]
+	folderCfg := m.folderCfgs[folder]
+	ignores := m.folderIgnores[folder]
+	gitignores := m.gitignores[folder]
+	_, started := m.folderRunners[folder]
+	m.fmut.RUnlock()
+
+	if !ok {
+		return errors.New("no such folder")
+	}
+	if started {
+		return errors.New("folder is running")
+	}
+
+	_ = m.loadIgnores(folderCfg, ignores, gitignores) // Ignore error, there might not be an .stignore
+
+	// No CurrentFiler, so that everything is hashed.
+	w := &scanner.Walker{
+		Dir:           folderCfg.Path(),
+		Matcher:       ignores,
+		BlockSize:     protocol.BlockSize,
+		TempNamer:     defTempNamer,
+		TempLifetime:  time.Duration(m.cfg.Options().KeepTemporariesH) * time.Hour,
+		MtimeRepo:     db.NewVirtualMtimeRepo(m.db, folderCfg.ID),
+		Placeholders:  db.NewPlaceholderRepo(m.db, folderCfg.ID),
+		IgnorePerms:   folderCfg.IgnorePerms,
+		AutoNormalize: folderCfg.AutoNormalize,
+		ModTimeWindow: time.Duration(folderCfg.ModTimeWindowS) * time.Second,
+		Hashers:       m.folderTuning(folder).Hashers,
+		ReadLimiter:   m.scanReadLimiter,
+		HasherSlots:   m.hasherSlots,
+		CPULimiter:    m.cpuLimiter,
+		ShortID:       m.shortID,
+	}
+
+	fchan, err := w.Walk()
+	if err != nil {
+		return err
+	}
+
+	var files []protocol.FileInfo
+	changed := 0
+	for f := range fchan {
+		if cur, ok := fs.Get(protocol.LocalDeviceID, f.Name); ok {
+			if sameContents(cur, f) {
+				f.Version = cur.Version
+			} else {
+				f.Version = cur.Version.Update(m.shortID)
+				changed++
+			}
+		} else {
+			changed++
+		}
+		files = append(files, f)
+	}
+
+	l.Infof("Rebuilt index for folder %q; %d items, %d of which changed", folder, len(files), changed)
+
+	// Files no longer present are marked as deleted.
+	fs.ReplaceWithDelete(protocol.LocalDeviceID, files, m.shortID)
+	return nil
+}
+
+// sameContents returns true if the two files are the same type of item with
+// the same permissions and contents.
+func sameContents(a, b protocol.FileInfo) bool {
+	return !a.IsDeleted() && !a.IsInvalid() && a.Flags == b.Flags && scanner.BlocksEqual(a.Blocks, b.Blocks)
+}
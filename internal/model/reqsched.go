@@ -0,0 +1,209 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+// A connection has this many slots for outstanding block requests to begin
+// with, unless configured otherwise for the device. When all are taken, the
+// next request to go out is the oldest of the highest priority folder
+// waiting, instead of whichever folder asked first.
+const deviceRequestSlots = 16
+
+// Unless configured, the number of slots adapts to the link, between these
+// bounds: it grows while requests are waiting for slots and the round trip
+// time stays close to the lowest seen, as on a long but uncongested link, and
+// shrinks when the round trip time grows without the throughput growing
+// along, as when a slow device is given more than it can handle.
+const (
+	minAdaptiveRequests = 2
+	maxAdaptiveRequests = 256
+)
+
+// A requestScheduler hands out the request slots of a connection by folder
+// priority.
+type requestScheduler struct {
+	limit    int
+	inFlight int
+	adaptive bool
+	waiting  requestWaiters
+	seq      int64 // order of arrival, for fairness within a priority
+
+	// The requests answered since the slots were last adapted, and their
+	// outcome.
+	samples int
+	rttSum  time.Duration
+	bytes   int64
+	since   time.Time
+	starved bool // a request had to wait for a slot
+
+	minRTT time.Duration // lowest seen, slowly forgotten
+	rtt    time.Duration // average over the last round
+	rate   float64       // bytes per second over the last round
+
+	mut sync.Mutex
+}
+
+type requestWaiter struct {
+	priority int
+	seq      int64
+	ready    chan struct{}
+}
+
+// newRequestScheduler returns a scheduler with the given number of slots, or
+// adapting the number of slots if it is zero.
+func newRequestScheduler(slots int) *requestScheduler {
+	s := &requestScheduler{
+		limit: slots,
+		mut:   sync.NewMutex(),
+	}
+	if slots <= 0 {
+		s.limit = deviceRequestSlots
+		s.adaptive = true
+	}
+	return s
+}
+
+// acquire waits for a request slot for a folder of the given priority.
+func (s *requestScheduler) acquire(priority int) {
+	s.mut.Lock()
+	if s.inFlight < s.limit && len(s.waiting) == 0 {
+		s.inFlight++
+		s.mut.Unlock()
+		return
+	}
+	w := &requestWaiter{
+		priority: priority,
+		seq:      s.seq,
+		ready:    make(chan struct{}),
+	}
+	s.seq++
+	s.starved = true
+	heap.Push(&s.waiting, w)
+	s.mut.Unlock()
+
+	<-w.ready
+}
+
+// release returns a slot, after a request answered with the given number of
+// bytes in the given time; a zero time if it failed.
+func (s *requestScheduler) release(bytes int, rtt time.Duration) {
+	s.mut.Lock()
+	s.inFlight--
+	if rtt > 0 {
+		s.sample(bytes, rtt, time.Now())
+	}
+	for s.inFlight < s.limit && len(s.waiting) > 0 {
+		w := heap.Pop(&s.waiting).(*requestWaiter)
+		s.inFlight++
+		close(w.ready)
+	}
+	s.mut.Unlock()
+}
+
+// sample records the outcome of a request. Once about as many requests as
+// there are slots have been answered, which is about one round trip, the
+// averages are updated and an adaptive number of slots adapted.
+func (s *requestScheduler) sample(bytes int, rtt time.Duration, now time.Time) {
+	if s.minRTT == 0 || rtt < s.minRTT {
+		s.minRTT = rtt
+	}
+	if s.samples == 0 {
+		s.since = now.Add(-rtt)
+	}
+	s.samples++
+	s.rttSum += rtt
+	s.bytes += int64(bytes)
+	if s.samples < s.limit {
+		return
+	}
+
+	prevRate := s.rate
+	s.rtt = s.rttSum / time.Duration(s.samples)
+	if period := now.Sub(s.since); period > 0 {
+		s.rate = float64(s.bytes) / period.Seconds()
+	}
+
+	switch {
+	case !s.adaptive:
+	case s.starved && s.rtt <= s.minRTT*3/2:
+		s.limit += s.limit/4 + 1
+		if s.limit > maxAdaptiveRequests {
+			s.limit = maxAdaptiveRequests
+		}
+	case s.rtt >= 2*s.minRTT && s.rate <= prevRate*1.1:
+		s.limit -= s.limit/4 + 1
+		if s.limit < minAdaptiveRequests {
+			s.limit = minAdaptiveRequests
+		}
+	}
+	if debug.On() {
+		l.Debugf("request slots: %d; rtt %v (min %v), %.0f B/s", s.limit, s.rtt, s.minRTT, s.rate)
+	}
+
+	// The lowest round trip time creeps towards the current one, so that a
+	// path that got slower for good doesn't keep the slots down forever.
+	s.minRTT += (s.rtt - s.minRTT) / 16
+
+	s.samples = 0
+	s.rttSum = 0
+	s.bytes = 0
+	s.starved = false
+}
+
+// A RequestStats describes the block requests on a connection.
+type RequestStats struct {
+	Limit    int           // slots for outstanding requests
+	Adaptive bool          // whether the limit adapts to the link
+	InFlight int           // requests outstanding
+	Waiting  int           // requests waiting for a slot
+	RTT      time.Duration // average round trip time, recently
+	Rate     float64       // bytes per second received, recently
+}
+
+func (s *requestScheduler) stats() RequestStats {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return RequestStats{
+		Limit:    s.limit,
+		Adaptive: s.adaptive,
+		InFlight: s.inFlight,
+		Waiting:  len(s.waiting),
+		RTT:      s.rtt,
+		Rate:     s.rate,
+	}
+}
+
+// requestWaiters is a heap of waiters, highest priority and oldest first.
+type requestWaiters []*requestWaiter
+
+func (q requestWaiters) Len() int { return len(q) }
+
+func (q requestWaiters) Less(a, b int) bool {
+	if q[a].priority != q[b].priority {
+		return q[a].priority > q[b].priority
+	}
+	return q[a].seq < q[b].seq
+}
+
+func (q requestWaiters) Swap(a, b int) { q[a], q[b] = q[b], q[a] }
+
+func (q *requestWaiters) Push(x interface{}) { *q = append(*q, x.(*requestWaiter)) }
+
+func (q *requestWaiters) Pop() interface{} {
+	old := *q
+	n := len(old)
+	w := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return w
+}
@@ -0,0 +1,112 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRequestScheduler(t *testing.T) {
+	s := newRequestScheduler(1)
+	s.acquire(0) // Takes the only slot
+
+	// Queue low and high priority requests, one at a time to fix the order
+	// of arrival.
+	order := make(chan int, 4)
+	var wg sync.WaitGroup
+	for _, prio := range []int{0, 1, 5, 1} {
+		prio := prio
+		s.mut.Lock()
+		queued := len(s.waiting)
+		s.mut.Unlock()
+		wg.Add(1)
+		go func() {
+			s.acquire(prio)
+			order <- prio
+			s.release(0, 0)
+			wg.Done()
+		}()
+		for {
+			s.mut.Lock()
+			n := len(s.waiting)
+			s.mut.Unlock()
+			if n > queued {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	s.release(0, 0)
+	var got []int
+	for i := 0; i < 4; i++ {
+		got = append(got, <-order)
+	}
+	expected := []int{5, 1, 1, 0}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("Slots handed out by priority %v, expected %v", got, expected)
+		}
+	}
+
+	wg.Wait()
+	s.mut.Lock()
+	inFlight := s.inFlight
+	s.mut.Unlock()
+	if inFlight != 0 {
+		t.Errorf("%d requests in flight after all were released", inFlight)
+	}
+}
+
+func TestRequestSchedulerAdapts(t *testing.T) {
+	s := newRequestScheduler(0)
+	if !s.adaptive || s.limit != deviceRequestSlots {
+		t.Fatalf("unexpected scheduler %+v", s)
+	}
+	now := time.Now()
+
+	// A round of requests with a steady round trip time while more were
+	// waiting grows the slots.
+	round := func(rtt time.Duration) {
+		for n := s.limit; n > 0; n-- {
+			s.starved = true
+			now = now.Add(rtt / time.Duration(s.limit))
+			s.sample(128<<10, rtt, now)
+		}
+	}
+	round(100 * time.Millisecond)
+	round(100 * time.Millisecond)
+	if s.limit <= deviceRequestSlots {
+		t.Fatalf("%d slots after a fast round, expected more than %d", s.limit, deviceRequestSlots)
+	}
+
+	// Up to the maximum.
+	for i := 0; i < 100; i++ {
+		round(100 * time.Millisecond)
+	}
+	if s.limit != maxAdaptiveRequests {
+		t.Fatalf("%d slots after many fast rounds, expected %d", s.limit, maxAdaptiveRequests)
+	}
+
+	// A round trip time growing without more throughput shrinks them,
+	// down to the minimum.
+	for i := 0; i < 20; i++ {
+		round(time.Duration(i+2) * 100 * time.Millisecond)
+	}
+	if s.limit != minAdaptiveRequests {
+		t.Fatalf("%d slots after many slow rounds, expected %d", s.limit, minAdaptiveRequests)
+	}
+
+	// A fixed number of slots stays fixed.
+	s = newRequestScheduler(4)
+	round(time.Second)
+	if s.adaptive || s.limit != 4 {
+		t.Errorf("unexpected fixed scheduler %+v", s)
+	}
+}
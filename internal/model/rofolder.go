@@ -41,7 +41,7 @@ func newROFolder(model *Model, folder string, interval time.Duration) *roFolder
 }
 
 func (s *roFolder) Serve() {
-	if debug {
+	if debug.On() {
 		l.Debugln(s, "starting")
 		defer l.Debugln(s, "exiting")
 	}
@@ -66,13 +66,21 @@ func (s *roFolder) Serve() {
 			return
 
 		case <-s.timer.C:
+			if s.model.Suspended() {
+				if debug.On() {
+					l.Debugln(s, "skip scan (suspended)")
+				}
+				s.timer.Reset(suspendedIntv)
+				continue
+			}
+
 			if err := s.model.CheckFolderHealth(s.folder); err != nil {
 				l.Infoln("Skipping folder", s.folder, "scan due to folder error:", err)
 				reschedule()
 				continue
 			}
 
-			if debug {
+			if debug.On() {
 				l.Debugln(s, "rescan")
 			}
 
@@ -116,6 +124,14 @@ func (s *roFolder) String() string {
 
 func (s *roFolder) BringToFront(string) {}
 
+func (s *roFolder) Errors() []FileError {
+	return nil
+}
+
+func (s *roFolder) Retry([]string) {}
+
+func (s *roFolder) Fetch([]string) {}
+
 func (s *roFolder) Jobs() ([]string, []string) {
 	return nil, nil
 }
@@ -13,6 +13,7 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
 	"time"
 
 	"github.com/syncthing/protocol"
@@ -33,6 +34,7 @@ const (
 	pauseIntv     = 60 * time.Second
 	nextPullIntv  = 10 * time.Second
 	shortPullIntv = 5 * time.Second
+	suspendedIntv = 10 * time.Second // how often a suspended model is checked on
 )
 
 // A pullBlockState is passed to the puller routine for each block that needs
@@ -52,6 +54,12 @@ type copyBlocksState struct {
 var (
 	activity    = newDeviceActivity()
 	errNoDevice = errors.New("no available source device")
+	errStopping = errors.New("folder is stopping")
+
+	errFolderNotWritable = errors.New("folder path not writable")
+	errFileTooLarge      = errors.New("file is larger than the maximum file size of the folder")
+	errFilesystemChanged = errors.New("folder path moved to another filesystem (unmounted?)")
+	errSnapshotFailed    = errors.New("not pulled, as taking a snapshot of the folder failed")
 )
 
 type rwFolder struct {
@@ -60,16 +68,35 @@ type rwFolder struct {
 	model            *Model
 	progressEmitter  *ProgressEmitter
 	virtualMtimeRepo *db.VirtualMtimeRepo
-
-	folder      string
-	dir         string
-	scanIntv    time.Duration
-	versioner   versioner.Versioner
-	ignorePerms bool
-	copiers     int
-	pullers     int
-	shortID     uint64
-	order       config.PullOrder
+	placeholderRepo  *db.PlaceholderRepo
+	tempBlockRepo    *db.TempBlockRepo
+	pendingDeletes   *db.PendingDeleteRepo
+	fsIDRepo         *db.FilesystemIDRepo
+
+	folder       string
+	dir          string
+	scanIntv     time.Duration
+	versioner    versioner.Versioner
+	ignorePerms  bool
+	shortID      uint64
+	order        config.PullOrder
+	marker       config.FolderConfiguration // for checking the folder marker
+	placeholders bool                       // create empty placeholders instead of pulling content
+	maxFileSize  int64                      // files larger than this are not pulled, if larger than zero
+	archive      bool                       // never apply remote deletions
+	dryRun       bool                       // never pull; see Model.PullPlan
+	deleteDelay  time.Duration
+	deletesDue   time.Time // when the first deletion held back by deleteDelay is due; zero if none is
+
+	snapshotCommand string // run before pulls deleting or replacing more than snapshotItems items; see snapshot
+	snapshotItems   int
+	snapshotTaken   bool  // the snapshot command ran during the current pull
+	snapshotErr     error // and failed, if not nil
+
+	pullRate *rateMeter // bytes pulled per second, while pulling
+
+	maxQueued int  // needed items handled per puller iteration, the rest wait in the database; unlimited if zero
+	queueFull bool // the last puller iteration stopped at maxQueued
 
 	stop        chan struct{}
 	queue       *jobQueue
@@ -78,6 +105,11 @@ type rwFolder struct {
 	pullTimer   *time.Timer
 	delayScan   chan time.Duration
 	remoteIndex chan struct{} // An index update was received, we should re-evaluate needs
+
+	errors     map[string]string // path -> error string
+	retryItems []string          // items to handle first in the next puller iteration
+	fetchItems map[string]bool   // placeholders to replace by the content
+	errorsMut  sync.Mutex        // protects errors, retryItems and fetchItems
 }
 
 func newRWFolder(m *Model, shortID uint64, cfg config.FolderConfiguration) *rwFolder {
@@ -90,15 +122,29 @@ func newRWFolder(m *Model, shortID uint64, cfg config.FolderConfiguration) *rwFo
 		model:            m,
 		progressEmitter:  m.progressEmitter,
 		virtualMtimeRepo: db.NewVirtualMtimeRepo(m.db, cfg.ID),
-
-		folder:      cfg.ID,
-		dir:         cfg.Path(),
-		scanIntv:    time.Duration(cfg.RescanIntervalS) * time.Second,
-		ignorePerms: cfg.IgnorePerms,
-		copiers:     cfg.Copiers,
-		pullers:     cfg.Pullers,
-		shortID:     shortID,
-		order:       cfg.Order,
+		placeholderRepo:  db.NewPlaceholderRepo(m.db, cfg.ID),
+		tempBlockRepo:    db.NewTempBlockRepo(m.db, cfg.ID),
+		pendingDeletes:   db.NewPendingDeleteRepo(m.db, cfg.ID),
+		fsIDRepo:         db.NewFilesystemIDRepo(m.db, cfg.ID),
+
+		folder:       cfg.ID,
+		dir:          cfg.Path(),
+		scanIntv:     time.Duration(cfg.RescanIntervalS) * time.Second,
+		ignorePerms:  cfg.IgnorePerms,
+		shortID:      shortID,
+		order:        cfg.Order,
+		marker:       cfg,
+		placeholders: cfg.Placeholders,
+		maxFileSize:  cfg.MaxFileSize(),
+		archive:      cfg.Archive,
+		dryRun:       cfg.DryRun,
+		deleteDelay:  cfg.DeleteDelay(),
+
+		snapshotCommand: cfg.SnapshotCommand,
+		snapshotItems:   cfg.SnapshotItems,
+
+		pullRate:  m.pullRate(cfg.ID),
+		maxQueued: m.cfg.Options().MaxPullQueueItems,
 
 		stop:        make(chan struct{}),
 		queue:       newJobQueue(),
@@ -106,13 +152,17 @@ func newRWFolder(m *Model, shortID uint64, cfg config.FolderConfiguration) *rwFo
 		scanTimer:   time.NewTimer(time.Millisecond), // The first scan should be done immediately.
 		delayScan:   make(chan time.Duration),
 		remoteIndex: make(chan struct{}, 1), // This needs to be 1-buffered so that we queue a notification if we're busy doing a pull when it comes.
+
+		errors:     make(map[string]string),
+		fetchItems: make(map[string]bool),
+		errorsMut:  sync.NewMutex(),
 	}
 }
 
 // Serve will run scans and pulls. It will return when Stop()ed or on a
 // critical error.
 func (p *rwFolder) Serve() {
-	if debug {
+	if debug.On() {
 		l.Debugln(p, "starting")
 		defer l.Debugln(p, "exiting")
 	}
@@ -126,6 +176,7 @@ func (p *rwFolder) Serve() {
 
 	var prevVer int64
 	var prevIgnoreHash string
+	var prevDestErr error
 
 	rescheduleScan := func() {
 		if p.scanIntv == 0 {
@@ -137,7 +188,7 @@ func (p *rwFolder) Serve() {
 		sleepNanos := (p.scanIntv.Nanoseconds()*3 + rand.Int63n(2*p.scanIntv.Nanoseconds())) / 4
 		intv := time.Duration(sleepNanos) * time.Nanosecond
 
-		if debug {
+		if debug.On() {
 			l.Debugln(p, "next rescan in", intv)
 		}
 		p.scanTimer.Reset(intv)
@@ -154,19 +205,41 @@ func (p *rwFolder) Serve() {
 		case <-p.remoteIndex:
 			prevVer = 0
 			p.pullTimer.Reset(shortPullIntv)
-			if debug {
+			if debug.On() {
 				l.Debugln(p, "remote index updated, rescheduling pull")
 			}
 
 		case <-p.pullTimer.C:
 			if !initialScanCompleted {
-				if debug {
+				if debug.On() {
 					l.Debugln(p, "skip (initial)")
 				}
 				p.pullTimer.Reset(nextPullIntv)
 				continue
 			}
 
+			if p.model.Suspended() {
+				if debug.On() {
+					l.Debugln(p, "skip (suspended)")
+				}
+				p.pullTimer.Reset(suspendedIntv)
+				continue
+			}
+
+			if p.dryRun {
+				if debug.On() {
+					l.Debugln(p, "skip (dry run)")
+				}
+				p.pullTimer.Reset(nextPullIntv)
+				continue
+			}
+
+			if err := p.model.CheckFolderHealth(p.folder); err != nil {
+				l.Infoln("Skipping folder", p.folder, "pull due to folder error:", err)
+				p.pullTimer.Reset(nextPullIntv)
+				continue
+			}
+
 			p.model.fmut.RLock()
 			curIgnores := p.model.folderIgnores[p.folder]
 			p.model.fmut.RUnlock()
@@ -174,36 +247,94 @@ func (p *rwFolder) Serve() {
 			if newHash := curIgnores.Hash(); newHash != prevIgnoreHash {
 				// The ignore patterns have changed. We need to re-evaluate if
 				// there are files we need now that were ignored before.
-				if debug {
+				if debug.On() {
 					l.Debugln(p, "ignore patterns have changed, resetting prevVer")
 				}
 				prevVer = 0
 				prevIgnoreHash = newHash
 			}
 
+			if !p.deletesDue.IsZero() && !time.Now().Before(p.deletesDue) {
+				// A deletion held back by the delete window is due now.
+				prevVer = 0
+			}
+
 			// RemoteLocalVersion() is a fast call, doesn't touch the database.
 			curVer := p.model.RemoteLocalVersion(p.folder)
 			if curVer == prevVer {
-				if debug {
+				if debug.On() {
 					l.Debugln(p, "skip (curVer == prevVer)", prevVer)
 				}
 				p.pullTimer.Reset(nextPullIntv)
 				continue
 			}
 
-			if debug {
+			if debug.On() {
 				l.Debugln(p, "pulling", prevVer, curVer)
 			}
 			p.setState(FolderSyncing)
+			p.pullRate.start(time.Now())
+			p.clearErrors()
+			p.snapshotTaken = false
+			healthy := true
 			tries := 0
+			prevNeed := -1
 			for {
 				tries++
 
+				err := p.checkDestination()
+				if err != nil && (prevDestErr == nil || err.Error() != prevDestErr.Error()) {
+					l.Warnf("Pausing folder %q - %v", p.folder, err)
+				} else if err == nil && prevDestErr != nil {
+					l.Infof("Resuming folder %q", p.folder)
+				}
+				prevDestErr = err
+				if err != nil {
+					p.setError(err)
+					p.pullTimer.Reset(nextPullIntv)
+					healthy = false
+					break
+				}
+
 				changed := p.pullerIteration(curIgnores)
-				if debug {
+				if debug.On() {
 					l.Debugln(p, "changed", changed)
 				}
 
+				if p.queueFull {
+					// Only part of what is needed was handled, so it takes
+					// a number of iterations to get in sync. Only those not
+					// bringing the need down count as tries.
+					need, _ := p.model.NeedSize(p.folder)
+					if prevNeed < 0 || need < prevNeed {
+						tries = 0
+					}
+					prevNeed = need
+				}
+
+				if p.stopping() {
+					// The pull was cut short; the files not yet handled
+					// will be pulled after the restart.
+					break
+				}
+
+				if p.model.Suspended() {
+					// The pull was cut short; the files not yet handled
+					// will be pulled when resumed.
+					p.pullTimer.Reset(suspendedIntv)
+					break
+				}
+
+				if err := p.model.CheckFolderHealth(p.folder); err != nil {
+					// The marker disappeared during the pull, most likely
+					// as the disk was unmounted. The folder stays in the
+					// error state until it's back.
+					l.Infoln("Stopping folder", p.folder, "pull due to folder error:", err)
+					p.pullTimer.Reset(nextPullIntv)
+					healthy = false
+					break
+				}
+
 				if changed == 0 {
 					// No files were changed by the puller, so we are in
 					// sync. Remember the local version number and
@@ -222,7 +353,7 @@ func (p *rwFolder) Serve() {
 						curVer = lv
 					}
 					prevVer = curVer
-					if debug {
+					if debug.On() {
 						l.Debugln(p, "next pull in", nextPullIntv)
 					}
 					p.pullTimer.Reset(nextPullIntv)
@@ -235,26 +366,37 @@ func (p *rwFolder) Serve() {
 					// errors preventing us. Flag this with a warning and
 					// wait a bit longer before retrying.
 					l.Warnf("Folder %q isn't making progress - check logs for possible root cause. Pausing puller for %v.", p.folder, pauseIntv)
-					if debug {
+					if debug.On() {
 						l.Debugln(p, "next pull in", pauseIntv)
 					}
 					p.pullTimer.Reset(pauseIntv)
 					break
 				}
 			}
-			p.setState(FolderIdle)
+			p.pullRate.stop(time.Now())
+			if healthy {
+				p.setState(FolderIdle)
+			}
 
 		// The reason for running the scanner from within the puller is that
 		// this is the easiest way to make sure we are not doing both at the
 		// same time.
 		case <-p.scanTimer.C:
+			if p.model.Suspended() {
+				if debug.On() {
+					l.Debugln(p, "skip scan (suspended)")
+				}
+				p.scanTimer.Reset(suspendedIntv)
+				continue
+			}
+
 			if err := p.model.CheckFolderHealth(p.folder); err != nil {
 				l.Infoln("Skipping folder", p.folder, "scan due to folder error:", err)
 				rescheduleScan()
 				continue
 			}
 
-			if debug {
+			if debug.On() {
 				l.Debugln(p, "rescan")
 			}
 
@@ -268,6 +410,10 @@ func (p *rwFolder) Serve() {
 				continue
 			}
 
+			// Conflict copies are in the index now; get rid of those
+			// exceeding the configured limits.
+			p.model.pruneConflicts(p.folder)
+
 			if p.scanIntv > 0 {
 				rescheduleScan()
 			}
@@ -282,10 +428,67 @@ func (p *rwFolder) Serve() {
 	}
 }
 
+// setMtime sets the modification time of the named file, found at path. If
+// the filesystem doesn't store the time as given, either because it can't be
+// set at all or is rounded (FAT has two second precision), the time is
+// shelved in the database so that the next scan doesn't see a change.
+func (p *rwFolder) setMtime(name, path string, t time.Time) error {
+	os.Chtimes(path, t, t)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.ModTime().Equal(t) {
+		p.virtualMtimeRepo.UpdateMtime(name, info.ModTime(), t)
+	}
+	return nil
+}
+
+// checkDestination makes sure the folder path is still on the filesystem it
+// was on at the first pull, as recorded in the database, and that it can be
+// written to, so that a failed mount never results in syncing into the empty
+// mount point directory, also when the mount failed at boot.
+func (p *rwFolder) checkDestination() error {
+	id, ok, err := osutil.FilesystemID(p.dir)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if want, known := p.fsIDRepo.Get(p.dir); !known {
+			p.fsIDRepo.Put(p.dir, id)
+		} else if id != want {
+			return errFilesystemChanged
+		}
+	}
+
+	fd, err := ioutil.TempFile(p.dir, defTempNamer.prefix)
+	if err != nil {
+		if debug.On() {
+			l.Debugln(p, "write test:", err)
+		}
+		return errFolderNotWritable
+	}
+	fd.Close()
+	os.Remove(fd.Name())
+	return nil
+}
+
 func (p *rwFolder) Stop() {
 	close(p.stop)
 }
 
+// stopping returns true once Stop has been called. Files that are being
+// pulled are then checkpointed: blocks already fetched are kept in the
+// temporary file, to be reused when the file is pulled again.
+func (p *rwFolder) stopping() bool {
+	select {
+	case <-p.stop:
+		return true
+	default:
+		return false
+	}
+}
+
 func (p *rwFolder) IndexUpdated() {
 	select {
 	case p.remoteIndex <- struct{}{}:
@@ -315,8 +518,9 @@ func (p *rwFolder) pullerIteration(ignores *ignore.Matcher) int {
 	pullWg := sync.NewWaitGroup()
 	doneWg := sync.NewWaitGroup()
 
-	if debug {
-		l.Debugln(p, "c", p.copiers, "p", p.pullers)
+	tuning := p.model.folderTuning(p.folder)
+	if debug.On() {
+		l.Debugln(p, "c", tuning.Copiers, "p", tuning.Pullers)
 	}
 
 	p.dbUpdates = make(chan protocol.FileInfo)
@@ -327,7 +531,7 @@ func (p *rwFolder) pullerIteration(ignores *ignore.Matcher) int {
 		updateWg.Done()
 	}()
 
-	for i := 0; i < p.copiers; i++ {
+	for i := 0; i < tuning.Copiers; i++ {
 		copyWg.Add(1)
 		go func() {
 			// copierRoutine finishes when copyChan is closed
@@ -336,7 +540,7 @@ func (p *rwFolder) pullerIteration(ignores *ignore.Matcher) int {
 		}()
 	}
 
-	for i := 0; i < p.pullers; i++ {
+	for i := 0; i < tuning.Pullers; i++ {
 		pullWg.Add(1)
 		go func() {
 			// pullerRoutine finishes when pullChan is closed
@@ -363,16 +567,29 @@ func (p *rwFolder) pullerIteration(ignores *ignore.Matcher) int {
 	// !!!
 
 	changed := 0
+	p.deletesDue = time.Time{}
+	p.queueFull = false
 
 	fileDeletions := map[string]protocol.FileInfo{}
 	dirDeletions := []protocol.FileInfo{}
 	buckets := map[string][]protocol.FileInfo{}
+	var destructive []string // items we have that are to be deleted or replaced
 
 	folderFiles.WithNeed(protocol.LocalDeviceID, func(intf db.FileIntf) bool {
 		// Needed items are delivered sorted lexicographically. We'll handle
 		// directories as they come along, so parents before children. Files
 		// are queued and the order may be changed later.
 
+		if p.stopping() {
+			return false
+		}
+		if p.maxQueued > 0 && changed >= p.maxQueued {
+			// The rest is left in the database until the next iteration,
+			// rather than held in memory.
+			p.queueFull = true
+			return false
+		}
+
 		file := intf.(protocol.FileInfo)
 
 		if ignores.Match(file.Name) {
@@ -380,13 +597,29 @@ func (p *rwFolder) pullerIteration(ignores *ignore.Matcher) int {
 			return true
 		}
 
-		if debug {
+		if debug.On() {
 			l.Debugln(p, "handling", file.Name)
 		}
 
+		if err := osutil.CheckFilename(file.Name); err != nil {
+			// Such files are marked invalid as the index arrives, but may
+			// have been stored before that.
+			p.newError(file.Name, err)
+			return true
+		}
+
 		switch {
+		case file.IsDeleted() && p.archive:
+			// The file is kept; see Model.RetainedFiles.
+			return true
+		case file.IsDeleted() && p.deleteDelay > 0 && !p.deletionDue(folderFiles, file):
+			// Held back by the delete window; see Model.PendingDeletes.
+			return true
 		case file.IsDeleted():
 			// A deleted file, directory or symlink
+			if df, ok := folderFiles.Get(protocol.LocalDeviceID, file.Name); ok && !df.IsDeleted() {
+				destructive = append(destructive, file.Name)
+			}
 			if file.IsDirectory() {
 				dirDeletions = append(dirDeletions, file)
 			} else {
@@ -404,13 +637,26 @@ func (p *rwFolder) pullerIteration(ignores *ignore.Matcher) int {
 			}
 		case file.IsDirectory() && !file.IsSymlink():
 			// A new or changed directory
-			if debug {
+			if debug.On() {
 				l.Debugln("Creating directory", file.Name)
 			}
 			p.handleDir(file)
+		case p.wantsPlaceholder(file):
+			// Only the metadata of the file is kept locally
+			if !p.handlePlaceholder(file) {
+				// The placeholder is already up to date
+				return true
+			}
+		case p.maxFileSize > 0 && !file.IsSymlink() && file.Size() > p.maxFileSize:
+			// Too large to pull; shown among the failed items.
+			p.newError(file.Name, errFileTooLarge)
+			return true
 		default:
 			// A new or changed file or symlink. This is the only case where we
 			// do stuff concurrently in the background
+			if lf, ok := folderFiles.Get(protocol.LocalDeviceID, file.Name); ok && !lf.IsDeleted() {
+				destructive = append(destructive, file.Name)
+			}
 			p.queue.Push(file.Name, file.Size(), file.Modified)
 		}
 
@@ -418,6 +664,34 @@ func (p *rwFolder) pullerIteration(ignores *ignore.Matcher) int {
 		return true
 	})
 
+	if p.placeholders {
+		p.removeDeletedPlaceholders(folderFiles)
+	}
+
+	if p.snapshotCommand != "" && len(destructive) > p.snapshotItems && !p.stopping() {
+		// The snapshot, or the failure to take it, holds for all the
+		// iterations of the pull.
+		if !p.snapshotTaken {
+			p.snapshotErr = p.snapshot(len(destructive))
+			p.snapshotTaken = true
+			if p.snapshotErr != nil {
+				l.Warnf("Folder %q: not pulling, as the snapshot before deleting or replacing %d items failed: %v", p.folder, len(destructive), p.snapshotErr)
+			}
+		}
+		if p.snapshotErr != nil {
+			// Nothing is pulled without the snapshot to go back to. The
+			// items show as failed until a retry, or the next change,
+			// runs the command again.
+			for _, name := range destructive {
+				p.newError(name, errSnapshotFailed)
+			}
+			p.queue.Clear()
+			fileDeletions = nil
+			dirDeletions = nil
+			changed = 0
+		}
+	}
+
 	// Reorder the file queue according to configuration
 
 	switch p.order {
@@ -435,10 +709,32 @@ func (p *rwFolder) pullerIteration(ignores *ignore.Matcher) int {
 		p.queue.SortOldestFirst()
 	}
 
+	// Items the user asked to retry go before everything else
+
+	p.errorsMut.Lock()
+	retryItems := p.retryItems
+	p.retryItems = nil
+	p.errorsMut.Unlock()
+	for i := len(retryItems) - 1; i >= 0; i-- {
+		p.queue.BringToFront(retryItems[i])
+	}
+
 	// Process the file queue
 
+	if !p.marker.HasMarker() {
+		// Don't write into what is likely an empty mount point. The caller
+		// notices and flags the folder error; the files are queued again by
+		// the next iteration.
+		p.queue.Clear()
+	}
+
 nextFile:
-	for {
+	for !p.stopping() {
+		if p.model.Suspended() {
+			p.queue.Clear()
+			break
+		}
+
 		fileName, ok := p.queue.Pop()
 		if !ok {
 			break
@@ -496,8 +792,19 @@ nextFile:
 	// Wait for the finisherChan to finish.
 	doneWg.Wait()
 
+	if p.stopping() {
+		// Leave the deletions for the next run, as the files to delete may
+		// be needed as the source of a rename that wasn't handled yet.
+		fileDeletions = nil
+		dirDeletions = nil
+	} else if !p.marker.HasMarker() {
+		// Files that aren't there because the disk is gone aren't deleted.
+		fileDeletions = nil
+		dirDeletions = nil
+	}
+
 	for _, file := range fileDeletions {
-		if debug {
+		if debug.On() {
 			l.Debugln("Deleting file", file.Name)
 		}
 		p.deleteFile(file)
@@ -505,7 +812,7 @@ nextFile:
 
 	for i := range dirDeletions {
 		dir := dirDeletions[len(dirDeletions)-i-1]
-		if debug {
+		if debug.On() {
 			l.Debugln("Deleting dir", dir.Name)
 		}
 		p.deleteDir(dir)
@@ -544,7 +851,7 @@ func (p *rwFolder) handleDir(file protocol.FileInfo) {
 		mode = 0755
 	}
 
-	if debug {
+	if debug.On() {
 		curFile, _ := p.model.CurrentFolderFile(p.folder, file.Name)
 		l.Debugf("need dir\n\t%v\n\t%v", file, curFile)
 	}
@@ -558,6 +865,7 @@ func (p *rwFolder) handleDir(file protocol.FileInfo) {
 		err = osutil.InWritableDir(osutil.Remove, realName)
 		if err != nil {
 			l.Infof("Puller (folder %q, dir %q): %v", p.folder, file.Name, err)
+			p.newError(file.Name, err)
 			return
 		}
 		fallthrough
@@ -579,12 +887,14 @@ func (p *rwFolder) handleDir(file protocol.FileInfo) {
 			p.dbUpdates <- file
 		} else {
 			l.Infof("Puller (folder %q, dir %q): %v", p.folder, file.Name, err)
+			p.newError(file.Name, err)
 		}
 		return
 	// Weird error when stat()'ing the dir. Probably won't work to do
 	// anything else with it if we can't even stat() it.
 	case err != nil:
 		l.Infof("Puller (folder %q, dir %q): %v", p.folder, file.Name, err)
+		p.newError(file.Name, err)
 		return
 	}
 
@@ -598,6 +908,7 @@ func (p *rwFolder) handleDir(file protocol.FileInfo) {
 		p.dbUpdates <- file
 	} else {
 		l.Infof("Puller (folder %q, dir %q): %v", p.folder, file.Name, err)
+		p.newError(file.Name, err)
 	}
 }
 
@@ -636,6 +947,7 @@ func (p *rwFolder) deleteDir(file protocol.FileInfo) {
 		p.dbUpdates <- file
 	} else {
 		l.Infof("Puller (folder %q, dir %q): delete: %v", p.folder, file.Name, err)
+		p.newError(file.Name, err)
 	}
 }
 
@@ -675,6 +987,7 @@ func (p *rwFolder) deleteFile(file protocol.FileInfo) {
 
 	if err != nil && !os.IsNotExist(err) {
 		l.Infof("Puller (folder %q, file %q): delete: %v", p.folder, file.Name, err)
+		p.newError(file.Name, err)
 	} else {
 		p.dbUpdates <- file
 	}
@@ -713,7 +1026,7 @@ func (p *rwFolder) renameFile(source, target protocol.FileInfo) {
 		})
 	}()
 
-	if debug {
+	if debug.On() {
 		l.Debugln(p, "taking rename shortcut", source.Name, "->", target.Name)
 	}
 
@@ -739,6 +1052,7 @@ func (p *rwFolder) renameFile(source, target protocol.FileInfo) {
 		err = p.shortcutFile(target)
 		if err != nil {
 			l.Infof("Puller (folder %q, file %q): rename from %q metadata: %v", p.folder, target.Name, source.Name, err)
+			p.newError(target.Name, err)
 			return
 		}
 	} else {
@@ -749,6 +1063,7 @@ func (p *rwFolder) renameFile(source, target protocol.FileInfo) {
 		err = osutil.InWritableDir(osutil.Remove, from)
 		if err != nil {
 			l.Infof("Puller (folder %q, file %q): delete %q after failed rename: %v", p.folder, target.Name, source.Name, err)
+			p.newError(source.Name, err)
 			return
 		}
 
@@ -772,7 +1087,7 @@ func (p *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 		// We are supposed to copy the entire file, and then fetch nothing. We
 		// are only updating metadata, so we don't actually *need* to make the
 		// copy.
-		if debug {
+		if debug.On() {
 			l.Debugln(p, "taking shortcut on", file.Name)
 		}
 		p.queue.Done(file.Name)
@@ -782,6 +1097,9 @@ func (p *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 		} else {
 			err = p.shortcutFile(file)
 		}
+		if err != nil {
+			p.newError(file.Name, err)
+		}
 		events.Default.Log(events.ItemFinished, map[string]interface{}{
 			"folder": p.folder,
 			"item":   file.Name,
@@ -800,10 +1118,11 @@ func (p *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 
 	reused := 0
 	var blocks []protocol.BlockInfo
+	written := make([]protocol.BlockInfo, len(file.Blocks))
 
 	// Check for an old temporary file which might have some blocks we could
 	// reuse.
-	tempBlocks, err := scanner.HashFile(tempName, protocol.BlockSize)
+	tempBlocks, err := p.tempFileBlocks(file.Name, tempName)
 	if err == nil {
 		// Check for any reusable blocks in the temp file
 		tempCopyBlocks, _ := scanner.BlockDiff(tempBlocks, file.Blocks)
@@ -815,10 +1134,12 @@ func (p *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 		}
 
 		// Since the blocks are already there, we don't need to get them.
-		for _, block := range file.Blocks {
+		for i, block := range file.Blocks {
 			_, ok := existingBlocks[block.String()]
 			if !ok {
 				blocks = append(blocks, block)
+			} else {
+				written[i] = block
 			}
 		}
 
@@ -845,10 +1166,11 @@ func (p *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 		reused:      reused,
 		ignorePerms: p.ignorePerms,
 		version:     curFile.Version,
+		written:     written,
 		mut:         sync.NewMutex(),
 	}
 
-	if debug {
+	if debug.On() {
 		l.Debugf("%v need file %s; copy %d, reused %v", p, file.Name, len(blocks), reused)
 	}
 
@@ -859,6 +1181,24 @@ func (p *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 	copyChan <- cs
 }
 
+// tempFileBlocks returns the blocks in the temporary file of the given file.
+// They are known if an earlier transfer of the file was interrupted, and
+// otherwise found by hashing the temporary file.
+func (p *rwFolder) tempFileBlocks(name, tempName string) ([]protocol.BlockInfo, error) {
+	info, err := os.Stat(tempName)
+	if err != nil {
+		p.tempBlockRepo.Remove(name)
+		return nil, err
+	}
+	if blocks, ok := p.tempBlockRepo.Get(name, info.Size(), info.ModTime().Unix()); ok {
+		if debug.On() {
+			l.Debugf("%v resuming %s from recorded blocks", p, name)
+		}
+		return blocks, nil
+	}
+	return scanner.HashFile(tempName, protocol.BlockSize)
+}
+
 // shortcutFile sets file mode and modification time, when that's the only
 // thing that has changed.
 func (p *rwFolder) shortcutFile(file protocol.FileInfo) error {
@@ -871,15 +1211,9 @@ func (p *rwFolder) shortcutFile(file protocol.FileInfo) error {
 	}
 
 	t := time.Unix(file.Modified, 0)
-	if err := os.Chtimes(realName, t, t); err != nil {
-		// Try using virtual mtimes
-		info, err := os.Stat(realName)
-		if err != nil {
-			l.Infof("Puller (folder %q, file %q): shortcut: unable to stat file: %v", p.folder, file.Name, err)
-			return err
-		}
-
-		p.virtualMtimeRepo.UpdateMtime(file.Name, info.ModTime(), t)
+	if err := p.setMtime(file.Name, realName, t); err != nil {
+		l.Infof("Puller (folder %q, file %q): shortcut: unable to stat file: %v", p.folder, file.Name, err)
+		return err
 	}
 
 	// This may have been a conflict. We should merge the version vectors so
@@ -929,6 +1263,12 @@ func (p *rwFolder) copierRoutine(in <-chan copyBlocksState, pullChan chan<- pull
 		p.model.fmut.RUnlock()
 
 		for _, block := range state.blocks {
+			if p.stopping() {
+				state.fail("copy", errStopping)
+				break
+			}
+
+			p.model.cpuLimiter.Wait()
 			buf = buf[:int(block.Size)]
 			found := p.model.finder.Iterate(block.Hash, func(folder, file string, index int32) bool {
 				fd, err := os.Open(filepath.Join(folderRoots[folder], file))
@@ -945,14 +1285,14 @@ func (p *rwFolder) copierRoutine(in <-chan copyBlocksState, pullChan chan<- pull
 				hash, err := scanner.VerifyBuffer(buf, block)
 				if err != nil {
 					if hash != nil {
-						if debug {
+						if debug.On() {
 							l.Debugf("Finder block mismatch in %s:%s:%d expected %q got %q", folder, file, index, block.Hash, hash)
 						}
 						err = p.model.finder.Fix(folder, file, index, block.Hash, hash)
 						if err != nil {
 							l.Warnln("finder fix:", err)
 						}
-					} else if debug {
+					} else if debug.On() {
 						l.Debugln("Finder failed to verify buffer", err)
 					}
 					return false
@@ -961,6 +1301,9 @@ func (p *rwFolder) copierRoutine(in <-chan copyBlocksState, pullChan chan<- pull
 				_, err = dstFd.WriteAt(buf, block.Offset)
 				if err != nil {
 					state.fail("dst write", err)
+				} else {
+					state.blockWritten(block)
+					p.pullRate.add(int64(block.Size), time.Now())
 				}
 				if file == state.file.Name {
 					state.copiedFromOrigin()
@@ -992,6 +1335,11 @@ func (p *rwFolder) pullerRoutine(in <-chan pullBlockState, out chan<- *sharedPul
 		if state.failed() != nil {
 			continue
 		}
+		if p.stopping() {
+			state.fail("pull", errStopping)
+			out <- state.sharedPullerState
+			continue
+		}
 
 		// Get an fd to the temporary file. Technically we don't need it until
 		// after fetching the block, but if we run into an error here there is
@@ -1001,6 +1349,12 @@ func (p *rwFolder) pullerRoutine(in <-chan pullBlockState, out chan<- *sharedPul
 			continue
 		}
 
+		p.model.cpuLimiter.Wait()
+
+		if p.model.pullerSlots != nil {
+			p.model.pullerSlots <- struct{}{}
+		}
+
 		var lastError error
 		potentialDevices := p.model.Availability(p.folder, state.file.Name)
 		for {
@@ -1040,10 +1394,16 @@ func (p *rwFolder) pullerRoutine(in <-chan pullBlockState, out chan<- *sharedPul
 			if err != nil {
 				state.fail("save", err)
 			} else {
+				state.blockWritten(state.block)
+				p.pullRate.add(int64(state.block.Size), time.Now())
 				state.pullDone()
 			}
 			break
 		}
+
+		if p.model.pullerSlots != nil {
+			<-p.model.pullerSlots
+		}
 		out <- state.sharedPullerState
 	}
 }
@@ -1051,12 +1411,16 @@ func (p *rwFolder) pullerRoutine(in <-chan pullBlockState, out chan<- *sharedPul
 func (p *rwFolder) performFinish(state *sharedPullerState) {
 	var err error
 	defer func() {
+		if err != nil {
+			p.newError(state.file.Name, err)
+		}
 		events.Default.Log(events.ItemFinished, map[string]interface{}{
 			"folder": p.folder,
 			"item":   state.file.Name,
 			"error":  err,
 			"type":   "file",
 			"action": "update",
+			"size":   state.file.Size(),
 		})
 	}()
 
@@ -1071,14 +1435,8 @@ func (p *rwFolder) performFinish(state *sharedPullerState) {
 
 	// Set the correct timestamp on the new file
 	t := time.Unix(state.file.Modified, 0)
-	err = os.Chtimes(state.tempName, t, t)
-	if err != nil {
-		// First try using virtual mtimes
-		if info, err := os.Stat(state.tempName); err != nil {
-			l.Infof("Puller (folder %q, file %q): final: unable to stat file: %v", p.folder, state.file.Name, err)
-		} else {
-			p.virtualMtimeRepo.UpdateMtime(state.file.Name, info.ModTime(), t)
-		}
+	if err := p.setMtime(state.file.Name, state.tempName, t); err != nil {
+		l.Infof("Puller (folder %q, file %q): final: unable to stat file: %v", p.folder, state.file.Name, err)
 	}
 
 	if p.inConflict(state.version, state.file.Version) {
@@ -1133,6 +1491,11 @@ func (p *rwFolder) performFinish(state *sharedPullerState) {
 		}
 	}
 
+	if p.placeholders {
+		// The content has been fetched, replacing the placeholder
+		p.placeholderRepo.Remove(state.file.Name)
+	}
+
 	// Record the updated file in the index
 	p.dbUpdates <- state.file
 }
@@ -1140,18 +1503,32 @@ func (p *rwFolder) performFinish(state *sharedPullerState) {
 func (p *rwFolder) finisherRoutine(in <-chan *sharedPullerState) {
 	for state := range in {
 		if closed, err := state.finalClose(); closed {
-			if debug {
+			if debug.On() {
 				l.Debugln(p, "closing", state.file.Name)
 			}
 			if err != nil {
 				l.Warnln("Puller: final:", err)
+				p.newError(state.file.Name, err)
 				continue
 			}
 
 			p.queue.Done(state.file.Name)
 			if state.failed() == nil {
+				p.tempBlockRepo.Remove(state.file.Name)
 				p.performFinish(state)
+				p.model.folderStatRef(p.folder).AddTransferred(state.file.Size(), 0)
+			} else if state.failed() == errStopping {
+				// The temporary file is left in place, for the blocks in it
+				// to be reused the next time around.
+				p.checkpoint(state)
+				if debug.On() {
+					l.Debugln(p, "checkpointed", state.file.Name)
+				}
 			} else {
+				// Likewise when the transfer failed, for example because the
+				// connection was lost.
+				p.checkpoint(state)
+				p.newError(state.file.Name, state.failed())
 				events.Default.Log(events.ItemFinished, map[string]interface{}{
 					"folder": p.folder,
 					"item":   state.file.Name,
@@ -1168,6 +1545,16 @@ func (p *rwFolder) finisherRoutine(in <-chan *sharedPullerState) {
 	}
 }
 
+// checkpoint records the blocks written to the temporary file of a failed
+// transfer, so that the next attempt requests only the missing ones.
+func (p *rwFolder) checkpoint(state *sharedPullerState) {
+	info, err := os.Stat(state.tempName)
+	if err != nil {
+		return
+	}
+	p.tempBlockRepo.Put(state.file.Name, info.Size(), info.ModTime().Unix(), state.writtenBlocks())
+}
+
 // Moves the given filename to the front of the job queue
 func (p *rwFolder) BringToFront(filename string) {
 	p.queue.BringToFront(filename)
@@ -1181,6 +1568,58 @@ func (p *rwFolder) DelayScan(next time.Duration) {
 	p.delayScan <- next
 }
 
+// Errors returns the items that failed during the last puller iteration,
+// sorted by path.
+func (p *rwFolder) Errors() []FileError {
+	p.errorsMut.Lock()
+	errors := make([]FileError, 0, len(p.errors))
+	for path, err := range p.errors {
+		errors = append(errors, FileError{Path: path, Err: err})
+	}
+	p.errorsMut.Unlock()
+	sort.Sort(fileErrorList(errors))
+	return errors
+}
+
+// Retry schedules a pull as soon as possible, handling the given items
+// before any others.
+func (p *rwFolder) Retry(items []string) {
+	p.errorsMut.Lock()
+	p.retryItems = append(p.retryItems, items...)
+	p.errorsMut.Unlock()
+	p.IndexUpdated()
+}
+
+// Fetch schedules a pull as soon as possible, replacing the placeholders for
+// the given items by their content.
+func (p *rwFolder) Fetch(items []string) {
+	p.errorsMut.Lock()
+	for _, item := range items {
+		p.fetchItems[item] = true
+	}
+	p.errorsMut.Unlock()
+	p.IndexUpdated()
+}
+
+func (p *rwFolder) newError(path string, err error) {
+	p.errorsMut.Lock()
+	defer p.errorsMut.Unlock()
+
+	// We might get more than one error report for a file (i.e. error on
+	// Write() followed by Close()); we keep the first error as that is
+	// probably closer to the root cause.
+	if _, ok := p.errors[path]; ok {
+		return
+	}
+	p.errors[path] = err.Error()
+}
+
+func (p *rwFolder) clearErrors() {
+	p.errorsMut.Lock()
+	p.errors = make(map[string]string)
+	p.errorsMut.Unlock()
+}
+
 // dbUpdaterRoutine aggregates db updates and commits them in batches no
 // larger than 1000 items, and no more delayed than 2 seconds.
 func (p *rwFolder) dbUpdaterRoutine() {
@@ -1203,6 +1642,9 @@ loop:
 
 			file.LocalVersion = 0
 			batch = append(batch, file)
+			if file.IsDeleted() && p.deleteDelay > 0 {
+				p.pendingDeletes.Remove(file.Name)
+			}
 
 			if len(batch) == maxBatchSize {
 				p.model.updateLocals(p.folder, batch)
@@ -1261,7 +1703,7 @@ func removeDevice(devices []protocol.DeviceID, device protocol.DeviceID) []proto
 func moveForConflict(name string) error {
 	ext := filepath.Ext(name)
 	withoutExt := name[:len(name)-len(ext)]
-	newName := withoutExt + time.Now().Format(".sync-conflict-20060102-150405") + ext
+	newName := withoutExt + ".sync-conflict-" + time.Now().Format(conflictTimeFormat) + ext
 	err := os.Rename(name, newName)
 	if os.IsNotExist(err) {
 		// We were supposed to move a file away but it does not exist. Either
@@ -1272,3 +1714,156 @@ func moveForConflict(name string) error {
 	}
 	return err
 }
+
+// A FileError is an error that occurred while syncing a specific item.
+type FileError struct {
+	Path string `json:"path"`
+	Err  string `json:"error"`
+}
+
+type fileErrorList []FileError
+
+func (l fileErrorList) Less(a, b int) bool {
+	return l[a].Path < l[b].Path
+}
+
+func (l fileErrorList) Swap(a, b int) {
+	l[a], l[b] = l[b], l[a]
+}
+
+func (l fileErrorList) Len() int {
+	return len(l)
+}
+
+// wantsPlaceholder returns true if the given needed file should be handled by
+// creating a placeholder: it's a file whose content we don't have, that
+// hasn't been asked for, and there is nothing but possibly an older
+// placeholder in its place.
+func (p *rwFolder) wantsPlaceholder(file protocol.FileInfo) bool {
+	if !p.placeholders || file.IsSymlink() {
+		return false
+	}
+
+	if cur, ok := p.model.CurrentFolderFile(p.folder, file.Name); ok && !cur.IsDeleted() && !cur.IsInvalid() {
+		// We have the content of a previous version, so keep it current.
+		return false
+	}
+
+	p.errorsMut.Lock()
+	fetch := p.fetchItems[file.Name]
+	delete(p.fetchItems, file.Name)
+	p.errorsMut.Unlock()
+	if fetch {
+		return false
+	}
+
+	info, err := osutil.Lstat(filepath.Join(p.dir, file.Name))
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	// Don't overwrite a file that isn't a placeholder, whatever its mtime.
+	return info.Mode().IsRegular() && info.Size() == 0 && p.placeholderRepo.IsPlaceholder(file.Name, 0, info.ModTime().Unix())
+}
+
+// handlePlaceholder creates or updates the placeholder for the given file. It
+// returns false if the placeholder was already up to date.
+func (p *rwFolder) handlePlaceholder(file protocol.FileInfo) bool {
+	realName := filepath.Join(p.dir, file.Name)
+
+	if cur, ok := p.model.CurrentFolderFile(p.folder, file.Name); ok && cur.IsInvalid() && cur.Version.Equal(file.Version) {
+		if _, err := osutil.Lstat(realName); err == nil {
+			return false
+		}
+	}
+
+	var err error
+	events.Default.Log(events.ItemStarted, map[string]interface{}{
+		"folder": p.folder,
+		"item":   file.Name,
+		"type":   "file",
+		"action": "placeholder",
+	})
+
+	defer func() {
+		events.Default.Log(events.ItemFinished, map[string]interface{}{
+			"folder": p.folder,
+			"item":   file.Name,
+			"error":  err,
+			"type":   "file",
+			"action": "placeholder",
+		})
+	}()
+
+	mode := os.FileMode(file.Flags & 0777)
+	if p.ignorePerms {
+		mode = 0644
+	}
+
+	tempName := filepath.Join(p.dir, defTempNamer.TempName(file.Name))
+	fd, err := os.OpenFile(tempName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		l.Infof("Puller (folder %q, file %q): placeholder: %v", p.folder, file.Name, err)
+		p.newError(file.Name, err)
+		return true
+	}
+	fd.Close()
+
+	t := time.Unix(file.Modified, 0)
+	os.Chtimes(tempName, t, t)
+	info, err := os.Stat(tempName)
+	if err == nil {
+		err = osutil.InWritableDir(func(path string) error {
+			return osutil.Rename(tempName, path)
+		}, realName)
+	}
+	if err != nil {
+		os.Remove(tempName)
+		l.Infof("Puller (folder %q, file %q): placeholder: %v", p.folder, file.Name, err)
+		p.newError(file.Name, err)
+		return true
+	}
+	p.placeholderRepo.Add(file.Name, info.ModTime().Unix())
+
+	// The file is in the index as invalid, as we can't serve its content
+	// to other devices.
+	p.dbUpdates <- protocol.FileInfo{
+		Name:     file.Name,
+		Flags:    file.Flags | protocol.FlagInvalid,
+		Modified: file.Modified,
+		Version:  file.Version,
+	}
+	return true
+}
+
+// removeDeletedPlaceholders removes the placeholders for files that have
+// been deleted. As we never had the content, the deletions aren't needed as
+// such and won't otherwise be handled.
+func (p *rwFolder) removeDeletedPlaceholders(folderFiles *db.FileSet) {
+	var deleted []protocol.FileInfo
+	folderFiles.WithHaveTruncated(protocol.LocalDeviceID, func(intf db.FileIntf) bool {
+		f := intf.(db.FileInfoTruncated)
+		if !f.IsInvalid() || f.IsDirectory() || f.IsSymlink() {
+			return true
+		}
+		gf, ok := folderFiles.GetGlobal(f.Name)
+		if !ok || !gf.IsDeleted() {
+			return true
+		}
+		realName := filepath.Join(p.dir, f.Name)
+		info, err := osutil.Lstat(realName)
+		if err != nil || !p.placeholderRepo.IsPlaceholder(f.Name, info.Size(), info.ModTime().Unix()) {
+			return true
+		}
+		if err := osutil.InWritableDir(osutil.Remove, realName); err != nil {
+			l.Infof("Puller (folder %q, file %q): placeholder: %v", p.folder, f.Name, err)
+			return true
+		}
+		deleted = append(deleted, gf)
+		return true
+	})
+
+	for _, gf := range deleted {
+		p.placeholderRepo.Remove(gf.Name)
+		p.dbUpdates <- gf
+	}
+}
@@ -7,13 +7,21 @@
 package model
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/events"
+	"github.com/syncthing/syncthing/internal/ignore"
 	"github.com/syncthing/syncthing/internal/scanner"
+	"github.com/syncthing/syncthing/internal/sync"
 
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/storage"
@@ -46,6 +54,12 @@ var blocks = []protocol.BlockInfo{
 // 02005008 - Existing file (currently in the index)
 // 02340070 - Temp file on the disk
 
+// testTempBlockRepo returns the temp block repo of the default folder. The
+// tests below shadow the db package.
+func testTempBlockRepo(m *Model) *db.TempBlockRepo {
+	return db.NewTempBlockRepo(m.db, "default")
+}
+
 func TestHandleFile(t *testing.T) {
 	// After the diff between required and existing we should:
 	// Copy: 2, 5, 8
@@ -73,9 +87,11 @@ func TestHandleFile(t *testing.T) {
 	m.updateLocals("default", []protocol.FileInfo{existingFile})
 
 	p := rwFolder{
-		folder: "default",
-		dir:    "testdata",
-		model:  m,
+		folder:        "default",
+		dir:           "testdata",
+		model:         m,
+		tempBlockRepo: testTempBlockRepo(m),
+		pullRate:      newRateMeter(),
 	}
 
 	copyChan := make(chan copyBlocksState, 1)
@@ -127,9 +143,11 @@ func TestHandleFileWithTemp(t *testing.T) {
 	m.updateLocals("default", []protocol.FileInfo{existingFile})
 
 	p := rwFolder{
-		folder: "default",
-		dir:    "testdata",
-		model:  m,
+		folder:        "default",
+		dir:           "testdata",
+		model:         m,
+		tempBlockRepo: testTempBlockRepo(m),
+		pullRate:      newRateMeter(),
 	}
 
 	copyChan := make(chan copyBlocksState, 1)
@@ -150,6 +168,59 @@ func TestHandleFileWithTemp(t *testing.T) {
 	}
 }
 
+func TestHandleFileWithRecordedTemp(t *testing.T) {
+	// The blocks recorded for an interrupted transfer are trusted instead
+	// of hashing the temp file, as long as it hasn't changed since.
+
+	file := protocol.FileInfo{
+		Name:   "file",
+		Blocks: blocks[1:],
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(defaultFolderConfig)
+
+	p := rwFolder{
+		folder:        "default",
+		dir:           "testdata",
+		model:         m,
+		tempBlockRepo: testTempBlockRepo(m),
+		pullRate:      newRateMeter(),
+	}
+
+	info, err := os.Stat(filepath.Join("testdata", defTempNamer.TempName("file")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := make([]protocol.BlockInfo, len(file.Blocks))
+	written[2] = file.Blocks[2]
+	written[6] = file.Blocks[6]
+	p.tempBlockRepo.Put("file", info.Size(), info.ModTime().Unix(), written)
+
+	copyChan := make(chan copyBlocksState, 1)
+	p.handleFile(file, copyChan, nil)
+	toCopy := <-copyChan
+
+	if len(toCopy.blocks) != 6 || toCopy.reused != 2 {
+		t.Fatalf("Unexpected count of copy blocks %d and reused blocks %d", len(toCopy.blocks), toCopy.reused)
+	}
+	for i, eq := range []int{1, 2, 4, 5, 6, 8} {
+		if string(toCopy.blocks[i].Hash) != string(blocks[eq].Hash) {
+			t.Errorf("Block mismatch: %s != %s", toCopy.blocks[i].String(), blocks[eq].String())
+		}
+	}
+
+	// A changed temp file is hashed instead.
+	p.tempBlockRepo.Put("file", info.Size(), info.ModTime().Unix()-1, written)
+	p.handleFile(file, copyChan, nil)
+	toCopy = <-copyChan
+
+	if len(toCopy.blocks) != 4 {
+		t.Errorf("Unexpected count of copy blocks after hashing: %d != 4", len(toCopy.blocks))
+	}
+}
+
 func TestCopierFinder(t *testing.T) {
 	// After diff between required and existing we should:
 	// Copy: 1, 2, 3, 4, 6, 7, 8
@@ -198,9 +269,11 @@ func TestCopierFinder(t *testing.T) {
 	}
 
 	p := rwFolder{
-		folder: "default",
-		dir:    "testdata",
-		model:  m,
+		folder:        "default",
+		dir:           "testdata",
+		model:         m,
+		tempBlockRepo: testTempBlockRepo(m),
+		pullRate:      newRateMeter(),
 	}
 
 	copyChan := make(chan copyBlocksState)
@@ -332,9 +405,11 @@ func TestLastResortPulling(t *testing.T) {
 	}
 
 	p := rwFolder{
-		folder: "default",
-		dir:    "testdata",
-		model:  m,
+		folder:        "default",
+		dir:           "testdata",
+		model:         m,
+		tempBlockRepo: testTempBlockRepo(m),
+		pullRate:      newRateMeter(),
 	}
 
 	copyChan := make(chan copyBlocksState)
@@ -388,8 +463,11 @@ func TestDeregisterOnFailInCopy(t *testing.T) {
 		folder:          "default",
 		dir:             "testdata",
 		model:           m,
+		tempBlockRepo:   testTempBlockRepo(m),
 		queue:           newJobQueue(),
 		progressEmitter: emitter,
+		errors:          make(map[string]string),
+		errorsMut:       sync.NewMutex(),
 	}
 
 	// queue.Done should be called by the finisher routine
@@ -440,6 +518,10 @@ func TestDeregisterOnFailInCopy(t *testing.T) {
 			t.Fatal("Still registered", len(p.progressEmitter.registry), len(p.queue.progress), len(p.queue.queued))
 		}
 
+		if errs := p.Errors(); len(errs) != 1 || errs[0].Path != "filex" {
+			t.Fatal("Expected a recorded error for filex, got", errs)
+		}
+
 		// Doing it again should have no effect
 		finisherChan <- state
 		time.Sleep(100 * time.Millisecond)
@@ -475,8 +557,11 @@ func TestDeregisterOnFailInPull(t *testing.T) {
 		folder:          "default",
 		dir:             "testdata",
 		model:           m,
+		tempBlockRepo:   testTempBlockRepo(m),
 		queue:           newJobQueue(),
 		progressEmitter: emitter,
+		errors:          make(map[string]string),
+		errorsMut:       sync.NewMutex(),
 	}
 
 	// queue.Done should be called by the finisher routine
@@ -531,3 +616,392 @@ func TestDeregisterOnFailInPull(t *testing.T) {
 		t.Fatal("Didn't get anything to the finisher")
 	}
 }
+
+func TestCheckDestination(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	p := rwFolder{
+		folder:   "default",
+		dir:      dir,
+		fsIDRepo: db.NewFilesystemIDRepo(ldb, "default"),
+	}
+
+	if err := p.checkDestination(); err != nil {
+		t.Fatal(err)
+	}
+	if fds, _ := ioutil.ReadDir(dir); len(fds) != 0 {
+		t.Error("write test file left behind")
+	}
+
+	if id, ok := p.fsIDRepo.Get(dir); ok {
+		// The recorded ID outlives the folder; a folder started anew on
+		// another filesystem is caught at its first pull.
+		db.NewFilesystemIDRepo(ldb, "default").Put(dir, id+1)
+		p2 := rwFolder{
+			folder:   "default",
+			dir:      dir,
+			fsIDRepo: db.NewFilesystemIDRepo(ldb, "default"),
+		}
+		if err := p2.checkDestination(); err != errFilesystemChanged {
+			t.Errorf("unexpected error %v for another filesystem", err)
+		}
+		p.fsIDRepo.Put(dir, id)
+	}
+
+	os.RemoveAll(dir)
+	if err := p.checkDestination(); err == nil {
+		t.Error("missing folder path accepted")
+	}
+}
+
+func TestPlaceholders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "placeholders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := defaultFolderConfig
+	cfg.RawPath = dir
+	cfg.Placeholders = true
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(cfg)
+
+	file := protocol.FileInfo{
+		Name:     "file",
+		Flags:    0644,
+		Modified: 1234567890,
+		Version:  protocol.Vector{{ID: 1, Value: 1}},
+		Blocks:   blocks[1:],
+	}
+	m.folderFiles["default"].Update(device1, []protocol.FileInfo{file})
+
+	p := newRWFolder(m, 0, cfg)
+	if changed := p.pullerIteration(ignore.New(false)); changed != 1 {
+		t.Fatalf("%d changed, expected 1", changed)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 || info.ModTime().Unix() != file.Modified {
+		t.Errorf("Unexpected placeholder size %d, mtime %v", info.Size(), info.ModTime())
+	}
+	if cur, ok := m.CurrentFolderFile("default", "file"); !ok || !cur.IsInvalid() || !cur.Version.Equal(file.Version) {
+		t.Errorf("Unexpected index entry %v for placeholder", cur)
+	}
+
+	// The placeholder is up to date, so nothing should happen.
+	if changed := p.pullerIteration(ignore.New(false)); changed != 0 {
+		t.Errorf("%d changed, expected 0", changed)
+	}
+
+	// A deleted file takes its placeholder with it.
+	file.Flags |= protocol.FlagDeleted
+	file.Blocks = nil
+	file.Version = protocol.Vector{{ID: 1, Value: 2}}
+	m.folderFiles["default"].Update(device1, []protocol.FileInfo{file})
+	p.pullerIteration(ignore.New(false))
+
+	if _, err := os.Stat(filepath.Join(dir, "file")); !os.IsNotExist(err) {
+		t.Error("Placeholder of deleted file not removed:", err)
+	}
+}
+
+func TestDeleteWindow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deletewindow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := defaultFolderConfig
+	cfg.RawPath = dir
+	cfg.DeleteDelayH = 1
+	if err := cfg.CreateMarker(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(cfg)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file := protocol.FileInfo{
+		Name:    "file",
+		Flags:   0644,
+		Version: protocol.Vector{{ID: 1, Value: 1}},
+		Blocks:  blocks[1:],
+	}
+	m.folderFiles["default"].Update(protocol.LocalDeviceID, []protocol.FileInfo{file})
+
+	file.Flags |= protocol.FlagDeleted
+	file.Blocks = nil
+	file.Version = protocol.Vector{{ID: 1, Value: 2}}
+	m.folderFiles["default"].Update(device1, []protocol.FileInfo{file})
+
+	p := newRWFolder(m, 0, cfg)
+	if changed := p.pullerIteration(ignore.New(false)); changed != 0 {
+		t.Fatalf("%d changed, expected 0", changed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "file")); err != nil {
+		t.Fatal("File deleted within the delete window:", err)
+	}
+	if d := p.deletesDue.Sub(time.Now()); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("Deletion due in %v, expected an hour", d)
+	}
+
+	// Once the window has passed the deletion is applied.
+	p.pendingDeletes.Remove("file")
+	p.pendingDeletes.Since("file", file.Version, time.Now().Add(-2*time.Hour))
+	if changed := p.pullerIteration(ignore.New(false)); changed != 1 {
+		t.Fatalf("%d changed, expected 1", changed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "file")); !os.IsNotExist(err) {
+		t.Error("File not deleted after the delete window:", err)
+	}
+	if !p.deletesDue.IsZero() {
+		t.Error("Unexpected deletion due at", p.deletesDue)
+	}
+}
+
+func TestSnapshotBeforeDeletion(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the snapshot command is a shell script")
+	}
+
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	folderDir := filepath.Join(dir, "folder")
+	os.Mkdir(folderDir, 0755)
+
+	cmd := filepath.Join(dir, "snapshot.sh")
+	script := "#!/bin/sh\necho \"$1 $2\" > " + filepath.Join(dir, "args") + "\n[ -e " + filepath.Join(dir, "fail") + " ] && exit 1\necho snap-1\n"
+	if err := ioutil.WriteFile(cmd, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := defaultFolderConfig
+	cfg.RawPath = folderDir
+	cfg.SnapshotCommand = cmd
+	if err := cfg.CreateMarker(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(cfg)
+
+	if err := ioutil.WriteFile(filepath.Join(folderDir, "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file := protocol.FileInfo{
+		Name:    "file",
+		Flags:   0644,
+		Version: protocol.Vector{{ID: 1, Value: 1}},
+		Blocks:  blocks[1:],
+	}
+	m.folderFiles["default"].Update(protocol.LocalDeviceID, []protocol.FileInfo{file})
+
+	file.Flags |= protocol.FlagDeleted
+	file.Blocks = nil
+	file.Version = protocol.Vector{{ID: 1, Value: 2}}
+	m.folderFiles["default"].Update(device1, []protocol.FileInfo{file})
+
+	sub := events.Default.Subscribe(events.FolderSnapshot)
+	defer events.Default.Unsubscribe(sub)
+
+	// Without a snapshot, nothing is deleted.
+	ioutil.WriteFile(filepath.Join(dir, "fail"), nil, 0644)
+	p := newRWFolder(m, 0, cfg)
+	if changed := p.pullerIteration(ignore.New(false)); changed != 0 {
+		t.Fatalf("%d changed, expected 0", changed)
+	}
+	if _, err := os.Stat(filepath.Join(folderDir, "file")); err != nil {
+		t.Fatal("File deleted without a snapshot:", err)
+	}
+	if errs := p.Errors(); len(errs) != 1 || errs[0].Path != "file" {
+		t.Error("Expected file to fail, got", errs)
+	}
+	if ev, err := sub.Poll(time.Second); err != nil || ev.Data.(map[string]interface{})["error"] == nil {
+		t.Error("Expected a failed snapshot event, got", ev, err)
+	}
+
+	// Nor by the next iteration of the same pull, which doesn't run the
+	// command again.
+	os.Remove(filepath.Join(dir, "args"))
+	os.Remove(filepath.Join(dir, "fail"))
+	if changed := p.pullerIteration(ignore.New(false)); changed != 0 {
+		t.Fatalf("%d changed, expected 0", changed)
+	}
+	if _, err := os.Stat(filepath.Join(folderDir, "file")); err != nil {
+		t.Fatal("File deleted without a snapshot:", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "args")); !os.IsNotExist(err) {
+		t.Error("Snapshot command run again in the same pull")
+	}
+
+	p = newRWFolder(m, 0, cfg)
+	if changed := p.pullerIteration(ignore.New(false)); changed != 1 {
+		t.Fatalf("%d changed, expected 1", changed)
+	}
+	if _, err := os.Stat(filepath.Join(folderDir, "file")); !os.IsNotExist(err) {
+		t.Error("File not deleted after the snapshot:", err)
+	}
+	if args, _ := ioutil.ReadFile(filepath.Join(dir, "args")); string(args) != folderDir+" 1\n" {
+		t.Errorf("Unexpected snapshot command arguments %q", args)
+	}
+	if ev, err := sub.Poll(time.Second); err != nil || ev.Data.(map[string]interface{})["snapshot"] != "snap-1" {
+		t.Error("Expected a snapshot event, got", ev, err)
+	}
+}
+
+func TestSnapshotTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the snapshot command is a shell script")
+	}
+
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cmd := filepath.Join(dir, "snapshot.sh")
+	if err := ioutil.WriteFile(cmd, []byte("#!/bin/sh\nexec sleep 10\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(timeout time.Duration) {
+		snapshotTimeout = timeout
+	}(snapshotTimeout)
+	snapshotTimeout = 100 * time.Millisecond
+
+	p := rwFolder{folder: "default", dir: dir, snapshotCommand: cmd}
+	t0 := time.Now()
+	if err := p.snapshot(1); err == nil {
+		t.Error("Unexpected snapshot from a command that didn't finish")
+	}
+	if d := time.Since(t0); d > 5*time.Second {
+		t.Errorf("Snapshot took %v, expected to time out after %v", d, snapshotTimeout)
+	}
+}
+
+func TestMaxQueued(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maxqueued")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := defaultFolderConfig
+	cfg.RawPath = dir
+	if err := cfg.CreateMarker(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(cfg)
+
+	// Five files we have, deleted by the other device.
+	var local, remote []protocol.FileInfo
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("file%d", i)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		file := protocol.FileInfo{
+			Name:    name,
+			Flags:   0644,
+			Version: protocol.Vector{{ID: 1, Value: 1}},
+			Blocks:  blocks[1:],
+		}
+		local = append(local, file)
+		file.Flags |= protocol.FlagDeleted
+		file.Blocks = nil
+		file.Version = protocol.Vector{{ID: 1, Value: 2}}
+		remote = append(remote, file)
+	}
+	m.folderFiles["default"].Update(protocol.LocalDeviceID, local)
+	m.folderFiles["default"].Update(device1, remote)
+
+	p := newRWFolder(m, 0, cfg)
+	p.maxQueued = 2
+	for _, exp := range []int{2, 2, 1} {
+		if changed := p.pullerIteration(ignore.New(false)); changed != exp {
+			t.Fatalf("%d changed, expected %d", changed, exp)
+		}
+		if p.queueFull != (exp == p.maxQueued) {
+			t.Errorf("queueFull %v after %d changes", p.queueFull, exp)
+		}
+	}
+	if need, _ := m.NeedSize("default"); need != 0 {
+		t.Errorf("%d items still needed", need)
+	}
+}
+
+func TestPullWithoutMarker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "marker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := defaultFolderConfig
+	cfg.RawPath = dir
+	if err := cfg.CreateMarker(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(cfg)
+
+	// A copy of a file we have, which needs nothing from the other device.
+	if err := ioutil.WriteFile(filepath.Join(dir, "original"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fileBlocks, err := scanner.Blocks(strings.NewReader("content"), protocol.BlockSize, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := protocol.FileInfo{
+		Name:    "original",
+		Flags:   0644,
+		Version: protocol.Vector{{ID: 1, Value: 1}},
+		Blocks:  fileBlocks,
+	}
+	m.updateLocals("default", []protocol.FileInfo{file})
+	file.Name = "copy"
+	m.folderFiles["default"].Update(device1, []protocol.FileInfo{file})
+
+	// Nothing is written into a folder without its marker.
+	os.Remove(cfg.MarkerPath())
+	p := newRWFolder(m, 0, cfg)
+	p.pullerIteration(ignore.New(false))
+	if _, err := os.Stat(filepath.Join(dir, "copy")); !os.IsNotExist(err) {
+		t.Fatal("File pulled without the marker:", err)
+	}
+
+	if err := cfg.CreateMarker(); err != nil {
+		t.Fatal(err)
+	}
+	p.pullerIteration(ignore.New(false))
+	if _, err := os.Stat(filepath.Join(dir, "copy")); err != nil {
+		t.Error("File not pulled with the marker:", err)
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/events"
+)
+
+// hashRequestOption is set on a Request message to ask for the SHA-256
+// digests of the blocks in the requested range instead of the data. The
+// response is the digests concatenated, one for each protocol.BlockSize
+// block (the last may be shorter). Only sent to devices announcing
+// featureHashRequest.
+const hashRequestOption = "hashes"
+
+// maxHashRequestBlocks limits the number of blocks hashed per request.
+const maxHashRequestBlocks = 1024
+
+var errHashRequestTooLarge = errors.New("hash request too large")
+
+// A ScrubMismatch is a file whose blocks on a device do not match the
+// global version of the file, although the device claims to have it.
+type ScrubMismatch struct {
+	Device string `json:"device"`
+	File   string `json:"file"`
+	Blocks []int  `json:"blocks,omitempty"` // indexes of the mismatching blocks
+	Error  string `json:"error,omitempty"`
+}
+
+func hasOption(options []protocol.Option, key string) bool {
+	for _, o := range options {
+		if o.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// hashRange returns the concatenated digests of the blocks in the given
+// range of the file.
+func hashRange(fn string, offset int64, size int) ([]byte, error) {
+	if offset%protocol.BlockSize != 0 {
+		return nil, protocol.ErrInvalid
+	}
+	if (size+protocol.BlockSize-1)/protocol.BlockSize > maxHashRequestBlocks {
+		return nil, errHashRequestTooLarge
+	}
+
+	fd, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var res []byte
+	buf := make([]byte, protocol.BlockSize)
+	for size > 0 {
+		n := protocol.BlockSize
+		if size < n {
+			n = size
+		}
+		n, err = fd.ReadAt(buf[:n], offset)
+		if n == 0 && err == io.EOF {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		hash := sha256.Sum256(buf[:n])
+		res = append(res, hash[:]...)
+		offset += int64(n)
+		size -= n
+	}
+	return res, nil
+}
+
+// Scrub compares the blocks of the files in the folder (under the given
+// prefix, if not empty) on the given devices with the global index, without
+// transferring any file data. Remote devices are asked to hash their copy.
+// Only files where the device has the global version are checked; local
+// files that changed on disk since the last scan are skipped. With no devices
+// given, the local device and all connected devices sharing the folder that
+// support hash requests are checked.
+func (m *Model) Scrub(folder, prefix string, devices []protocol.DeviceID) ([]ScrubMismatch, error) {
+	m.fmut.RLock()
+	fs, ok := m.folderFiles[folder]
+	cfg := m.folderCfgs[folder]
+	shared := m.folderDevices[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return nil, errors.New("no such folder")
+	}
+
+	if len(devices) == 0 {
+		devices = []protocol.DeviceID{protocol.LocalDeviceID}
+		for _, id := range shared {
+			if m.ConnectedTo(id) && m.deviceSupports(id, featureHashRequest) {
+				devices = append(devices, id)
+			}
+		}
+	}
+	for _, id := range devices {
+		if id == protocol.LocalDeviceID || id == m.id {
+			continue
+		}
+		if !m.folderSharedWith(folder, id) {
+			return nil, fmt.Errorf("folder %q is not shared with %s", folder, id)
+		}
+		if !m.deviceSupports(id, featureHashRequest) {
+			return nil, fmt.Errorf("device %s does not support hash requests", id)
+		}
+	}
+
+	var names []string
+	iterator := func(f db.FileIntf) bool {
+		if !f.IsDeleted() && !f.IsInvalid() && !f.IsDirectory() && !f.IsSymlink() {
+			names = append(names, f.(db.FileInfoTruncated).Name)
+		}
+		return true
+	}
+	if prefix == "" {
+		fs.WithGlobalTruncated(iterator)
+	} else {
+		fs.WithPrefixedGlobalTruncated(prefix, iterator)
+	}
+
+	var mismatches []ScrubMismatch
+	for _, name := range names {
+		global, ok := fs.GetGlobal(name)
+		if !ok {
+			continue
+		}
+		for _, id := range devices {
+			if id == m.id {
+				id = protocol.LocalDeviceID
+			}
+			if f, ok := fs.Get(id, name); !ok || !f.Version.Equal(global.Version) {
+				continue
+			}
+
+			var hashes []byte
+			var err error
+			if id == protocol.LocalDeviceID {
+				fn := filepath.Join(cfg.Path(), name)
+				if info, serr := os.Lstat(fn); serr != nil || info.Size() != global.Size() || info.ModTime().Unix() != global.Modified {
+					// Changed since the last scan; the scanner deals with it.
+					continue
+				}
+				hashes, err = m.scrubLocal(fn, global)
+			} else {
+				hashes, err = m.scrubRemote(id, folder, global)
+			}
+
+			mm := ScrubMismatch{Device: id.String(), File: name}
+			if id == protocol.LocalDeviceID {
+				mm.Device = m.id.String()
+			}
+			if err != nil {
+				mm.Error = err.Error()
+				mismatches = append(mismatches, mm)
+				continue
+			}
+			for i, b := range global.Blocks {
+				if b.Size == 0 {
+					// The single block of an empty file.
+					continue
+				}
+				if len(hashes) < (i+1)*sha256.Size || !bytes.Equal(hashes[i*sha256.Size:(i+1)*sha256.Size], b.Hash) {
+					mm.Blocks = append(mm.Blocks, i)
+				}
+			}
+			if len(mm.Blocks) > 0 {
+				if debug.On() {
+					l.Debugf("%v scrub: %s %q: mismatching blocks %v", m, id, name, mm.Blocks)
+				}
+				if id == protocol.LocalDeviceID {
+					l.Warnf("Corrupted file %q in folder %q: %d of %d blocks don't match the index", name, folder, len(mm.Blocks), len(global.Blocks))
+					events.Default.Log(events.LocalCorruption, map[string]interface{}{
+						"folder": folder,
+						"item":   name,
+						"blocks": mm.Blocks,
+					})
+				}
+				mismatches = append(mismatches, mm)
+			}
+		}
+	}
+	return mismatches, nil
+}
+
+func (m *Model) scrubLocal(fn string, f protocol.FileInfo) ([]byte, error) {
+	var hashes []byte
+	for offset := int64(0); offset < f.Size(); offset += maxHashRequestBlocks * protocol.BlockSize {
+		size := f.Size() - offset
+		if size > maxHashRequestBlocks*protocol.BlockSize {
+			size = maxHashRequestBlocks * protocol.BlockSize
+		}
+		bs, err := hashRange(fn, offset, int(size))
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, bs...)
+	}
+	return hashes, nil
+}
+
+func (m *Model) scrubRemote(deviceID protocol.DeviceID, folder string, f protocol.FileInfo) ([]byte, error) {
+	options := []protocol.Option{{Key: hashRequestOption, Value: "1"}}
+	var hashes []byte
+	for offset := int64(0); offset < f.Size(); offset += maxHashRequestBlocks * protocol.BlockSize {
+		size := f.Size() - offset
+		if size > maxHashRequestBlocks*protocol.BlockSize {
+			size = maxHashRequestBlocks * protocol.BlockSize
+		}
+		bs, err := m.requestGlobal(deviceID, folder, f.Name, offset, int(size), nil, 0, options)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, bs...)
+	}
+	return hashes, nil
+}
+
+// VerifyFolder rehashes the local files of the folder (under the given
+// prefix, if not empty) and compares them with the index. Corrupted files are
+// reported with a LocalCorruption event.
+func (m *Model) VerifyFolder(folder, prefix string) ([]ScrubMismatch, error) {
+	return m.Scrub(folder, prefix, []protocol.DeviceID{protocol.LocalDeviceID})
+}
@@ -0,0 +1,101 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/events"
+)
+
+// The folder option in the cluster config carrying the proof that the
+// sender knows the secret of the folder.
+const secretProofOption = "secretProof"
+
+// secretProof returns the proof that the sending device knows the secret
+// of the folder: an HMAC of the folder and the devices, keyed with the
+// secret. It is bound to the devices so that it can't be replayed to
+// another one.
+func secretProof(secret, folder string, from, to protocol.DeviceID) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(folder))
+	mac.Write(from[:])
+	mac.Write(to[:])
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// folderSecret returns the secret of the folder; empty if it has none.
+func (m *Model) folderSecret(folder string) string {
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+	return m.folderCfgs[folder].Secret
+}
+
+// folderAuthorized returns true if the device may exchange indexes and data
+// for the folder: the folder has no secret, or the device has proven
+// knowing it.
+func (m *Model) folderAuthorized(folder string, deviceID protocol.DeviceID) bool {
+	if m.folderSecret(folder) == "" {
+		return true
+	}
+	m.pmut.RLock()
+	defer m.pmut.RUnlock()
+	return m.folderAuth[deviceID][folder]
+}
+
+// checkSecrets verifies the secret proofs in the cluster config of the
+// device, for each of the folders with a secret shared with it. The
+// indexes of the folders are sent once the proof is verified; folders
+// without a matching proof are rejected.
+func (m *Model) checkSecrets(deviceID protocol.DeviceID, cm protocol.ClusterConfigMessage) {
+	proofs := make(map[string]string)
+	for _, folder := range cm.Folders {
+		for _, opt := range folder.Options {
+			if opt.Key == secretProofOption {
+				proofs[folder.ID] = opt.Value
+			}
+		}
+	}
+
+	m.fmut.RLock()
+	secrets := make(map[string]string)
+	for _, folder := range m.deviceFolders[deviceID] {
+		if secret := m.folderCfgs[folder].Secret; secret != "" {
+			secrets[folder] = secret
+		}
+	}
+	m.fmut.RUnlock()
+
+	for folder, secret := range secrets {
+		expected := secretProof(secret, folder, deviceID, m.id)
+		if !hmac.Equal([]byte(proofs[folder]), []byte(expected)) {
+			l.Warnf("Device %v did not prove knowing the secret of folder %q; not sharing the folder with it", deviceID, folder)
+			events.Default.Log(events.FolderSecretMismatch, map[string]string{
+				"folder": folder,
+				"device": deviceID.String(),
+			})
+			continue
+		}
+
+		m.pmut.Lock()
+		if m.folderAuth[deviceID] == nil {
+			m.folderAuth[deviceID] = make(map[string]bool)
+		}
+		if !m.folderAuth[deviceID][folder] {
+			m.folderAuth[deviceID][folder] = true
+			if conn, ok := m.protoConn[deviceID]; ok {
+				m.fmut.RLock()
+				go m.sendIndexes(conn, folder, m.folderFiles[folder], m.folderIgnores[folder])
+				m.fmut.RUnlock()
+			}
+		}
+		m.pmut.Unlock()
+	}
+}
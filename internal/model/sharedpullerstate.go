@@ -13,6 +13,7 @@ import (
 
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/faults"
 	"github.com/syncthing/syncthing/internal/sync"
 )
 
@@ -29,14 +30,15 @@ type sharedPullerState struct {
 	version     protocol.Vector // The current (old) version
 
 	// Mutable, must be locked for access
-	err        error      // The first error we hit
-	fd         *os.File   // The fd of the temp file
-	copyTotal  int        // Total number of copy actions for the whole job
-	pullTotal  int        // Total number of pull actions for the whole job
-	copyOrigin int        // Number of blocks copied from the original file
-	copyNeeded int        // Number of copy actions still pending
-	pullNeeded int        // Number of block pulls still pending
-	mut        sync.Mutex // Protects the above
+	err        error                // The first error we hit
+	fd         *os.File             // The fd of the temp file
+	copyTotal  int                  // Total number of copy actions for the whole job
+	pullTotal  int                  // Total number of pull actions for the whole job
+	copyOrigin int                  // Number of blocks copied from the original file
+	copyNeeded int                  // Number of copy actions still pending
+	pullNeeded int                  // Number of block pulls still pending
+	written    []protocol.BlockInfo // The blocks in the temp file, by index; unwritten ones are zero
+	mut        sync.Mutex           // Protects the above
 }
 
 // A momentary state representing the progress of the puller
@@ -77,7 +79,7 @@ func (s *sharedPullerState) tempFile() (io.WriterAt, error) {
 
 	// If the temp file is already open, return the file descriptor
 	if s.fd != nil {
-		return lockedWriterAt{&s.mut, s.fd}, nil
+		return lockedWriterAt{&s.mut, faults.Default.WriterAt(s.fd)}, nil
 	}
 
 	// Ensure that the parent directory is writable. This is
@@ -124,7 +126,7 @@ func (s *sharedPullerState) tempFile() (io.WriterAt, error) {
 	// Same fd will be used by all writers
 	s.fd = fd
 
-	return lockedWriterAt{&s.mut, s.fd}, nil
+	return lockedWriterAt{&s.mut, faults.Default.WriterAt(s.fd)}, nil
 }
 
 // sourceFile opens the existing source file for reading
@@ -176,7 +178,7 @@ func (s *sharedPullerState) failed() error {
 func (s *sharedPullerState) copyDone() {
 	s.mut.Lock()
 	s.copyNeeded--
-	if debug {
+	if debug.On() {
 		l.Debugln("sharedPullerState", s.folder, s.file.Name, "copyNeeded ->", s.copyNeeded)
 	}
 	s.mut.Unlock()
@@ -194,7 +196,7 @@ func (s *sharedPullerState) pullStarted() {
 	s.copyNeeded--
 	s.pullTotal++
 	s.pullNeeded++
-	if debug {
+	if debug.On() {
 		l.Debugln("sharedPullerState", s.folder, s.file.Name, "pullNeeded start ->", s.pullNeeded)
 	}
 	s.mut.Unlock()
@@ -203,12 +205,29 @@ func (s *sharedPullerState) pullStarted() {
 func (s *sharedPullerState) pullDone() {
 	s.mut.Lock()
 	s.pullNeeded--
-	if debug {
+	if debug.On() {
 		l.Debugln("sharedPullerState", s.folder, s.file.Name, "pullNeeded done ->", s.pullNeeded)
 	}
 	s.mut.Unlock()
 }
 
+// blockWritten records that the block has been written to the temp file.
+func (s *sharedPullerState) blockWritten(block protocol.BlockInfo) {
+	s.mut.Lock()
+	if i := int(block.Offset / protocol.BlockSize); i < len(s.written) {
+		s.written[i] = block
+	}
+	s.mut.Unlock()
+}
+
+// writtenBlocks returns the blocks in the temp file, by index, with a nil
+// hash for those not written.
+func (s *sharedPullerState) writtenBlocks() []protocol.BlockInfo {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return append([]protocol.BlockInfo(nil), s.written...)
+}
+
 // finalClose atomically closes and returns closed status of a file. A true
 // first return value means the file was closed and should be finished, with
 // the error indicating the success or failure of the close. A false first
@@ -0,0 +1,78 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/events"
+)
+
+// The snapshot command is killed, and the snapshot failed, if it hasn't
+// finished after this long.
+var snapshotTimeout = 10 * time.Minute
+
+// snapshot runs the snapshot command of the folder before a pull deleting or
+// replacing the given number of items. The command is given the folder path
+// and the number of items, and prints the identifier of the snapshot it
+// took, which is recorded by a FolderSnapshot event.
+func (p *rwFolder) snapshot(items int) error {
+	cmd := exec.Command(p.snapshotCommand, p.dir, strconv.Itoa(items))
+	// The GUI credentials are none of the command's business.
+	for _, x := range os.Environ() {
+		if !strings.HasPrefix(x, "STGUIAUTH=") && !strings.HasPrefix(x, "STGUIAPIKEY=") {
+			cmd.Env = append(cmd.Env, x)
+		}
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Start()
+	if err == nil {
+		done := make(chan error, 1)
+		go func() {
+			done <- cmd.Wait()
+		}()
+		select {
+		case err = <-done:
+			if msg := strings.TrimSpace(stderr.String()); err != nil && msg != "" {
+				err = fmt.Errorf("%v: %s", err, msg)
+			}
+		case <-time.After(snapshotTimeout):
+			// The output isn't looked at, as what the command started may
+			// still be writing it.
+			cmd.Process.Kill()
+			err = fmt.Errorf("timed out after %v", snapshotTimeout)
+		}
+	}
+	if err != nil {
+		events.Default.Log(events.FolderSnapshot, map[string]interface{}{
+			"folder": p.folder,
+			"items":  items,
+			"error":  err.Error(),
+		})
+		return err
+	}
+
+	// The identifier is the first line of output.
+	id := strings.TrimSpace(strings.SplitN(stdout.String(), "\n", 2)[0])
+
+	l.Infof("Folder %q: took snapshot %q before deleting or replacing %d items", p.folder, id, items)
+	events.Default.Log(events.FolderSnapshot, map[string]interface{}{
+		"folder":   p.folder,
+		"items":    items,
+		"snapshot": id,
+	})
+	return nil
+}
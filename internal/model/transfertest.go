@@ -0,0 +1,123 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"errors"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+const (
+	transferTestWorkers   = 4
+	transferTestMaxBlocks = 1024
+)
+
+type transferTestBlock struct {
+	folder string
+	name   string
+	block  protocol.BlockInfo
+}
+
+// TransferTest measures the transfer rate from the given connected device by
+// requesting blocks of the files it has announced in the folders shared with
+// it, over and over for the given duration. The data received is discarded.
+// It returns the number of bytes received and the time it took.
+func (m *Model) TransferTest(deviceID protocol.DeviceID, duration time.Duration) (int64, time.Duration, error) {
+	if !m.ConnectedTo(deviceID) {
+		return 0, 0, errors.New("device is not connected")
+	}
+
+	blocks := m.transferTestBlocks(deviceID)
+	if len(blocks) == 0 {
+		return 0, 0, errors.New("device has no data in shared folders")
+	}
+
+	next := make(chan transferTestBlock)
+	done := make(chan struct{})
+	var received int64
+	var firstErr error
+	mut := sync.NewMutex()
+	wg := sync.NewWaitGroup()
+
+	t0 := time.Now()
+	for i := 0; i < transferTestWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range next {
+				buf, err := m.requestGlobal(deviceID, b.folder, b.name, b.block.Offset, int(b.block.Size), b.block.Hash, 0, nil)
+				mut.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+						close(done)
+					}
+					mut.Unlock()
+					return
+				}
+				received += int64(len(buf))
+				mut.Unlock()
+			}
+		}()
+	}
+
+	deadline := time.After(duration)
+loop:
+	for i := 0; ; i = (i + 1) % len(blocks) {
+		select {
+		case next <- blocks[i]:
+		case <-deadline:
+			break loop
+		case <-done:
+			break loop
+		}
+	}
+	close(next)
+	wg.Wait()
+	elapsed := time.Since(t0)
+
+	if received == 0 && firstErr != nil {
+		return 0, elapsed, firstErr
+	}
+	return received, elapsed, nil
+}
+
+// transferTestBlocks returns up to transferTestMaxBlocks blocks of regular
+// files the device has in the folders shared with it.
+func (m *Model) transferTestBlocks(deviceID protocol.DeviceID) []transferTestBlock {
+	m.fmut.RLock()
+	sets := make(map[string]*db.FileSet)
+	for _, folder := range m.deviceFolders[deviceID] {
+		sets[folder] = m.folderFiles[folder]
+	}
+	m.fmut.RUnlock()
+
+	var blocks []transferTestBlock
+	for folder, fs := range sets {
+		fs.WithHave(deviceID, func(fi db.FileIntf) bool {
+			f := fi.(protocol.FileInfo)
+			if f.IsDeleted() || f.IsInvalid() || f.IsDirectory() || f.IsSymlink() {
+				return true
+			}
+			for _, block := range f.Blocks {
+				blocks = append(blocks, transferTestBlock{folder, f.Name, block})
+				if len(blocks) == transferTestMaxBlocks {
+					return false
+				}
+			}
+			return true
+		})
+		if len(blocks) == transferTestMaxBlocks {
+			break
+		}
+	}
+	return blocks
+}
@@ -0,0 +1,105 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"errors"
+	"runtime"
+)
+
+// Folders smaller than this don't gain from more than one copier.
+const smallFolderBytes = 1 << 30
+
+// FolderTuning is the number of concurrent copier, puller and hasher
+// routines in use for a folder.
+type FolderTuning struct {
+	Copiers int `json:"copiers"`
+	Pullers int `json:"pullers"`
+	Hashers int `json:"hashers"`
+}
+
+// FolderTuning returns the numbers of routines used for the folder, with
+// the automatically tuned values filled in.
+func (m *Model) FolderTuning(folder string) (FolderTuning, error) {
+	m.fmut.RLock()
+	_, ok := m.folderCfgs[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return FolderTuning{}, errors.New("no such folder")
+	}
+	return m.folderTuning(folder), nil
+}
+
+// folderTuning returns the numbers of routines to use for the folder. The
+// values are read from the current configuration, so that changes apply
+// from the next pull or scan on. Values not set are tuned from the number
+// of CPU cores and the size of the folder.
+func (m *Model) folderTuning(folder string) FolderTuning {
+	m.fmut.RLock()
+	folderCfg := m.folderCfgs[folder]
+	numFolders := len(m.folderCfgs)
+	m.fmut.RUnlock()
+	if cfg, ok := m.cfg.Folders()[folder]; ok {
+		folderCfg = cfg
+	}
+
+	cpus := runtime.GOMAXPROCS(-1)
+	t := FolderTuning{
+		Copiers: folderCfg.Copiers,
+		Pullers: folderCfg.Pullers,
+		Hashers: folderCfg.Hashers,
+	}
+	if t.Copiers <= 0 || t.Pullers <= 0 {
+		_, _, bytes := m.GlobalSize(folder)
+		if t.Copiers <= 0 {
+			t.Copiers = autoCopiers(cpus, numFolders, bytes)
+		}
+		if t.Pullers <= 0 {
+			t.Pullers = autoPullers(t.Copiers)
+		}
+	}
+	if t.Hashers <= 0 {
+		t.Hashers = autoHashers(cpus, numFolders)
+	}
+	return t
+}
+
+// autoCopiers returns the number of copiers for a folder of the given size:
+// one for small folders, otherwise one per CPU core available to the folder,
+// up to four.
+func autoCopiers(cpus, numFolders int, bytes int64) int {
+	if bytes < smallFolderBytes || numFolders < 1 {
+		return 1
+	}
+	n := cpus / numFolders
+	switch {
+	case n < 1:
+		return 1
+	case n > 4:
+		return 4
+	}
+	return n
+}
+
+// autoPullers returns the number of pullers to keep each of the copiers
+// busy.
+func autoPullers(copiers int) int {
+	return 16 * copiers
+}
+
+// autoHashers returns the number of hashers for a folder: the CPU cores
+// divided per folder.
+func autoHashers(cpus, numFolders int) int {
+	if numFolders < 1 {
+		return 1
+	}
+	if perFolder := cpus / numFolders; perFolder > 0 {
+		// We have CPUs to spare, divide them per folder.
+		return perFolder
+	}
+	return 1
+}
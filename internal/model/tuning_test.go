@@ -0,0 +1,34 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import "testing"
+
+func TestAutoTuning(t *testing.T) {
+	cases := []struct {
+		cpus, folders int
+		bytes         int64
+		copiers       int
+		pullers       int
+		hashers       int
+	}{
+		{8, 1, 1 << 20, 1, 16, 8},
+		{8, 1, 10 << 30, 4, 64, 8},
+		{8, 4, 10 << 30, 2, 32, 2},
+		{2, 4, 10 << 30, 1, 16, 1},
+		{32, 2, 100 << 30, 4, 64, 16},
+		{4, 0, 0, 1, 16, 1},
+	}
+	for _, tc := range cases {
+		copiers := autoCopiers(tc.cpus, tc.folders, tc.bytes)
+		pullers := autoPullers(copiers)
+		hashers := autoHashers(tc.cpus, tc.folders)
+		if copiers != tc.copiers || pullers != tc.pullers || hashers != tc.hashers {
+			t.Errorf("%d cpus, %d folders, %d bytes: got %d/%d/%d, expected %d/%d/%d", tc.cpus, tc.folders, tc.bytes, copiers, pullers, hashers, tc.copiers, tc.pullers, tc.hashers)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package osutil
+
+import (
+	"errors"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+var (
+	ErrNameEmpty    = errors.New("empty file name")
+	ErrNameOutside  = errors.New("path outside the folder")
+	ErrNameNUL      = errors.New("file name contains a NUL byte")
+	ErrNameReserved = errors.New("file name reserved by Windows")
+)
+
+// windowsReservedNames are the device names that can't be used as file
+// names on Windows, with or without an extension.
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// CheckFilename returns an error if the file name, in native format and
+// relative to the folder root, can't be used safely: if it is empty,
+// absolute, refers to something outside the folder, or contains a NUL
+// byte. On Windows, names reserved for devices are refused as well. This is
+// the check applied to every name, whether found by the scanner or received
+// from another device.
+func CheckFilename(name string) error {
+	return checkFilename(name, runtime.GOOS == "windows")
+}
+
+func checkFilename(name string, windows bool) error {
+	clean := filepath.Clean(name)
+	switch {
+	case name == "" || clean == ".":
+		return ErrNameEmpty
+	case strings.IndexByte(name, 0) >= 0:
+		return ErrNameNUL
+	case filepath.IsAbs(name) || filepath.VolumeName(name) != "" || strings.HasPrefix(name, string(filepath.Separator)):
+		return ErrNameOutside
+	case clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)):
+		return ErrNameOutside
+	}
+
+	if windows {
+		for _, part := range strings.Split(clean, string(filepath.Separator)) {
+			base := part
+			if i := strings.IndexByte(base, '.'); i >= 0 {
+				base = base[:i]
+			}
+			if windowsReservedNames[strings.ToUpper(strings.TrimRight(base, " "))] {
+				return ErrNameReserved
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package osutil
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckFilename(t *testing.T) {
+	cases := []struct {
+		name   string
+		err    error
+		winErr error
+	}{
+		{"foo", nil, nil},
+		{filepath.Join("a", "b", "c.txt"), nil, nil},
+		{filepath.Join("a", "..", "b"), nil, nil},
+		{"..foo", nil, nil},
+		{"console", nil, nil},
+		{"", ErrNameEmpty, ErrNameEmpty},
+		{".", ErrNameEmpty, ErrNameEmpty},
+		{"foo\x00bar", ErrNameNUL, ErrNameNUL},
+		{"..", ErrNameOutside, ErrNameOutside},
+		{filepath.Join("..", "foo"), ErrNameOutside, ErrNameOutside},
+		{filepath.Join("a", "..", "..", "foo"), ErrNameOutside, ErrNameOutside},
+		{string(filepath.Separator) + "foo", ErrNameOutside, ErrNameOutside},
+		{"CON", nil, ErrNameReserved},
+		{"nul.txt", nil, ErrNameReserved},
+		{"Com1 ", nil, ErrNameReserved},
+		{filepath.Join("a", "lpt9.tar.gz"), nil, ErrNameReserved},
+	}
+
+	for _, tc := range cases {
+		if err := checkFilename(tc.name, false); err != tc.err {
+			t.Errorf("%q: got %v, expected %v", tc.name, err, tc.err)
+		}
+		if err := checkFilename(tc.name, true); err != tc.winErr {
+			t.Errorf("%q on Windows: got %v, expected %v", tc.name, err, tc.winErr)
+		}
+	}
+}
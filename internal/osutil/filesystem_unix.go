@@ -0,0 +1,29 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build !windows
+
+package osutil
+
+import (
+	"os"
+	"syscall"
+)
+
+// FilesystemID returns an identifier of the filesystem the given path is on,
+// which changes when another filesystem is mounted over it or unmounted. The
+// boolean is false if this can't be determined on the platform.
+func FilesystemID(path string) (uint64, bool, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, false, err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false, nil
+	}
+	return uint64(st.Dev), true, nil
+}
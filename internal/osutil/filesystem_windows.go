@@ -0,0 +1,19 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build windows
+
+package osutil
+
+import "os"
+
+// FilesystemID returns an identifier of the filesystem the given path is on.
+// It can't be determined on Windows, where drives aren't mounted over
+// directories as a rule, so the boolean is always false.
+func FilesystemID(path string) (uint64, bool, error) {
+	_, err := os.Stat(path)
+	return 0, false, err
+}
@@ -7,25 +7,31 @@
 package scanner
 
 import (
+	"io"
 	"os"
 	"path/filepath"
 
+	"github.com/juju/ratelimit"
 	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/cpulimit"
 	"github.com/syncthing/syncthing/internal/sync"
 )
 
 // The parallell hasher reads FileInfo structures from the inbox, hashes the
 // file to populate the Blocks element and sends it to the outbox. A number of
 // workers are used in parallel. The outbox will become closed when the inbox
-// is closed and all items handled.
+// is closed and all items handled. If the limiter is not nil, file data is
+// read no faster than it allows. If slots is not nil, a slot is held for the
+// duration of each file hashed. If cpu is not nil, reads are throttled
+// according to it.
 
-func newParallelHasher(dir string, blockSize, workers int, outbox, inbox chan protocol.FileInfo) {
+func newParallelHasher(dir string, blockSize, workers int, limiter *ratelimit.Bucket, slots chan struct{}, cpu *cpulimit.Limiter, outbox, inbox chan protocol.FileInfo) {
 	wg := sync.NewWaitGroup()
 	wg.Add(workers)
 
 	for i := 0; i < workers; i++ {
 		go func() {
-			hashFiles(dir, blockSize, outbox, inbox)
+			hashFiles(dir, blockSize, limiter, slots, cpu, outbox, inbox)
 			wg.Done()
 		}()
 	}
@@ -37,9 +43,13 @@ func newParallelHasher(dir string, blockSize, workers int, outbox, inbox chan pr
 }
 
 func HashFile(path string, blockSize int) ([]protocol.BlockInfo, error) {
+	return hashFile(path, blockSize, nil, nil)
+}
+
+func hashFile(path string, blockSize int, limiter *ratelimit.Bucket, cpu *cpulimit.Limiter) ([]protocol.BlockInfo, error) {
 	fd, err := os.Open(path)
 	if err != nil {
-		if debug {
+		if debug.On() {
 			l.Debugln("open:", err)
 		}
 		return []protocol.BlockInfo{}, err
@@ -48,25 +58,36 @@ func HashFile(path string, blockSize int) ([]protocol.BlockInfo, error) {
 	fi, err := fd.Stat()
 	if err != nil {
 		fd.Close()
-		if debug {
+		if debug.On() {
 			l.Debugln("stat:", err)
 		}
 		return []protocol.BlockInfo{}, err
 	}
 	defer fd.Close()
-	return Blocks(fd, blockSize, fi.Size())
+
+	var r io.Reader = fd
+	if limiter != nil || cpu != nil {
+		r = &limitedReader{r: fd, bucket: limiter, cpu: cpu}
+	}
+	return Blocks(r, blockSize, fi.Size())
 }
 
-func hashFiles(dir string, blockSize int, outbox, inbox chan protocol.FileInfo) {
+func hashFiles(dir string, blockSize int, limiter *ratelimit.Bucket, slots chan struct{}, cpu *cpulimit.Limiter, outbox, inbox chan protocol.FileInfo) {
 	for f := range inbox {
 		if f.IsDirectory() || f.IsDeleted() || f.IsSymlink() {
 			outbox <- f
 			continue
 		}
 
-		blocks, err := HashFile(filepath.Join(dir, f.Name), blockSize)
+		if slots != nil {
+			slots <- struct{}{}
+		}
+		blocks, err := hashFile(filepath.Join(dir, f.Name), blockSize, limiter, cpu)
+		if slots != nil {
+			<-slots
+		}
 		if err != nil {
-			if debug {
+			if debug.On() {
 				l.Debugln("hash error:", f.Name, err)
 			}
 			continue
@@ -76,3 +97,18 @@ func hashFiles(dir string, blockSize int, outbox, inbox chan protocol.FileInfo)
 		outbox <- f
 	}
 }
+
+type limitedReader struct {
+	r      io.Reader
+	bucket *ratelimit.Bucket // may be nil
+	cpu    *cpulimit.Limiter // may be nil
+}
+
+func (r *limitedReader) Read(buf []byte) (int, error) {
+	r.cpu.Wait()
+	n, err := r.r.Read(buf)
+	if r.bucket != nil {
+		r.bucket.Wait(int64(n))
+	}
+	return n, err
+}
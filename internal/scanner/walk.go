@@ -15,7 +15,9 @@ import (
 	"time"
 	"unicode/utf8"
 
+	"github.com/juju/ratelimit"
 	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/cpulimit"
 	"github.com/syncthing/syncthing/internal/db"
 	"github.com/syncthing/syncthing/internal/ignore"
 	"github.com/syncthing/syncthing/internal/osutil"
@@ -55,6 +57,9 @@ type Walker struct {
 	CurrentFiler CurrentFiler
 	// If MtimeRepo is not nil, it is used to provide mtimes on systems that don't support setting arbirtary mtimes.
 	MtimeRepo *db.VirtualMtimeRepo
+	// If Placeholders is not nil, placeholder files that haven't been
+	// touched since they were created are skipped.
+	Placeholders *db.PlaceholderRepo
 	// If IgnorePerms is true, changes to permission bits will not be
 	// detected. Scanned files will get zero permission bits and the
 	// NoPermissionBits flag set.
@@ -62,12 +67,38 @@ type Walker struct {
 	// When AutoNormalize is set, file names that are in UTF8 but incorrect
 	// normalization form will be corrected.
 	AutoNormalize bool
+	// Modification times this far apart are considered equal, for
+	// filesystems storing them with less than second precision (FAT).
+	ModTimeWindow time.Duration
 	// Number of routines to use for hashing
 	Hashers int
+	// If ReadLimiter is not nil, it limits the rate at which file data is
+	// read for hashing. It may be shared between several Walkers.
+	ReadLimiter *ratelimit.Bucket
+	// If HasherSlots is not nil, a hasher must put a value into it before
+	// hashing a file and take it out again afterwards. The capacity of the
+	// channel thus limits the number of files being hashed at once, over all
+	// Walkers sharing it.
+	HasherSlots chan struct{}
+	// If CPULimiter is not nil, hashing is throttled according to it.
+	CPULimiter *cpulimit.Limiter
+	// If MaxFileSize is larger than zero, larger files are skipped like
+	// ignored files.
+	MaxFileSize int64
 	// Our vector clock id
 	ShortID uint64
 }
 
+// ModTimeEqual returns true if the modification times a and b, in seconds,
+// are at most window apart.
+func ModTimeEqual(a, b int64, window time.Duration) bool {
+	d := a - b
+	if d < 0 {
+		d = -d
+	}
+	return time.Duration(d)*time.Second <= window
+}
+
 type TempNamer interface {
 	// Temporary returns a temporary name for the filed referred to by filepath.
 	TempName(path string) string
@@ -83,7 +114,7 @@ type CurrentFiler interface {
 // Walk returns the list of files found in the local folder by scanning the
 // file system. Files are blockwise hashed.
 func (w *Walker) Walk() (chan protocol.FileInfo, error) {
-	if debug {
+	if debug.On() {
 		l.Debugln("Walk", w.Dir, w.Subs, w.BlockSize, w.Matcher)
 	}
 
@@ -94,7 +125,7 @@ func (w *Walker) Walk() (chan protocol.FileInfo, error) {
 
 	files := make(chan protocol.FileInfo)
 	hashedFiles := make(chan protocol.FileInfo)
-	newParallelHasher(w.Dir, w.BlockSize, w.Hashers, hashedFiles, files)
+	newParallelHasher(w.Dir, w.BlockSize, w.Hashers, w.ReadLimiter, w.HasherSlots, w.CPULimiter, hashedFiles, files)
 
 	go func() {
 		hashFiles := w.walkAndHashFiles(files)
@@ -123,7 +154,7 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 		}
 
 		if err != nil {
-			if debug {
+			if debug.On() {
 				l.Debugln("error:", p, info, err)
 			}
 			return skip
@@ -131,7 +162,7 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 
 		rn, err := filepath.Rel(w.Dir, p)
 		if err != nil {
-			if debug {
+			if debug.On() {
 				l.Debugln("rel error:", p, err)
 			}
 			return skip
@@ -148,12 +179,12 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 
 		if w.TempNamer != nil && w.TempNamer.IsTemporary(rn) {
 			// A temporary file
-			if debug {
+			if debug.On() {
 				l.Debugln("temporary:", rn)
 			}
 			if info.Mode().IsRegular() && mtime.Add(w.TempLifetime).Before(now) {
 				os.Remove(p)
-				if debug {
+				if debug.On() {
 					l.Debugln("removing temporary:", rn, mtime)
 				}
 			}
@@ -163,7 +194,7 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 		if sn := filepath.Base(rn); sn == ".stignore" || sn == ".stfolder" ||
 			strings.HasPrefix(rn, ".stversions") || w.Matcher.Match(rn) {
 			// An ignored file
-			if debug {
+			if debug.On() {
 				l.Debugln("ignored:", rn)
 			}
 			return skip
@@ -174,6 +205,11 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 			return skip
 		}
 
+		if err := osutil.CheckFilename(rn); err != nil {
+			l.Warnf("File name %q can't be synced (%v); skipping.", rn, err)
+			return skip
+		}
+
 		var normalizedRn string
 		if runtime.GOOS == "darwin" {
 			// Mac OS X file names should always be NFD normalized.
@@ -235,7 +271,7 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 			target, flags, err := symlinks.Read(p)
 			flags = flags & protocol.SymlinkTypeMask
 			if err != nil {
-				if debug {
+				if debug.On() {
 					l.Debugln("readlink error:", p, err)
 				}
 				return skip
@@ -243,7 +279,7 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 
 			blocks, err := Blocks(strings.NewReader(target), w.BlockSize, 0)
 			if err != nil {
-				if debug {
+				if debug.On() {
 					l.Debugln("hash link error:", p, err)
 				}
 				return skip
@@ -271,7 +307,7 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 				Blocks:   blocks,
 			}
 
-			if debug {
+			if debug.On() {
 				l.Debugln("symlink to hash:", p, f)
 			}
 
@@ -308,7 +344,7 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 				Flags:    flags,
 				Modified: mtime.Unix(),
 			}
-			if debug {
+			if debug.On() {
 				l.Debugln("dir:", p, f)
 			}
 			fchan <- f
@@ -316,6 +352,24 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 		}
 
 		if info.Mode().IsRegular() {
+			if w.Placeholders != nil && w.Placeholders.IsPlaceholder(rn, info.Size(), mtime.Unix()) {
+				// The file has no content locally; it's in the index as
+				// invalid, which is right as it is.
+				if debug.On() {
+					l.Debugln("placeholder:", rn)
+				}
+				return nil
+			}
+
+			if w.MaxFileSize > 0 && info.Size() > w.MaxFileSize {
+				// Skipped like an ignored file; the model sets the invalid
+				// bit if the file is in the index.
+				if debug.On() {
+					l.Debugln("too large:", rn, info.Size())
+				}
+				return nil
+			}
+
 			curMode := uint32(info.Mode())
 			if runtime.GOOS == "windows" && osutil.IsWindowsExecutable(rn) {
 				curMode |= 0111
@@ -333,12 +387,12 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 				//  - has the same size as previously
 				cf, ok = w.CurrentFiler.CurrentFile(rn)
 				permUnchanged := w.IgnorePerms || !cf.HasPermissionBits() || PermsEqual(cf.Flags, curMode)
-				if ok && permUnchanged && !cf.IsDeleted() && cf.Modified == mtime.Unix() && !cf.IsDirectory() &&
+				if ok && permUnchanged && !cf.IsDeleted() && ModTimeEqual(cf.Modified, mtime.Unix(), w.ModTimeWindow) && !cf.IsDirectory() &&
 					!cf.IsSymlink() && !cf.IsInvalid() && cf.Size() == info.Size() {
 					return nil
 				}
 
-				if debug {
+				if debug.On() {
 					l.Debugln("rescan:", cf, mtime.Unix(), info.Mode()&os.ModePerm)
 				}
 			}
@@ -354,7 +408,7 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 				Flags:    flags,
 				Modified: mtime.Unix(),
 			}
-			if debug {
+			if debug.On() {
 				l.Debugln("to hash:", p, f)
 			}
 			fchan <- f
@@ -369,7 +423,7 @@ func checkDir(dir string) error {
 		return err
 	} else if !info.IsDir() {
 		return errors.New(dir + ": not a directory")
-	} else if debug {
+	} else if debug.On() {
 		l.Debugln("checkDir", dir, info)
 	}
 	return nil
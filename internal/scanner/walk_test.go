@@ -16,7 +16,9 @@ import (
 	rdebug "runtime/debug"
 	"sort"
 	"testing"
+	"time"
 
+	"github.com/juju/ratelimit"
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/ignore"
 	"golang.org/x/text/unicode/norm"
@@ -120,6 +122,78 @@ func TestWalk(t *testing.T) {
 	}
 }
 
+func TestWalkMaxFileSize(t *testing.T) {
+	ignores := ignore.New(false)
+	err := ignores.Load("testdata/.stignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := Walker{
+		Dir:         "testdata",
+		BlockSize:   128 * 1024,
+		Matcher:     ignores,
+		Hashers:     2,
+		MaxFileSize: 4,
+	}
+
+	fchan, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tmp []protocol.FileInfo
+	for f := range fchan {
+		tmp = append(tmp, f)
+	}
+	sort.Sort(fileList(tmp))
+	files := fileList(tmp).testfiles()
+
+	// Only the directories and the files of at most four bytes remain.
+	var expected testfileList
+	for _, f := range testdata {
+		if f.hash == "" || f.size <= 4 {
+			expected = append(expected, f)
+		}
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("Walk returned unexpected data\nExpected: %v\nActual: %v", expected, files)
+	}
+}
+
+func TestWalkLimited(t *testing.T) {
+	ignores := ignore.New(false)
+	err := ignores.Load("testdata/.stignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := Walker{
+		Dir:         "testdata",
+		BlockSize:   128 * 1024,
+		Matcher:     ignores,
+		Hashers:     2,
+		ReadLimiter: ratelimit.NewBucketWithRate(1024*1024, 1024*1024),
+		HasherSlots: make(chan struct{}, 1),
+	}
+
+	fchan, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tmp []protocol.FileInfo
+	for f := range fchan {
+		tmp = append(tmp, f)
+	}
+	sort.Sort(fileList(tmp))
+	files := fileList(tmp).testfiles()
+
+	if !reflect.DeepEqual(files, testdata) {
+		t.Errorf("Walk returned unexpected data\nExpected: %v\nActual: %v", testdata, files)
+	}
+}
+
 func TestWalkError(t *testing.T) {
 	w := Walker{
 		Dir:       "testdata-missing",
@@ -337,3 +411,22 @@ func (l testfileList) String() string {
 	b.WriteString("}")
 	return b.String()
 }
+
+func TestModTimeEqual(t *testing.T) {
+	cases := []struct {
+		a, b   int64
+		window time.Duration
+		equal  bool
+	}{
+		{100, 100, 0, true},
+		{100, 101, 0, false},
+		{100, 102, 2 * time.Second, true},
+		{102, 100, 2 * time.Second, true},
+		{100, 103, 2 * time.Second, false},
+	}
+	for _, tc := range cases {
+		if eq := ModTimeEqual(tc.a, tc.b, tc.window); eq != tc.equal {
+			t.Errorf("ModTimeEqual(%d, %d, %v) = %v, expected %v", tc.a, tc.b, tc.window, eq, tc.equal)
+		}
+	}
+}
@@ -11,23 +11,31 @@ import (
 
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/sync"
 	"github.com/syndtr/goleveldb/leveldb"
 )
 
 type DeviceStatistics struct {
-	LastSeen time.Time `json:"lastSeen"`
+	LastSeen      time.Time `json:"lastSeen"`
+	InBytesTotal  int64     `json:"inBytesTotal"`
+	OutBytesTotal int64     `json:"outBytesTotal"`
 }
 
 type DeviceStatisticsReference struct {
-	ns     *db.NamespacedKV
-	device protocol.DeviceID
+	ns      *db.NamespacedKV
+	device  protocol.DeviceID
+	mut     sync.Mutex // serializes read-modify-write of the byte counters
+	history *transferHistory
 }
 
 func NewDeviceStatisticsReference(ldb *leveldb.DB, device protocol.DeviceID) *DeviceStatisticsReference {
 	prefix := string(db.KeyTypeDeviceStatistic) + device.String()
+	ns := db.NewNamespacedKV(ldb, prefix)
 	return &DeviceStatisticsReference{
-		ns:     db.NewNamespacedKV(ldb, prefix),
-		device: device,
+		ns:      ns,
+		device:  device,
+		mut:     sync.NewMutex(),
+		history: newTransferHistory(ns),
 	}
 }
 
@@ -38,21 +46,63 @@ func (s *DeviceStatisticsReference) GetLastSeen() time.Time {
 		// time.Time{} from s.ns
 		return time.Unix(0, 0)
 	}
-	if debug {
+	if debug.On() {
 		l.Debugln("stats.DeviceStatisticsReference.GetLastSeen:", s.device, t)
 	}
 	return t
 }
 
 func (s *DeviceStatisticsReference) WasSeen() {
-	if debug {
+	if debug.On() {
 		l.Debugln("stats.DeviceStatisticsReference.WasSeen:", s.device)
 	}
 	s.ns.PutTime("lastSeen", time.Now())
 }
 
+// GetTransferred returns the total number of bytes received from and sent
+// to the device, over all connections.
+func (s *DeviceStatisticsReference) GetTransferred() (in, out int64) {
+	in, _ = s.ns.Int64("inBytesTotal")
+	out, _ = s.ns.Int64("outBytesTotal")
+	return in, out
+}
+
+// AddTransferred adds the given number of bytes to the totals received from
+// and sent to the device, and to the history as of the next StoreHistory.
+func (s *DeviceStatisticsReference) AddTransferred(in, out int64) {
+	if in == 0 && out == 0 {
+		return
+	}
+	if debug.On() {
+		l.Debugln("stats.DeviceStatisticsReference.AddTransferred:", s.device, in, out)
+	}
+
+	s.history.add(in, out)
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	inTotal, outTotal := s.GetTransferred()
+	s.ns.PutInt64("inBytesTotal", inTotal+in)
+	s.ns.PutInt64("outBytesTotal", outTotal+out)
+}
+
 func (s *DeviceStatisticsReference) GetStatistics() DeviceStatistics {
+	in, out := s.GetTransferred()
 	return DeviceStatistics{
-		LastSeen: s.GetLastSeen(),
+		LastSeen:      s.GetLastSeen(),
+		InBytesTotal:  in,
+		OutBytesTotal: out,
 	}
 }
+
+// StoreHistory writes the transfers added since the last call to the history
+// in the database.
+func (s *DeviceStatisticsReference) StoreHistory() {
+	s.history.store(time.Now())
+}
+
+// GetHistory returns the hourly and daily transfer totals.
+func (s *DeviceStatisticsReference) GetHistory() History {
+	return s.history.get(time.Now())
+}
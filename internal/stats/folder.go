@@ -18,8 +18,9 @@ type FolderStatistics struct {
 }
 
 type FolderStatisticsReference struct {
-	ns     *db.NamespacedKV
-	folder string
+	ns      *db.NamespacedKV
+	folder  string
+	history *transferHistory
 }
 
 type LastFile struct {
@@ -29,9 +30,11 @@ type LastFile struct {
 
 func NewFolderStatisticsReference(ldb *leveldb.DB, folder string) *FolderStatisticsReference {
 	prefix := string(db.KeyTypeFolderStatistic) + folder
+	ns := db.NewNamespacedKV(ldb, prefix)
 	return &FolderStatisticsReference{
-		ns:     db.NewNamespacedKV(ldb, prefix),
-		folder: folder,
+		ns:      ns,
+		folder:  folder,
+		history: newTransferHistory(ns),
 	}
 }
 
@@ -51,13 +54,31 @@ func (s *FolderStatisticsReference) GetLastFile() LastFile {
 }
 
 func (s *FolderStatisticsReference) ReceivedFile(filename string) {
-	if debug {
+	if debug.On() {
 		l.Debugln("stats.FolderStatisticsReference.ReceivedFile:", s.folder, filename)
 	}
 	s.ns.PutTime("lastFileAt", time.Now())
 	s.ns.PutString("lastFileName", filename)
 }
 
+// AddTransferred adds the size of a file synced into the folder, or of data
+// sent from it, to the current period of the history. It is only kept in
+// memory until StoreHistory is called.
+func (s *FolderStatisticsReference) AddTransferred(in, out int64) {
+	s.history.add(in, out)
+}
+
+// StoreHistory writes the transfers added since the last call to the history
+// in the database.
+func (s *FolderStatisticsReference) StoreHistory() {
+	s.history.store(time.Now())
+}
+
+// GetHistory returns the hourly and daily transfer totals.
+func (s *FolderStatisticsReference) GetHistory() History {
+	return s.history.get(time.Now())
+}
+
 func (s *FolderStatisticsReference) GetStatistics() FolderStatistics {
 	return FolderStatistics{
 		LastFile: s.GetLastFile(),
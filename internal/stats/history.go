@@ -0,0 +1,124 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package stats
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+// The retention policy for the transfer history: hourly totals are kept for
+// a week, daily totals for a year.
+const (
+	HistoryHours = 7 * 24
+	HistoryDays  = 365
+)
+
+// A HistoryPeriod holds the number of bytes transferred in the hour or day
+// starting at Start.
+type HistoryPeriod struct {
+	Start    time.Time `json:"start"`
+	InBytes  int64     `json:"inBytes"`
+	OutBytes int64     `json:"outBytes"`
+}
+
+// The History of transfers of a device or folder, oldest period first.
+// Periods without transfers are left out.
+type History struct {
+	Hourly []HistoryPeriod `json:"hourly"`
+	Daily  []HistoryPeriod `json:"daily"`
+}
+
+// The transferHistory accumulates transfers in memory, to be added to the
+// history stored in the database now and then. The history is small enough
+// to be stored under a single key.
+type transferHistory struct {
+	ns      *db.NamespacedKV
+	mut     sync.Mutex
+	in, out int64 // not yet stored
+}
+
+func newTransferHistory(ns *db.NamespacedKV) *transferHistory {
+	return &transferHistory{
+		ns:  ns,
+		mut: sync.NewMutex(),
+	}
+}
+
+func (h *transferHistory) add(in, out int64) {
+	h.mut.Lock()
+	h.in += in
+	h.out += out
+	h.mut.Unlock()
+}
+
+// store adds the pending transfers to the periods containing the given time,
+// and drops the periods that have passed out of retention.
+func (h *transferHistory) store(now time.Time) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	if h.in == 0 && h.out == 0 {
+		return
+	}
+	hist := h.prunedLocked(now)
+	hist.Hourly = addToPeriod(hist.Hourly, hourStart(now), h.in, h.out)
+	hist.Daily = addToPeriod(hist.Daily, dayStart(now), h.in, h.out)
+	h.in, h.out = 0, 0
+
+	bs, _ := json.Marshal(hist)
+	h.ns.PutBytes("history", bs)
+}
+
+func (h *transferHistory) get(now time.Time) History {
+	h.store(now)
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	return h.prunedLocked(now)
+}
+
+// prunedLocked returns the stored history without the periods that have
+// passed out of retention.
+func (h *transferHistory) prunedLocked(now time.Time) History {
+	var hist History
+	if bs, ok := h.ns.Bytes("history"); ok {
+		json.Unmarshal(bs, &hist)
+	}
+	hist.Hourly = dropBefore(hist.Hourly, hourStart(now).Add(-(HistoryHours-1)*time.Hour))
+	hist.Daily = dropBefore(hist.Daily, dayStart(now).AddDate(0, 0, -(HistoryDays-1)))
+	return hist
+}
+
+func hourStart(t time.Time) time.Time {
+	return t.Truncate(time.Hour)
+}
+
+func dayStart(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+func dropBefore(periods []HistoryPeriod, cutoff time.Time) []HistoryPeriod {
+	for len(periods) > 0 && periods[0].Start.Before(cutoff) {
+		periods = periods[1:]
+	}
+	return periods
+}
+
+// addToPeriod adds the transfers to the period starting at start, which is
+// the last one or a new one.
+func addToPeriod(periods []HistoryPeriod, start time.Time, in, out int64) []HistoryPeriod {
+	if n := len(periods); n > 0 && periods[n-1].Start.Equal(start) {
+		periods[n-1].InBytes += in
+		periods[n-1].OutBytes += out
+		return periods
+	}
+	return append(periods, HistoryPeriod{start, in, out})
+}
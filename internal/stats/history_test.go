@@ -0,0 +1,59 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package stats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestTransferHistory(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTransferHistory(db.NewNamespacedKV(ldb, "test"))
+
+	t0 := time.Date(2015, 6, 1, 10, 15, 0, 0, time.UTC)
+	h.add(100, 10)
+	h.store(t0)
+	h.add(200, 20)
+	h.store(t0.Add(30 * time.Minute))
+	h.add(400, 40)
+
+	hist := h.get(t0.Add(2 * time.Hour))
+	if len(hist.Hourly) != 2 {
+		t.Fatal("Expected two hours, got", hist.Hourly)
+	}
+	if p := hist.Hourly[0]; !p.Start.Equal(t0.Truncate(time.Hour)) || p.InBytes != 300 || p.OutBytes != 30 {
+		t.Error("Unexpected first hour", p)
+	}
+	if p := hist.Hourly[1]; !p.Start.Equal(t0.Add(2*time.Hour).Truncate(time.Hour)) || p.InBytes != 400 {
+		t.Error("Unexpected second hour", p)
+	}
+	if len(hist.Daily) != 1 || hist.Daily[0].InBytes != 700 || hist.Daily[0].OutBytes != 70 {
+		t.Error("Unexpected daily history", hist.Daily)
+	}
+
+	// The history is kept in the database.
+	h = newTransferHistory(db.NewNamespacedKV(ldb, "test"))
+	if hist := h.get(t0.Add(2 * time.Hour)); len(hist.Hourly) != 2 {
+		t.Error("History was not stored", hist)
+	}
+
+	// Hours are dropped after a week, days after a year.
+	if hist := h.get(t0.AddDate(0, 0, 7)); len(hist.Hourly) != 1 || len(hist.Daily) != 1 {
+		t.Error("Expected the first hour to be dropped", hist)
+	}
+	if hist := h.get(t0.AddDate(1, 0, 0)); len(hist.Hourly) != 0 || len(hist.Daily) != 0 {
+		t.Error("Expected everything to be dropped", hist)
+	}
+}
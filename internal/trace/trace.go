@@ -0,0 +1,111 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package trace keeps track of the debug facilities of the other packages, so
+// that debug output can be enabled and disabled at runtime rather than only
+// through the STTRACE environment variable.
+package trace
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// A Flag tells whether a debug facility is enabled. It may be checked while
+// being toggled.
+type Flag struct {
+	enabled int32 // accessed atomically
+}
+
+// NewFlag returns a flag, initially enabled or not.
+func NewFlag(enabled bool) *Flag {
+	f := &Flag{}
+	f.Set(enabled)
+	return f
+}
+
+// On returns true if the facility is enabled.
+func (f *Flag) On() bool {
+	return atomic.LoadInt32(&f.enabled) != 0
+}
+
+// Set enables or disables the facility.
+func (f *Flag) Set(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&f.enabled, v)
+}
+
+// A Toggle is what a registered facility is enabled and disabled through. A
+// Flag is one; packages outside this tree, which can't use Flag, provide
+// their own.
+type Toggle interface {
+	On() bool
+	Set(enabled bool)
+}
+
+type facility struct {
+	description string
+	flag        Toggle
+}
+
+var (
+	facilities = make(map[string]facility)
+	mut        sync.Mutex
+)
+
+// Register makes the debug facility with the given name available for
+// toggling. The facility is enabled and disabled by setting the given flag,
+// which the package checks before producing debug output.
+func Register(name, description string, flag Toggle) {
+	mut.Lock()
+	facilities[name] = facility{description, flag}
+	mut.Unlock()
+}
+
+// Facilities returns the descriptions of the registered facilities, by name.
+func Facilities() map[string]string {
+	mut.Lock()
+	defer mut.Unlock()
+
+	res := make(map[string]string, len(facilities))
+	for name, f := range facilities {
+		res[name] = f.description
+	}
+	return res
+}
+
+// Enabled returns the names of the currently enabled facilities, sorted.
+func Enabled() []string {
+	mut.Lock()
+	defer mut.Unlock()
+
+	res := []string{}
+	for name, f := range facilities {
+		if f.flag.On() {
+			res = append(res, name)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Set enables or disables the named facility.
+func Set(name string, enabled bool) error {
+	mut.Lock()
+	defer mut.Unlock()
+
+	f, ok := facilities[name]
+	if !ok {
+		return errors.New("no such debug facility")
+	}
+	f.flag.Set(enabled)
+	return nil
+}
@@ -0,0 +1,46 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package trace
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSet(t *testing.T) {
+	first, second := NewFlag(false), NewFlag(false)
+	Register("first", "The first facility", first)
+	Register("second", "The second facility", second)
+
+	if desc := Facilities()["first"]; desc != "The first facility" {
+		t.Errorf("unexpected description %q", desc)
+	}
+	if enabled := Enabled(); len(enabled) != 0 {
+		t.Errorf("unexpected enabled facilities %v", enabled)
+	}
+
+	if err := Set("second", true); err != nil {
+		t.Fatal(err)
+	}
+	if first.On() || !second.On() {
+		t.Errorf("unexpected flags %v, %v after enabling", first.On(), second.On())
+	}
+	if enabled := Enabled(); !reflect.DeepEqual(enabled, []string{"second"}) {
+		t.Errorf("unexpected enabled facilities %v", enabled)
+	}
+
+	if err := Set("second", false); err != nil {
+		t.Fatal(err)
+	}
+	if second.On() {
+		t.Error("facility not disabled")
+	}
+
+	if err := Set("nonexistent", true); err == nil {
+		t.Error("unexpected nil error for unknown facility")
+	}
+}
@@ -78,6 +78,15 @@ func ToURL(url string) error {
 	}
 }
 
+// Rollback restores the binary saved by the last upgrade.
+func Rollback() error {
+	path, err := osext.Executable()
+	if err != nil {
+		return err
+	}
+	return rollback(path)
+}
+
 type Relation int
 
 const (
@@ -79,10 +79,10 @@ func SelectLatestRelease(version string, rels []Release) (Release, error) {
 			assetName := path.Base(asset.Name)
 			// Check for the architecture
 			expectedRelease := releaseName(rel.Tag)
-			if debug {
+			if debug.On() {
 				l.Debugf("expected release asset %q", expectedRelease)
 			}
-			if debug {
+			if debug.On() {
 				l.Debugln("considering release", assetName)
 			}
 			if strings.HasPrefix(assetName, expectedRelease) {
@@ -96,12 +96,12 @@ func SelectLatestRelease(version string, rels []Release) (Release, error) {
 // Upgrade to the given release, saving the previous binary with a ".old" extension.
 func upgradeTo(binary string, rel Release) error {
 	expectedRelease := releaseName(rel.Tag)
-	if debug {
+	if debug.On() {
 		l.Debugf("expected release asset %q", expectedRelease)
 	}
 	for _, asset := range rel.Assets {
 		assetName := path.Base(asset.Name)
-		if debug {
+		if debug.On() {
 			l.Debugln("considering release", assetName)
 		}
 
@@ -133,8 +133,25 @@ func upgradeToURL(binary string, url string) error {
 	return nil
 }
 
+// Restore the binary saved by the last upgrade, keeping the replaced one
+// with a ".failed" extension.
+func rollback(binary string) error {
+	old := binary + ".old"
+	if _, err := os.Stat(old); err != nil {
+		return err
+	}
+
+	failed := binary + ".failed"
+	os.Remove(failed)
+	err := os.Rename(binary, failed)
+	if err != nil {
+		return err
+	}
+	return os.Rename(old, binary)
+}
+
 func readRelease(dir, url string) (string, error) {
-	if debug {
+	if debug.On() {
 		l.Debugf("loading %q", url)
 	}
 
@@ -182,13 +199,13 @@ fileLoop:
 
 		shortName := path.Base(hdr.Name)
 
-		if debug {
+		if debug.On() {
 			l.Debugf("considering file %q", shortName)
 		}
 
 		switch shortName {
 		case "syncthing":
-			if debug {
+			if debug.On() {
 				l.Debugln("writing and hashing binary")
 			}
 			tempName, actualMD5, err = writeBinary(dir, tr)
@@ -208,7 +225,7 @@ fileLoop:
 			}
 
 			expectedMD5 = strings.TrimSpace(string(bs))
-			if debug {
+			if debug.On() {
 				l.Debugln("expected md5 is", actualMD5)
 			}
 
@@ -250,13 +267,13 @@ fileLoop:
 	for _, file := range archive.File {
 		shortName := path.Base(file.Name)
 
-		if debug {
+		if debug.On() {
 			l.Debugf("considering file %q", shortName)
 		}
 
 		switch shortName {
 		case "syncthing.exe":
-			if debug {
+			if debug.On() {
 				l.Debugln("writing and hashing binary")
 			}
 
@@ -285,7 +302,7 @@ fileLoop:
 			}
 
 			expectedMD5 = strings.TrimSpace(string(bs))
-			if debug {
+			if debug.On() {
 				l.Debugln("expected md5 is", actualMD5)
 			}
 
@@ -339,7 +356,7 @@ func writeBinary(dir string, inFile io.Reader) (filename, md5sum string, err err
 	}
 
 	actualMD5 := fmt.Sprintf("%x", h.Sum(nil))
-	if debug {
+	if debug.On() {
 		l.Debugln("actual md5 is", actualMD5)
 	}
 
@@ -10,7 +10,9 @@ package upgrade
 
 import (
 	"encoding/json"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -94,3 +96,32 @@ func TestErrorRelease(t *testing.T) {
 		t.Error("Should return an error when no release were available")
 	}
 }
+
+func TestRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rollback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	binary := filepath.Join(dir, "syncthing")
+	if err := rollback(binary); err == nil {
+		t.Error("Rollback without a previous binary succeeded")
+	}
+
+	ioutil.WriteFile(binary, []byte("new"), 0755)
+	ioutil.WriteFile(binary+".old", []byte("old"), 0755)
+	if err := rollback(binary); err != nil {
+		t.Fatal(err)
+	}
+
+	if bs, _ := ioutil.ReadFile(binary); string(bs) != "old" {
+		t.Errorf("Binary is %q after rollback, expected the previous one", bs)
+	}
+	if bs, _ := ioutil.ReadFile(binary + ".failed"); string(bs) != "new" {
+		t.Errorf("Failed binary is %q, expected the replaced one", bs)
+	}
+	if _, err := os.Stat(binary + ".old"); !os.IsNotExist(err) {
+		t.Error("Previous binary still present:", err)
+	}
+}
@@ -16,6 +16,10 @@ func upgradeToURL(binary, url string) error {
 	return ErrUpgradeUnsupported
 }
 
+func rollback(binary string) error {
+	return ErrUpgradeUnsupported
+}
+
 func LatestRelease(version string) (Release, error) {
 	return Release{}, ErrUpgradeUnsupported
 }
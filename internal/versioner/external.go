@@ -34,7 +34,7 @@ func NewExternal(folderID, folderPath string, params map[string]string) Versione
 		folderPath: folderPath,
 	}
 
-	if debug {
+	if debug.On() {
 		l.Debugf("instantiated %#v", s)
 	}
 	return s
@@ -45,7 +45,7 @@ func NewExternal(folderID, folderPath string, params map[string]string) Versione
 func (v External) Archive(filePath string) error {
 	_, err := osutil.Lstat(filePath)
 	if os.IsNotExist(err) {
-		if debug {
+		if debug.On() {
 			l.Debugln("not archiving nonexistent file", filePath)
 		}
 		return nil
@@ -53,7 +53,7 @@ func (v External) Archive(filePath string) error {
 		return err
 	}
 
-	if debug {
+	if debug.On() {
 		l.Debugln("archiving", filePath)
 	}
 
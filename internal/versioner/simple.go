@@ -35,7 +35,7 @@ func NewSimple(folderID, folderPath string, params map[string]string) Versioner
 		folderPath: folderPath,
 	}
 
-	if debug {
+	if debug.On() {
 		l.Debugf("instantiated %#v", s)
 	}
 	return s
@@ -46,7 +46,7 @@ func NewSimple(folderID, folderPath string, params map[string]string) Versioner
 func (v Simple) Archive(filePath string) error {
 	fileInfo, err := osutil.Lstat(filePath)
 	if os.IsNotExist(err) {
-		if debug {
+		if debug.On() {
 			l.Debugln("not archiving nonexistent file", filePath)
 		}
 		return nil
@@ -58,7 +58,7 @@ func (v Simple) Archive(filePath string) error {
 	_, err = os.Stat(versionsDir)
 	if err != nil {
 		if os.IsNotExist(err) {
-			if debug {
+			if debug.On() {
 				l.Debugln("creating versions dir", versionsDir)
 			}
 			os.MkdirAll(versionsDir, 0755)
@@ -68,7 +68,7 @@ func (v Simple) Archive(filePath string) error {
 		}
 	}
 
-	if debug {
+	if debug.On() {
 		l.Debugln("archiving", filePath)
 	}
 
@@ -86,7 +86,7 @@ func (v Simple) Archive(filePath string) error {
 
 	ver := taggedFilename(file, fileInfo.ModTime().Format(TimeFormat))
 	dst := filepath.Join(dir, ver)
-	if debug {
+	if debug.On() {
 		l.Debugln("moving to", dst)
 	}
 	err = osutil.Rename(filePath, dst)
@@ -114,7 +114,7 @@ func (v Simple) Archive(filePath string) error {
 
 	if len(versions) > v.keep {
 		for _, toRemove := range versions[:len(versions)-v.keep] {
-			if debug {
+			if debug.On() {
 				l.Debugln("cleaning out", toRemove)
 			}
 			err = os.Remove(toRemove)
@@ -47,12 +47,12 @@ func NewStaggered(folderID, folderPath string, params map[string]string) Version
 	// Use custom path if set, otherwise .stversions in folderPath
 	var versionsDir string
 	if params["versionsPath"] == "" {
-		if debug {
+		if debug.On() {
 			l.Debugln("using default dir .stversions")
 		}
 		versionsDir = filepath.Join(folderPath, ".stversions")
 	} else {
-		if debug {
+		if debug.On() {
 			l.Debugln("using dir", params["versionsPath"])
 		}
 		versionsDir = params["versionsPath"]
@@ -71,7 +71,7 @@ func NewStaggered(folderID, folderPath string, params map[string]string) Version
 		mutex: sync.NewMutex(),
 	}
 
-	if debug {
+	if debug.On() {
 		l.Debugf("instantiated %#v", s)
 	}
 
@@ -86,12 +86,12 @@ func NewStaggered(folderID, folderPath string, params map[string]string) Version
 }
 
 func (v Staggered) clean() {
-	if debug {
+	if debug.On() {
 		l.Debugln("Versioner clean: Waiting for lock on", v.versionsPath)
 	}
 	v.mutex.Lock()
 	defer v.mutex.Unlock()
-	if debug {
+	if debug.On() {
 		l.Debugln("Versioner clean: Cleaning", v.versionsPath)
 	}
 
@@ -144,13 +144,13 @@ func (v Staggered) clean() {
 		}
 
 		if path == v.versionsPath {
-			if debug {
+			if debug.On() {
 				l.Debugln("Cleaner: versions dir is empty, don't delete", path)
 			}
 			continue
 		}
 
-		if debug {
+		if debug.On() {
 			l.Debugln("Cleaner: deleting empty directory", path)
 		}
 		err = os.Remove(path)
@@ -159,13 +159,13 @@ func (v Staggered) clean() {
 		}
 	}
 
-	if debug {
+	if debug.On() {
 		l.Debugln("Cleaner: Finished cleaning", v.versionsPath)
 	}
 }
 
 func (v Staggered) expire(versions []string) {
-	if debug {
+	if debug.On() {
 		l.Debugln("Versioner: Expiring versions", versions)
 	}
 	var prevAge int64
@@ -184,7 +184,7 @@ func (v Staggered) expire(versions []string) {
 
 		versionTime, err := time.Parse(TimeFormat, filenameTag(file))
 		if err != nil {
-			if debug {
+			if debug.On() {
 				l.Debugf("Versioner: file name %q is invalid: %v", file, err)
 			}
 			continue
@@ -193,7 +193,7 @@ func (v Staggered) expire(versions []string) {
 
 		// If the file is older than the max age of the last interval, remove it
 		if lastIntv := v.interval[len(v.interval)-1]; lastIntv.end > 0 && age > lastIntv.end {
-			if debug {
+			if debug.On() {
 				l.Debugln("Versioner: File over maximum age -> delete ", file)
 			}
 			err = os.Remove(file)
@@ -219,7 +219,7 @@ func (v Staggered) expire(versions []string) {
 		}
 
 		if prevAge-age < usedInterval.step {
-			if debug {
+			if debug.On() {
 				l.Debugln("too many files in step -> delete", file)
 			}
 			err = os.Remove(file)
@@ -236,7 +236,7 @@ func (v Staggered) expire(versions []string) {
 // Archive moves the named file away to a version archive. If this function
 // returns nil, the named file does not exist any more (has been archived).
 func (v Staggered) Archive(filePath string) error {
-	if debug {
+	if debug.On() {
 		l.Debugln("Waiting for lock on ", v.versionsPath)
 	}
 	v.mutex.Lock()
@@ -244,7 +244,7 @@ func (v Staggered) Archive(filePath string) error {
 
 	_, err := osutil.Lstat(filePath)
 	if os.IsNotExist(err) {
-		if debug {
+		if debug.On() {
 			l.Debugln("not archiving nonexistent file", filePath)
 		}
 		return nil
@@ -254,7 +254,7 @@ func (v Staggered) Archive(filePath string) error {
 
 	if _, err := os.Stat(v.versionsPath); err != nil {
 		if os.IsNotExist(err) {
-			if debug {
+			if debug.On() {
 				l.Debugln("creating versions dir", v.versionsPath)
 			}
 			os.MkdirAll(v.versionsPath, 0755)
@@ -264,7 +264,7 @@ func (v Staggered) Archive(filePath string) error {
 		}
 	}
 
-	if debug {
+	if debug.On() {
 		l.Debugln("archiving", filePath)
 	}
 
@@ -282,7 +282,7 @@ func (v Staggered) Archive(filePath string) error {
 
 	ver := taggedFilename(file, time.Now().Format(TimeFormat))
 	dst := filepath.Join(dir, ver)
-	if debug {
+	if debug.On() {
 		l.Debugln("moving to", dst)
 	}
 	err = osutil.Rename(filePath, dst)
@@ -0,0 +1,123 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build integration
+
+package integration
+
+import (
+	"log"
+	"testing"
+	"time"
+)
+
+// The fault tests sync a set of files from h1 to h2 while the instances
+// inject faults, as configured by the STFAULTS environment variable, and
+// verify that they converge nonetheless. Dropped and truncated connections
+// are reestablished after the reconnection interval; failed writes are
+// retried on the next puller iteration.
+
+const faultsTimeout = 5 * time.Minute
+
+func TestFaultsConnectionDrops(t *testing.T) {
+	testFaults(t, "drop=0.002", "drop=0.002")
+}
+
+func TestFaultsTruncatedMessages(t *testing.T) {
+	testFaults(t, "truncate=0.002", "truncate=0.002")
+}
+
+func TestFaultsDelayedResponses(t *testing.T) {
+	testFaults(t, "delay=250ms", "delay=250ms")
+}
+
+func TestFaultsDiskFull(t *testing.T) {
+	testFaults(t, "", "diskfull=0.05")
+}
+
+func TestFaultsCombined(t *testing.T) {
+	testFaults(t, "drop=0.001,truncate=0.001,delay=50ms", "drop=0.001,delay=50ms,diskfull=0.02")
+}
+
+func testFaults(t *testing.T, senderFaults, receiverFaults string) {
+	log.Println("Cleaning...")
+	err := removeAll("s1", "s2", "h1/index*", "h2/index*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log.Println("Generating files...")
+	err = generateFiles("s1", 200, 20, "../LICENSE")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log.Printf("Starting up (sender faults %q, receiver faults %q)...", senderFaults, receiverFaults)
+	sender := syncthingProcess{ // id1
+		instance: "1",
+		argv:     []string{"-home", "h1"},
+		port:     8081,
+		apiKey:   apiKey,
+		faults:   senderFaults,
+	}
+	err = sender.start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver := syncthingProcess{ // id2
+		instance: "2",
+		argv:     []string{"-home", "h2"},
+		port:     8082,
+		apiKey:   apiKey,
+		faults:   receiverFaults,
+	}
+	err = receiver.start()
+	if err != nil {
+		sender.stop()
+		t.Fatal(err)
+	}
+
+	log.Println("Awaiting convergence...")
+	err = awaitSync(faultsTimeout, sender, receiver)
+	if err != nil {
+		sender.stop()
+		receiver.stop()
+		t.Fatal(err)
+	}
+
+	_, err = sender.stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = receiver.stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log.Println("Comparing directories...")
+	err = compareDirectories("s1", "s2")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// awaitSync waits for all the given devices to be in sync with each other,
+// returning the last error seen if that doesn't happen within the timeout.
+func awaitSync(timeout time.Duration, ps ...syncthingProcess) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		time.Sleep(time.Second)
+
+		err := allDevicesInSync(ps)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+	}
+}
@@ -40,6 +40,7 @@ type syncthingProcess struct {
 	csrfToken string
 	lastEvent int
 	id        protocol.DeviceID
+	faults    string // STFAULTS value; see faults_test.go
 
 	cmd   *exec.Cmd
 	logfd *os.File
@@ -71,6 +72,9 @@ func (p *syncthingProcess) start() error {
 	cmd.Stdout = p.logfd
 	cmd.Stderr = p.logfd
 	cmd.Env = append(os.Environ(), env...)
+	if p.faults != "" {
+		cmd.Env = append(cmd.Env, "STFAULTS="+p.faults)
+	}
 
 	err := cmd.Start()
 	if err != nil {